@@ -0,0 +1,91 @@
+package armor
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"sync/atomic"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// ABChain splits traffic between two plugin chains, e.g. to roll out a
+	// new casbin policy gradually. Routing is deterministic on `Key`, so a
+	// client keeps using the same chain.
+	ABChain struct {
+		ChainA *PluginChain
+		ChainB *PluginChain
+
+		// WeightB is the fraction of traffic, from 0 to 1, sent to chain B.
+		WeightB float64
+
+		// StickyHeader is a request header which, if present, always selects
+		// chain B.
+		StickyHeader string
+
+		// Key returns the request attribute to route on, default the client
+		// IP, read from X-Forwarded-For of TrustedProxies only, e.g. of
+		// `util.ParseIPNets`, so clients cannot pick their chain.
+		Key            func(c echo.Context) string
+		TrustedProxies util.IPNets
+
+		hitsA uint64
+		hitsB uint64
+	}
+
+	// ABResults holds the number of requests routed to each chain.
+	ABResults struct {
+		A uint64 `json:"a"`
+		B uint64 `json:"b"`
+	}
+)
+
+// useB reports whether the request is routed to chain B.
+func (ab *ABChain) useB(c echo.Context) bool {
+	if ab.StickyHeader != "" && c.Request().Header.Get(ab.StickyHeader) != "" {
+		return true
+	}
+	if ab.WeightB <= 0 {
+		return false
+	}
+	if ab.WeightB >= 1 {
+		return true
+	}
+	var key string
+	if ab.Key != nil {
+		key = ab.Key(c)
+	} else {
+		key = plugin.RemoteIP(c.Request(), ab.TrustedProxies)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return float64(binary.BigEndian.Uint64(sum[:8]))/math.MaxUint64 < ab.WeightB
+}
+
+// Process applies chain A or B.
+func (ab *ABChain) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	a, b := ab.ChainA.Process(next), ab.ChainB.Process(next)
+	return func(c echo.Context) error {
+		if ab.useB(c) {
+			atomic.AddUint64(&ab.hitsB, 1)
+			return b(c)
+		}
+		atomic.AddUint64(&ab.hitsA, 1)
+		return a(c)
+	}
+}
+
+// Middleware returns the A/B chain as a single middleware.
+func (ab *ABChain) Middleware() echo.MiddlewareFunc {
+	return ab.Process
+}
+
+// Results returns the number of requests routed to each chain so far.
+func (ab *ABChain) Results() ABResults {
+	return ABResults{
+		A: atomic.LoadUint64(&ab.hitsA),
+		B: atomic.LoadUint64(&ab.hitsB),
+	}
+}
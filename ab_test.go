@@ -0,0 +1,68 @@
+package armor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestABChain(t *testing.T) {
+	ab := &ABChain{
+		ChainA:       &PluginChain{plugins: []plugin.Plugin{Middleware("a", 1)(headerMiddleware("a"))}},
+		ChainB:       &PluginChain{plugins: []plugin.Plugin{Middleware("b", 1)(headerMiddleware("b"))}},
+		WeightB:      0.05,
+		StickyHeader: "X-Canary",
+	}
+	e := echo.New()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+	h := ab.Process(ok)
+	serve := func(ip string, header http.Header) string {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		assert.NoError(t, h(e.NewContext(req, rec)))
+		return rec.Header().Get("X-Middleware")
+	}
+
+	// Split, 10000 requests, B expected 500 with a standard deviation of ~22
+	for i := 0; i < 10000; i++ {
+		serve(fmt.Sprintf("10.0.%d.%d", i/256, i%256), nil)
+	}
+	r := ab.Results()
+	assert.Equal(t, uint64(10000), r.A+r.B)
+	assert.InDelta(t, 500, r.B, 100)
+
+	// Deterministic
+	first := serve("10.1.0.1", nil)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, serve("10.1.0.1", nil))
+	}
+
+	// X-Forwarded-For of the trusted proxies only
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, serve("10.1.0.1", http.Header{echo.HeaderXForwardedFor: {fmt.Sprintf("10.3.0.%d", i)}}))
+	}
+	ab.TrustedProxies, _ = util.ParseIPNets([]string{"10.1.0.0/16"})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, serve(fmt.Sprintf("10.4.0.%d", i), nil), serve("10.1.0.1", http.Header{echo.HeaderXForwardedFor: {fmt.Sprintf("10.4.0.%d", i)}}))
+	}
+	ab.TrustedProxies = nil
+
+	// Sticky
+	ab.WeightB = 0
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "b", serve(fmt.Sprintf("10.2.0.%d", i), http.Header{"X-Canary": {"1"}}))
+		assert.Equal(t, "a", serve(fmt.Sprintf("10.2.0.%d", i), nil))
+	}
+}
@@ -0,0 +1,358 @@
+package armor
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/armor/dns"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type (
+	// dnsManager issues and renews the certificates of the hosts with the
+	// ACME DNS-01 challenge, wildcard ones included.
+	dnsManager struct {
+		mutex      sync.Mutex
+		regMutex   sync.Mutex
+		client     *acme.Client
+		email      string
+		provider   dns.Provider
+		timeout    time.Duration
+		cache      autocert.Cache
+		domains    map[string]bool
+		logger     *log.Logger
+		registered bool
+		certs      map[string]*tls.Certificate
+		issuing    map[string]*issuing
+		retry      map[string]time.Time
+	}
+
+	issuing struct {
+		done chan struct{}
+		cert *tls.Certificate
+		err  error
+	}
+)
+
+const (
+	// Certificates are renewed 30 days before they expire
+	renewBefore = 30 * 24 * time.Hour
+
+	// Time to issue a certificate
+	issueTimeout = 5 * time.Minute
+
+	// Delay before a failed issuance is retried
+	issueRetryDelay = time.Minute
+
+	// Same account key as autocert
+	accountKey = "acme_account+key"
+)
+
+func (a *Armor) newDNSManager(cache autocert.Cache) (*dnsManager, error) {
+	p, err := dns.New(a.TLS.DNS)
+	if err != nil {
+		return nil, err
+	}
+	m := &dnsManager{
+		client:   &acme.Client{DirectoryURL: a.TLS.DirectoryURL},
+		email:    a.TLS.Email,
+		provider: p,
+		timeout:  a.TLS.DNS.Timeout(),
+		cache:    cache,
+		domains:  map[string]bool{},
+		logger:   a.Logger,
+		certs:    map[string]*tls.Certificate{},
+		issuing:  map[string]*issuing{},
+		retry:    map[string]time.Time{},
+	}
+	if m.client.DirectoryURL == "" {
+		m.client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	for host := range a.Hosts {
+		m.domains[strings.ToLower(host)] = true
+	}
+	for _, d := range a.TLS.Domains {
+		m.domains[strings.ToLower(d)] = true
+	}
+	return m, nil
+}
+
+// domain returns the configured domain of the certificate of name, the name
+// itself or a wildcard of its parent.
+func (m *dnsManager) domain(name string) string {
+	if m.domains[name] {
+		return name
+	}
+	if i := strings.Index(name, "."); i > 0 && m.domains["*"+name[i:]] {
+		return "*" + name[i:]
+	}
+	return ""
+}
+
+// GetCertificate returns the certificate of the hello server name, issued on
+// the first handshake and renewed in the background.
+func (m *dnsManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if name == "" {
+		return nil, errors.New("acme/dns: missing server name")
+	}
+	domain := m.domain(name)
+	if domain == "" {
+		return nil, fmt.Errorf("acme/dns: host %s not configured", name)
+	}
+
+	m.mutex.Lock()
+	cert := m.certs[domain]
+	m.mutex.Unlock()
+	if cert == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), issueTimeout)
+		defer cancel()
+		if cert = m.load(ctx, domain); cert == nil {
+			if !m.retryDue(domain) {
+				return nil, fmt.Errorf("acme/dns: domain=%s, issuance failed, retrying later", domain)
+			}
+			return m.obtain(domain)
+		}
+		m.mutex.Lock()
+		m.certs[domain] = cert
+		m.mutex.Unlock()
+	}
+	if time.Until(cert.Leaf.NotAfter) < renewBefore && m.retryDue(domain) {
+		go m.obtain(domain)
+	}
+	return cert, nil
+}
+
+// obtain issues the certificate of domain once for concurrent callers.
+func (m *dnsManager) obtain(domain string) (*tls.Certificate, error) {
+	m.mutex.Lock()
+	i, ok := m.issuing[domain]
+	if !ok {
+		i = &issuing{done: make(chan struct{})}
+		m.issuing[domain] = i
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), issueTimeout)
+			defer cancel()
+			i.cert, i.err = m.issue(ctx, domain)
+			m.mutex.Lock()
+			if i.err == nil {
+				m.certs[domain] = i.cert
+			} else {
+				m.retry[domain] = time.Now().Add(issueRetryDelay)
+			}
+			delete(m.issuing, domain)
+			m.mutex.Unlock()
+			if i.err != nil {
+				m.logger.Errorf("acme/dns: domain=%s, error=%v", domain, i.err)
+			}
+			close(i.done)
+		}()
+	}
+	m.mutex.Unlock()
+	<-i.done
+	return i.cert, i.err
+}
+
+// retryDue returns whether the issuance of domain may be attempted, not
+// failed a moment ago.
+func (m *dnsManager) retryDue(domain string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return time.Now().After(m.retry[domain])
+}
+
+// register registers the account, once.
+func (m *dnsManager) register(ctx context.Context) error {
+	m.regMutex.Lock()
+	defer m.regMutex.Unlock()
+	if m.registered {
+		return nil
+	}
+	if m.client.Key == nil {
+		key, err := m.accountKey(ctx)
+		if err != nil {
+			return err
+		}
+		m.client.Key = key
+	}
+	account := new(acme.Account)
+	if m.email != "" {
+		account.Contact = []string{"mailto:" + m.email}
+	}
+	if _, err := m.client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+	m.registered = true
+	return nil
+}
+
+func (m *dnsManager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	if data, err := m.cache.Get(ctx, accountKey); err == nil {
+		if b, _ := pem.Decode(data); b != nil {
+			return x509.ParseECPrivateKey(b.Bytes)
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, m.cache.Put(ctx, accountKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// issue orders the certificate of domain and solves its DNS-01 challenges.
+func (m *dnsManager) issue(ctx context.Context, domain string) (*tls.Certificate, error) {
+	if err := m.register(ctx); err != nil {
+		return nil, err
+	}
+	o, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range o.AuthzURLs {
+		if err = m.authorize(ctx, u); err != nil {
+			return nil, err
+		}
+	}
+	if o, err = m.client.WaitOrder(ctx, o.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cached with the same format as autocert
+	buf := new(bytes.Buffer)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pem.Encode(buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range chain {
+		pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
+	if err = m.cache.Put(ctx, cacheKey(domain), buf.Bytes()); err != nil {
+		m.logger.Warnf("acme/dns: domain=%s, cache error=%v", domain, err)
+	}
+	m.logger.Infof("acme/dns: certificate issued for %s", domain)
+	return parseCertificate(buf.Bytes())
+}
+
+// authorize solves the DNS-01 challenge of the authorization at url.
+func (m *dnsManager) authorize(ctx context.Context, url string) error {
+	z, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if z.Status != acme.StatusPending {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no dns-01 challenge for %s", z.Identifier.Value)
+	}
+	value, err := m.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	// The identifier of a wildcard is its parent
+	fqdn := "_acme-challenge." + z.Identifier.Value
+	if err = m.provider.Present(ctx, fqdn, value); err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.provider.CleanUp(context.Background(), fqdn, value); err != nil {
+			m.logger.Warnf("acme/dns: record=%s, cleanup error=%v", fqdn, err)
+		}
+	}()
+	if !dns.Wait(ctx, fqdn, value, m.timeout) {
+		m.logger.Warnf("acme/dns: record=%s not visible after %v", fqdn, m.timeout)
+	}
+	if _, err = m.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = m.client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// load returns the cached certificate of domain, nil without.
+func (m *dnsManager) load(ctx context.Context, domain string) *tls.Certificate {
+	data, err := m.cache.Get(ctx, cacheKey(domain))
+	if err != nil {
+		return nil
+	}
+	cert, err := parseCertificate(data)
+	if err != nil || time.Now().After(cert.Leaf.NotAfter) {
+		return nil
+	}
+	return cert
+}
+
+// cacheKey returns the cache key of domain, `*` is not valid in file names
+// on every system.
+func cacheKey(domain string) string {
+	return strings.Replace(domain, "*", "_", 1) + "+dns01"
+}
+
+// parseCertificate parses a PEM private key followed by the certificate
+// chain.
+func parseCertificate(data []byte) (*tls.Certificate, error) {
+	b, rest := pem.Decode(data)
+	if b == nil || !strings.Contains(b.Type, "PRIVATE") {
+		return nil, errors.New("acme/dns: no private key")
+	}
+	key, err := x509.ParseECPrivateKey(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{PrivateKey: key}
+	for {
+		if b, rest = pem.Decode(rest); b == nil {
+			break
+		}
+		cert.Certificate = append(cert.Certificate, b.Bytes)
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("acme/dns: no certificate")
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
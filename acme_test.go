@@ -0,0 +1,74 @@
+package armor
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/labstack/armor/dns"
+	"github.com/labstack/gommon/log"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestDNSManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	cache := autocert.DirCache(dir)
+
+	// Cached wildcard certificate
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "*.example.com"},
+		DNSNames:     []string{"*.example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	kder, _ := x509.MarshalECPrivateKey(key)
+	buf := new(bytes.Buffer)
+	pem.Encode(buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	assert.NoError(t, cache.Put(context.Background(), cacheKey("*.example.com"), buf.Bytes()))
+
+	a := &Armor{
+		Logger: log.New("armor"),
+		Hosts:  Hosts{"api.labstack.com": &Host{}},
+		TLS: &TLS{
+			Domains: []string{"*.example.com"},
+			DNS:     &dns.Config{Provider: dns.Cloudflare, APIToken: "secret"},
+		},
+	}
+	m, err := a.newDNSManager(cache)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "api.labstack.com", m.domain("api.labstack.com"))
+	assert.Equal(t, "*.example.com", m.domain("www.example.com"))
+	assert.Equal(t, "", m.domain("a.b.example.com"))
+	assert.Equal(t, "", m.domain("example.com"))
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, der, cert.Certificate[0])
+	}
+	_, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "labstack.com"})
+	assert.Error(t, err)
+}
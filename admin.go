@@ -0,0 +1,499 @@
+package armor
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	echomw "github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type (
+	// UserCacheInvalidator is implemented by plugins caching results per
+	// user, e.g. casbin decisions of `Cas`.
+	UserCacheInvalidator interface {
+		InvalidateUserCache(username string) int
+	}
+
+	// Reloader is implemented by plugins reloading external config on
+	// demand, e.g. the casbin policy of `Cas`.
+	Reloader interface {
+		Reload() error
+	}
+
+	// TargetHealthReporter is implemented by plugins with health checked
+	// upstream targets, e.g. `Proxy`.
+	TargetHealthReporter interface {
+		TargetHealth() []plugin.TargetHealth
+	}
+
+	// CachePurger is implemented by plugins caching responses, e.g. `Cache`.
+	CachePurger interface {
+		Purge(key string, prefix bool) (int, error)
+	}
+
+	// MaintenanceToggler is implemented by plugins with a maintenance mode,
+	// e.g. `Maintenance`.
+	MaintenanceToggler interface {
+		SetMaintenance(enabled bool)
+		InMaintenance() bool
+	}
+
+	// AdminMaintenance is the maintenance mode of a level.
+	AdminMaintenance struct {
+		Host    string `json:"host,omitempty"`
+		Path    string `json:"path,omitempty"`
+		Enabled bool   `json:"enabled"`
+	}
+
+	// AdminSnapshot is the state of the attached plugin chain at a point in
+	// time.
+	AdminSnapshot struct {
+		Time    time.Time           `json:"time"`
+		Version string              `json:"version"`
+		Plugins []plugin.PluginInfo `json:"plugins"`
+		Config  []plugin.RawPlugin  `json:"config"`
+		Memory  int64               `json:"memory"`
+	}
+
+	// AdminScope lists the plugins of the global level, empty host and path,
+	// a host or a path of a host.
+	AdminScope struct {
+		Host    string              `json:"host,omitempty"`
+		Path    string              `json:"path,omitempty"`
+		Plugins []plugin.PluginInfo `json:"plugins"`
+	}
+
+	// AdminPluginConfig is the config of a plugin and the level it is
+	// configured at.
+	AdminPluginConfig struct {
+		Host   string           `json:"host,omitempty"`
+		Path   string           `json:"path,omitempty"`
+		Config plugin.RawPlugin `json:"config"`
+	}
+
+	// pluginScope is the plugins of a level.
+	pluginScope struct {
+		host, path string
+		plugins    []plugin.Plugin
+	}
+)
+
+// Attach sets the plugin chain served by the admin endpoints.
+func (a *Admin) Attach(chain *PluginChain) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.chain = chain
+}
+
+// AttachArmor sets the armor whose global, host and path plugins are served
+// by the admin endpoints, besides the attached chain.
+func (a *Admin) AttachArmor(armor *Armor) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.armor = armor
+}
+
+func (a *Admin) attached() *PluginChain {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.chain
+}
+
+func (a *Admin) attachedArmor() *Armor {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.armor
+}
+
+// scopes returns the global level, the plugins of the chain and the global
+// plugins of the armor, then the hosts and paths of the armor by name.
+func (a *Admin) scopes() []pluginScope {
+	global := pluginScope{}
+	if chain := a.attached(); chain != nil {
+		global.plugins = chain.Plugins()
+	}
+	armor := a.attachedArmor()
+	if armor == nil {
+		return []pluginScope{global}
+	}
+	armor.mutex.RLock()
+	global.plugins = append(global.plugins, armor.Plugins...)
+	hosts := make([]*Host, 0, len(armor.Hosts))
+	for _, h := range armor.Hosts {
+		hosts = append(hosts, h)
+	}
+	armor.mutex.RUnlock()
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Name < hosts[j].Name
+	})
+	scopes := []pluginScope{global}
+	for _, h := range hosts {
+		h.mutex.RLock()
+		scopes = append(scopes, pluginScope{host: h.Name, plugins: append([]plugin.Plugin(nil), h.Plugins...)})
+		paths := make([]*Path, 0, len(h.Paths))
+		for _, p := range h.Paths {
+			paths = append(paths, p)
+		}
+		h.mutex.RUnlock()
+		sort.Slice(paths, func(i, j int) bool {
+			return paths[i].Name < paths[j].Name
+		})
+		for _, p := range paths {
+			p.mutex.RLock()
+			scopes = append(scopes, pluginScope{host: h.Name, path: p.Name, plugins: append([]plugin.Plugin(nil), p.Plugins...)})
+			p.mutex.RUnlock()
+		}
+	}
+	return scopes
+}
+
+// allPlugins returns the plugins of all levels.
+func (a *Admin) allPlugins() []plugin.Plugin {
+	plugins := []plugin.Plugin{}
+	for _, s := range a.scopes() {
+		plugins = append(plugins, s.plugins...)
+	}
+	return plugins
+}
+
+// effectiveScopes returns the levels applying to requests to the `host` and
+// `path` query params, from the global level to the path.
+func (a *Admin) effectiveScopes(c echo.Context) ([]pluginScope, error) {
+	host, path := c.QueryParam("host"), c.QueryParam("path")
+	if host == "" && path != "" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "path requires a host")
+	}
+	scopes := []pluginScope{}
+	found := host == ""
+	for _, s := range a.scopes() {
+		if s.host == "" || s.host == host && (s.path == "" || s.path == path) {
+			scopes = append(scopes, s)
+			found = found || s.host == host && s.path == path
+		}
+	}
+	if !found {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("host=%s, path=%s not found", host, path))
+	}
+	return scopes, nil
+}
+
+// Start starts the admin server on `Address` in the background, separate
+// from the main server. All endpoints require `AuthToken` as bearer token.
+func (a *Admin) Start() error {
+	if a.AuthToken == "" {
+		return errors.New("admin auth token is required")
+	}
+	var (
+		ln  net.Listener
+		err error
+	)
+	if armor := a.attachedArmor(); armor != nil {
+		ln, err = armor.Listen(a.Address)
+	} else {
+		ln, err = net.Listen("tcp", a.Address)
+	}
+	if err != nil {
+		return err
+	}
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Listener = ln
+	e.Use(echomw.KeyAuth(func(key string, _ echo.Context) (bool, error) {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(a.AuthToken)) == 1, nil
+	}))
+	e.GET("/health", a.health)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	e.GET("/plugins", a.plugins)
+	e.GET("/chain", a.chainOrder)
+	e.GET("/config", a.config)
+	e.GET("/snapshot", a.snapshot)
+	e.DELETE("/casbin/cache/:username", a.invalidateUserCache)
+	e.POST("/reload", a.reload)
+	e.GET("/proxy/health", a.proxyHealth)
+	e.DELETE("/cache", a.purgeCache)
+	e.GET("/scopes", a.listScopes)
+	e.PUT("/plugins/:name", a.updatePlugin)
+	e.GET("/config/effective", a.effectiveConfig)
+	e.GET("/maintenance", a.maintenance)
+	e.PUT("/maintenance", a.setMaintenance(true))
+	e.DELETE("/maintenance", a.setMaintenance(false))
+
+	a.mutex.Lock()
+	a.echo = e
+	a.mutex.Unlock()
+	go func() {
+		if err := e.Start(""); err != nil && err != http.ErrServerClosed {
+			e.Logger.Error(err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the admin server listens on, nil if not started.
+func (a *Admin) Addr() net.Addr {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a.echo == nil {
+		return nil
+	}
+	return a.echo.Listener.Addr()
+}
+
+// Shutdown gracefully stops the admin server, the main server and the
+// attached chain keep running.
+func (a *Admin) Shutdown(ctx context.Context) error {
+	a.mutex.Lock()
+	e := a.echo
+	a.echo = nil
+	a.mutex.Unlock()
+	if e == nil {
+		return nil
+	}
+	return e.Shutdown(ctx)
+}
+
+func (a *Admin) health(c echo.Context) error {
+	if a.attached() == nil && a.attachedArmor() == nil {
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{"status": "no chain attached"})
+	}
+	return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+}
+
+func (a *Admin) plugins(c echo.Context) error {
+	infos := []plugin.PluginInfo{}
+	if chain := a.attached(); chain != nil {
+		for _, p := range chain.Plugins() {
+			infos = append(infos, plugin.Describe(p))
+		}
+	}
+	return c.JSON(http.StatusOK, infos)
+}
+
+func (a *Admin) chainOrder(c echo.Context) error {
+	names := []string{}
+	if chain := a.attached(); chain != nil {
+		for _, p := range chain.Plugins() {
+			names = append(names, p.Name())
+		}
+	}
+	return c.JSON(http.StatusOK, names)
+}
+
+func (a *Admin) rawConfig() []plugin.RawPlugin {
+	config := []plugin.RawPlugin{}
+	if chain := a.attached(); chain != nil {
+		for _, p := range chain.Plugins() {
+			if rp := plugin.RedactedConfig(p); rp != nil {
+				config = append(config, rp)
+			}
+		}
+	}
+	return config
+}
+
+func (a *Admin) config(c echo.Context) error {
+	return c.JSON(http.StatusOK, a.rawConfig())
+}
+
+func (a *Admin) snapshot(c echo.Context) error {
+	s := &AdminSnapshot{
+		Time:    time.Now(),
+		Version: Version,
+		Plugins: []plugin.PluginInfo{},
+		Config:  a.rawConfig(),
+	}
+	if chain := a.attached(); chain != nil {
+		plugins := chain.Plugins()
+		for _, p := range plugins {
+			s.Plugins = append(s.Plugins, plugin.Describe(p))
+		}
+		s.Memory = EstimateTotalMemory(plugins)
+	}
+	return c.JSON(http.StatusOK, s)
+}
+
+func (a *Admin) invalidateUserCache(c echo.Context) error {
+	evicted := 0
+	for _, p := range a.allPlugins() {
+		if i, ok := p.(UserCacheInvalidator); ok {
+			evicted += i.InvalidateUserCache(c.Param("username"))
+		}
+	}
+	return c.JSON(http.StatusOK, echo.Map{"evicted": evicted})
+}
+
+func (a *Admin) reload(c echo.Context) error {
+	reloaded := []string{}
+	for _, p := range a.allPlugins() {
+		if r, ok := p.(Reloader); ok {
+			if err := r.Reload(); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("plugin=%s, %v", p.Name(), err))
+			}
+			reloaded = append(reloaded, p.Name())
+		}
+	}
+	return c.JSON(http.StatusOK, echo.Map{"reloaded": reloaded})
+}
+
+func (a *Admin) proxyHealth(c echo.Context) error {
+	health := []echo.Map{}
+	for _, p := range a.allPlugins() {
+		if r, ok := p.(TargetHealthReporter); ok {
+			if targets := r.TargetHealth(); targets != nil {
+				health = append(health, echo.Map{"plugin": p.Name(), "targets": targets})
+			}
+		}
+	}
+	return c.JSON(http.StatusOK, health)
+}
+
+// purgeCache purges the responses cached for the `key` query param, the host
+// and request URI, or all keys starting with `prefix`.
+func (a *Admin) purgeCache(c echo.Context) error {
+	key, prefix := c.QueryParam("key"), false
+	if key == "" {
+		key, prefix = c.QueryParam("prefix"), true
+	}
+	if key == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "key or prefix is required")
+	}
+	purged := 0
+	for _, p := range a.allPlugins() {
+		if cp, ok := p.(CachePurger); ok {
+			n, err := cp.Purge(key, prefix)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("plugin=%s, %v", p.Name(), err))
+			}
+			purged += n
+		}
+	}
+	return c.JSON(http.StatusOK, echo.Map{"purged": purged})
+}
+
+func (a *Admin) listScopes(c echo.Context) error {
+	scopes := []AdminScope{}
+	for _, s := range a.scopes() {
+		scope := AdminScope{Host: s.host, Path: s.path, Plugins: []plugin.PluginInfo{}}
+		for _, p := range s.plugins {
+			scope.Plugins = append(scope.Plugins, plugin.Describe(p))
+		}
+		scopes = append(scopes, scope)
+	}
+	return c.JSON(http.StatusOK, scopes)
+}
+
+// updatePlugin updates the plugins named `name` of the level given by the
+// `host` and `path` query params with the config in the body. The config is
+// validated and the plugins keep their order. The secrets read back redacted
+// keep their current values.
+func (a *Admin) updatePlugin(c echo.Context) error {
+	name, host, path := c.Param("name"), c.QueryParam("host"), c.QueryParam("path")
+	plugins := []plugin.Plugin{}
+	for _, s := range a.scopes() {
+		if s.host == host && s.path == path {
+			for _, p := range s.plugins {
+				if p.Name() == name {
+					plugins = append(plugins, p)
+				}
+			}
+		}
+	}
+	if len(plugins) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("plugin=%s not found", name))
+	}
+	rp := plugin.RawPlugin{}
+	if err := c.Bind(&rp); err != nil {
+		return err
+	}
+	if n, ok := rp["name"]; ok && n != name {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("plugin=%s, name=%v does not match", name, n))
+	}
+	rp["name"] = name
+	for _, p := range plugins {
+		r := plugin.RawPlugin(merge(plugin.UnredactedConfig(p, rp), map[string]interface{}{"order": p.Order()}))
+		np, err := buildPlugin(r, nil, nil, nil)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		plugin.Update(p, np)
+		release(np)
+	}
+	return c.JSON(http.StatusOK, plugin.RedactedConfig(plugins[0]))
+}
+
+// effectiveConfig returns the config of the plugins applying to requests to
+// the `host` and `path` query params, the global ones without.
+func (a *Admin) effectiveConfig(c echo.Context) error {
+	scopes, err := a.effectiveScopes(c)
+	if err != nil {
+		return err
+	}
+	config := []AdminPluginConfig{}
+	for _, s := range scopes {
+		for _, p := range s.plugins {
+			if rp := plugin.RedactedConfig(p); rp != nil {
+				config = append(config, AdminPluginConfig{Host: s.host, Path: s.path, Config: rp})
+			}
+		}
+	}
+	return c.JSON(http.StatusOK, config)
+}
+
+// maintenancePlugins returns the maintenance plugins by level, only the ones
+// of the `host` and `path` query params if set.
+func (a *Admin) maintenancePlugins(c echo.Context) ([]pluginScope, []MaintenanceToggler) {
+	params := c.QueryParams()
+	_, hostSet := params["host"]
+	_, pathSet := params["path"]
+	host, path := params.Get("host"), params.Get("path")
+	var (
+		scopes  []pluginScope
+		plugins []MaintenanceToggler
+	)
+	for _, s := range a.scopes() {
+		if hostSet && s.host != host || pathSet && s.path != path {
+			continue
+		}
+		for _, p := range s.plugins {
+			if m, ok := p.(MaintenanceToggler); ok {
+				scopes, plugins = append(scopes, s), append(plugins, m)
+			}
+		}
+	}
+	return scopes, plugins
+}
+
+func (a *Admin) maintenance(c echo.Context) error {
+	scopes, plugins := a.maintenancePlugins(c)
+	states := []AdminMaintenance{}
+	for i, m := range plugins {
+		states = append(states, AdminMaintenance{Host: scopes[i].host, Path: scopes[i].path, Enabled: m.InMaintenance()})
+	}
+	return c.JSON(http.StatusOK, states)
+}
+
+// setMaintenance enables or disables the maintenance mode of the plugins of
+// the `host` and `path` query params, all without, until their `enabled`
+// config changes.
+func (a *Admin) setMaintenance(enabled bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, plugins := a.maintenancePlugins(c)
+		if len(plugins) == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "maintenance plugin not found")
+		}
+		for _, m := range plugins {
+			m.SetMaintenance(enabled)
+		}
+		return a.maintenance(c)
+	}
+}
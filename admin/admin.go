@@ -6,7 +6,8 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
-func loadPlugins(a *armor.Armor) (err error) {
+// LoadPlugins loads the plugins of the store.
+func LoadPlugins(a *armor.Armor) (err error) {
 	plugins, err := a.Store.FindPlugins()
 	if err != nil {
 		return
@@ -28,9 +29,13 @@ func Start(a *armor.Armor) {
 	// 	return usr == "admin" && pwd == "L@B$t@ck0709", nil
 	// }))
 
-	// Load plugins
-	if err := loadPlugins(a); err != nil {
-		a.Logger.Fatal(err)
+	// Authenticated admin server, replacing the API
+	if a.Admin.AuthToken != "" {
+		a.Admin.AttachArmor(a)
+		if err := a.Admin.Start(); err != nil {
+			a.Logger.Fatal(err)
+		}
+		return
 	}
 
 	// API
@@ -51,5 +51,10 @@ func Init(a *armor.Armor, e *echo.Echo) error {
 	// plugins.POST("/targets", h.addProxyTarget)
 	// plugins.DELETE("/targets/:target", h.removeProxyTarget)
 
+	ln, err := a.Listen(a.Admin.Address)
+	if err != nil {
+		return err
+	}
+	e.Listener = ln
 	return e.Start(a.Admin.Address)
 }
@@ -0,0 +1,400 @@
+package armor
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin(t *testing.T) {
+	chain, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginHeader, "set": map[string]interface{}{"X-Name": "armor"}},
+			{"name": plugin.PluginRedirect, "from": "/old", "to": "/new"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	a := &Admin{Address: "127.0.0.1:0"}
+	assert.Error(t, a.Start())
+	a.AuthToken = "secret"
+	if !assert.NoError(t, a.Start()) {
+		return
+	}
+	defer a.Shutdown(context.Background())
+	url := "http://" + a.Addr().String()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func(path, token string, v interface{}) int {
+		req, _ := http.NewRequest(http.MethodGet, url+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer res.Body.Close()
+		if v != nil && res.StatusCode == http.StatusOK {
+			b, _ := ioutil.ReadAll(res.Body)
+			assert.NoError(t, json.Unmarshal(b, v), string(b))
+		}
+		return res.StatusCode
+	}
+
+	// Authentication
+	for _, path := range []string{"/health", "/metrics", "/plugins", "/config", "/chain", "/snapshot"} {
+		assert.Equal(t, http.StatusBadRequest, get(path, "", nil), path)
+		assert.Equal(t, http.StatusUnauthorized, get(path, "wrong", nil), path)
+	}
+
+	// Not attached
+	assert.Equal(t, http.StatusServiceUnavailable, get("/health", "secret", nil))
+
+	a.Attach(chain)
+	assert.Equal(t, http.StatusOK, get("/health", "secret", nil))
+	assert.Equal(t, http.StatusOK, get("/metrics", "secret", nil))
+
+	infos := []plugin.PluginInfo{}
+	assert.Equal(t, http.StatusOK, get("/plugins", "secret", &infos))
+	if assert.Len(t, infos, 2) {
+		assert.Equal(t, "Redirect", infos[0].Type)
+		assert.Equal(t, "Header", infos[1].Type)
+	}
+
+	names := []string{}
+	assert.Equal(t, http.StatusOK, get("/chain", "secret", &names))
+	assert.Equal(t, []string{plugin.PluginRedirect, plugin.PluginHeader}, names)
+
+	config := []map[string]interface{}{}
+	assert.Equal(t, http.StatusOK, get("/config", "secret", &config))
+	if assert.Len(t, config, 2) {
+		assert.Equal(t, "/old", config[0]["from"])
+	}
+
+	snapshot := new(AdminSnapshot)
+	assert.Equal(t, http.StatusOK, get("/snapshot", "secret", snapshot))
+	assert.Equal(t, Version, snapshot.Version)
+	assert.Len(t, snapshot.Plugins, 2)
+	assert.Len(t, snapshot.Config, 2)
+
+	req, _ := http.NewRequest(http.MethodDelete, url+"/casbin/cache/jon", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	if res, err := client.Do(req); assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.JSONEq(t, `{"evicted":0}`, string(b))
+	}
+
+	// Shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, a.Shutdown(ctx))
+	_, err = client.Get(url + "/health")
+	assert.Error(t, err)
+	assert.Nil(t, a.Addr())
+}
+
+func TestAdminRedactedConfig(t *testing.T) {
+	chain, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginJwt, "secret": "jwt-secret"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	a := &Admin{Address: "127.0.0.1:0", AuthToken: "secret"}
+	a.Attach(chain)
+	if !assert.NoError(t, a.Start()) {
+		return
+	}
+	defer a.Shutdown(context.Background())
+	for _, path := range []string{"/config", "/snapshot", "/config/effective"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+a.Addr().String()+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, path)
+		assert.NotContains(t, string(b), "jwt-secret", path)
+		assert.Contains(t, string(b), `"secret":"REDACTED"`, path)
+	}
+
+	// Secrets put back redacted keep their values
+	req, _ := http.NewRequest(http.MethodPut, "http://"+a.Addr().String()+"/plugins/jwt", strings.NewReader(`{"secret":"REDACTED","issuer":"armor"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	raw := plugin.RawConfig(chain.Plugins()[0])
+	assert.Equal(t, "jwt-secret", raw["secret"])
+	assert.Equal(t, "armor", raw["issuer"])
+}
+
+func TestAdminInvalidateUserCache(t *testing.T) {
+	chain, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginCas, "url": "https://cas.labstack.com/cas", "casbin": map[string]interface{}{
+				"model":             "plugin/testdata/casbin_model.conf",
+				"policy":            "plugin/testdata/casbin_policy.csv",
+				"enforce_cache_ttl": "1m",
+			}},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	chain.Replay([]ReplayRequest{
+		{Method: http.MethodGet, Path: "/", Username: "jon"},
+		{Method: http.MethodGet, Path: "/", Username: "joe"},
+	})
+	a := &Admin{Address: "127.0.0.1:0", AuthToken: "secret"}
+	a.Attach(chain)
+	if !assert.NoError(t, a.Start()) {
+		return
+	}
+	defer a.Shutdown(context.Background())
+
+	evict := func(username string) string {
+		req, _ := http.NewRequest(http.MethodDelete, "http://"+a.Addr().String()+"/casbin/cache/"+username, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return string(b)
+	}
+	assert.JSONEq(t, `{"evicted":1}`, evict("jon"))
+	assert.JSONEq(t, `{"evicted":0}`, evict("jon"))
+	assert.JSONEq(t, `{"evicted":1}`, evict("joe"))
+
+	// Reload
+	req, _ := http.NewRequest(http.MethodPost, "http://"+a.Addr().String()+"/reload", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	if res, err := http.DefaultClient.Do(req); assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.JSONEq(t, `{"reloaded":["cas"]}`, string(b))
+	}
+}
+
+func TestAdminProxyHealth(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+	chain, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginProxy, "targets": []interface{}{map[string]interface{}{"url": s.URL}}, "health_check": map[string]interface{}{
+				"path": "/health",
+			}},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer chain.GracefulShutdown(context.Background())
+	a := &Admin{Address: "127.0.0.1:0", AuthToken: "secret"}
+	a.Attach(chain)
+	if !assert.NoError(t, a.Start()) {
+		return
+	}
+	defer a.Shutdown(context.Background())
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+a.Addr().String()+"/proxy/health", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	health := []struct {
+		Plugin  string                `json:"plugin"`
+		Targets []plugin.TargetHealth `json:"targets"`
+	}{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&health))
+	if assert.Len(t, health, 1) && assert.Len(t, health[0].Targets, 1) {
+		assert.Equal(t, plugin.PluginProxy, health[0].Plugin)
+		assert.Equal(t, s.URL, health[0].Targets[0].URL)
+		assert.True(t, health[0].Targets[0].InRotation)
+	}
+}
+
+func TestAdminPurgeCache(t *testing.T) {
+	chain, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginCache},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer chain.GracefulShutdown(context.Background())
+	a := &Admin{Address: "127.0.0.1:0", AuthToken: "secret"}
+	a.Attach(chain)
+	if !assert.NoError(t, a.Start()) {
+		return
+	}
+	defer a.Shutdown(context.Background())
+
+	purge := func(query string) *http.Response {
+		req, _ := http.NewRequest(http.MethodDelete, "http://"+a.Addr().String()+"/cache"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return res
+	}
+	res := purge("")
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = purge("?prefix=example.com/")
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	body := struct {
+		Purged int `json:"purged"`
+	}{-1}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(t, 0, body.Purged)
+}
+
+func TestAdminArmorPlugins(t *testing.T) {
+	a := &Armor{Echo: echo.New(), Hosts: Hosts{}, Port: "8080", TLS: &TLS{Port: "8443"}}
+	decode := func(rp plugin.RawPlugin) plugin.Plugin {
+		p := plugin.Decode(rp, a.Echo, nil)
+		p.Initialize()
+		return p
+	}
+	a.AddPlugin(decode(plugin.RawPlugin{"name": plugin.PluginHeader, "order": 1, "set": map[string]interface{}{"X-Level": "global"}}))
+	host := a.FindHost("example.com", true)
+	host.AddPlugin(decode(plugin.RawPlugin{"name": plugin.PluginHeader, "order": 1, "set": map[string]interface{}{"X-Level": "host"}}))
+	host.FindPath("/api").AddPlugin(decode(plugin.RawPlugin{"name": plugin.PluginBodyLimit, "order": 2, "limit": "1M"}))
+
+	admin := &Admin{Address: "127.0.0.1:0", AuthToken: "secret"}
+	admin.AttachArmor(a)
+	if !assert.NoError(t, admin.Start()) {
+		return
+	}
+	defer admin.Shutdown(context.Background())
+	do := func(method, path, body string, v interface{}) int {
+		req, _ := http.NewRequest(method, "http://"+admin.Addr().String()+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer res.Body.Close()
+		if v != nil && res.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(v))
+		}
+		return res.StatusCode
+	}
+
+	scopes := []AdminScope{}
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/scopes", "", &scopes))
+	if assert.Len(t, scopes, 3) {
+		assert.Equal(t, "", scopes[0].Host)
+		assert.Equal(t, "example.com", scopes[1].Host)
+		assert.Equal(t, "/api", scopes[2].Path)
+		assert.Equal(t, "BodyLimit", scopes[2].Plugins[0].Type)
+	}
+
+	// Update
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPut, "/plugins/cors?host=example.com", `{}`, nil))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/plugins/header?host=example.com", `{"name":"cors"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/plugins/header?host=example.com", `{"set":"invalid"}`, nil))
+	config := plugin.RawPlugin{}
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/plugins/header?host=example.com", `{"set":{"X-Level":"updated"}}`, &config))
+	assert.Equal(t, map[string]interface{}{"X-Level": "updated"}, config["set"])
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "example.com:8080"
+	rec := httptest.NewRecorder()
+	a.Echo.ServeHTTP(rec, req)
+	assert.Equal(t, "updated", rec.Header().Get("X-Level"))
+	assert.Equal(t, 1, host.Plugins[0].Order())
+
+	// Effective config
+	effective := []AdminPluginConfig{}
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/config/effective?host=example.com&path=/api", "", &effective))
+	if assert.Len(t, effective, 3) {
+		assert.Equal(t, "", effective[0].Host)
+		assert.Equal(t, "example.com", effective[1].Host)
+		assert.Equal(t, "/api", effective[2].Path)
+		assert.Equal(t, "1M", effective[2].Config["limit"])
+	}
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/config/effective?host=other.com", "", nil))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/config/effective?path=/api", "", nil))
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	a := &Armor{Echo: echo.New(), Hosts: Hosts{}, Port: "8080", TLS: &TLS{Port: "8443"}}
+	decode := func(rp plugin.RawPlugin) plugin.Plugin {
+		p := plugin.Decode(rp, a.Echo, nil)
+		p.Initialize()
+		return p
+	}
+	a.FindHost("example.com", true).AddPlugin(decode(plugin.RawPlugin{"name": plugin.PluginMaintenance, "order": 1}))
+	a.FindHost("other.com", true).AddPlugin(decode(plugin.RawPlugin{"name": plugin.PluginMaintenance, "order": 1}))
+
+	admin := &Admin{Address: "127.0.0.1:0", AuthToken: "secret"}
+	admin.AttachArmor(a)
+	if !assert.NoError(t, admin.Start()) {
+		return
+	}
+	defer admin.Shutdown(context.Background())
+	do := func(method, path string) (int, []AdminMaintenance) {
+		req, _ := http.NewRequest(method, "http://"+admin.Addr().String()+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		defer res.Body.Close()
+		states := []AdminMaintenance{}
+		if res.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&states))
+		}
+		return res.StatusCode, states
+	}
+	serve := func(host string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		a.Echo.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	code, states := do(http.MethodPut, "/maintenance?host=example.com")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []AdminMaintenance{{Host: "example.com", Enabled: true}}, states)
+	assert.Equal(t, http.StatusServiceUnavailable, serve("example.com:8080"))
+	assert.NotEqual(t, http.StatusServiceUnavailable, serve("other.com:8080"))
+
+	_, states = do(http.MethodGet, "/maintenance")
+	assert.Equal(t, []AdminMaintenance{{Host: "example.com", Enabled: true}, {Host: "other.com"}}, states)
+	_, states = do(http.MethodDelete, "/maintenance")
+	assert.Equal(t, []AdminMaintenance{{Host: "example.com"}, {Host: "other.com"}}, states)
+	assert.NotEqual(t, http.StatusServiceUnavailable, serve("example.com:8080"))
+	code, _ = do(http.MethodPut, "/maintenance?host=missing.com")
+	assert.Equal(t, http.StatusNotFound, code)
+}
@@ -8,6 +8,8 @@ import (
 
 	"github.com/hashicorp/serf/serf"
 
+	"github.com/labstack/armor/backend"
+	"github.com/labstack/armor/dns"
 	"github.com/labstack/armor/plugin"
 	"github.com/labstack/armor/store"
 	"github.com/labstack/armor/util"
@@ -18,42 +20,77 @@ import (
 
 type (
 	Armor struct {
-		mutex         sync.RWMutex
-		Name          string             `json:"name"`
-		Address       string             `json:"address"`
-		Port          string             `json:"-"`
-		TLS           *TLS               `json:"tls"`
-		Admin         *Admin             `json:"admin"`
-		Storm         *Storm             `json:"storm"`
-		Postgres      *Postgres          `json:"postgres"`
-		Cluster       *Cluster           `json:"cluster"`
-		ReadTimeout   time.Duration      `json:"read_timeout"`
-		WriteTimeout  time.Duration      `json:"write_timeout"`
-		RawPlugins    []plugin.RawPlugin `json:"plugins"`
-		Hosts         Hosts              `json:"hosts"`
-		RootDir       string             `json:"-"`
-		Store         store.Store        `json:"-"`
-		Plugins       []plugin.Plugin    `json:"-"`
-		Echo          *echo.Echo         `json:"-"`
-		Logger        *log.Logger        `json:"-"`
-		Colorer       *color.Color       `json:"-"`
-		DefaultConfig bool               `json:"-"`
+		mutex             sync.RWMutex
+		Name              string             `json:"name"`
+		Address           string             `json:"address"`
+		H2C               bool               `json:"h2c"`
+		ProxyProtocol     *ProxyProtocol     `json:"proxy_protocol"`
+		Port              string             `json:"-"`
+		TLS               *TLS               `json:"tls"`
+		Admin             *Admin             `json:"admin"`
+		Metrics           *Metrics           `json:"metrics"`
+		Storm             *Storm             `json:"storm"`
+		Postgres          *Postgres          `json:"postgres"`
+		Cluster           *Cluster           `json:"cluster"`
+		Backend           *backend.Config    `json:"backend"`
+		ReadTimeout       time.Duration      `json:"read_timeout"`
+		WriteTimeout      time.Duration      `json:"write_timeout"`
+		ReadHeaderTimeout time.Duration      `json:"read_header_timeout"`
+		IdleTimeout       time.Duration      `json:"idle_timeout"`
+		MaxHeaderBytes    int                `json:"max_header_bytes"`
+		ShutdownTimeout   time.Duration      `json:"shutdown_timeout"`
+		ReusePort         bool               `json:"reuse_port"`
+		RawPlugins        []plugin.RawPlugin `json:"plugins"`
+		Hosts             Hosts              `json:"hosts"`
+		ErrorPages        ErrorPages         `json:"error_pages"`
+		RootDir           string             `json:"-"`
+		Store             store.Store        `json:"-"`
+		Plugins           []plugin.Plugin    `json:"-"`
+		Echo              *echo.Echo         `json:"-"`
+		Logger            *log.Logger        `json:"-"`
+		Colorer           *color.Color       `json:"-"`
+		DefaultConfig     bool               `json:"-"`
+		errorTemplates    errorTemplates
+		listeners         listenerSet
 	}
 
 	TLS struct {
-		Address      string `json:"address"`
-		Port         string `json:"-"`
-		CertFile     string `json:"cert_file"`
-		KeyFile      string `json:"key_file"`
-		Auto         bool   `json:"auto"`
-		CacheDir     string `json:"cache_dir"`
-		Email        string `json:"email"`
-		DirectoryURL string `json:"directory_url"`
-		Secured      bool   `json:"secured"`
+		Address      string      `json:"address"`
+		Port         string      `json:"-"`
+		CertFile     string      `json:"cert_file"`
+		KeyFile      string      `json:"key_file"`
+		Auto         bool        `json:"auto"`
+		CacheDir     string      `json:"cache_dir"`
+		Email        string      `json:"email"`
+		DirectoryURL string      `json:"directory_url"`
+		Secured      bool        `json:"secured"`
+		Domains      []string    `json:"domains"`
+		DNS          *dns.Config `json:"dns"`
+	}
+
+	// ProxyProtocol accepts the PROXY protocol header, v1 or v2, on the
+	// HTTP and HTTPS listeners, required from the Trusted load balancers,
+	// e.g. `10.0.0.0/8`, which are required. Timeout in seconds reading the
+	// header, default 5.
+	ProxyProtocol struct {
+		Trusted []string      `json:"trusted"`
+		Timeout time.Duration `json:"timeout"`
 	}
 
 	Admin struct {
+		mutex     sync.RWMutex
+		echo      *echo.Echo
+		chain     *PluginChain
+		armor     *Armor
+		Address   string `json:"address"`
+		AuthToken string `json:"auth_token"`
+	}
+
+	// Metrics serves the Prometheus metrics at Path, default `/metrics`, on
+	// Address or, without, on the main server.
+	Metrics struct {
 		Address string `json:"address"`
+		Path    string `json:"path"`
 	}
 
 	Storm struct {
@@ -81,7 +118,25 @@ type (
 		Plugins     []plugin.Plugin    `json:"-"`
 		Group       *echo.Group        `json:"-"`
 		ClientCAs   []string           `json:"client_ca"`
+		TLS         *HostTLS           `json:"tls"`
 		TLSConfig   *tls.Config        `json:"-"`
+		ErrorPages  ErrorPages         `json:"error_pages"`
+	}
+
+	// HostTLS is the TLS policy of a host, on top of the global one.
+	HostTLS struct {
+		// MinVersion is `1.0`, `1.1`, `1.2` or `1.3`.
+		MinVersion string `json:"min_version"`
+
+		// CipherSuites of TLS 1.0 to 1.2, e.g.
+		// `TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256`.
+		CipherSuites []string `json:"cipher_suites"`
+
+		// CurvePreferences, `X25519`, `P256`, `P384` or `P521`.
+		CurvePreferences []string `json:"curve_preferences"`
+
+		// ALPN protocols, e.g. `h2` and `http/1.1`.
+		ALPN []string `json:"alpn"`
 	}
 
 	Path struct {
@@ -98,6 +153,12 @@ type (
 	Paths map[string]*Path
 )
 
+// Timeouts in seconds, not to let slow clients hold the connections
+const (
+	defaultReadHeaderTimeout = 10
+	defaultIdleTimeout       = 120
+)
+
 const (
 	Version = "0.4.14"
 	Website = "https://armor.labstack.com"
@@ -151,19 +212,19 @@ func (a *Armor) AddPlugin(p plugin.Plugin) {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 	if p.Order() < 0 {
-		a.Echo.Pre(p.Process)
+		a.Echo.Pre(mount(p))
 	} else {
-		a.Echo.Use(p.Process)
+		a.Echo.Use(mount(p))
 	}
 	a.Plugins = append(a.Plugins, p)
 }
 
-func (a *Armor) UpdatePlugin(plugin plugin.Plugin) {
+func (a *Armor) UpdatePlugin(np plugin.Plugin) {
 	a.mutex.RLock()
 	defer a.mutex.RUnlock()
 	for _, p := range a.Plugins {
-		if p.Name() == plugin.Name() {
-			p.Update(plugin)
+		if p.Name() == np.Name() {
+			plugin.Update(p, np)
 		}
 	}
 }
@@ -286,33 +347,33 @@ func (h *Host) FindPath(name string) (p *Path) {
 func (h *Host) AddPlugin(p plugin.Plugin) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
-	h.Group.Use(p.Process)
+	h.Group.Use(mount(p))
 	h.Plugins = append(h.Plugins, p)
 }
 
-func (h *Host) UpdatePlugin(plugin plugin.Plugin) {
+func (h *Host) UpdatePlugin(np plugin.Plugin) {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 	for _, p := range h.Plugins {
-		if p.Name() == plugin.Name() {
-			p.Update(plugin)
+		if p.Name() == np.Name() {
+			plugin.Update(p, np)
 		}
 	}
 }
 
-func (p *Path) AddPlugin(plugin plugin.Plugin) {
+func (p *Path) AddPlugin(np plugin.Plugin) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	p.Group.Use(plugin.Process)
-	p.Plugins = append(p.Plugins, plugin)
+	p.Group.Use(mount(np))
+	p.Plugins = append(p.Plugins, np)
 }
 
-func (p *Path) UpdatePlugin(plugin plugin.Plugin) {
+func (p *Path) UpdatePlugin(np plugin.Plugin) {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
 	for _, p := range p.Plugins {
-		if p.Name() == plugin.Name() {
-			p.Update(plugin)
+		if p.Name() == np.Name() {
+			plugin.Update(p, np)
 		}
 	}
 }
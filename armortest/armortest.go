@@ -0,0 +1,227 @@
+// Package armortest provides an armor test server for acceptance tests.
+package armortest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/armor"
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"gopkg.in/cas.v2"
+)
+
+type (
+	// TestServer serves an armor plugin chain, with an optional mock CAS
+	// server, from a local HTTP server. Requests passing through all plugins
+	// are served by `Handler`.
+	TestServer struct {
+		Handler echo.HandlerFunc
+
+		t       *testing.T
+		config  *armor.Config
+		server  *httptest.Server
+		client  *http.Client
+		mutex   sync.RWMutex
+		chain   *armor.PluginChain
+		mockCAS *mockCAS
+	}
+
+	// mockCAS is a CAS server issuing service tickets for its users, the user
+	// logging in is given by the `UserHeader` request header.
+	mockCAS struct {
+		server  *httptest.Server
+		users   map[string]cas.UserAttributes
+		mutex   sync.Mutex
+		tickets map[string]mockTicket
+		count   int
+	}
+
+	mockTicket struct {
+		username string
+		service  string
+	}
+)
+
+// UserHeader is the request header with the username to log in as on the mock
+// CAS server. The client copies it to the CAS login redirect.
+const UserHeader = "X-Mock-CAS-User"
+
+// New starts a test server for the plugin chain built from config, it fails
+// the test if the chain can't be built. Call `Close` when done.
+func New(t *testing.T, config *armor.Config) *TestServer {
+	ts := &TestServer{
+		Handler: func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		},
+		t:      t,
+		config: config,
+	}
+	ts.build()
+	e := echo.New()
+	e.HideBanner = true
+	e.Any("/*", func(c echo.Context) error {
+		ts.mutex.RLock()
+		chain := ts.chain
+		ts.mutex.RUnlock()
+		return chain.Process(func(c echo.Context) error {
+			return ts.Handler(c)
+		})(c)
+	})
+	ts.server = httptest.NewServer(e)
+	jar, _ := cookiejar.New(nil)
+	ts.client = &http.Client{Jar: jar}
+	return ts
+}
+
+func (ts *TestServer) build() {
+	config := *ts.config
+	if ts.mockCAS != nil {
+		config.Plugins = make([]plugin.RawPlugin, len(ts.config.Plugins))
+		for i, rp := range ts.config.Plugins {
+			r := plugin.RawPlugin{}
+			for k, v := range rp {
+				r[k] = v
+			}
+			if r.Name() == plugin.PluginCas {
+				r["url"] = ts.mockCAS.server.URL + "/cas"
+			}
+			config.Plugins[i] = r
+		}
+	}
+	chain, err := armor.Build(&config)
+	if err != nil {
+		ts.t.Fatalf("armortest: failed to build plugin chain: %v", err)
+	}
+	ts.mutex.Lock()
+	ts.chain = chain
+	ts.mutex.Unlock()
+}
+
+// URL returns the base URL of the server.
+func (ts *TestServer) URL() string {
+	return ts.server.URL
+}
+
+// Client returns a client for the server which keeps cookies, e.g. the CAS
+// session, and follows redirects.
+func (ts *TestServer) Client() *http.Client {
+	return ts.client
+}
+
+// InjectMockCAS starts a mock CAS server for users and points the CAS
+// plugins at it.
+func (ts *TestServer) InjectMockCAS(users map[string]cas.UserAttributes) {
+	if ts.mockCAS == nil {
+		m := &mockCAS{tickets: map[string]mockTicket{}}
+		m.server = httptest.NewServer(http.HandlerFunc(m.serveHTTP))
+		ts.mockCAS = m
+	}
+	ts.mockCAS.mutex.Lock()
+	ts.mockCAS.users = users
+	ts.mockCAS.mutex.Unlock()
+	ts.build()
+}
+
+// Ticket issues a service ticket for username and service on the mock CAS
+// server, e.g. to request `service + "?ticket=" + ticket` directly.
+func (ts *TestServer) Ticket(username, service string) string {
+	if ts.mockCAS == nil {
+		ts.t.Fatal("armortest: mock CAS server not injected")
+	}
+	return ts.mockCAS.issue(username, service)
+}
+
+// Close shuts down the server and the mock CAS server.
+func (ts *TestServer) Close() {
+	ts.server.Close()
+	if ts.mockCAS != nil {
+		ts.mockCAS.server.Close()
+	}
+}
+
+func (m *mockCAS) issue(username, service string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.count++
+	b := make([]byte, 10)
+	rand.Read(b)
+	ticket := fmt.Sprintf("ST-%d-%s-mockcas", m.count, hex.EncodeToString(b))
+	m.tickets[ticket] = mockTicket{username: username, service: service}
+	return ticket
+}
+
+// redeem validates a ticket once, it returns the user attributes if valid.
+func (m *mockCAS) redeem(ticket, service string) (string, cas.UserAttributes, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	t, ok := m.tickets[ticket]
+	delete(m.tickets, ticket)
+	if !ok || t.service != service {
+		return "", nil, false
+	}
+	attr, ok := m.users[t.username]
+	return t.username, attr, ok
+}
+
+func (m *mockCAS) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get("service")
+	switch r.URL.Path {
+	case "/cas/login":
+		username := r.Header.Get(UserHeader)
+		m.mutex.Lock()
+		_, ok := m.users[username]
+		m.mutex.Unlock()
+		if !ok {
+			http.Error(w, "unknown user", http.StatusUnauthorized)
+			return
+		}
+		u, err := url.Parse(service)
+		if err != nil {
+			http.Error(w, "invalid service", http.StatusBadRequest)
+			return
+		}
+		q := u.Query()
+		q.Set("ticket", m.issue(username, service))
+		u.RawQuery = q.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	case "/cas/serviceValidate":
+		w.Header().Set("Content-Type", "application/xml")
+		username, attr, ok := m.redeem(r.URL.Query().Get("ticket"), service)
+		if !ok {
+			fmt.Fprint(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+	<cas:authenticationFailure code="INVALID_TICKET">Ticket not recognized</cas:authenticationFailure>
+</cas:serviceResponse>`)
+			return
+		}
+		a := new(strings.Builder)
+		for k, values := range attr {
+			for _, v := range values {
+				fmt.Fprintf(a, "<cas:%s>%s</cas:%s>", k, escape(v), k)
+			}
+		}
+		fmt.Fprintf(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+	<cas:authenticationSuccess>
+		<cas:user>%s</cas:user>
+		<cas:attributes>%s</cas:attributes>
+	</cas:authenticationSuccess>
+</cas:serviceResponse>`, escape(username), a)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func escape(s string) string {
+	b := new(strings.Builder)
+	xml.EscapeText(b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,83 @@
+package armortest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/labstack/armor"
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cas.v2"
+)
+
+func TestCasCasbin(t *testing.T) {
+	ts := New(t, &armor.Config{
+		Plugins: []plugin.RawPlugin{
+			{
+				"name": plugin.PluginCas,
+				"url":  "https://cas.labstack.com/cas",
+				"casbin": map[string]interface{}{
+					"model":  "../plugin/testdata/casbin_model.conf",
+					"policy": "../plugin/testdata/casbin_policy.csv",
+				},
+			},
+		},
+	})
+	defer ts.Close()
+	ts.InjectMockCAS(map[string]cas.UserAttributes{
+		"jon": {"mail": {"jon@labstack.com"}},
+		"joe": {"mail": {"joe@labstack.com"}},
+	})
+	mail := ""
+	ts.Handler = func(c echo.Context) error {
+		mail = c.Request().Header.Get("X-CAS-Attr-mail")
+		return c.String(http.StatusOK, c.Request().Header.Get("X-CAS-User"))
+	}
+
+	// Login, allowed
+	req, _ := http.NewRequest(echo.GET, ts.URL()+"/users", nil)
+	req.Header.Set(UserHeader, "jon")
+	res, err := ts.Client().Do(req)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "jon@labstack.com", mail)
+	}
+
+	// Session
+	res, err = ts.Client().Get(ts.URL() + "/users")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	// Denied by policy
+	res, err = http.Get(ts.URL() + "/users?ticket=" + ts.Ticket("joe", ts.URL()+"/users"))
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	}
+
+	// Ticket is single use
+	ticket := ts.Ticket("jon", ts.URL()+"/users")
+	res, err = http.Get(ts.URL() + "/users?ticket=" + ticket)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	res, err = http.Get(ts.URL() + "/users?ticket=" + ticket)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	}
+
+	// Unknown user
+	req, _ = http.NewRequest(echo.GET, ts.URL()+"/users", nil)
+	req.Header.Set(UserHeader, "jane")
+	res, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	}
+}
@@ -1,75 +1,135 @@
+// Package backend loads the armor config from a config store, etcd, Consul,
+// ZooKeeper or a Kubernetes ConfigMap, and watches it for changes, for a
+// fleet of armor instances to share one config. The Kubernetes Ingress
+// resources are a config too, for armor to run as an Ingress controller.
 package backend
 
 import (
+	"bytes"
 	"fmt"
 	"time"
-
-	"github.com/docker/libkv"
-	"github.com/docker/libkv/store"
-	"github.com/docker/libkv/store/consul"
-	"github.com/docker/libkv/store/etcd"
-	"github.com/docker/libkv/store/zookeeper"
-	"github.com/labstack/gommon/log"
 )
 
-func main() {
-	Start()
-}
+type (
+	// Backend is a config store holding the armor config, YAML or JSON.
+	Backend interface {
+		// Get returns the config.
+		Get() ([]byte, error)
 
-func Start() {
-	// Register
-	consul.Register()
-	etcd.Register()
-	zookeeper.Register()
-
-	client := "localhost:8500"
-
-	// Initialize a new store with consul
-	kv, err := libkv.NewStore(
-		store.CONSUL, // or "consul"
-		[]string{client},
-		&store.Config{
-			ConnectionTimeout: 10 * time.Second,
-		},
-	)
-	if err != nil {
-		log.Fatal("Cannot create store consul")
-	}
+		// Watch sends the config each time it changes until stop is closed.
+		// Lost connections are retried.
+		Watch(stop <-chan struct{}) (<-chan []byte, error)
 
-	key := "armor"
-	err = kv.Put(key, []byte("bar"), &store.WriteOptions{IsDir: true})
-	if err != nil {
-		fmt.Errorf("Something went wrong when initializing key: %v", key)
+		// Close closes the connection to the store.
+		Close()
 	}
 
-	stopCh := make(chan struct{})
-	events, err := kv.WatchTree(key, stopCh)
+	// Config is the config store of a backend.
+	Config struct {
+		// Type is `etcd`, `consul`, `zookeeper`, `kubernetes` or `ingress`.
+		Type string `json:"type"`
 
-	for {
-		select {
-		case pairs := <-events:
-			// Do something with events
-			for _, pair := range pairs {
-				fmt.Printf("value changed on key %v: new value=%s\n", key, pair.Value)
-			}
-		}
+		// Endpoints of the store, e.g. `localhost:2379`. For `kubernetes`
+		// the API server URL, default the one of the cluster armor runs in.
+		Endpoints []string `json:"endpoints"`
+
+		// Key of the config, default `armor/config`. For `kubernetes` the
+		// ConfigMap data key, default `config.yaml`.
+		Key string `json:"key"`
+
+		// Namespace and Name of the ConfigMap, the namespace default the one
+		// of the pod. For `ingress` the namespace of the Ingress resources,
+		// default all.
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+
+		// IngressClass of the Ingress resources routed by armor, default
+		// `armor`.
+		IngressClass string `json:"ingress_class"`
+
+		// Username and Password of etcd, Token of the Kubernetes API server,
+		// default the service account token of the pod.
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Token    string `json:"token"`
+
+		// ConnectionTimeout in seconds, default 10.
+		ConnectionTimeout time.Duration `json:"connection_timeout"`
 	}
+)
+
+const (
+	// Types
+	Etcd       = "etcd"
+	Consul     = "consul"
+	Zookeeper  = "zookeeper"
+	Kubernetes = "kubernetes"
+	Ingress    = "ingress"
 
-	// key := "foo"
-	// err = kv.Put(key, []byte("bar"), nil)
-	// if err != nil {
-	// 	fmt.Errorf("Error trying to put value at key: %v", key)
-	// }
+	// Delays between the retries of a lost watch
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+func (c *Config) key(def string) string {
+	if c.Key == "" {
+		return def
+	}
+	return c.Key
+}
 
-	// pair, err := kv.Get(key)
-	// if err != nil {
-	// 	fmt.Errorf("Error trying accessing value at key: %v", key)
-	// }
+func (c *Config) timeout() time.Duration {
+	if c.ConnectionTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return c.ConnectionTimeout * time.Second
+}
 
-	// err = kv.Delete(key)
-	// if err != nil {
-	// 	fmt.Errorf("Error trying to delete key %v", key)
-	// }
+// New returns the backend of config.
+func New(config *Config) (Backend, error) {
+	switch config.Type {
+	case Etcd, Consul, Zookeeper:
+		return newKV(config)
+	case Kubernetes:
+		return newKubernetes(config)
+	case Ingress:
+		return newIngress(config)
+	}
+	return nil, fmt.Errorf("invalid backend type=%s", config.Type)
+}
 
-	// log.Info("value: ", string(pair.Value))
+// watch sends the values of the watches started by start, retried until stop
+// is closed, skipping the unchanged ones. A watch ends when its channel is
+// closed.
+func watch(last []byte, stop <-chan struct{}, start func(stop <-chan struct{}) (<-chan []byte, error)) <-chan []byte {
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		delay := minRetryDelay
+		for {
+			if ch, err := start(stop); err == nil {
+				for v := range ch {
+					delay = minRetryDelay
+					if bytes.Equal(v, last) {
+						continue
+					}
+					last = v
+					select {
+					case out <- v:
+					case <-stop:
+						return
+					}
+				}
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+	}()
+	return out
 }
@@ -0,0 +1,313 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+type (
+	// ingress is an Ingress controller backend, the config is the hosts and
+	// paths of the Ingress resources of the class, proxied to their
+	// services.
+	ingress struct {
+		*kubernetesAPI
+		namespace string
+		class     string
+	}
+
+	ingressList struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []*ingressResource `json:"items"`
+	}
+
+	ingressResource struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Namespace   string            `json:"namespace"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			IngressClassName string `json:"ingressClassName"`
+			Rules            []struct {
+				Host string `json:"host"`
+				HTTP struct {
+					Paths []struct {
+						Path    string `json:"path"`
+						Backend struct {
+							Service struct {
+								Name string `json:"name"`
+								Port struct {
+									Name   string `json:"name"`
+									Number int    `json:"number"`
+								} `json:"port"`
+							} `json:"service"`
+						} `json:"backend"`
+					} `json:"paths"`
+				} `json:"http"`
+			} `json:"rules"`
+		} `json:"spec"`
+	}
+
+	ingressEvent struct {
+		Type string `json:"type"`
+	}
+
+	// ingressConfig is the armor config of the Ingress resources.
+	ingressConfig struct {
+		Hosts map[string]*ingressHost `json:"hosts"`
+	}
+
+	ingressHost struct {
+		Plugins []map[string]interface{} `json:"plugins,omitempty"`
+		Paths   map[string]*ingressPath  `json:"paths,omitempty"`
+	}
+
+	ingressPath struct {
+		Plugins []map[string]interface{} `json:"plugins"`
+	}
+)
+
+const (
+	// Annotations of the Ingress resources
+	ingressAnnotationCasURL          = "armor.labstack.com/cas-url"
+	ingressAnnotationCasbinModel     = "armor.labstack.com/casbin-model"
+	ingressAnnotationCasbinPolicy    = "armor.labstack.com/casbin-policy"
+	ingressAnnotationPlugins         = "armor.labstack.com/plugins"
+	ingressAnnotationBackendProtocol = "armor.labstack.com/backend-protocol"
+	ingressAnnotationClass           = "kubernetes.io/ingress.class"
+)
+
+func newIngress(config *Config) (*ingress, error) {
+	api, err := newKubernetesAPI(config)
+	if err != nil {
+		return nil, err
+	}
+	b := &ingress{kubernetesAPI: api, namespace: config.Namespace, class: config.IngressClass}
+	if b.class == "" {
+		b.class = "armor"
+	}
+	return b, nil
+}
+
+func (b *ingress) path() string {
+	if b.namespace == "" {
+		return "/apis/networking.k8s.io/v1/ingresses"
+	}
+	return "/apis/networking.k8s.io/v1/namespaces/" + url.PathEscape(b.namespace) + "/ingresses"
+}
+
+func (b *ingress) list() (*ingressList, error) {
+	res, err := b.request(context.Background(), b.path(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("ingresses, %v", err)
+	}
+	defer res.Body.Close()
+	l := new(ingressList)
+	if err = json.NewDecoder(res.Body).Decode(l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// value returns the armor config of the Ingress resources of the class of l,
+// those sorted first win the paths routed by several.
+func (b *ingress) value(l *ingressList) ([]byte, error) {
+	sort.Slice(l.Items, func(i, j int) bool {
+		mi, mj := l.Items[i].Metadata, l.Items[j].Metadata
+		return mi.Namespace < mj.Namespace || mi.Namespace == mj.Namespace && mi.Name < mj.Name
+	})
+	config := &ingressConfig{Hosts: map[string]*ingressHost{}}
+	for _, ing := range l.Items {
+		if ing.Spec.IngressClassName != b.class && ing.Metadata.Annotations[ingressAnnotationClass] != b.class {
+			continue
+		}
+		plugins, err := ing.plugins()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range ing.Spec.Rules {
+			// The default backend, of no host, is not routed
+			if r.Host == "" {
+				continue
+			}
+			h := config.Hosts[r.Host]
+			if h == nil {
+				h = &ingressHost{Paths: map[string]*ingressPath{}}
+				config.Hosts[r.Host] = h
+			}
+			for _, p := range r.HTTP.Paths {
+				target := ing.target(p.Backend.Service.Name, p.Backend.Service.Port.Name, p.Backend.Service.Port.Number)
+				if target == nil {
+					continue
+				}
+				proxy := map[string]interface{}{
+					"name":    "proxy",
+					"targets": []map[string]interface{}{target},
+				}
+				route := append(append([]map[string]interface{}(nil), plugins...), proxy)
+				// Prefix paths, Exact ones too
+				path := strings.TrimSuffix(p.Path, "/")
+				if path == "" {
+					if h.Plugins == nil {
+						h.Plugins = route
+					}
+				} else if h.Paths[path] == nil {
+					h.Paths[path] = &ingressPath{Plugins: route}
+				}
+			}
+		}
+	}
+	for name, h := range config.Hosts {
+		if h.Plugins == nil && len(h.Paths) == 0 {
+			delete(config.Hosts, name)
+		}
+	}
+	return json.Marshal(config)
+}
+
+// plugins returns the plugins of the annotations of ing, before the proxy.
+func (ing *ingressResource) plugins() ([]map[string]interface{}, error) {
+	a := ing.Metadata.Annotations
+	var plugins []map[string]interface{}
+	if u := a[ingressAnnotationCasURL]; u != "" {
+		cas := map[string]interface{}{"name": "cas", "url": u}
+		if a[ingressAnnotationCasbinModel] != "" || a[ingressAnnotationCasbinPolicy] != "" {
+			cas["casbin"] = map[string]interface{}{
+				"model":  a[ingressAnnotationCasbinModel],
+				"policy": a[ingressAnnotationCasbinPolicy],
+			}
+		}
+		plugins = append(plugins, cas)
+	}
+	if v := a[ingressAnnotationPlugins]; v != "" {
+		var raw []map[string]interface{}
+		if err := yaml.Unmarshal([]byte(v), &raw); err != nil {
+			return nil, fmt.Errorf("ingress=%s/%s, invalid annotation %s, %v", ing.Metadata.Namespace, ing.Metadata.Name, ingressAnnotationPlugins, err)
+		}
+		plugins = append(plugins, raw...)
+	}
+	return plugins, nil
+}
+
+// target returns the proxy target of the service port, discovered by the
+// SRV records of a named port.
+func (ing *ingressResource) target(service, port string, number int) map[string]interface{} {
+	if service == "" {
+		return nil
+	}
+	scheme, t := "http", map[string]interface{}{}
+	switch p := ing.Metadata.Annotations[ingressAnnotationBackendProtocol]; p {
+	case "https":
+		scheme = p
+	case "h2c", "grpc":
+		t["protocol"] = p
+	}
+	host := service + "." + ing.Metadata.Namespace + ".svc"
+	switch {
+	case number > 0:
+		t["url"] = scheme + "://" + host + ":" + strconv.Itoa(number)
+	case port != "":
+		t["url"] = scheme + "://_" + port + "._tcp." + host
+		t["discovery"] = "srv"
+	default:
+		return nil
+	}
+	return t
+}
+
+func (b *ingress) Get() ([]byte, error) {
+	l, err := b.list()
+	if err != nil {
+		return nil, err
+	}
+	return b.value(l)
+}
+
+// Watch watches the Ingress resources from the latest list, listed anew on
+// changes.
+func (b *ingress) Watch(stop <-chan struct{}) (<-chan []byte, error) {
+	last, err := b.Get()
+	if err != nil {
+		return nil, err
+	}
+	return watch(last, stop, func(stop <-chan struct{}) (<-chan []byte, error) {
+		l, err := b.list()
+		if err != nil {
+			return nil, err
+		}
+		version := l.Metadata.ResourceVersion
+		v, err := b.value(l)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		res, err := b.request(ctx, b.path(), url.Values{
+			"watch":           {"true"},
+			"resourceVersion": {version},
+		})
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		values := make(chan []byte)
+		go func() {
+			select {
+			case <-stop:
+			case <-ctx.Done():
+			}
+			cancel()
+		}()
+		go func() {
+			defer close(values)
+			defer cancel()
+			defer res.Body.Close()
+			send := func(v []byte) bool {
+				select {
+				case values <- v:
+					return true
+				case <-stop:
+					return false
+				}
+			}
+			if !send(v) {
+				return
+			}
+			dec := json.NewDecoder(res.Body)
+			for {
+				e := new(ingressEvent)
+				if err := dec.Decode(e); err != nil {
+					return
+				}
+				switch e.Type {
+				case "ADDED", "MODIFIED", "DELETED":
+				case "ERROR":
+					// Expired resource version, listed anew
+					return
+				default:
+					continue
+				}
+				l, err := b.list()
+				if err != nil {
+					return
+				}
+				if v, err := b.value(l); err == nil && !send(v) {
+					return
+				}
+			}
+		}()
+		return values, nil
+	}), nil
+}
+
+func (b *ingress) Close() {
+	b.client.CloseIdleConnections()
+}
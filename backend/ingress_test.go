@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testIngresses = `{"metadata":{"resourceVersion":"%d"},"items":[
+{"metadata":{"name":"web","namespace":"shop","annotations":{
+  "armor.labstack.com/cas-url":"https://cas.example.com/cas",
+  "armor.labstack.com/casbin-model":"/etc/armor/model.conf",
+  "armor.labstack.com/casbin-policy":"/etc/armor/policy.csv"}},
+ "spec":{"ingressClassName":"armor","rules":[{"host":"shop.example.com","http":{"paths":[
+  {"path":"/","pathType":"Prefix","backend":{"service":{"name":"web","port":{"number":8080}}}},
+  {"path":"/api/","pathType":"Prefix","backend":{"service":{"name":"api","port":{"name":"http"}}}}]}}]}},
+{"metadata":{"name":"other","namespace":"shop","annotations":{"kubernetes.io/ingress.class":"nginx"}},
+ "spec":{"rules":[{"host":"other.example.com","http":{"paths":[
+  {"path":"/","backend":{"service":{"name":"other","port":{"number":80}}}}]}}]}},
+{"metadata":{"name":"admin","namespace":"shop","annotations":{
+  "kubernetes.io/ingress.class":"armor",
+  "armor.labstack.com/plugins":"- name: ip-filter\n  allow: [10.0.0.0/8]"}},
+ "spec":{"rules":[{"host":"shop.example.com","http":{"paths":[
+  {"path":"/admin","backend":{"service":{"name":"admin","port":{"number":%d}}}}]}}]}}]}`
+
+func TestIngress(t *testing.T) {
+	var version int32 = 1
+	modified := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		if r.URL.Path != "/apis/networking.k8s.io/v1/ingresses" {
+			http.NotFound(w, r)
+			return
+		}
+		v := atomic.LoadInt32(&version)
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprintf(w, testIngresses, v, 8000+v)
+			return
+		}
+		assert.Equal(t, fmt.Sprint(v), r.URL.Query().Get("resourceVersion"))
+		w.(http.Flusher).Flush()
+		for range modified {
+			atomic.AddInt32(&version, 1)
+			fmt.Fprint(w, `{"type":"MODIFIED","object":{}}`+"\n")
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer s.Close()
+
+	b, err := New(&Config{Type: Ingress, Endpoints: []string{s.URL}, Token: "secret"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer b.Close()
+	v, err := b.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var config struct {
+		Hosts map[string]map[string]interface{} `json:"hosts"`
+	}
+	assert.NoError(t, json.Unmarshal(v, &config))
+	assert.NotContains(t, config.Hosts, "other.example.com")
+	host := config.Hosts["shop.example.com"]
+	if !assert.NotNil(t, host) {
+		return
+	}
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "cas", "url": "https://cas.example.com/cas", "casbin": map[string]interface{}{
+			"model": "/etc/armor/model.conf", "policy": "/etc/armor/policy.csv",
+		}},
+		map[string]interface{}{"name": "proxy", "targets": []interface{}{
+			map[string]interface{}{"url": "http://web.shop.svc:8080"},
+		}},
+	}, host["plugins"])
+	paths := host["paths"].(map[string]interface{})
+	api := paths["/api"].(map[string]interface{})["plugins"].([]interface{})
+	assert.Equal(t, map[string]interface{}{"url": "http://_http._tcp.api.shop.svc", "discovery": "srv"},
+		api[1].(map[string]interface{})["targets"].([]interface{})[0])
+	admin := paths["/admin"].(map[string]interface{})["plugins"].([]interface{})
+	assert.Equal(t, "ip-filter", admin[0].(map[string]interface{})["name"])
+	assert.Equal(t, "proxy", admin[1].(map[string]interface{})["name"])
+
+	stop := make(chan struct{})
+	defer close(stop)
+	values, err := b.Watch(stop)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Listed anew on changes
+	modified <- struct{}{}
+	select {
+	case v := <-values:
+		assert.Contains(t, string(v), "http://admin.shop.svc:8002")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change")
+	}
+	close(modified)
+}
@@ -0,0 +1,239 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type (
+	// kubernetes is a ConfigMap backend, read and watched with the API
+	// server.
+	kubernetes struct {
+		*kubernetesAPI
+		namespace string
+		name      string
+		key       string
+	}
+
+	// kubernetesAPI is a client of the API server.
+	kubernetesAPI struct {
+		client *http.Client
+		url    string
+		token  string
+	}
+
+	configMap struct {
+		Metadata struct {
+			Name            string `json:"name"`
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Data map[string]string `json:"data"`
+	}
+
+	configMapEvent struct {
+		Type   string          `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+)
+
+// Service account of the pod
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func newKubernetes(config *Config) (*kubernetes, error) {
+	b := &kubernetes{
+		namespace: config.Namespace,
+		name:      config.Name,
+		key:       config.key("config.yaml"),
+	}
+	if b.name == "" {
+		return nil, errors.New("kubernetes backend requires a configmap name")
+	}
+	api, err := newKubernetesAPI(config)
+	if err != nil {
+		return nil, err
+	}
+	b.kubernetesAPI = api
+	if b.namespace == "" {
+		ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, errors.New("kubernetes backend requires a namespace outside of a cluster")
+		}
+		b.namespace = strings.TrimSpace(string(ns))
+	}
+	return b, nil
+}
+
+// newKubernetesAPI returns the client of the API server of config, by default
+// the one of the cluster armor runs in with the service account of the pod.
+func newKubernetesAPI(config *Config) (*kubernetesAPI, error) {
+	b := &kubernetesAPI{token: config.Token}
+	transport := &http.Transport{
+		Proxy:       http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{Timeout: config.timeout()}).DialContext,
+	}
+	if len(config.Endpoints) > 0 {
+		b.url = strings.TrimSuffix(config.Endpoints[0], "/")
+	} else {
+		// In cluster
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("%s backend requires an endpoint outside of a cluster", config.Type)
+		}
+		b.url = "https://" + net.JoinHostPort(host, port)
+		ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if b.token == "" {
+		if t, err := ioutil.ReadFile(serviceAccountDir + "/token"); err == nil {
+			b.token = strings.TrimSpace(string(t))
+		}
+	}
+	b.client = &http.Client{Transport: transport}
+	return b, nil
+}
+
+// request returns the response of a GET of path, an error if not 200.
+func (a *kubernetesAPI) request(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := a.url + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	res, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errors.New(res.Status)
+	}
+	return res, nil
+}
+
+func (b *kubernetes) do(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	res, err := b.request(ctx, "/api/v1/namespaces/"+url.PathEscape(b.namespace)+"/configmaps"+path, query)
+	if err != nil {
+		return nil, fmt.Errorf("configmap=%s/%s, %v", b.namespace, b.name, err)
+	}
+	return res, nil
+}
+
+func (b *kubernetes) get() (*configMap, error) {
+	res, err := b.do(context.Background(), "/"+url.PathEscape(b.name), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	cm := new(configMap)
+	if err = json.NewDecoder(res.Body).Decode(cm); err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
+
+func (b *kubernetes) value(cm *configMap) ([]byte, error) {
+	v, ok := cm.Data[b.key]
+	if !ok {
+		return nil, fmt.Errorf("configmap=%s/%s, key=%s not found", b.namespace, b.name, b.key)
+	}
+	return []byte(v), nil
+}
+
+func (b *kubernetes) Get() ([]byte, error) {
+	cm, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+	return b.value(cm)
+}
+
+func (b *kubernetes) Watch(stop <-chan struct{}) (<-chan []byte, error) {
+	cm, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+	last, err := b.value(cm)
+	if err != nil {
+		return nil, err
+	}
+	version := cm.Metadata.ResourceVersion
+	return watch(last, stop, func(stop <-chan struct{}) (<-chan []byte, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		res, err := b.do(ctx, "", url.Values{
+			"watch":           {"true"},
+			"fieldSelector":   {"metadata.name=" + b.name},
+			"resourceVersion": {version},
+		})
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		values := make(chan []byte)
+		go func() {
+			select {
+			case <-stop:
+			case <-ctx.Done():
+			}
+			cancel()
+		}()
+		go func() {
+			defer close(values)
+			defer cancel()
+			defer res.Body.Close()
+			dec := json.NewDecoder(res.Body)
+			for {
+				e := new(configMapEvent)
+				if err := dec.Decode(e); err != nil {
+					return
+				}
+				switch e.Type {
+				case "ADDED", "MODIFIED":
+				case "ERROR":
+					// Expired resource version, watch from the current one
+					version = ""
+					return
+				default:
+					continue
+				}
+				cm := new(configMap)
+				if err := json.Unmarshal(e.Object, cm); err != nil {
+					return
+				}
+				version = cm.Metadata.ResourceVersion
+				if v, err := b.value(cm); err == nil {
+					select {
+					case values <- v:
+					case <-stop:
+						return
+					}
+				}
+			}
+		}()
+		return values, nil
+	}), nil
+}
+
+func (b *kubernetes) Close() {
+	b.client.CloseIdleConnections()
+}
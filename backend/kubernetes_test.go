@@ -0,0 +1,74 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKubernetes(t *testing.T) {
+	modified := make(chan string)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/api/v1/namespaces/edge/configmaps/armor":
+			fmt.Fprint(w, `{"metadata":{"name":"armor","resourceVersion":"1"},"data":{"config.yaml":"address: :8080"}}`)
+		case "/api/v1/namespaces/edge/configmaps":
+			assert.Equal(t, "true", r.URL.Query().Get("watch"))
+			assert.Equal(t, "metadata.name=armor", r.URL.Query().Get("fieldSelector"))
+			assert.Equal(t, "1", r.URL.Query().Get("resourceVersion"))
+			w.(http.Flusher).Flush()
+			for v := range modified {
+				fmt.Fprintf(w, `{"type":"MODIFIED","object":{"metadata":{"name":"armor","resourceVersion":"2"},"data":{"config.yaml":%q}}}`+"\n", v)
+				w.(http.Flusher).Flush()
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	b, err := New(&Config{Type: Kubernetes, Endpoints: []string{s.URL}, Namespace: "edge", Name: "armor", Token: "secret"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer b.Close()
+	v, err := b.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "address: :8080", string(v))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	values, err := b.Watch(stop)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Unchanged values are skipped
+	modified <- "address: :8080"
+	modified <- "address: :8081"
+	select {
+	case v := <-values:
+		assert.Equal(t, "address: :8081", string(v))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change")
+	}
+	close(modified)
+
+	// Missing key
+	b, _ = New(&Config{Type: Kubernetes, Endpoints: []string{s.URL}, Namespace: "edge", Name: "armor", Token: "secret", Key: "armor.yaml"})
+	_, err = b.Get()
+	assert.Error(t, err)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(&Config{Type: "vault"})
+	assert.Error(t, err)
+	_, err = New(&Config{Type: Etcd})
+	assert.Error(t, err)
+	_, err = New(&Config{Type: Kubernetes, Endpoints: []string{"http://localhost:8001"}})
+	assert.Error(t, err)
+}
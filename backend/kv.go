@@ -0,0 +1,84 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/libkv"
+	"github.com/docker/libkv/store"
+	"github.com/docker/libkv/store/consul"
+	"github.com/docker/libkv/store/etcd"
+	"github.com/docker/libkv/store/zookeeper"
+)
+
+type (
+	// kv is a key-value store backend, etcd with the v2 API, Consul or
+	// ZooKeeper.
+	kv struct {
+		store store.Store
+		key   string
+	}
+)
+
+func init() {
+	consul.Register()
+	etcd.Register()
+	zookeeper.Register()
+}
+
+func newKV(config *Config) (*kv, error) {
+	backends := map[string]store.Backend{
+		Etcd:      store.ETCD,
+		Consul:    store.CONSUL,
+		Zookeeper: store.ZK,
+	}
+	if len(config.Endpoints) == 0 {
+		return nil, fmt.Errorf("%s backend requires endpoints", config.Type)
+	}
+	s, err := libkv.NewStore(backends[config.Type], config.Endpoints, &store.Config{
+		ConnectionTimeout: config.timeout(),
+		Username:          config.Username,
+		Password:          config.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &kv{store: s, key: strings.TrimPrefix(config.key("armor/config"), "/")}, nil
+}
+
+func (b *kv) Get() ([]byte, error) {
+	pair, err := b.store.Get(b.key)
+	if err != nil {
+		return nil, fmt.Errorf("key=%s, %v", b.key, err)
+	}
+	return pair.Value, nil
+}
+
+func (b *kv) Watch(stop <-chan struct{}) (<-chan []byte, error) {
+	last, err := b.Get()
+	if err != nil {
+		return nil, err
+	}
+	return watch(last, stop, func(stop <-chan struct{}) (<-chan []byte, error) {
+		pairs, err := b.store.Watch(b.key, stop)
+		if err != nil {
+			return nil, err
+		}
+		values := make(chan []byte)
+		go func() {
+			defer close(values)
+			for pair := range pairs {
+				select {
+				case values <- pair.Value:
+				case <-stop:
+					return
+				}
+			}
+		}()
+		return values, nil
+	}), nil
+}
+
+func (b *kv) Close() {
+	b.store.Close()
+}
@@ -0,0 +1,55 @@
+package backend
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsul(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/armor/config" {
+			http.NotFound(w, r)
+			return
+		}
+		index, value := 1, "address: :8080"
+		if i := r.URL.Query().Get("index"); i != "" {
+			if i == "2" {
+				// Blocking query, unchanged
+				time.Sleep(100 * time.Millisecond)
+			}
+			index, value = 2, "address: :8081"
+		}
+		w.Header().Set("X-Consul-Index", fmt.Sprint(index))
+		fmt.Fprintf(w, `[{"Key":"armor/config","ModifyIndex":%d,"Value":%q}]`, index, base64.StdEncoding.EncodeToString([]byte(value)))
+	}))
+	defer s.Close()
+
+	b, err := New(&Config{Type: Consul, Endpoints: []string{strings.TrimPrefix(s.URL, "http://")}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer b.Close()
+	v, err := b.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "address: :8080", string(v))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	values, err := b.Watch(stop)
+	if !assert.NoError(t, err) {
+		return
+	}
+	select {
+	case v := <-values:
+		assert.Equal(t, "address: :8081", string(v))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change")
+	}
+}
@@ -0,0 +1,94 @@
+package armor
+
+import (
+	"fmt"
+
+	"github.com/labstack/armor/plugin"
+)
+
+type (
+	// Builder assembles a plugin chain from typed plugin configs, e.g.
+	// `armor.New().WithCAS(cas).WithCasbin(casbin).WithOrder(plugin.PluginCas, -1).Build()`.
+	Builder struct {
+		specs  []pluginSpec
+		casbin *plugin.CasbinConfig
+		probe  plugin.ProbeFunc
+		errs   Errors
+	}
+)
+
+// New returns an empty plugin chain builder.
+func New() *Builder {
+	return new(Builder)
+}
+
+// WithPlugin adds a plugin from its raw config.
+func (b *Builder) WithPlugin(rp plugin.RawPlugin) *Builder {
+	b.specs = append(b.specs, pluginSpec{raw: rp})
+	return b
+}
+
+// WithCAS adds the CAS plugin.
+func (b *Builder) WithCAS(config plugin.CasConfig) *Builder {
+	b.specs = append(b.specs, pluginSpec{
+		raw: plugin.RawPlugin{"name": plugin.PluginCas},
+		configure: func(p plugin.Plugin) {
+			c := p.(*plugin.Cas)
+			c.CasConfig = config
+			if b.casbin != nil {
+				c.CasbinCfg = *b.casbin
+			}
+		},
+	})
+	return b
+}
+
+// WithCasbin enables casbin authorization on the CAS plugin added with
+// `WithCAS`.
+func (b *Builder) WithCasbin(config plugin.CasbinConfig) *Builder {
+	b.casbin = &config
+	return b
+}
+
+// WithProbe sets the probe resolving config values, see `Config.Probe`.
+func (b *Builder) WithProbe(probe plugin.ProbeFunc) *Builder {
+	b.probe = probe
+	return b
+}
+
+// WithOrder sets the order of the plugins added so far with the given name.
+func (b *Builder) WithOrder(name string, order int) *Builder {
+	found := false
+	for i, s := range b.specs {
+		if s.raw.Name() != name {
+			continue
+		}
+		found = true
+		rp := plugin.RawPlugin{}
+		for k, v := range s.raw {
+			rp[k] = v
+		}
+		rp["order"] = order
+		b.specs[i].raw = rp
+	}
+	if !found {
+		b.errs = append(b.errs, fmt.Errorf("plugin=%s, error=not found to set order", name))
+	}
+	return b
+}
+
+// Build validates, initializes and assembles the plugins into a chain. All
+// errors are returned together as `Errors`.
+func (b *Builder) Build() (*PluginChain, error) {
+	errs := append(Errors{}, b.errs...)
+	if b.casbin != nil {
+		found := false
+		for _, s := range b.specs {
+			found = found || s.raw.Name() == plugin.PluginCas
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("plugin=%s, error=casbin requires WithCAS", plugin.PluginCas))
+		}
+	}
+	return build(b.specs, b.probe, errs)
+}
@@ -0,0 +1,67 @@
+package armor
+
+import (
+	"testing"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuilder(t *testing.T) {
+	casbin := plugin.CasbinConfig{
+		Model:  "plugin/testdata/casbin_model.conf",
+		Policy: "plugin/testdata/casbin_policy.csv",
+	}
+	header := plugin.RawPlugin{"name": plugin.PluginHeader, "set": map[string]interface{}{"X-Name": "armor"}}
+	chain, err := New().
+		WithPlugin(header).
+		WithCAS(plugin.CasConfig{URL: "https://cas.labstack.com/cas"}).
+		WithCasbin(casbin).
+		WithOrder(plugin.PluginCas, -1).
+		Build()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Manual
+	manual, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			header,
+			{
+				"name":  plugin.PluginCas,
+				"order": -1,
+				"url":   "https://cas.labstack.com/cas",
+				"casbin": map[string]interface{}{
+					"model":  casbin.Model,
+					"policy": casbin.Policy,
+				},
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	plugins, manualPlugins := chain.Plugins(), manual.Plugins()
+	if assert.Len(t, plugins, len(manualPlugins)) {
+		for i, p := range plugins {
+			assert.Equal(t, manualPlugins[i].Name(), p.Name())
+			assert.Equal(t, manualPlugins[i].Order(), p.Order())
+		}
+		assert.Equal(t, manualPlugins[0].(*plugin.Cas).CasConfig, plugins[0].(*plugin.Cas).CasConfig)
+		assert.Equal(t, manualPlugins[1].(*plugin.Header).HeaderConfig, plugins[1].(*plugin.Header).HeaderConfig)
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	_, err := New().
+		WithCAS(plugin.CasConfig{URL: "cas"}).
+		WithCasbin(plugin.CasbinConfig{Model: "unknown.conf"}).
+		WithOrder(plugin.PluginGzip, 1).
+		Build()
+	if assert.IsType(t, Errors{}, err) {
+		assert.Len(t, err.(Errors), 2)
+	}
+
+	_, err = New().WithCasbin(plugin.CasbinConfig{}).Build()
+	assert.Error(t, err)
+}
@@ -0,0 +1,249 @@
+package armor
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+type (
+	// certStore serves the certificates loaded from files, reloaded when the
+	// files change, e.g. renewed by cert-manager or certbot, and stapled with
+	// an OCSP response refreshed in the background.
+	certStore struct {
+		mutex  sync.RWMutex
+		files  []*certFile
+		names  map[string]*tls.Certificate
+		client *http.Client
+		logger *log.Logger
+	}
+
+	certFile struct {
+		certFile string
+		keyFile  string
+		modTime  time.Time
+		cert     *tls.Certificate
+		nextOCSP time.Time
+	}
+)
+
+const (
+	// Interval of the checks of the files and the OCSP responses. The files
+	// are polled, Kubernetes secrets are replaced with symlinks.
+	certCheckInterval = 10 * time.Second
+
+	// Delay before a failed OCSP request is retried
+	ocspRetryDelay = time.Hour
+)
+
+func newCertStore(logger *log.Logger) *certStore {
+	return &certStore{
+		names:  map[string]*tls.Certificate{},
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+	}
+}
+
+// add loads the certificate of the cert and key files.
+func (s *certStore) add(cert, key string) error {
+	f := &certFile{certFile: cert, keyFile: key}
+	if err := s.load(f); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.files = append(s.files, f)
+	s.mutex.Unlock()
+	s.staple(f)
+	s.index()
+	return nil
+}
+
+// load loads the files of f if they changed.
+func (s *certStore) load(f *certFile) error {
+	modTime, err := latestModTime(f.certFile, f.keyFile)
+	if err != nil {
+		return err
+	}
+	if modTime.Equal(f.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	f.cert, f.modTime, f.nextOCSP = &cert, modTime, time.Time{}
+	s.mutex.Unlock()
+	return nil
+}
+
+func latestModTime(files ...string) (t time.Time, err error) {
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return
+}
+
+// staple fetches the OCSP response of the certificate of f when due.
+func (s *certStore) staple(f *certFile) {
+	s.mutex.RLock()
+	cert, next := f.cert, f.nextOCSP
+	s.mutex.RUnlock()
+	now := time.Now()
+	if now.Before(next) || len(cert.Leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+		return
+	}
+	staple, next, err := s.fetchOCSP(cert)
+	if err != nil {
+		s.logger.Warnf("ocsp: cert=%s, error=%v", f.certFile, err)
+		next = now.Add(ocspRetryDelay)
+	}
+
+	// Copied, the served certificate is read without a lock
+	c := *cert
+	if staple != nil {
+		c.OCSPStaple = staple
+	} else if r, err := ocsp.ParseResponse(c.OCSPStaple, nil); err != nil || now.After(r.NextUpdate) {
+		c.OCSPStaple = nil
+	}
+	s.mutex.Lock()
+	if f.cert == cert {
+		f.cert, f.nextOCSP = &c, next
+	}
+	s.mutex.Unlock()
+}
+
+// fetchOCSP returns the OCSP response of cert and when to refresh it, half
+// way to its expiry.
+func (s *certStore) fetchOCSP(cert *tls.Certificate) ([]byte, time.Time, error) {
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	res, err := s.client.Post(cert.Leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("responder=%s, %s", cert.Leaf.OCSPServer[0], res.Status)
+	}
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	r, err := ocsp.ParseResponseForCert(raw, cert.Leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if r.Status != ocsp.Good {
+		return nil, time.Time{}, fmt.Errorf("certificate status=%d", r.Status)
+	}
+	next := time.Now().Add(12 * time.Hour)
+	if !r.NextUpdate.IsZero() {
+		next = r.ThisUpdate.Add(r.NextUpdate.Sub(r.ThisUpdate) / 2)
+	}
+	if min := time.Now().Add(time.Minute); next.Before(min) {
+		next = min
+	}
+	return raw, next, nil
+}
+
+// index maps the names of the certificates to them, the last one wins, the
+// same as `tls.Config.BuildNameToCertificate`.
+func (s *certStore) index() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	names := map[string]*tls.Certificate{}
+	for _, f := range s.files {
+		if f.cert.Leaf.Subject.CommonName != "" {
+			names[f.cert.Leaf.Subject.CommonName] = f.cert
+		}
+		for _, n := range f.cert.Leaf.DNSNames {
+			names[n] = f.cert
+		}
+	}
+	s.names = names
+}
+
+// check reloads the changed files and refreshes the due OCSP responses.
+func (s *certStore) check() {
+	s.mutex.RLock()
+	files := append([]*certFile(nil), s.files...)
+	s.mutex.RUnlock()
+	for _, f := range files {
+		s.mutex.RLock()
+		modTime := f.modTime
+		s.mutex.RUnlock()
+		if err := s.load(f); err != nil {
+			// Retried, e.g. the key is not written yet
+			s.logger.Errorf("tls: cert=%s, reload error=%v", f.certFile, err)
+		} else if !modTime.Equal(f.modTime) {
+			s.logger.Infof("tls: cert=%s reloaded", f.certFile)
+		}
+		s.staple(f)
+	}
+	s.index()
+}
+
+// watch checks the certificates until stop is closed.
+func (s *certStore) watch(stop <-chan struct{}) {
+	t := time.NewTicker(certCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			s.check()
+		}
+	}
+}
+
+// get returns the certificate of name, nil without.
+func (s *certStore) get(name string) *tls.Certificate {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	name = strings.ToLower(name)
+	if cert, ok := s.names[name]; ok {
+		return cert
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		return s.names["*"+name[i:]]
+	}
+	return nil
+}
+
+// fallback returns the first certificate, served to the clients without a
+// matching server name.
+func (s *certStore) fallback() *tls.Certificate {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.files) == 0 {
+		return nil
+	}
+	return s.files[0].cert
+}
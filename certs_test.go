@@ -0,0 +1,112 @@
+package armor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// CA and OCSP responder
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDER)
+	requests := 0
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		b, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(b)
+		if !assert.NoError(t, err) {
+			return
+		}
+		res, _ := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now(),
+			NextUpdate:   time.Now().Add(24 * time.Hour),
+		}, caKey)
+		w.Write(res)
+	}))
+	defer responder.Close()
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	write := func(serial int64, names ...string) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, _ := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			DNSNames:     names,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			OCSPServer:   []string{responder.URL},
+		}, ca, &key.PublicKey, caKey)
+		kder, _ := x509.MarshalECPrivateKey(key)
+		chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+		assert.NoError(t, ioutil.WriteFile(certFile, chain, 0600))
+		assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600))
+		// Modified later than the last write
+		mt := time.Now().Add(time.Duration(serial) * time.Second)
+		os.Chtimes(certFile, mt, mt)
+		os.Chtimes(keyFile, mt, mt)
+	}
+
+	write(2, "*.labstack.com")
+	s := newCertStore(log.New("armor"))
+	if !assert.NoError(t, s.add(certFile, keyFile)) {
+		return
+	}
+	cert := s.get("www.labstack.com")
+	if assert.NotNil(t, cert) {
+		assert.Equal(t, int64(2), cert.Leaf.SerialNumber.Int64())
+		r, err := ocsp.ParseResponse(cert.OCSPStaple, ca)
+		if assert.NoError(t, err) {
+			assert.Equal(t, ocsp.Good, r.Status)
+		}
+	}
+	assert.Nil(t, s.get("labstack.io"))
+	assert.Equal(t, cert, s.fallback())
+
+	// Not due
+	s.check()
+	assert.Equal(t, 1, requests)
+
+	// Renewed
+	write(3, "*.labstack.com", "labstack.io")
+	s.check()
+	cert = s.get("labstack.io")
+	if assert.NotNil(t, cert) {
+		assert.Equal(t, int64(3), cert.Leaf.SerialNumber.Int64())
+		assert.NotEmpty(t, cert.OCSPStaple)
+	}
+	assert.Equal(t, 2, requests)
+}
@@ -0,0 +1,235 @@
+package armor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+//go:generate go run ./cmd/gen-schema -o schema/armor-config.schema.json
+
+type (
+	// Config defines the plugins assembled into a standalone plugin chain.
+	Config struct {
+		Plugins []plugin.RawPlugin `json:"plugins"`
+
+		// Templates holds shared plugin settings which plugins pull in by
+		// name with `inherits`.
+		Templates map[string]plugin.RawPlugin `json:"templates"`
+
+		// Probe resolves the config values of plugins implementing
+		// `ConfigProber`.
+		Probe plugin.ProbeFunc `json:"-"`
+	}
+
+	// PluginChain applies a list of plugins, sorted by order, as a single unit.
+	PluginChain struct {
+		mutex        sync.RWMutex
+		plugins      []plugin.Plugin
+		byName       *PluginMap
+		interceptors []Interceptor
+
+		// GlobalConcurrencyLimits limits the concurrent requests through the
+		// plugins of a type, by plugin name, e.g. `"ldap": 20`. The limit is
+		// shared by all instances in the chain.
+		GlobalConcurrencyLimits map[string]int
+		semaphoreMutex          sync.Mutex
+		semaphores              map[string]chan struct{}
+	}
+
+	// Errors collects the errors from building a plugin chain.
+	Errors []error
+
+	// pluginSpec is a raw plugin to build, configure optionally sets typed
+	// config on the decoded plugin.
+	pluginSpec struct {
+		raw       plugin.RawPlugin
+		configure func(plugin.Plugin)
+	}
+)
+
+func (e Errors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// Build decodes and initializes the plugins from config and assembles them
+// into a chain. All plugin errors are returned together as `Errors`.
+func Build(config *Config) (*PluginChain, error) {
+	specs := []pluginSpec{}
+	errs := Errors{}
+	for _, rp := range config.Plugins {
+		rp, err := inherit(rp, config.Templates, nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		specs = append(specs, pluginSpec{raw: rp})
+	}
+	return build(specs, config.Probe, errs)
+}
+
+// build assembles the plugin specs into a chain, errs holds the errors so far.
+func build(specs []pluginSpec, probe plugin.ProbeFunc, errs Errors) (*PluginChain, error) {
+	chain := new(PluginChain)
+	logger := log.New("armor")
+	i, j := -50, 0
+	for _, s := range specs {
+		rp := s.raw
+
+		// Order, same as `Armor.SavePlugins`
+		if o, ok := rp["order"].(float64); ok { // Decoded from JSON
+			rp = plugin.RawPlugin(merge(rp, map[string]interface{}{"order": int(o)}))
+		} else if _, ok := rp["order"]; !ok {
+			r := plugin.RawPlugin{}
+			for k, v := range rp {
+				r[k] = v
+			}
+			if _, ok := prePlugins[rp.Name()]; ok {
+				i++
+				r["order"] = i
+			} else {
+				j++
+				r["order"] = j
+			}
+			rp = r
+		}
+		p, err := buildPlugin(rp, s.configure, probe, logger)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		chain.plugins = append(chain.plugins, p)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	sort.SliceStable(chain.plugins, func(i, j int) bool {
+		return chain.plugins[i].Order() < chain.plugins[j].Order()
+	})
+	chain.index()
+	return chain, nil
+}
+
+// inherit deep-merges the templates named by `inherits`, recursively, under
+// the plugin settings.
+func inherit(rp plugin.RawPlugin, templates map[string]plugin.RawPlugin, seen []string) (plugin.RawPlugin, error) {
+	name, _ := rp["inherits"].(string)
+	if name == "" {
+		return rp, nil
+	}
+	for _, s := range seen {
+		if s == name {
+			return nil, fmt.Errorf("plugin=%v, error=inheritance cycle %s -> %s", rp["name"], strings.Join(seen, " -> "), name)
+		}
+	}
+	t, ok := templates[name]
+	if !ok {
+		return nil, fmt.Errorf("plugin=%v, error=template=%s not found", rp["name"], name)
+	}
+	t, err := inherit(t, templates, append(seen, name))
+	if err != nil {
+		return nil, err
+	}
+	return plugin.RawPlugin(merge(t, rp)), nil
+}
+
+// merge returns dst with src deep-merged on top of it, leaving both unchanged.
+func merge(dst, src map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(dst)+len(src))
+	for k, v := range dst {
+		m[k] = v
+	}
+	for k, v := range src {
+		if sm, ok := toMap(v); ok {
+			if dm, ok := toMap(m[k]); ok {
+				m[k] = merge(dm, sm)
+				continue
+			}
+		}
+		m[k] = v
+	}
+	return m
+}
+
+func toMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case plugin.RawPlugin:
+		return m, true
+	}
+	return nil, false
+}
+
+// buildPlugin decodes, configures, probes and initializes a plugin,
+// recovering from panics.
+func buildPlugin(rp plugin.RawPlugin, configure func(plugin.Plugin), probe plugin.ProbeFunc, l *log.Logger) (p plugin.Plugin, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("plugin=%v, error=%v", rp["name"], r)
+		}
+	}()
+	p = plugin.Decode(rp, nil, l)
+	if configure != nil {
+		configure(p)
+	}
+	if v, ok := p.(ConfigProber); ok && probe != nil {
+		if err = v.ProbeConfig(probe); err != nil {
+			return nil, fmt.Errorf("plugin=%s, error=%v", p.Name(), err)
+		}
+	}
+	if err = plugin.ValidateConfig(p); err != nil {
+		return nil, fmt.Errorf("plugin=%s, error=%v", p.Name(), err)
+	}
+	p.Initialize()
+	return
+}
+
+// Plugins returns the plugins in the chain.
+func (pc *PluginChain) Plugins() []plugin.Plugin {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+	return append([]plugin.Plugin(nil), pc.plugins...)
+}
+
+// Process applies the chain, the plugin with the lowest order runs first.
+// Plugins implementing `RuntimeValidator` are validated right before they run,
+// inside the interceptors.
+func (pc *PluginChain) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+	h := next
+	for i := len(pc.plugins) - 1; i >= 0; i-- {
+		p := pc.plugins[i]
+		h = plugin.Activate(p)(h)
+		if sem := pc.semaphore(p.Name()); sem != nil {
+			h = limitConcurrency(sem, p.Name(), h)
+		}
+		if v, ok := p.(RuntimeValidator); ok {
+			h = validateRuntime(v, h)
+		}
+		if len(pc.interceptors) > 0 {
+			h = intercept(pc.interceptors, p, h)
+		}
+	}
+	return h
+}
+
+// Middleware returns the chain as a single middleware, e.g. to add armor to
+// an existing Echo app with `e.Use(chain.Middleware())`.
+func (pc *PluginChain) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			return pc.Process(next)(c)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package armor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuild(t *testing.T) {
+	chain, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginHeader, "set": map[string]interface{}{"X-Name": "armor"}},
+			{"name": plugin.PluginRedirect, "from": "/old", "to": "/new"},
+		},
+	})
+	if assert.NoError(t, err) {
+		plugins := chain.Plugins()
+		if assert.Len(t, plugins, 2) {
+			assert.Equal(t, plugin.PluginRedirect, plugins[0].Name())
+			assert.Equal(t, plugin.PluginHeader, plugins[1].Name())
+		}
+	}
+
+	e := echo.New()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, chain.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, "armor", rec.Header().Get("X-Name"))
+
+	req = httptest.NewRequest(echo.GET, "/old", nil)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, chain.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+}
+
+func TestBuildErrors(t *testing.T) {
+	_, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": "unknown"},
+			{"name": plugin.PluginBodyInspect, "rules": []interface{}{
+				map[string]interface{}{"json_path": "a", "regexp": "("},
+			}},
+			{"name": plugin.PluginGzip},
+		},
+	})
+	if assert.IsType(t, Errors{}, err) {
+		assert.Len(t, err.(Errors), 2)
+	}
+}
+
+func TestBuildInherits(t *testing.T) {
+	config := &Config{
+		Templates: map[string]plugin.RawPlugin{
+			"base": {"set": map[string]interface{}{"X-Team": "platform", "X-Env": "dev"}},
+			"prod": {"inherits": "base", "set": map[string]interface{}{"X-Env": "prod"}},
+		},
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginHeader, "inherits": "prod", "add": map[string]interface{}{"X-Name": "armor"}},
+		},
+	}
+	chain, err := Build(config)
+	if assert.NoError(t, err) {
+		h := chain.Plugins()[0].(*plugin.Header)
+		assert.Equal(t, map[string]string{"X-Team": "platform", "X-Env": "prod"}, h.Set) // Chained
+		assert.Equal(t, map[string]string{"X-Name": "armor"}, h.Add)
+	}
+
+	// Override
+	config.Plugins[0]["set"] = map[string]interface{}{"X-Team": "edge"}
+	chain, err = Build(config)
+	if assert.NoError(t, err) {
+		h := chain.Plugins()[0].(*plugin.Header)
+		assert.Equal(t, map[string]string{"X-Team": "edge", "X-Env": "prod"}, h.Set)
+	}
+
+	// Cycle
+	config.Templates["base"]["inherits"] = "prod"
+	_, err = Build(config)
+	assert.Error(t, err)
+
+	// Not found
+	config.Plugins[0]["inherits"] = "unknown"
+	_, err = Build(config)
+	assert.Error(t, err)
+}
+
+func TestBuildProbe(t *testing.T) {
+	config := &Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginCas, "url": "vault"},
+		},
+	}
+	_, err := Build(config)
+	assert.Error(t, err)
+
+	config.Probe = func(key string) (string, error) {
+		return map[string]string{"url": "https://cas.labstack.com/cas"}[key], nil
+	}
+	chain, err := Build(config)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://cas.labstack.com/cas", chain.Plugins()[0].(*plugin.Cas).URL)
+	}
+}
+
+func TestPluginChainMiddleware(t *testing.T) {
+	chain, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginHeader, "set": map[string]interface{}{"X-Name": "armor"}},
+			{"name": plugin.PluginRedirect, "from": "/old", "to": "/users"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	order := []string{}
+	chain.plugins = append(chain.plugins, Middleware("last", 100)(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			order = append(order, c.Response().Header().Get("X-Name"))
+			return next(c)
+		}
+	}))
+
+	e := echo.New()
+	e.Use(chain.Middleware())
+	e.GET("/users", func(c echo.Context) error {
+		order = append(order, "handler")
+		return c.String(http.StatusOK, "users")
+	})
+
+	req := httptest.NewRequest(echo.GET, "/users", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "users", rec.Body.String())
+	assert.Equal(t, "armor", rec.Header().Get("X-Name"))
+	assert.Equal(t, []string{"armor", "handler"}, order)
+
+	req = httptest.NewRequest(echo.GET, "/old", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "/users", rec.Header().Get(echo.HeaderLocation))
+}
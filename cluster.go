@@ -4,6 +4,7 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/hashicorp/logutils"
 	"github.com/hashicorp/serf/serf"
@@ -39,6 +40,12 @@ func (a *Armor) StartCluster() {
 	conf.MemberlistConfig.BindAddr = host
 	conf.MemberlistConfig.BindPort = p
 	a.Cluster.Serf, err = serf.Create(conf)
+	// After an upgrade, the address is free once the previous process left
+	deadline := time.Now().Add(a.ShutdownTimeout * time.Second)
+	for err != nil && upgradedFrom() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		a.Cluster.Serf, err = serf.Create(conf)
+	}
 	if err != nil {
 		a.Logger.Fatal(err)
 	}
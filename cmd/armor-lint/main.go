@@ -0,0 +1,90 @@
+// Command armor-lint validates the plugins of an armor config file.
+//
+//	armor-lint --config config.yaml
+//
+// It prints `{"valid": bool, "errors": [...]}` and exits non-zero if the
+// config is invalid.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	"github.com/labstack/armor"
+	"github.com/labstack/armor/plugin"
+)
+
+type (
+	result struct {
+		Valid  bool     `json:"valid"`
+		Errors []string `json:"errors"`
+	}
+)
+
+func main() {
+	configFile := flag.String("config", "", "config file")
+	flag.Parse()
+	r := lint(*configFile)
+	b, _ := json.MarshalIndent(r, "", "  ")
+	fmt.Println(string(b))
+	if !r.Valid {
+		os.Exit(1)
+	}
+}
+
+func lint(configFile string) (r result) {
+	r.Errors = []string{}
+	defer func() {
+		r.Valid = len(r.Errors) == 0
+	}()
+	if configFile == "" {
+		r.Errors = append(r.Errors, "config file is required")
+		return
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		r.Errors = append(r.Errors, err.Error())
+		return
+	}
+	a := new(armor.Armor)
+	if err := yaml.Unmarshal(data, a); err != nil {
+		r.Errors = append(r.Errors, fmt.Sprintf("failed to parse the config file: %v", err))
+		return
+	}
+
+	check := func(prefix string, plugins []plugin.RawPlugin) {
+		if _, err := armor.Build(&armor.Config{Plugins: plugins}); err != nil {
+			errs, ok := err.(armor.Errors)
+			if !ok {
+				errs = armor.Errors{err}
+			}
+			for _, err := range errs {
+				r.Errors = append(r.Errors, prefix+err.Error())
+			}
+		}
+	}
+	check("", a.RawPlugins)
+	hosts := make([]string, 0, len(a.Hosts))
+	for hn := range a.Hosts {
+		hosts = append(hosts, hn)
+	}
+	sort.Strings(hosts)
+	for _, hn := range hosts {
+		host := a.Hosts[hn]
+		check(fmt.Sprintf("host=%s, ", hn), host.RawPlugins)
+		paths := make([]string, 0, len(host.Paths))
+		for pn := range host.Paths {
+			paths = append(paths, pn)
+		}
+		sort.Strings(paths)
+		for _, pn := range paths {
+			check(fmt.Sprintf("host=%s, path=%s, ", hn, pn), host.Paths[pn].RawPlugins)
+		}
+	}
+	return
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLintCLI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor-lint")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "armor-lint")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); !assert.NoError(t, err, string(out)) {
+		return
+	}
+	run := func(args ...string) (r result, exitErr error) {
+		out, err := exec.Command(bin, args...).Output()
+		assert.NoError(t, json.Unmarshal(out, &r), string(out))
+		return r, err
+	}
+
+	r, err := run("--config", "testdata/valid.yaml")
+	assert.NoError(t, err)
+	assert.True(t, r.Valid)
+	assert.Empty(t, r.Errors)
+
+	r, err = run("--config", "testdata/invalid.yaml")
+	assert.Error(t, err)
+	assert.False(t, r.Valid)
+	if assert.Len(t, r.Errors, 3) {
+		assert.Contains(t, r.Errors[0], "plugin=unknown not found")
+		assert.Contains(t, r.Errors[1], "host=api.labstack.com, plugin=proxy")
+		assert.Contains(t, r.Errors[2], "host=api.labstack.com, path=/login, plugin=cas")
+	}
+
+	r, err = run("--config", "testdata/missing.yaml")
+	assert.Error(t, err)
+	assert.False(t, r.Valid)
+}
@@ -0,0 +1,213 @@
+// Command gen-schema generates the JSON Schema of the armor plugin chain
+// config from the plugin config structs.
+//
+//	go run ./cmd/gen-schema -o schema/armor-config.schema.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/labstack/armor/plugin"
+)
+
+var (
+	// plugins lists the plugin names in the schema, keep in sync with
+	// `plugin.DefaultLookup`.
+	plugins = []string{
+		plugin.PluginBodyLimit,
+		plugin.PluginBodyInspect,
+		plugin.PluginLogger,
+		plugin.PluginRedirect,
+		plugin.PluginHTTPSRedirect,
+		plugin.PluginHTTPSWWWRedirect,
+		plugin.PluginHTTPSNonWWWRedirect,
+		plugin.PluginWWWRedirect,
+		plugin.PluginNonWWWRedirect,
+		plugin.PluginAddTrailingSlash,
+		plugin.PluginRemoveTrailingSlash,
+		plugin.PluginRewrite,
+		plugin.PluginSecure,
+		plugin.PluginCORS,
+		plugin.PluginGzip,
+		plugin.PluginHeader,
+		plugin.PluginHeaders,
+		plugin.PluginProxy,
+		plugin.PluginStatic,
+		plugin.PluginFile,
+		plugin.PluginCas,
+		plugin.PluginOidc,
+		plugin.PluginSaml,
+		plugin.PluginJwt,
+		plugin.PluginLdap,
+		plugin.PluginBasicAuth,
+		plugin.PluginAPIKey,
+		plugin.PluginRateLimit,
+		plugin.PluginCache,
+		plugin.PluginBodyRewrite,
+		plugin.PluginTracing,
+		plugin.PluginAccessLog,
+		plugin.PluginSecureHeaders,
+		plugin.PluginCSRF,
+		plugin.PluginIPFilter,
+		plugin.PluginCompress,
+		plugin.PluginRequestID,
+		plugin.PluginExtAuthz,
+		plugin.PluginAudit,
+		plugin.PluginMaintenance,
+	}
+
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+func main() {
+	out := flag.String("o", "", "output file, default stdout")
+	flag.Parse()
+	b, err := generate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *out == "" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err := ioutil.WriteFile(*out, b, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// generate returns the schema of `armor.Config`.
+func generate() ([]byte, error) {
+	defs := map[string]interface{}{}
+	refs := []interface{}{}
+	for _, name := range plugins {
+		p := plugin.Decode(plugin.RawPlugin{"name": name, "order": 0}, nil, nil)
+		s := schema(reflect.TypeOf(p))
+		props := s["properties"].(map[string]interface{})
+		props["name"] = map[string]interface{}{"const": name}
+		props["order"] = map[string]interface{}{"type": "integer"}
+		s["required"] = append([]string{"name"}, required(s)...)
+		defs[name] = s
+		refs = append(refs, map[string]interface{}{"$ref": "#/definitions/" + name})
+	}
+	b, err := json.MarshalIndent(map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "armor plugin chain config",
+		"type":        "object",
+		"definitions": defs,
+		"properties": map[string]interface{}{
+			"plugins": map[string]interface{}{
+				"type":  "array",
+				"items": map[string]interface{}{"oneOf": refs},
+			},
+			"templates": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": map[string]interface{}{"type": "object"},
+			},
+		},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func required(s map[string]interface{}) []string {
+	r, _ := s["required"].([]string)
+	return r
+}
+
+// schema returns the schema of t, nil for types which can't be configured,
+// e.g. functions and interfaces.
+func schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == durationType {
+		return map[string]interface{}{"type": "string", "format": "duration"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		items := schema(t.Elem())
+		if items == nil {
+			return nil
+		}
+		return map[string]interface{}{"type": "array", "items": items}
+	case reflect.Map:
+		values := schema(t.Elem())
+		if values == nil {
+			return nil
+		}
+		return map[string]interface{}{"type": "object", "additionalProperties": values}
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			return map[string]interface{}{}
+		}
+	case reflect.Struct:
+		s := map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{},
+		}
+		fields(t, s)
+		return s
+	}
+	return nil
+}
+
+// fields adds the fields of struct t to the object schema s, squashed
+// structs are inlined.
+func fields(t reflect.Type, s map[string]interface{}) {
+	props := s["properties"].(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		if len(tag) > 1 && tag[1] == "squash" {
+			ft := f.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields(ft, s)
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fs := schema(f.Type)
+		if fs == nil {
+			continue
+		}
+		if d := f.Tag.Get("description"); d != "" {
+			fs["description"] = d
+		}
+		props[name] = fs
+		if f.Tag.Get("required") == "true" {
+			s["required"] = append(required(s), name)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	SampleBase struct {
+		Skip string `yaml:"skip"`
+	}
+
+	sample struct {
+		SampleBase `yaml:",squash"`
+		URL        string            `yaml:"url" required:"true" description:"Server URL"`
+		Timeout    time.Duration     `yaml:"timeout"`
+		Retries    *int              `yaml:"retries"`
+		Items      []sampleItem      `yaml:"items"`
+		Labels     map[string]string `yaml:"labels"`
+		Func       func()            `yaml:"func"`
+		Ignored    string            `yaml:"-"`
+		hidden     string
+	}
+
+	sampleItem struct {
+		Name   string    `yaml:"name"`
+		Weight float64   `yaml:"weight"`
+		Tags   *[]string `yaml:"tags"`
+	}
+)
+
+func TestSchema(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"skip":    map[string]interface{}{"type": "string"},
+			"url":     map[string]interface{}{"type": "string", "description": "Server URL"},
+			"timeout": map[string]interface{}{"type": "string", "format": "duration"},
+			"retries": map[string]interface{}{"type": "integer"},
+			"items": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"name":   map[string]interface{}{"type": "string"},
+						"weight": map[string]interface{}{"type": "number"},
+						"tags": map[string]interface{}{
+							"type":  "array",
+							"items": map[string]interface{}{"type": "string"},
+						},
+					},
+				},
+			},
+			"labels": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": map[string]interface{}{"type": "string"},
+			},
+		},
+		"required": []string{"url"},
+	}, schema(reflect.TypeOf(&sample{})))
+}
+
+// TestGenerated fails if the committed schema is stale, run `go generate` in
+// the repository root to update it.
+func TestGenerated(t *testing.T) {
+	b, err := generate()
+	if !assert.NoError(t, err) {
+		return
+	}
+	committed, err := ioutil.ReadFile("../../schema/armor-config.schema.json")
+	if assert.NoError(t, err) {
+		assert.Equal(t, string(committed), string(b))
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"io/ioutil"
 	stdLog "log"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/labstack/armor"
+	"github.com/labstack/armor/backend"
 	"github.com/labstack/armor/store"
 	"github.com/labstack/gommon/color"
 	"github.com/labstack/gommon/log"
@@ -43,11 +46,12 @@ ________________________O/_______
 )
 
 var (
-	configFile string
-	port       string
-	root       string
-	expose     bool
-	rootCmd    = &cobra.Command{
+	configFile    string
+	configBackend backend.Backend
+	port          string
+	root          string
+	expose        bool
+	rootCmd       = &cobra.Command{
 		Use:   "armor",
 		Short: "Armor is an uncomplicated, modern HTTP server",
 		Long:  ``,
@@ -110,29 +114,22 @@ func initConfig() {
 		logger.Fatalf("Failed to parse the config file: %v", err)
 	}
 
-	// Defaults
-	if a.Address == "" {
-		a.Address = net.JoinHostPort("", port)
-	}
-	_, a.Port, _ = net.SplitHostPort(a.Address)
-	if a.Storm == nil {
-		a.Storm = &armor.Storm{
-			URI: filepath.Join(a.RootDir, "storm.db"),
+	// Config backend, on top of the file
+	if a.Backend != nil {
+		if configBackend, err = backend.New(a.Backend); err != nil {
+			logger.Fatalf("Failed to connect to the config backend: %v", err)
 		}
-	}
-	if a.Admin == nil {
-		a.Admin = &armor.Admin{
-			Address: "localhost:8081",
+		if data, err = configBackend.Get(); err != nil {
+			logger.Fatalf("Failed to get the config from the backend: %v", err)
 		}
-	}
-	if a.Cluster == nil {
-		a.Cluster = &armor.Cluster{
-			Address: ":8082",
-			Peers:   []string{"localhost:8082"},
+		if err = yaml.Unmarshal(data, a); err != nil {
+			logger.Fatalf("Failed to parse the backend config: %v", err)
 		}
 	}
-	if a.Hosts == nil {
-		a.Hosts = make(armor.Hosts)
+
+	setDefaults(a)
+	if err = a.ValidateErrorPages(); err != nil {
+		logger.Fatalf("Invalid error pages: %v", err)
 	}
 
 	// HTTP
@@ -152,9 +149,41 @@ func initConfig() {
 	// Start cluster
 	go a.StartCluster()
 
+	// Reload on SIGHUP and config file changes
+	if !a.DefaultConfig {
+		if _, err := armor.WatchConfig(configFile, logger, func() {
+			reloadConfig(a, nil)
+		}); err != nil {
+			logger.Errorf("Failed to watch the config file: %v", err)
+		}
+	}
+	if configBackend != nil {
+		if values, err := configBackend.Watch(nil); err != nil {
+			logger.Errorf("Failed to watch the config backend: %v", err)
+		} else {
+			go func() {
+				for v := range values {
+					reloadConfig(a, v)
+				}
+			}()
+		}
+	}
+
+	// Load plugins
+	if err := admin.LoadPlugins(a); err != nil {
+		logger.Fatal(err)
+	}
+
 	// Start admin
 	go admin.Start(a)
 
+	// Start metrics
+	if a.Metrics != nil && a.Metrics.Address != "" {
+		go func() {
+			logger.Fatal(a.StartMetrics())
+		}()
+	}
+
 	// Create tunnel
 	if expose {
 		go h.CreateTunnel()
@@ -162,10 +191,85 @@ func initConfig() {
 
 	// Start server
 	colorer.Printf(banner, colorer.Red("v"+armor.Version), colorer.Blue(armor.Website))
+	serve := func(start func() error) {
+		if err := start(); err != nil && err != http.ErrServerClosed {
+			logger.Fatal(err)
+		}
+	}
 	if a.TLS != nil {
-		go func() {
-			logger.Fatal(h.StartTLS())
-		}()
+		go serve(h.StartTLS)
+	}
+	go serve(h.Start)
+
+	// Take over from the process upgraded from, drain the connections on
+	// SIGTERM and upgrade on SIGUSR2
+	if err := a.Ready(); err != nil {
+		logger.Errorf("upgrade: failed to stop the previous process: %v", err)
+	}
+	if err := a.AwaitShutdown(a.ShutdownTimeout * time.Second); err != nil {
+		logger.Errorf("shutdown: %v", err)
+	}
+}
+
+// setDefaults sets the defaults of the config a.
+func setDefaults(a *armor.Armor) {
+	if a.Address == "" {
+		a.Address = net.JoinHostPort("", port)
+	}
+	_, a.Port, _ = net.SplitHostPort(a.Address)
+	if a.Storm == nil {
+		a.Storm = &armor.Storm{
+			URI: filepath.Join(a.RootDir, "storm.db"),
+		}
+	}
+	if a.Admin == nil {
+		a.Admin = &armor.Admin{
+			Address: "localhost:8081",
+		}
+	}
+	if a.Cluster == nil {
+		a.Cluster = &armor.Cluster{
+			Address: ":8082",
+			Peers:   []string{"localhost:8082"},
+		}
+	}
+	if a.Hosts == nil {
+		a.Hosts = make(armor.Hosts)
+	}
+	if a.ShutdownTimeout <= 0 {
+		a.ShutdownTimeout = 30
+	}
+}
+
+// reloadConfig parses the config file and the backend config anew, or
+// config if set, and applies them to a. The running config is kept on errors.
+func reloadConfig(a *armor.Armor, config []byte) {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		a.Logger.Errorf("reload: failed to read the config file: %v", err)
+		return
+	}
+	c := &armor.Armor{RootDir: a.RootDir}
+	if err = yaml.Unmarshal(data, c); err != nil {
+		a.Logger.Errorf("reload: failed to parse the config file: %v", err)
+		return
+	}
+	if configBackend != nil {
+		if config == nil {
+			if config, err = configBackend.Get(); err != nil {
+				a.Logger.Errorf("reload: failed to get the backend config: %v", err)
+				return
+			}
+		}
+		if err = yaml.Unmarshal(config, c); err != nil {
+			a.Logger.Errorf("reload: failed to parse the backend config: %v", err)
+			return
+		}
+	}
+	setDefaults(c)
+	if err = a.Reload(c); err != nil {
+		a.Logger.Errorf("reload: keeping the running config: %v", err)
+		return
 	}
-	logger.Fatal(h.Start())
+	a.Logger.Infof("reload: applied %s", configFile)
 }
@@ -0,0 +1,47 @@
+package armor
+
+import (
+	"github.com/labstack/echo/v4"
+)
+
+// semaphore returns the semaphore shared by the plugins named name, nil if
+// there's no limit. It's called with the read lock held.
+func (pc *PluginChain) semaphore(name string) chan struct{} {
+	limit := pc.GlobalConcurrencyLimits[name]
+	if limit <= 0 {
+		return nil
+	}
+	pc.semaphoreMutex.Lock()
+	defer pc.semaphoreMutex.Unlock()
+	if pc.semaphores == nil {
+		pc.semaphores = map[string]chan struct{}{}
+	}
+	sem, ok := pc.semaphores[name]
+	if !ok || cap(sem) != limit {
+		sem = make(chan struct{}, limit)
+		pc.semaphores[name] = sem
+	}
+	return sem
+}
+
+// limitConcurrency holds a slot of sem while the request is processed by
+// next. A request passing several plugins of the type takes a single slot.
+func limitConcurrency(sem chan struct{}, name string, next echo.HandlerFunc) echo.HandlerFunc {
+	key := "armor_concurrency_" + name
+	return func(c echo.Context) error {
+		if c.Get(key) != nil {
+			return next(c)
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-c.Request().Context().Done():
+			return c.Request().Context().Err()
+		}
+		c.Set(key, true)
+		defer func() {
+			c.Set(key, nil)
+			<-sem
+		}()
+		return next(c)
+	}
+}
@@ -0,0 +1,68 @@
+package armor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobalConcurrencyLimits(t *testing.T) {
+	ldap := func(order int) plugin.Plugin {
+		return Middleware("ldap", order)(func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		})
+	}
+	run := func(chain *PluginChain) (max int32) {
+		var active int32
+		e := echo.New()
+		h := chain.Process(func(c echo.Context) error {
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			return c.String(http.StatusOK, "OK")
+		})
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec := httptest.NewRecorder()
+				assert.NoError(t, h(e.NewContext(httptest.NewRequest(echo.GET, "/", nil), rec)))
+				assert.Equal(t, http.StatusOK, rec.Code)
+			}()
+		}
+		wg.Wait()
+		return
+	}
+
+	chain := &PluginChain{plugins: []plugin.Plugin{ldap(1), ldap(2)}}
+	assert.True(t, run(chain) > 5)
+
+	chain.GlobalConcurrencyLimits = map[string]int{"ldap": 5}
+	assert.True(t, run(chain) <= 5)
+
+	// Gone client
+	chain.GlobalConcurrencyLimits = map[string]int{"ldap": 1}
+	sem := chain.semaphore("ldap")
+	sem <- struct{}{}
+	defer func() { <-sem }()
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+	err := chain.Process(echo.NotFoundHandler)(echo.New().NewContext(req.WithContext(ctx), httptest.NewRecorder()))
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,126 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type (
+	// cloudflare sets the records with the Cloudflare API v4.
+	cloudflare struct {
+		client *http.Client
+		url    string
+		token  string
+		zoneID string
+		ttl    int
+	}
+
+	cloudflareResponse struct {
+		Success bool            `json:"success"`
+		Result  json.RawMessage `json:"result"`
+	}
+
+	cloudflareRecord struct {
+		ID      string `json:"id,omitempty"`
+		Type    string `json:"type"`
+		Name    string `json:"name"`
+		Content string `json:"content"`
+		TTL     int    `json:"ttl"`
+	}
+)
+
+func newCloudflare(config *Config) (*cloudflare, error) {
+	p := &cloudflare{
+		client: &http.Client{Timeout: 30 * time.Second},
+		url:    config.endpoint("https://api.cloudflare.com/client/v4"),
+		token:  env(config.APIToken, "CLOUDFLARE_API_TOKEN"),
+		zoneID: config.ZoneID,
+		ttl:    config.ttl(),
+	}
+	if p.token == "" {
+		return nil, errors.New("cloudflare dns provider requires an api token")
+	}
+	return p, nil
+}
+
+func (p *cloudflare) do(ctx context.Context, method, path string, body, v interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, p.url+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+	res := new(cloudflareResponse)
+	if err = do(p.client, req.WithContext(ctx), res); err != nil {
+		return err
+	}
+	if !res.Success {
+		return fmt.Errorf("%s %s failed", method, path)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(res.Result, v)
+}
+
+func (p *cloudflare) zone(ctx context.Context, fqdn string) (string, error) {
+	if p.zoneID != "" {
+		return p.zoneID, nil
+	}
+	for _, z := range zones(fqdn) {
+		found := []struct {
+			ID string `json:"id"`
+		}{}
+		if err := p.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(z), nil, &found); err != nil {
+			return "", err
+		}
+		if len(found) > 0 {
+			return found[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare zone of %s not found", fqdn)
+}
+
+func (p *cloudflare) Present(ctx context.Context, fqdn, value string) error {
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	return p.do(ctx, http.MethodPost, "/zones/"+zone+"/dns_records", &cloudflareRecord{
+		Type:    "TXT",
+		Name:    fqdn,
+		Content: value,
+		TTL:     p.ttl,
+	}, nil)
+}
+
+func (p *cloudflare) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	records := []cloudflareRecord{}
+	q := url.Values{"type": {"TXT"}, "name": {fqdn}, "content": {value}}
+	if err = p.do(ctx, http.MethodGet, "/zones/"+zone+"/dns_records?"+q.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err = p.do(ctx, http.MethodDelete, "/zones/"+zone+"/dns_records/"+r.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Package dns provides the DNS providers solving the ACME DNS-01 challenge,
+// Route 53, Cloudflare and Google Cloud DNS, for wildcard certificates and the
+// hosts not reachable from the internet.
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type (
+	// Provider sets the TXT records of the DNS-01 challenge. The fqdn of a
+	// record has no trailing dot, e.g. `_acme-challenge.example.com`.
+	Provider interface {
+		// Present creates the TXT record fqdn with value.
+		Present(ctx context.Context, fqdn, value string) error
+
+		// CleanUp removes the TXT record fqdn with value.
+		CleanUp(ctx context.Context, fqdn, value string) error
+	}
+
+	// Config is the DNS provider of the challenge.
+	Config struct {
+		// Provider is `route53`, `cloudflare` or `gcloud`.
+		Provider string `json:"provider"`
+
+		// Endpoint of the provider API, default the public one.
+		Endpoint string `json:"endpoint"`
+
+		// Route 53 credentials, default the `AWS_ACCESS_KEY_ID`,
+		// `AWS_SECRET_ACCESS_KEY` and `AWS_SESSION_TOKEN` environment
+		// variables, and hosted zone, default the one of the record.
+		AccessKeyID     string `json:"access_key_id"`
+		SecretAccessKey string `json:"secret_access_key"`
+		SessionToken    string `json:"session_token"`
+		HostedZoneID    string `json:"hosted_zone_id"`
+
+		// Cloudflare API token, default the `CLOUDFLARE_API_TOKEN`
+		// environment variable, and zone, default the one of the record.
+		APIToken string `json:"api_token"`
+		ZoneID   string `json:"zone_id"`
+
+		// Google Cloud service account key file, default the
+		// `GOOGLE_APPLICATION_CREDENTIALS` environment variable, project,
+		// default the one of the key, and managed zone, default the one of
+		// the record.
+		CredentialsFile string `json:"credentials_file"`
+		Project         string `json:"project"`
+		ManagedZone     string `json:"managed_zone"`
+
+		// TTL of the records in seconds, default 120.
+		TTL int `json:"ttl"`
+
+		// PropagationTimeout in seconds to wait for a record to be visible,
+		// default 120.
+		PropagationTimeout time.Duration `json:"propagation_timeout"`
+	}
+)
+
+const (
+	// Providers
+	Route53    = "route53"
+	Cloudflare = "cloudflare"
+	GCloud     = "gcloud"
+)
+
+// New returns the provider of config.
+func New(config *Config) (Provider, error) {
+	switch config.Provider {
+	case Route53:
+		return newRoute53(config)
+	case Cloudflare:
+		return newCloudflare(config)
+	case GCloud:
+		return newGCloud(config)
+	}
+	return nil, fmt.Errorf("invalid dns provider=%s", config.Provider)
+}
+
+func (c *Config) ttl() int {
+	if c.TTL <= 0 {
+		return 120
+	}
+	return c.TTL
+}
+
+// Timeout returns the propagation timeout.
+func (c *Config) Timeout() time.Duration {
+	if c.PropagationTimeout <= 0 {
+		return 2 * time.Minute
+	}
+	return c.PropagationTimeout * time.Second
+}
+
+func (c *Config) endpoint(def string) string {
+	if c.Endpoint == "" {
+		return def
+	}
+	return strings.TrimSuffix(c.Endpoint, "/")
+}
+
+func env(value, name string) string {
+	if value == "" {
+		return strings.TrimSpace(os.Getenv(name))
+	}
+	return value
+}
+
+// Wait waits for the TXT record fqdn with value to be visible until timeout,
+// and returns whether it is.
+func Wait(ctx context.Context, fqdn, value string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		values, _ := net.DefaultResolver.LookupTXT(ctx, fqdn)
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// zones returns the candidate zones of fqdn, from the closest one.
+func zones(fqdn string) []string {
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	zones := []string{}
+	for i := 1; i < len(labels)-1; i++ {
+		zones = append(zones, strings.Join(labels[i:], "."))
+	}
+	return zones
+}
+
+// do sends req and decodes the JSON response into v.
+func do(client *http.Client, req *http.Request, v interface{}) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s, %s: %s", req.Method, req.URL.Path, res.Status, strings.TrimSpace(string(b)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,102 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZones(t *testing.T) {
+	assert.Equal(t, []string{"www.example.com", "example.com"}, zones("_acme-challenge.www.example.com"))
+	assert.Equal(t, []string{}, zones("example.com"))
+}
+
+func TestCloudflare(t *testing.T) {
+	records := map[string]string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		switch {
+		case r.URL.Path == "/zones":
+			if r.URL.Query().Get("name") == "example.com" {
+				w.Write([]byte(`{"success":true,"result":[{"id":"z1"}]}`))
+				return
+			}
+			w.Write([]byte(`{"success":true,"result":[]}`))
+		case r.URL.Path == "/zones/z1/dns_records" && r.Method == http.MethodPost:
+			rec := new(cloudflareRecord)
+			json.NewDecoder(r.Body).Decode(rec)
+			assert.Equal(t, "TXT", rec.Type)
+			assert.Equal(t, 60, rec.TTL)
+			records["r1"] = rec.Name + "=" + rec.Content
+			w.Write([]byte(`{"success":true,"result":{"id":"r1"}}`))
+		case r.URL.Path == "/zones/z1/dns_records":
+			assert.Equal(t, "_acme-challenge.www.example.com", r.URL.Query().Get("name"))
+			w.Write([]byte(`{"success":true,"result":[{"id":"r1"}]}`))
+		case r.URL.Path == "/zones/z1/dns_records/r1" && r.Method == http.MethodDelete:
+			delete(records, "r1")
+			w.Write([]byte(`{"success":true,"result":{"id":"r1"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	p, err := New(&Config{Provider: Cloudflare, Endpoint: s.URL, APIToken: "secret", TTL: 60})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	if assert.NoError(t, p.Present(ctx, "_acme-challenge.www.example.com", "value")) {
+		assert.Equal(t, "_acme-challenge.www.example.com=value", records["r1"])
+	}
+	if assert.NoError(t, p.CleanUp(ctx, "_acme-challenge.www.example.com", "value")) {
+		assert.Empty(t, records)
+	}
+}
+
+func TestRoute53(t *testing.T) {
+	bodies := []string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/"), auth)
+		assert.Contains(t, auth, "/us-east-1/route53/aws4_request")
+		switch r.URL.Path {
+		case "/2013-04-01/hostedzonesbyname":
+			w.Write([]byte(`<ListHostedZonesByNameResponse><HostedZones><HostedZone><Id>/hostedzone/Z1</Id><Name>example.com.</Name></HostedZone></HostedZones></ListHostedZonesByNameResponse>`))
+		case "/2013-04-01/hostedzone/Z1/rrset":
+			b, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(b))
+			w.Write([]byte(`<ChangeResourceRecordSetsResponse/>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	p, err := New(&Config{Provider: Route53, Endpoint: s.URL, AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	assert.NoError(t, p.Present(ctx, "_acme-challenge.example.com", "value"))
+	assert.NoError(t, p.CleanUp(ctx, "_acme-challenge.example.com", "value"))
+	if assert.Len(t, bodies, 2) {
+		assert.Contains(t, bodies[0], "<Action>UPSERT</Action>")
+		assert.Contains(t, bodies[0], "<Name>_acme-challenge.example.com.</Name>")
+		assert.Contains(t, bodies[0], "<Value>&#34;value&#34;</Value>")
+		assert.Contains(t, bodies[1], "<Action>DELETE</Action>")
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(&Config{Provider: "bind"})
+	assert.Error(t, err)
+	_, err = New(&Config{Provider: Cloudflare})
+	assert.Error(t, err)
+}
@@ -0,0 +1,190 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+type (
+	// gcloud sets the records with the Google Cloud DNS API v1,
+	// authenticated with a service account key.
+	gcloud struct {
+		client  *http.Client
+		url     string
+		project string
+		zone    string
+		ttl     int
+	}
+
+	gcloudKey struct {
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		PrivateKeyID string `json:"private_key_id"`
+		TokenURI     string `json:"token_uri"`
+		ProjectID    string `json:"project_id"`
+	}
+
+	gcloudRecordSet struct {
+		Name    string   `json:"name"`
+		Type    string   `json:"type"`
+		TTL     int      `json:"ttl"`
+		Rrdatas []string `json:"rrdatas"`
+	}
+
+	gcloudChange struct {
+		Additions []*gcloudRecordSet `json:"additions,omitempty"`
+		Deletions []*gcloudRecordSet `json:"deletions,omitempty"`
+	}
+)
+
+func newGCloud(config *Config) (*gcloud, error) {
+	file := env(config.CredentialsFile, "GOOGLE_APPLICATION_CREDENTIALS")
+	if file == "" {
+		return nil, errors.New("gcloud dns provider requires a credentials file")
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key := new(gcloudKey)
+	if err = json.Unmarshal(b, key); err != nil {
+		return nil, fmt.Errorf("credentials file=%s, %v", file, err)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	jc := &jwt.Config{
+		Email:        key.ClientEmail,
+		PrivateKey:   []byte(key.PrivateKey),
+		PrivateKeyID: key.PrivateKeyID,
+		TokenURL:     key.TokenURI,
+		Scopes:       []string{"https://www.googleapis.com/auth/ndev.clouddns.readwrite"},
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Timeout: 30 * time.Second})
+	p := &gcloud{
+		client:  jc.Client(ctx),
+		url:     config.endpoint("https://dns.googleapis.com/dns/v1"),
+		project: config.Project,
+		zone:    config.ManagedZone,
+		ttl:     config.ttl(),
+	}
+	p.client.Timeout = 30 * time.Second
+	if p.project == "" {
+		p.project = key.ProjectID
+	}
+	if p.project == "" {
+		return nil, errors.New("gcloud dns provider requires a project")
+	}
+	return p, nil
+}
+
+func (p *gcloud) do(ctx context.Context, method, path string, body, v interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, p.url+"/projects/"+url.PathEscape(p.project)+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(p.client, req.WithContext(ctx), v)
+}
+
+func (p *gcloud) managedZone(ctx context.Context, fqdn string) (string, error) {
+	if p.zone != "" {
+		return p.zone, nil
+	}
+	for _, z := range zones(fqdn) {
+		found := new(struct {
+			ManagedZones []struct {
+				Name string `json:"name"`
+			} `json:"managedZones"`
+		})
+		if err := p.do(ctx, http.MethodGet, "/managedZones?dnsName="+url.QueryEscape(z+"."), nil, found); err != nil {
+			return "", err
+		}
+		if len(found.ManagedZones) > 0 {
+			return found.ManagedZones[0].Name, nil
+		}
+	}
+	return "", fmt.Errorf("gcloud managed zone of %s not found", fqdn)
+}
+
+// records returns the TXT record set fqdn, nil without.
+func (p *gcloud) records(ctx context.Context, zone, fqdn string) (*gcloudRecordSet, error) {
+	found := new(struct {
+		Rrsets []*gcloudRecordSet `json:"rrsets"`
+	})
+	q := url.Values{"name": {fqdn + "."}, "type": {"TXT"}}
+	if err := p.do(ctx, http.MethodGet, "/managedZones/"+zone+"/rrsets?"+q.Encode(), nil, found); err != nil {
+		return nil, err
+	}
+	if len(found.Rrsets) == 0 {
+		return nil, nil
+	}
+	return found.Rrsets[0], nil
+}
+
+// change replaces the TXT record set fqdn with the values of it returned by
+// update, removed if none.
+func (p *gcloud) change(ctx context.Context, fqdn string, update func([]string) []string) error {
+	zone, err := p.managedZone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	current, err := p.records(ctx, zone, fqdn)
+	if err != nil {
+		return err
+	}
+	c := new(gcloudChange)
+	values := []string{}
+	if current != nil {
+		c.Deletions = append(c.Deletions, current)
+		values = current.Rrdatas
+	}
+	if values = update(values); len(values) > 0 {
+		c.Additions = append(c.Additions, &gcloudRecordSet{
+			Name:    fqdn + ".",
+			Type:    "TXT",
+			TTL:     p.ttl,
+			Rrdatas: values,
+		})
+	}
+	if len(c.Additions) == 0 && len(c.Deletions) == 0 {
+		return nil
+	}
+	return p.do(ctx, http.MethodPost, "/managedZones/"+zone+"/changes", c, nil)
+}
+
+func (p *gcloud) Present(ctx context.Context, fqdn, value string) error {
+	return p.change(ctx, fqdn, func(values []string) []string {
+		return append(values, strconv.Quote(value))
+	})
+}
+
+func (p *gcloud) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.change(ctx, fqdn, func(values []string) []string {
+		kept := []string{}
+		for _, v := range values {
+			if v != strconv.Quote(value) {
+				kept = append(kept, v)
+			}
+		}
+		return kept
+	})
+}
@@ -0,0 +1,193 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// route53 sets the records with the Route 53 API, signed with AWS
+	// Signature Version 4.
+	route53 struct {
+		client       *http.Client
+		url          string
+		accessKeyID  string
+		secretKey    string
+		sessionToken string
+		zoneID       string
+		ttl          int
+	}
+
+	route53Change struct {
+		XMLName xml.Name `xml:"ChangeResourceRecordSetsRequest"`
+		XMLNS   string   `xml:"xmlns,attr"`
+		Action  string   `xml:"ChangeBatch>Changes>Change>Action"`
+		Set     struct {
+			Name   string   `xml:"Name"`
+			Type   string   `xml:"Type"`
+			TTL    int      `xml:"TTL"`
+			Values []string `xml:"ResourceRecords>ResourceRecord>Value"`
+		} `xml:"ChangeBatch>Changes>Change>ResourceRecordSet"`
+	}
+
+	route53Zones struct {
+		Zones []struct {
+			ID   string `xml:"Id"`
+			Name string `xml:"Name"`
+		} `xml:"HostedZones>HostedZone"`
+	}
+)
+
+const route53Namespace = "https://route53.amazonaws.com/doc/2013-04-01/"
+
+func newRoute53(config *Config) (*route53, error) {
+	p := &route53{
+		client:       &http.Client{Timeout: 30 * time.Second},
+		url:          config.endpoint("https://route53.amazonaws.com"),
+		accessKeyID:  env(config.AccessKeyID, "AWS_ACCESS_KEY_ID"),
+		secretKey:    env(config.SecretAccessKey, "AWS_SECRET_ACCESS_KEY"),
+		sessionToken: env(config.SessionToken, "AWS_SESSION_TOKEN"),
+		zoneID:       strings.TrimPrefix(config.HostedZoneID, "/hostedzone/"),
+		ttl:          config.ttl(),
+	}
+	if p.accessKeyID == "" || p.secretKey == "" {
+		return nil, errors.New("route53 dns provider requires an access key")
+	}
+	return p, nil
+}
+
+func (p *route53) do(ctx context.Context, method, path string, body []byte, v interface{}) error {
+	req, err := http.NewRequest(method, p.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/xml")
+	}
+	p.sign(req, body, time.Now().UTC())
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s, %s: %s", method, req.URL.Path, res.Status, strings.TrimSpace(string(b)))
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.NewDecoder(res.Body).Decode(v)
+}
+
+// sign signs req with AWS Signature Version 4, Route 53 is in `us-east-1`.
+func (p *route53) sign(req *http.Request, body []byte, t time.Time) {
+	date := t.Format("20060102T150405Z")
+	day := date[:8]
+	scope := day + "/us-east-1/route53/aws4_request"
+	hash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+	if p.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.sessionToken)
+	}
+
+	// Canonical request
+	names := []string{"host"}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	headers := ""
+	for _, name := range names {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		headers += name + ":" + value + "\n"
+	}
+	signed := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		headers,
+		signed,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	crHash := sha256.Sum256([]byte(canonical))
+
+	// Signature
+	key := []byte("AWS4" + p.secretKey)
+	for _, s := range []string{day, "us-east-1", "route53", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, "AWS4-HMAC-SHA256\n"+date+"\n"+scope+"\n"+hex.EncodeToString(crHash[:])))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+p.accessKeyID+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+func (p *route53) zone(ctx context.Context, fqdn string) (string, error) {
+	if p.zoneID != "" {
+		return p.zoneID, nil
+	}
+	for _, z := range zones(fqdn) {
+		found := new(route53Zones)
+		path := "/2013-04-01/hostedzonesbyname?dnsname=" + z + "&maxitems=1"
+		if err := p.do(ctx, http.MethodGet, path, nil, found); err != nil {
+			return "", err
+		}
+		if len(found.Zones) > 0 && strings.TrimSuffix(found.Zones[0].Name, ".") == z {
+			return strings.TrimPrefix(found.Zones[0].ID, "/hostedzone/"), nil
+		}
+	}
+	return "", fmt.Errorf("route53 hosted zone of %s not found", fqdn)
+}
+
+func (p *route53) change(ctx context.Context, action, fqdn, value string) error {
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	c := &route53Change{XMLNS: route53Namespace, Action: action}
+	c.Set.Name = fqdn + "."
+	c.Set.Type = "TXT"
+	c.Set.TTL = p.ttl
+	c.Set.Values = []string{strconv.Quote(value)}
+	body, err := xml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return p.do(ctx, http.MethodPost, "/2013-04-01/hostedzone/"+zone+"/rrset", append([]byte(xml.Header), body...), nil)
+}
+
+func (p *route53) Present(ctx context.Context, fqdn, value string) error {
+	return p.change(ctx, "UPSERT", fqdn, value)
+}
+
+func (p *route53) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.change(ctx, "DELETE", fqdn, value)
+}
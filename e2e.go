@@ -0,0 +1,107 @@
+package armor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// E2ETestCase is an HTTP request fired against a plugin chain and the
+	// response expected. The request URL is resolved against the test server.
+	E2ETestCase struct {
+		Name          string
+		Request       *http.Request
+		ExpectStatus  int
+		ExpectHeaders map[string]string
+		MaxLatencyMs  int64
+	}
+
+	// E2EResult is the outcome of an `E2ETestCase`.
+	E2EResult struct {
+		Name     string
+		Status   int
+		Header   http.Header
+		Body     []byte
+		Latency  time.Duration
+		Passed   bool
+		Failures []string
+	}
+)
+
+// RunE2ETest serves the chain from a temporary HTTP server and runs the test
+// cases against it in order. Requests passing through all plugins get a 404.
+// Redirects are not followed.
+func RunE2ETest(chain *PluginChain, testCases []E2ETestCase) []E2EResult {
+	e := echo.New()
+	e.HideBanner = true
+	e.Any("/*", chain.Process(func(c echo.Context) error {
+		return echo.ErrNotFound
+	}))
+	s := httptest.NewServer(e)
+	defer s.Close()
+	base, _ := url.Parse(s.URL)
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	results := make([]E2EResult, len(testCases))
+	for i, tc := range testCases {
+		results[i] = runE2ETestCase(client, base, tc)
+	}
+	return results
+}
+
+func runE2ETestCase(client *http.Client, base *url.URL, tc E2ETestCase) (r E2EResult) {
+	r.Name = tc.Name
+	if tc.Request == nil {
+		r.Failures = []string{"request is required"}
+		return
+	}
+	req := tc.Request.WithContext(tc.Request.Context())
+	req.URL = base.ResolveReference(&url.URL{
+		Path:     tc.Request.URL.Path,
+		RawPath:  tc.Request.URL.RawPath,
+		RawQuery: tc.Request.URL.RawQuery,
+	})
+	req.RequestURI = ""
+	if req.Host == "" || req.Host == "example.com" { // Default of `httptest.NewRequest`
+		req.Host = base.Host
+	}
+
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		r.Failures = []string{err.Error()}
+		return
+	}
+	defer res.Body.Close()
+	r.Body, err = ioutil.ReadAll(res.Body)
+	r.Latency = time.Since(start)
+	r.Status = res.StatusCode
+	r.Header = res.Header
+	if err != nil {
+		r.Failures = append(r.Failures, err.Error())
+	}
+
+	if tc.ExpectStatus != 0 && r.Status != tc.ExpectStatus {
+		r.Failures = append(r.Failures, fmt.Sprintf("status=%d, expected=%d", r.Status, tc.ExpectStatus))
+	}
+	for k, v := range tc.ExpectHeaders {
+		if got := r.Header.Get(k); got != v {
+			r.Failures = append(r.Failures, fmt.Sprintf("header=%s, value=%q, expected=%q", k, got, v))
+		}
+	}
+	if max := time.Duration(tc.MaxLatencyMs) * time.Millisecond; max > 0 && r.Latency > max {
+		r.Failures = append(r.Failures, fmt.Sprintf("latency=%v, max=%v", r.Latency, max))
+	}
+	r.Passed = len(r.Failures) == 0
+	return
+}
@@ -0,0 +1,72 @@
+package armor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunE2ETest(t *testing.T) {
+	chain, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginHeader, "set": map[string]interface{}{"X-Name": "armor"}},
+			{"name": plugin.PluginRedirect, "from": "/old", "to": "/new"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	slow := Middleware("slow", 100)(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Request().URL.Path == "/slow" {
+				time.Sleep(20 * time.Millisecond)
+			}
+			return next(c)
+		}
+	})
+	chain.plugins = append(chain.plugins, slow)
+
+	results := RunE2ETest(chain, []E2ETestCase{
+		{
+			Name:          "redirect",
+			Request:       httptest.NewRequest(echo.GET, "/old", nil),
+			ExpectStatus:  http.StatusMovedPermanently,
+			ExpectHeaders: map[string]string{echo.HeaderLocation: "/new"},
+		},
+		{
+			Name:          "header mismatch",
+			Request:       httptest.NewRequest(echo.GET, "/", nil),
+			ExpectStatus:  http.StatusOK,
+			ExpectHeaders: map[string]string{"X-Name": "echo"},
+		},
+		{
+			Name:         "slow",
+			Request:      httptest.NewRequest(echo.GET, "/slow", nil),
+			ExpectStatus: http.StatusNotFound,
+			MaxLatencyMs: 5,
+		},
+		{
+			Name: "no request",
+		},
+	})
+	if !assert.Len(t, results, 4) {
+		return
+	}
+	assert.True(t, results[0].Passed, "%v", results[0].Failures)
+	assert.Equal(t, "redirect", results[0].Name)
+
+	assert.False(t, results[1].Passed)
+	assert.Equal(t, http.StatusNotFound, results[1].Status)
+	assert.Len(t, results[1].Failures, 2)
+
+	assert.False(t, results[2].Passed)
+	assert.Len(t, results[2].Failures, 1)
+	assert.True(t, results[2].Latency >= 20*time.Millisecond)
+
+	assert.False(t, results[3].Passed)
+}
@@ -0,0 +1,180 @@
+package armor
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// ErrorPages are the Go html template files of the error responses by
+	// status, e.g. `404`, class, `4xx` or `5xx`, or `default`.
+	ErrorPages map[string]string
+
+	// ErrorPageData is the data of the error page templates.
+	ErrorPageData struct {
+		Code      int
+		Status    string
+		Message   string
+		Method    string
+		Host      string
+		Path      string
+		URI       string
+		RequestID string
+		// Username of the auth plugins, e.g. the CAS username
+		Username string
+		Time     time.Time
+	}
+
+	// errorTemplates are the parsed templates by file.
+	errorTemplates struct {
+		mutex     sync.RWMutex
+		templates map[string]*template.Template
+	}
+)
+
+// page returns the template file of the status code, if any.
+func (p ErrorPages) page(code int) string {
+	s := strconv.Itoa(code)
+	for _, k := range []string{s, s[:1] + "xx", "default"} {
+		if f, ok := p[k]; ok {
+			return f
+		}
+	}
+	return ""
+}
+
+func (p ErrorPages) validate() error {
+	for k, f := range p {
+		code, err := strconv.Atoi(k)
+		if k != "4xx" && k != "5xx" && k != "default" && (err != nil || code < 400 || code > 599) {
+			return fmt.Errorf("invalid error page status=%s", k)
+		}
+		if _, err := template.ParseFiles(f); err != nil {
+			return fmt.Errorf("invalid error page=%s, %v", f, err)
+		}
+	}
+	return nil
+}
+
+// ValidateErrorPages parses the global and host error pages.
+func (a *Armor) ValidateErrorPages() error {
+	if err := a.ErrorPages.validate(); err != nil {
+		return err
+	}
+	for name, h := range a.Hosts {
+		if err := h.ErrorPages.validate(); err != nil {
+			return fmt.Errorf("host=%s, %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (t *errorTemplates) get(file string) (*template.Template, error) {
+	t.mutex.RLock()
+	tmpl := t.templates[file]
+	t.mutex.RUnlock()
+	if tmpl != nil {
+		return tmpl, nil
+	}
+	tmpl, err := template.ParseFiles(file)
+	if err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.templates == nil {
+		t.templates = map[string]*template.Template{}
+	}
+	t.templates[file] = tmpl
+	return tmpl, nil
+}
+
+// reset drops the parsed templates, e.g. on reload.
+func (t *errorTemplates) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.templates = nil
+}
+
+// errorPage returns the template file of the host and status code, the host
+// pages first.
+func (a *Armor) errorPage(host string, code int) (file string) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if h := a.Hosts[util.StripPort(host)]; h != nil {
+		h.mutex.RLock()
+		file = h.ErrorPages.page(code)
+		h.mutex.RUnlock()
+	}
+	if file == "" {
+		file = a.ErrorPages.page(code)
+	}
+	return
+}
+
+// acceptsHTML reports whether the client of r takes an HTML page, API
+// clients asking for JSON get the default error.
+func acceptsHTML(r *http.Request) bool {
+	accept := r.Header.Get(echo.HeaderAccept)
+	return accept == "" || strings.Contains(accept, echo.MIMETextHTML) || strings.Contains(accept, "*/*") ||
+		strings.Contains(accept, "text/*")
+}
+
+// errorHandler renders the error pages, falling back to fallback without a
+// page for the error.
+func (a *Armor) errorHandler(fallback echo.HTTPErrorHandler) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		code, msg := http.StatusInternalServerError, ""
+		if he, ok := err.(*echo.HTTPError); ok {
+			code = he.Code
+			msg, _ = he.Message.(string)
+		}
+		if msg == "" {
+			msg = http.StatusText(code)
+		}
+		req := c.Request()
+		if c.Response().Committed || req.Method == http.MethodHead || !acceptsHTML(req) {
+			fallback(err, c)
+			return
+		}
+		file := a.errorPage(req.Host, code)
+		if file == "" {
+			fallback(err, c)
+			return
+		}
+		buf := new(bytes.Buffer)
+		t, terr := a.errorTemplates.get(file)
+		if terr == nil {
+			terr = t.Execute(buf, &ErrorPageData{
+				Code:      code,
+				Status:    http.StatusText(code),
+				Message:   msg,
+				Method:    req.Method,
+				Host:      req.Host,
+				Path:      req.URL.Path,
+				URI:       req.RequestURI,
+				RequestID: plugin.GetRequestID(c),
+				Username:  plugin.AuthSubject(c),
+				Time:      time.Now(),
+			})
+		}
+		if terr != nil {
+			a.Logger.Errorf("error page=%s, %v", file, terr)
+			fallback(err, c)
+			return
+		}
+		if err := c.HTMLBlob(code, buf.Bytes()); err != nil {
+			a.Logger.Error(err)
+		}
+	}
+}
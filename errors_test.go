@@ -0,0 +1,83 @@
+package armor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	page := func(name, body string) string {
+		f := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(f, []byte(body), 0644))
+		return f
+	}
+
+	e := echo.New()
+	a := &Armor{
+		Echo:       e,
+		Logger:     log.New("armor"),
+		ErrorPages: ErrorPages{"5xx": page("5xx.html", "{{.Code}} {{.Status}}")},
+		Hosts: Hosts{"example.com": &Host{
+			ErrorPages: ErrorPages{"403": page("403.html", "{{.Username}} may not see {{.Path}}")},
+		}},
+	}
+	assert.NoError(t, a.ValidateErrorPages())
+	e.HTTPErrorHandler = a.errorHandler(e.DefaultHTTPErrorHandler)
+	e.GET("/admin", func(c echo.Context) error {
+		c.Set("casUsername", "jon")
+		return echo.ErrForbidden
+	})
+	e.GET("/fail", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusBadGateway)
+	})
+	do := func(host, path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		if accept != "" {
+			req.Header.Set(echo.HeaderAccept, accept)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Host page
+	rec := do("example.com:8080", "/admin", "text/html,*/*;q=0.8")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, echo.MIMETextHTMLCharsetUTF8, rec.Header().Get(echo.HeaderContentType))
+	assert.Equal(t, "jon may not see /admin", rec.Body.String())
+
+	// Global class page
+	rec = do("example.com", "/fail", "")
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Equal(t, "502 Bad Gateway", rec.Body.String())
+
+	// JSON clients
+	rec = do("example.com", "/admin", echo.MIMEApplicationJSON)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"message":"Forbidden"`)
+
+	// No page
+	rec = do("other.com", "/admin", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"message":"Forbidden"`)
+
+	// Invalid
+	a.ErrorPages = ErrorPages{"200": page("200.html", "")}
+	assert.Error(t, a.ValidateErrorPages())
+	a.ErrorPages = ErrorPages{"404": filepath.Join(dir, "missing.html")}
+	assert.Error(t, a.ValidateErrorPages())
+}
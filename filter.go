@@ -0,0 +1,98 @@
+package armor
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// PathCondition matches requests by path prefix and, optionally, method.
+	PathCondition struct {
+		Prefix  string
+		Methods []string
+	}
+
+	// Filter applies Chain to the requests matching When.
+	Filter struct {
+		When  PathCondition
+		Chain *PluginChain
+	}
+
+	// FilteredChain routes each request to the chain of the first matching
+	// filter or to Default, e.g. CAS and casbin for `/admin` only. A nil
+	// Default passes other requests through.
+	FilteredChain struct {
+		Filters []Filter
+		Default *PluginChain
+
+		// Handler handles the requests behind the chain for `ServeHTTP`,
+		// default not found.
+		Handler echo.HandlerFunc
+
+		once sync.Once
+		echo *echo.Echo
+	}
+)
+
+// Match reports whether the request matches the condition. The prefix is
+// matched by segments of the cleaned path, e.g. `/admin` matches `/admin`,
+// `/admin/users` and `//admin`, not `/administrator`.
+func (pc PathCondition) Match(r *http.Request) bool {
+	p := path.Clean("/" + r.URL.Path)
+	if p != pc.Prefix && !strings.HasPrefix(p, strings.TrimSuffix(pc.Prefix, "/")+"/") {
+		return false
+	}
+	if len(pc.Methods) == 0 {
+		return true
+	}
+	for _, m := range pc.Methods {
+		if strings.EqualFold(m, r.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Process applies the chain selected for the request.
+func (fc *FilteredChain) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	chains := make([]echo.HandlerFunc, len(fc.Filters))
+	for i, f := range fc.Filters {
+		chains[i] = f.Chain.Process(next)
+	}
+	def := next
+	if fc.Default != nil {
+		def = fc.Default.Process(next)
+	}
+	return func(c echo.Context) error {
+		for i, f := range fc.Filters {
+			if f.When.Match(c.Request()) {
+				return chains[i](c)
+			}
+		}
+		return def(c)
+	}
+}
+
+// Middleware returns the filtered chain as a single middleware.
+func (fc *FilteredChain) Middleware() echo.MiddlewareFunc {
+	return fc.Process
+}
+
+// ServeHTTP serves the request through the filtered chain and `Handler`.
+func (fc *FilteredChain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fc.once.Do(func() {
+		fc.echo = echo.New()
+	})
+	h := fc.Handler
+	if h == nil {
+		h = echo.NotFoundHandler
+	}
+	c := fc.echo.NewContext(r, w)
+	if err := fc.Process(h)(c); err != nil {
+		fc.echo.HTTPErrorHandler(err, c)
+	}
+}
@@ -0,0 +1,69 @@
+package armor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilteredChain(t *testing.T) {
+	chain := func(name string) *PluginChain {
+		return &PluginChain{plugins: []plugin.Plugin{Middleware(name, 1)(headerMiddleware(name))}}
+	}
+	fc := &FilteredChain{
+		Filters: []Filter{
+			{When: PathCondition{Prefix: "/admin"}, Chain: chain("admin")},
+			{When: PathCondition{Prefix: "/api", Methods: []string{http.MethodPost}}, Chain: chain("api-write")},
+			{When: PathCondition{Prefix: "/api"}, Chain: chain("api")},
+		},
+		Default: chain("default"),
+		Handler: func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		},
+	}
+	serve := func(method, path string) string {
+		req := httptest.NewRequest(method, path, nil)
+		rec := httptest.NewRecorder()
+		fc.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header().Get("X-Middleware")
+	}
+	assert.Equal(t, "admin", serve(echo.GET, "/admin/users"))
+	assert.Equal(t, "api-write", serve(echo.POST, "/api/users"))
+	assert.Equal(t, "api", serve(echo.GET, "/api/users"))
+	assert.Equal(t, "default", serve(echo.GET, "/"))
+
+	// Segments of the cleaned path
+	for _, path := range []string{"/admin", "/admin/", "//admin", "/./admin", "/public/../admin/users"} {
+		assert.Equal(t, "admin", serve(echo.GET, path), path)
+	}
+	assert.Equal(t, "default", serve(echo.GET, "/administrator"))
+
+	// Middleware, no default
+	fc.Default = nil
+	e := echo.New()
+	e.Use(fc.Middleware())
+	e.GET("/*", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	req := httptest.NewRequest(echo.GET, "/public", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "", rec.Header().Get("X-Middleware"))
+	req = httptest.NewRequest(echo.GET, "/admin", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, "admin", rec.Header().Get("X-Middleware"))
+
+	// Not found
+	fc.Handler = nil
+	req = httptest.NewRequest(echo.GET, "/", nil)
+	rec = httptest.NewRecorder()
+	fc.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -16,6 +16,8 @@ import (
 	"github.com/mitchellh/go-homedir"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type (
@@ -37,19 +39,11 @@ func (a *Armor) NewHTTP() (h *HTTP) {
 	}
 	e.HideBanner = true
 	e.HidePort = true
-	e.Server = &http.Server{
-		Addr:         a.Address,
-		ReadTimeout:  a.ReadTimeout * time.Second,
-		WriteTimeout: a.WriteTimeout * time.Second,
-	}
+	e.Server = a.newServer(a.Address)
 	if a.TLS != nil {
 		_, a.TLS.Port, _ = net.SplitHostPort(a.TLS.Address)
-		e.TLSServer = &http.Server{
-			Addr:         a.TLS.Address,
-			TLSConfig:    a.setupTLSConfig(),
-			ReadTimeout:  a.ReadTimeout * time.Second,
-			WriteTimeout: a.WriteTimeout * time.Second,
-		}
+		e.TLSServer = a.newServer(a.TLS.Address)
+		e.TLSServer.TLSConfig = a.setupTLSConfig()
 		e.AutoTLSManager.Email = a.TLS.Email
 		e.AutoTLSManager.Client = new(acme.Client)
 		if a.TLS.DirectoryURL != "" {
@@ -57,6 +51,7 @@ func (a *Armor) NewHTTP() (h *HTTP) {
 		}
 	}
 	e.Logger = h.logger
+	e.HTTPErrorHandler = a.errorHandler(e.DefaultHTTPErrorHandler)
 
 	// Internal
 	e.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -67,10 +62,43 @@ func (a *Armor) NewHTTP() (h *HTTP) {
 			return next(c)
 		}
 	})
+	e.Pre(a.metricsMiddleware())
 
 	return
 }
 
+// newServer returns a server on address with the timeouts and limits.
+func (a *Armor) newServer(address string) *http.Server {
+	readHeaderTimeout, idleTimeout := a.ReadHeaderTimeout, a.IdleTimeout
+	if readHeaderTimeout <= 0 {
+		readHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	return &http.Server{
+		Addr:              address,
+		ReadTimeout:       a.ReadTimeout * time.Second,
+		ReadHeaderTimeout: readHeaderTimeout * time.Second,
+		WriteTimeout:      a.WriteTimeout * time.Second,
+		IdleTimeout:       idleTimeout * time.Second,
+		MaxHeaderBytes:    a.MaxHeaderBytes,
+	}
+}
+
+// listen returns the listener of a server on address, accepting the PROXY
+// protocol if enabled.
+func (a *Armor) listen(address string) (net.Listener, error) {
+	ln, err := a.Listen(address)
+	if err != nil || a.ProxyProtocol == nil {
+		return ln, err
+	}
+	if ln, err = a.ProxyProtocol.wrap(ln); err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
 func (h *HTTP) CreateTunnel() {
 	c := &tunnel.Configuration{
 		Host:       "labstack.me:22",
@@ -95,9 +123,39 @@ func (h *HTTP) Start() error {
 	} else {
 		a.Colorer.Printf("⇨ http server started on %s\n", a.Colorer.Green(a.Address))
 	}
+	if e.Listener == nil {
+		ln, err := a.listen(a.Address)
+		if err != nil {
+			return err
+		}
+		e.Listener = ln
+	}
+	if a.H2C {
+		return h.startH2C()
+	}
 	return e.StartServer(e.Server)
 }
 
+// startH2C serves HTTP/2 cleartext, e.g. gRPC without TLS, along with HTTP/1.
+func (h *HTTP) startH2C() error {
+	e := h.echo
+	s := e.Server
+	s.ErrorLog = e.StdLogger
+	// StartServer replaces the handler
+	s.Handler = h2c.NewHandler(h.handler(), new(http2.Server))
+	return s.Serve(e.Listener)
+}
+
+// handler returns the handler of the HTTP server, serving the "http-01"
+// challenges of auto TLS too.
+func (h *HTTP) handler() http.Handler {
+	a := h.armor
+	if a.TLS != nil && a.TLS.Auto && a.TLS.DNS == nil {
+		return h.echo.AutoTLSManager.HTTPHandler(h.echo)
+	}
+	return h.echo
+}
+
 func (h *HTTP) StartTLS() error {
 	a := h.armor
 	e := h.echo
@@ -106,15 +164,8 @@ func (h *HTTP) StartTLS() error {
 	// Enable HTTP/2
 	s.TLSConfig.NextProtos = append(s.TLSConfig.NextProtos, "h2")
 
+	var dnsm *dnsManager
 	if a.TLS.Auto {
-		// Enable the "http-01" challenge
-		e.Server.Handler = e.AutoTLSManager.HTTPHandler(e.Server.Handler)
-
-		hosts := []string{}
-		for host := range a.Hosts {
-			hosts = append(hosts, host)
-		}
-		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(hosts...) // Added security
 		home, err := homedir.Dir()
 		if err != nil {
 			return err
@@ -122,40 +173,72 @@ func (h *HTTP) StartTLS() error {
 		if a.TLS.CacheDir == "" {
 			a.TLS.CacheDir = filepath.Join(home, ".armor", "cache")
 		}
-		e.AutoTLSManager.Cache = autocert.DirCache(a.TLS.CacheDir)
+		cache := autocert.DirCache(a.TLS.CacheDir)
+
+		if a.TLS.DNS != nil {
+			// Enable the "dns-01" challenge
+			if dnsm, err = a.newDNSManager(cache); err != nil {
+				return err
+			}
+		} else {
+			// Enable the "http-01" challenge, of the handler of h2c
+			if !a.H2C {
+				e.Server.Handler = e.AutoTLSManager.HTTPHandler(e.Server.Handler)
+			}
+
+			hosts := append([]string(nil), a.TLS.Domains...)
+			for host := range a.Hosts {
+				hosts = append(hosts, host)
+			}
+			e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(hosts...) // Added security
+			e.AutoTLSManager.Cache = cache
+		}
 	}
 
 	// Load certificates - start
+	// Reloaded when the files change and stapled with OCSP
+	certs := newCertStore(h.logger)
 	// Global
 	if a.TLS.CertFile != "" && a.TLS.KeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(a.TLS.CertFile, a.TLS.KeyFile)
-		if err != nil {
+		if err := certs.add(a.TLS.CertFile, a.TLS.KeyFile); err != nil {
 			h.logger.Fatal(err)
 		}
-		s.TLSConfig.Certificates = append(s.TLSConfig.Certificates, cert)
 	}
 	// Host
-	for _, host := range a.Hosts {
+	for name, host := range a.Hosts {
+		if host.TLS != nil {
+			if err := host.TLS.apply(new(tls.Config)); err != nil {
+				h.logger.Fatalf("host=%s, %v", name, err)
+			}
+		}
 		if host.CertFile == "" || host.KeyFile == "" {
 			continue
 		}
-		cert, err := tls.LoadX509KeyPair(host.CertFile, host.KeyFile)
-		if err != nil {
+		if err := certs.add(host.CertFile, host.KeyFile); err != nil {
 			h.logger.Fatal(err)
 		}
-		s.TLSConfig.Certificates = append(s.TLSConfig.Certificates, cert)
 	}
-	s.TLSConfig.BuildNameToCertificate()
+	go certs.watch(nil)
 	// Load certificates - end
 
 	s.TLSConfig.GetCertificate = func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-		if cert, ok := s.TLSConfig.NameToCertificate[clientHello.ServerName]; ok {
+		if cert := certs.get(clientHello.ServerName); cert != nil {
 			// Use provided certificate
 			return cert, nil
+		} else if dnsm != nil {
+			return dnsm.GetCertificate(clientHello)
 		} else if a.TLS.Auto {
 			return e.AutoTLSManager.GetCertificate(clientHello)
 		}
-		return nil, nil // No certificate
+		return certs.fallback(), nil
+	}
+
+	if e.TLSListener == nil {
+		ln, err := a.listen(a.TLS.Address)
+		if err != nil {
+			return err
+		}
+		e.TLSListener = tls.NewListener(ln, s.TLSConfig)
 	}
 
 	a.Colorer.Printf("⇨ https server started on %s\n", a.Colorer.Green(a.TLS.Address))
@@ -0,0 +1,43 @@
+package armor
+
+import (
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// Interceptor wraps every plugin invocation of a chain, e.g. for tracing.
+	// An error from `Before` stops the request, `After` gets the error
+	// returned by the plugin.
+	Interceptor interface {
+		Before(p plugin.Plugin, c echo.Context) error
+		After(p plugin.Plugin, c echo.Context, err error)
+	}
+)
+
+// AddInterceptor adds an interceptor to the chain, interceptors run in the
+// order they are added.
+func (pc *PluginChain) AddInterceptor(i Interceptor) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.interceptors = append(pc.interceptors, i)
+}
+
+// intercept runs the interceptors around h, the handler of plugin p.
+func intercept(interceptors []Interceptor, p plugin.Plugin, h echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		for i, ic := range interceptors {
+			if err = ic.Before(p, c); err != nil {
+				for j := i - 1; j >= 0; j-- {
+					interceptors[j].After(p, c, err)
+				}
+				return
+			}
+		}
+		err = h(c)
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptors[i].After(p, c, err)
+		}
+		return
+	}
+}
@@ -0,0 +1,57 @@
+package armor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type recorder struct {
+	calls  []string
+	reject string
+}
+
+func (r *recorder) Before(p plugin.Plugin, c echo.Context) error {
+	r.calls = append(r.calls, "before:"+p.Name())
+	if p.Name() == r.reject {
+		return echo.ErrForbidden
+	}
+	return nil
+}
+
+func (r *recorder) After(p plugin.Plugin, c echo.Context, err error) {
+	s := "after:" + p.Name()
+	if err != nil {
+		s += ":" + err.Error()
+	}
+	r.calls = append(r.calls, s)
+}
+
+func TestInterceptor(t *testing.T) {
+	chain := &PluginChain{plugins: []plugin.Plugin{
+		Middleware("one", 1)(headerMiddleware("one")),
+		Middleware("two", 2)(headerMiddleware("two")),
+	}}
+	r := new(recorder)
+	chain.AddInterceptor(r)
+	e := echo.New()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	assert.NoError(t, chain.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(t, []string{"before:one", "before:two", "after:two", "after:one"}, r.calls)
+
+	// Reject
+	r.calls, r.reject = nil, "two"
+	rec := httptest.NewRecorder()
+	err := chain.Process(ok)(e.NewContext(req, rec))
+	assert.Equal(t, echo.ErrForbidden, err)
+	assert.Equal(t, []string{"before:one", "before:two", "after:one:" + echo.ErrForbidden.Error()}, r.calls)
+	assert.Equal(t, "one", rec.Header().Get("X-Middleware"))
+}
@@ -0,0 +1,24 @@
+package armor
+
+import (
+	"github.com/labstack/armor/plugin"
+)
+
+type (
+	// MemoryEstimator is implemented by plugins which can estimate the memory,
+	// in bytes, their config consumes at most, e.g. for caches and buffers.
+	MemoryEstimator interface {
+		EstimateMemory() int64
+	}
+)
+
+// EstimateTotalMemory sums the memory estimates of the plugins implementing
+// `MemoryEstimator`.
+func EstimateTotalMemory(plugins []plugin.Plugin) (total int64) {
+	for _, p := range plugins {
+		if m, ok := p.(MemoryEstimator); ok {
+			total += m.EstimateMemory()
+		}
+	}
+	return
+}
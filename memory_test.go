@@ -0,0 +1,31 @@
+package armor
+
+import (
+	"testing"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateTotalMemory(t *testing.T) {
+	chain, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginCas, "url": "https://cas.labstack.com/cas", "casbin": map[string]interface{}{
+				"model":             "plugin/testdata/casbin_model.conf",
+				"policy":            "plugin/testdata/casbin_policy.csv",
+				"enforce_cache_ttl": "1m",
+			}},
+			{"name": plugin.PluginBodyInspect},
+			{"name": plugin.PluginGzip},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	plugins := chain.Plugins()
+	cas := plugins[0].(MemoryEstimator).EstimateMemory()
+	assert.True(t, cas > 100<<10 && cas < 1<<20, "cas=%d", cas) // 1000 entries
+	body := plugins[1].(MemoryEstimator).EstimateMemory()
+	assert.Equal(t, int64(1<<20), body)
+	assert.Equal(t, cas+body, EstimateTotalMemory(plugins))
+}
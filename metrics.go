@@ -0,0 +1,87 @@
+package armor
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "armor_http_requests_total",
+		Help: "Number of requests served by host and status class.",
+	}, []string{"host", "code"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "armor_http_request_duration_seconds",
+		Help:    "Duration of the requests served by host.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpRequestDuration)
+}
+
+func (m *Metrics) path() string {
+	if m.Path == "" {
+		return "/metrics"
+	}
+	return m.Path
+}
+
+// metricsHost returns the configured host name of r, empty for others to
+// bound the label values.
+func (a *Armor) metricsHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if _, ok := a.Hosts[host]; ok {
+		return host
+	}
+	return ""
+}
+
+// metricsMiddleware counts the requests and serves the metrics if not on a
+// separate listener.
+func (a *Armor) metricsMiddleware() echo.MiddlewareFunc {
+	var handler echo.HandlerFunc
+	path := ""
+	if a.Metrics != nil && a.Metrics.Address == "" {
+		handler, path = echo.WrapHandler(promhttp.Handler()), a.Metrics.path()
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if handler != nil && c.Request().URL.Path == path {
+				return handler(c)
+			}
+			start := time.Now()
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+			host := a.metricsHost(c.Request())
+			httpRequests.WithLabelValues(host, plugin.StatusClass(c.Response().Status)).Inc()
+			httpRequestDuration.WithLabelValues(host).Observe(time.Since(start).Seconds())
+			return nil
+		}
+	}
+}
+
+// StartMetrics serves the metrics on the metrics address.
+func (a *Armor) StartMetrics() error {
+	mux := http.NewServeMux()
+	mux.Handle(a.Metrics.path(), promhttp.Handler())
+	ln, err := a.Listen(a.Metrics.Address)
+	if err != nil {
+		return err
+	}
+	a.Colorer.Printf("⇨ metrics server started on %s\n", a.Colorer.Green(a.Metrics.Address))
+	return http.Serve(ln, mux)
+}
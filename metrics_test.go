@@ -0,0 +1,42 @@
+package armor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	a := &Armor{
+		Logger:  log.New("armor"),
+		Metrics: &Metrics{},
+		Hosts:   Hosts{"example.com": new(Host)},
+	}
+	a.NewHTTP()
+	a.Echo.GET("/", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	ok := httpRequests.WithLabelValues("example.com", "2xx")
+	notFound := httpRequests.WithLabelValues("", "4xx")
+	okBefore, notFoundBefore := testutil.ToFloat64(ok), testutil.ToFloat64(notFound)
+
+	rec := httptest.NewRecorder()
+	a.Echo.ServeHTTP(rec, httptest.NewRequest(echo.GET, "http://example.com:8080/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = httptest.NewRecorder()
+	a.Echo.ServeHTTP(rec, httptest.NewRequest(echo.GET, "http://other.com/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, okBefore+1, testutil.ToFloat64(ok))
+	assert.Equal(t, notFoundBefore+1, testutil.ToFloat64(notFound))
+
+	// Served on the main server
+	rec = httptest.NewRecorder()
+	a.Echo.ServeHTTP(rec, httptest.NewRequest(echo.GET, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `armor_http_requests_total{code="2xx",host="example.com"}`)
+}
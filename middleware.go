@@ -0,0 +1,13 @@
+package armor
+
+import (
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+)
+
+// Middleware returns a decorator which turns an `echo.MiddlewareFunc` into a
+// plugin with the given name and order, e.g.
+// `armor.Middleware("cors", 10)(middleware.CORS())`, see `plugin.Middleware`.
+func Middleware(name string, order int) func(echo.MiddlewareFunc) plugin.Plugin {
+	return plugin.Middleware(name, order)
+}
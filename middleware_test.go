@@ -0,0 +1,48 @@
+package armor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func headerMiddleware(value string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Response().Header().Set("X-Middleware", value)
+			return next(c)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+
+	p := Middleware("test", 10)(headerMiddleware("one"))
+	assert.Equal(t, "test", p.Name())
+	assert.Equal(t, 10, p.Order())
+
+	p.Initialize()
+	rec := httptest.NewRecorder()
+	assert.NoError(t, p.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, "one", rec.Header().Get("X-Middleware"))
+
+	// Update
+	p.Update(Middleware("test", 10)(headerMiddleware("two")))
+	rec = httptest.NewRecorder()
+	assert.NoError(t, p.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, "two", rec.Header().Get("X-Middleware"))
+	plugin.Update(p, Middleware("test", 10)(headerMiddleware("three")))
+	rec = httptest.NewRecorder()
+	assert.NoError(t, p.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, "three", rec.Header().Get("X-Middleware"))
+	assert.Equal(t, "test", plugin.Describe(p).Name)
+}
@@ -0,0 +1,63 @@
+package armor
+
+import (
+	"context"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+type (
+	// OpenAPITagger is implemented by plugins tagging the operations they
+	// handle in the generated OpenAPI document.
+	OpenAPITagger interface {
+		OpenAPITag() *openapi3.Tag
+	}
+
+	// OpenAPISecurer is implemented by plugins authenticating requests, the
+	// scheme is required for all operations behind the chain.
+	OpenAPISecurer interface {
+		OpenAPISecurityScheme() *openapi3.SecurityScheme
+	}
+)
+
+// GenerateOpenAPISpec builds an OpenAPI 3 document describing the security
+// requirements of chain. Security schemes are named after their plugin.
+func GenerateOpenAPISpec(chain *PluginChain) (*openapi3.T, error) {
+	doc := &openapi3.T{
+		OpenAPI: "3.0.3",
+		Info: &openapi3.Info{
+			Title:   "armor",
+			Version: Version,
+		},
+		Paths: openapi3.Paths{},
+	}
+	requirement := openapi3.NewSecurityRequirement()
+	for _, p := range chain.Plugins() {
+		if t, ok := p.(OpenAPITagger); ok {
+			if tag := t.OpenAPITag(); tag != nil && doc.Tags.Get(tag.Name) == nil {
+				doc.Tags = append(doc.Tags, tag)
+			}
+		}
+		if s, ok := p.(OpenAPISecurer); ok {
+			scheme := s.OpenAPISecurityScheme()
+			if scheme == nil {
+				continue
+			}
+			if _, ok := requirement[p.Name()]; ok {
+				continue
+			}
+			if doc.Components.SecuritySchemes == nil {
+				doc.Components.SecuritySchemes = openapi3.SecuritySchemes{}
+			}
+			doc.Components.SecuritySchemes[p.Name()] = &openapi3.SecuritySchemeRef{Value: scheme}
+			requirement.Authenticate(p.Name())
+		}
+	}
+	if len(requirement) > 0 {
+		doc.Security = openapi3.SecurityRequirements{requirement}
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,50 @@
+package armor
+
+import (
+	"testing"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateOpenAPISpec(t *testing.T) {
+	chain, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginHeader, "set": map[string]interface{}{"X-Name": "armor"}},
+			{"name": plugin.PluginCas, "url": "https://cas.labstack.com/cas"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc, err := GenerateOpenAPISpec(chain)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, doc.Tags, 1) {
+		assert.Equal(t, "CAS SSO", doc.Tags[0].Name)
+	}
+	if s := doc.Components.SecuritySchemes[plugin.PluginCas]; assert.NotNil(t, s) {
+		assert.Equal(t, "apiKey", s.Value.Type)
+		assert.Equal(t, "cookie", s.Value.In)
+		assert.Equal(t, "_cas_session", s.Value.Name)
+	}
+	if assert.Len(t, doc.Security, 1) {
+		assert.Contains(t, doc.Security[0], plugin.PluginCas)
+	}
+
+	// No authentication
+	chain, err = Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginHeader, "set": map[string]interface{}{"X-Name": "armor"}},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc, err = GenerateOpenAPISpec(chain)
+	if assert.NoError(t, err) {
+		assert.Empty(t, doc.Components.SecuritySchemes)
+		assert.Empty(t, doc.Security)
+	}
+}
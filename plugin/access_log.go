@@ -0,0 +1,365 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+	cas "gopkg.in/cas.v2"
+)
+
+// Access logs of the requests as JSON lines or in the Apache combined format,
+// written to stdout, a rotated file or syslog.
+
+type (
+	AccessLog struct {
+		Base            `json:",squash" yaml:",squash"`
+		AccessLogConfig `json:",squash" yaml:",squash"`
+
+		sink       accessLogSink
+		sinkConfig AccessLogOutput
+	}
+
+	AccessLogConfig struct {
+		// Format is `json` (default) or `combined`.
+		Format string `yaml:"format"`
+
+		// Fields are the fields of the json format, in order, default
+		// time, remote_ip, host, method, uri, status, bytes_in, bytes_out,
+		// latency_ms, referer, user_agent and user.
+		Fields []string `yaml:"fields"`
+
+		// Output is where the logs are written, default stdout.
+		Output AccessLogOutput `yaml:"output"`
+
+		// TrustedProxies are the proxies the client IP is read from
+		// X-Forwarded-For of, as in the ip-filter plugin. Without, it is the
+		// address of the connection, the PROXY protocol one behind a load
+		// balancer.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+
+		// Hosts, if set, are the only hosts logged, SkipHosts are never
+		// logged.
+		Hosts     []string `yaml:"hosts"`
+		SkipHosts []string `yaml:"skip_hosts"`
+
+		// SampleRate, from 0 to 1 (default), is the share of the requests
+		// logged. Server errors are always logged.
+		SampleRate *float64 `yaml:"sample_rate"`
+
+		// SkipPaths are requests not logged, e.g. `/health`.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// AccessLogOutput is `stdout` (default), `file` or `syslog`.
+	AccessLogOutput struct {
+		Type string `yaml:"type"`
+
+		// Path of the file, rotated after MaxSize megabytes (default 100).
+		// MaxBackups rotated files are kept, all if 0, for MaxAge days, forever
+		// if 0, and gzipped if Compress.
+		Path       string `yaml:"path"`
+		MaxSize    int    `yaml:"max_size"`
+		MaxBackups int    `yaml:"max_backups"`
+		MaxAge     int    `yaml:"max_age"`
+		Compress   bool   `yaml:"compress"`
+
+		// Network and Address of the syslog server, the local one if empty,
+		// Tag of the messages, default `armor`.
+		Network string `yaml:"network"`
+		Address string `yaml:"address"`
+		Tag     string `yaml:"tag"`
+	}
+)
+
+const (
+	// Formats
+	AccessLogJSON     = "json"
+	AccessLogCombined = "combined"
+
+	// Outputs
+	AccessLogStdout = "stdout"
+	AccessLogFile   = "file"
+	AccessLogSyslog = "syslog"
+
+	combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+var (
+	accessLogDefaultFields = []string{"time", "remote_ip", "host", "method", "uri", "status",
+		"bytes_in", "bytes_out", "latency_ms", "referer", "user_agent", "user"}
+
+	accessLogFields = map[string]bool{
+		"time": true, "remote_ip": true, "remote_port": true, "host": true, "method": true, "uri": true,
+		"path": true, "protocol": true, "status": true, "bytes_in": true, "bytes_out": true,
+		"latency_ms": true, "referer": true, "user_agent": true, "request_id": true,
+		"user": true, "cas_username": true, "cas_attributes": true, "error": true,
+	}
+)
+
+func (c AccessLogConfig) fields() []string {
+	if len(c.Fields) == 0 {
+		return accessLogDefaultFields
+	}
+	return c.Fields
+}
+
+func (c AccessLogConfig) sampleRate() float64 {
+	if c.SampleRate == nil {
+		return 1
+	}
+	return *c.SampleRate
+}
+
+// hostLogged reports if the requests to host are logged.
+func (c AccessLogConfig) hostLogged(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range c.SkipHosts {
+		if strings.EqualFold(h, host) {
+			return false
+		}
+	}
+	if len(c.Hosts) == 0 {
+		return true
+	}
+	for _, h := range c.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func validAccessLogField(f string) bool {
+	if strings.HasPrefix(f, "header:") || strings.HasPrefix(f, "cas_attribute:") {
+		return !strings.HasSuffix(f, ":")
+	}
+	return accessLogFields[f]
+}
+
+// accessLogField returns the value of the json field f.
+func accessLogField(c echo.Context, f string, start time.Time, latency time.Duration, err error, trusted util.IPNets) interface{} {
+	req, res := c.Request(), c.Response()
+	switch f {
+	case "time":
+		return start.Format(time.RFC3339Nano)
+	case "remote_ip":
+		return remoteIP(req, trusted)
+	case "remote_port":
+		_, port, _ := net.SplitHostPort(req.RemoteAddr)
+		return port
+	case "host":
+		return req.Host
+	case "method":
+		return req.Method
+	case "uri":
+		return req.RequestURI
+	case "path":
+		return req.URL.Path
+	case "protocol":
+		return req.Proto
+	case "status":
+		return res.Status
+	case "bytes_in":
+		n, _ := strconv.ParseInt(req.Header.Get(echo.HeaderContentLength), 10, 64)
+		return n
+	case "bytes_out":
+		return res.Size
+	case "latency_ms":
+		return float64(latency) / float64(time.Millisecond)
+	case "referer":
+		return req.Referer()
+	case "user_agent":
+		return req.UserAgent()
+	case "request_id":
+		return GetRequestID(c)
+	case "user":
+		return AuthSubject(c)
+	case "cas_username":
+		s, _ := c.Get("casUsername").(string)
+		return s
+	case "cas_attributes":
+		attr, _ := c.Get("casAttributes").(cas.UserAttributes)
+		if attr == nil {
+			return map[string][]string{}
+		}
+		return attr
+	case "error":
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+	if strings.HasPrefix(f, "header:") {
+		return req.Header.Get(f[len("header:"):])
+	}
+	if strings.HasPrefix(f, "cas_attribute:") {
+		attr, _ := c.Get("casAttributes").(cas.UserAttributes)
+		return strings.Join(attr[f[len("cas_attribute:"):]], " ")
+	}
+	return nil
+}
+
+func jsonAccessLog(c echo.Context, fields []string, start time.Time, latency time.Duration, err error, trusted util.IPNets) []byte {
+	b := new(bytes.Buffer)
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(f)
+		v, _ := json.Marshal(accessLogField(c, f, start, latency, err, trusted))
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// combinedAccessLog formats the request in the Apache combined log format.
+func combinedAccessLog(c echo.Context, start time.Time, trusted util.IPNets) []byte {
+	req, res := c.Request(), c.Response()
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	size := "-"
+	if res.Size > 0 {
+		size = strconv.FormatInt(res.Size, 10)
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n",
+		remoteIP(req, trusted),
+		orDash(strings.Replace(AuthSubject(c), " ", "%20", -1)),
+		start.Format(combinedTimeFormat),
+		strconv.Quote(req.Method+" "+req.RequestURI+" "+req.Proto),
+		res.Status,
+		size,
+		strconv.Quote(orDash(req.Referer())),
+		strconv.Quote(orDash(req.UserAgent())),
+	))
+}
+
+func (l *AccessLog) Initialize() {
+	trusted, err := util.ParseIPNets(l.TrustedProxies)
+	if err != nil {
+		if l.Logger != nil {
+			l.Logger.Errorf("access-log: %v", err)
+		}
+		l.Middleware = internalErrorMid
+		return
+	}
+	// The sink is kept on updates of the format
+	if l.sink != nil && l.sinkConfig != l.Output {
+		l.sink.Close()
+		l.sink = nil
+	}
+	if l.sink == nil {
+		sink, err := newAccessLogSink(l.Output)
+		if err != nil {
+			if l.Logger != nil {
+				l.Logger.Errorf("access-log: invalid output: %v", err)
+			}
+			l.Middleware = internalErrorMid
+			return
+		}
+		l.sink, l.sinkConfig = sink, l.Output
+	}
+	sink, config, fields, rate := l.sink, l.AccessLogConfig, l.fields(), l.sampleRate()
+	l.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			if !config.hostLogged(c.Request().Host) {
+				return next(c)
+			}
+			start := time.Now()
+			if err = next(c); err != nil {
+				c.Error(err)
+			}
+			latency := time.Since(start)
+			if c.Response().Status < http.StatusInternalServerError && rate < 1 && rand.Float64() >= rate {
+				return nil
+			}
+			var line []byte
+			if config.Format == AccessLogCombined {
+				line = combinedAccessLog(c, start, trusted)
+			} else {
+				line = jsonAccessLog(c, fields, start, latency, err, trusted)
+			}
+			if _, werr := sink.Write(line); werr != nil && l.Logger != nil {
+				l.Logger.Errorf("access-log: failed to write: %v", werr)
+			}
+			// Handled
+			return nil
+		}
+	}
+}
+
+func (l *AccessLog) Update(p Plugin) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.AccessLogConfig = p.(*AccessLog).AccessLogConfig
+	l.Initialize()
+}
+
+func (l *AccessLog) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return skipPaths(l.SkipPaths, next, l.Middleware(next))
+}
+
+func (l *AccessLog) ValidateConfig() error {
+	switch l.Format {
+	case "", AccessLogJSON, AccessLogCombined:
+	default:
+		return fmt.Errorf("invalid access log format=%s", l.Format)
+	}
+	for _, f := range l.Fields {
+		if !validAccessLogField(f) {
+			return fmt.Errorf("invalid access log field=%s", f)
+		}
+	}
+	switch l.Output.Type {
+	case "", AccessLogStdout, AccessLogSyslog:
+	case AccessLogFile:
+		if l.Output.Path == "" {
+			return errors.New("access-log file output requires a path")
+		}
+	default:
+		return fmt.Errorf("invalid access log output type=%s", l.Output.Type)
+	}
+	if l.Output.MaxSize < 0 || l.Output.MaxBackups < 0 || l.Output.MaxAge < 0 {
+		return errors.New("invalid access log file rotation")
+	}
+	if r := l.sampleRate(); r < 0 || r > 1 {
+		return fmt.Errorf("invalid access log sample rate=%v", r)
+	}
+	if _, err := util.ParseIPNets(l.TrustedProxies); err != nil {
+		return err
+	}
+	return validatePathRules(l.SkipPaths)
+}
+
+// ShutdownGrace closes the output.
+func (l *AccessLog) ShutdownGrace(ctx context.Context) {
+	l.mutex.Lock()
+	s := l.sink
+	l.sink = nil
+	l.mutex.Unlock()
+	if s != nil {
+		s.Close()
+	}
+}
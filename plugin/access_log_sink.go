@@ -0,0 +1,53 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type (
+	// accessLogSink writes the access log lines.
+	accessLogSink interface {
+		io.WriteCloser
+	}
+
+	// stdoutSink writes whole lines to stdout.
+	stdoutSink struct {
+		mutex sync.Mutex
+	}
+)
+
+func (s *stdoutSink) Write(b []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return os.Stdout.Write(b)
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
+
+func newAccessLogSink(o AccessLogOutput) (accessLogSink, error) {
+	switch o.Type {
+	case "", AccessLogStdout:
+		return new(stdoutSink), nil
+	case AccessLogFile:
+		if o.Path == "" {
+			return nil, fmt.Errorf("file output requires a path")
+		}
+		return &lumberjack.Logger{
+			Filename:   o.Path,
+			MaxSize:    o.MaxSize,
+			MaxBackups: o.MaxBackups,
+			MaxAge:     o.MaxAge,
+			Compress:   o.Compress,
+		}, nil
+	case AccessLogSyslog:
+		return newSyslogSink(o)
+	}
+	return nil, fmt.Errorf("invalid output type=%s", o.Type)
+}
@@ -0,0 +1,16 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package plugin
+
+import (
+	"log/syslog"
+)
+
+func newSyslogSink(o AccessLogOutput) (accessLogSink, error) {
+	tag := o.Tag
+	if tag == "" {
+		tag = "armor"
+	}
+	return syslog.Dial(o.Network, o.Address, syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package plugin
+
+import (
+	"errors"
+)
+
+func newSyslogSink(o AccessLogOutput) (accessLogSink, error) {
+	return nil, errors.New("syslog output is not supported on this platform")
+}
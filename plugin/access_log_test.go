@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	cas "gopkg.in/cas.v2"
+)
+
+func accessLogged(l *AccessLog, host string, status int) {
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/orders?page=2", nil)
+	req.Host = host
+	req.Header.Set("User-Agent", "curl/7.64")
+	req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.1")
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.Set("casUsername", "alice")
+	c.Set("casAttributes", cas.UserAttributes{"group": {"staff", "admin"}})
+	l.Process(func(c echo.Context) error {
+		return c.String(status, "OK")
+	})(c)
+}
+
+func TestAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor-access-log")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	rate := 0.0
+	l := initialized(&AccessLog{AccessLogConfig: AccessLogConfig{
+		Fields:         []string{"host", "remote_ip", "remote_port", "uri", "status", "user", "cas_attributes", "cas_attribute:group", "header:User-Agent"},
+		Output:         AccessLogOutput{Type: AccessLogFile, Path: path},
+		TrustedProxies: []string{"192.0.2.1"},
+		SkipHosts:      []string{"internal.example.com"},
+		SampleRate:     &rate,
+	}}).(*AccessLog)
+	assert.NoError(t, l.ValidateConfig())
+
+	// Skipped host and not sampled
+	accessLogged(l, "internal.example.com", http.StatusInternalServerError)
+	accessLogged(l, "example.com", http.StatusOK)
+	// Server errors are always logged
+	accessLogged(l, "example.com:8080", http.StatusBadGateway)
+
+	// Combined format, the file is kept, of untrusted X-Forwarded-For
+	l.Update(&AccessLog{AccessLogConfig: AccessLogConfig{
+		Format: AccessLogCombined,
+		Output: l.Output,
+		Hosts:  []string{"example.com"},
+	}})
+	accessLogged(l, "other.example.com", http.StatusOK)
+	accessLogged(l, "example.com", http.StatusOK)
+	l.ShutdownGrace(context.Background())
+
+	b, err := ioutil.ReadFile(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+	assert.Equal(t, `{"host":"example.com:8080","remote_ip":"203.0.113.1","remote_port":"1234","uri":"/orders?page=2","status":502,"user":"alice",`+
+		`"cas_attributes":{"group":["staff","admin"]},"cas_attribute:group":"staff admin","header:User-Agent":"curl/7.64"}`, lines[0])
+	var v map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &v))
+	assert.Regexp(t, `^192\.0\.2\.1 - alice \[[^\]]+\] "GET /orders\?page=2 HTTP/1\.1" 200 2 "-" "curl/7\.64"$`, lines[1])
+}
+
+func TestAccessLogConfig(t *testing.T) {
+	assert.NoError(t, (&AccessLog{}).ValidateConfig())
+	assert.Error(t, (&AccessLog{AccessLogConfig: AccessLogConfig{Format: "common"}}).ValidateConfig())
+	assert.Error(t, (&AccessLog{AccessLogConfig: AccessLogConfig{Fields: []string{"password"}}}).ValidateConfig())
+	assert.Error(t, (&AccessLog{AccessLogConfig: AccessLogConfig{Fields: []string{"header:"}}}).ValidateConfig())
+	assert.Error(t, (&AccessLog{AccessLogConfig: AccessLogConfig{Output: AccessLogOutput{Type: AccessLogFile}}}).ValidateConfig())
+	assert.Error(t, (&AccessLog{AccessLogConfig: AccessLogConfig{Output: AccessLogOutput{Type: "kafka"}}}).ValidateConfig())
+	rate := 1.5
+	assert.Error(t, (&AccessLog{AccessLogConfig: AccessLogConfig{SampleRate: &rate}}).ValidateConfig())
+	assert.Error(t, (&AccessLog{AccessLogConfig: AccessLogConfig{TrustedProxies: []string{"proxy"}}}).ValidateConfig())
+}
@@ -0,0 +1,368 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/labstack/echo/v4"
+)
+
+// API key authentication, of keys in a file, redis or SQL, with per-key
+// scopes and rate limits.
+
+type (
+	APIKey struct {
+		Base         `json:",squash" yaml:",squash"`
+		APIKeyConfig `json:",squash" yaml:",squash"`
+
+		keys        apiKeyStore
+		limits      rateLimitStore
+		limitConfig RateLimitStoreConfig
+		casbinMid   *casbinMiddleware
+	}
+
+	APIKeyConfig struct {
+		// Header is the request header of the key, default `X-API-Key`.
+		// Query, e.g. `api_key`, is the query parameter of the key of requests
+		// without the header.
+		Header string `yaml:"header"`
+		Query  string `yaml:"query"`
+
+		// Store holds the keys.
+		Store APIKeyStoreConfig `yaml:"store"`
+
+		// CacheTTL keeps the keys of redis and SQL stores, the unknown ones
+		// too, for the duration, default 1m.
+		CacheTTL time.Duration `yaml:"cache_ttl"`
+
+		// Scopes are required of the keys, all of them.
+		Scopes []string `yaml:"scopes"`
+
+		// RateLimit limits the keys without a limit of their own.
+		RateLimit APIKeyRateLimit `yaml:"rate_limit"`
+
+		// SkipPaths are requests passed without authentication, e.g.
+		// `/health` or `GET /public/*`.
+		SkipPaths []string `yaml:"skip_paths"`
+
+		// CasbinCfg authorizes the keys, the owner is the subject. Policies
+		// for the key's scopes apply too.
+		CasbinCfg CasbinConfig `yaml:"casbin"`
+	}
+
+	// APIKeyStoreConfig selects the store of the keys, Backend is `file`
+	// (default), `redis`, `postgres` or `mysql`, URI the file, redis URL,
+	// postgres URI or MySQL DSN. Table is the SQL table, default `api_keys`,
+	// or the prefix of the redis keys, default `armor:apikey:`.
+	APIKeyStoreConfig struct {
+		Backend string `yaml:"backend"`
+		URI     string `yaml:"uri" armor:"probe"`
+		Table   string `yaml:"table"`
+	}
+
+	// APIKeyRateLimit is Requests per Period, default 1s, refilling a bucket
+	// of Burst, default Requests, for each key. Store keeps the buckets, as
+	// in the rate-limit plugin.
+	APIKeyRateLimit struct {
+		Requests int                  `yaml:"requests"`
+		Period   time.Duration        `yaml:"period"`
+		Burst    int                  `yaml:"burst"`
+		Store    RateLimitStoreConfig `yaml:"store"`
+	}
+
+	// APIKeyEntry is a key of a store, by the SHA-256 hex Hash of the key,
+	// or the Key itself in a file. Requests per Period, with Burst, limit the
+	// key instead of the plugin's rate limit.
+	APIKeyEntry struct {
+		Key      string        `yaml:"key"`
+		Hash     string        `yaml:"hash"`
+		Owner    string        `yaml:"owner"`
+		Scopes   []string      `yaml:"scopes"`
+		Requests int           `yaml:"requests"`
+		Period   time.Duration `yaml:"period"`
+		Burst    int           `yaml:"burst"`
+	}
+
+	apiKeyCtxKey int
+)
+
+const (
+	APIKeyOwnerCtxKey apiKeyCtxKey = iota
+	APIKeyScopesCtxKey
+)
+
+func (c APIKeyConfig) header() string {
+	if c.Header == "" {
+		return "X-API-Key"
+	}
+	return c.Header
+}
+
+func (c APIKeyConfig) cacheTTL() time.Duration {
+	if c.CacheTTL <= 0 {
+		return time.Minute
+	}
+	return c.CacheTTL
+}
+
+func (c APIKeyStoreConfig) backend() string {
+	if c.Backend == "" {
+		return APIKeyStoreFile
+	}
+	return c.Backend
+}
+
+func (c APIKeyStoreConfig) table() string {
+	if c.Table == "" {
+		return apiKeySQLTable
+	}
+	return c.Table
+}
+
+// limit returns the rate limit of k, of the key or the default one.
+func (k *APIKeyEntry) limit(def APIKeyRateLimit) RateLimitConfig {
+	if k.Requests > 0 {
+		return RateLimitConfig{Requests: k.Requests, Period: k.Period, Burst: k.Burst}
+	}
+	return RateLimitConfig{Requests: def.Requests, Period: def.Period, Burst: def.Burst}
+}
+
+// hasScopes reports whether the key has all of scopes.
+func (k *APIKeyEntry) hasScopes(scopes []string) bool {
+	for _, s := range scopes {
+		found := false
+		for _, ks := range k.Scopes {
+			if ks == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *APIKey) Initialize() {
+	if a.keys != nil {
+		a.keys.close()
+		a.keys = nil
+	}
+	a.casbinMid = nil
+	// The buckets are kept on updates of the limits
+	if a.limits != nil && a.limitConfig != a.RateLimit.Store {
+		a.limits.close()
+		a.limits = nil
+	}
+	if a.limits == nil {
+		limits, err := newRateLimitStore(a.RateLimit.Store)
+		if err != nil {
+			if a.Logger != nil {
+				a.Logger.Errorf("api-key: invalid rate limit store: %v", err)
+			}
+			a.Middleware = internalErrorMid
+			return
+		}
+		a.limits, a.limitConfig = limits, a.RateLimit.Store
+	}
+	authz := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return next
+	}
+	if a.CasbinCfg.Model != "" {
+		casbinMid, err := newSubjectCasbinMiddleware(a.CasbinCfg, getAPIKeyOwner)
+		if err != nil {
+			if a.Logger != nil {
+				a.Logger.Errorf("api-key: invalid casbin config: %v", err)
+			}
+			a.Middleware = internalErrorMid
+			return
+		}
+		casbinMid.RolesFunc = func(c echo.Context) []string {
+			scopes, _ := c.Request().Context().Value(APIKeyScopesCtxKey).([]string)
+			return scopes
+		}
+		a.casbinMid, authz = casbinMid, casbinMid.MiddlewareFunc()
+	}
+	keys, err := newAPIKeyStore(a.Store, a.cacheTTL(), a.Logger)
+	if err != nil {
+		if a.Logger != nil {
+			a.Logger.Errorf("api-key: invalid store: %v", err)
+		}
+		a.Middleware = internalErrorMid
+		return
+	}
+	a.keys = keys
+	config, limits := a.APIKeyConfig, a.limits
+	header := config.header()
+	a.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := authz(next)
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(header)
+			if key == "" && config.Query != "" {
+				key = c.QueryParam(config.Query)
+			}
+			if key == "" {
+				return echo.ErrUnauthorized
+			}
+			hash := apiKeyHash(key)
+			k, err := keys.get(hash)
+			if err != nil {
+				c.Logger().Errorf("api-key: %v", err)
+				return echo.ErrServiceUnavailable
+			}
+			if k == nil {
+				return echo.ErrUnauthorized
+			}
+			if !k.hasScopes(config.Scopes) {
+				return echo.ErrForbidden
+			}
+			if l := k.limit(config.RateLimit); l.Requests > 0 {
+				if err := limitRequest(c, limits, "apikey:"+hash, l.rate(), l.burst()); err != nil {
+					return err
+				}
+			}
+			setAPIKeyOwner(c, k)
+			return h(c)
+		}
+	}
+}
+
+func (a *APIKey) Update(p Plugin) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.APIKeyConfig = p.(*APIKey).APIKeyConfig
+	a.Initialize()
+}
+
+func (*APIKey) Priority() int {
+	return -1
+}
+
+func (a *APIKey) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return skipPaths(a.SkipPaths, next, a.Middleware(next))
+}
+
+func (a *APIKey) ValidateConfig() error {
+	if a.Store.URI == "" {
+		return errors.New("api-key store requires a uri")
+	}
+	switch a.Store.backend() {
+	case APIKeyStoreFile:
+		if _, err := loadAPIKeys(a.Store.URI); err != nil {
+			return err
+		}
+	case APIKeyStoreRedis:
+	case APIKeyStorePostgres, APIKeyStoreMySQL:
+		if !casbinTableRegex.MatchString(a.Store.table()) {
+			return fmt.Errorf("invalid api-key table=%s", a.Store.Table)
+		}
+	default:
+		return fmt.Errorf("invalid api-key store backend=%s", a.Store.Backend)
+	}
+	if a.CacheTTL < 0 {
+		return errors.New("invalid api-key cache_ttl")
+	}
+	if l := a.RateLimit; l.Requests < 0 || l.Period < 0 || l.Burst < 0 {
+		return errors.New("invalid api-key rate limit")
+	}
+	switch a.RateLimit.Store.Backend {
+	case "", RateLimitStoreMemory:
+	case RateLimitStoreRedis:
+		if a.RateLimit.Store.URI == "" {
+			return errors.New("api-key redis rate limit store requires a uri")
+		}
+	default:
+		return fmt.Errorf("invalid rate limit store backend=%s", a.RateLimit.Store.Backend)
+	}
+	if err := validatePathRules(a.SkipPaths); err != nil {
+		return err
+	}
+	if a.CasbinCfg.Model != "" {
+		if _, err := a.CasbinCfg.Enforcer(); err != nil {
+			return fmt.Errorf("invalid casbin config: %v", err)
+		}
+	}
+	return nil
+}
+
+// ShutdownGrace closes the stores.
+func (a *APIKey) ShutdownGrace(ctx context.Context) {
+	a.mutex.Lock()
+	keys, limits := a.keys, a.limits
+	a.keys, a.limits = nil, nil
+	a.mutex.Unlock()
+	if keys != nil {
+		keys.close()
+	}
+	if limits != nil {
+		limits.close()
+	}
+}
+
+// Reload loads the file of keys again, or drops the cached keys, and loads
+// the casbin model and policy again if configured.
+func (a *APIKey) Reload() error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a.keys == nil {
+		return nil
+	}
+	if err := a.keys.reload(); err != nil {
+		return err
+	}
+	if a.casbinMid == nil {
+		return nil
+	}
+	return a.casbinMid.Reload()
+}
+
+func (*APIKey) DefaultConfig() interface{} {
+	return APIKeyConfig{
+		Store: APIKeyStoreConfig{URI: "/etc/armor/api-keys.yaml"},
+		RateLimit: APIKeyRateLimit{
+			Requests: 100,
+			Period:   time.Minute,
+		},
+	}
+}
+
+func (a *APIKey) ProbeConfig(probe ProbeFunc) error {
+	return ProbeConfig(&a.APIKeyConfig, probe)
+}
+
+func (*APIKey) OpenAPITag() *openapi3.Tag {
+	return &openapi3.Tag{
+		Name:        "API key",
+		Description: "Authenticated by API key",
+	}
+}
+
+func (a *APIKey) OpenAPISecurityScheme() *openapi3.SecurityScheme {
+	return &openapi3.SecurityScheme{
+		Type: "apiKey",
+		In:   "header",
+		Name: a.header(),
+	}
+}
+
+// setAPIKeyOwner stores the owner and scopes of k on the echo and request
+// contexts.
+func setAPIKeyOwner(c echo.Context, k *APIKeyEntry) {
+	r := c.Request()
+	c.Set("apiKeyOwner", k.Owner)
+	c.Set("apiKeyScopes", k.Scopes)
+	ctx := context.WithValue(r.Context(), APIKeyOwnerCtxKey, k.Owner)
+	ctx = context.WithValue(ctx, APIKeyScopesCtxKey, k.Scopes)
+	c.SetRequest(r.WithContext(ctx))
+}
+
+func getAPIKeyOwner(c echo.Context) string {
+	owner, _ := c.Request().Context().Value(APIKeyOwnerCtxKey).(string)
+	return owner
+}
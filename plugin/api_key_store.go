@@ -0,0 +1,334 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-redis/redis"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+	"github.com/mitchellh/mapstructure"
+)
+
+type (
+	// apiKeyStore returns the key of a SHA-256 hex hash, nil if none.
+	apiKeyStore interface {
+		get(hash string) (*APIKeyEntry, error)
+		reload() error
+		close() error
+	}
+
+	// apiKeyFileStore is the keys of a YAML or JSON file, reloaded once
+	// changed.
+	apiKeyFileStore struct {
+		file    string
+		mutex   sync.RWMutex
+		keys    map[string]*APIKeyEntry
+		watcher *fileWatcher
+	}
+
+	// apiKeyRedisStore is the keys of the hashes Prefix<hash>, of the `owner`,
+	// `scopes`, space separated, `requests`, `period` and `burst` fields.
+	apiKeyRedisStore struct {
+		client *redis.Client
+		prefix string
+	}
+
+	apiKeySQLStore struct {
+		db    *sqlx.DB
+		table string
+	}
+
+	// apiKeyCachedStore caches the keys of a remote store, the unknown ones
+	// too.
+	apiKeyCachedStore struct {
+		apiKeyStore
+		keys *lru.Cache
+		ttl  time.Duration
+	}
+
+	apiKeyCacheEntry struct {
+		key     *APIKeyEntry
+		expires time.Time
+	}
+
+	apiKeyRow struct {
+		Owner    string `db:"owner"`
+		Scopes   string `db:"scopes"`
+		Requests int    `db:"requests"`
+		Period   string `db:"period"`
+		Burst    int    `db:"burst"`
+	}
+)
+
+const (
+	// API key store backends
+	APIKeyStoreFile     = "file"
+	APIKeyStoreRedis    = "redis"
+	APIKeyStorePostgres = "postgres"
+	APIKeyStoreMySQL    = "mysql"
+
+	apiKeyRedisPrefix = "armor:apikey:"
+	apiKeySQLTable    = "api_keys"
+	apiKeyCacheSize   = 10000
+)
+
+// apiKeyHash returns the SHA-256 hex hash of key, the keys are stored by
+// hash.
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeyStore returns the key store of the configured backend, the keys
+// of remote stores are cached for ttl.
+func newAPIKeyStore(config APIKeyStoreConfig, ttl time.Duration, logger *log.Logger) (apiKeyStore, error) {
+	if config.URI == "" {
+		return nil, fmt.Errorf("api-key store=%s requires a uri", config.backend())
+	}
+	var store apiKeyStore
+	switch config.backend() {
+	case APIKeyStoreFile:
+		return newAPIKeyFileStore(config.URI, logger)
+	case APIKeyStoreRedis:
+		opt, err := redis.ParseURL(config.URI)
+		if err != nil {
+			return nil, err
+		}
+		client := redis.NewClient(opt)
+		if err := client.Ping().Err(); err != nil {
+			client.Close()
+			return nil, err
+		}
+		prefix := config.Table
+		if prefix == "" {
+			prefix = apiKeyRedisPrefix
+		}
+		store = &apiKeyRedisStore{client: client, prefix: prefix}
+	case APIKeyStorePostgres, APIKeyStoreMySQL:
+		table := config.table()
+		if !casbinTableRegex.MatchString(table) {
+			return nil, fmt.Errorf("invalid api-key table=%s", table)
+		}
+		db, err := sqlx.Connect(config.Backend, config.URI)
+		if err != nil {
+			return nil, err
+		}
+		s := &apiKeySQLStore{db: db, table: table}
+		if _, err := db.Exec(s.schema()); err != nil {
+			db.Close()
+			return nil, err
+		}
+		store = s
+	default:
+		return nil, fmt.Errorf("invalid api-key store backend=%s", config.Backend)
+	}
+	keys, _ := lru.New(apiKeyCacheSize)
+	return &apiKeyCachedStore{apiKeyStore: store, keys: keys, ttl: ttl}, nil
+}
+
+func newAPIKeyFileStore(file string, logger *log.Logger) (*apiKeyFileStore, error) {
+	s := &apiKeyFileStore{file: file}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	w, err := watchFile(file, logger, func() {
+		if err := s.reload(); err != nil {
+			if logger != nil {
+				logger.Errorf("api-key: failed to reload, keeping the current keys: %v", err)
+			}
+		} else if logger != nil {
+			logger.Infof("api-key: reloaded file=%s", file)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.watcher = w
+	return s, nil
+}
+
+// loadAPIKeys reads the list of keys of a YAML or JSON file, by hash.
+func loadAPIKeys(file string) (map[string]*APIKeyEntry, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var raw []map[string]interface{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("file=%s, %v", file, err)
+	}
+	keys := make(map[string]*APIKeyEntry, len(raw))
+	for i, r := range raw {
+		k := new(APIKeyEntry)
+		dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			TagName:    "yaml",
+			Result:     k,
+			DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
+		})
+		if err == nil {
+			err = dec.Decode(r)
+		}
+		if err == nil {
+			err = k.validate()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("file=%s, key %d, %v", file, i+1, err)
+		}
+		hash := strings.ToLower(k.Hash)
+		if k.Key != "" {
+			hash = apiKeyHash(k.Key)
+		}
+		k.Key, k.Hash = "", hash
+		keys[hash] = k
+	}
+	return keys, nil
+}
+
+func (s *apiKeyFileStore) get(hash string) (*APIKeyEntry, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.keys[hash], nil
+}
+
+func (s *apiKeyFileStore) reload() error {
+	keys, err := loadAPIKeys(s.file)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.keys = keys
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *apiKeyFileStore) close() error {
+	if s.watcher != nil {
+		s.watcher.stop(context.Background())
+	}
+	return nil
+}
+
+func (s *apiKeyRedisStore) get(hash string) (*APIKeyEntry, error) {
+	v, err := s.client.HGetAll(s.prefix + hash).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(v) == 0 {
+		return nil, nil
+	}
+	requests, _ := strconv.Atoi(v["requests"])
+	burst, _ := strconv.Atoi(v["burst"])
+	return newAPIKeyEntry(hash, v["owner"], v["scopes"], requests, v["period"], burst)
+}
+
+func (*apiKeyRedisStore) reload() error {
+	return nil
+}
+
+func (s *apiKeyRedisStore) close() error {
+	return s.client.Close()
+}
+
+func (s *apiKeySQLStore) schema() string {
+	return fmt.Sprintf(`create table if not exists %s (
+		key_hash varchar(64) not null primary key,
+		owner varchar(255) not null,
+		scopes varchar(1024) not null default '',
+		requests integer not null default 0,
+		period varchar(32) not null default '',
+		burst integer not null default 0
+	)`, s.table)
+}
+
+func (s *apiKeySQLStore) get(hash string) (*APIKeyEntry, error) {
+	var rows []apiKeyRow
+	if err := s.db.Select(&rows, s.db.Rebind(fmt.Sprintf(`select owner, scopes, requests, period, burst
+		from %s where key_hash = ?`, s.table)), hash); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	r := rows[0]
+	return newAPIKeyEntry(hash, r.Owner, r.Scopes, r.Requests, r.Period, r.Burst)
+}
+
+func (*apiKeySQLStore) reload() error {
+	return nil
+}
+
+func (s *apiKeySQLStore) close() error {
+	return s.db.Close()
+}
+
+// newAPIKeyEntry returns the key of the fields of a remote store.
+func newAPIKeyEntry(hash, owner, scopes string, requests int, period string, burst int) (*APIKeyEntry, error) {
+	k := &APIKeyEntry{
+		Hash:     hash,
+		Owner:    owner,
+		Scopes:   strings.Fields(scopes),
+		Requests: requests,
+		Burst:    burst,
+	}
+	if period != "" {
+		d, err := time.ParseDuration(period)
+		if err != nil {
+			return nil, fmt.Errorf("key of owner=%s, invalid period=%s", owner, period)
+		}
+		k.Period = d
+	}
+	if err := k.validate(); err != nil {
+		return nil, fmt.Errorf("key of owner=%s, %v", owner, err)
+	}
+	return k, nil
+}
+
+func (s *apiKeyCachedStore) get(hash string) (*APIKeyEntry, error) {
+	if v, ok := s.keys.Get(hash); ok {
+		if e := v.(apiKeyCacheEntry); time.Now().Before(e.expires) {
+			return e.key, nil
+		}
+		s.keys.Remove(hash)
+	}
+	k, err := s.apiKeyStore.get(hash)
+	if err != nil {
+		return nil, err
+	}
+	s.keys.Add(hash, apiKeyCacheEntry{key: k, expires: time.Now().Add(s.ttl)})
+	return k, nil
+}
+
+// reload drops the cached keys.
+func (s *apiKeyCachedStore) reload() error {
+	s.keys.Purge()
+	return nil
+}
+
+func (k *APIKeyEntry) validate() error {
+	if k.Owner == "" {
+		return errors.New("owner is required")
+	}
+	if (k.Key == "") == (k.Hash == "") {
+		return errors.New("either key or hash is required")
+	}
+	if k.Hash != "" {
+		if b, err := hex.DecodeString(k.Hash); err != nil || len(b) != sha256.Size {
+			return errors.New("invalid hash, a SHA-256 hex digest expected")
+		}
+	}
+	if k.Requests < 0 || k.Period < 0 || k.Burst < 0 {
+		return errors.New("invalid rate limit")
+	}
+	return nil
+}
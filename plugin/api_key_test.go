@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAPIKey(t *testing.T, config APIKeyConfig) (*APIKey, func(key, query string) (*httptest.ResponseRecorder, string, error)) {
+	a := validated(t, &APIKey{APIKeyConfig: config}).(*APIKey)
+	e := echo.New()
+	return a, func(key, query string) (*httptest.ResponseRecorder, string, error) {
+		owner := ""
+		h := a.Process(func(c echo.Context) error {
+			owner = AuthSubject(c)
+			return c.String(http.StatusOK, "OK")
+		})
+		req := httptest.NewRequest(echo.GET, "/users"+query, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		err := h(e.NewContext(req, rec))
+		return rec, owner, err
+	}
+}
+
+func TestAPIKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "keys.yaml")
+	write := func(s string) {
+		assert.NoError(t, ioutil.WriteFile(file, []byte(s), 0644))
+	}
+	policy := filepath.Join(dir, "policy.csv")
+	assert.NoError(t, ioutil.WriteFile(policy, []byte("p, jon, *\np, admin, /users\n"), 0644))
+	write(`
+- key: jon-key
+  owner: jon
+  scopes: [read, write]
+- hash: ` + apiKeyHash("joe-key") + `
+  owner: joe
+  scopes: [read, admin]
+  requests: 1
+  period: 1m
+- key: jim-key
+  owner: jim
+`)
+	a, do := newTestAPIKey(t, APIKeyConfig{
+		Query:     "api_key",
+		Store:     APIKeyStoreConfig{URI: file},
+		Scopes:    []string{"read"},
+		RateLimit: APIKeyRateLimit{Requests: 2, Period: time.Minute},
+		CasbinCfg: CasbinConfig{
+			Model:      "testdata/casbin_model.conf",
+			Policy:     policy,
+			PathObject: true,
+		},
+	})
+	defer a.ShutdownGrace(context.Background())
+
+	// Header, then query parameter, with the default limit
+	rec, owner, err := do("jon-key", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "jon", owner)
+	assert.Equal(t, "2", rec.Header().Get("RateLimit-Limit"))
+	_, owner, err = do("", "?api_key=jon-key")
+	assert.NoError(t, err)
+	assert.Equal(t, "jon", owner)
+	_, _, err = do("jon-key", "")
+	assert.Equal(t, http.StatusTooManyRequests, err.(*echo.HTTPError).Code)
+
+	// Invalid, missing scope
+	for _, key := range []string{"", "wrong", "JON-KEY"} {
+		_, _, err = do(key, "")
+		assert.Equal(t, echo.ErrUnauthorized, err, key)
+	}
+	_, _, err = do("jim-key", "")
+	assert.Equal(t, echo.ErrForbidden, err)
+
+	// Authorized by the admin scope, with its own limit
+	rec, owner, err = do("joe-key", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "joe", owner)
+	assert.Equal(t, "1", rec.Header().Get("RateLimit-Limit"))
+	_, _, err = do("joe-key", "")
+	assert.Equal(t, http.StatusTooManyRequests, err.(*echo.HTTPError).Code)
+
+	// Reloaded once changed, invalid files keep the current keys
+	time.Sleep(50 * time.Millisecond) // Distinct modification time
+	write("- key: jon-key\n  owner: jon\n  scopes: [read]\n")
+	assert.Eventually(t, func() bool {
+		_, _, err := do("joe-key", "")
+		return err == echo.ErrUnauthorized
+	}, 2*time.Second, 20*time.Millisecond)
+	write("- key: jon-key\n")
+	assert.Error(t, a.Reload())
+	_, _, err = do("jon-key", "")
+	assert.Equal(t, http.StatusTooManyRequests, err.(*echo.HTTPError).Code)
+}
+
+func TestAPIKeyRedis(t *testing.T) {
+	r, err := miniredis.Run()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	hash := apiKeyHash("jon-key")
+	r.HSet(apiKeyRedisPrefix+hash, "owner", "jon")
+	r.HSet(apiKeyRedisPrefix+hash, "scopes", "read write")
+	a, do := newTestAPIKey(t, APIKeyConfig{
+		Store:  APIKeyStoreConfig{Backend: APIKeyStoreRedis, URI: "redis://" + r.Addr()},
+		Scopes: []string{"write"},
+	})
+	defer a.ShutdownGrace(context.Background())
+
+	_, owner, err := do("jon-key", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "jon", owner)
+	_, _, err = do("joe-key", "")
+	assert.Equal(t, echo.ErrUnauthorized, err)
+
+	// Cached until reloaded
+	r.Del(apiKeyRedisPrefix + hash)
+	_, _, err = do("jon-key", "")
+	assert.NoError(t, err)
+	assert.NoError(t, a.Reload())
+	_, _, err = do("jon-key", "")
+	assert.Equal(t, echo.ErrUnauthorized, err)
+
+	// Unavailable
+	assert.NoError(t, a.Reload())
+	r.Close()
+	_, _, err = do("jon-key", "")
+	assert.Equal(t, echo.ErrServiceUnavailable, err)
+}
+
+func TestAPIKeyValidateConfig(t *testing.T) {
+	for _, c := range []APIKeyConfig{
+		{},
+		{Store: APIKeyStoreConfig{URI: "testdata/missing.yaml"}},
+		{Store: APIKeyStoreConfig{Backend: "mongodb", URI: "mongodb://localhost"}},
+		{Store: APIKeyStoreConfig{Backend: APIKeyStorePostgres, URI: "postgres://localhost", Table: "keys; drop table users"}},
+		{Store: APIKeyStoreConfig{Backend: APIKeyStoreRedis, URI: "redis://localhost"}, RateLimit: APIKeyRateLimit{Requests: -1}},
+		{Store: APIKeyStoreConfig{Backend: APIKeyStoreRedis, URI: "redis://localhost"}, RateLimit: APIKeyRateLimit{Store: RateLimitStoreConfig{Backend: RateLimitStoreRedis}}},
+	} {
+		a := &APIKey{APIKeyConfig: c}
+		assert.Error(t, a.ValidateConfig(), c.Store.URI)
+	}
+
+	// Invalid keys
+	for _, keys := range []string{
+		"- key: jon-key\n",
+		"- owner: jon\n",
+		"- key: jon-key\n  hash: " + apiKeyHash("jon-key") + "\n  owner: jon\n",
+		"- hash: jon-key\n  owner: jon\n",
+		"- key: jon-key\n  owner: jon\n  requests: -1\n",
+		"key: jon-key\n",
+	} {
+		f, err := ioutil.TempFile("", "armor")
+		if !assert.NoError(t, err) {
+			return
+		}
+		f.WriteString(keys)
+		f.Close()
+		_, err = loadAPIKeys(f.Name())
+		assert.Error(t, err, keys)
+		os.Remove(f.Name())
+	}
+}
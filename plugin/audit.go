@@ -0,0 +1,292 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+)
+
+// Audit events of the authentication and authorization decisions, the
+// subject, request, decision, matched policy and latency, written as JSON
+// lines to stdout, a rotated file or syslog, or sent in batches to a webhook
+// or a Kafka REST proxy.
+
+type (
+	Audit struct {
+		Base        `json:",squash" yaml:",squash"`
+		AuditConfig `json:",squash" yaml:",squash"`
+
+		sink       auditSink
+		sinkConfig AuditOutput
+	}
+
+	AuditConfig struct {
+		// Events are the audited decisions, `authn` and/or `authz`, default
+		// both.
+		Events []string `yaml:"events"`
+
+		// Output is where the events are written, default stdout.
+		Output AuditOutput `yaml:"output"`
+
+		// TrustedProxies are the proxies the client IP of the events is read
+		// from X-Forwarded-For of, as in the ip-filter plugin.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+
+		// SkipPaths are requests not audited.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// AuditOutput is an access log output, `stdout` (default), `file` or
+	// `syslog`, or `webhook` or `kafka`.
+	AuditOutput struct {
+		AccessLogOutput `json:",squash" yaml:",squash"`
+
+		// URL the batches of events are posted to, a JSON array for the
+		// webhook, the base URL of the Kafka REST proxy of Topic otherwise.
+		URL   string `yaml:"url"`
+		Topic string `yaml:"topic"`
+
+		// Headers of the requests, e.g. `Authorization`, Timeout of the
+		// requests, default 10s.
+		Headers map[string]string `yaml:"headers"`
+		Timeout time.Duration     `yaml:"timeout"`
+	}
+
+	// authDecision is a decision of an authorization plugin, recorded for
+	// the audit plugin.
+	authDecision struct {
+		plugin   string
+		subject  string
+		decision string
+		policy   string
+		latency  time.Duration
+	}
+
+	auditEvent struct {
+		Time       time.Time `json:"time"`
+		RequestID  string    `json:"request_id,omitempty"`
+		Type       string    `json:"type"`
+		Plugin     string    `json:"plugin,omitempty"`
+		Subject    string    `json:"subject,omitempty"`
+		Method     string    `json:"method"`
+		Host       string    `json:"host"`
+		Path       string    `json:"path"`
+		RemoteIP   string    `json:"remote_ip"`
+		RemoteAddr string    `json:"remote_addr"`
+		Decision   string    `json:"decision"`
+		Policy     string    `json:"policy,omitempty"`
+		LatencyMS  float64   `json:"latency_ms,omitempty"`
+		Status     int       `json:"status"`
+	}
+)
+
+const (
+	// Events
+	AuditAuthn = "authn"
+	AuditAuthz = "authz"
+
+	// Outputs
+	AuditWebhook = "webhook"
+	AuditKafka   = "kafka"
+
+	// Decisions
+	decisionAllow = "allow"
+	decisionDeny  = "deny"
+	decisionError = "error"
+
+	auditDecisionsKey = "auditDecisions"
+)
+
+// recordDecision records d for the audit plugin, if any.
+func recordDecision(c echo.Context, d authDecision) {
+	if ds, ok := c.Get(auditDecisionsKey).(*[]authDecision); ok {
+		*ds = append(*ds, d)
+	}
+}
+
+// authPlugin returns the auth plugin and the user it authenticated, if any.
+func authPlugin(c echo.Context) (string, string) {
+	for _, k := range authSubjectKeys {
+		if s, ok := c.Get(k).(string); ok && s != "" {
+			return strings.TrimSuffix(k, "Username"), s
+		}
+	}
+	return "", ""
+}
+
+func (c AuditConfig) audited(event string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, e := range c.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// events returns the audit events of the request of c, of the client IP
+// read from X-Forwarded-For of trusted proxies only and the address of the
+// connection.
+func (c AuditConfig) events(e echo.Context, start time.Time, decisions []authDecision, trusted util.IPNets) []auditEvent {
+	req := e.Request()
+	status := e.Response().Status
+	event := func(typ, plugin, subject, decision string) auditEvent {
+		return auditEvent{
+			Time:       start,
+			RequestID:  GetRequestID(e),
+			Type:       typ,
+			Plugin:     plugin,
+			Subject:    subject,
+			Method:     req.Method,
+			Host:       req.Host,
+			Path:       req.URL.Path,
+			RemoteIP:   remoteIP(req, trusted),
+			RemoteAddr: req.RemoteAddr,
+			Decision:   decision,
+			Status:     status,
+		}
+	}
+	var events []auditEvent
+	if c.audited(AuditAuthn) {
+		if plugin, sub := authPlugin(e); sub != "" {
+			events = append(events, event(AuditAuthn, plugin, sub, decisionAllow))
+		} else if status == http.StatusUnauthorized {
+			events = append(events, event(AuditAuthn, "", "", decisionDeny))
+		}
+	}
+	if c.audited(AuditAuthz) {
+		for _, d := range decisions {
+			ev := event(AuditAuthz, d.plugin, d.subject, d.decision)
+			ev.Policy = d.policy
+			ev.LatencyMS = float64(d.latency.Nanoseconds()) / 1e6
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+func (o AuditOutput) timeout() time.Duration {
+	if o.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return o.Timeout
+}
+
+func (a *Audit) ValidateConfig() error {
+	for _, e := range a.Events {
+		if e != AuditAuthn && e != AuditAuthz {
+			return fmt.Errorf("invalid audit event=%s", e)
+		}
+	}
+	o := a.Output
+	switch o.Type {
+	case "", AccessLogStdout, AccessLogSyslog:
+	case AccessLogFile:
+		if o.Path == "" {
+			return errors.New("audit file output requires a path")
+		}
+		if o.MaxSize < 0 || o.MaxBackups < 0 || o.MaxAge < 0 {
+			return errors.New("invalid audit file rotation")
+		}
+	case AuditWebhook, AuditKafka:
+		if u, err := url.Parse(o.URL); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid audit output url=%s", o.URL)
+		}
+		if o.Type == AuditKafka && o.Topic == "" {
+			return errors.New("audit kafka output requires a topic")
+		}
+		if o.Timeout < 0 {
+			return errors.New("invalid audit output timeout")
+		}
+	default:
+		return fmt.Errorf("invalid audit output type=%s", o.Type)
+	}
+	if _, err := util.ParseIPNets(a.TrustedProxies); err != nil {
+		return err
+	}
+	return validatePathRules(a.SkipPaths)
+}
+
+func (a *Audit) Initialize() {
+	trusted, err := util.ParseIPNets(a.TrustedProxies)
+	if err != nil {
+		if a.Logger != nil {
+			a.Logger.Errorf("audit: %v", err)
+		}
+		a.Middleware = internalErrorMid
+		return
+	}
+	// The sink, and its queued events, is kept on updates of the events
+	if a.sink != nil && !reflect.DeepEqual(a.sinkConfig, a.Output) {
+		a.sink.close(context.Background())
+		a.sink = nil
+	}
+	if a.sink == nil {
+		sink, err := newAuditSink(a.Output, a.Logger)
+		if err != nil {
+			if a.Logger != nil {
+				a.Logger.Errorf("audit: invalid output: %v", err)
+			}
+			a.Middleware = internalErrorMid
+			return
+		}
+		a.sink, a.sinkConfig = sink, a.Output
+	}
+	sink, config := a.sink, a.AuditConfig
+	a.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			var decisions []authDecision
+			c.Set(auditDecisionsKey, &decisions)
+			start := time.Now()
+			if err = next(c); err != nil {
+				c.Error(err)
+			}
+			if events := config.events(c, start, decisions, trusted); len(events) > 0 {
+				sink.write(events)
+			}
+			// Handled
+			return nil
+		}
+	}
+}
+
+func (a *Audit) Update(p Plugin) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.AuditConfig = p.(*Audit).AuditConfig
+	a.Initialize()
+}
+
+func (a *Audit) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return skipPaths(a.SkipPaths, next, a.Middleware(next))
+}
+
+// ShutdownGrace sends the queued events and closes the output.
+func (a *Audit) ShutdownGrace(ctx context.Context) {
+	a.mutex.Lock()
+	s := a.sink
+	a.sink = nil
+	a.mutex.Unlock()
+	if s != nil {
+		s.close(ctx)
+	}
+}
+
+// marshalAuditEvent returns the JSON line of e.
+func marshalAuditEvent(e auditEvent) []byte {
+	b, _ := json.Marshal(e)
+	return append(b, '\n')
+}
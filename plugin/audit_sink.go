@@ -0,0 +1,193 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+type (
+	// auditSink writes the audit events.
+	auditSink interface {
+		write(events []auditEvent)
+		close(ctx context.Context)
+	}
+
+	// lineAuditSink writes the events as JSON lines to an access log sink.
+	lineAuditSink struct {
+		sink   accessLogSink
+		logger *log.Logger
+	}
+
+	// httpAuditSink posts the events in batches, to a webhook or a Kafka
+	// REST proxy.
+	httpAuditSink struct {
+		config   AuditOutput
+		logger   *log.Logger
+		client   *http.Client
+		events   chan auditEvent
+		done     chan struct{}
+		stopped  chan struct{}
+		stopOnce sync.Once
+	}
+)
+
+const (
+	auditQueueSize     = 4096
+	auditBatchSize     = 256
+	auditBatchInterval = time.Second
+)
+
+func newAuditSink(o AuditOutput, logger *log.Logger) (auditSink, error) {
+	switch o.Type {
+	case AuditWebhook, AuditKafka:
+		if o.URL == "" {
+			return nil, errors.New("audit output requires a url")
+		}
+		s := &httpAuditSink{
+			config:  o,
+			logger:  logger,
+			client:  &http.Client{Timeout: o.timeout()},
+			events:  make(chan auditEvent, auditQueueSize),
+			done:    make(chan struct{}),
+			stopped: make(chan struct{}),
+		}
+		go s.run()
+		return s, nil
+	}
+	sink, err := newAccessLogSink(o.AccessLogOutput)
+	if err != nil {
+		return nil, err
+	}
+	return &lineAuditSink{sink: sink, logger: logger}, nil
+}
+
+func (s *lineAuditSink) write(events []auditEvent) {
+	// A line per write, a message per event for syslog
+	for _, e := range events {
+		if _, err := s.sink.Write(marshalAuditEvent(e)); err != nil {
+			auditDropped.Inc()
+			if s.logger != nil {
+				s.logger.Errorf("audit: failed to write: %v", err)
+			}
+		}
+	}
+}
+
+func (s *lineAuditSink) close(context.Context) {
+	s.sink.Close()
+}
+
+// write queues events, they are dropped if the queue is full.
+func (s *httpAuditSink) write(events []auditEvent) {
+	for _, e := range events {
+		select {
+		case s.events <- e:
+		default:
+			auditDropped.Inc()
+		}
+	}
+}
+
+func (s *httpAuditSink) run() {
+	defer close(s.stopped)
+	t := time.NewTicker(auditBatchInterval)
+	defer t.Stop()
+	batch := make([]auditEvent, 0, auditBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.send(batch); err != nil {
+			auditDropped.Add(float64(len(batch)))
+			if s.logger != nil {
+				s.logger.Errorf("audit: failed to send %d events: %v", len(batch), err)
+			}
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case e := <-s.events:
+			if batch = append(batch, e); len(batch) == auditBatchSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		case <-s.done:
+			for {
+				select {
+				case e := <-s.events:
+					if batch = append(batch, e); len(batch) == auditBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// close sends the queued events.
+func (s *httpAuditSink) close(ctx context.Context) {
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+	}
+}
+
+// send posts batch, as a JSON array to the webhook or as the records of the
+// topic to the Kafka REST proxy.
+func (s *httpAuditSink) send(batch []auditEvent) error {
+	u, ct := s.config.URL, "application/json"
+	var body interface{} = batch
+	if s.config.Type == AuditKafka {
+		type record struct {
+			Value auditEvent `json:"value"`
+		}
+		records := make([]record, len(batch))
+		for i, e := range batch {
+			records[i].Value = e
+		}
+		body = struct {
+			Records []record `json:"records"`
+		}{records}
+		u, ct = strings.TrimSuffix(u, "/")+"/topics/"+s.config.Topic, "application/vnd.kafka.json.v2+json"
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ct)
+	for k, v := range s.config.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return errors.New(res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func audited(a *Audit, mid echo.MiddlewareFunc, path, user string) int {
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, path, nil)
+	req.Header.Set(echo.HeaderXRequestID, "r1")
+	req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.1")
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	if user != "" {
+		c.Set("casUsername", user)
+	}
+	a.Process(mid(func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}))(c)
+	return rec.Code
+}
+
+func TestAuditFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	policy := filepath.Join(dir, "armor.rego")
+	assert.NoError(t, ioutil.WriteFile(policy, []byte(opaTestPolicy), 0644))
+	om, err := newOPAMiddleware(OPAConfig{Policy: policy}, AuthSubject, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer om.stop(context.Background())
+
+	path := filepath.Join(dir, "audit.log")
+	a := initialized(&Audit{AuditConfig: AuditConfig{Output: AuditOutput{AccessLogOutput: AccessLogOutput{Type: AccessLogFile, Path: path}}}}).(*Audit)
+	assert.NoError(t, a.ValidateConfig())
+	assert.Equal(t, http.StatusOK, audited(a, om.MiddlewareFunc(), "/docs", "jon"))
+	assert.Equal(t, http.StatusForbidden, audited(a, om.MiddlewareFunc(), "/admin", "jon"))
+	assert.Equal(t, http.StatusUnauthorized, audited(a, om.MiddlewareFunc(), "/admin", ""))
+	a.ShutdownGrace(context.Background())
+
+	b, err := ioutil.ReadFile(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if !assert.Len(t, lines, 5) {
+		return
+	}
+	events := make([]map[string]interface{}, len(lines))
+	for i, l := range lines {
+		assert.NoError(t, json.Unmarshal([]byte(l), &events[i]))
+	}
+	assert.Equal(t, "authn", events[0]["type"])
+	assert.Equal(t, "cas", events[0]["plugin"])
+	assert.Equal(t, "jon", events[0]["subject"])
+	assert.Equal(t, "r1", events[0]["request_id"])
+	assert.Equal(t, "192.0.2.1", events[0]["remote_ip"]) // Not of untrusted clients
+	assert.Equal(t, "192.0.2.1:1234", events[0]["remote_addr"])
+	assert.Equal(t, "authz", events[1]["type"])
+	assert.Equal(t, "opa", events[1]["plugin"])
+	assert.Equal(t, "allow", events[1]["decision"])
+	assert.Equal(t, "data.armor.allow", events[1]["policy"])
+	assert.Equal(t, "/docs", events[1]["path"])
+	assert.Contains(t, events[1], "latency_ms")
+	assert.Equal(t, "deny", events[3]["decision"])
+	assert.Equal(t, float64(http.StatusForbidden), events[3]["status"])
+	assert.Equal(t, "authn", events[4]["type"])
+	assert.Equal(t, "deny", events[4]["decision"])
+	assert.Equal(t, float64(http.StatusUnauthorized), events[4]["status"])
+}
+
+func TestAuditKafka(t *testing.T) {
+	var (
+		mutex   sync.Mutex
+		records []map[string]interface{}
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/audit", r.URL.Path)
+		assert.Equal(t, "application/vnd.kafka.json.v2+json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer t", r.Header.Get("Authorization"))
+		var body struct {
+			Records []map[string]interface{} `json:"records"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		mutex.Lock()
+		records = append(records, body.Records...)
+		mutex.Unlock()
+	}))
+	defer ts.Close()
+
+	a := initialized(&Audit{AuditConfig: AuditConfig{
+		Events:         []string{AuditAuthz},
+		TrustedProxies: []string{"192.0.2.0/24"},
+		Output: AuditOutput{
+			AccessLogOutput: AccessLogOutput{Type: AuditKafka},
+			URL:             ts.URL,
+			Topic:           "audit",
+			Headers:         map[string]string{"Authorization": "Bearer t"},
+		},
+	}}).(*Audit)
+	assert.NoError(t, a.ValidateConfig())
+	mid := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			recordDecision(c, authDecision{plugin: "casbin", subject: "jon", decision: decisionAllow, policy: "jon, /, GET"})
+			return next(c)
+		}
+	}
+	assert.Equal(t, http.StatusOK, audited(a, mid, "/", "jon"))
+	a.ShutdownGrace(context.Background())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if assert.Len(t, records, 1) {
+		v := records[0]["value"].(map[string]interface{})
+		assert.Equal(t, "authz", v["type"])
+		assert.Equal(t, "jon, /, GET", v["policy"])
+		assert.Equal(t, "203.0.113.1", v["remote_ip"]) // Of a trusted proxy
+	}
+
+	// Invalid
+	assert.Error(t, (&Audit{AuditConfig: AuditConfig{Output: AuditOutput{AccessLogOutput: AccessLogOutput{Type: AuditKafka}, URL: ts.URL}}}).ValidateConfig())
+	assert.Error(t, (&Audit{AuditConfig: AuditConfig{Events: []string{"login"}}}).ValidateConfig())
+	assert.Error(t, (&Audit{AuditConfig: AuditConfig{TrustedProxies: []string{"proxy"}}}).ValidateConfig())
+}
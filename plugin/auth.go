@@ -0,0 +1,18 @@
+package plugin
+
+import (
+	"github.com/labstack/echo/v4"
+)
+
+// authSubjectKeys are the echo context keys of the users of the auth plugins.
+var authSubjectKeys = []string{"casUsername", "oidcUsername", "samlUsername", "jwtUsername", "ldapUsername", "basicAuthUsername", "apiKeyOwner"}
+
+// AuthSubject returns the user authenticated by an auth plugin, if any.
+func AuthSubject(c echo.Context) string {
+	for _, k := range authSubjectKeys {
+		if s, ok := c.Get(k).(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
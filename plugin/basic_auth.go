@@ -0,0 +1,387 @@
+package plugin
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HTTP basic authentication against an htpasswd file.
+
+type (
+	BasicAuth struct {
+		Base            `json:",squash" yaml:",squash"`
+		BasicAuthConfig `json:",squash" yaml:",squash"`
+
+		users     *htpasswd
+		watcher   *fileWatcher
+		casbinMid *casbinMiddleware
+	}
+
+	BasicAuthConfig struct {
+		// File is the htpasswd file of the users, of bcrypt or apr1 hashes as
+		// written by `htpasswd -B` or `htpasswd -m`. It is reloaded once
+		// changed.
+		File string `yaml:"file"`
+
+		// Realm is sent in the basic auth challenge, default `armor`.
+		Realm string `yaml:"realm"`
+
+		// SkipPaths are requests passed without authentication, e.g.
+		// `/health` or `GET /public/*`.
+		SkipPaths []string `yaml:"skip_paths"`
+
+		// CasbinCfg authorizes the users, the username is the subject.
+		CasbinCfg CasbinConfig `yaml:"casbin"`
+	}
+
+	// htpasswd is the password hashes of an htpasswd file, by username. The
+	// passwords verified are cached with their hash, a changed hash is
+	// verified anew.
+	htpasswd struct {
+		file     string
+		mutex    sync.RWMutex
+		hashes   map[string]string
+		verified *lru.Cache
+	}
+
+	basicAuthCtxKey int
+)
+
+const (
+	BasicAuthUsernameCtxKey basicAuthCtxKey = iota
+)
+
+const (
+	basicAuthCacheSize = 10000
+
+	apr1Prefix  = "$apr1$"
+	apr1MaxSalt = 8
+	apr1Chars   = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var errHtpasswdUnsupportedHash = errors.New("unsupported hash, bcrypt or apr1 expected")
+
+func (c BasicAuthConfig) realm() string {
+	if c.Realm == "" {
+		return "armor"
+	}
+	return c.Realm
+}
+
+func (b *BasicAuth) Initialize() {
+	if b.watcher != nil {
+		b.watcher.stop(context.Background())
+		b.watcher = nil
+	}
+	b.users, b.casbinMid = nil, nil
+	users, err := loadHtpasswd(b.File)
+	if err != nil {
+		if b.Logger != nil {
+			b.Logger.Errorf("basic-auth: %v", err)
+		}
+		b.Middleware = internalErrorMid
+		return
+	}
+	authz := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return next
+	}
+	if b.CasbinCfg.Model != "" {
+		casbinMid, err := newSubjectCasbinMiddleware(b.CasbinCfg, getBasicAuthUsername)
+		if err != nil {
+			if b.Logger != nil {
+				b.Logger.Errorf("basic-auth: invalid casbin config: %v", err)
+			}
+			b.Middleware = internalErrorMid
+			return
+		}
+		b.casbinMid, authz = casbinMid, casbinMid.MiddlewareFunc()
+	}
+	logger := b.Logger
+	if b.watcher, err = watchFile(b.File, logger, func() {
+		if err := users.load(); err != nil {
+			if logger != nil {
+				logger.Errorf("basic-auth: failed to reload, keeping the current users: %v", err)
+			}
+		} else if logger != nil {
+			logger.Infof("basic-auth: reloaded file=%s", users.file)
+		}
+	}); err != nil {
+		if b.Logger != nil {
+			b.Logger.Errorf("basic-auth: failed to watch file=%s: %v", b.File, err)
+		}
+		b.Middleware = internalErrorMid
+		return
+	}
+	b.users = users
+	realm := b.realm()
+	b.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := authz(next)
+		return func(c echo.Context) error {
+			username, password, ok := c.Request().BasicAuth()
+			if !ok || !users.verify(username, password) {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, fmt.Sprintf("Basic realm=%q", realm))
+				return echo.ErrUnauthorized
+			}
+			setBasicAuthUser(c, username)
+			return h(c)
+		}
+	}
+}
+
+func (b *BasicAuth) Update(p Plugin) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.BasicAuthConfig = p.(*BasicAuth).BasicAuthConfig
+	b.Initialize()
+}
+
+func (*BasicAuth) Priority() int {
+	return -1
+}
+
+func (b *BasicAuth) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return skipPaths(b.SkipPaths, next, b.Middleware(next))
+}
+
+func (b *BasicAuth) ValidateConfig() error {
+	if b.File == "" {
+		return errors.New("basic-auth file is required")
+	}
+	if _, err := loadHtpasswd(b.File); err != nil {
+		return err
+	}
+	if err := validatePathRules(b.SkipPaths); err != nil {
+		return err
+	}
+	if b.CasbinCfg.Model != "" {
+		if _, err := b.CasbinCfg.Enforcer(); err != nil {
+			return fmt.Errorf("invalid casbin config: %v", err)
+		}
+	}
+	return nil
+}
+
+// ShutdownGrace stops watching the htpasswd file.
+func (b *BasicAuth) ShutdownGrace(ctx context.Context) {
+	b.mutex.Lock()
+	w := b.watcher
+	b.watcher = nil
+	b.mutex.Unlock()
+	if w != nil {
+		w.stop(ctx)
+	}
+}
+
+// Reload loads the htpasswd file again, and the casbin model and policy if
+// configured.
+func (b *BasicAuth) Reload() error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.users == nil {
+		return nil
+	}
+	if err := b.users.load(); err != nil {
+		return err
+	}
+	if b.casbinMid == nil {
+		return nil
+	}
+	return b.casbinMid.Reload()
+}
+
+func (*BasicAuth) DefaultConfig() interface{} {
+	return BasicAuthConfig{
+		File: "/etc/armor/htpasswd",
+	}
+}
+
+func (*BasicAuth) OpenAPITag() *openapi3.Tag {
+	return &openapi3.Tag{
+		Name:        "Basic auth",
+		Description: "Authenticated by basic auth against an htpasswd file",
+	}
+}
+
+func (*BasicAuth) OpenAPISecurityScheme() *openapi3.SecurityScheme {
+	return &openapi3.SecurityScheme{
+		Type:   "http",
+		Scheme: "basic",
+	}
+}
+
+// setBasicAuthUser stores the user on the echo and request contexts.
+func setBasicAuthUser(c echo.Context, username string) {
+	r := c.Request()
+	c.Set("basicAuthUsername", username)
+	c.SetRequest(r.WithContext(context.WithValue(r.Context(), BasicAuthUsernameCtxKey, username)))
+}
+
+func getBasicAuthUsername(c echo.Context) string {
+	username, _ := c.Request().Context().Value(BasicAuthUsernameCtxKey).(string)
+	return username
+}
+
+func loadHtpasswd(file string) (*htpasswd, error) {
+	verified, _ := lru.New(basicAuthCacheSize)
+	h := &htpasswd{file: file, verified: verified}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load reads the file, the current users are kept if invalid.
+func (h *htpasswd) load() error {
+	b, err := ioutil.ReadFile(h.file)
+	if err != nil {
+		return err
+	}
+	hashes, err := parseHtpasswd(b)
+	if err != nil {
+		return fmt.Errorf("file=%s, %v", h.file, err)
+	}
+	h.mutex.Lock()
+	h.hashes = hashes
+	h.mutex.Unlock()
+	return nil
+}
+
+// parseHtpasswd returns the hashes of the `username:hash` lines of b, blank
+// lines and `#` comments are skipped.
+func parseHtpasswd(b []byte) (map[string]string, error) {
+	hashes := map[string]string{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		j := strings.IndexByte(line, ':')
+		if j <= 0 {
+			return nil, fmt.Errorf("line %d, invalid entry", i+1)
+		}
+		username, hash := line[:j], line[j+1:]
+		if err := validHtpasswdHash(hash); err != nil {
+			return nil, fmt.Errorf("line %d, user=%s, %v", i+1, username, err)
+		}
+		hashes[username] = hash
+	}
+	return hashes, nil
+}
+
+func validHtpasswdHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	case strings.HasPrefix(hash, apr1Prefix):
+		parts := strings.Split(hash[len(apr1Prefix):], "$")
+		if len(parts) != 2 || len(parts[1]) != 22 {
+			return errors.New("invalid apr1 hash")
+		}
+		// htpasswd salts are of 8 characters at most, a longer one never
+		// matches
+		if len(parts[0]) > apr1MaxSalt {
+			return fmt.Errorf("invalid apr1 hash, salt longer than %d characters", apr1MaxSalt)
+		}
+		return nil
+	}
+	return errHtpasswdUnsupportedHash
+}
+
+// verify checks the password of username, a successful check is cached.
+func (h *htpasswd) verify(username, password string) bool {
+	h.mutex.RLock()
+	hash, ok := h.hashes[username]
+	h.mutex.RUnlock()
+	if !ok {
+		return false
+	}
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	if v, ok := h.verified.Get(key); ok && v.(string) == hash {
+		return true
+	}
+	if !htpasswdMatch(hash, password) {
+		return false
+	}
+	h.verified.Add(key, hash)
+	return true
+}
+
+func htpasswdMatch(hash, password string) bool {
+	if strings.HasPrefix(hash, apr1Prefix) {
+		salt := hash[len(apr1Prefix):]
+		salt = salt[:strings.IndexByte(salt, '$')]
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// apr1 returns the Apache MD5 crypt hash of password with salt, of
+// apr1MaxSalt characters at most.
+func apr1(password, salt string) string {
+	pw := []byte(password)
+	alt := md5.Sum([]byte(password + salt + password))
+	d := md5.New()
+	d.Write([]byte(password + apr1Prefix + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(alt[:])
+		} else {
+			d.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	sum := d.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 == 1 {
+			d.Write(pw)
+		} else {
+			d.Write(sum)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 == 1 {
+			d.Write(sum)
+		} else {
+			d.Write(pw)
+		}
+		sum = d.Sum(nil)
+	}
+	out := make([]byte, 0, 22)
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, apr1Chars[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(sum[i[0]])<<16|uint32(sum[i[1]])<<8|uint32(sum[i[2]]), 4)
+	}
+	encode(uint32(sum[11]), 2)
+	return apr1Prefix + salt + "$" + string(out)
+}
@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestApr1(t *testing.T) {
+	// openssl passwd -apr1
+	assert.Equal(t, "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", apr1("myPassword", "r31....."))
+	assert.Equal(t, "$apr1$abc$wrwVpaRg6xZp1WObx2zbt.", apr1("a-longer-password-than-16-bytes", "abc"))
+}
+
+func TestBasicAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	jon, err := bcrypt.GenerateFromPassword([]byte("jon-secret"), bcrypt.MinCost)
+	if !assert.NoError(t, err) {
+		return
+	}
+	file := filepath.Join(dir, "htpasswd")
+	write := func(s string) {
+		assert.NoError(t, ioutil.WriteFile(file, []byte(s), 0644))
+	}
+	write("# users\njon:" + string(jon) + "\n\njoe:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n")
+
+	b := validated(t, &BasicAuth{BasicAuthConfig: BasicAuthConfig{
+		File:  file,
+		Realm: "labstack",
+		CasbinCfg: CasbinConfig{
+			Model:  "testdata/casbin_model.conf",
+			Policy: "testdata/casbin_policy.csv",
+		},
+	}}).(*BasicAuth)
+	defer b.ShutdownGrace(context.Background())
+	e := echo.New()
+	username := ""
+	h := b.Process(func(c echo.Context) error {
+		username = AuthSubject(c)
+		return c.String(http.StatusOK, "OK")
+	})
+	do := func(username, password string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(echo.GET, "/users", nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		rec := httptest.NewRecorder()
+		return rec, h(e.NewContext(req, rec))
+	}
+
+	// Valid, then cached
+	for i := 0; i < 2; i++ {
+		_, err = do("jon", "jon-secret")
+		assert.NoError(t, err)
+		assert.Equal(t, "jon", username)
+	}
+
+	// Invalid
+	for _, c := range [][2]string{{"", ""}, {"jon", ""}, {"jon", "wrong"}, {"jim", "jon-secret"}, {"joe", "wrong"}} {
+		rec, err := do(c[0], c[1])
+		assert.Equal(t, echo.ErrUnauthorized, err, c[0])
+		assert.Equal(t, `Basic realm="labstack"`, rec.Header().Get(echo.HeaderWWWAuthenticate))
+	}
+
+	// apr1, not authorized by casbin
+	username = ""
+	_, err = do("joe", "myPassword")
+	assert.Equal(t, echo.ErrForbidden, err)
+	assert.Empty(t, username)
+
+	// Reloaded once changed, invalid files keep the current users
+	time.Sleep(50 * time.Millisecond) // Distinct modification time
+	write("joe:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n")
+	assert.Eventually(t, func() bool {
+		_, err := do("jon", "jon-secret")
+		return err == echo.ErrUnauthorized
+	}, 2*time.Second, 20*time.Millisecond)
+	write("jon:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+	assert.Error(t, b.Reload())
+	_, err = do("joe", "myPassword")
+	assert.Equal(t, echo.ErrForbidden, err)
+
+	// Salts over 8 characters, truncated by htpasswd, are rejected
+	_, err = parseHtpasswd([]byte("jim:$apr1$r31.....x$HqJZimcKQFAMYayBlzkrA/\n"))
+	assert.EqualError(t, err, "line 1, user=jim, invalid apr1 hash, salt longer than 8 characters")
+
+	// Missing file
+	b.BasicAuthConfig = BasicAuthConfig{File: filepath.Join(dir, "missing")}
+	assert.Error(t, b.ValidateConfig())
+	b.Initialize()
+	h = b.Process(func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	_, err = do("jon", "jon-secret")
+	assert.Error(t, err)
+	assert.Nil(t, b.watcher)
+}
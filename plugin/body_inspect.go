@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Reject or redact requests based on the JSON request body.
+
+type (
+	BodyInspect struct {
+		Base              `yaml:",squash"`
+		BodyInspectConfig `yaml:",squash"`
+	}
+
+	BodyInspectConfig struct {
+		MaxBodyBytes int64      `yaml:"max_body_bytes"`
+		Rules        []BodyRule `yaml:"rules"`
+	}
+
+	// BodyRule matches the value at `JSONPath` (gjson syntax) against an
+	// optional regular expression.
+	BodyRule struct {
+		regexp     *regexp.Regexp
+		JSONPath   string `yaml:"json_path"`
+		Regexp     string `yaml:"regexp"`
+		Action     string `yaml:"action"`
+		StatusCode int    `yaml:"status_code"`
+		Message    string `yaml:"message"`
+	}
+)
+
+const (
+	// Body rule actions
+	BodyRuleReject = "reject"
+	BodyRuleRedact = "redact"
+)
+
+func (b *BodyInspect) ValidateConfig() error {
+	for _, r := range b.Rules {
+		if r.JSONPath == "" {
+			return errors.New("body rule requires json_path")
+		}
+		if _, err := regexp.Compile(r.Regexp); err != nil {
+			return fmt.Errorf("invalid body rule regexp=%s, error=%v", r.Regexp, err)
+		}
+		switch r.Action {
+		case "", BodyRuleReject, BodyRuleRedact:
+		default:
+			return fmt.Errorf("invalid body rule action=%s", r.Action)
+		}
+	}
+	return nil
+}
+
+func (*BodyInspect) DefaultConfig() interface{} {
+	return BodyInspectConfig{
+		MaxBodyBytes: 1 << 20,
+		Rules: []BodyRule{
+			{JSONPath: "password", Action: BodyRuleRedact},
+		},
+	}
+}
+
+func (b *BodyInspect) Initialize() {
+	// Defaults
+	if b.MaxBodyBytes == 0 {
+		b.MaxBodyBytes = 1 << 20 // 1 MB
+	}
+	rules := make([]BodyRule, len(b.Rules))
+	for i, r := range b.Rules {
+		if r.Regexp != "" {
+			re, err := regexp.Compile(r.Regexp)
+			if err != nil {
+				if b.Logger != nil {
+					b.Logger.Errorf("body-inspect: invalid rule regexp=%s, error=%v", r.Regexp, err)
+				}
+				b.Middleware = internalErrorMid
+				return
+			}
+			r.regexp = re
+		}
+		if r.Action == "" {
+			r.Action = BodyRuleReject
+		}
+		if r.StatusCode == 0 {
+			r.StatusCode = http.StatusBadRequest
+		}
+		if r.Message == "" {
+			r.Message = http.StatusText(r.StatusCode)
+		}
+		rules[i] = r
+	}
+	b.Rules = rules
+	limit := b.MaxBodyBytes
+	b.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Body == nil || req.ContentLength == 0 {
+				return next(c)
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(c.Response(), req.Body, limit))
+			if err != nil {
+				return echo.ErrStatusRequestEntityTooLarge
+			}
+			for _, r := range rules {
+				if !r.match(body) {
+					continue
+				}
+				switch r.Action {
+				case BodyRuleReject:
+					return echo.NewHTTPError(r.StatusCode, r.Message)
+				case BodyRuleRedact:
+					if body, err = sjson.SetBytes(body, r.JSONPath, "REDACTED"); err != nil {
+						return err
+					}
+				}
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+			req.Header.Set(echo.HeaderContentLength, strconv.Itoa(len(body)))
+			return next(c)
+		}
+	}
+}
+
+func (b *BodyInspect) Update(p Plugin) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.BodyInspectConfig = p.(*BodyInspect).BodyInspectConfig
+	b.Initialize()
+}
+
+// EstimateMemory estimates the body buffered per request.
+func (b *BodyInspect) EstimateMemory() int64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.MaxBodyBytes
+}
+
+func (r *BodyRule) match(body []byte) bool {
+	v := gjson.GetBytes(body, r.JSONPath)
+	if !v.Exists() {
+		return false
+	}
+	return r.regexp == nil || r.regexp.MatchString(v.String())
+}
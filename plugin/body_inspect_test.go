@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyInspect(t *testing.T) {
+	e := echo.New()
+	body := ""
+	echoBody := func(c echo.Context) error {
+		b, _ := ioutil.ReadAll(c.Request().Body)
+		body = string(b)
+		return c.String(http.StatusOK, "OK")
+	}
+	b := initialized(&BodyInspect{BodyInspectConfig: BodyInspectConfig{Rules: []BodyRule{
+		{JSONPath: "query", Regexp: "(?i)drop table", StatusCode: http.StatusForbidden},
+		{JSONPath: "user.ssn", Action: BodyRuleRedact},
+	}}}).(*BodyInspect)
+
+	// Reject
+	req := httptest.NewRequest(echo.POST, "/", strings.NewReader(`{"query":"DROP TABLE users"}`))
+	rec := httptest.NewRecorder()
+	err := b.Process(echoBody)(e.NewContext(req, rec))
+	if assert.IsType(t, new(echo.HTTPError), err) {
+		assert.Equal(t, http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	// Redact
+	req = httptest.NewRequest(echo.POST, "/", strings.NewReader(`{"user":{"name":"jon","ssn":"123-45-6789"}}`))
+	rec = httptest.NewRecorder()
+	assert.NoError(t, b.Process(echoBody)(e.NewContext(req, rec)))
+	assert.Equal(t, `{"user":{"name":"jon","ssn":"REDACTED"}}`, body)
+
+	// No match
+	req = httptest.NewRequest(echo.POST, "/", strings.NewReader(`{"query":"select 1"}`))
+	rec = httptest.NewRecorder()
+	assert.NoError(t, b.Process(echoBody)(e.NewContext(req, rec)))
+	assert.Equal(t, `{"query":"select 1"}`, body)
+
+	// Too large
+	b.Update(&BodyInspect{BodyInspectConfig: BodyInspectConfig{MaxBodyBytes: 4, Rules: b.Rules}})
+	req = httptest.NewRequest(echo.POST, "/", strings.NewReader(`{"query":"select 1"}`))
+	rec = httptest.NewRecorder()
+	assert.Equal(t, echo.ErrStatusRequestEntityTooLarge, b.Process(echoBody)(e.NewContext(req, rec)))
+
+	// Invalid regexp, rejected by validation and failing the requests
+	invalid := BodyInspectConfig{Rules: []BodyRule{{JSONPath: "query", Regexp: "(drop"}}}
+	assert.Error(t, (&BodyInspect{BodyInspectConfig: invalid}).ValidateConfig())
+	assert.NotPanics(t, func() { b.Update(&BodyInspect{BodyInspectConfig: invalid}) })
+	req = httptest.NewRequest(echo.POST, "/", strings.NewReader(`{"query":"select 1"}`))
+	rec = httptest.NewRecorder()
+	assert.Error(t, b.Process(echoBody)(e.NewContext(req, rec)))
+}
+
+func TestBodyInspectUpdate(t *testing.T) {
+	e := echo.New()
+	b := initialized(&BodyInspect{BodyInspectConfig: BodyInspectConfig{Rules: []BodyRule{{JSONPath: "query", Regexp: "drop"}}}}).(*BodyInspect)
+	h := b.Process(func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			b.Update(&BodyInspect{BodyInspectConfig: BodyInspectConfig{MaxBodyBytes: int64(64 + i), Rules: []BodyRule{{JSONPath: "query", Regexp: "truncate"}}}})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest(echo.POST, "/", strings.NewReader(`{"query":"drop"}`))
+		err := h(e.NewContext(req, httptest.NewRecorder()))
+		assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+	<-done
+}
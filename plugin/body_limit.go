@@ -1,30 +1,92 @@
 package plugin
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	gbytes "github.com/labstack/gommon/bytes"
 )
 
 type (
 	BodyLimit struct {
 		Base                       `yaml:",squash"`
 		middleware.BodyLimitConfig `yaml:",squash"`
+
+		// Timeout, if set, is the time to receive the body in, e.g. `30s`,
+		// slow clients get `408 Request Timeout`. The body is read before
+		// the next plugins.
+		Timeout time.Duration `yaml:"timeout"`
 	}
 )
 
+// bodyTimeout reads the request body within timeout.
+func bodyTimeout(timeout time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+				return next(c)
+			}
+			type result struct {
+				body []byte
+				err  error
+			}
+			done := make(chan result, 1)
+			go func(body io.Reader) {
+				b, err := ioutil.ReadAll(body)
+				done <- result{b, err}
+			}(req.Body)
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			select {
+			case r := <-done:
+				if r.err != nil {
+					return r.err
+				}
+				req.Body = ioutil.NopCloser(bytes.NewReader(r.body))
+				return next(c)
+			case <-t.C:
+				// The read ends with the connection
+				c.Response().Header().Set("Connection", "close")
+				return echo.NewHTTPError(http.StatusRequestTimeout)
+			}
+		}
+	}
+}
+
 func (b *BodyLimit) Initialize() {
-	b.Middleware = middleware.BodyLimitWithConfig(b.BodyLimitConfig)
+	mid := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return next
+	}
+	if b.Timeout > 0 {
+		mid = bodyTimeout(b.Timeout)
+	}
+	if b.Limit != "" {
+		limit, timeout := middleware.BodyLimitWithConfig(b.BodyLimitConfig), mid
+		mid = func(next echo.HandlerFunc) echo.HandlerFunc {
+			return limit(timeout(next))
+		}
+	}
+	b.Middleware = mid
 }
 
 func (b *BodyLimit) Update(p Plugin) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 	b.BodyLimitConfig = p.(*BodyLimit).BodyLimitConfig
+	b.Timeout = p.(*BodyLimit).Timeout
 	b.Initialize()
 }
 
-func (b *BodyLimit) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
-	return b.Middleware(next)
+func (b *BodyLimit) ValidateConfig() error {
+	if b.Limit == "" {
+		return nil
+	}
+	_, err := gbytes.Parse(b.Limit)
+	return err
 }
@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyLimit(t *testing.T) {
+	e := echo.New()
+	p := Decode(RawPlugin{
+		"name":    PluginBodyLimit,
+		"order":   1,
+		"limit":   "8B",
+		"timeout": "50ms",
+	}, e, nil).(*BodyLimit)
+	if !assert.NoError(t, p.ValidateConfig()) {
+		return
+	}
+	p.Initialize()
+
+	do := func(body io.Reader) (int, string) {
+		req := httptest.NewRequest(echo.POST, "/", body)
+		rec := httptest.NewRecorder()
+		var received string
+		err := p.Process(func(c echo.Context) error {
+			b, err := ioutil.ReadAll(c.Request().Body)
+			if err != nil {
+				return err
+			}
+			received = string(b)
+			return c.String(http.StatusOK, "OK")
+		})(e.NewContext(req, rec))
+		if err != nil {
+			e.HTTPErrorHandler(err, e.NewContext(req, rec))
+		}
+		if rec.Code == http.StatusRequestTimeout {
+			assert.Equal(t, "close", rec.Header().Get("Connection"))
+		}
+		return rec.Code, received
+	}
+
+	code, body := do(strings.NewReader("armor"))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "armor", body)
+	code, _ = do(strings.NewReader("labstack armor"))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+
+	// Slow client
+	r, w := io.Pipe()
+	defer w.Close()
+	go w.Write([]byte("arm"))
+	code, _ = do(ioutil.NopCloser(r))
+	assert.Equal(t, http.StatusRequestTimeout, code)
+
+	// Timeout only
+	p.Update(Decode(RawPlugin{"name": PluginBodyLimit, "order": 1, "timeout": time.Second.String()}, e, nil))
+	code, body = do(strings.NewReader("labstack armor"))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "labstack armor", body)
+
+	p = Decode(RawPlugin{"name": PluginBodyLimit, "order": 1, "limit": "8X"}, e, nil).(*BodyLimit)
+	assert.Error(t, p.ValidateConfig())
+}
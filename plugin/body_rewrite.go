@@ -0,0 +1,309 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/valyala/fasttemplate"
+)
+
+// Substitute regular expression matches in request and response bodies, e.g.
+// the absolute URLs of the upstream by the public host.
+
+type (
+	BodyRewrite struct {
+		Base              `json:",squash" yaml:",squash"`
+		BodyRewriteConfig `json:",squash" yaml:",squash"`
+	}
+
+	BodyRewriteConfig struct {
+		// Rules rewrite the response bodies, RequestRules the request bodies.
+		Rules        []BodyRewriteRule `yaml:"rules"`
+		RequestRules []BodyRewriteRule `yaml:"request_rules"`
+
+		// ContentTypes are the media types rewritten, `type/*` matches all
+		// subtypes. Default text, JavaScript, JSON and XML.
+		ContentTypes []string `yaml:"content_types"`
+
+		// MaxBodyBytes, default 1MB, is the largest body buffered to be
+		// rewritten, larger bodies are streamed unchanged.
+		MaxBodyBytes int64 `yaml:"max_body_bytes"`
+
+		// SkipPaths are requests passed without rewriting.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// BodyRewriteRule replaces the matches of Regexp by Replace, a template
+	// of the request, e.g. `${scheme}://${host}`, also expanding the groups
+	// of Regexp, e.g. `${1}`.
+	BodyRewriteRule struct {
+		regexp  *regexp.Regexp
+		replace *fasttemplate.Template
+		Regexp  string `yaml:"regexp"`
+		Replace string `yaml:"replace"`
+	}
+
+	// bodyRewriteWriter buffers a response to rewrite it, until it exceeds
+	// max bytes.
+	bodyRewriteWriter struct {
+		http.ResponseWriter
+		rewrite   func([]byte) []byte
+		accept    func(http.Header) bool
+		max       int64
+		buf       bytes.Buffer
+		status    int
+		buffering bool
+	}
+)
+
+var bodyRewriteContentTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/xhtml+xml",
+}
+
+func (b *BodyRewrite) ValidateConfig() error {
+	if len(b.Rules) == 0 && len(b.RequestRules) == 0 {
+		return errors.New("body-rewrite requires rules or request_rules")
+	}
+	for _, rules := range [][]BodyRewriteRule{b.Rules, b.RequestRules} {
+		for _, r := range rules {
+			if r.Regexp == "" {
+				return errors.New("body rewrite rule requires regexp")
+			}
+			if _, err := regexp.Compile(r.Regexp); err != nil {
+				return fmt.Errorf("invalid body rewrite regexp=%s, error=%v", r.Regexp, err)
+			}
+		}
+	}
+	for _, t := range b.ContentTypes {
+		if _, _, err := mime.ParseMediaType(t); err != nil {
+			return fmt.Errorf("invalid body rewrite content type=%s", t)
+		}
+	}
+	if b.MaxBodyBytes < 0 {
+		return fmt.Errorf("invalid body rewrite max body bytes=%d", b.MaxBodyBytes)
+	}
+	return validatePathRules(b.SkipPaths)
+}
+
+func (b *BodyRewrite) Initialize() {
+	// Defaults
+	if b.MaxBodyBytes == 0 {
+		b.MaxBodyBytes = 1 << 20 // 1 MB
+	}
+	if len(b.ContentTypes) == 0 {
+		b.ContentTypes = bodyRewriteContentTypes
+	}
+	for _, rules := range [][]BodyRewriteRule{b.Rules, b.RequestRules} {
+		for i := range rules {
+			r := &rules[i]
+			r.regexp = regexp.MustCompile(r.Regexp)
+			r.replace = fasttemplate.New(r.Replace, "${", "}")
+		}
+	}
+}
+
+func (b *BodyRewrite) Update(p Plugin) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.BodyRewriteConfig = p.(*BodyRewrite).BodyRewriteConfig
+	b.Initialize()
+}
+
+// EstimateMemory estimates the bodies buffered per request.
+func (b *BodyRewrite) EstimateMemory() int64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if len(b.RequestRules) > 0 && len(b.Rules) > 0 {
+		return 2 * b.MaxBodyBytes
+	}
+	return b.MaxBodyBytes
+}
+
+// templateTag reports whether tag is a template variable, others are groups
+// of the regular expression.
+func templateTag(tag string) bool {
+	switch tag {
+	case "scheme", "method", "uri", "path", "host", "remote_ip", "user", CSPNonceKey, CSRFTokenKey, RequestIDKey:
+		return true
+	}
+	return strings.Contains(tag, ":")
+}
+
+// expand returns the replacement of r for the request of c.
+func (r *BodyRewriteRule) expand(c echo.Context) []byte {
+	buf := new(bytes.Buffer)
+	r.replace.ExecuteFunc(buf, func(w io.Writer, tag string) (int, error) {
+		if templateTag(tag) {
+			mapTag(buf, c, tag, nil)
+			return 0, nil
+		}
+		return w.Write([]byte("${" + tag + "}"))
+	})
+	return buf.Bytes()
+}
+
+func rewriter(rules []BodyRewriteRule, c echo.Context) func([]byte) []byte {
+	replaces := make([][]byte, len(rules))
+	for i := range rules {
+		replaces[i] = rules[i].expand(c)
+	}
+	return func(body []byte) []byte {
+		for i, r := range rules {
+			body = r.regexp.ReplaceAll(body, replaces[i])
+		}
+		return body
+	}
+}
+
+// rewritable reports whether a body with the header h may be rewritten.
+func (b *BodyRewriteConfig) rewritable(h http.Header) bool {
+	if e := h.Get(echo.HeaderContentEncoding); e != "" && e != "identity" {
+		return false
+	}
+	t, _, err := mime.ParseMediaType(h.Get(echo.HeaderContentType))
+	if err != nil {
+		return false
+	}
+	return mediaTypeMatch(b.ContentTypes, t)
+}
+
+func (b *BodyRewrite) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	config := b.BodyRewriteConfig
+	return skipPaths(b.SkipPaths, next, func(c echo.Context) error {
+		req := c.Request()
+		if len(config.RequestRules) > 0 && req.Body != nil && req.ContentLength != 0 && config.rewritable(req.Header) {
+			if err := config.rewriteRequest(c); err != nil {
+				return err
+			}
+		}
+		if len(config.Rules) == 0 || req.Method == http.MethodHead || c.IsWebSocket() {
+			return next(c)
+		}
+		// Compressed bodies are not rewritten
+		req.Header.Del(echo.HeaderAcceptEncoding)
+		res := c.Response()
+		w := &bodyRewriteWriter{
+			ResponseWriter: res.Writer,
+			rewrite:        rewriter(config.Rules, c),
+			accept:         config.rewritable,
+			max:            config.MaxBodyBytes,
+		}
+		res.Writer = w
+		defer func() { res.Writer = w.ResponseWriter }()
+		err := next(c)
+		if ferr := w.finish(); err == nil {
+			err = ferr
+		}
+		return err
+	})
+}
+
+// rewriteRequest rewrites the request body unless larger than MaxBodyBytes.
+func (b *BodyRewriteConfig) rewriteRequest(c echo.Context) error {
+	req := c.Request()
+	if req.ContentLength > b.MaxBodyBytes {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, b.MaxBodyBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > b.MaxBodyBytes {
+		// Streamed unchanged
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil
+	}
+	req.Body.Close()
+	body = rewriter(b.RequestRules, c)(body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set(echo.HeaderContentLength, strconv.Itoa(len(body)))
+	return nil
+}
+
+func (w *bodyRewriteWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = code
+	h := w.Header()
+	length, err := strconv.ParseInt(h.Get(echo.HeaderContentLength), 10, 64)
+	w.buffering = code >= http.StatusOK && code != http.StatusNoContent && code != http.StatusPartialContent &&
+		code != http.StatusNotModified && w.accept(h) && (err != nil || length <= w.max)
+	if !w.buffering {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *bodyRewriteWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.buffering {
+		return w.ResponseWriter.Write(b)
+	}
+	if int64(w.buf.Len()+len(b)) <= w.max {
+		return w.buf.Write(b)
+	}
+	// Too large, streamed unchanged
+	w.buffering = false
+	w.ResponseWriter.WriteHeader(w.status)
+	if _, err := w.ResponseWriter.Write(w.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	w.buf = bytes.Buffer{}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish writes the rewritten body.
+func (w *bodyRewriteWriter) finish() error {
+	if !w.buffering {
+		return nil
+	}
+	w.buffering = false
+	body := w.rewrite(w.buf.Bytes())
+	h := w.Header()
+	h.Set(echo.HeaderContentLength, strconv.Itoa(len(body)))
+	if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// No longer byte for byte
+		h.Set("Etag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(body)
+	return err
+}
+
+// Flush is delayed to the end of buffered bodies.
+func (w *bodyRewriteWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.buffering {
+		f.Flush()
+	}
+}
+
+func (w *bodyRewriteWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("body-rewrite: response does not implement http.Hijacker")
+	}
+	return h.Hijack()
+}
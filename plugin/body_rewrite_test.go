@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func rewritten(b *BodyRewrite, h echo.HandlerFunc, body string) *httptest.ResponseRecorder {
+	e := echo.New()
+	req := httptest.NewRequest(echo.POST, "https://example.com/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMETextPlain)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	if err := b.Process(h)(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	return rec
+}
+
+func TestBodyRewrite(t *testing.T) {
+	b := initialized(&BodyRewrite{BodyRewriteConfig: BodyRewriteConfig{
+		Rules: []BodyRewriteRule{
+			{Regexp: `http://app:8080(/\w*)`, Replace: "${scheme}://${host}${1}"},
+		},
+		RequestRules: []BodyRewriteRule{
+			{Regexp: `example\.com`, Replace: "app:8080"},
+		},
+		MaxBodyBytes: 64,
+	}}).(*BodyRewrite)
+	assert.NoError(t, b.ValidateConfig())
+
+	var received string
+	respond := func(contentType, body string) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			data, _ := ioutil.ReadAll(c.Request().Body)
+			received = string(data)
+			c.Response().Header().Set("Etag", `"v1"`)
+			return c.Blob(http.StatusOK, contentType, []byte(body))
+		}
+	}
+	rec := rewritten(b, respond(echo.MIMETextHTMLCharsetUTF8, `<a href="http://app:8080/about">`), "https://example.com/")
+	assert.Equal(t, `<a href="https://example.com/about">`, rec.Body.String())
+	assert.Equal(t, "36", rec.Header().Get(echo.HeaderContentLength))
+	assert.Equal(t, `W/"v1"`, rec.Header().Get("Etag"))
+	assert.Equal(t, "https://app:8080/", received)
+
+	// Content types
+	rec = rewritten(b, respond("image/svg", "http://app:8080/"), "")
+	assert.Equal(t, "http://app:8080/", rec.Body.String())
+
+	// Larger than max body bytes
+	large := "http://app:8080/" + strings.Repeat("a", 64)
+	rec = rewritten(b, respond(echo.MIMETextPlain, large), large)
+	assert.Equal(t, large, rec.Body.String())
+	assert.Equal(t, large, received)
+
+	assert.Error(t, (&BodyRewrite{}).ValidateConfig())
+	assert.Error(t, (&BodyRewrite{BodyRewriteConfig: BodyRewriteConfig{Rules: []BodyRewriteRule{{Regexp: "("}}}}).ValidateConfig())
+}
+
+func TestBodyRewriteStreamed(t *testing.T) {
+	b := initialized(&BodyRewrite{BodyRewriteConfig: BodyRewriteConfig{
+		Rules:        []BodyRewriteRule{{Regexp: "a", Replace: "b"}},
+		MaxBodyBytes: 4,
+	}}).(*BodyRewrite)
+	rec := rewritten(b, func(c echo.Context) error {
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, echo.MIMETextPlain)
+		res.WriteHeader(http.StatusOK)
+		for _, s := range []string{"aa", "aa", "aa"} {
+			res.Write([]byte(s))
+			res.Flush()
+		}
+		return nil
+	}, "")
+	assert.Equal(t, "aaaaaa", rec.Body.String())
+	assert.True(t, rec.Flushed)
+
+	rec = rewritten(b, func(c echo.Context) error {
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, echo.MIMETextPlain)
+		res.Write([]byte("aa"))
+		res.Flush()
+		res.Write([]byte("a"))
+		return nil
+	}, "")
+	assert.Equal(t, "bbb", rec.Body.String())
+}
@@ -0,0 +1,482 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Caches the GET responses of the next plugins, e.g. `proxy`, following
+// Cache-Control, Expires and Vary.
+
+type (
+	Cache struct {
+		Base        `json:",squash" yaml:",squash"`
+		CacheConfig `json:",squash" yaml:",squash"`
+
+		store       cacheStore
+		storeConfig CacheStoreConfig
+	}
+
+	CacheConfig struct {
+		// Store keeps the responses in `memory` (default) or on `disk`.
+		Store CacheStoreConfig `yaml:"store"`
+
+		// MaxObjectSize is the largest body cached in bytes, default 1MB.
+		MaxObjectSize int64 `yaml:"max_object_size"`
+
+		// TTL is the freshness of responses without Cache-Control max-age or
+		// Expires, not cached by default.
+		TTL time.Duration `yaml:"ttl"`
+
+		// Paths override the freshness of the responses of matching requests,
+		// the first match applies.
+		Paths []CachePath `yaml:"paths"`
+
+		// SkipPaths are requests never cached, e.g. `/api/**`.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// CacheStoreConfig selects the store, Dir is the directory of the disk
+	// store and MaxEntries, default 10000, bounds the keys kept in memory.
+	CacheStoreConfig struct {
+		Backend    string `yaml:"backend"`
+		Dir        string `yaml:"dir"`
+		MaxEntries int    `yaml:"max_entries"`
+	}
+
+	// CachePath sets the TTL of the responses to requests matching Path, a
+	// path pattern like `skip_paths`.
+	CachePath struct {
+		Path string        `yaml:"path"`
+		TTL  time.Duration `yaml:"ttl"`
+	}
+
+	cacheControl map[string]string
+
+	// cacheWriter tees the response up to max bytes.
+	cacheWriter struct {
+		http.ResponseWriter
+		max    int64
+		header http.Header
+		body   bytes.Buffer
+		wrote  bool
+		skip   bool
+	}
+)
+
+const (
+	cacheDefaultMaxObjectSize = 1 << 20
+	cacheDefaultMaxEntries    = 10000
+)
+
+// heuristicallyCacheable are the statuses cached without explicit freshness,
+// RFC 7231 6.1.
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK: true, http.StatusNonAuthoritativeInfo: true, http.StatusNoContent: true,
+	http.StatusMultipleChoices: true, http.StatusMovedPermanently: true,
+	http.StatusNotFound: true, http.StatusMethodNotAllowed: true, http.StatusGone: true,
+	http.StatusRequestURITooLong: true, http.StatusNotImplemented: true,
+}
+
+func (c CacheStoreConfig) maxEntries() int {
+	if c.MaxEntries <= 0 {
+		return cacheDefaultMaxEntries
+	}
+	return c.MaxEntries
+}
+
+func (c CacheConfig) maxObjectSize() int64 {
+	if c.MaxObjectSize <= 0 {
+		return cacheDefaultMaxObjectSize
+	}
+	return c.MaxObjectSize
+}
+
+func unsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+func parseCacheControl(v string) cacheControl {
+	cc := cacheControl{}
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		k, v := d, ""
+		if i := strings.IndexByte(d, '='); i >= 0 {
+			k, v = d[:i], strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+		}
+		cc[strings.ToLower(strings.TrimSpace(k))] = v
+	}
+	return cc
+}
+
+func (cc cacheControl) has(d string) bool {
+	_, ok := cc[d]
+	return ok
+}
+
+// seconds returns the value of the delta-seconds directive d.
+func (cc cacheControl) seconds(d string) (time.Duration, bool) {
+	v, ok := cc[d]
+	if !ok {
+		return 0, false
+	}
+	s, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || s < 0 {
+		return 0, true
+	}
+	return time.Duration(s) * time.Second, true
+}
+
+// cacheKey identifies the response to r, purged by the admin API.
+func cacheKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// cacheVary returns the header names in the Vary of h, nil for `*`.
+func cacheVary(h http.Header) (vary []string, ok bool) {
+	for _, v := range h[echo.HeaderVary] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary, true
+}
+
+// cacheVariant joins the values of the vary headers of r.
+func cacheVariant(vary []string, r *http.Request) string {
+	b := new(strings.Builder)
+	for _, name := range vary {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strings.Join(r.Header[name], ","))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func (c *Cache) Initialize() {
+	// The entries are kept on updates of the freshness
+	if c.store != nil && c.storeConfig != c.Store {
+		c.store.close()
+		c.store = nil
+	}
+	if c.store == nil {
+		store, err := newCacheStore(c.Store)
+		if err != nil {
+			if c.Logger != nil {
+				c.Logger.Errorf("cache: invalid store: %v", err)
+			}
+			c.Middleware = internalErrorMid
+			return
+		}
+		c.store, c.storeConfig = store, c.Store
+	}
+	paths := make([]pathRule, len(c.Paths))
+	for i, p := range c.Paths {
+		paths[i], _ = parsePathRule(p.Path)
+	}
+	store, config := c.store, c.CacheConfig
+	c.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			req := ctx.Request()
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				err := next(ctx)
+				if err == nil && unsafeMethod(req.Method) && ctx.Response().Status < http.StatusBadRequest {
+					// Invalidates the cached response, RFC 7234 4.4
+					if _, err := store.purge(cacheKey(req), false); err != nil {
+						ctx.Logger().Errorf("cache: %v", err)
+					}
+				}
+				return err
+			}
+			if ctx.IsWebSocket() || req.Header.Get("Range") != "" {
+				return next(ctx)
+			}
+			key := cacheKey(req)
+			reqCC := parseCacheControl(req.Header.Get("Cache-Control"))
+			maxAge, hasMaxAge := reqCC.seconds("max-age")
+			if !reqCC.has("no-cache") && req.Header.Get("Pragma") != "no-cache" && !(hasMaxAge && maxAge == 0) {
+				e, err := lookupCache(store, key, req)
+				if err != nil {
+					ctx.Logger().Errorf("cache: %v", err)
+				}
+				if e != nil && (!hasMaxAge || time.Since(e.Stored) <= maxAge) {
+					return serveCache(ctx, e)
+				}
+			}
+
+			res := ctx.Response()
+			res.Header().Set("X-Cache", "MISS")
+			w := &cacheWriter{ResponseWriter: res.Writer, max: config.maxObjectSize()}
+			res.Writer = w
+			err := next(ctx)
+			res.Writer = w.ResponseWriter
+			if err != nil || req.Method != http.MethodGet || !w.wrote || w.skip || reqCC.has("no-store") {
+				return err
+			}
+			var ttl *time.Duration
+			for i, p := range paths {
+				if p.match(req.Method, req.URL.Path) {
+					ttl = &config.Paths[i].TTL
+					break
+				}
+			}
+			e := newCacheEntry(key, req, res.Status, w.header, config.TTL, ttl)
+			if e == nil {
+				return nil
+			}
+			e.Body = w.body.Bytes()
+			if err := storeCache(store, e, req); err != nil {
+				ctx.Logger().Errorf("cache: %v", err)
+			}
+			return nil
+		}
+	}
+}
+
+// lookupCache returns the fresh response to r, nil if none.
+func lookupCache(store cacheStore, key string, r *http.Request) (*cacheEntry, error) {
+	e, err := store.get(key, "")
+	if err != nil || e == nil || e.Vary == nil {
+		return e, err
+	}
+	return store.get(key, cacheVariant(e.Vary, r))
+}
+
+func storeCache(store cacheStore, e *cacheEntry, r *http.Request) error {
+	if len(e.Vary) == 0 {
+		return store.set(e.Key, "", e)
+	}
+	// The vary headers select the variant
+	marker := &cacheEntry{Key: e.Key, Vary: e.Vary, Stored: e.Stored, Expires: e.Expires}
+	if err := store.set(e.Key, "", marker); err != nil {
+		return err
+	}
+	return store.set(e.Key, cacheVariant(e.Vary, r), e)
+}
+
+// newCacheEntry returns the entry of a response, nil if it may not be cached.
+// ttl overrides the freshness of the response, def applies without.
+func newCacheEntry(key string, r *http.Request, status int, h http.Header, def time.Duration, ttl *time.Duration) *cacheEntry {
+	cc := parseCacheControl(strings.Join(h["Cache-Control"], ","))
+	if cc.has("no-store") || cc.has("private") || cc.has("no-cache") || len(h[echo.HeaderSetCookie]) > 0 {
+		return nil
+	}
+	if r.Header.Get(echo.HeaderAuthorization) != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return nil
+	}
+	vary, ok := cacheVary(h)
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	var fresh time.Duration
+	explicit := true
+	if ttl != nil {
+		fresh = *ttl
+	} else if d, ok := cc.seconds("s-maxage"); ok {
+		fresh = d
+	} else if d, ok := cc.seconds("max-age"); ok {
+		fresh = d
+	} else if v := h.Get("Expires"); v != "" {
+		if t, err := http.ParseTime(v); err == nil {
+			date := now
+			if d, err := http.ParseTime(h.Get("Date")); err == nil {
+				date = d
+			}
+			fresh = t.Sub(date)
+		}
+	} else {
+		fresh, explicit = def, false
+	}
+	if fresh <= 0 || !explicit && !heuristicallyCacheable[status] {
+		return nil
+	}
+	header := http.Header{}
+	for k, v := range h {
+		header[k] = v
+	}
+	header.Del("X-Cache")
+	return &cacheEntry{
+		Key:     key,
+		Status:  status,
+		Header:  header,
+		Vary:    vary,
+		Stored:  now,
+		Expires: now.Add(fresh),
+	}
+}
+
+// serveCache responds with e, 304 if the request validators match.
+func serveCache(c echo.Context, e *cacheEntry) error {
+	req, res := c.Request(), c.Response()
+	h := res.Header()
+	for k, v := range e.Header {
+		h[k] = v
+	}
+	age := time.Since(e.Stored)
+	if s, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && s > 0 {
+		age += time.Duration(s) * time.Second
+	}
+	h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	h.Set("X-Cache", "HIT")
+	if notModified(req, e.Header) && e.Status == http.StatusOK {
+		h.Del(echo.HeaderContentLength)
+		return c.NoContent(http.StatusNotModified)
+	}
+	res.WriteHeader(e.Status)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+	_, err := res.Write(e.Body)
+	return err
+}
+
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get(echo.HeaderIfModifiedSince))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get(echo.HeaderLastModified))
+	return err == nil && !lm.After(ims)
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		w.header = http.Header{}
+		for k, v := range w.ResponseWriter.Header() {
+			w.header[k] = v
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.skip {
+		if int64(w.body.Len()+len(b)) > w.max {
+			w.skip = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *cacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.skip = true
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("cache: response does not implement http.Hijacker")
+	}
+	return h.Hijack()
+}
+
+func (c *Cache) Update(p Plugin) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.CacheConfig = p.(*Cache).CacheConfig
+	c.Initialize()
+}
+
+func (c *Cache) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return skipPaths(c.SkipPaths, next, c.Middleware(next))
+}
+
+func (c *Cache) ValidateConfig() error {
+	switch c.Store.Backend {
+	case "", CacheStoreMemory:
+	case CacheStoreDisk:
+		if c.Store.Dir == "" {
+			return errors.New("cache disk store requires a dir")
+		}
+	default:
+		return fmt.Errorf("invalid cache store backend=%s", c.Store.Backend)
+	}
+	if c.MaxObjectSize < 0 || c.Store.MaxEntries < 0 || c.TTL < 0 {
+		return errors.New("invalid cache max object size, max entries or ttl")
+	}
+	for _, p := range c.Paths {
+		if _, err := parsePathRule(p.Path); err != nil {
+			return err
+		}
+		if p.TTL < 0 {
+			return fmt.Errorf("invalid cache ttl=%v of path=%s", p.TTL, p.Path)
+		}
+	}
+	return validatePathRules(c.SkipPaths)
+}
+
+// Purge removes the cached responses of key, the host and request URI, or
+// of all keys starting with it.
+func (c *Cache) Purge(key string, prefix bool) (int, error) {
+	c.mutex.RLock()
+	store := c.store
+	c.mutex.RUnlock()
+	if store == nil {
+		return 0, nil
+	}
+	return store.purge(key, prefix)
+}
+
+// ShutdownGrace closes the store.
+func (c *Cache) ShutdownGrace(ctx context.Context) {
+	c.mutex.Lock()
+	s := c.store
+	c.store = nil
+	c.mutex.Unlock()
+	if s != nil {
+		s.close()
+	}
+}
@@ -0,0 +1,315 @@
+package plugin
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+type (
+	// cacheStore keeps the responses of a key by variant, the values of the
+	// request headers listed by Vary. The entry of variant "" lists them.
+	cacheStore interface {
+		get(key, variant string) (*cacheEntry, error)
+		set(key, variant string, e *cacheEntry) error
+		// purge removes the key, or all keys starting with it, and returns
+		// the number of keys removed.
+		purge(key string, prefix bool) (int, error)
+		close() error
+	}
+
+	cacheEntry struct {
+		Key     string      `json:"key"`
+		Status  int         `json:"status"`
+		Header  http.Header `json:"header"`
+		Vary    []string    `json:"vary,omitempty"`
+		Stored  time.Time   `json:"stored"`
+		Expires time.Time   `json:"expires"`
+		Body    []byte      `json:"-"`
+	}
+
+	cacheMemoryStore struct {
+		items *lru.Cache
+	}
+
+	cacheMemoryItem struct {
+		mutex    sync.Mutex
+		variants map[string]*cacheEntry
+	}
+
+	// cacheDiskStore keeps a directory per key with a file per variant, the
+	// JSON entry on the first line followed by the body.
+	cacheDiskStore struct {
+		dir  string
+		done chan struct{}
+	}
+)
+
+const (
+	// Cache store backends
+	CacheStoreMemory = "memory"
+	CacheStoreDisk   = "disk"
+
+	// cacheMaxVariants bounds the variants kept per key in memory.
+	cacheMaxVariants = 32
+
+	// cacheCleanupInterval is the interval the disk store removes expired
+	// entries at.
+	cacheCleanupInterval = time.Minute
+)
+
+func (e *cacheEntry) expired(now time.Time) bool {
+	return !now.Before(e.Expires)
+}
+
+func newCacheStore(config CacheStoreConfig) (cacheStore, error) {
+	switch config.Backend {
+	case "", CacheStoreMemory:
+		items, err := lru.New(config.maxEntries())
+		if err != nil {
+			return nil, err
+		}
+		return &cacheMemoryStore{items: items}, nil
+	case CacheStoreDisk:
+		if err := os.MkdirAll(config.Dir, 0700); err != nil {
+			return nil, err
+		}
+		s := &cacheDiskStore{dir: config.Dir, done: make(chan struct{})}
+		go s.cleanup()
+		return s, nil
+	}
+	return nil, fmt.Errorf("invalid cache store backend=%s", config.Backend)
+}
+
+func (s *cacheMemoryStore) get(key, variant string) (*cacheEntry, error) {
+	v, ok := s.items.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	item := v.(*cacheMemoryItem)
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	e := item.variants[variant]
+	if e != nil && e.expired(time.Now()) {
+		delete(item.variants, variant)
+		return nil, nil
+	}
+	return e, nil
+}
+
+func (s *cacheMemoryStore) set(key, variant string, e *cacheEntry) error {
+	item := &cacheMemoryItem{variants: map[string]*cacheEntry{}}
+	if ok, _ := s.items.ContainsOrAdd(key, item); ok {
+		if v, ok := s.items.Get(key); ok {
+			item = v.(*cacheMemoryItem)
+		}
+	}
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	if _, ok := item.variants[variant]; !ok && len(item.variants) >= cacheMaxVariants {
+		item.variants = map[string]*cacheEntry{}
+	}
+	item.variants[variant] = e
+	return nil
+}
+
+func (s *cacheMemoryStore) purge(key string, prefix bool) (int, error) {
+	if !prefix {
+		if s.items.Contains(key) {
+			s.items.Remove(key)
+			return 1, nil
+		}
+		return 0, nil
+	}
+	n := 0
+	for _, k := range s.items.Keys() {
+		if strings.HasPrefix(k.(string), key) {
+			s.items.Remove(k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *cacheMemoryStore) close() error {
+	s.items.Purge()
+	return nil
+}
+
+func cacheHash(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func (s *cacheDiskStore) path(key, variant string) string {
+	return filepath.Join(s.dir, cacheHash(key), cacheHash(variant))
+}
+
+// readCacheFile reads the entry of the file at p, with the body if body is
+// set.
+func readCacheFile(p string, body bool) (*cacheEntry, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	e := new(cacheEntry)
+	if err := json.Unmarshal(line, e); err != nil {
+		return nil, err
+	}
+	if body {
+		if e.Body, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (s *cacheDiskStore) get(key, variant string) (*cacheEntry, error) {
+	p := s.path(key, variant)
+	e, err := readCacheFile(p, true)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e.expired(time.Now()) {
+		os.Remove(p)
+		return nil, nil
+	}
+	return e, nil
+}
+
+func (s *cacheDiskStore) set(key, variant string, e *cacheEntry) error {
+	p := s.path(key, variant)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(append(meta, '\n'), e.Body...))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// Readers see the old or the new entry
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// keyOf returns the key of the directory dir, empty if it has no entries.
+func (s *cacheDiskStore) keyOf(dir string) string {
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if e, err := readCacheFile(filepath.Join(dir, f.Name()), false); err == nil {
+			return e.Key
+		}
+	}
+	return ""
+}
+
+func (s *cacheDiskStore) purge(key string, prefix bool) (int, error) {
+	if !prefix {
+		dir := filepath.Join(s.dir, cacheHash(key))
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 1, os.RemoveAll(dir)
+	}
+	dirs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(s.dir, d.Name())
+		if k := s.keyOf(dir); k != "" && strings.HasPrefix(k, key) {
+			if err := os.RemoveAll(dir); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *cacheDiskStore) cleanup() {
+	t := time.NewTicker(cacheCleanupInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.removeExpired()
+		}
+	}
+}
+
+// removeExpired removes the expired entries and the keys left without.
+func (s *cacheDiskStore) removeExpired() {
+	now := time.Now()
+	dirs, _ := ioutil.ReadDir(s.dir)
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(s.dir, d.Name())
+		files, _ := ioutil.ReadDir(dir)
+		left := len(files)
+		for _, f := range files {
+			p := filepath.Join(dir, f.Name())
+			if e, err := readCacheFile(p, false); err == nil && !e.expired(now) {
+				continue
+			}
+			if strings.HasPrefix(f.Name(), ".") && now.Sub(f.ModTime()) < cacheCleanupInterval {
+				// Being written
+				continue
+			}
+			if os.Remove(p) == nil {
+				left--
+			}
+		}
+		if left == 0 {
+			os.Remove(dir)
+		}
+	}
+}
+
+func (s *cacheDiskStore) close() error {
+	close(s.done)
+	return nil
+}
@@ -0,0 +1,174 @@
+package plugin
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func cached(c *Cache, h echo.HandlerFunc, method, target string, header http.Header) *httptest.ResponseRecorder {
+	e := echo.New()
+	req := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	ctx := e.NewContext(req, rec)
+	if err := c.Process(h)(ctx); err != nil {
+		e.HTTPErrorHandler(err, ctx)
+	}
+	return rec
+}
+
+func testCache(t *testing.T, c *Cache) {
+	calls := 0
+	h := func(c echo.Context) error {
+		calls++
+		c.Response().Header().Set("Cache-Control", "max-age=60")
+		c.Response().Header().Set("Etag", `"v1"`)
+		return c.String(http.StatusOK, "OK")
+	}
+	rec := cached(c, h, echo.GET, "/a", nil)
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	rec = cached(c, h, echo.GET, "/a", nil)
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "OK", rec.Body.String())
+	assert.Equal(t, "0", rec.Header().Get("Age"))
+	assert.Equal(t, 1, calls)
+
+	// Validators
+	rec = cached(c, h, echo.GET, "/a", http.Header{"If-None-Match": {`"v1"`}})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	// Bypassed by request no-cache
+	cached(c, h, echo.GET, "/a", http.Header{"Cache-Control": {"no-cache"}})
+	assert.Equal(t, 2, calls)
+
+	// Invalidated by unsafe methods
+	cached(c, h, echo.POST, "/a", nil)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, "MISS", cached(c, h, echo.GET, "/a", nil).Header().Get("X-Cache"))
+	assert.Equal(t, 4, calls)
+
+	// Purge
+	cached(c, h, echo.GET, "/b/1", nil)
+	cached(c, h, echo.GET, "/b/2", nil)
+	n, err := c.Purge("example.com/b/", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = c.Purge("example.com/a", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	cached(c, h, echo.GET, "/a", nil)
+	assert.Equal(t, 7, calls)
+}
+
+func TestCache(t *testing.T) {
+	c := initialized(&Cache{CacheConfig: CacheConfig{}}).(*Cache)
+	assert.NoError(t, c.ValidateConfig())
+	testCache(t, c)
+}
+
+func TestCacheDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor-cache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	c := initialized(&Cache{CacheConfig: CacheConfig{Store: CacheStoreConfig{Backend: CacheStoreDisk, Dir: dir}}}).(*Cache)
+	assert.NoError(t, c.ValidateConfig())
+	testCache(t, c)
+	c.ShutdownGrace(context.Background())
+}
+
+func TestCacheControl(t *testing.T) {
+	c := initialized(&Cache{CacheConfig: CacheConfig{MaxObjectSize: 4}}).(*Cache)
+	calls := 0
+	respond := func(header http.Header, body string) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			calls++
+			for k, v := range header {
+				c.Response().Header()[k] = v
+			}
+			return c.String(http.StatusOK, body)
+		}
+	}
+	for _, h := range []http.Header{
+		{},
+		{"Cache-Control": {"no-store"}},
+		{"Cache-Control": {"private, max-age=60"}},
+		{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}},
+		{"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+	} {
+		calls = 0
+		cached(c, respond(h, "OK"), echo.GET, "/", nil)
+		cached(c, respond(h, "OK"), echo.GET, "/", nil)
+		assert.Equal(t, 2, calls, "%v", h)
+	}
+
+	// Larger than max object size
+	calls = 0
+	h := respond(http.Header{"Cache-Control": {"max-age=60"}}, "large")
+	cached(c, h, echo.GET, "/large", nil)
+	cached(c, h, echo.GET, "/large", nil)
+	assert.Equal(t, 2, calls)
+
+	// Expires
+	calls = 0
+	h = respond(http.Header{"Expires": {time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)}}, "OK")
+	cached(c, h, echo.GET, "/expires", nil)
+	cached(c, h, echo.GET, "/expires", nil)
+	assert.Equal(t, 1, calls)
+
+	// Vary
+	calls = 0
+	h = func(c echo.Context) error {
+		calls++
+		c.Response().Header().Set("Cache-Control", "max-age=60")
+		c.Response().Header().Set("Vary", "Accept-Language")
+		return c.String(http.StatusOK, c.Request().Header.Get("Accept-Language"))
+	}
+	assert.Equal(t, "en", cached(c, h, echo.GET, "/vary", http.Header{"Accept-Language": {"en"}}).Body.String())
+	assert.Equal(t, "de", cached(c, h, echo.GET, "/vary", http.Header{"Accept-Language": {"de"}}).Body.String())
+	rec := cached(c, h, echo.GET, "/vary", http.Header{"Accept-Language": {"en"}})
+	assert.Equal(t, "en", rec.Body.String())
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+	assert.Equal(t, 2, calls)
+}
+
+func TestCachePaths(t *testing.T) {
+	c := initialized(&Cache{CacheConfig: CacheConfig{
+		TTL: time.Minute,
+		Paths: []CachePath{
+			{Path: "/nocache/**"},
+			{Path: "/static/**", TTL: time.Hour},
+		},
+	}}).(*Cache)
+	assert.NoError(t, c.ValidateConfig())
+	calls := 0
+	h := func(c echo.Context) error {
+		calls++
+		c.Response().Header().Set("Cache-Control", "max-age=1")
+		return c.String(http.StatusOK, "OK")
+	}
+	cached(c, h, echo.GET, "/static/app.js", nil)
+	assert.Equal(t, "HIT", cached(c, h, echo.GET, "/static/app.js", nil).Header().Get("X-Cache"))
+	e, err := c.store.get("example.com/static/app.js", "")
+	if assert.NoError(t, err) && assert.NotNil(t, e) {
+		assert.WithinDuration(t, time.Now().Add(time.Hour), e.Expires, time.Minute)
+	}
+	cached(c, h, echo.GET, "/nocache/a", nil)
+	cached(c, h, echo.GET, "/nocache/a", nil)
+	assert.Equal(t, 3, calls)
+
+	assert.Error(t, (&Cache{CacheConfig: CacheConfig{Store: CacheStoreConfig{Backend: CacheStoreDisk}}}).ValidateConfig())
+	assert.Error(t, (&Cache{CacheConfig: CacheConfig{Paths: []CachePath{{Path: "static"}}}}).ValidateConfig())
+}
@@ -4,28 +4,201 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/casbin/casbin"
+	"github.com/getkin/kin-openapi/openapi3"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
 	"gopkg.in/cas.v2"
-	"net/url"
-	"strings"
 )
 
 type (
 	Cas struct {
 		Base      `json:",squash" yaml:",squash"`
 		CasConfig `json:",squash" yaml:",squash"`
+
+		// SessionStore keeps user sessions if `PersistUserSession` is set,
+		// defaults to an in-memory store.
+		SessionStore CasSessionStore `json:"-" yaml:"-"`
+
+		casbin    echo.MiddlewareFunc
+		casbinMid *casbinMiddleware
+		watcher   *casbinWatcher
+		opaMid    *opaMiddleware
 	}
 
 	CasConfig struct {
-		URL string `json:"url" yaml:"url"`
+		URL       string       `json:"url" yaml:"url" required:"true" armor:"probe"`
 		CasbinCfg CasbinConfig `yaml:"casbin"`
+
+		// OPA authorizes with Open Policy Agent instead of casbin.
+		OPA OPAConfig `yaml:"opa"`
+
+		// CookieMaxAge sets the session cookie Max-Age after a successful ticket
+		// validation, e.g. to match the CAS ticket-granting ticket lifetime.
+		CookieMaxAge time.Duration `yaml:"cookie_max_age"`
+
+		// ParseTicketLifetime counts CookieMaxAge from the authentication date
+		// in the CAS response instead of from the ticket validation.
+		ParseTicketLifetime bool `yaml:"parse_ticket_lifetime"`
+
+		// AttributeCacheOnError keeps the last attributes released for a user
+		// and uses them when a later validation releases none, e.g. during a
+		// CAS attribute repository outage, for AttributeCacheTTL after their
+		// release, default 5m.
+		AttributeCacheOnError bool          `yaml:"attribute_cache_on_error"`
+		AttributeCacheTTL     time.Duration `yaml:"attribute_cache_ttl"`
+
+		// PersistUserSession stores the username and attributes server-side
+		// after the first ticket validation, later requests with the same
+		// session cookie skip CAS validation. CAS single logout removes it.
+		PersistUserSession bool `yaml:"persist_user_session"`
+
+		// SessionPersistenceBackend keeps the user sessions in `memory`
+		// (default), `redis`, `postgres` or a `file` so they survive restarts,
+		// it implies PersistUserSession. SessionPersistenceURI is the redis
+		// URL, postgres URI or file path.
+		SessionPersistenceBackend string `yaml:"session_persistence_backend"`
+		SessionPersistenceURI     string `yaml:"session_persistence_uri" armor:"probe"`
+
+		// SessionStoreCfg shares the user sessions between armor instances,
+		// it takes precedence over SessionPersistenceBackend and implies
+		// PersistUserSession.
+		SessionStoreCfg CasSessionStoreConfig `yaml:"session_store"`
+
+		// ForwardedUserHeader is the upstream request header set to the
+		// username in addition to X-CAS-User, default X-Forwarded-User. An
+		// empty value disables it.
+		ForwardedUserHeader *string `yaml:"forwarded_user_header"`
+
+		// ServiceURLOverrideHeader is a request header, set by a reverse
+		// proxy, with the service URL to use instead of the request URL. The
+		// URL must match one of AllowedServiceURLPatterns (regular
+		// expressions), otherwise the request is rejected.
+		ServiceURLOverrideHeader  string   `yaml:"service_url_override_header"`
+		AllowedServiceURLPatterns []string `yaml:"allowed_service_url_patterns"`
+
+		// ManagementAPIToken authenticates admin calls to the CAS management
+		// API, e.g. `SimulateAttributeRelease`.
+		ManagementAPIToken string `yaml:"management_api_token" armor:"probe,secret"`
+
+		// AttributeBlacklist lists attributes which are kept in the context,
+		// e.g. for casbin, but not sent upstream as X-CAS-Attr-* headers.
+		AttributeBlacklist []string `yaml:"attribute_blacklist"`
+
+		// ForwardAttributes, if set, lists the only attributes sent upstream,
+		// mapped to the header name, e.g. `mail: X-User-Email`. An empty
+		// header name keeps X-CAS-Attr-<name>.
+		ForwardAttributes map[string]string `yaml:"forward_attributes"`
+
+		// SkipPaths are requests passed without authentication, e.g.
+		// `/health` or `GET /public/*`.
+		SkipPaths []string `yaml:"skip_paths"`
+
+		// GatewayPaths are path patterns, e.g. `/public/*`, trying single
+		// sign-on without the CAS login page. Users without a CAS session
+		// continue anonymously, casbin isn't applied to them.
+		GatewayPaths []string `yaml:"gateway_paths"`
+
+		// RenewPaths are path patterns requiring a fresh CAS login for every
+		// request, even with an existing session, e.g. `/admin/*`.
+		RenewPaths []string `yaml:"renew_paths"`
+
+		// StripInboundHeaders removes all X-CAS-* headers sent by the client,
+		// so only headers set by armor reach the upstream.
+		StripInboundHeaders bool `yaml:"strip_inbound_headers"`
+
+		// DebugMode logs the URL and raw response of every CAS ticket
+		// validation at debug level, RedactSensitive masks the username.
+		DebugMode       bool `yaml:"debug_mode"`
+		RedactSensitive bool `yaml:"redact_sensitive"`
+
+		// LogoutPath, e.g. `/logout`, clears the local session and redirects
+		// to the CAS logout. CAS single logout requests from the CAS server
+		// are handled on any path.
+		LogoutPath string `yaml:"logout_path"`
+
+		// CookieEncryptionKey, exactly 32 bytes, encrypts the session cookie
+		// with AES-256-GCM so it doesn't reveal the session ticket.
+		CookieEncryptionKey string `yaml:"cookie_encryption_key" armor:"probe,secret"`
+
+		// OnNewSession is called after a fresh ticket validation, not for
+		// requests authenticated by an existing session.
+		OnNewSession func(c echo.Context, username string, attrs cas.UserAttributes) `json:"-" yaml:"-"`
+	}
+
+	// CasSessionStoreConfig selects the session backend, `memory`, `redis`,
+	// `memcached`, `postgres` or `file`. URI is the redis URL, comma
+	// separated memcached servers, postgres URI or file path. Sessions expire
+	// after TTL, default CookieMaxAge or 24 hours.
+	CasSessionStoreConfig struct {
+		Backend string        `yaml:"backend"`
+		URI     string        `yaml:"uri" armor:"probe"`
+		TTL     time.Duration `yaml:"ttl"`
+	}
+
+	// casServiceRequest is the request URL replaced by the service URL
+	// override during CAS handling.
+	casServiceRequest struct {
+		host  string
+		url   *url.URL
+		proto string
 	}
 
 	CasbinConfig struct {
-		Model string `yaml:"model"`
-		Policy string `yaml:"policy"`
+		Model            string `yaml:"model"`
+		Policy           string `yaml:"policy"`
 		SubjectAttribute string `yaml:"subject_attr"`
+
+		// EnforceCacheTTL enables caching of enforcement results for the
+		// duration, at most EnforceCacheSize (default 1000) results are kept.
+		EnforceCacheTTL  time.Duration `yaml:"enforce_cache_ttl"`
+		EnforceCacheSize int           `yaml:"enforce_cache_size"`
+
+		// EnforcementLogSampleRate is the fraction of enforcement decisions
+		// logged, from 0 (never) to 1 (always), sampled by request id.
+		// AlwaysLogDeny logs all denials regardless of the rate.
+		EnforcementLogSampleRate float64 `yaml:"enforcement_log_sample_rate"`
+		AlwaysLogDeny            bool    `yaml:"always_log_deny"`
+
+		// SubjectTransformRegex rewrites the subject with
+		// SubjectTransformReplace before enforcement, e.g. `^([^@]+)@.*$`
+		// and `$1` for the local part of an email.
+		SubjectTransformRegex   string `yaml:"subject_transform_regex"`
+		SubjectTransformReplace string `yaml:"subject_transform_replace"`
+
+		// RoleAttribute is a multi-valued attribute, e.g. `memberOf`, whose
+		// values are enforced as roles when the subject is denied, any
+		// allowed role grants access. RoleTransformRegex rewrites each value
+		// with RoleTransformReplace, e.g. `^cn=([^,]+),.*$` and `$1` for the
+		// common name of a group DN.
+		RoleAttribute        string `yaml:"role_attr"`
+		RoleTransformRegex   string `yaml:"role_transform_regex"`
+		RoleTransformReplace string `yaml:"role_transform_replace"`
+
+		// Watch reloads the model and policy when their files change,
+		// PollInterval additionally checks the files periodically, e.g. for
+		// network file systems without change events.
+		Watch        bool          `yaml:"watch"`
+		PollInterval time.Duration `yaml:"poll_interval"`
+
+		// PathObject enforces the cleaned request path as the object and the
+		// method as the action, e.g. for RBAC with resources models, instead
+		// of `*` for every request.
+		PathObject bool `yaml:"path_object"`
+
+		// PolicyAdapter loads the policy from a database instead of Policy,
+		// PollInterval reloads it periodically.
+		PolicyAdapter CasbinPolicyAdapterConfig `yaml:"policy_adapter"`
 	}
 )
 
@@ -33,55 +206,403 @@ func (cfg CasbinConfig) Enforcer() (*casbin.Enforcer, error) {
 	if cfg.Model == "" {
 		return nil, errors.New("invalid casbin model")
 	}
-	return casbin.NewEnforcerSafe(cfg.Model, cfg.Policy)
+	if cfg.PolicyAdapter.Type == "" {
+		return casbin.NewEnforcerSafe(cfg.Model, cfg.Policy)
+	}
+	a, err := newCasbinAdapter(cfg.PolicyAdapter)
+	if err != nil {
+		return nil, err
+	}
+	// The policy is only read, the connection isn't kept after loading it
+	defer a.Close()
+	return casbin.NewEnforcerSafe(cfg.Model, a)
 }
 
-func newCasClient(c CasConfig) (*cas.Client, error) {
+// policySource describes where the policy is loaded from.
+func (cfg CasbinConfig) policySource() string {
+	if cfg.PolicyAdapter.Type != "" {
+		return cfg.PolicyAdapter.Type
+	}
+	return cfg.Policy
+}
+
+func (c CasConfig) forwardedUserHeader() string {
+	if c.ForwardedUserHeader == nil {
+		return "X-Forwarded-User"
+	}
+	return *c.ForwardedUserHeader
+}
+
+// sessionStore returns the session store config, from
+// SessionPersistenceBackend if there's no `session_store`.
+func (c CasConfig) sessionStore() CasSessionStoreConfig {
+	if c.SessionStoreCfg.Backend != "" {
+		return c.SessionStoreCfg
+	}
+	return CasSessionStoreConfig{
+		Backend: c.SessionPersistenceBackend,
+		URI:     c.SessionPersistenceURI,
+		TTL:     c.SessionStoreCfg.TTL,
+	}
+}
+
+// persistSessions reports whether user sessions are stored server-side.
+func (c CasConfig) persistSessions() bool {
+	return c.PersistUserSession || c.sessionStore().Backend != ""
+}
+
+// attributeHeader returns the upstream header of the attribute, false if it
+// isn't forwarded.
+func (c CasConfig) attributeHeader(attr string) (string, bool) {
+	if c.blacklisted(attr) {
+		return "", false
+	}
+	if c.ForwardAttributes == nil {
+		return "X-CAS-Attr-" + attr, true
+	}
+	for a, h := range c.ForwardAttributes {
+		if strings.EqualFold(a, attr) {
+			if h == "" {
+				h = "X-CAS-Attr-" + attr
+			}
+			return h, true
+		}
+	}
+	return "", false
+}
+
+func (c CasConfig) blacklisted(attr string) bool {
+	for _, a := range c.AttributeBlacklist {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+func newCasClient(c CasConfig, l *log.Logger) (*cas.Client, error) {
 	casURL, err := url.Parse(c.URL)
 	if err != nil {
 		return nil, err
 	}
 
+	var client *http.Client
+	if c.DebugMode && l != nil {
+		client = &http.Client{Transport: &casDebugTransport{
+			transport: http.DefaultTransport,
+			logger:    l,
+			redact:    c.RedactSensitive,
+		}}
+	}
 	return cas.NewClient(&cas.Options{
-		URL:         casURL,
+		URL:    casURL,
+		Client: client,
 	}), nil
 }
 
 type casCtxKey int
 
+// casAttributeCache stores the last known attributes per username, of the
+// casAttributeCacheSize most recent users, for a TTL.
+type (
+	casAttributeCache struct {
+		ttl   time.Duration
+		attrs *lru.Cache
+	}
+
+	casAttributeCacheEntry struct {
+		attr    cas.UserAttributes
+		expires time.Time
+	}
+)
+
+func newCasAttributeCache(ttl time.Duration) *casAttributeCache {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	attrs, _ := lru.New(casAttributeCacheSize)
+	return &casAttributeCache{ttl: ttl, attrs: attrs}
+}
+
+// get returns the attributes of username, nil once expired.
+func (ac *casAttributeCache) get(username string) cas.UserAttributes {
+	v, ok := ac.attrs.Get(username)
+	if !ok {
+		return nil
+	}
+	if e := v.(casAttributeCacheEntry); time.Now().Before(e.expires) {
+		return e.attr
+	}
+	ac.attrs.Remove(username)
+	return nil
+}
+
+func (ac *casAttributeCache) set(username string, attr cas.UserAttributes) {
+	ac.attrs.Add(username, casAttributeCacheEntry{attr: attr, expires: time.Now().Add(ac.ttl)})
+}
+
 type casbinMiddleware struct {
-	Enforcer *casbin.Enforcer
+	mutex       sync.RWMutex
+	Enforcer    *casbin.Enforcer
 	SubjectFunc func(c echo.Context) string
+
+	// RolesFunc, if set, returns further subjects enforced when the subject
+	// is denied, e.g. the groups of the user.
+	RolesFunc func(c echo.Context) []string
+
+	roleTransform        *regexp.Regexp
+	roleTransformReplace string
+
+	// subjectTransform, if set, rewrites the usernames invalidated as the
+	// subjects are.
+	subjectTransform        *regexp.Regexp
+	subjectTransformReplace string
+
+	cfg           CasbinConfig
+	cache         *enforceCache
+	logSampleRate float64
+	alwaysLogDeny bool
+	pathObject    bool
+
+	// withAction passes the request method as the action, for models with
+	// a `sub, obj, act` request definition.
+	withAction bool
+}
+
+// current returns the enforcer and whether its model has an action, both
+// change on `Reload`.
+func (cb *casbinMiddleware) current() (*casbin.Enforcer, bool) {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+	return cb.Enforcer, cb.withAction
+}
+
+// enforce returns the casbin decision for the request values, using the
+// enforce cache if enabled.
+func (cb *casbinMiddleware) enforce(rvals ...string) bool {
+	enforcer, _ := cb.current()
+	return cb.enforceWith(enforcer, rvals)
+}
+
+func (cb *casbinMiddleware) enforceWith(enforcer *casbin.Enforcer, rvals []string) bool {
+	if cb.cache != nil {
+		if allow, ok := cb.cache.get(rvals); ok {
+			return allow
+		}
+	}
+	params := make([]interface{}, len(rvals))
+	for i, v := range rvals {
+		params[i] = v
+	}
+	allow, _ := enforcer.EnforceSafe(params...)
+	if cb.cache != nil {
+		// Don't cache a decision of an enforcer replaced meanwhile
+		if current, _ := cb.current(); current == enforcer {
+			cb.cache.add(rvals, allow)
+		}
+	}
+	return allow
+}
+
+// Reload loads the model and policy again, e.g. after a file change. Requests
+// in flight finish with the previous enforcer. On error the previous enforcer
+// is kept.
+func (cb *casbinMiddleware) Reload() error {
+	enforcer, err := cb.cfg.Enforcer()
+	if err != nil {
+		return err
+	}
+	cb.mutex.Lock()
+	cb.Enforcer, cb.withAction = enforcer, modelHasAction(enforcer)
+	cb.mutex.Unlock()
+	cb.InvalidateCache()
+	return nil
+}
+
+func modelHasAction(enforcer *casbin.Enforcer) bool {
+	r, ok := enforcer.GetModel()["r"]["r"]
+	return ok && len(r.Tokens) > 2
+}
+
+// InvalidateCache drops all cached enforcement results, it must be called
+// whenever the policy changes.
+func (cb *casbinMiddleware) InvalidateCache() {
+	if cb.cache != nil {
+		cb.cache.purge()
+	}
+}
+
+// InvalidateUserCache drops the cached enforcement results of username, e.g.
+// after a role change, and returns the number of evicted results. The
+// subject transform applies to username as to the enforced subjects.
+func (cb *casbinMiddleware) InvalidateUserCache(username string) int {
+	if cb.cache == nil {
+		return 0
+	}
+	if cb.subjectTransform != nil {
+		username = cb.subjectTransform.ReplaceAllString(username, cb.subjectTransformReplace)
+	}
+	return cb.cache.invalidate(username)
 }
 
 func (cb *casbinMiddleware) MiddlewareFunc() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func (c echo.Context) error {
-			if cb.Enforcer == nil {
+		return func(c echo.Context) error {
+			enforcer, withAction := cb.current()
+			sub := cb.SubjectFunc(c)
+			if enforcer == nil {
+				recordDecision(c, authDecision{plugin: "casbin", subject: sub, decision: decisionError})
 				return echo.ErrForbidden
 			}
-			sub := cb.SubjectFunc(c)
 			if sub == "" {
+				if anonymous, _ := c.Get(casAnonymousKey).(bool); anonymous {
+					return next(c)
+				}
 				return echo.ErrUnauthorized
 			}
-			if allow, _ := cb.Enforcer.EnforceSafe(sub, "*"); allow {
+			obj, act := "*", "*"
+			if cb.pathObject {
+				obj, act = cleanPath(c.Request().URL.Path), c.Request().Method
+			}
+			start := time.Now()
+			var rvals []string
+			enforce := func(sub string) bool {
+				if rvals = []string{sub, obj}; withAction {
+					rvals = append(rvals, act)
+				}
+				return cb.enforceWith(enforcer, rvals)
+			}
+			allow := enforce(sub)
+			if !allow && cb.RolesFunc != nil {
+				for _, role := range cb.RolesFunc(c) {
+					if cb.roleTransform != nil {
+						role = cb.roleTransform.ReplaceAllString(role, cb.roleTransformReplace)
+					}
+					if role == "" {
+						continue
+					}
+					if allow = enforce(role); allow {
+						break
+					}
+				}
+			}
+			cb.logDecision(c, sub, obj, allow)
+			d := authDecision{plugin: "casbin", subject: sub, decision: decisionDeny, latency: time.Since(start)}
+			if allow {
+				// The request matching the policy, of the user or of a role
+				d.decision, d.policy = decisionAllow, strings.Join(rvals, ", ")
+				recordDecision(c, d)
+				c.Set(casbinDecisionKey, "allow")
 				return next(c)
 			}
+			recordDecision(c, d)
+			c.Set(casbinDecisionKey, "deny")
+			casbinDenied.Inc()
 			return echo.ErrForbidden
 		}
 	}
 }
 
+// logDecision logs the enforcement decision if sampled, the sampling is
+// deterministic on the request id so all decisions of a request are logged
+// together.
+func (cb *casbinMiddleware) logDecision(c echo.Context, sub, obj string, allow bool) {
+	if !allow && cb.alwaysLogDeny {
+		c.Logger().Warnj(decisionLog(c, sub, obj, allow))
+		return
+	}
+	id := GetRequestID(c)
+	if id == "" {
+		id = sub + " " + c.Request().URL.Path
+	}
+	if !sampled(id, cb.logSampleRate) {
+		return
+	}
+	if allow {
+		c.Logger().Infoj(decisionLog(c, sub, obj, allow))
+	} else {
+		c.Logger().Warnj(decisionLog(c, sub, obj, allow))
+	}
+}
+
+func decisionLog(c echo.Context, sub, obj string, allow bool) log.JSON {
+	return log.JSON{
+		"casbin":     "enforce",
+		"sub":        sub,
+		"obj":        obj,
+		"allow":      allow,
+		"method":     c.Request().Method,
+		"uri":        c.Request().RequestURI,
+		"request_id": GetRequestID(c),
+	}
+}
+
+// sampled reports whether key falls within the sample rate.
+func sampled(key string, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	if rate >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return float64(h.Sum32())/math.MaxUint32 < rate
+}
+
 func newCasbinMiddleware(cfg CasbinConfig) (*casbinMiddleware, error) {
+	cb, err := newSubjectCasbinMiddleware(cfg, attrGetter(cfg.SubjectAttribute))
+	if err != nil || cb == nil {
+		return cb, err
+	}
+	if cfg.RoleAttribute != "" {
+		cb.RolesFunc = func(c echo.Context) []string {
+			attrs, _ := c.Request().Context().Value(CasAttributesCtxKey).(cas.UserAttributes)
+			return attrs[cfg.RoleAttribute]
+		}
+	}
+	return cb, nil
+}
+
+// newSubjectCasbinMiddleware enforces the subject returned by sub, for
+// authentication plugins other than CAS.
+func newSubjectCasbinMiddleware(cfg CasbinConfig, sub func(c echo.Context) string) (*casbinMiddleware, error) {
 	enforcer, err := cfg.Enforcer()
 	if err != nil || enforcer == nil {
 		return nil, err
 	}
-	sub := attrGetter(cfg.SubjectAttribute)
-	return &casbinMiddleware{
-		Enforcer: enforcer,
-		SubjectFunc: sub,
-	}, nil
+	var subTransform *regexp.Regexp
+	if cfg.SubjectTransformRegex != "" {
+		if subTransform, err = regexp.Compile(cfg.SubjectTransformRegex); err != nil {
+			return nil, fmt.Errorf("invalid subject transform regex=%s, error=%v", cfg.SubjectTransformRegex, err)
+		}
+		sub = subjectTransform(sub, subTransform, cfg.SubjectTransformReplace)
+	}
+	var roleTransform *regexp.Regexp
+	if cfg.RoleTransformRegex != "" {
+		if roleTransform, err = regexp.Compile(cfg.RoleTransformRegex); err != nil {
+			return nil, fmt.Errorf("invalid role transform regex=%s, error=%v", cfg.RoleTransformRegex, err)
+		}
+	}
+	cb := &casbinMiddleware{
+		Enforcer:      enforcer,
+		SubjectFunc:   sub,
+		logSampleRate: cfg.EnforcementLogSampleRate,
+		alwaysLogDeny: cfg.AlwaysLogDeny,
+		pathObject:    cfg.PathObject,
+		withAction:    modelHasAction(enforcer),
+		cfg:           cfg,
+
+		roleTransform:        roleTransform,
+		roleTransformReplace: cfg.RoleTransformReplace,
+
+		subjectTransform:        subTransform,
+		subjectTransformReplace: cfg.SubjectTransformReplace,
+	}
+	if cfg.EnforceCacheTTL > 0 {
+		cb.cache = newEnforceCache(cfg.EnforceCacheSize, cfg.EnforceCacheTTL)
+	}
+	return cb, nil
 }
 
 const (
@@ -89,32 +610,326 @@ const (
 	CasAttributesCtxKey
 )
 
-func newCasMiddleware(client *cas.Client) echo.MiddlewareFunc {
+const (
+	// ReplayUserKey is the context key of the username for `ProcessReplay`.
+	ReplayUserKey = "armor_replay_user"
+
+	// casSessionCookie is the session cookie name used by the CAS client.
+	casSessionCookie = "_cas_session"
+
+	casHeaderPrefix = "X-Cas-"
+
+	// casGatewayCookie marks a gateway login attempt, later requests without
+	// a ticket continue anonymously instead of trying again.
+	casGatewayCookie = "_cas_gateway"
+
+	// casAnonymousKey is set on the echo context of anonymous requests on
+	// gateway paths.
+	casAnonymousKey = "casAnonymous"
+
+	// casLogoutTicketsSize is the number of service tickets remembered to
+	// find the user of single logout requests.
+	casLogoutTicketsSize = 10000
+
+	// casAttributeCacheSize is the number of users of the attributes kept
+	// by AttributeCacheOnError.
+	casAttributeCacheSize = 10000
+)
+
+// setSessionCookieMaxAge replaces the CAS session cookie on the response with
+// one expiring after the given max age.
+func setSessionCookieMaxAge(c echo.Context, maxAge time.Duration) {
+	cookie, err := c.Request().Cookie(casSessionCookie)
+	if err != nil {
+		return
+	}
+	header := c.Response().Header()
+	cookies := header[echo.HeaderSetCookie]
+	header.Del(echo.HeaderSetCookie)
+	for _, v := range cookies {
+		if !strings.HasPrefix(v, casSessionCookie+"=") {
+			header.Add(echo.HeaderSetCookie, v)
+		}
+	}
+	cookie.MaxAge = int(maxAge.Seconds())
+	if cookie.MaxAge <= 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(c.Response(), cookie)
+}
+
+// setCasUser stores the CAS user on the echo and request contexts and in
+// the upstream request headers.
+func setCasUser(c echo.Context, config CasConfig, username string, attr cas.UserAttributes) {
+	r := c.Request()
+	c.Set("casAttributes", attr)
+	c.Set("casUsername", username)
+	newCtx := context.WithValue(r.Context(), CasUsernameCtxKey, username)
+	newCtx = context.WithValue(newCtx, CasAttributesCtxKey, attr)
+	r.Header.Set("X-CAS-User", username)
+	if h := config.forwardedUserHeader(); h != "" {
+		r.Header.Set(h, username)
+	}
+	for _, k := range config.AttributeBlacklist {
+		r.Header.Del(fmt.Sprintf("X-CAS-Attr-%s", k))
+	}
+	for k, h := range config.ForwardAttributes {
+		if h == "" {
+			h = fmt.Sprintf("X-CAS-Attr-%s", k)
+		}
+		r.Header.Del(h)
+	}
+	for k, v := range attr {
+		if h, ok := config.attributeHeader(k); ok {
+			r.Header.Set(h, strings.Join(v, " "))
+		}
+	}
+	c.SetRequest(r.WithContext(newCtx))
+}
+
+// newCasMiddleware returns the CAS middleware, onLogout, if set, is called
+// with the username of CAS single logout requests.
+func newCasMiddleware(client *cas.Client, config CasConfig, store CasSessionStore, onLogout func(username string)) echo.MiddlewareFunc {
 	casHandle := echo.WrapMiddleware(client.Handle)
 	casHandler := echo.WrapMiddleware(client.Handler)
-	authMid := func (next echo.HandlerFunc) echo.HandlerFunc {
-		return casHandle(casHandler(next))
+	redirectToLogin := func(c echo.Context, param string) error {
+		u, err := client.LoginUrlForRequest(c.Request())
+		if err != nil {
+			return err
+		}
+		return c.Redirect(http.StatusFound, u+"&"+param+"=true")
+	}
+
+	// A request with a ticket on a renew path is validated even with a
+	// session, the ticket comes from the renewed login.
+	renew := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			if !matchPaths(config.RenewPaths, r) {
+				return next(c)
+			}
+			if r.URL.Query().Get("ticket") == "" {
+				if c.IsWebSocket() {
+					return echo.ErrUnauthorized
+				}
+				return redirectToLogin(c, "renew")
+			}
+			cookies := r.Cookies()
+			r.Header.Del("Cookie")
+			for _, cookie := range cookies {
+				if cookie.Name != casSessionCookie {
+					r.AddCookie(cookie)
+				}
+			}
+			return next(c)
+		}
+	}
+	gateway := func(next, anonymous echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			if !matchPaths(config.GatewayPaths, r) || cas.IsAuthenticated(r) {
+				return next(c)
+			}
+			if _, err := r.Cookie(casGatewayCookie); err == nil || c.IsWebSocket() {
+				c.Set(casAnonymousKey, true)
+				return anonymous(c)
+			}
+			http.SetCookie(c.Response(), &http.Cookie{Name: casGatewayCookie, Value: "1", Path: "/", HttpOnly: true})
+			return redirectToLogin(c, "gateway")
+		}
+	}
+	// A WebSocket client can not follow the login redirect
+	webSocket := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.IsWebSocket() && !cas.IsAuthenticated(c.Request()) {
+				return echo.ErrUnauthorized
+			}
+			return next(c)
+		}
+	}
+	// The CAS client passes requests with an invalid ticket unauthenticated
+	validated := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			if r.URL.Query().Get("ticket") != "" && !cas.IsAuthenticated(r) {
+				casValidationFailures.Inc()
+			}
+			return next(c)
+		}
+	}
+	authMid := func(next, anonymous echo.HandlerFunc) echo.HandlerFunc {
+		return renew(casHandle(validated(gateway(webSocket(casHandler(next)), anonymous))))
+	}
+	var tickets *lru.Cache
+	if onLogout != nil {
+		tickets, _ = lru.New(casLogoutTicketsSize)
+	}
+	var cache *casAttributeCache
+	if config.AttributeCacheOnError {
+		cache = newCasAttributeCache(config.AttributeCacheTTL)
+	}
+	patterns := make([]*regexp.Regexp, len(config.AllowedServiceURLPatterns))
+	for i, p := range config.AllowedServiceURLPatterns {
+		patterns[i] = regexp.MustCompile(p)
+	}
+	allowed := func(s string) bool {
+		for _, p := range patterns {
+			if p.MatchString(s) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The CAS client derives the service URL from the request
+	overrideService := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			v := r.Header.Get(config.ServiceURLOverrideHeader)
+			if config.ServiceURLOverrideHeader == "" || v == "" {
+				return next(c)
+			}
+			u, err := url.Parse(v)
+			if err != nil || !u.IsAbs() || !allowed(v) {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid service url")
+			}
+			c.Set("casServiceRequest", &casServiceRequest{
+				host:  r.Host,
+				url:   r.URL,
+				proto: r.Header.Get(echo.HeaderXForwardedProto),
+			})
+			su := *r.URL
+			su.Path, su.RawPath = u.Path, u.RawPath
+			r.Host, r.URL = u.Host, &su
+			r.Header.Set(echo.HeaderXForwardedProto, u.Scheme)
+			return next(c)
+		}
+	}
+	restoreService := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if o, ok := c.Get("casServiceRequest").(*casServiceRequest); ok {
+				r := c.Request()
+				r.Host, r.URL = o.host, o.url
+				r.Header.Del(echo.HeaderXForwardedProto)
+				if o.proto != "" {
+					r.Header.Set(echo.HeaderXForwardedProto, o.proto)
+				}
+			}
+			return next(c)
+		}
 	}
 	moveAttrToCtx := func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			r := c.Request()
 			attr := cas.Attributes(r)
 			username := cas.Username(r)
-			c.Set("casAttributes", attr)
-			c.Set("casUsername", username)
-			newCtx := context.WithValue(r.Context(), CasUsernameCtxKey, username)
-			newCtx = context.WithValue(newCtx, CasAttributesCtxKey, attr)
-			r.Header.Set("X-CAS-User", username)
-			for k, v := range(attr) {
-				r.Header.Set(fmt.Sprintf("X-CAS-Attr-%s", k), strings.Join(v, " "))
-			}
-			c.SetRequest(r.WithContext(newCtx))
+			r.Header.Del("X-CAS-Stale-Attributes")
+			if cache != nil {
+				if len(attr) > 0 {
+					cache.set(username, attr)
+				} else if cached := cache.get(username); cached != nil {
+					attr = cached
+					r.Header.Set("X-CAS-Stale-Attributes", "true")
+				}
+			}
+			fresh := c.Get("casUsername") == nil && r.URL.Query().Get("ticket") != ""
+			setCasUser(c, config, username, attr)
+			if fresh && config.OnNewSession != nil {
+				config.OnNewSession(c, username, attr)
+			}
+			if ticket := r.URL.Query().Get("ticket"); tickets != nil && ticket != "" {
+				tickets.Add(ticket, username)
+			}
+			if config.CookieMaxAge > 0 && r.URL.Query().Get("ticket") != "" {
+				maxAge := config.CookieMaxAge
+				if date := cas.AuthenticationDate(r); config.ParseTicketLifetime && !date.IsZero() {
+					maxAge -= time.Since(date)
+				}
+				setSessionCookieMaxAge(c, maxAge)
+			}
+			if store != nil {
+				if cookie, err := r.Cookie(casSessionCookie); err == nil {
+					if err := store.Set(cookie.Value, &CasSession{
+						Ticket:     r.URL.Query().Get("ticket"),
+						Username:   username,
+						Attributes: attr,
+					}); err != nil {
+						c.Logger().Errorf("cas: failed to save session: %v", err)
+					}
+				}
+			}
 			return next(c)
 		}
 	}
-	return func(next echo.HandlerFunc) echo.HandlerFunc {
-		return authMid(moveAttrToCtx(next))
+	logout := func(c echo.Context) error {
+		r := c.Request()
+		if cookie, err := r.Cookie(casSessionCookie); err == nil && store != nil {
+			if s, err := store.Get(cookie.Value); err == nil && s != nil && onLogout != nil {
+				onLogout(s.Username)
+			}
+			if err := store.Delete(cookie.Value); err != nil {
+				return err
+			}
+		}
+		client.RedirectToLogout(c.Response(), r)
+		return nil
+	}
+	mid := func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := overrideService(authMid(restoreService(moveAttrToCtx(next)), restoreService(next)))
+		return func(c echo.Context) error {
+			r := c.Request()
+
+			// The CAS client validates tickets without the request context,
+			// don't start a validation for a gone client.
+			if err := r.Context().Err(); err != nil {
+				return err
+			}
+			if config.StripInboundHeaders {
+				for k := range r.Header {
+					if strings.HasPrefix(k, casHeaderPrefix) {
+						r.Header.Del(k)
+					}
+				}
+			}
+			if config.LogoutPath != "" && r.URL.Path == config.LogoutPath {
+				return logout(c)
+			}
+			if store == nil && tickets == nil {
+				return h(c)
+			}
+			if ticket, ok := singleLogoutTicket(r); ok {
+				if tickets != nil {
+					if u, ok := tickets.Get(ticket); ok {
+						tickets.Remove(ticket)
+						onLogout(u.(string))
+					}
+				}
+				if store != nil {
+					if err := store.DeleteByTicket(ticket); err != nil {
+						return err
+					}
+				}
+				return h(c)
+			}
+			if store == nil {
+				return h(c)
+			}
+			if cookie, err := r.Cookie(casSessionCookie); err == nil && !matchPaths(config.RenewPaths, r) {
+				if s, err := store.Get(cookie.Value); err == nil && s != nil {
+					setCasUser(c, config, s.Username, s.Attributes)
+					return next(c)
+				}
+			}
+			return h(c)
+		}
+	}
+	if aead, _ := newCasCookieCipher(config.CookieEncryptionKey); aead != nil {
+		encrypt := casCookieEncryption(aead)
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return encrypt(mid(next))
+		}
 	}
+	return mid
 }
 
 func getUsername(c echo.Context) string {
@@ -140,31 +955,241 @@ func attrGetter(attr string) func(c echo.Context) string {
 	}
 }
 
+func subjectTransform(get func(c echo.Context) string, re *regexp.Regexp, repl string) func(c echo.Context) string {
+	return func(c echo.Context) string {
+		if sub := get(c); sub != "" {
+			return re.ReplaceAllString(sub, repl)
+		}
+		return ""
+	}
+}
+
 func internalErrorMid(_ echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		return echo.ErrInternalServerError
 	}
 }
 
+func (r *Cas) ValidateConfig() error {
+	u, err := url.Parse(r.URL)
+	if err != nil || !u.IsAbs() {
+		return fmt.Errorf("invalid cas url=%s", r.URL)
+	}
+	if _, err := newCasCookieCipher(r.CookieEncryptionKey); err != nil {
+		return err
+	}
+	if r.LogoutPath != "" && !strings.HasPrefix(r.LogoutPath, "/") {
+		return fmt.Errorf("invalid cas logout path=%s", r.LogoutPath)
+	}
+	switch ss := r.sessionStore(); ss.Backend {
+	case "", CasSessionBackendMemory:
+	case CasSessionBackendRedis, CasSessionBackendMemcached, CasSessionBackendPostgres, CasSessionBackendFile:
+		if ss.URI == "" {
+			return fmt.Errorf("session persistence backend=%s requires a uri", ss.Backend)
+		}
+	default:
+		return fmt.Errorf("invalid session persistence backend=%s", ss.Backend)
+	}
+	for _, rules := range [][]string{r.GatewayPaths, r.RenewPaths, r.SkipPaths} {
+		if err := validatePathRules(rules); err != nil {
+			return err
+		}
+	}
+	for _, p := range r.AllowedServiceURLPatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("invalid allowed service url pattern=%s, error=%v", p, err)
+		}
+	}
+	if _, err := regexp.Compile(r.CasbinCfg.SubjectTransformRegex); err != nil {
+		return fmt.Errorf("invalid casbin subject transform regex=%s, error=%v", r.CasbinCfg.SubjectTransformRegex, err)
+	}
+	if _, err := regexp.Compile(r.CasbinCfg.RoleTransformRegex); err != nil {
+		return fmt.Errorf("invalid casbin role transform regex=%s, error=%v", r.CasbinCfg.RoleTransformRegex, err)
+	}
+	if r.CasbinCfg.Model != "" {
+		if r.OPA.enabled() {
+			return errors.New("cas requires either casbin or opa")
+		}
+		if _, err := r.CasbinCfg.Enforcer(); err != nil {
+			return fmt.Errorf("invalid casbin config: %v", err)
+		}
+	}
+	return r.OPA.validate()
+}
+
+func (*Cas) DefaultConfig() interface{} {
+	return CasConfig{
+		URL: "https://cas.example.com",
+		CasbinCfg: CasbinConfig{
+			Model:  "/etc/armor/model.conf",
+			Policy: "/etc/armor/policy.csv",
+		},
+		CookieMaxAge: 8 * time.Hour,
+	}
+}
+
+// EstimateMemory estimates the casbin or OPA decision cache. Sessions and cached
+// attributes grow with the number of users and aren't included.
+func (r *Cas) EstimateMemory() int64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	ttl, size := r.CasbinCfg.EnforceCacheTTL, r.CasbinCfg.EnforceCacheSize
+	if r.OPA.enabled() {
+		ttl, size = r.OPA.DecisionCacheTTL, r.OPA.DecisionCacheSize
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	if size <= 0 {
+		size = 1000
+	}
+	return int64(size) * enforceCacheEntrySize
+}
+
+func (*Cas) OpenAPITag() *openapi3.Tag {
+	return &openapi3.Tag{
+		Name:        "CAS SSO",
+		Description: "Authenticated by CAS single sign-on",
+	}
+}
+
+// OpenAPISecurityScheme describes the CAS session cookie set after the
+// ticket validation.
+func (r *Cas) OpenAPISecurityScheme() *openapi3.SecurityScheme {
+	return &openapi3.SecurityScheme{
+		Type:        "apiKey",
+		In:          "cookie",
+		Name:        casSessionCookie,
+		Description: fmt.Sprintf("CAS session, log in at %s/login", strings.TrimSuffix(r.URL, "/")),
+	}
+}
+
+func (r *Cas) ProbeConfig(probe ProbeFunc) error {
+	return ProbeConfig(&r.CasConfig, probe)
+}
+
 func (r *Cas) Initialize() {
-	client, err := newCasClient(r.CasConfig)
+	client, err := newCasClient(r.CasConfig, r.Logger)
 	if err != nil {
 		r.Middleware = internalErrorMid
 		return
 	}
-	casMid := newCasMiddleware(client)
+	if _, err := newCasCookieCipher(r.CookieEncryptionKey); err != nil {
+		if r.Logger != nil {
+			r.Logger.Errorf("cas: %v", err)
+		}
+		r.Middleware = internalErrorMid
+		return
+	}
+	persist := r.persistSessions()
+	if persist && r.SessionStore == nil {
+		if r.SessionStore, err = newCasSessionStore(r.CasConfig); err != nil {
+			if r.Logger != nil {
+				r.Logger.Errorf("cas: failed to open session store: %v", err)
+			}
+			r.Middleware = internalErrorMid
+			return
+		}
+	}
+	var store CasSessionStore
+	if persist {
+		store = r.SessionStore
+	}
+	r.casbin, r.casbinMid = nil, nil
+	if r.watcher != nil {
+		r.watcher.stop(context.Background())
+		r.watcher = nil
+	}
+	if r.opaMid != nil {
+		r.opaMid.stop(context.Background())
+		r.opaMid = nil
+	}
+	if r.OPA.enabled() {
+		opaMid, err := newOPAMiddleware(r.OPA, getUsername, r.Logger)
+		if err != nil {
+			if r.Logger != nil {
+				r.Logger.Errorf("opa: %v", err)
+			}
+			r.Middleware = internalErrorMid
+			return
+		}
+		casMid := newCasMiddleware(client, r.CasConfig, store, func(username string) {
+			opaMid.InvalidateUserCache(username)
+		})
+		opaMidFunc := opaMid.MiddlewareFunc()
+		r.opaMid = opaMid
+		r.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+			return casMid(opaMidFunc(next))
+		}
+		return
+	}
 	casbinMid, err := newCasbinMiddleware(r.CasbinCfg)
-	if err != nil {
-		r.Middleware = casMid
+	if err != nil || casbinMid == nil {
+		r.Middleware = newCasMiddleware(client, r.CasConfig, store, nil)
 		return
 	}
+	var onLogout func(string)
+	if casbinMid.cache != nil {
+		onLogout = func(username string) {
+			casbinMid.InvalidateUserCache(username)
+		}
+	}
+	casMid := newCasMiddleware(client, r.CasConfig, store, onLogout)
 	casbinMidFunc := casbinMid.MiddlewareFunc()
+	r.casbin, r.casbinMid = casbinMidFunc, casbinMid
+	if r.CasbinCfg.Watch || r.CasbinCfg.PollInterval > 0 {
+		if r.watcher, err = watchCasbin(casbinMid, r.Logger); err != nil && r.Logger != nil {
+			r.Logger.Errorf("casbin: failed to watch the policy: %v", err)
+		}
+	}
 	mid := func(next echo.HandlerFunc) echo.HandlerFunc {
 		return casMid(casbinMidFunc(next))
 	}
 	r.Middleware = mid
 }
 
+// Reload loads the casbin model and policy, or the OPA policy, again, if
+// configured.
+func (r *Cas) Reload() error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.opaMid != nil {
+		return r.opaMid.Reload()
+	}
+	if r.casbinMid == nil {
+		return nil
+	}
+	return r.casbinMid.Reload()
+}
+
+// ShutdownGrace stops the casbin policy watcher and the OPA policy polling.
+func (r *Cas) ShutdownGrace(ctx context.Context) {
+	r.mutex.Lock()
+	w, om := r.watcher, r.opaMid
+	r.watcher, r.opaMid = nil, nil
+	r.mutex.Unlock()
+	if w != nil {
+		w.stop(ctx)
+	}
+	if om != nil {
+		om.stop(ctx)
+	}
+}
+
+// InvalidateUserCache drops the cached casbin or OPA results of username and
+// returns the number of evicted results. CAS single logout calls it too.
+func (r *Cas) InvalidateUserCache(username string) int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.opaMid != nil {
+		return r.opaMid.InvalidateUserCache(username)
+	}
+	if r.casbinMid == nil {
+		return 0
+	}
+	return r.casbinMid.InvalidateUserCache(username)
+}
+
 func (r *Cas) Update(p Plugin) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
@@ -179,5 +1204,30 @@ func (*Cas) Priority() int {
 func (r *Cas) Process(next echo.HandlerFunc) echo.HandlerFunc {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
-	return r.Middleware(next)
+	return skipPaths(r.SkipPaths, next, r.Middleware(next))
+}
+
+// Claims claims the requests with a service ticket whatever `Methods`, the
+// logins return to the service with a GET.
+func (r *Cas) Claims(req *http.Request) bool {
+	return req.URL.Query().Get("ticket") != ""
+}
+
+// ProcessReplay authenticates the user set as `ReplayUserKey` on the context
+// without calling the CAS server and applies casbin, for offline replays.
+func (r *Cas) ProcessReplay(next echo.HandlerFunc) echo.HandlerFunc {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	config, h := r.CasConfig, next
+	if r.casbin != nil {
+		h = r.casbin(next)
+	}
+	return func(c echo.Context) error {
+		username, _ := c.Get(ReplayUserKey).(string)
+		if username == "" {
+			return echo.ErrUnauthorized
+		}
+		setCasUser(c, config, username, cas.UserAttributes{})
+		return h(c)
+	}
 }
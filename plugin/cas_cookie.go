@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// casCookieWriter encrypts the CAS session cookie set on the response
+	// before the header is written.
+	casCookieWriter struct {
+		http.ResponseWriter
+		aead      cipher.AEAD
+		encrypted bool
+	}
+)
+
+var errCasCookieTampered = errors.New("cas: invalid session cookie")
+
+// newCasCookieCipher returns the AES-256-GCM cipher for key, nil if key is
+// empty.
+func newCasCookieCipher(key string) (cipher.AEAD, error) {
+	if key == "" {
+		return nil, nil
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("cas cookie encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptCookie seals value with a random nonce, the cookie name is
+// authenticated so the value can't be moved to another cookie.
+func encryptCookie(aead cipher.AEAD, name, value string) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func decryptCookie(aead cipher.AEAD, name, value string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errCasCookieTampered
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	v, err := aead.Open(nil, nonce, sealed, []byte(name))
+	if err != nil {
+		return "", errCasCookieTampered
+	}
+	return string(v), nil
+}
+
+// decryptRequestCookie replaces the encrypted CAS session cookie of r with
+// its value, an invalid one is dropped as if the client sent none.
+func decryptRequestCookie(r *http.Request, aead cipher.AEAD) {
+	cookies := r.Cookies()
+	found := false
+	for _, c := range cookies {
+		if c.Name == casSessionCookie {
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name == casSessionCookie {
+			v, err := decryptCookie(aead, c.Name, c.Value)
+			if err != nil {
+				continue
+			}
+			c.Value = v
+		}
+		r.AddCookie(c)
+	}
+}
+
+// encrypt encrypts the CAS session cookies in the Set-Cookie headers, once.
+func (w *casCookieWriter) encrypt() {
+	if w.encrypted {
+		return
+	}
+	w.encrypted = true
+	h := w.Header()
+	lines := h[echo.HeaderSetCookie]
+	for i, line := range lines {
+		cookies := (&http.Response{Header: http.Header{echo.HeaderSetCookie: {line}}}).Cookies()
+		if len(cookies) != 1 || cookies[0].Name != casSessionCookie {
+			continue
+		}
+		c := cookies[0]
+		v, err := encryptCookie(w.aead, c.Name, c.Value)
+		if err != nil {
+			// Never send the session ticket in clear text
+			c.Value, c.MaxAge = "", -1
+		} else {
+			c.Value = v
+		}
+		lines[i] = c.String()
+	}
+}
+
+func (w *casCookieWriter) WriteHeader(code int) {
+	w.encrypt()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *casCookieWriter) Write(b []byte) (int, error) {
+	w.encrypt()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *casCookieWriter) Flush() {
+	w.encrypt()
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (w *casCookieWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// casCookieEncryption encrypts the CAS session cookie with aead, the CAS
+// client and session store only see the decrypted value.
+func casCookieEncryption(aead cipher.AEAD) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			decryptRequestCookie(c.Request(), aead)
+			res := c.Response()
+			w := &casCookieWriter{ResponseWriter: res.Writer, aead: aead}
+			res.Writer = w
+			err := next(c)
+			if err == nil && !res.Committed {
+				w.encrypt()
+			}
+			return err
+		}
+	}
+}
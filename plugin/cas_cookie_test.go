@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const casTestCookieKey = "0123456789abcdef0123456789abcdef"
+
+func TestCasCookieEncryption(t *testing.T) {
+	aead, err := newCasCookieCipher(casTestCookieKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := encryptCookie(aead, casSessionCookie, "session-id")
+	if assert.NoError(t, err) {
+		assert.NotContains(t, v, "session-id")
+		d, err := decryptCookie(aead, casSessionCookie, v)
+		assert.NoError(t, err)
+		assert.Equal(t, "session-id", d)
+
+		// Moved to another cookie
+		_, err = decryptCookie(aead, "other", v)
+		assert.Error(t, err)
+	}
+
+	// Key size
+	for key, size := range map[string]string{"short": "5", casTestCookieKey + "0": "33"} {
+		_, err := newCasCookieCipher(key)
+		assert.EqualError(t, err, "cas cookie encryption key must be 32 bytes, got "+size)
+		c := &Cas{CasConfig: CasConfig{URL: "https://cas.labstack.com/cas", CookieEncryptionKey: key}}
+		assert.Error(t, c.ValidateConfig())
+	}
+	aead, err = newCasCookieCipher("")
+	assert.NoError(t, err)
+	assert.Nil(t, aead)
+}
+
+func TestCasCookieEncryptionSession(t *testing.T) {
+	s := newCasServer("jon", nil, time.Now())
+	defer s.Close()
+	var username string
+	ok := func(c echo.Context) error {
+		username = getUsername(c)
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+	c := initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", CookieEncryptionKey: casTestCookieKey}}).(*Cas)
+	aead, _ := newCasCookieCipher(casTestCookieKey)
+
+	// Encrypted on the response
+	req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var cookie *http.Cookie
+	for _, sc := range (&http.Response{Header: rec.Header()}).Cookies() {
+		if sc.Name == casSessionCookie {
+			cookie = sc
+		}
+	}
+	if !assert.NotNil(t, cookie) {
+		return
+	}
+	plain, err := decryptCookie(aead, casSessionCookie, cookie.Value)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, plain)
+
+	// Decrypted on the request
+	username = ""
+	req = httptest.NewRequest(echo.GET, "/", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "jon", username)
+
+	// The clear text value isn't accepted
+	req = httptest.NewRequest(echo.GET, "/", nil)
+	req.AddCookie(&http.Cookie{Name: casSessionCookie, Value: plain})
+	rec = httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusFound, rec.Code)
+
+	// Tampered
+	b, _ := base64.RawURLEncoding.DecodeString(cookie.Value)
+	b[len(b)-1] ^= 1
+	req = httptest.NewRequest(echo.GET, "/", nil)
+	req.AddCookie(&http.Cookie{Name: casSessionCookie, Value: base64.RawURLEncoding.EncodeToString(b)})
+	rec = httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderLocation), s.URL+"/cas/login"))
+
+	// Invalid key
+	c = initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", CookieEncryptionKey: "short"}}).(*Cas)
+	req = httptest.NewRequest(echo.GET, "/?ticket=ST-2", nil)
+	assert.Equal(t, echo.ErrInternalServerError, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+}
@@ -0,0 +1,44 @@
+package plugin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/gommon/log"
+)
+
+type (
+	// casDebugTransport logs the CAS ticket validation calls.
+	casDebugTransport struct {
+		transport http.RoundTripper
+		logger    *log.Logger
+		redact    bool
+	}
+)
+
+var casUserElement = regexp.MustCompile(`(<cas:user>)[^<]*(</cas:user>)`)
+
+func (t *casDebugTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, err := t.transport.RoundTrip(r)
+	if !strings.HasSuffix(r.URL.Path, "Validate") && !strings.HasSuffix(r.URL.Path, "/validate") {
+		return res, err
+	}
+	if err != nil {
+		t.logger.Debugf("cas: validation url=%s, error=%v", r.URL, err)
+		return res, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if t.redact {
+		body = casUserElement.ReplaceAll(body, []byte("${1}[redacted]${2}"))
+	}
+	t.logger.Debugf("cas: validation url=%s, status=%d, body=%s", r.URL, res.StatusCode, body)
+	return res, nil
+}
@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/cas.v2"
+)
+
+var casManagementClient = &http.Client{Timeout: 10 * time.Second}
+
+// SimulateAttributeRelease returns the attributes the CAS server would release
+// for username to service, without the user logging in. It calls the CAS
+// management API with `ManagementAPIToken`.
+func (r *Cas) SimulateAttributeRelease(username, service string) (cas.UserAttributes, error) {
+	r.mutex.RLock()
+	config := r.CasConfig
+	r.mutex.RUnlock()
+	if config.ManagementAPIToken == "" {
+		return nil, errors.New("cas management api token is required")
+	}
+	u, err := url.Parse(strings.TrimSuffix(config.URL, "/") + "/api/users/" + url.PathEscape(username) + "/attributes")
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = url.Values{"service": {service}}.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.ManagementAPIToken)
+	req.Header.Set("Accept", "application/json")
+	res, err := casManagementClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cas management api: user=%s, status=%d", username, res.StatusCode)
+	}
+
+	// Values are either a string or a list of strings
+	body := map[string]interface{}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("cas management api: invalid response: %v", err)
+	}
+	attr := cas.UserAttributes{}
+	for k, v := range body {
+		switch v := v.(type) {
+		case []interface{}:
+			for _, s := range v {
+				attr.Add(k, fmt.Sprint(s))
+			}
+		default:
+			attr.Add(k, fmt.Sprint(v))
+		}
+	}
+	return attr, nil
+}
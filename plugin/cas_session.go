@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"sync"
+
+	"gopkg.in/cas.v2"
+)
+
+type (
+	// CasSession is the authenticated CAS user kept server-side.
+	CasSession struct {
+		Ticket     string             `json:"ticket"`
+		Username   string             `json:"username"`
+		Attributes cas.UserAttributes `json:"attributes"`
+	}
+
+	// CasSessionStore stores CAS sessions by session cookie value. Get returns
+	// a nil session if none is found.
+	CasSessionStore interface {
+		Get(id string) (*CasSession, error)
+		Set(id string, s *CasSession) error
+		Delete(id string) error
+		DeleteByTicket(ticket string) error
+	}
+
+	casMemorySessionStore struct {
+		mutex    sync.RWMutex
+		sessions map[string]*CasSession
+	}
+
+	casLogoutRequest struct {
+		XMLName      xml.Name `xml:"LogoutRequest"`
+		SessionIndex string   `xml:"SessionIndex"`
+	}
+)
+
+func newCasMemorySessionStore() *casMemorySessionStore {
+	return &casMemorySessionStore{sessions: map[string]*CasSession{}}
+}
+
+func (s *casMemorySessionStore) Get(id string) (*CasSession, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.sessions[id], nil
+}
+
+func (s *casMemorySessionStore) Set(id string, session *CasSession) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions[id] = session
+	return nil
+}
+
+func (s *casMemorySessionStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *casMemorySessionStore) DeleteByTicket(ticket string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, session := range s.sessions {
+		if session.Ticket == ticket {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+// singleLogoutTicket returns the service ticket of a CAS single logout
+// request, the back-channel POST sent by the CAS server.
+func singleLogoutTicket(r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost ||
+		!strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return "", false
+	}
+	v := r.FormValue("logoutRequest")
+	if v == "" {
+		return "", false
+	}
+	lr := new(casLogoutRequest)
+	if err := xml.Unmarshal([]byte(v), lr); err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(lr.SessionIndex), true
+}
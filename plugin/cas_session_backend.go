@@ -0,0 +1,315 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/go-redis/redis"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq" // Postgres driver
+)
+
+type (
+	casRedisSessionStore struct {
+		client *redis.Client
+		ttl    time.Duration
+	}
+
+	casMemcachedSessionStore struct {
+		client *memcache.Client
+		ttl    time.Duration
+	}
+
+	casPostgresSessionStore struct {
+		db  *sqlx.DB
+		ttl time.Duration
+	}
+
+	casFileSessionStore struct {
+		*casMemorySessionStore
+		path string
+	}
+)
+
+const (
+	// Session persistence backends
+	CasSessionBackendMemory    = "memory"
+	CasSessionBackendRedis     = "redis"
+	CasSessionBackendMemcached = "memcached"
+	CasSessionBackendPostgres  = "postgres"
+	CasSessionBackendFile      = "file"
+
+	casRedisSessionPrefix = "armor:cas:session:"
+	casRedisTicketPrefix  = "armor:cas:ticket:"
+
+	// Memcached keys can't contain spaces or control characters, ids and
+	// tickets are hashed.
+	casMemcachedSessionPrefix = "armor:cas:session:"
+	casMemcachedTicketPrefix  = "armor:cas:ticket:"
+	casMemcachedPingKey       = "armor:cas:ping"
+
+	casPostgresSessionSchema = `
+		create table if not exists cas_sessions (
+			id text primary key,
+			ticket text not null,
+			session jsonb not null,
+			expires_at timestamptz not null
+		);
+		create index if not exists cas_sessions_ticket on cas_sessions (ticket);
+	`
+)
+
+// newCasSessionStore returns the session store of the configured backend.
+// Sessions expire with the session cookie.
+func newCasSessionStore(config CasConfig) (CasSessionStore, error) {
+	ss := config.sessionStore()
+	ttl := ss.TTL
+	if ttl <= 0 {
+		ttl = config.CookieMaxAge
+	}
+	if ttl <= 0 {
+		ttl = 24 * time.Hour // CAS client session cookie
+	}
+	uri := ss.URI
+	switch ss.Backend {
+	case "", CasSessionBackendMemory:
+		return newCasMemorySessionStore(), nil
+	case CasSessionBackendRedis:
+		opt, err := redis.ParseURL(uri)
+		if err != nil {
+			return nil, err
+		}
+		client := redis.NewClient(opt)
+		if err := client.Ping().Err(); err != nil {
+			client.Close()
+			return nil, err
+		}
+		return &casRedisSessionStore{client: client, ttl: ttl}, nil
+	case CasSessionBackendMemcached:
+		client := memcache.New(strings.Split(uri, ",")...)
+		if err := client.Set(&memcache.Item{Key: casMemcachedPingKey, Value: []byte{1}, Expiration: 1}); err != nil {
+			return nil, err
+		}
+		return &casMemcachedSessionStore{client: client, ttl: ttl}, nil
+	case CasSessionBackendPostgres:
+		db, err := sqlx.Connect("postgres", uri)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec(casPostgresSessionSchema); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return &casPostgresSessionStore{db: db, ttl: ttl}, nil
+	case CasSessionBackendFile:
+		return newCasFileSessionStore(uri)
+	}
+	return nil, fmt.Errorf("invalid session persistence backend=%s", ss.Backend)
+}
+
+func (s *casRedisSessionStore) Get(id string) (*CasSession, error) {
+	b, err := s.client.Get(casRedisSessionPrefix + id).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	session := new(CasSession)
+	return session, json.Unmarshal(b, session)
+}
+
+func (s *casRedisSessionStore) Set(id string, session *CasSession) error {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	p := s.client.TxPipeline()
+	p.Set(casRedisSessionPrefix+id, b, s.ttl)
+	if session.Ticket != "" {
+		p.Set(casRedisTicketPrefix+session.Ticket, id, s.ttl)
+	}
+	_, err = p.Exec()
+	return err
+}
+
+func (s *casRedisSessionStore) Delete(id string) error {
+	return s.client.Del(casRedisSessionPrefix + id).Err()
+}
+
+func (s *casRedisSessionStore) DeleteByTicket(ticket string) error {
+	id, err := s.client.Get(casRedisTicketPrefix + ticket).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return s.client.Del(casRedisSessionPrefix+id, casRedisTicketPrefix+ticket).Err()
+}
+
+func casMemcachedKey(prefix, v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return prefix + hex.EncodeToString(sum[:])
+}
+
+// expiration returns the item expiration, memcached reads more than 30 days
+// as a unix time.
+func (s *casMemcachedSessionStore) expiration() int32 {
+	if s.ttl > 30*24*time.Hour {
+		return int32(time.Now().Add(s.ttl).Unix())
+	}
+	return int32(s.ttl / time.Second)
+}
+
+func (s *casMemcachedSessionStore) Get(id string) (*CasSession, error) {
+	item, err := s.client.Get(casMemcachedKey(casMemcachedSessionPrefix, id))
+	if err == memcache.ErrCacheMiss {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	session := new(CasSession)
+	return session, json.Unmarshal(item.Value, session)
+}
+
+func (s *casMemcachedSessionStore) Set(id string, session *CasSession) error {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if err := s.client.Set(&memcache.Item{
+		Key:        casMemcachedKey(casMemcachedSessionPrefix, id),
+		Value:      b,
+		Expiration: s.expiration(),
+	}); err != nil {
+		return err
+	}
+	if session.Ticket == "" {
+		return nil
+	}
+	return s.client.Set(&memcache.Item{
+		Key:        casMemcachedKey(casMemcachedTicketPrefix, session.Ticket),
+		Value:      []byte(id),
+		Expiration: s.expiration(),
+	})
+}
+
+func (s *casMemcachedSessionStore) Delete(id string) error {
+	err := s.client.Delete(casMemcachedKey(casMemcachedSessionPrefix, id))
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+func (s *casMemcachedSessionStore) DeleteByTicket(ticket string) error {
+	key := casMemcachedKey(casMemcachedTicketPrefix, ticket)
+	item, err := s.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := s.Delete(string(item.Value)); err != nil {
+		return err
+	}
+	if err := s.client.Delete(key); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+func (s *casPostgresSessionStore) Get(id string) (*CasSession, error) {
+	var b []byte
+	err := s.db.Get(&b, `select session from cas_sessions where id = $1 and expires_at > now()`, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	session := new(CasSession)
+	return session, json.Unmarshal(b, session)
+}
+
+func (s *casPostgresSessionStore) Set(id string, session *CasSession) error {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`insert into cas_sessions (id, ticket, session, expires_at)
+		values ($1, $2, $3, $4) on conflict (id) do update set ticket = $2, session = $3,
+		expires_at = $4`, id, session.Ticket, b, time.Now().Add(s.ttl))
+	return err
+}
+
+func (s *casPostgresSessionStore) Delete(id string) error {
+	_, err := s.db.Exec(`delete from cas_sessions where id = $1`, id)
+	return err
+}
+
+func (s *casPostgresSessionStore) DeleteByTicket(ticket string) error {
+	_, err := s.db.Exec(`delete from cas_sessions where ticket = $1`, ticket)
+	return err
+}
+
+// newCasFileSessionStore loads the sessions saved at path, the file is
+// rewritten on every change.
+func newCasFileSessionStore(path string) (*casFileSessionStore, error) {
+	s := &casFileSessionStore{casMemorySessionStore: newCasMemorySessionStore(), path: path}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.sessions); err != nil {
+		return nil, fmt.Errorf("invalid session file=%s, error=%v", path, err)
+	}
+	return s, nil
+}
+
+func (s *casFileSessionStore) save() error {
+	s.mutex.RLock()
+	b, err := json.Marshal(s.sessions)
+	s.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".sessions")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *casFileSessionStore) Set(id string, session *CasSession) error {
+	s.casMemorySessionStore.Set(id, session)
+	return s.save()
+}
+
+func (s *casFileSessionStore) Delete(id string) error {
+	s.casMemorySessionStore.Delete(id)
+	return s.save()
+}
+
+func (s *casFileSessionStore) DeleteByTicket(ticket string) error {
+	s.casMemorySessionStore.DeleteByTicket(ticket)
+	return s.save()
+}
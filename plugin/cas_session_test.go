@@ -0,0 +1,213 @@
+package plugin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSessionRestart checks that sessions created by one plugin instance are
+// served by a new instance with the same config, e.g. after a restart.
+func testSessionRestart(t *testing.T, config CasConfig) {
+	s := newCasServer("jon", map[string]string{"mail": "jon@labstack.com"}, time.Now())
+	defer s.Close()
+	validations := 0
+	h := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validations++
+		h.ServeHTTP(w, r)
+	})
+	config.URL = s.URL + "/cas"
+	username := ""
+	ok := func(c echo.Context) error {
+		username = getUsername(c)
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+
+	c := initialized(&Cas{CasConfig: config}).(*Cas)
+	req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	cookies := (&http.Response{Header: rec.Header()}).Cookies()
+	if !assert.Len(t, cookies, 1) {
+		return
+	}
+
+	// Restart
+	c = initialized(&Cas{CasConfig: config}).(*Cas)
+	username = ""
+	req = httptest.NewRequest(echo.GET, "/", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "jon", username)
+	assert.Equal(t, 1, validations)
+
+	// Single logout
+	form := url.Values{"logoutRequest": {`<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol">
+		<samlp:SessionIndex>ST-1</samlp:SessionIndex>
+	</samlp:LogoutRequest>`}}
+	req = httptest.NewRequest(echo.POST, "/", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	c = initialized(&Cas{CasConfig: config}).(*Cas)
+	session, err := c.SessionStore.Get(cookies[0].Value)
+	assert.NoError(t, err)
+	assert.Nil(t, session)
+}
+
+func TestCasSessionRedis(t *testing.T) {
+	r, err := miniredis.Run()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	testSessionRestart(t, CasConfig{
+		SessionPersistenceBackend: CasSessionBackendRedis,
+		SessionPersistenceURI:     "redis://" + r.Addr(),
+	})
+	assert.Empty(t, r.Keys())
+}
+
+func TestCasSessionFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	testSessionRestart(t, CasConfig{
+		SessionPersistenceBackend: CasSessionBackendFile,
+		SessionPersistenceURI:     filepath.Join(dir, "sessions.json"),
+	})
+}
+
+// newMemcached starts a memcached server implementing get, set and delete.
+func newMemcached(t *testing.T) (addr string, keys func() []string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mutex sync.Mutex
+	items := map[string][]byte{}
+	keys = func() (k []string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for key := range items {
+			k = append(k, key)
+		}
+		return
+	}
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			f := strings.Fields(line)
+			if len(f) == 0 {
+				continue
+			}
+			mutex.Lock()
+			switch f[0] {
+			case "get", "gets":
+				for _, k := range f[1:] {
+					if v, ok := items[k]; ok {
+						fmt.Fprintf(conn, "VALUE %s 0 %d 1\r\n%s\r\n", k, len(v), v)
+					}
+				}
+				fmt.Fprint(conn, "END\r\n")
+			case "set":
+				n, _ := strconv.Atoi(f[4])
+				v := make([]byte, n+2)
+				io.ReadFull(r, v)
+				items[f[1]] = v[:n]
+				fmt.Fprint(conn, "STORED\r\n")
+			case "delete":
+				if _, ok := items[f[1]]; ok {
+					delete(items, f[1])
+					fmt.Fprint(conn, "DELETED\r\n")
+				} else {
+					fmt.Fprint(conn, "NOT_FOUND\r\n")
+				}
+			default:
+				fmt.Fprint(conn, "ERROR\r\n")
+			}
+			mutex.Unlock()
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String(), keys, func() { ln.Close() }
+}
+
+func TestCasSessionMemcached(t *testing.T) {
+	addr, keys, stop := newMemcached(t)
+	defer stop()
+	testSessionRestart(t, CasConfig{
+		SessionStoreCfg: CasSessionStoreConfig{
+			Backend: CasSessionBackendMemcached,
+			URI:     addr,
+		},
+	})
+	assert.Equal(t, []string{casMemcachedPingKey}, keys())
+}
+
+func TestCasSessionStoreConfig(t *testing.T) {
+	r, err := miniredis.Run()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+
+	// Precedence over the session persistence backend
+	config := CasConfig{
+		SessionPersistenceBackend: CasSessionBackendFile,
+		SessionPersistenceURI:     "/nonexistent/sessions.json",
+		SessionStoreCfg: CasSessionStoreConfig{
+			Backend: CasSessionBackendRedis,
+			URI:     "redis://" + r.Addr(),
+			TTL:     time.Hour,
+		},
+	}
+	assert.True(t, config.persistSessions())
+	store, err := newCasSessionStore(config)
+	if assert.NoError(t, err) {
+		assert.NoError(t, store.Set("id", &CasSession{Ticket: "ST-1", Username: "jon"}))
+		assert.Equal(t, time.Hour, r.TTL(casRedisSessionPrefix+"id"))
+	}
+
+	c := &Cas{CasConfig: CasConfig{
+		URL:             "https://cas.labstack.com/cas",
+		SessionStoreCfg: CasSessionStoreConfig{Backend: CasSessionBackendMemcached},
+	}}
+	assert.Error(t, c.ValidateConfig())
+	c.SessionStoreCfg.Backend = "mongo"
+	assert.Error(t, c.ValidateConfig())
+}
@@ -0,0 +1,1056 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cas.v2"
+)
+
+const casServiceResponse = `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+	<cas:authenticationSuccess>
+		<cas:user>%s</cas:user>
+		<cas:attributes>
+			<cas:authenticationDate>%s</cas:authenticationDate>
+			%s
+		</cas:attributes>
+	</cas:authenticationSuccess>
+</cas:serviceResponse>`
+
+// newCasServer starts a CAS server validating any ticket for the given user.
+func newCasServer(user string, attrs map[string]string, date time.Time) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/serviceValidate") {
+			http.NotFound(w, r)
+			return
+		}
+		a := ""
+		for k, v := range attrs {
+			a += fmt.Sprintf("<cas:%s>%s</cas:%s>", k, v, k)
+		}
+		fmt.Fprintf(w, casServiceResponse, user, date.Format(time.RFC3339), a)
+	}))
+}
+
+func TestCasCookieMaxAge(t *testing.T) {
+	s := newCasServer("jon", nil, time.Now().Add(-time.Hour))
+	defer s.Close()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+
+	// Configured
+	c := initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", CookieMaxAge: 8 * time.Hour}}).(*Cas)
+	req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, rec.Header()[echo.HeaderSetCookie], 1)
+	assert.Contains(t, rec.Header().Get(echo.HeaderSetCookie), "Max-Age=28800")
+
+	// Derived from the authentication date
+	c = initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", CookieMaxAge: 8 * time.Hour, ParseTicketLifetime: true}}).(*Cas)
+	req = httptest.NewRequest(echo.GET, "/?ticket=ST-2", nil)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Regexp(t, "Max-Age=25(199|200)$", rec.Header().Get(echo.HeaderSetCookie))
+}
+
+func TestCasMethods(t *testing.T) {
+	s := newCasServer("jon", nil, time.Now())
+	defer s.Close()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+	c := initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas"}}).(*Cas)
+	c.Methods = []string{"POST", "PUT", "DELETE"}
+	h := Activate(c)(ok)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		assert.NoError(t, h(e.NewContext(httptest.NewRequest(method, target, nil), rec)))
+		return rec
+	}
+
+	// Public
+	assert.Equal(t, http.StatusOK, serve(echo.GET, "/").Code)
+
+	// Login required
+	rec := serve(echo.POST, "/")
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Contains(t, rec.Header().Get(echo.HeaderLocation), s.URL+"/cas/login")
+
+	// The login returns with a GET
+	rec = serve(echo.GET, "/?ticket=ST-1")
+	assert.Contains(t, rec.Header().Get(echo.HeaderSetCookie), casSessionCookie)
+}
+
+func TestCasAttributeCacheOnError(t *testing.T) {
+	attrs := map[string]string{"mail": "jon@labstack.com"}
+	s := newCasServer("jon", attrs, time.Now())
+	defer s.Close()
+	var header http.Header
+	var mail string
+	ok := func(c echo.Context) error {
+		header = c.Request().Header
+		mail = getCasAttributes(c).Get("mail")
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+	c := initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", AttributeCacheOnError: true}}).(*Cas)
+
+	req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, "jon@labstack.com", mail)
+	assert.Equal(t, "", header.Get("X-CAS-Stale-Attributes"))
+
+	// Attribute repository outage
+	delete(attrs, "mail")
+	req = httptest.NewRequest(echo.GET, "/?ticket=ST-2", nil)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, "jon@labstack.com", mail)
+	assert.Equal(t, "jon@labstack.com", header.Get("X-CAS-Attr-mail"))
+	assert.Equal(t, "true", header.Get("X-CAS-Stale-Attributes"))
+
+	// Expired, revoked attributes no longer apply
+	c = initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", AttributeCacheOnError: true, AttributeCacheTTL: 20 * time.Millisecond}}).(*Cas)
+	attrs["mail"] = "jon@labstack.com"
+	req = httptest.NewRequest(echo.GET, "/?ticket=ST-3", nil)
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(t, "jon@labstack.com", mail)
+	delete(attrs, "mail")
+	time.Sleep(30 * time.Millisecond)
+	req = httptest.NewRequest(echo.GET, "/?ticket=ST-4", nil)
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(t, "", mail)
+	assert.Equal(t, "", header.Get("X-CAS-Stale-Attributes"))
+}
+
+func TestCasbinEnforceCache(t *testing.T) {
+	cb, err := newCasbinMiddleware(CasbinConfig{
+		Model:           "testdata/casbin_model.conf",
+		Policy:          "testdata/casbin_policy.csv",
+		EnforceCacheTTL: time.Minute,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	hits := testutil.ToFloat64(casbinCacheHits)
+	misses := testutil.ToFloat64(casbinCacheMisses)
+
+	assert.True(t, cb.enforce("jon", "*"))
+	assert.False(t, cb.enforce("joe", "*"))
+	assert.Equal(t, misses+2, testutil.ToFloat64(casbinCacheMisses))
+
+	// Hit
+	assert.True(t, cb.enforce("jon", "*"))
+	assert.False(t, cb.enforce("joe", "*"))
+	assert.Equal(t, hits+2, testutil.ToFloat64(casbinCacheHits))
+
+	// Policy change
+	cb.Enforcer.AddPolicy("joe", "*")
+	assert.False(t, cb.enforce("joe", "*"))
+	cb.InvalidateCache()
+	assert.True(t, cb.enforce("joe", "*"))
+	assert.Equal(t, misses+3, testutil.ToFloat64(casbinCacheMisses))
+}
+
+func TestCasbinInvalidateUserCache(t *testing.T) {
+	cb, err := newCasbinMiddleware(CasbinConfig{
+		Model:           "testdata/casbin_model.conf",
+		Policy:          "testdata/casbin_policy.csv",
+		EnforceCacheTTL: time.Minute,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, cb.enforce("jon", "*"))
+	assert.True(t, cb.enforce("jon", "/admin"))
+	assert.False(t, cb.enforce("joe", "*"))
+	assert.False(t, cb.enforce("jonathan", "*"))
+
+	// Role change
+	cb.Enforcer.RemovePolicy("jon", "*")
+	assert.True(t, cb.enforce("jon", "*"))
+	assert.Equal(t, 2, cb.InvalidateUserCache("jon"))
+	assert.False(t, cb.enforce("jon", "*"))
+	assert.Equal(t, 0, cb.InvalidateUserCache("nobody"))
+
+	// Other users are kept
+	misses := testutil.ToFloat64(casbinCacheMisses)
+	assert.False(t, cb.enforce("joe", "*"))
+	assert.False(t, cb.enforce("jonathan", "*"))
+	assert.Equal(t, misses, testutil.ToFloat64(casbinCacheMisses))
+
+	// Transformed subjects, of the usernames, exactly
+	cb, err = newCasbinMiddleware(CasbinConfig{
+		Model:                   "testdata/casbin_model.conf",
+		Policy:                  "testdata/casbin_policy.csv",
+		EnforceCacheTTL:         time.Minute,
+		SubjectTransformRegex:   `^([^@]+)@.*$`,
+		SubjectTransformReplace: "$1",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, cb.enforce("jon", "*"))
+	assert.False(t, cb.enforce("jon2", "*"))
+	assert.Equal(t, 1, cb.InvalidateUserCache("jon@labstack.com"))
+	assert.Equal(t, 1, cb.InvalidateUserCache("jon2@labstack.com"))
+}
+
+func TestCasSingleLogoutInvalidatesCasbinCache(t *testing.T) {
+	s := newCasServer("jon", nil, time.Now())
+	defer s.Close()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+	c := initialized(&Cas{CasConfig: CasConfig{
+		URL: s.URL + "/cas",
+		CasbinCfg: CasbinConfig{
+			Model:           "testdata/casbin_model.conf",
+			Policy:          "testdata/casbin_policy.csv",
+			EnforceCacheTTL: time.Minute,
+		},
+	}}).(*Cas)
+
+	req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, c.casbinMid.cache.cache.Len())
+
+	form := url.Values{"logoutRequest": {`<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol">
+		<samlp:SessionIndex>ST-1</samlp:SessionIndex>
+	</samlp:LogoutRequest>`}}
+	req = httptest.NewRequest(echo.POST, "/", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	c.Process(ok)(e.NewContext(req, httptest.NewRecorder()))
+	assert.Equal(t, 0, c.casbinMid.cache.cache.Len())
+	assert.Equal(t, 0, c.InvalidateUserCache("jon"))
+}
+
+func TestCasbinPathAuthorization(t *testing.T) {
+	e := echo.New()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+	serve := func(cb *casbinMiddleware, user, method, path string) int {
+		cb.SubjectFunc = func(echo.Context) string {
+			return user
+		}
+		rec := httptest.NewRecorder()
+		err := cb.MiddlewareFunc()(ok)(e.NewContext(httptest.NewRequest(method, path, nil), rec))
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he.Code
+		}
+		return rec.Code
+	}
+	cfg := CasbinConfig{
+		Model:      "testdata/casbin_resource_model.conf",
+		Policy:     "testdata/casbin_resource_policy.csv",
+		PathObject: true,
+	}
+	cb, err := newCasbinMiddleware(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, serve(cb, "jon", echo.DELETE, "/users/1"))
+	assert.Equal(t, http.StatusOK, serve(cb, "joe", echo.GET, "/docs/api"))
+	assert.Equal(t, http.StatusForbidden, serve(cb, "joe", echo.POST, "/docs/api"))
+	assert.Equal(t, http.StatusForbidden, serve(cb, "joe", echo.GET, "/users/1"))
+
+	// Cleaned paths
+	for _, path := range []string{"/docs/../users/1", "//users/1", "/docs/./../users/1"} {
+		assert.Equal(t, http.StatusForbidden, serve(cb, "joe", echo.GET, path), path)
+	}
+	assert.Equal(t, http.StatusOK, serve(cb, "joe", echo.GET, "/users/../docs/api"))
+
+	// Model without action
+	cb, err = newCasbinMiddleware(CasbinConfig{
+		Model:      "testdata/casbin_model.conf",
+		Policy:     "testdata/casbin_policy.csv",
+		PathObject: true,
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, serve(cb, "jon", echo.GET, "/users/1"))
+		assert.Equal(t, http.StatusForbidden, serve(cb, "joe", echo.GET, "/users/1"))
+	}
+
+	// Wildcard object, the default
+	cfg.PathObject = false
+	cb, err = newCasbinMiddleware(cfg)
+	if assert.NoError(t, err) {
+		// `*` doesn't match the `/docs/*` object nor the `GET` action
+		assert.Equal(t, http.StatusForbidden, serve(cb, "joe", echo.GET, "/docs/api"))
+		cb.Enforcer.AddPolicy("joe", "*", "*")
+		assert.Equal(t, http.StatusOK, serve(cb, "joe", echo.POST, "/users/1"))
+	}
+}
+
+func TestCasbinReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	policy := filepath.Join(dir, "policy.csv")
+	write := func(p string) {
+		assert.NoError(t, ioutil.WriteFile(policy, []byte(p), 0644))
+	}
+	write("p, jon, *\n")
+	cfg := CasbinConfig{
+		Model:           "testdata/casbin_model.conf",
+		Policy:          policy,
+		EnforceCacheTTL: time.Minute,
+	}
+	eventually := func(cb *casbinMiddleware, sub string, allow bool) bool {
+		for i := 0; i < 100; i++ {
+			if cb.enforce(sub, "*") == allow {
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+
+	// On demand
+	cb, err := newCasbinMiddleware(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, cb.enforce("jon", "*"))
+	write("p, joe, *\n")
+	assert.True(t, cb.enforce("jon", "*"))
+	assert.NoError(t, cb.Reload())
+	assert.False(t, cb.enforce("jon", "*"))
+	assert.True(t, cb.enforce("joe", "*"))
+
+	// Invalid model keeps the current enforcer
+	cb.cfg.Model = filepath.Join(dir, "missing.conf")
+	assert.Error(t, cb.Reload())
+	assert.True(t, cb.enforce("joe", "*"))
+
+	// File watcher
+	for _, cfg := range []CasbinConfig{
+		{Model: cfg.Model, Policy: policy, Watch: true},
+		{Model: cfg.Model, Policy: policy, PollInterval: 20 * time.Millisecond},
+	} {
+		write("p, jon, *\n")
+		c := initialized(&Cas{CasConfig: CasConfig{URL: "https://cas.labstack.com/cas", CasbinCfg: cfg}}).(*Cas)
+		if !assert.NotNil(t, c.watcher) {
+			return
+		}
+		assert.True(t, c.casbinMid.enforce("jon", "*"))
+		time.Sleep(50 * time.Millisecond) // Distinct modification time
+		write("p, joe, *\n")
+		assert.True(t, eventually(c.casbinMid, "joe", true))
+		assert.False(t, c.casbinMid.enforce("jon", "*"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		c.ShutdownGrace(ctx)
+		cancel()
+		assert.Nil(t, c.watcher)
+	}
+}
+
+func TestCasbinPolicyAdapter(t *testing.T) {
+	r, err := miniredis.Run()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	r.Push(casbinRedisKey, `{"PType":"p","V0":"jon","V1":"*"}`)
+	cfg := CasbinConfig{
+		Model: "testdata/casbin_model.conf",
+		PolicyAdapter: CasbinPolicyAdapterConfig{
+			Type: CasbinAdapterRedis,
+			URI:  "redis://" + r.Addr(),
+		},
+	}
+	cb, err := newCasbinMiddleware(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, cb.enforce("jon", "*"))
+	assert.False(t, cb.enforce("joe", "*"))
+
+	a, err := newCasbinAdapter(cfg.PolicyAdapter)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close()
+	assert.NoError(t, a.AddPolicy("p", "p", []string{"joe", "/users/*"}))
+	assert.NoError(t, a.RemovePolicy("p", "p", []string{"jon", "*"}))
+	assert.NoError(t, cb.Reload())
+	assert.False(t, cb.enforce("jon", "*"))
+	assert.True(t, cb.enforce("joe", "/users/1"))
+	assert.NoError(t, a.RemoveFilteredPolicy("p", "p", 0, "joe"))
+	assert.NoError(t, cb.Reload())
+	assert.False(t, cb.enforce("joe", "/users/1"))
+
+	// Invalid adapters
+	for _, pa := range []CasbinPolicyAdapterConfig{
+		{Type: "mongo", URI: "mongodb://localhost"},
+		{Type: CasbinAdapterRedis},
+		{Type: CasbinAdapterPostgres, URI: "postgres://localhost", Table: "rules; drop table users"},
+	} {
+		_, err := newCasbinAdapter(pa)
+		assert.Error(t, err)
+	}
+}
+
+func TestCasbinRule(t *testing.T) {
+	r := newCasbinRule("p", []string{"jon", "/users/*", "GET"})
+	assert.Equal(t, "p, jon, /users/*, GET", r.line())
+	assert.True(t, r.matches("p", 1, []string{"/users/*"}))
+	assert.True(t, r.matches("p", 0, []string{"", "", "GET"}))
+	assert.False(t, r.matches("p", 0, []string{"joe"}))
+	assert.False(t, r.matches("g", 0, []string{"jon"}))
+}
+
+func TestCasPersistUserSession(t *testing.T) {
+	s := newCasServer("jon", map[string]string{"mail": "jon@labstack.com"}, time.Now())
+	defer s.Close()
+	validations := 0
+	h := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validations++
+		h.ServeHTTP(w, r)
+	})
+	var username, mail string
+	ok := func(c echo.Context) error {
+		username = getUsername(c)
+		mail = getCasAttributes(c).Get("mail")
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+	c := initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", PersistUserSession: true}}).(*Cas)
+
+	req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, 1, validations)
+	cookie := &http.Cookie{Name: casSessionCookie}
+	for _, sc := range (&http.Response{Header: rec.Header()}).Cookies() {
+		if sc.Name == casSessionCookie {
+			cookie = sc
+		}
+	}
+	session, err := c.SessionStore.Get(cookie.Value)
+	if assert.NoError(t, err) && assert.NotNil(t, session) {
+		assert.Equal(t, "ST-1", session.Ticket)
+		assert.Equal(t, "jon", session.Username)
+	}
+
+	// Hit, from a fresh plugin sharing the store
+	c2 := initialized(&Cas{CasConfig: c.CasConfig, SessionStore: c.SessionStore}).(*Cas)
+	username, mail = "", ""
+	req = httptest.NewRequest(echo.GET, "/", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, c2.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, validations)
+	assert.Equal(t, "jon", username)
+	assert.Equal(t, "jon@labstack.com", mail)
+	assert.Equal(t, "jon", req.Header.Get("X-CAS-User"))
+
+	// Single logout
+	form := url.Values{"logoutRequest": {`<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol">
+		<samlp:SessionIndex>ST-1</samlp:SessionIndex>
+	</samlp:LogoutRequest>`}}
+	req = httptest.NewRequest(echo.POST, "/", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, c2.Process(ok)(e.NewContext(req, rec)))
+	session, err = c.SessionStore.Get(cookie.Value)
+	assert.NoError(t, err)
+	assert.Nil(t, session)
+}
+
+func TestCasLogoutPath(t *testing.T) {
+	s := newCasServer("jon", nil, time.Now())
+	defer s.Close()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+	c := initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", LogoutPath: "/logout", PersistUserSession: true}}).(*Cas)
+	sessionCookie := func(rec *httptest.ResponseRecorder) *http.Cookie {
+		for _, sc := range (&http.Response{Header: rec.Header()}).Cookies() {
+			if sc.Name == casSessionCookie {
+				return sc
+			}
+		}
+		return nil
+	}
+
+	req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	cookie := sessionCookie(rec)
+	if !assert.NotNil(t, cookie) {
+		return
+	}
+	cookie.MaxAge = 0
+
+	// Logout
+	req = httptest.NewRequest(echo.GET, "/logout", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, s.URL+"/cas/logout", rec.Header().Get(echo.HeaderLocation))
+	if cleared := sessionCookie(rec); assert.NotNil(t, cleared) {
+		assert.True(t, cleared.MaxAge < 0)
+	}
+	session, err := c.SessionStore.Get(cookie.Value)
+	assert.NoError(t, err)
+	assert.Nil(t, session)
+
+	// The old cookie is no longer authenticated
+	req = httptest.NewRequest(echo.GET, "/", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderLocation), s.URL+"/cas/login"))
+
+	// Validation
+	c = &Cas{CasConfig: CasConfig{URL: s.URL + "/cas", LogoutPath: "logout"}}
+	assert.Error(t, c.ValidateConfig())
+}
+
+func TestCasForwardedUserHeader(t *testing.T) {
+	s := newCasServer("jon", nil, time.Now())
+	defer s.Close()
+	var header http.Header
+	ok := func(c echo.Context) error {
+		header = c.Request().Header
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+	custom, empty := "X-Remote-User", ""
+
+	// Default
+	c := initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas"}}).(*Cas)
+	req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(t, "jon", header.Get("X-CAS-User"))
+	assert.Equal(t, "jon", header.Get("X-Forwarded-User"))
+
+	// Custom
+	c = initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", ForwardedUserHeader: &custom}}).(*Cas)
+	req = httptest.NewRequest(echo.GET, "/?ticket=ST-2", nil)
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(t, "jon", header.Get("X-Remote-User"))
+	assert.Equal(t, "", header.Get("X-Forwarded-User"))
+
+	// Disabled
+	c = initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", ForwardedUserHeader: &empty}}).(*Cas)
+	req = httptest.NewRequest(echo.GET, "/?ticket=ST-3", nil)
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(t, "jon", header.Get("X-CAS-User"))
+	assert.Equal(t, "", header.Get("X-Forwarded-User"))
+}
+
+func TestCasOnNewSession(t *testing.T) {
+	s := newCasServer("jon", map[string]string{"mail": "jon@labstack.com"}, time.Now())
+	defer s.Close()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+	calls := []string{}
+	c := initialized(&Cas{CasConfig: CasConfig{
+		URL: s.URL + "/cas",
+		OnNewSession: func(c echo.Context, username string, attrs cas.UserAttributes) {
+			calls = append(calls, username+" "+attrs.Get("mail"))
+		},
+	}}).(*Cas)
+
+	// First authentication
+	req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"jon jon@labstack.com"}, calls)
+
+	// Same session
+	cookies := (&http.Response{Header: rec.Header()}).Cookies()
+	if !assert.NotEmpty(t, cookies) {
+		return
+	}
+	for i := 0; i < 2; i++ {
+		req = httptest.NewRequest(echo.GET, "/", nil)
+		req.AddCookie(cookies[0])
+		rec = httptest.NewRecorder()
+		assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	assert.Len(t, calls, 1)
+}
+
+func TestCasServiceURLOverrideHeader(t *testing.T) {
+	s := newCasServer("jon", nil, time.Now())
+	defer s.Close()
+	service := ""
+	h := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service = r.URL.Query().Get("service")
+		h.ServeHTTP(w, r)
+	})
+	path := ""
+	ok := func(c echo.Context) error {
+		path = c.Request().URL.Path
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+	c := initialized(&Cas{CasConfig: CasConfig{
+		URL:                       s.URL + "/cas",
+		ServiceURLOverrideHeader:  "X-Forwarded-Service-URL",
+		AllowedServiceURLPatterns: []string{`^https://app\.labstack\.com/`},
+	}}).(*Cas)
+
+	// Trusted
+	req := httptest.NewRequest(echo.GET, "/users?ticket=ST-1", nil)
+	req.Header.Set("X-Forwarded-Service-URL", "https://app.labstack.com/app/users")
+	rec := httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "https://app.labstack.com/app/users", service)
+	assert.Equal(t, "/users", path)
+
+	req = httptest.NewRequest(echo.GET, "/users", nil)
+	req.Header.Set("X-Forwarded-Service-URL", "https://app.labstack.com/app/users")
+	rec = httptest.NewRecorder()
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Contains(t, rec.Header().Get(echo.HeaderLocation), "service="+url.QueryEscape("https://app.labstack.com/app/users"))
+
+	// Untrusted
+	service = ""
+	for _, v := range []string{"https://evil.com/app.labstack.com/", "/app/users"} {
+		req = httptest.NewRequest(echo.GET, "/users?ticket=ST-2", nil)
+		req.Header.Set("X-Forwarded-Service-URL", v)
+		err := c.Process(ok)(e.NewContext(req, httptest.NewRecorder()))
+		if assert.IsType(t, &echo.HTTPError{}, err) {
+			assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+		}
+		assert.Equal(t, "", service)
+	}
+}
+
+func TestCasbinEnforcementLogSampling(t *testing.T) {
+	e := echo.New()
+	buf := new(bytes.Buffer)
+	e.Logger.SetOutput(buf)
+	e.Logger.SetLevel(log.DEBUG)
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+	run := func(config CasbinConfig, sub string, n int) int {
+		config.Model = "testdata/casbin_model.conf"
+		config.Policy = "testdata/casbin_policy.csv"
+		cb, err := newCasbinMiddleware(config)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		cb.SubjectFunc = func(echo.Context) string {
+			return sub
+		}
+		buf.Reset()
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest(echo.GET, "/", nil)
+			req.Header.Set(echo.HeaderXRequestID, fmt.Sprintf("id-%d", i))
+			cb.MiddlewareFunc()(ok)(e.NewContext(req, httptest.NewRecorder()))
+		}
+		return strings.Count(buf.String(), `"casbin":"enforce"`)
+	}
+
+	// Deny, always logged
+	assert.Equal(t, 100, run(CasbinConfig{AlwaysLogDeny: true}, "joe", 100))
+	assert.Equal(t, 100, run(CasbinConfig{AlwaysLogDeny: true, EnforcementLogSampleRate: 0.1}, "joe", 100))
+	assert.Equal(t, 0, run(CasbinConfig{}, "joe", 100))
+
+	// Allow, sampled
+	assert.Equal(t, 0, run(CasbinConfig{AlwaysLogDeny: true}, "jon", 100))
+	assert.Equal(t, 100, run(CasbinConfig{EnforcementLogSampleRate: 1}, "jon", 100))
+	n := run(CasbinConfig{EnforcementLogSampleRate: 0.5}, "jon", 1000)
+	assert.InDelta(t, 500, n, 100)
+	assert.Equal(t, n, run(CasbinConfig{EnforcementLogSampleRate: 0.5}, "jon", 1000)) // Deterministic
+}
+
+func TestCasSimulateAttributeRelease(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/cas/api/users/jon/attributes" || r.URL.Query().Get("service") != "https://app.labstack.com" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"mail": "jon@labstack.com", "memberOf": ["admin", "dev"]}`))
+	}))
+	defer s.Close()
+
+	c := initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", ManagementAPIToken: "secret"}}).(*Cas)
+	attr, err := c.SimulateAttributeRelease("jon", "https://app.labstack.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "jon@labstack.com", attr.Get("mail"))
+		assert.Equal(t, []string{"admin", "dev"}, attr["memberOf"])
+	}
+
+	// Unknown user
+	_, err = c.SimulateAttributeRelease("joe", "https://app.labstack.com")
+	assert.Error(t, err)
+
+	// Invalid token
+	c = initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", ManagementAPIToken: "invalid"}}).(*Cas)
+	_, err = c.SimulateAttributeRelease("jon", "https://app.labstack.com")
+	assert.Error(t, err)
+
+	c = initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas"}}).(*Cas)
+	_, err = c.SimulateAttributeRelease("jon", "https://app.labstack.com")
+	assert.Error(t, err)
+}
+
+func TestCasAttributeBlacklist(t *testing.T) {
+	s := newCasServer("jon", map[string]string{"mail": "jon@labstack.com", "ssn": "078-05-1120"}, time.Now())
+	defer s.Close()
+	var header http.Header
+	var attr cas.UserAttributes
+	ok := func(c echo.Context) error {
+		header = c.Request().Header
+		attr = getCasAttributes(c)
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+	c := initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", AttributeBlacklist: []string{"ssn"}}}).(*Cas)
+
+	req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+	req.Header.Set("X-CAS-Attr-ssn", "spoofed")
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(t, "078-05-1120", attr.Get("ssn"))
+	assert.Equal(t, "", header.Get("X-CAS-Attr-ssn"))
+	assert.Equal(t, "jon@labstack.com", header.Get("X-CAS-Attr-mail"))
+}
+
+func TestCasbinSubjectTransform(t *testing.T) {
+	e := echo.New()
+	for _, tc := range []struct {
+		regex, replace, expect string
+	}{
+		{`^([^@]+)@.*$`, "$1", "jon"},
+		{`^[^@]+@(.*)$`, "$1", "labstack.com"},
+		{"", "", "jon@labstack.com"},
+	} {
+		cb, err := newCasbinMiddleware(CasbinConfig{
+			Model:                   "testdata/casbin_model.conf",
+			Policy:                  "testdata/casbin_policy.csv",
+			SubjectAttribute:        "mail",
+			SubjectTransformRegex:   tc.regex,
+			SubjectTransformReplace: tc.replace,
+		})
+		if !assert.NoError(t, err) {
+			continue
+		}
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), CasAttributesCtxKey, cas.UserAttributes{"mail": {"jon@labstack.com"}}))
+		assert.Equal(t, tc.expect, cb.SubjectFunc(e.NewContext(req, nil)))
+	}
+
+	// Local part matches the policy
+	cb, _ := newCasbinMiddleware(CasbinConfig{
+		Model:                   "testdata/casbin_model.conf",
+		Policy:                  "testdata/casbin_policy.csv",
+		SubjectAttribute:        "mail",
+		SubjectTransformRegex:   `@.*$`,
+		SubjectTransformReplace: "",
+	})
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), CasAttributesCtxKey, cas.UserAttributes{"mail": {"jon@labstack.com"}}))
+	rec := httptest.NewRecorder()
+	assert.NoError(t, cb.MiddlewareFunc()(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestCasbinRoleAttribute(t *testing.T) {
+	e := echo.New()
+	cb, err := newCasbinMiddleware(CasbinConfig{
+		Model:                "testdata/casbin_model.conf",
+		Policy:               "testdata/casbin_role_policy.csv",
+		RoleAttribute:        "memberOf",
+		RoleTransformRegex:   `^cn=([^,]+),.*$`,
+		RoleTransformReplace: "$1",
+		PathObject:           true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := cb.MiddlewareFunc()(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	for _, tc := range []struct {
+		groups []string
+		err    error
+	}{
+		{[]string{"cn=dev,ou=groups,dc=labstack,dc=com", "cn=admin,ou=groups,dc=labstack,dc=com"}, nil},
+		{[]string{"cn=dev,ou=groups,dc=labstack,dc=com"}, echo.ErrForbidden},
+		{nil, echo.ErrForbidden},
+	} {
+		req := httptest.NewRequest(echo.GET, "/users", nil)
+		ctx := context.WithValue(req.Context(), CasUsernameCtxKey, "joe")
+		req = req.WithContext(context.WithValue(ctx, CasAttributesCtxKey, cas.UserAttributes{"memberOf": tc.groups}))
+		assert.Equal(t, tc.err, h(e.NewContext(req, httptest.NewRecorder())), tc.groups)
+	}
+
+	_, err = newCasbinMiddleware(CasbinConfig{
+		Model:              "testdata/casbin_model.conf",
+		Policy:             "testdata/casbin_role_policy.csv",
+		RoleTransformRegex: "(",
+	})
+	assert.Error(t, err)
+}
+
+func TestCasDebugMode(t *testing.T) {
+	s := newCasServer("jon", map[string]string{"mail": "jon@labstack.com"}, time.Now())
+	defer s.Close()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+	buf := new(bytes.Buffer)
+	l := log.New("test")
+	l.SetOutput(buf)
+	l.SetLevel(log.DEBUG)
+	debugCas := func(config CasConfig) *Cas {
+		return initialized(&Cas{Base: Base{Logger: l}, CasConfig: config}).(*Cas)
+	}
+
+	c := debugCas(CasConfig{URL: s.URL + "/cas", DebugMode: true})
+	req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	assert.Contains(t, buf.String(), "serviceValidate?")
+	assert.Contains(t, buf.String(), "<cas:user>jon</cas:user>")
+	assert.Contains(t, buf.String(), "<cas:mail>jon@labstack.com</cas:mail>")
+
+	// Redacted
+	buf.Reset()
+	c = debugCas(CasConfig{URL: s.URL + "/cas", DebugMode: true, RedactSensitive: true})
+	req = httptest.NewRequest(echo.GET, "/?ticket=ST-2", nil)
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	assert.Contains(t, buf.String(), "<cas:user>[redacted]</cas:user>")
+	assert.NotContains(t, buf.String(), "<cas:user>jon</cas:user>")
+
+	// Disabled
+	buf.Reset()
+	c = debugCas(CasConfig{URL: s.URL + "/cas"})
+	req = httptest.NewRequest(echo.GET, "/?ticket=ST-3", nil)
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(t, "", buf.String())
+}
+
+func TestCasForwardAttributes(t *testing.T) {
+	s := newCasServer("jon", map[string]string{"mail": "jon@labstack.com", "ssn": "078-05-1120"}, time.Now())
+	defer s.Close()
+	var header http.Header
+	var attr cas.UserAttributes
+	ok := func(c echo.Context) error {
+		header = c.Request().Header
+		attr = getCasAttributes(c)
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+
+	// Whitelist and rename
+	c := initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", ForwardAttributes: map[string]string{"mail": "X-User-Email"}}}).(*Cas)
+	req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+	req.Header.Set("X-User-Email", "joe@labstack.com")
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(t, "078-05-1120", attr.Get("ssn"))
+	assert.Equal(t, "jon@labstack.com", header.Get("X-User-Email"))
+	assert.Equal(t, "", header.Get("X-CAS-Attr-mail"))
+	assert.Equal(t, "", header.Get("X-CAS-Attr-ssn"))
+
+	// Default header name
+	c = initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", ForwardAttributes: map[string]string{"ssn": ""}}}).(*Cas)
+	req = httptest.NewRequest(echo.GET, "/?ticket=ST-2", nil)
+	assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(t, "078-05-1120", header.Get("X-CAS-Attr-ssn"))
+	assert.Equal(t, "", header.Get("X-CAS-Attr-mail"))
+
+	// Strip inbound headers
+	for _, strip := range []bool{false, true} {
+		c = initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", ForwardAttributes: map[string]string{"mail": ""}, StripInboundHeaders: strip}}).(*Cas)
+		req = httptest.NewRequest(echo.GET, "/?ticket=ST-3", nil)
+		req.Header.Set("X-CAS-Attr-role", "admin")
+		assert.NoError(t, c.Process(ok)(e.NewContext(req, httptest.NewRecorder())))
+		assert.Equal(t, "jon@labstack.com", header.Get("X-CAS-Attr-mail"))
+		if strip {
+			assert.Equal(t, "", header.Get("X-CAS-Attr-role"))
+		} else {
+			assert.Equal(t, "admin", header.Get("X-CAS-Attr-role"))
+		}
+	}
+}
+
+func TestCasGateway(t *testing.T) {
+	s := newCasServer("jon", nil, time.Now())
+	defer s.Close()
+	username := ""
+	ok := func(c echo.Context) error {
+		username = getUsername(c)
+		return c.String(http.StatusOK, "OK")
+	}
+	e := echo.New()
+	c := initialized(&Cas{CasConfig: CasConfig{
+		URL:          s.URL + "/cas",
+		GatewayPaths: []string{"/public/*"},
+		CasbinCfg: CasbinConfig{
+			Model:  "testdata/casbin_model.conf",
+			Policy: "testdata/casbin_policy.csv",
+		},
+	}}).(*Cas)
+	assert.NoError(t, c.ValidateConfig())
+	h := c.Process(ok)
+
+	// Gateway login
+	req := httptest.NewRequest(echo.GET, "/public/index.html", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusFound, rec.Code)
+	u, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/cas/login", u.Path)
+		assert.Equal(t, "true", u.Query().Get("gateway"))
+	}
+	cookie := rec.Result().Cookies()
+	assert.Equal(t, casGatewayCookie, cookie[len(cookie)-1].Name)
+
+	// Anonymous without an SSO session
+	req = httptest.NewRequest(echo.GET, "/public/index.html", nil)
+	req.AddCookie(cookie[len(cookie)-1])
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "", username)
+
+	// Authenticated with an SSO session
+	req = httptest.NewRequest(echo.GET, "/public/index.html?ticket=ST-1", nil)
+	assert.NoError(t, h(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(t, "jon", username)
+
+	// Other paths
+	req = httptest.NewRequest(echo.GET, "/private", nil)
+	req.AddCookie(cookie[len(cookie)-1])
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.NotContains(t, rec.Header().Get(echo.HeaderLocation), "gateway")
+
+	assert.Error(t, (&Cas{CasConfig: CasConfig{URL: s.URL, RenewPaths: []string{"["}}}).ValidateConfig())
+}
+
+func TestCasRenew(t *testing.T) {
+	s := newCasServer("jon", nil, time.Now())
+	defer s.Close()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, getUsername(c))
+	}
+	e := echo.New()
+	for _, persist := range []bool{false, true} {
+		c := initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", RenewPaths: []string{"/admin/*"}, PersistUserSession: persist}}).(*Cas)
+		h := c.Process(ok)
+		req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, h(e.NewContext(req, rec)))
+		session := rec.Result().Cookies()[0]
+
+		// Session
+		req = httptest.NewRequest(echo.GET, "/", nil)
+		req.AddCookie(session)
+		rec = httptest.NewRecorder()
+		assert.NoError(t, h(e.NewContext(req, rec)))
+		assert.Equal(t, "jon", rec.Body.String())
+
+		// Renew despite the session
+		req = httptest.NewRequest(echo.GET, "/admin/users", nil)
+		req.AddCookie(session)
+		rec = httptest.NewRecorder()
+		assert.NoError(t, h(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusFound, rec.Code)
+		u, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "true", u.Query().Get("renew"))
+		}
+
+		// The renewed ticket is validated in a new session
+		req = httptest.NewRequest(echo.GET, "/admin/users?ticket=ST-2", nil)
+		req.AddCookie(session)
+		rec = httptest.NewRecorder()
+		assert.NoError(t, h(e.NewContext(req, rec)))
+		assert.Equal(t, "jon", rec.Body.String())
+		if cookies := rec.Result().Cookies(); assert.NotEmpty(t, cookies) {
+			assert.NotEqual(t, session.Value, cookies[0].Value)
+		}
+	}
+}
+
+func TestCasWebSocket(t *testing.T) {
+	s := newCasServer("jon", nil, time.Now())
+	defer s.Close()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, getUsername(c))
+	}
+	e := echo.New()
+	c := initialized(&Cas{CasConfig: CasConfig{
+		URL: s.URL + "/cas",
+		CasbinCfg: CasbinConfig{
+			Model:  "testdata/casbin_model.conf",
+			Policy: "testdata/casbin_policy.csv",
+		},
+	}}).(*Cas)
+	h := c.Process(ok)
+	upgrade := func(req *http.Request) *http.Request {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set(echo.HeaderUpgrade, "websocket")
+		return req
+	}
+
+	// Unauthorized instead of the login redirect
+	rec := httptest.NewRecorder()
+	assert.Equal(t, echo.ErrUnauthorized, h(e.NewContext(upgrade(httptest.NewRequest(echo.GET, "/", nil)), rec)))
+
+	// Authorized with a session
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(httptest.NewRequest(echo.GET, "/?ticket=ST-1", nil), rec)))
+	req := upgrade(httptest.NewRequest(echo.GET, "/", nil))
+	req.AddCookie(rec.Result().Cookies()[0])
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, "jon", rec.Body.String())
+}
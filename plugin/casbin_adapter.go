@@ -0,0 +1,314 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/persist"
+	"github.com/go-redis/redis"
+	_ "github.com/go-sql-driver/mysql" // MySQL driver
+	"github.com/jmoiron/sqlx"
+)
+
+type (
+	// CasbinPolicyAdapterConfig loads the casbin policy from a database
+	// instead of the policy file. Type is `postgres`, `mysql` or `redis`,
+	// URI the postgres URI, MySQL DSN or redis URL. Table is the SQL table,
+	// default `casbin_rule` as created by the gorm adapter, or the redis
+	// key, default `casbin_rules` as used by the redis adapter.
+	CasbinPolicyAdapterConfig struct {
+		Type  string `yaml:"type"`
+		URI   string `yaml:"uri" armor:"probe"`
+		Table string `yaml:"table"`
+	}
+
+	// casbinRule is a policy line, the columns match the gorm adapter and
+	// the JSON the redis adapter.
+	casbinRule struct {
+		PType string `db:"p_type"`
+		V0    string `db:"v0"`
+		V1    string `db:"v1"`
+		V2    string `db:"v2"`
+		V3    string `db:"v3"`
+		V4    string `db:"v4"`
+		V5    string `db:"v5"`
+	}
+
+	casbinAdapter interface {
+		persist.Adapter
+		Close() error
+	}
+
+	casbinSQLAdapter struct {
+		db    *sqlx.DB
+		table string
+	}
+
+	casbinRedisAdapter struct {
+		client *redis.Client
+		key    string
+	}
+)
+
+const (
+	// Casbin policy adapters
+	CasbinAdapterPostgres = "postgres"
+	CasbinAdapterMySQL    = "mysql"
+	CasbinAdapterRedis    = "redis"
+
+	casbinSQLTable = "casbin_rule"
+	casbinRedisKey = "casbin_rules"
+)
+
+var casbinTableRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// newCasbinAdapter connects to the configured policy database.
+func newCasbinAdapter(cfg CasbinPolicyAdapterConfig) (casbinAdapter, error) {
+	if cfg.URI == "" {
+		return nil, fmt.Errorf("casbin policy adapter=%s requires a uri", cfg.Type)
+	}
+	switch cfg.Type {
+	case CasbinAdapterPostgres, CasbinAdapterMySQL:
+		table := cfg.Table
+		if table == "" {
+			table = casbinSQLTable
+		}
+		if !casbinTableRegex.MatchString(table) {
+			return nil, fmt.Errorf("invalid casbin policy table=%s", table)
+		}
+		db, err := sqlx.Connect(cfg.Type, cfg.URI)
+		if err != nil {
+			return nil, err
+		}
+		a := &casbinSQLAdapter{db: db, table: table}
+		if _, err := db.Exec(a.schema()); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return a, nil
+	case CasbinAdapterRedis:
+		key := cfg.Table
+		if key == "" {
+			key = casbinRedisKey
+		}
+		opt, err := redis.ParseURL(cfg.URI)
+		if err != nil {
+			return nil, err
+		}
+		client := redis.NewClient(opt)
+		if err := client.Ping().Err(); err != nil {
+			client.Close()
+			return nil, err
+		}
+		return &casbinRedisAdapter{client: client, key: key}, nil
+	}
+	return nil, fmt.Errorf("invalid casbin policy adapter=%s", cfg.Type)
+}
+
+func newCasbinRule(ptype string, rule []string) casbinRule {
+	r := casbinRule{PType: ptype}
+	for i, v := range []*string{&r.V0, &r.V1, &r.V2, &r.V3, &r.V4, &r.V5} {
+		if i < len(rule) {
+			*v = rule[i]
+		}
+	}
+	return r
+}
+
+func (r casbinRule) values() []string {
+	return []string{r.V0, r.V1, r.V2, r.V3, r.V4, r.V5}
+}
+
+// line returns the rule as a policy file line.
+func (r casbinRule) line() string {
+	v := r.values()
+	for len(v) > 0 && v[len(v)-1] == "" {
+		v = v[:len(v)-1]
+	}
+	return strings.Join(append([]string{r.PType}, v...), ", ")
+}
+
+// matches reports whether the rule matches the filter of
+// RemoveFilteredPolicy, empty values match anything.
+func (r casbinRule) matches(ptype string, fieldIndex int, fieldValues []string) bool {
+	if r.PType != ptype {
+		return false
+	}
+	v := r.values()
+	for i, f := range fieldValues {
+		if j := fieldIndex + i; f != "" && (j >= len(v) || v[j] != f) {
+			return false
+		}
+	}
+	return true
+}
+
+// casbinRules returns the policy rules of m.
+func casbinRules(m model.Model) (rules []casbinRule) {
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range m[sec] {
+			for _, rule := range ast.Policy {
+				rules = append(rules, newCasbinRule(ptype, rule))
+			}
+		}
+	}
+	return
+}
+
+func (a *casbinSQLAdapter) schema() string {
+	return fmt.Sprintf(`create table if not exists %s (
+		p_type varchar(100) not null default '',
+		v0 varchar(100) not null default '',
+		v1 varchar(100) not null default '',
+		v2 varchar(100) not null default '',
+		v3 varchar(100) not null default '',
+		v4 varchar(100) not null default '',
+		v5 varchar(100) not null default ''
+	)`, a.table)
+}
+
+func (a *casbinSQLAdapter) LoadPolicy(m model.Model) error {
+	var rules []casbinRule
+	if err := a.db.Select(&rules, fmt.Sprintf(`select p_type, v0, v1, v2, v3, v4, v5 from %s`, a.table)); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		persist.LoadPolicyLine(r.line(), m)
+	}
+	return nil
+}
+
+func (a *casbinSQLAdapter) insert(e sqlx.Execer, r casbinRule) error {
+	_, err := e.Exec(a.db.Rebind(fmt.Sprintf(`insert into %s (p_type, v0, v1, v2, v3, v4, v5)
+		values (?, ?, ?, ?, ?, ?, ?)`, a.table)), r.PType, r.V0, r.V1, r.V2, r.V3, r.V4, r.V5)
+	return err
+}
+
+func (a *casbinSQLAdapter) SavePolicy(m model.Model) error {
+	tx, err := a.db.Beginx()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`delete from %s`, a.table)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, r := range casbinRules(m) {
+		if err := a.insert(tx, r); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (a *casbinSQLAdapter) AddPolicy(sec, ptype string, rule []string) error {
+	return a.insert(a.db, newCasbinRule(ptype, rule))
+}
+
+func (a *casbinSQLAdapter) RemovePolicy(sec, ptype string, rule []string) error {
+	r := newCasbinRule(ptype, rule)
+	_, err := a.db.Exec(a.db.Rebind(fmt.Sprintf(`delete from %s where p_type = ? and v0 = ? and v1 = ?
+		and v2 = ? and v3 = ? and v4 = ? and v5 = ?`, a.table)), r.PType, r.V0, r.V1, r.V2, r.V3, r.V4, r.V5)
+	return err
+}
+
+func (a *casbinSQLAdapter) RemoveFilteredPolicy(sec, ptype string, fieldIndex int, fieldValues ...string) error {
+	query := fmt.Sprintf(`delete from %s where p_type = ?`, a.table)
+	args := []interface{}{ptype}
+	for i, v := range fieldValues {
+		if j := fieldIndex + i; v != "" && j < 6 {
+			query += fmt.Sprintf(" and v%d = ?", j)
+			args = append(args, v)
+		}
+	}
+	_, err := a.db.Exec(a.db.Rebind(query), args...)
+	return err
+}
+
+func (a *casbinSQLAdapter) Close() error {
+	return a.db.Close()
+}
+
+func (a *casbinRedisAdapter) rules() ([]casbinRule, error) {
+	values, err := a.client.LRange(a.key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]casbinRule, len(values))
+	for i, v := range values {
+		if err := json.Unmarshal([]byte(v), &rules[i]); err != nil {
+			return nil, fmt.Errorf("invalid casbin rule=%s, error=%v", v, err)
+		}
+	}
+	return rules, nil
+}
+
+func (a *casbinRedisAdapter) save(rules []casbinRule) error {
+	p := a.client.TxPipeline()
+	p.Del(a.key)
+	for _, r := range rules {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		p.RPush(a.key, b)
+	}
+	_, err := p.Exec()
+	return err
+}
+
+func (a *casbinRedisAdapter) LoadPolicy(m model.Model) error {
+	rules, err := a.rules()
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		persist.LoadPolicyLine(r.line(), m)
+	}
+	return nil
+}
+
+func (a *casbinRedisAdapter) SavePolicy(m model.Model) error {
+	return a.save(casbinRules(m))
+}
+
+func (a *casbinRedisAdapter) AddPolicy(sec, ptype string, rule []string) error {
+	b, err := json.Marshal(newCasbinRule(ptype, rule))
+	if err != nil {
+		return err
+	}
+	return a.client.RPush(a.key, b).Err()
+}
+
+// RemovePolicy rewrites the list, rules written by other tools may omit
+// empty values and not match the marshalled rule.
+func (a *casbinRedisAdapter) RemovePolicy(sec, ptype string, rule []string) error {
+	removed := newCasbinRule(ptype, rule)
+	return a.remove(func(r casbinRule) bool { return r == removed })
+}
+
+func (a *casbinRedisAdapter) RemoveFilteredPolicy(sec, ptype string, fieldIndex int, fieldValues ...string) error {
+	return a.remove(func(r casbinRule) bool { return r.matches(ptype, fieldIndex, fieldValues) })
+}
+
+func (a *casbinRedisAdapter) remove(match func(casbinRule) bool) error {
+	rules, err := a.rules()
+	if err != nil {
+		return err
+	}
+	kept := rules[:0]
+	for _, r := range rules {
+		if !match(r) {
+			kept = append(kept, r)
+		}
+	}
+	return a.save(kept)
+}
+
+func (a *casbinRedisAdapter) Close() error {
+	return a.client.Close()
+}
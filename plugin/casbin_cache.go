@@ -0,0 +1,90 @@
+package plugin
+
+import (
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type (
+	// enforceCache caches casbin decisions by request values for a TTL.
+	enforceCache struct {
+		ttl   time.Duration
+		cache *lru.Cache
+	}
+
+	enforceCacheEntry struct {
+		allow   bool
+		expires time.Time
+	}
+)
+
+var (
+	casbinCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "casbin_cache_hits_total",
+		Help: "Number of casbin decisions served from the enforce cache.",
+	})
+	casbinCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "casbin_cache_misses_total",
+		Help: "Number of casbin decisions not found in the enforce cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(casbinCacheHits, casbinCacheMisses)
+}
+
+// enforceCacheEntrySize estimates the memory of a cache entry: the LRU list
+// element and map entry, the key and the value.
+const enforceCacheEntrySize = 256
+
+func newEnforceCache(size int, ttl time.Duration) *enforceCache {
+	if size <= 0 {
+		size = 1000
+	}
+	cache, _ := lru.New(size) // Only fails for a non-positive size
+	return &enforceCache{ttl: ttl, cache: cache}
+}
+
+func enforceCacheKey(rvals []string) string {
+	return strings.Join(rvals, "\x00")
+}
+
+func (ec *enforceCache) get(rvals []string) (allow, ok bool) {
+	if v, found := ec.cache.Get(enforceCacheKey(rvals)); found {
+		e := v.(enforceCacheEntry)
+		if time.Now().Before(e.expires) {
+			casbinCacheHits.Inc()
+			return e.allow, true
+		}
+	}
+	casbinCacheMisses.Inc()
+	return false, false
+}
+
+func (ec *enforceCache) add(rvals []string, allow bool) {
+	ec.cache.Add(enforceCacheKey(rvals), enforceCacheEntry{
+		allow:   allow,
+		expires: time.Now().Add(ec.ttl),
+	})
+}
+
+// invalidate removes the entries of the subject, exactly the first request
+// value, and returns their count.
+func (ec *enforceCache) invalidate(sub string) (n int) {
+	for _, k := range ec.cache.Keys() {
+		if key := k.(string); strings.SplitN(key, "\x00", 2)[0] == sub {
+			if ec.cache.Contains(key) {
+				ec.cache.Remove(key)
+				n++
+			}
+		}
+	}
+	return
+}
+
+func (ec *enforceCache) purge() {
+	ec.cache.Purge()
+}
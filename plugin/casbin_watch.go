@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/labstack/gommon/log"
+)
+
+type (
+	// casbinWatcher reloads a casbin middleware when its model or policy
+	// file changes.
+	casbinWatcher struct {
+		cb      *casbinMiddleware
+		files   map[string]os.FileInfo
+		logger  *log.Logger
+		done    chan struct{}
+		stopped chan struct{}
+	}
+)
+
+// casbinWatchDelay coalesces the events of a single save, e.g. truncate and
+// write.
+const casbinWatchDelay = 100 * time.Millisecond
+
+// watchCasbin starts watching the model and policy files of cb as set in
+// its config.
+func watchCasbin(cb *casbinMiddleware, logger *log.Logger) (*casbinWatcher, error) {
+	w := &casbinWatcher{
+		cb:      cb,
+		files:   map[string]os.FileInfo{},
+		logger:  logger,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for _, f := range []string{cb.cfg.Model, cb.cfg.Policy} {
+		if f == "" {
+			continue
+		}
+		f, err := filepath.Abs(f)
+		if err != nil {
+			return nil, err
+		}
+		w.files[f], _ = os.Stat(f)
+	}
+
+	var (
+		fsw    *fsnotify.Watcher
+		events chan fsnotify.Event
+		errs   chan error
+	)
+	if cb.cfg.Watch {
+		var err error
+		if fsw, err = fsnotify.NewWatcher(); err != nil {
+			return nil, err
+		}
+		// Watch the directories, editors often replace the file on save
+		for f := range w.files {
+			if err := fsw.Add(filepath.Dir(f)); err != nil {
+				fsw.Close()
+				return nil, err
+			}
+		}
+		events, errs = fsw.Events, fsw.Errors
+	}
+	var (
+		ticker *time.Ticker
+		poll   <-chan time.Time
+	)
+	if cb.cfg.PollInterval > 0 {
+		ticker = time.NewTicker(cb.cfg.PollInterval)
+		poll = ticker.C
+	}
+
+	go func() {
+		defer close(w.stopped)
+		if fsw != nil {
+			defer fsw.Close()
+		}
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		var pending <-chan time.Time
+		for {
+			select {
+			case <-w.done:
+				return
+			case e := <-events:
+				if _, ok := w.files[e.Name]; ok {
+					pending = time.After(casbinWatchDelay)
+				}
+			case err := <-errs:
+				if w.logger != nil {
+					w.logger.Errorf("casbin: watch error: %v", err)
+				}
+			case <-pending:
+				pending = nil
+				w.changed()
+				w.reload()
+			case <-poll:
+				// Policy adapters have no change events
+				if w.changed() || w.cb.cfg.PolicyAdapter.Type != "" {
+					w.reload()
+				}
+			}
+		}
+	}()
+	return w, nil
+}
+
+// changed reports whether a file changed since the last check.
+func (w *casbinWatcher) changed() (changed bool) {
+	for f, last := range w.files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if last == nil || !fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size() {
+			changed = true
+		}
+		w.files[f] = fi
+	}
+	return
+}
+
+func (w *casbinWatcher) reload() {
+	if err := w.cb.Reload(); err != nil {
+		if w.logger != nil {
+			w.logger.Errorf("casbin: failed to reload, keeping the current policy: %v", err)
+		}
+		return
+	}
+	if w.logger != nil {
+		w.logger.Infof("casbin: reloaded model=%s, policy=%s", w.cb.cfg.Model, w.cb.cfg.policySource())
+	}
+}
+
+// stop stops watching, it returns once the watcher is stopped or ctx is
+// done.
+func (w *casbinWatcher) stop(ctx context.Context) {
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+	select {
+	case <-w.stopped:
+	case <-ctx.Done():
+	}
+}
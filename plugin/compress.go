@@ -0,0 +1,441 @@
+package plugin
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+)
+
+// Response compression with brotli, zstd and gzip, negotiated with the
+// Accept-Encoding of the request.
+
+type (
+	Compress struct {
+		Base           `json:",squash" yaml:",squash"`
+		CompressConfig `json:",squash" yaml:",squash"`
+
+		pools map[string]*sync.Pool
+	}
+
+	CompressConfig struct {
+		// Encodings are `br`, `zstd` and `gzip`, the server preference when
+		// the client accepts several equally, default all in this order.
+		Encodings []string `yaml:"encodings"`
+
+		// Levels of the encoders, default their default one.
+		Levels CompressLevels `yaml:"levels"`
+
+		// ContentTypes are the media types compressed, `type/*` matches all
+		// subtypes. Default text, JavaScript, JSON, XML, SVG and WebAssembly.
+		ContentTypes []string `yaml:"content_types"`
+
+		// MinSize, default 1KB, is the smallest body compressed.
+		MinSize int `yaml:"min_size"`
+
+		// SkipPaths are requests passed without compression.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// CompressLevels are gzip `1` to `9`, brotli `0` to `11` and zstd `1` to
+	// `22`, zero for the default.
+	CompressLevels struct {
+		Gzip   int `yaml:"gzip"`
+		Brotli int `yaml:"br"`
+		Zstd   int `yaml:"zstd"`
+	}
+
+	compressEncoder interface {
+		io.WriteCloser
+		Reset(io.Writer)
+		Flush() error
+	}
+
+	// compressWriter buffers the start of a response until its size and
+	// type tell whether to compress it.
+	compressWriter struct {
+		http.ResponseWriter
+		config   *CompressConfig
+		encoding string
+		pool     *sync.Pool
+		encoder  compressEncoder
+		status   int
+		buf      []byte
+		decided  bool
+	}
+)
+
+const (
+	// Encodings
+	CompressBrotli = "br"
+	CompressZstd   = "zstd"
+	CompressGzip   = "gzip"
+
+	compressDefaultMinSize = 1024
+)
+
+var (
+	compressEncodings    = []string{CompressBrotli, CompressZstd, CompressGzip}
+	compressContentTypes = []string{
+		"text/*",
+		"application/javascript",
+		"application/json",
+		"application/xml",
+		"application/xhtml+xml",
+		"application/wasm",
+		"image/svg+xml",
+	}
+)
+
+func (c *CompressConfig) encodings() []string {
+	if len(c.Encodings) == 0 {
+		return compressEncodings
+	}
+	return c.Encodings
+}
+
+func (c *CompressConfig) contentTypes() []string {
+	if len(c.ContentTypes) == 0 {
+		return compressContentTypes
+	}
+	return c.ContentTypes
+}
+
+func (c *CompressConfig) minSize() int {
+	if c.MinSize <= 0 {
+		return compressDefaultMinSize
+	}
+	return c.MinSize
+}
+
+// newEncoder returns a new encoder of encoding.
+func (l CompressLevels) newEncoder(encoding string) (compressEncoder, error) {
+	switch encoding {
+	case CompressBrotli:
+		level := l.Brotli
+		if level == 0 {
+			level = brotli.DefaultCompression
+		}
+		return brotli.NewWriterLevel(nil, level), nil
+	case CompressZstd:
+		level := zstd.SpeedDefault
+		if l.Zstd != 0 {
+			level = zstd.EncoderLevelFromZstd(l.Zstd)
+		}
+		return zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	case CompressGzip:
+		level := l.Gzip
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(nil, level)
+	}
+	return nil, fmt.Errorf("invalid compress encoding=%s", encoding)
+}
+
+// negotiate returns the encoding of encodings preferred by the
+// Accept-Encoding header, empty if none is accepted.
+func negotiate(header string, encodings []string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := mime.ParseMediaType("x/" + strings.TrimSpace(part))
+		if name == "" {
+			continue
+		}
+		v := 1.0
+		if s, ok := params["q"]; ok {
+			var err error
+			if v, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		q[strings.TrimPrefix(name, "x/")] = v
+	}
+	best, bestQ := "", 0.0
+	for _, e := range encodings {
+		v, ok := q[e]
+		if !ok {
+			v = q["*"]
+		}
+		if v > bestQ {
+			best, bestQ = e, v
+		}
+	}
+	return best
+}
+
+// mediaTypeMatch reports whether the media type t is one of types, `type/*`
+// matching all subtypes.
+func mediaTypeMatch(types []string, t string) bool {
+	for _, ct := range types {
+		if ct == t || strings.HasSuffix(ct, "/*") && strings.HasPrefix(t, strings.TrimSuffix(ct, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Compress) ValidateConfig() error {
+	for _, e := range c.Encodings {
+		switch e {
+		case CompressBrotli, CompressZstd, CompressGzip:
+		default:
+			return fmt.Errorf("invalid compress encoding=%s", e)
+		}
+	}
+	if l := c.Levels.Gzip; l < gzip.HuffmanOnly || l > gzip.BestCompression {
+		return fmt.Errorf("invalid gzip level=%d", l)
+	}
+	if l := c.Levels.Brotli; l < 0 || l > brotli.BestCompression {
+		return fmt.Errorf("invalid brotli level=%d", l)
+	}
+	if l := c.Levels.Zstd; l < 0 || l > 22 {
+		return fmt.Errorf("invalid zstd level=%d", l)
+	}
+	for _, t := range c.ContentTypes {
+		if _, _, err := mime.ParseMediaType(t); err != nil {
+			return fmt.Errorf("invalid compress content type=%s", t)
+		}
+	}
+	if c.MinSize < 0 {
+		return errors.New("invalid compress min_size")
+	}
+	return validatePathRules(c.SkipPaths)
+}
+
+func (c *Compress) Initialize() {
+	c.pools = make(map[string]*sync.Pool, len(c.encodings()))
+	for _, e := range c.encodings() {
+		e, levels := e, c.Levels
+		c.pools[e] = &sync.Pool{New: func() interface{} {
+			enc, err := levels.newEncoder(e)
+			if err != nil {
+				return err
+			}
+			return enc
+		}}
+	}
+}
+
+func (c *Compress) Update(p Plugin) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.CompressConfig = p.(*Compress).CompressConfig
+	c.Initialize()
+}
+
+func (c *Compress) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	config, pools := c.CompressConfig, c.pools
+	return skipPaths(c.SkipPaths, next, func(ctx echo.Context) error {
+		req := ctx.Request()
+		if req.Method == http.MethodHead || ctx.IsWebSocket() {
+			return next(ctx)
+		}
+		res := ctx.Response()
+		w := &compressWriter{
+			ResponseWriter: res.Writer,
+			config:         &config,
+			encoding:       negotiate(req.Header.Get(echo.HeaderAcceptEncoding), config.encodings()),
+		}
+		if w.encoding != "" {
+			w.pool = pools[w.encoding]
+		}
+		res.Writer = w
+		defer func() { res.Writer = w.ResponseWriter }()
+		err := next(ctx)
+		if ferr := w.finish(); err == nil {
+			err = ferr
+		}
+		return err
+	})
+}
+
+// eligible reports whether the response may be compressed, on its status and
+// headers known so far.
+func (w *compressWriter) eligible() bool {
+	h := w.Header()
+	if w.status < http.StatusOK || w.status == http.StatusNoContent || w.status == http.StatusPartialContent ||
+		w.status == http.StatusNotModified {
+		return false
+	}
+	if e := h.Get(echo.HeaderContentEncoding); e != "" && e != "identity" {
+		return false
+	}
+	if strings.Contains(h.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	if ct := h.Get(echo.HeaderContentType); ct != "" {
+		t, _, err := mime.ParseMediaType(ct)
+		return err == nil && mediaTypeMatch(w.config.contentTypes(), t)
+	}
+	return true
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = code
+	if !w.eligible() {
+		w.pass()
+		return
+	}
+	if length, err := strconv.Atoi(w.Header().Get(echo.HeaderContentLength)); err == nil {
+		if length < w.config.minSize() {
+			w.vary()
+			w.pass()
+		} else if w.Header().Get(echo.HeaderContentType) != "" {
+			w.start()
+		}
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.config.minSize() {
+			return len(b), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide compresses or not the buffered start of the body and writes it.
+func (w *compressWriter) decide() error {
+	h := w.Header()
+	if h.Get(echo.HeaderContentType) == "" && len(w.buf) > 0 {
+		h.Set(echo.HeaderContentType, http.DetectContentType(w.buf))
+	}
+	if !w.eligible() {
+		w.pass()
+	} else if len(w.buf) < w.config.minSize() {
+		w.vary()
+		w.pass()
+	} else {
+		w.start()
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.encoder != nil {
+		_, err = w.encoder.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// vary tells caches the response depends on Accept-Encoding.
+func (w *compressWriter) vary() {
+	h := w.Header()
+	for _, v := range h[echo.HeaderVary] {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f == "*" || strings.EqualFold(f, echo.HeaderAcceptEncoding) {
+				return
+			}
+		}
+	}
+	h.Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+}
+
+// pass writes the response unchanged.
+func (w *compressWriter) pass() {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// start writes the headers of the compressed response.
+func (w *compressWriter) start() {
+	w.vary()
+	if w.pool == nil {
+		w.pass()
+		return
+	}
+	enc, ok := w.pool.Get().(compressEncoder)
+	if !ok {
+		w.pass()
+		return
+	}
+	w.decided = true
+	enc.Reset(w.ResponseWriter)
+	w.encoder = enc
+	h := w.Header()
+	h.Set(echo.HeaderContentEncoding, w.encoding)
+	h.Del(echo.HeaderContentLength)
+	h.Del("Accept-Ranges")
+	if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// No longer byte for byte
+		h.Set("Etag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// finish writes the buffered body or ends the compressed one.
+func (w *compressWriter) finish() error {
+	if w.status == 0 {
+		return nil
+	}
+	if !w.decided {
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.encoder == nil {
+		return nil
+	}
+	err := w.encoder.Close()
+	w.encoder.Reset(nil)
+	w.pool.Put(w.encoder)
+	w.encoder = nil
+	return err
+}
+
+// Flush sends the buffered body, compressed or not, e.g. of streams.
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.decide()
+	}
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("compress: response does not implement http.Hijacker")
+	}
+	return h.Hijack()
+}
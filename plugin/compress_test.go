@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, CompressBrotli, negotiate("gzip, deflate, br", compressEncodings))
+	assert.Equal(t, CompressGzip, negotiate("gzip, br;q=0.5", compressEncodings))
+	assert.Equal(t, CompressZstd, negotiate("br;q=0, *", compressEncodings))
+	assert.Equal(t, CompressGzip, negotiate("br, gzip", []string{CompressGzip}))
+	assert.Equal(t, "", negotiate("identity", compressEncodings))
+	assert.Equal(t, "", negotiate("", compressEncodings))
+}
+
+func TestCompress(t *testing.T) {
+	e := echo.New()
+	p := Decode(RawPlugin{
+		"name":     PluginCompress,
+		"order":    1,
+		"levels":   map[string]interface{}{"br": 4, "zstd": 19},
+		"min_size": 64,
+	}, e, nil).(*Compress)
+	if !assert.NoError(t, p.ValidateConfig()) {
+		return
+	}
+	p.Initialize()
+	body := strings.Repeat("armor compresses responses ", 20)
+
+	do := func(accept string, h func(c echo.Context) error) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.Header.Set(echo.HeaderAcceptEncoding, accept)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, p.Process(h)(e.NewContext(req, rec)))
+		return rec
+	}
+	text := func(c echo.Context) error {
+		c.Response().Header().Set("Etag", `"v1"`)
+		c.Response().Header().Set("Accept-Ranges", "bytes")
+		return c.String(http.StatusOK, body)
+	}
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		CompressBrotli: func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		CompressZstd: func(r io.Reader) (io.Reader, error) {
+			d, err := zstd.NewReader(r)
+			return d, err
+		},
+		CompressGzip: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	}
+	for encoding, decode := range decoders {
+		// Twice for the pooled encoders
+		for i := 0; i < 2; i++ {
+			rec := do(encoding, text)
+			assert.Equal(t, encoding, rec.Header().Get(echo.HeaderContentEncoding))
+			assert.Equal(t, echo.HeaderAcceptEncoding, rec.Header().Get(echo.HeaderVary))
+			assert.Equal(t, `W/"v1"`, rec.Header().Get("Etag"))
+			assert.Empty(t, rec.Header().Get("Accept-Ranges"))
+			assert.True(t, rec.Body.Len() < len(body))
+			r, err := decode(rec.Body)
+			if assert.NoError(t, err, encoding) {
+				b, err := ioutil.ReadAll(r)
+				assert.NoError(t, err)
+				assert.Equal(t, body, string(b))
+			}
+		}
+	}
+
+	// Not accepted, still varying
+	rec := do("", text)
+	assert.Empty(t, rec.Header().Get(echo.HeaderContentEncoding))
+	assert.Equal(t, echo.HeaderAcceptEncoding, rec.Header().Get(echo.HeaderVary))
+	assert.Equal(t, `"v1"`, rec.Header().Get("Etag"))
+	assert.Equal(t, body, rec.Body.String())
+
+	// Too small, with and without a length
+	rec = do("br", func(c echo.Context) error {
+		return c.String(http.StatusOK, "armor")
+	})
+	assert.Empty(t, rec.Header().Get(echo.HeaderContentEncoding))
+	assert.Equal(t, "armor", rec.Body.String())
+	rec = do("br", func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentLength, "5")
+		return c.Blob(http.StatusOK, echo.MIMETextPlain, []byte("armor"))
+	})
+	assert.Empty(t, rec.Header().Get(echo.HeaderContentEncoding))
+	assert.Equal(t, "5", rec.Header().Get(echo.HeaderContentLength))
+
+	// Content types
+	rec = do("br", func(c echo.Context) error {
+		return c.Blob(http.StatusOK, "image/png", []byte(body))
+	})
+	assert.Empty(t, rec.Header().Get(echo.HeaderContentEncoding))
+	assert.Empty(t, rec.Header().Get(echo.HeaderVary))
+	assert.Equal(t, body, rec.Body.String())
+
+	// Sniffed and with a known length
+	rec = do("gzip", func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentLength, strconv.Itoa(len(body)))
+		c.Response().WriteHeader(http.StatusOK)
+		_, err := io.Copy(c.Response(), bytes.NewBufferString(body))
+		return err
+	})
+	assert.Equal(t, CompressGzip, rec.Header().Get(echo.HeaderContentEncoding))
+	assert.Empty(t, rec.Header().Get(echo.HeaderContentLength))
+	assert.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), "text/plain"))
+
+	// Already encoded
+	rec = do("gzip", func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentEncoding, "br")
+		return c.String(http.StatusOK, body)
+	})
+	assert.Equal(t, "br", rec.Header().Get(echo.HeaderContentEncoding))
+	assert.Equal(t, body, rec.Body.String())
+}
+
+func TestCompressValidateConfig(t *testing.T) {
+	for _, r := range []RawPlugin{
+		{"name": PluginCompress, "order": 1, "encodings": []interface{}{"deflate"}},
+		{"name": PluginCompress, "order": 1, "levels": map[string]interface{}{"br": 12}},
+		{"name": PluginCompress, "order": 1, "levels": map[string]interface{}{"gzip": 10}},
+	} {
+		assert.Error(t, Decode(r, echo.New(), nil).(*Compress).ValidateConfig())
+	}
+}
@@ -0,0 +1,151 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+type (
+	// DefaultConfigurer is implemented by plugins which provide a minimal
+	// valid config with sensible defaults, e.g. to bootstrap a config file.
+	DefaultConfigurer interface {
+		DefaultConfig() interface{}
+	}
+)
+
+// PrintDefaultConfig marshals the default config of p, with its name, in the
+// format, `yaml` or `json`.
+func PrintDefaultConfig(p Plugin, format string) ([]byte, error) {
+	d, ok := p.(DefaultConfigurer)
+	if !ok {
+		return nil, fmt.Errorf("plugin=%s has no default config", p.Name())
+	}
+	rp := Encode(d.DefaultConfig())
+	rp["name"] = p.Name()
+	switch format {
+	case "yaml":
+		return yaml.Marshal(rp)
+	case "json":
+		return json.MarshalIndent(rp, "", "  ")
+	}
+	return nil, fmt.Errorf("invalid config format=%s", format)
+}
+
+// UnmarshalConfig decodes a plugin from its `yaml` or `json` config.
+func UnmarshalConfig(data []byte, format string) (p Plugin, err error) {
+	rp := RawPlugin{}
+	switch format {
+	case "yaml":
+		err = yaml.Unmarshal(data, &rp)
+	case "json":
+		err = json.Unmarshal(data, &rp)
+	default:
+		err = fmt.Errorf("invalid config format=%s", format)
+	}
+	if err != nil {
+		return
+	}
+	if _, ok := rp["name"].(string); !ok {
+		return nil, fmt.Errorf("plugin name is required")
+	}
+	if _, ok := rp["order"]; !ok {
+		rp["order"] = 0
+	} else if f, ok := rp["order"].(float64); ok {
+		rp["order"] = int(f)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("plugin=%s, error=%v", rp.Name(), r)
+		}
+	}()
+	return Decode(rp, nil, nil), nil
+}
+
+// Encode returns the raw config of a config struct, the reverse of `Decode`.
+// Zero values are left out.
+func Encode(config interface{}) RawPlugin {
+	rp := RawPlugin{}
+	encodeStruct(reflect.Indirect(reflect.ValueOf(config)), rp)
+	return rp
+}
+
+func encodeStruct(v reflect.Value, m map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		if len(tag) > 1 && tag[1] == "squash" && fv.Kind() == reflect.Struct {
+			encodeStruct(fv, m)
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = f.Name
+		}
+		if e := encodeValue(fv); e != nil {
+			m[name] = e
+		}
+	}
+}
+
+func encodeValue(v reflect.Value) interface{} {
+	if d, ok := v.Interface().(time.Duration); ok {
+		if d == 0 {
+			return nil
+		}
+		return d.String()
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		if e := encodeValue(v.Elem()); e != nil {
+			return e
+		}
+		return reflect.Zero(v.Elem().Type()).Interface() // Set to zero
+	case reflect.Struct:
+		m := map[string]interface{}{}
+		encodeStruct(v, m)
+		if len(m) == 0 {
+			return nil
+		}
+		return m
+	case reflect.Slice, reflect.Map:
+		if v.Len() == 0 {
+			return nil
+		}
+		if v.Kind() == reflect.Slice {
+			s := make([]interface{}, v.Len())
+			for i := range s {
+				e := v.Index(i)
+				if s[i] = encodeValue(e); s[i] == nil {
+					s[i] = reflect.Zero(e.Type()).Interface()
+					if reflect.Indirect(e).Kind() == reflect.Struct {
+						s[i] = map[string]interface{}{}
+					}
+				}
+			}
+			return s
+		}
+		return v.Interface()
+	case reflect.Func, reflect.Chan, reflect.Interface:
+		return nil
+	}
+	if reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface()) {
+		return nil
+	}
+	return v.Interface()
+}
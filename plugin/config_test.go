@@ -0,0 +1,46 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultConfig(t *testing.T) {
+	for _, name := range []string{PluginCas, PluginBodyInspect} {
+		p := Decode(RawPlugin{"name": name, "order": 0}, nil, nil)
+		for _, format := range []string{"yaml", "json"} {
+			b, err := PrintDefaultConfig(p, format)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			np, err := UnmarshalConfig(b, format)
+			if assert.NoError(t, err, string(b)) {
+				assert.Equal(t, name, np.Name())
+				assert.Equal(t, p.(DefaultConfigurer).DefaultConfig(), configOf(np))
+			}
+		}
+	}
+
+	b, err := PrintDefaultConfig(Decode(RawPlugin{"name": PluginCas, "order": 0}, nil, nil), "yaml")
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(b), "url: https://cas.example.com")
+		assert.Contains(t, string(b), "model: /etc/armor/model.conf")
+		assert.Contains(t, string(b), "cookie_max_age: 8h0m0s")
+	}
+
+	_, err = PrintDefaultConfig(Decode(RawPlugin{"name": PluginGzip, "order": 0}, nil, nil), "yaml")
+	assert.Error(t, err)
+	_, err = UnmarshalConfig([]byte(`{"name": "unknown"}`), "json")
+	assert.Error(t, err)
+}
+
+func configOf(p Plugin) interface{} {
+	switch p := p.(type) {
+	case *Cas:
+		return p.CasConfig
+	case *BodyInspect:
+		return p.BodyInspectConfig
+	}
+	return nil
+}
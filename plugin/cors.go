@@ -1,7 +1,6 @@
 package plugin
 
 import (
-	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
@@ -22,9 +21,3 @@ func (c *CORS) Update(p Plugin) {
 	c.CORSConfig = p.(*CORS).CORSConfig
 	c.Initialize()
 }
-
-func (c *CORS) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	return c.Middleware(next)
-}
@@ -0,0 +1,296 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CSRF tokens tied to the CAS session, validated on the state-changing
+// methods. Double-submit tokens are sent in a cookie readable by scripts,
+// synchronizer tokens are derived from the session and only passed in
+// headers.
+
+type (
+	CSRF struct {
+		Base       `json:",squash" yaml:",squash"`
+		CSRFConfig `json:",squash" yaml:",squash"`
+
+		secret     []byte
+		secretFrom string
+	}
+
+	CSRFConfig struct {
+		// Mode is `double-submit` (default) or `synchronizer`.
+		Mode string `yaml:"mode"`
+
+		// Secret signs the tokens, random per instance if empty, so it is
+		// shared by the instances behind a load balancer.
+		Secret string `yaml:"secret" armor:"probe,secret"`
+
+		// SessionCookie is the cookie the tokens are tied to, default the CAS
+		// session cookie.
+		SessionCookie string `yaml:"session_cookie"`
+
+		// HeaderName is the request header of the token, also set on the
+		// responses and on the upstream request, default `X-CSRF-Token`.
+		// FormField is the field of url-encoded forms, default `_csrf`.
+		HeaderName string `yaml:"header_name"`
+		FormField  string `yaml:"form_field"`
+
+		// Cookie of the double-submit token, default `_csrf`.
+		Cookie CSRFCookie `yaml:"cookie"`
+
+		// SkipPaths are requests not validated, e.g. `POST /webhooks/*`.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// CSRFCookie is readable by scripts, its Name default `_csrf`, Path
+	// default `/`, SameSite `lax` (default), `strict` or `none`.
+	CSRFCookie struct {
+		Name     string `yaml:"name"`
+		Domain   string `yaml:"domain"`
+		Path     string `yaml:"path"`
+		Secure   bool   `yaml:"secure"`
+		SameSite string `yaml:"same_site"`
+	}
+)
+
+const (
+	// Modes
+	CSRFDoubleSubmit = "double-submit"
+	CSRFSynchronizer = "synchronizer"
+
+	// CSRFTokenKey is the context key of the token of the request, for
+	// handlers and templates, e.g. `${csrf_token}` in body-rewrite.
+	CSRFTokenKey = "csrf_token"
+
+	// Largest url-encoded form read for its token
+	csrfMaxFormBytes = 1 << 20
+)
+
+var errCSRFToken = echo.NewHTTPError(http.StatusForbidden, "invalid csrf token")
+
+func (c CSRFConfig) headerName() string {
+	if c.HeaderName == "" {
+		return "X-CSRF-Token"
+	}
+	return c.HeaderName
+}
+
+func (c CSRFConfig) formField() string {
+	if c.FormField == "" {
+		return "_csrf"
+	}
+	return c.FormField
+}
+
+func (c CSRFConfig) sessionCookie() string {
+	if c.SessionCookie == "" {
+		return casSessionCookie
+	}
+	return c.SessionCookie
+}
+
+func (c CSRFCookie) name() string {
+	if c.Name == "" {
+		return "_csrf"
+	}
+	return c.Name
+}
+
+func (c CSRFCookie) path() string {
+	if c.Path == "" {
+		return "/"
+	}
+	return c.Path
+}
+
+// set sets the cookie with value on the response, SameSite=None is written
+// by hand as http.SameSite has no such mode before Go 1.13.
+func (c CSRFCookie) set(w http.ResponseWriter, value string) {
+	cookie := &http.Cookie{
+		Name:     c.name(),
+		Value:    value,
+		Domain:   c.Domain,
+		Path:     c.path(),
+		Secure:   c.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	switch strings.ToLower(c.SameSite) {
+	case "strict":
+		cookie.SameSite = http.SameSiteStrictMode
+	case "none":
+		cookie.SameSite = 0
+		w.Header().Add("Set-Cookie", cookie.String()+"; SameSite=None")
+		return
+	}
+	http.SetCookie(w, cookie)
+}
+
+// csrfSafeMethod reports whether method does not change state.
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// csrfSign returns the signature of the values with secret.
+func csrfSign(secret []byte, values ...string) string {
+	h := hmac.New(sha256.New, secret)
+	for _, v := range values {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// newDoubleSubmitToken returns a random token signed with the session.
+func newDoubleSubmitToken(secret []byte, session string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	return nonce + "." + csrfSign(secret, CSRFDoubleSubmit, session, nonce), nil
+}
+
+// validDoubleSubmitToken reports whether token was issued for session.
+func validDoubleSubmitToken(secret []byte, session, token string) bool {
+	i := strings.IndexByte(token, '.')
+	if i <= 0 {
+		return false
+	}
+	return hmac.Equal([]byte(token[i+1:]), []byte(csrfSign(secret, CSRFDoubleSubmit, session, token[:i])))
+}
+
+// submittedToken returns the token of the header or of the url-encoded form
+// of r, the body is kept for the upstream.
+func (c CSRFConfig) submittedToken(r *http.Request) string {
+	if t := r.Header.Get(c.headerName()); t != "" {
+		return t
+	}
+	mt, _, _ := mime.ParseMediaType(r.Header.Get(echo.HeaderContentType))
+	if mt != echo.MIMEApplicationForm || r.Body == nil {
+		return ""
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, csrfMaxFormBytes+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+	if err != nil || len(b) > csrfMaxFormBytes {
+		return ""
+	}
+	form, _ := url.ParseQuery(string(b))
+	return form.Get(c.formField())
+}
+
+func (s *CSRF) Initialize() {
+	// The random secret is kept on updates
+	if s.secret == nil || s.secretFrom != s.Secret {
+		s.secret, s.secretFrom = []byte(s.Secret), s.Secret
+		if s.Secret == "" {
+			s.secret = make([]byte, 32)
+			if _, err := rand.Read(s.secret); err != nil {
+				if s.Logger != nil {
+					s.Logger.Errorf("csrf: failed to generate a secret: %v", err)
+				}
+				s.secret = nil
+				s.Middleware = internalErrorMid
+				return
+			}
+		}
+	}
+	config, secret := s.CSRFConfig, s.secret
+	header, cookieName := config.headerName(), config.Cookie.name()
+	s.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			session := ""
+			if cookie, err := r.Cookie(config.sessionCookie()); err == nil {
+				session = cookie.Value
+			}
+
+			var token string
+			if config.Mode == CSRFSynchronizer {
+				if session == "" && !csrfSafeMethod(r.Method) {
+					return errCSRFToken
+				}
+				if session != "" {
+					token = csrfSign(secret, CSRFSynchronizer, session)
+					if !csrfSafeMethod(r.Method) && !hmac.Equal([]byte(config.submittedToken(r)), []byte(token)) {
+						return errCSRFToken
+					}
+				}
+			} else {
+				if cookie, err := r.Cookie(cookieName); err == nil && validDoubleSubmitToken(secret, session, cookie.Value) {
+					token = cookie.Value
+				}
+				if !csrfSafeMethod(r.Method) {
+					if token == "" || !hmac.Equal([]byte(config.submittedToken(r)), []byte(token)) {
+						return errCSRFToken
+					}
+				}
+				if token == "" {
+					var err error
+					if token, err = newDoubleSubmitToken(secret, session); err != nil {
+						return err
+					}
+					config.Cookie.set(c.Response(), token)
+				}
+			}
+			if token != "" {
+				c.Set(CSRFTokenKey, token)
+				r.Header.Set(header, token)
+				c.Response().Header().Set(header, token)
+			}
+			return next(c)
+		}
+	}
+}
+
+func (s *CSRF) Update(p Plugin) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.CSRFConfig = p.(*CSRF).CSRFConfig
+	s.Initialize()
+}
+
+func (s *CSRF) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return skipPaths(s.SkipPaths, next, s.Middleware(next))
+}
+
+func (s *CSRF) ValidateConfig() error {
+	switch s.Mode {
+	case "", CSRFDoubleSubmit, CSRFSynchronizer:
+	default:
+		return fmt.Errorf("invalid csrf mode=%s", s.Mode)
+	}
+	switch strings.ToLower(s.Cookie.SameSite) {
+	case "", "lax", "strict":
+	case "none":
+		if !s.Cookie.Secure {
+			return errors.New("csrf cookie same_site none requires secure")
+		}
+	default:
+		return fmt.Errorf("invalid csrf cookie same_site=%s", s.Cookie.SameSite)
+	}
+	return validatePathRules(s.SkipPaths)
+}
@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRFDoubleSubmit(t *testing.T) {
+	e := echo.New()
+	p := Decode(RawPlugin{
+		"name":   PluginCSRF,
+		"order":  1,
+		"secret": "secret",
+		"cookie": map[string]interface{}{"secure": true, "same_site": "strict"},
+	}, e, nil).(*CSRF)
+	if !assert.NoError(t, p.ValidateConfig()) {
+		return
+	}
+	p.Initialize()
+
+	do := func(req *http.Request, session, cookie, token string) (*httptest.ResponseRecorder, string, string) {
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: casSessionCookie, Value: session})
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "_csrf", Value: cookie})
+		}
+		if token != "" {
+			req.Header.Set("X-CSRF-Token", token)
+		}
+		rec := httptest.NewRecorder()
+		var key, body string
+		err := p.Process(func(c echo.Context) error {
+			key, _ = c.Get(CSRFTokenKey).(string)
+			b, _ := ioutil.ReadAll(c.Request().Body)
+			body = string(b)
+			return c.String(http.StatusOK, "OK")
+		})(e.NewContext(req, rec))
+		if err != nil {
+			e.HTTPErrorHandler(err, e.NewContext(req, rec))
+		}
+		return rec, key, body
+	}
+
+	// Issued on a safe request
+	rec, token, _ := do(httptest.NewRequest(echo.GET, "/", nil), "alice", "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, token, rec.Header().Get("X-CSRF-Token"))
+	cookie := rec.Header().Get(echo.HeaderSetCookie)
+	assert.Contains(t, cookie, "_csrf="+token)
+	assert.Contains(t, cookie, "Secure")
+	assert.Contains(t, cookie, "SameSite=Strict")
+	assert.NotContains(t, cookie, "HttpOnly")
+
+	// Kept while valid
+	rec, next, _ := do(httptest.NewRequest(echo.GET, "/", nil), "alice", token, "")
+	assert.Equal(t, token, next)
+	assert.Empty(t, rec.Header().Get(echo.HeaderSetCookie))
+
+	// Unsafe methods
+	rec, _, _ = do(httptest.NewRequest(echo.POST, "/", nil), "alice", token, "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec, _, _ = do(httptest.NewRequest(echo.POST, "/", nil), "alice", token, "forged")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec, _, _ = do(httptest.NewRequest(echo.DELETE, "/", nil), "alice", token, token)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Tied to the session
+	rec, _, _ = do(httptest.NewRequest(echo.POST, "/", nil), "mallory", token, token)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	_, next, _ = do(httptest.NewRequest(echo.GET, "/", nil), "mallory", token, "")
+	assert.NotEqual(t, token, next)
+
+	// Form field, the body is kept
+	form := url.Values{"_csrf": {token}, "name": {"armor"}}.Encode()
+	req := httptest.NewRequest(echo.POST, "/", strings.NewReader(form))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec, _, body := do(req, "alice", token, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, form, body)
+}
+
+func TestCSRFSynchronizer(t *testing.T) {
+	e := echo.New()
+	p := Decode(RawPlugin{
+		"name":        PluginCSRF,
+		"order":       1,
+		"mode":        CSRFSynchronizer,
+		"header_name": "X-XSRF-Token",
+	}, e, nil).(*CSRF)
+	p.Initialize()
+
+	do := func(method, session, token string) (int, string) {
+		req := httptest.NewRequest(method, "/", nil)
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: casSessionCookie, Value: session})
+		}
+		if token != "" {
+			req.Header.Set("X-XSRF-Token", token)
+		}
+		rec := httptest.NewRecorder()
+		err := p.Process(func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		})(e.NewContext(req, rec))
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he.Code, ""
+		}
+		assert.Empty(t, rec.Header().Get(echo.HeaderSetCookie))
+		return rec.Code, rec.Header().Get("X-XSRF-Token")
+	}
+
+	code, token := do(echo.GET, "alice", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, token)
+	code, _ = do(echo.PUT, "alice", token)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do(echo.PUT, "bob", token)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = do(echo.PUT, "", token)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// The random secret is kept on updates
+	p.Update(Decode(RawPlugin{
+		"name":        PluginCSRF,
+		"order":       1,
+		"mode":        CSRFSynchronizer,
+		"header_name": "X-XSRF-Token",
+	}, e, nil))
+	code, _ = do(echo.PUT, "alice", token)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestCSRFValidateConfig(t *testing.T) {
+	p := Decode(RawPlugin{
+		"name":  PluginCSRF,
+		"order": 1,
+		"mode":  "cookie",
+	}, echo.New(), nil).(*CSRF)
+	assert.Error(t, p.ValidateConfig())
+
+	p = Decode(RawPlugin{
+		"name":   PluginCSRF,
+		"order":  1,
+		"cookie": map[string]interface{}{"same_site": "none"},
+	}, echo.New(), nil).(*CSRF)
+	assert.Error(t, p.ValidateConfig())
+}
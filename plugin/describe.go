@@ -0,0 +1,48 @@
+package plugin
+
+import (
+	"reflect"
+)
+
+type (
+	// PluginInfo describes a plugin at runtime.
+	PluginInfo struct {
+		Name    string `json:"name"`
+		Order   int    `json:"order"`
+		Type    string `json:"type"`
+		Package string `json:"package"`
+	}
+
+	// Describer is implemented by plugins which customize their `PluginInfo`.
+	Describer interface {
+		Describe() PluginInfo
+	}
+)
+
+// BaseDescribe returns the type name and package of v, a plugin or any value.
+func BaseDescribe(v interface{}) PluginInfo {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return PluginInfo{}
+	}
+	return PluginInfo{
+		Type:    t.Name(),
+		Package: t.PkgPath(),
+	}
+}
+
+// Describe returns the info of p, from its own `Describe` if implemented.
+// A method on `Base` only sees `Base`, not the embedding plugin type, hence
+// the function.
+func Describe(p Plugin) PluginInfo {
+	if d, ok := p.(Describer); ok {
+		return d.Describe()
+	}
+	info := BaseDescribe(p)
+	info.Name = p.Name()
+	info.Order = p.Order()
+	return info
+}
@@ -0,0 +1,34 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type described struct {
+	counter
+}
+
+func (d *described) Describe() PluginInfo {
+	info := BaseDescribe(d)
+	info.Name = "custom"
+	return info
+}
+
+func TestDescribe(t *testing.T) {
+	p := Decode(RawPlugin{"name": PluginCas, "order": -1}, nil, nil)
+	assert.Equal(t, PluginInfo{
+		Name:    PluginCas,
+		Order:   -1,
+		Type:    "Cas",
+		Package: "github.com/labstack/armor/plugin",
+	}, Describe(p))
+	assert.Equal(t, "Header", Describe(Decode(RawPlugin{"name": PluginHeader, "order": 1}, nil, nil)).Type)
+
+	// User-defined
+	c := &counter{Base: Base{name: "counter"}}
+	assert.Equal(t, "counter", Describe(c).Type)
+	d := &described{}
+	assert.Equal(t, PluginInfo{Name: "custom", Type: "described", Package: "github.com/labstack/armor/plugin"}, Describe(d))
+}
@@ -0,0 +1,548 @@
+package plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// External authorization of the requests by an HTTP service, or a gRPC one
+// implementing the Envoy ext_authz v3 Authorization service, encoding its
+// protobuf messages by hand.
+
+type (
+	ExtAuthz struct {
+		Base           `json:",squash" yaml:",squash"`
+		ExtAuthzConfig `json:",squash" yaml:",squash"`
+
+		conn     *grpc.ClientConn
+		connFrom string
+	}
+
+	ExtAuthzConfig struct {
+		// Protocol is `http` (default) or `grpc`.
+		Protocol string `yaml:"protocol"`
+
+		// URL of the HTTP authorizer, the request path is appended to its
+		// path, or host:port of the gRPC one.
+		URL string `yaml:"url"`
+
+		// Insecure connects to the gRPC authorizer without TLS.
+		Insecure bool `yaml:"insecure"`
+
+		// Timeout of the checks, default `1s`.
+		Timeout time.Duration `yaml:"timeout"`
+
+		// Headers are the request headers sent to the authorizer, default all.
+		Headers []string `yaml:"headers"`
+
+		// UpstreamHeaders are the headers of the allowing HTTP responses set
+		// on the upstream request, e.g. `X-User-Roles`.
+		UpstreamHeaders []string `yaml:"upstream_headers"`
+
+		// TrustedProxies are the proxies X-Forwarded-For of the requests is
+		// sent to the authorizer of, with the address of the connection
+		// appended. The others are sent as the only address.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+
+		// SubjectHeader passes the user of the auth plugins, e.g. the CAS
+		// username, default `X-Auth-Subject`.
+		SubjectHeader string `yaml:"subject_header"`
+
+		// FailOpen allows the requests when the authorizer fails, otherwise
+		// they get StatusOnError, default 403.
+		FailOpen      bool `yaml:"fail_open"`
+		StatusOnError int  `yaml:"status_on_error"`
+
+		// SkipPaths are requests not authorized, e.g. `/health`.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// extAuthzResult is the decision of the authorizer with its header
+	// mutations.
+	extAuthzResult struct {
+		allow bool
+
+		// Denied response
+		status int
+		body   []byte
+
+		// Upstream request headers, set, appended and removed
+		set, add http.Header
+		remove   []string
+
+		// Response headers
+		response http.Header
+	}
+)
+
+const (
+	ExtAuthzHTTP = "http"
+	ExtAuthzGRPC = "grpc"
+
+	extAuthzCheckMethod = "/envoy.service.auth.v3.Authorization/Check"
+
+	// Largest denied response body of the HTTP authorizer
+	extAuthzMaxBody = 64 << 10
+)
+
+// extAuthzHopHeaders are not passed to or from the authorizer.
+var extAuthzHopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Content-Length":    true,
+}
+
+func (c ExtAuthzConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return time.Second
+	}
+	return c.Timeout
+}
+
+func (c ExtAuthzConfig) subjectHeader() string {
+	if c.SubjectHeader == "" {
+		return "X-Auth-Subject"
+	}
+	return c.SubjectHeader
+}
+
+func (c ExtAuthzConfig) statusOnError() int {
+	if c.StatusOnError == 0 {
+		return http.StatusForbidden
+	}
+	return c.StatusOnError
+}
+
+// headers returns the request headers of c sent to the authorizer, of
+// X-Forwarded-For of trusted proxies only.
+func (c ExtAuthzConfig) headers(ctx echo.Context, trusted util.IPNets) http.Header {
+	r := ctx.Request()
+	h := http.Header{}
+	if len(c.Headers) == 0 {
+		for k, v := range r.Header {
+			if !extAuthzHopHeaders[k] {
+				h[k] = v
+			}
+		}
+	} else {
+		for _, k := range c.Headers {
+			if v := r.Header[textproto.CanonicalMIMEHeaderKey(k)]; len(v) > 0 {
+				h[textproto.CanonicalMIMEHeaderKey(k)] = v
+			}
+		}
+	}
+	h.Del(c.subjectHeader()) // Only from armor
+	if s := AuthSubject(ctx); s != "" {
+		h.Set(c.subjectHeader(), s)
+	}
+	peer := remoteIP(r, nil)
+	forwarded := strings.Join(r.Header[echo.HeaderXForwardedFor], ", ")
+	if forwarded != "" && trusted.Contains(net.ParseIP(peer)) {
+		peer = forwarded + ", " + peer
+	}
+	h.Set(echo.HeaderXForwardedFor, peer)
+	return h
+}
+
+func (a *ExtAuthz) ValidateConfig() error {
+	switch a.Protocol {
+	case "", ExtAuthzHTTP:
+		if u, err := url.Parse(a.URL); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid ext-authz url=%s", a.URL)
+		}
+	case ExtAuthzGRPC:
+		if _, _, err := net.SplitHostPort(a.URL); err != nil || strings.Contains(a.URL, "/") {
+			return fmt.Errorf("ext-authz grpc requires a host:port url=%s", a.URL)
+		}
+	default:
+		return fmt.Errorf("invalid ext-authz protocol=%s", a.Protocol)
+	}
+	if a.Timeout < 0 {
+		return errors.New("invalid ext-authz timeout")
+	}
+	if a.StatusOnError != 0 && (a.StatusOnError < 400 || a.StatusOnError > 599) {
+		return fmt.Errorf("invalid ext-authz status on error=%d", a.StatusOnError)
+	}
+	if _, err := util.ParseIPNets(a.TrustedProxies); err != nil {
+		return err
+	}
+	return validatePathRules(a.SkipPaths)
+}
+
+func (a *ExtAuthz) Initialize() {
+	config := a.ExtAuthzConfig
+	trusted, err := util.ParseIPNets(config.TrustedProxies)
+	if err != nil {
+		if a.Logger != nil {
+			a.Logger.Errorf("ext-authz: %v", err)
+		}
+		a.Middleware = internalErrorMid
+		return
+	}
+	var check func(ctx context.Context, c echo.Context) (*extAuthzResult, error)
+	if config.Protocol == ExtAuthzGRPC {
+		// The connection is kept on updates of the other settings
+		from := config.URL + " " + strconv.FormatBool(config.Insecure)
+		if a.conn != nil && a.connFrom != from {
+			a.conn.Close()
+			a.conn = nil
+		}
+		if a.conn == nil {
+			opt := grpc.WithInsecure()
+			if !config.Insecure {
+				opt = grpc.WithTransportCredentials(credentials.NewTLS(new(tls.Config)))
+			}
+			conn, err := grpc.Dial(config.URL, opt)
+			if err != nil {
+				if a.Logger != nil {
+					a.Logger.Errorf("ext-authz: %v", err)
+				}
+				a.Middleware = internalErrorMid
+				return
+			}
+			a.conn, a.connFrom = conn, from
+		}
+		conn := a.conn
+		check = func(ctx context.Context, c echo.Context) (*extAuthzResult, error) {
+			return config.checkGRPC(ctx, conn, c, trusted)
+		}
+	} else {
+		if a.conn != nil {
+			a.conn.Close()
+			a.conn = nil
+		}
+		client := &http.Client{
+			// The redirects of the authorizer are its response
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		check = func(ctx context.Context, c echo.Context) (*extAuthzResult, error) {
+			return config.checkHTTP(ctx, client, c, trusted)
+		}
+	}
+
+	a.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx, cancel := context.WithTimeout(c.Request().Context(), config.timeout())
+			defer cancel()
+			start := time.Now()
+			r, err := check(ctx, c)
+			d := authDecision{plugin: "ext-authz", subject: AuthSubject(c), policy: config.URL, latency: time.Since(start)}
+			if err != nil {
+				d.decision = decisionError
+				recordDecision(c, d)
+				extAuthzChecks.WithLabelValues("error").Inc()
+				c.Logger().Errorf("ext-authz: %v", err)
+				if config.FailOpen {
+					return next(c)
+				}
+				return echo.NewHTTPError(config.statusOnError())
+			}
+			header := c.Response().Header()
+			for k, v := range r.response {
+				header[k] = append(header[k], v...)
+			}
+			if !r.allow {
+				d.decision = decisionDeny
+				recordDecision(c, d)
+				extAuthzChecks.WithLabelValues("deny").Inc()
+				if len(r.body) == 0 {
+					return echo.NewHTTPError(r.status)
+				}
+				ct := header.Get(echo.HeaderContentType)
+				if ct == "" {
+					ct = echo.MIMETextPlainCharsetUTF8
+				}
+				return c.Blob(r.status, ct, r.body)
+			}
+			d.decision = decisionAllow
+			recordDecision(c, d)
+			extAuthzChecks.WithLabelValues("allow").Inc()
+			req := c.Request()
+			for _, k := range r.remove {
+				req.Header.Del(k)
+			}
+			for k, v := range r.set {
+				req.Header[k] = v
+			}
+			for k, v := range r.add {
+				req.Header[k] = append(req.Header[k], v...)
+			}
+			return next(c)
+		}
+	}
+}
+
+// checkHTTP sends the method, path and headers of the request of c to the
+// authorizer, a 200 response allows it, the others are returned to the
+// client.
+func (c ExtAuthzConfig) checkHTTP(ctx context.Context, client *http.Client, e echo.Context, trusted util.IPNets) (*extAuthzResult, error) {
+	r := e.Request()
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+	u.RawPath = ""
+	u.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequest(r.Method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.headers(e, trusted)
+	req.Header.Set(echo.HeaderXForwardedProto, e.Scheme())
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	result := &extAuthzResult{status: res.StatusCode, set: http.Header{}, response: http.Header{}}
+	if res.StatusCode == http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		result.allow = true
+		for _, k := range c.UpstreamHeaders {
+			if v := res.Header[textproto.CanonicalMIMEHeaderKey(k)]; len(v) > 0 {
+				result.set[textproto.CanonicalMIMEHeaderKey(k)] = v
+			}
+		}
+		return result, nil
+	}
+	if result.body, err = ioutil.ReadAll(io.LimitReader(res.Body, extAuthzMaxBody)); err != nil {
+		return nil, err
+	}
+	for k, v := range res.Header {
+		if !extAuthzHopHeaders[k] && k != "Date" {
+			result.response[k] = v
+		}
+	}
+	return result, nil
+}
+
+// checkGRPC calls the Check method of the Envoy Authorization service.
+func (c ExtAuthzConfig) checkGRPC(ctx context.Context, conn *grpc.ClientConn, e echo.Context, trusted util.IPNets) (*extAuthzResult, error) {
+	req := encodeCheckRequest(e, c.headers(e, trusted))
+	var res []byte
+	if err := conn.Invoke(ctx, extAuthzCheckMethod, &req, &res, grpc.CallCustomCodec(otlpCodec{})); err != nil {
+		return nil, err
+	}
+	return decodeCheckResponse(res)
+}
+
+// encodeCheckRequest encodes CheckRequest of the request of c, the peer is
+// the address of the connection.
+func encodeCheckRequest(c echo.Context, headers http.Header) []byte {
+	r := c.Request()
+	b := new(protoBuffer)
+	// AttributeContext
+	b.message(1, func(ac *protoBuffer) {
+		// Peer source
+		ac.message(1, func(p *protoBuffer) {
+			p.message(1, func(addr *protoBuffer) {
+				addr.message(1, func(sa *protoBuffer) {
+					sa.string(2, remoteIP(r, nil))
+					if _, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+						n, _ := strconv.ParseUint(port, 10, 32)
+						sa.uint(3, n)
+					}
+				})
+			})
+		})
+		// Request
+		ac.message(4, func(req *protoBuffer) {
+			// HttpRequest
+			req.message(2, func(h *protoBuffer) {
+				h.string(1, GetRequestID(c))
+				h.string(2, r.Method)
+				for k, v := range headers {
+					h.message(3, func(kv *protoBuffer) {
+						kv.string(1, strings.ToLower(k))
+						kv.string(2, strings.Join(v, ","))
+					})
+				}
+				h.string(4, r.RequestURI)
+				h.string(5, r.Host)
+				h.string(6, c.Scheme())
+				h.string(7, r.URL.RawQuery)
+				h.string(10, r.Proto)
+			})
+		})
+	})
+	return b.Bytes()
+}
+
+// decodeCheckResponse decodes CheckResponse, a non-OK status denies.
+func decodeCheckResponse(b []byte) (*extAuthzResult, error) {
+	r := &extAuthzResult{
+		allow:    true,
+		status:   http.StatusForbidden,
+		set:      http.Header{},
+		add:      http.Header{},
+		response: http.Header{},
+	}
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1: // google.rpc.Status
+			return protoFields(data, func(field int, v uint64, _ []byte) error {
+				if field == 1 && v != 0 {
+					r.allow = false
+				}
+				return nil
+			})
+		case 2: // DeniedHttpResponse
+			return protoFields(data, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1: // HttpStatus
+					return protoFields(data, func(field int, v uint64, _ []byte) error {
+						if field == 1 && v != 0 {
+							r.status = int(v)
+						}
+						return nil
+					})
+				case 2:
+					return decodeHeaderOption(data, r.response, r.response)
+				case 3:
+					r.body = append([]byte(nil), data...)
+				}
+				return nil
+			})
+		case 3: // OkHttpResponse
+			return protoFields(data, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 2:
+					return decodeHeaderOption(data, r.set, r.add)
+				case 5:
+					r.remove = append(r.remove, string(data))
+				case 6:
+					return decodeHeaderOption(data, r.response, r.response)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r.status < 400 || r.status > 599 {
+		r.status = http.StatusForbidden
+	}
+	return r, nil
+}
+
+// decodeHeaderOption decodes HeaderValueOption into add, appended by default,
+// or into set.
+func decodeHeaderOption(b []byte, set, add http.Header) error {
+	var key, value string
+	appendValue := true
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1: // HeaderValue
+			return protoFields(data, func(field int, _ uint64, data []byte) error {
+				switch field {
+				case 1:
+					key = string(data)
+				case 2:
+					value = string(data)
+				}
+				return nil
+			})
+		case 2: // BoolValue append
+			appendValue = false
+			return protoFields(data, func(field int, v uint64, _ []byte) error {
+				if field == 1 {
+					appendValue = v != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || key == "" {
+		return err
+	}
+	if appendValue {
+		add.Add(key, value)
+	} else {
+		set.Set(key, value)
+	}
+	return nil
+}
+
+// protoFields calls f with the fields of the message b, the value of the
+// varint and fixed ones, the data of the length-delimited ones.
+func protoFields(b []byte, f func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid protobuf tag")
+		}
+		b = b[n:]
+		var v uint64
+		var data []byte
+		switch tag & 7 {
+		case 0:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errors.New("invalid protobuf fixed64")
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("invalid protobuf length")
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return errors.New("invalid protobuf fixed32")
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return fmt.Errorf("invalid protobuf wire type=%d", tag&7)
+		}
+		if err := f(int(tag>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *ExtAuthz) Update(p Plugin) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.ExtAuthzConfig = p.(*ExtAuthz).ExtAuthzConfig
+	a.Initialize()
+}
+
+func (a *ExtAuthz) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return skipPaths(a.SkipPaths, next, a.Middleware(next))
+}
@@ -0,0 +1,176 @@
+package plugin
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func extAuthzServe(t *testing.T, raw RawPlugin, path string) (*httptest.ResponseRecorder, http.Header) {
+	e := echo.New()
+	raw["name"], raw["order"] = "ext-authz", 1
+	a := Decode(raw, e, nil).(*ExtAuthz)
+	if !assert.NoError(t, a.ValidateConfig()) {
+		return nil, nil
+	}
+	a.Initialize()
+	var upstream http.Header
+	e.GET("/*", a.Process(func(c echo.Context) error {
+		upstream = c.Request().Header
+		return c.String(http.StatusOK, "OK")
+	}), func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("casUsername", "jon")
+			return next(c)
+		}
+	})
+	req := httptest.NewRequest(echo.GET, path, nil)
+	req.Header.Set("X-Debug", "1")
+	req.Header.Set("X-Auth-Subject", "admin")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec, upstream
+}
+
+func TestExtAuthzHTTP(t *testing.T) {
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "jon", r.Header.Get("X-Auth-Subject"))
+		if r.URL.Path == "/check/docs" && r.URL.RawQuery == "page=1" {
+			w.Header().Set("X-User-Roles", "reader")
+			w.Header().Set("X-Other", "1")
+			return
+		}
+		w.Header().Set(echo.HeaderContentType, echo.MIMETextPlain)
+		w.Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("denied"))
+	}))
+	defer authz.Close()
+	raw := func() RawPlugin {
+		return RawPlugin{"url": authz.URL + "/check", "upstream_headers": []interface{}{"X-User-Roles"}}
+	}
+
+	rec, upstream := extAuthzServe(t, raw(), "/docs?page=1")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "reader", upstream.Get("X-User-Roles"))
+	assert.Empty(t, upstream.Get("X-Other"))
+
+	rec, upstream = extAuthzServe(t, raw(), "/admin")
+	assert.Nil(t, upstream)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "denied", rec.Body.String())
+	assert.Equal(t, "Bearer", rec.Header().Get(echo.HeaderWWWAuthenticate))
+
+	// Unreachable
+	down := RawPlugin{"url": "http://127.0.0.1:1", "status_on_error": 503}
+	rec, _ = extAuthzServe(t, down, "/docs")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	down = RawPlugin{"url": "http://127.0.0.1:1", "fail_open": true}
+	rec, _ = extAuthzServe(t, down, "/docs")
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestExtAuthzGRPC(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := grpc.NewServer(grpc.CustomCodec(otlpCodec{}), grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		assert.Equal(t, extAuthzCheckMethod, method)
+		var req []byte
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		assert.True(t, bytes.Contains(req, []byte("x-auth-subject")))
+		res := new(protoBuffer)
+		header := func(b *protoBuffer, field int, k, v string, appendValue bool) {
+			b.message(field, func(o *protoBuffer) {
+				o.message(1, func(h *protoBuffer) {
+					h.string(1, k)
+					h.string(2, v)
+				})
+				o.message(2, func(a *protoBuffer) {
+					if appendValue {
+						a.uint(1, 1)
+					}
+				})
+			})
+		}
+		if bytes.Contains(req, []byte("/docs")) {
+			res.message(1, func(*protoBuffer) {})
+			res.message(3, func(ok *protoBuffer) {
+				header(ok, 2, "x-user-roles", "reader", false)
+				ok.string(5, "x-debug")
+				header(ok, 6, "x-authz", "ok", true)
+			})
+		} else {
+			res.message(1, func(st *protoBuffer) { st.uint(1, 7) })
+			res.message(2, func(d *protoBuffer) {
+				d.message(1, func(st *protoBuffer) { st.uint(1, 401) })
+				d.string(3, "denied")
+			})
+		}
+		b := res.Bytes()
+		return stream.SendMsg(&b)
+	}))
+	go s.Serve(ln)
+	defer s.Stop()
+
+	raw := func() RawPlugin {
+		return RawPlugin{"protocol": "grpc", "url": ln.Addr().String(), "insecure": true}
+	}
+	rec, upstream := extAuthzServe(t, raw(), "/docs")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "reader", upstream.Get("X-User-Roles"))
+	assert.Empty(t, upstream.Get("X-Debug"))
+	assert.Equal(t, "ok", rec.Header().Get("X-Authz"))
+
+	rec, upstream = extAuthzServe(t, raw(), "/admin")
+	assert.Nil(t, upstream)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "denied", rec.Body.String())
+}
+
+func TestExtAuthzForwardedFor(t *testing.T) {
+	trusted, _ := util.ParseIPNets([]string{"10.0.0.0/8"})
+	check := func(peer string) (http.Header, []byte) {
+		e := echo.New()
+		req := httptest.NewRequest(echo.GET, "/docs", nil)
+		req.RemoteAddr = peer + ":1234"
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.1")
+		c := e.NewContext(req, httptest.NewRecorder())
+		h := ExtAuthzConfig{}.headers(c, trusted)
+		return h, encodeCheckRequest(c, h)
+	}
+
+	// Spoofed by clients, appended to of trusted proxies
+	h, req := check("192.0.2.1")
+	assert.Equal(t, "192.0.2.1", h.Get(echo.HeaderXForwardedFor))
+	assert.True(t, bytes.Contains(req, []byte("192.0.2.1")))
+	assert.False(t, bytes.Contains(req, []byte("203.0.113.1")))
+	h, req = check("10.0.0.1")
+	assert.Equal(t, "203.0.113.1, 10.0.0.1", h.Get(echo.HeaderXForwardedFor))
+	assert.True(t, bytes.Contains(req, []byte("\x12\x0810.0.0.1")))
+}
+
+func TestExtAuthzConfig(t *testing.T) {
+	for _, c := range []ExtAuthzConfig{
+		{URL: "authz:9000"},
+		{Protocol: ExtAuthzGRPC, URL: "http://authz"},
+		{Protocol: "thrift", URL: "http://authz"},
+		{URL: "http://authz", StatusOnError: 200},
+		{URL: "http://authz", TrustedProxies: []string{"proxy"}},
+	} {
+		assert.Error(t, (&ExtAuthz{ExtAuthzConfig: c}).ValidateConfig())
+	}
+	_, err := decodeCheckResponse([]byte{0x0a, 0x05})
+	assert.Error(t, err)
+}
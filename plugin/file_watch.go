@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/labstack/gommon/log"
+)
+
+type (
+	// fileWatcher calls reload when a file changes.
+	fileWatcher struct {
+		file    string
+		last    os.FileInfo
+		reload  func()
+		done    chan struct{}
+		stopped chan struct{}
+	}
+)
+
+// watchFile starts watching file.
+func watchFile(file string, logger *log.Logger, reload func()) (*fileWatcher, error) {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// Watch the directory, editors and Kubernetes secret volumes replace the
+	// file
+	if err := fsw.Add(filepath.Dir(file)); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+	w := &fileWatcher{
+		file:    file,
+		reload:  reload,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	w.last, _ = os.Stat(file)
+	go func() {
+		defer close(w.stopped)
+		defer fsw.Close()
+		var pending <-chan time.Time
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-fsw.Events:
+				pending = time.After(casbinWatchDelay)
+			case err := <-fsw.Errors:
+				if logger != nil {
+					logger.Errorf("watch error, file=%s: %v", file, err)
+				}
+			case <-pending:
+				pending = nil
+				if w.changed() {
+					w.reload()
+				}
+			}
+		}
+	}()
+	return w, nil
+}
+
+// changed reports whether the file changed since the last check.
+func (w *fileWatcher) changed() bool {
+	fi, err := os.Stat(w.file)
+	if err != nil {
+		return false
+	}
+	last := w.last
+	w.last = fi
+	return last == nil || !os.SameFile(fi, last) || !fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size()
+}
+
+// stop stops watching, it returns once the watcher is stopped or ctx is
+// done.
+func (w *fileWatcher) stop(ctx context.Context) {
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+	select {
+	case <-w.stopped:
+	case <-ctx.Done():
+	}
+}
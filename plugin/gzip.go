@@ -1,7 +1,6 @@
 package plugin
 
 import (
-	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
@@ -22,9 +21,3 @@ func (g *Gzip) Update(p Plugin) {
 	g.GzipConfig = p.(*Gzip).GzipConfig
 	g.Initialize()
 }
-
-func (g *Gzip) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	g.mutex.RLock()
-	defer g.mutex.RUnlock()
-	return g.Middleware(next)
-}
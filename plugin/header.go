@@ -1,23 +1,89 @@
 package plugin
 
-import "github.com/labstack/echo/v4"
+import (
+	"net/http"
 
-// Add/remove HTTP response headers.
+	"github.com/labstack/echo/v4"
+)
+
+// Add/remove HTTP request and response headers, the values are templates,
+// e.g. `${remote_ip}` or `${user}`.
 
 type (
 	Header struct {
 		Base         `yaml:",squash"`
 		HeaderConfig `yaml:",squash"`
+
+		request, headers, response headerOps
 	}
 
 	HeaderConfig struct {
+		// Set, Add and Del are the response headers, set before the next
+		// plugins.
+		Set map[string]string `yaml:"set"`
+		Add map[string]string `yaml:"add"`
+		Del []string          `yaml:"del"`
+
+		// Request headers, passed to the next plugins and the upstream.
+		Request HeaderRules `yaml:"request"`
+
+		// Response headers, applied before the response is written.
+		Response HeaderRules `yaml:"response"`
+	}
+
+	HeaderRules struct {
 		Set map[string]string `yaml:"set"`
 		Add map[string]string `yaml:"add"`
 		Del []string          `yaml:"del"`
 	}
+
+	headerValue struct {
+		name  string
+		value *Template
+	}
+
+	headerOps struct {
+		set, add []headerValue
+		del      []string
+	}
 )
 
-func (*Header) Initialize() {
+func newHeaderOps(rules ...HeaderRules) (o headerOps) {
+	for _, r := range rules {
+		for k, v := range r.Set {
+			o.set = append(o.set, headerValue{k, NewTemplate(v)})
+		}
+		for k, v := range r.Add {
+			o.add = append(o.add, headerValue{k, NewTemplate(v)})
+		}
+		o.del = append(o.del, r.Del...)
+	}
+	return
+}
+
+func (o headerOps) empty() bool {
+	return len(o.set) == 0 && len(o.add) == 0 && len(o.del) == 0
+}
+
+// apply sets, adds and deletes the headers of h, in this order.
+func (o headerOps) apply(c echo.Context, h http.Header) {
+	for _, v := range o.set {
+		s, _ := v.value.Execute(c)
+		h.Set(v.name, s)
+	}
+	for _, v := range o.add {
+		s, _ := v.value.Execute(c)
+		h.Add(v.name, s)
+	}
+	for _, k := range o.del {
+		h.Del(k)
+	}
+}
+
+func (h *Header) Initialize() {
+	h.request = newHeaderOps(h.Request)
+	h.headers = newHeaderOps(HeaderRules{Set: h.Set, Add: h.Add, Del: h.Del})
+	h.response = newHeaderOps(h.Response)
 }
 
 func (h *Header) Update(p Plugin) {
@@ -30,16 +96,16 @@ func (h *Header) Update(p Plugin) {
 func (h *Header) Process(next echo.HandlerFunc) echo.HandlerFunc {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
+	request, headers, response := h.request, h.headers, h.response
 	return func(c echo.Context) error {
-		header := c.Response().Header()
-		for k, v := range h.Set { // Set headers
-			header.Set(k, v)
-		}
-		for k, v := range h.Add { // Add headers
-			header.Add(k, v)
-		}
-		for _, k := range h.Del { // Delete headers
-			header.Del(k)
+		request.apply(c, c.Request().Header)
+		headers.apply(c, c.Response().Header())
+		if !response.empty() {
+			// After the handler, e.g. to delete or replace the upstream headers
+			res := c.Response()
+			res.Before(func() {
+				response.apply(c, res.Header())
+			})
 		}
 		return next(c)
 	}
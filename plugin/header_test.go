@@ -32,3 +32,40 @@ func TestHeader(t *testing.T) {
 	assert.EqualValues(t, []string{"Jon", "Joe"}, rec.Header()["Name"]) // Add
 	assert.Equal(t, "", rec.Header().Get("Delete"))                     // Del
 }
+
+func TestHeaderTemplates(t *testing.T) {
+	e := echo.New()
+	h := Decode(RawPlugin{
+		"name":  "headers",
+		"order": 1,
+		"request": map[string]interface{}{
+			"set": map[string]interface{}{"X-User": "${user}", "X-Real-IP": "${remote_ip}"},
+			"del": []interface{}{"X-Debug"},
+		},
+		"response": map[string]interface{}{
+			"set": map[string]interface{}{"X-Id": "${path:id}"},
+			"del": []interface{}{"X-Powered-By"},
+		},
+	}, e, nil).(*Header)
+	h.Initialize()
+	e.GET("/users/:id", h.Process(func(c echo.Context) error {
+		assert.Equal(t, "jon", c.Request().Header.Get("X-User"))
+		assert.Equal(t, "192.0.2.1", c.Request().Header.Get("X-Real-IP"))
+		assert.Empty(t, c.Request().Header.Get("X-Debug"))
+		c.Response().Header().Set("X-Powered-By", "upstream")
+		return c.String(http.StatusOK, "OK")
+	}), func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("casUsername", "jon")
+			return next(c)
+		}
+	})
+	req := httptest.NewRequest(echo.GET, "/users/1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Debug", "1")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("X-Id"))
+	assert.Empty(t, rec.Header().Get("X-Powered-By"))
+}
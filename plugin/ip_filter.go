@@ -0,0 +1,218 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Client IP allow and deny lists, by CIDR and by GeoIP country.
+
+type (
+	IPFilter struct {
+		Base           `json:",squash" yaml:",squash"`
+		IPFilterConfig `json:",squash" yaml:",squash"`
+
+		geo     geoReader
+		geoFrom string
+	}
+
+	IPFilterConfig struct {
+		// Allow and Deny are CIDRs or IPs, e.g. `10.0.0.0/8`. Clients in Deny,
+		// or not in Allow if set, are rejected.
+		Allow []string `yaml:"allow"`
+		Deny  []string `yaml:"deny"`
+
+		// TrustedProxies are the proxies, CIDRs or IPs, the client IP is read
+		// from X-Forwarded-For of, the first address from the right not in
+		// the list. Without, it is the address of the connection, the PROXY
+		// protocol one behind a load balancer.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+
+		// GeoIP filters by country.
+		GeoIP IPFilterGeoIP `yaml:"geoip"`
+
+		// ErrorPage is an HTML file sent to the rejected clients.
+		ErrorPage string `yaml:"error_page"`
+
+		// SkipPaths are requests not filtered, e.g. `/health`.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// IPFilterGeoIP rejects the countries, ISO codes e.g. `FR`, of
+	// DenyCountries or not in AllowCountries if set, looked up in the MaxMind
+	// Database, e.g. GeoLite2-Country.mmdb, read on start and when its path
+	// changes.
+	IPFilterGeoIP struct {
+		Database       string   `yaml:"database"`
+		AllowCountries []string `yaml:"allow_countries"`
+		DenyCountries  []string `yaml:"deny_countries"`
+	}
+
+	geoReader interface {
+		Lookup(ip net.IP, result interface{}) error
+	}
+
+	geoCountry struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+)
+
+// clientIP returns the IP of the client of r, from X-Forwarded-For when the
+// connection is from trusted.
+func clientIP(r *http.Request, trusted util.IPNets) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trusted.Contains(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header[echo.HeaderXForwardedFor], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		fip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if fip == nil {
+			break
+		}
+		ip = fip
+		if !trusted.Contains(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// remoteIP returns the client IP of r as in clientIP, the address of the
+// connection if it is not an IP.
+func remoteIP(r *http.Request, trusted util.IPNets) string {
+	if ip := clientIP(r, trusted); ip != nil {
+		return ip.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RemoteIP returns the client IP of r, from X-Forwarded-For when the
+// connection is from trusted, else the address of the connection.
+func RemoteIP(r *http.Request, trusted util.IPNets) string {
+	return remoteIP(r, trusted)
+}
+
+func countrySet(codes []string) map[string]bool {
+	s := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		s[strings.ToUpper(c)] = true
+	}
+	return s
+}
+
+func (f *IPFilter) Initialize() {
+	fail := func(err error) {
+		if f.Logger != nil {
+			f.Logger.Errorf("ip-filter: %v", err)
+		}
+		f.Middleware = internalErrorMid
+	}
+	allow, err := util.ParseIPNets(f.Allow)
+	if err != nil {
+		fail(err)
+		return
+	}
+	deny, err := util.ParseIPNets(f.Deny)
+	if err != nil {
+		fail(err)
+		return
+	}
+	trusted, err := util.ParseIPNets(f.TrustedProxies)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if f.GeoIP.Database != f.geoFrom || f.geo == nil {
+		f.geo, f.geoFrom = nil, f.GeoIP.Database
+		if f.GeoIP.Database != "" {
+			// In memory, not to unmap it under the requests on updates
+			b, err := ioutil.ReadFile(f.GeoIP.Database)
+			if err == nil {
+				f.geo, err = maxminddb.FromBytes(b)
+			}
+			if err != nil {
+				fail(fmt.Errorf("failed to open geoip database=%s, %v", f.GeoIP.Database, err))
+				return
+			}
+		}
+	}
+	var page []byte
+	if f.ErrorPage != "" {
+		if page, err = ioutil.ReadFile(f.ErrorPage); err != nil {
+			fail(err)
+			return
+		}
+	}
+	geo := f.geo
+	allowCountries, denyCountries := countrySet(f.GeoIP.AllowCountries), countrySet(f.GeoIP.DenyCountries)
+	allowed := func(ip net.IP) bool {
+		if ip == nil || deny.Contains(ip) || (len(allow) > 0 && !allow.Contains(ip)) {
+			return false
+		}
+		if geo == nil || (len(allowCountries) == 0 && len(denyCountries) == 0) {
+			return true
+		}
+		var country geoCountry
+		if err := geo.Lookup(ip, &country); err != nil && f.Logger != nil {
+			f.Logger.Warnf("ip-filter: failed to look up country of ip=%s, %v", ip, err)
+		}
+		code := country.Country.ISOCode
+		return !denyCountries[code] && (len(allowCountries) == 0 || allowCountries[code])
+	}
+	f.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if allowed(clientIP(c.Request(), trusted)) {
+				return next(c)
+			}
+			ipFilterDenied.Inc()
+			if page != nil {
+				return c.HTMLBlob(http.StatusForbidden, page)
+			}
+			return echo.ErrForbidden
+		}
+	}
+}
+
+func (f *IPFilter) Update(p Plugin) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.IPFilterConfig = p.(*IPFilter).IPFilterConfig
+	f.Initialize()
+}
+
+func (f *IPFilter) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return skipPaths(f.SkipPaths, next, f.Middleware(next))
+}
+
+func (f *IPFilter) ValidateConfig() error {
+	for _, list := range [][]string{f.Allow, f.Deny, f.TrustedProxies} {
+		if _, err := util.ParseIPNets(list); err != nil {
+			return err
+		}
+	}
+	if f.GeoIP.Database == "" && (len(f.GeoIP.AllowCountries) > 0 || len(f.GeoIP.DenyCountries) > 0) {
+		return errors.New("geoip countries require a database")
+	}
+	return validatePathRules(f.SkipPaths)
+}
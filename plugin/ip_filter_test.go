@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeGeo map[string]string
+
+func (g fakeGeo) Lookup(ip net.IP, result interface{}) error {
+	result.(*geoCountry).Country.ISOCode = g[ip.String()]
+	return nil
+}
+
+func TestIPFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor-ip-filter")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	page := filepath.Join(dir, "403.html")
+	assert.NoError(t, ioutil.WriteFile(page, []byte("<h1>Forbidden</h1>"), 0600))
+
+	e := echo.New()
+	p := Decode(RawPlugin{
+		"name":            PluginIPFilter,
+		"order":           1,
+		"allow":           []interface{}{"192.0.2.0/24", "2001:db8::/32"},
+		"deny":            []interface{}{"192.0.2.66"},
+		"trusted_proxies": []interface{}{"10.0.0.0/8"},
+		"geoip": map[string]interface{}{
+			"database":       "GeoLite2-Country.mmdb",
+			"deny_countries": []interface{}{"fr"},
+		},
+		"error_page": page,
+	}, e, nil).(*IPFilter)
+	if !assert.NoError(t, p.ValidateConfig()) {
+		return
+	}
+	p.geo, p.geoFrom = fakeGeo{"192.0.2.33": "FR"}, "GeoLite2-Country.mmdb"
+	p.Initialize()
+
+	do := func(remote string, forwarded ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.RemoteAddr = remote
+		for _, f := range forwarded {
+			req.Header.Add(echo.HeaderXForwardedFor, f)
+		}
+		rec := httptest.NewRecorder()
+		err := p.Process(func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		})(e.NewContext(req, rec))
+		if err != nil {
+			e.HTTPErrorHandler(err, e.NewContext(req, rec))
+		}
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, do("192.0.2.1:1234").Code)
+	assert.Equal(t, http.StatusOK, do("[2001:db8::1]:1234").Code)
+	rec := do("192.0.2.66:1234")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, "<h1>Forbidden</h1>", rec.Body.String())
+	assert.Equal(t, http.StatusForbidden, do("198.51.100.1:1234").Code)
+
+	// Country
+	assert.Equal(t, http.StatusForbidden, do("192.0.2.33:1234").Code)
+
+	// X-Forwarded-For of trusted proxies only
+	assert.Equal(t, http.StatusOK, do("10.0.0.1:1234", "198.51.100.1, 192.0.2.1", "10.0.0.2").Code)
+	assert.Equal(t, http.StatusForbidden, do("10.0.0.1:1234", "192.0.2.1, 198.51.100.1").Code)
+	assert.Equal(t, http.StatusForbidden, do("198.51.100.1:1234", "192.0.2.1").Code)
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := util.ParseIPNets([]string{"10.0.0.0/8"})
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "10.0.0.1", clientIP(req, trusted).String())
+	req.Header.Set(echo.HeaderXForwardedFor, "10.0.0.3, 10.0.0.2")
+	assert.Equal(t, "10.0.0.3", clientIP(req, trusted).String())
+	req.Header.Set(echo.HeaderXForwardedFor, "unknown, 192.0.2.1")
+	assert.Equal(t, "192.0.2.1", clientIP(req, trusted).String())
+}
+
+func TestIPFilterValidateConfig(t *testing.T) {
+	p := Decode(RawPlugin{
+		"name":  PluginIPFilter,
+		"order": 1,
+		"allow": []interface{}{"192.0.2.0/33"},
+	}, echo.New(), nil).(*IPFilter)
+	assert.Error(t, p.ValidateConfig())
+
+	p = Decode(RawPlugin{
+		"name":  PluginIPFilter,
+		"order": 1,
+		"geoip": map[string]interface{}{"allow_countries": []interface{}{"US"}},
+	}, echo.New(), nil).(*IPFilter)
+	assert.Error(t, p.ValidateConfig())
+}
@@ -0,0 +1,450 @@
+package plugin
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Bearer token verification with a static key or a JWKS URL.
+
+type (
+	Jwt struct {
+		Base      `json:",squash" yaml:",squash"`
+		JwtConfig `json:",squash" yaml:",squash"`
+
+		jwks      *jwksCache
+		casbinMid *casbinMiddleware
+	}
+
+	JwtConfig struct {
+		// Key is a PEM file with the public key or certificate verifying the
+		// tokens, Secret an HMAC secret. JWKSURL serves the keys instead,
+		// they're refreshed every JWKSRefreshInterval (default 1 hour) and
+		// when a token is signed by an unknown key.
+		Key                 string        `yaml:"key"`
+		Secret              string        `yaml:"secret" armor:"probe,secret"`
+		JWKSURL             string        `yaml:"jwks_url"`
+		JWKSRefreshInterval time.Duration `yaml:"jwks_refresh_interval"`
+
+		// Issuer and Audience are checked if set, tokens must expire.
+		Issuer   string `yaml:"issuer"`
+		Audience string `yaml:"audience"`
+
+		// UsernameClaim is the claim used as the username, default `sub`.
+		UsernameClaim string `yaml:"username_claim"`
+
+		// SkipPaths are requests passed without authentication, e.g.
+		// `/health` or `GET /public/*`.
+		SkipPaths []string `yaml:"skip_paths"`
+
+		// CasbinCfg authorizes the users, `subject_attr` is a claim.
+		CasbinCfg CasbinConfig `yaml:"casbin"`
+	}
+
+	// jwksCache keeps the keys served at a JWKS URL.
+	jwksCache struct {
+		url     string
+		client  *http.Client
+		logger  *log.Logger
+		mutex   sync.RWMutex
+		keys    *jose.JSONWebKeySet
+		fetched time.Time
+		done    chan struct{}
+		stopped chan struct{}
+	}
+
+	jwtCtxKey int
+)
+
+const (
+	JwtUsernameCtxKey jwtCtxKey = iota
+	JwtClaimsCtxKey
+)
+
+const (
+	jwtDefaultRefreshInterval = time.Hour
+
+	// jwksMinRefreshInterval limits the refreshes caused by tokens signed by
+	// unknown keys.
+	jwksMinRefreshInterval = time.Minute
+)
+
+func (j *Jwt) Initialize() {
+	if j.jwks != nil {
+		j.jwks.stop(context.Background())
+		j.jwks = nil
+	}
+	j.casbinMid = nil
+	key, err := j.verificationKey()
+	if err != nil {
+		if j.Logger != nil {
+			j.Logger.Errorf("jwt: %v", err)
+		}
+		j.Middleware = internalErrorMid
+		return
+	}
+	if j.JWKSURL != "" {
+		interval := j.JWKSRefreshInterval
+		if interval <= 0 {
+			interval = jwtDefaultRefreshInterval
+		}
+		j.jwks = newJWKSCache(j.JWKSURL, interval, j.Logger)
+	}
+	authz := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return next
+	}
+	if j.CasbinCfg.Model != "" {
+		casbinMid, err := newSubjectCasbinMiddleware(j.CasbinCfg, jwtClaimGetter(j.CasbinCfg.SubjectAttribute))
+		if err != nil {
+			if j.Logger != nil {
+				j.Logger.Errorf("jwt: invalid casbin config: %v", err)
+			}
+			j.Middleware = internalErrorMid
+			return
+		}
+		if claim := j.CasbinCfg.RoleAttribute; claim != "" {
+			casbinMid.RolesFunc = func(c echo.Context) []string {
+				claims, _ := c.Request().Context().Value(JwtClaimsCtxKey).(map[string]interface{})
+				return jwtStrings(claims[claim])
+			}
+		}
+		j.casbinMid, authz = casbinMid, casbinMid.MiddlewareFunc()
+	}
+	config, jwks := j.JwtConfig, j.jwks
+	j.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := authz(next)
+		return func(c echo.Context) error {
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+				return jwtUnauthorized(c)
+			}
+			claims, err := verifyJwt(auth[7:], config, key, jwks)
+			if err != nil {
+				c.Logger().Debugf("jwt: invalid token: %v", err)
+				return jwtUnauthorized(c)
+			}
+			username, _ := claims[config.usernameClaim()].(string)
+			setJwtUser(c, username, claims)
+			return h(c)
+		}
+	}
+}
+
+// verificationKey returns the static key, nil with a JWKS URL.
+func (c JwtConfig) verificationKey() (interface{}, error) {
+	if c.Secret != "" {
+		return []byte(c.Secret), nil
+	}
+	if c.Key == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("invalid jwt key=%s", c.Key)
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func (c JwtConfig) usernameClaim() string {
+	if c.UsernameClaim == "" {
+		return "sub"
+	}
+	return c.UsernameClaim
+}
+
+func jwtUnauthorized(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+	return echo.ErrUnauthorized
+}
+
+// verifyJwt verifies the token signature with key or the JWKS key and
+// checks its registered claims, it returns all claims.
+func verifyJwt(raw string, config JwtConfig, key interface{}, jwks *jwksCache) (map[string]interface{}, error) {
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, err
+	}
+	if jwks != nil {
+		kid := ""
+		for _, h := range token.Headers {
+			if h.KeyID != "" {
+				kid = h.KeyID
+				break
+			}
+		}
+		k, err := jwks.key(kid)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+	}
+	var registered jwt.Claims
+	claims := map[string]interface{}{}
+	if err := token.Claims(key, &registered, &claims); err != nil {
+		return nil, err
+	}
+	if registered.Expiry == nil {
+		return nil, errors.New("token without expiry")
+	}
+	expected := jwt.Expected{Issuer: config.Issuer, Time: time.Now()}
+	if config.Audience != "" {
+		expected.Audience = jwt.Audience{config.Audience}
+	}
+	return claims, registered.Validate(expected)
+}
+
+func (j *Jwt) Update(p Plugin) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.JwtConfig = p.(*Jwt).JwtConfig
+	j.Initialize()
+}
+
+func (*Jwt) Priority() int {
+	return -1
+}
+
+func (j *Jwt) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+	return skipPaths(j.SkipPaths, next, j.Middleware(next))
+}
+
+func (j *Jwt) ValidateConfig() error {
+	n := 0
+	for _, v := range []string{j.Key, j.Secret, j.JWKSURL} {
+		if v != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("jwt requires one of key, secret or jwks_url")
+	}
+	if _, err := j.verificationKey(); err != nil {
+		return err
+	}
+	if err := validatePathRules(j.SkipPaths); err != nil {
+		return err
+	}
+	if j.CasbinCfg.Model != "" {
+		if _, err := j.CasbinCfg.Enforcer(); err != nil {
+			return fmt.Errorf("invalid casbin config: %v", err)
+		}
+	}
+	return nil
+}
+
+func (*Jwt) DefaultConfig() interface{} {
+	return JwtConfig{
+		JWKSURL: "https://accounts.example.com/.well-known/jwks.json",
+		Issuer:  "https://accounts.example.com",
+	}
+}
+
+func (j *Jwt) ProbeConfig(probe ProbeFunc) error {
+	return ProbeConfig(&j.JwtConfig, probe)
+}
+
+func (*Jwt) OpenAPITag() *openapi3.Tag {
+	return &openapi3.Tag{
+		Name:        "JWT",
+		Description: "Authenticated by a JWT bearer token",
+	}
+}
+
+func (*Jwt) OpenAPISecurityScheme() *openapi3.SecurityScheme {
+	return &openapi3.SecurityScheme{
+		Type:         "http",
+		Scheme:       "bearer",
+		BearerFormat: "JWT",
+	}
+}
+
+// Reload loads the casbin model and policy again, if configured.
+func (j *Jwt) Reload() error {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+	if j.casbinMid == nil {
+		return nil
+	}
+	return j.casbinMid.Reload()
+}
+
+// ShutdownGrace stops the JWKS refresh.
+func (j *Jwt) ShutdownGrace(ctx context.Context) {
+	j.mutex.Lock()
+	jwks := j.jwks
+	j.jwks = nil
+	j.mutex.Unlock()
+	if jwks != nil {
+		jwks.stop(ctx)
+	}
+}
+
+// setJwtUser stores the username and claims on the echo and request
+// contexts.
+func setJwtUser(c echo.Context, username string, claims map[string]interface{}) {
+	r := c.Request()
+	c.Set("jwtClaims", claims)
+	c.Set("jwtUsername", username)
+	newCtx := context.WithValue(r.Context(), JwtUsernameCtxKey, username)
+	newCtx = context.WithValue(newCtx, JwtClaimsCtxKey, claims)
+	c.SetRequest(r.WithContext(newCtx))
+}
+
+func getJwtUsername(c echo.Context) string {
+	username, _ := c.Request().Context().Value(JwtUsernameCtxKey).(string)
+	return username
+}
+
+// jwtStrings returns the strings of a string or array claim.
+func jwtStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		s := make([]string, 0, len(v))
+		for _, e := range v {
+			if e, ok := e.(string); ok {
+				s = append(s, e)
+			}
+		}
+		return s
+	}
+	return nil
+}
+
+// jwtClaimGetter returns the casbin subject, the username or the claim.
+func jwtClaimGetter(claim string) func(c echo.Context) string {
+	if claim == "" {
+		return getJwtUsername
+	}
+	return func(c echo.Context) string {
+		claims, _ := c.Request().Context().Value(JwtClaimsCtxKey).(map[string]interface{})
+		s, _ := claims[claim].(string)
+		return s
+	}
+}
+
+// newJWKSCache fetches the keys at url in the background, every interval.
+func newJWKSCache(url string, interval time.Duration, logger *log.Logger) *jwksCache {
+	c := &jwksCache{
+		url:     url,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		logger:  logger,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go func() {
+		defer close(c.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := c.refresh(); err != nil && c.logger != nil {
+				c.logger.Errorf("jwt: failed to fetch jwks=%s: %v", c.url, err)
+			}
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return c
+}
+
+func (c *jwksCache) refresh() error {
+	c.mutex.Lock()
+	c.fetched = time.Now()
+	c.mutex.Unlock()
+	res, err := c.client.Get(c.url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status=%d", res.StatusCode)
+	}
+	keys := new(jose.JSONWebKeySet)
+	if err := json.NewDecoder(res.Body).Decode(keys); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.keys = keys
+	c.mutex.Unlock()
+	return nil
+}
+
+// lookup returns the key kid, or the only key for tokens without a key id.
+func (c *jwksCache) lookup(kid string) (interface{}, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.keys == nil {
+		return nil, false
+	}
+	if kid == "" {
+		if len(c.keys.Keys) == 1 {
+			return c.keys.Keys[0].Key, true
+		}
+		return nil, false
+	}
+	if keys := c.keys.Key(kid); len(keys) > 0 {
+		return keys[0].Key, true
+	}
+	return nil, false
+}
+
+// key returns the key kid, refreshing the keys if it's unknown, e.g. after
+// a key rotation.
+func (c *jwksCache) key(kid string) (interface{}, error) {
+	if k, ok := c.lookup(kid); ok {
+		return k, nil
+	}
+	c.mutex.RLock()
+	recent := time.Since(c.fetched) < jwksMinRefreshInterval && c.keys != nil
+	c.mutex.RUnlock()
+	if !recent {
+		if err := c.refresh(); err != nil {
+			return nil, err
+		}
+		if k, ok := c.lookup(kid); ok {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id=%s", kid)
+}
+
+// stop stops the refresh, it returns once stopped or ctx is done.
+func (c *jwksCache) stop(ctx context.Context) {
+	close(c.done)
+	select {
+	case <-c.stopped:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,179 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func signJwt(t *testing.T, key jose.SigningKey, kid string, claims map[string]interface{}) string {
+	opts := &jose.SignerOptions{}
+	if kid != "" {
+		opts = opts.WithHeader("kid", kid)
+	}
+	signer, err := jose.NewSigner(key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJwtJWKS(t *testing.T) {
+	keys := map[string]*rsa.PrivateKey{}
+	var mutex sync.Mutex
+	fetches := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		fetches++
+		set := jose.JSONWebKeySet{}
+		for kid, k := range keys {
+			set.Keys = append(set.Keys, jose.JSONWebKey{Key: &k.PublicKey, KeyID: kid, Algorithm: "RS256", Use: "sig"})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer s.Close()
+	addKey := func(kid string) jose.SigningKey {
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutex.Lock()
+		keys[kid] = k
+		mutex.Unlock()
+		return jose.SigningKey{Algorithm: jose.RS256, Key: k}
+	}
+	key := addKey("1")
+
+	j := initialized(&Jwt{JwtConfig: JwtConfig{
+		JWKSURL:       s.URL,
+		Issuer:        "https://accounts.labstack.com",
+		Audience:      "armor",
+		UsernameClaim: "email",
+		CasbinCfg: CasbinConfig{
+			Model:            "testdata/casbin_model.conf",
+			Policy:           "testdata/casbin_policy.csv",
+			SubjectAttribute: "nickname",
+		},
+	}}).(*Jwt)
+	defer j.ShutdownGrace(context.Background())
+	assert.NoError(t, j.ValidateConfig())
+	// Wait for the initial fetch, the fetches are counted below
+	for {
+		j.jwks.mutex.RLock()
+		fetched := j.jwks.keys != nil
+		j.jwks.mutex.RUnlock()
+		if fetched {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	e := echo.New()
+	username := ""
+	h := j.Process(func(c echo.Context) error {
+		username = getJwtUsername(c)
+		return c.String(http.StatusOK, "OK")
+	})
+	claims := func(modify func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":      "https://accounts.labstack.com",
+			"aud":      "armor",
+			"sub":      "1234",
+			"email":    "jon@labstack.com",
+			"nickname": "jon",
+			"exp":      time.Now().Add(time.Hour).Unix(),
+		}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+	do := func(token string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		return rec, h(e.NewContext(req, rec))
+	}
+
+	// Valid
+	rec, err := do(signJwt(t, key, "1", claims(nil)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "jon@labstack.com", username)
+
+	// Invalid
+	for _, token := range []string{
+		"",
+		"invalid",
+		signJwt(t, key, "1", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.com" })),
+		signJwt(t, key, "1", claims(func(c map[string]interface{}) { c["aud"] = "other" })),
+		signJwt(t, key, "1", claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() })),
+		signJwt(t, key, "1", claims(func(c map[string]interface{}) { delete(c, "exp") })),
+		signJwt(t, jose.SigningKey{Algorithm: jose.HS256, Key: []byte("secret")}, "1", claims(nil)),
+	} {
+		rec, err := do(token)
+		assert.Equal(t, echo.ErrUnauthorized, err, token)
+		assert.Equal(t, "Bearer", rec.Header().Get(echo.HeaderWWWAuthenticate))
+	}
+
+	// Casbin
+	_, err = do(signJwt(t, key, "1", claims(func(c map[string]interface{}) { c["nickname"] = "joe" })))
+	assert.Equal(t, echo.ErrForbidden, err)
+
+	// Key rotation
+	mutex.Lock()
+	n := fetches
+	mutex.Unlock()
+	j.jwks.mutex.Lock()
+	j.jwks.fetched = time.Time{}
+	j.jwks.mutex.Unlock()
+	_, err = do(signJwt(t, addKey("2"), "2", claims(nil)))
+	assert.NoError(t, err)
+	mutex.Lock()
+	assert.Equal(t, n+1, fetches)
+	mutex.Unlock()
+
+	// Unknown keys refresh at most every jwksMinRefreshInterval
+	_, err = do(signJwt(t, addKey("3"), "3", claims(nil)))
+	assert.Equal(t, echo.ErrUnauthorized, err)
+	mutex.Lock()
+	assert.Equal(t, n+1, fetches)
+	mutex.Unlock()
+}
+
+func TestJwtSecret(t *testing.T) {
+	j := initialized(&Jwt{JwtConfig: JwtConfig{Secret: "secret"}}).(*Jwt)
+	assert.NoError(t, j.ValidateConfig())
+	e := echo.New()
+	h := j.Process(func(c echo.Context) error {
+		return c.String(http.StatusOK, getJwtUsername(c))
+	})
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	req.Header.Set(echo.HeaderAuthorization, "bearer "+signJwt(t, jose.SigningKey{Algorithm: jose.HS256, Key: []byte("secret")}, "", map[string]interface{}{
+		"sub": "jon",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}))
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, "jon", rec.Body.String())
+
+	assert.Error(t, (&Jwt{JwtConfig: JwtConfig{Secret: "secret", JWKSURL: "https://accounts.labstack.com/jwks"}}).ValidateConfig())
+	assert.Error(t, (&Jwt{}).ValidateConfig())
+}
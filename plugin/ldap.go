@@ -0,0 +1,416 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/go-ldap/ldap/v3"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/labstack/echo/v4"
+)
+
+// HTTP basic authentication against an LDAP or Active Directory server.
+
+type (
+	Ldap struct {
+		Base       `json:",squash" yaml:",squash"`
+		LdapConfig `json:",squash" yaml:",squash"`
+
+		cache     *lru.Cache
+		casbinMid *casbinMiddleware
+	}
+
+	LdapConfig struct {
+		// URL is the server, `ldap://host:389` or `ldaps://host:636`.
+		// StartTLS upgrades `ldap://` connections.
+		URL                string `yaml:"url"`
+		StartTLS           bool   `yaml:"start_tls"`
+		InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+
+		// BindDN and BindPassword search the users, anonymously if empty.
+		BindDN       string `yaml:"bind_dn"`
+		BindPassword string `yaml:"bind_password" armor:"probe,secret"`
+
+		// UserFilter finds the user below BaseDN, `%s` is the escaped
+		// username, default `(uid=%s)`, `(sAMAccountName=%s)` for Active
+		// Directory.
+		BaseDN     string `yaml:"base_dn"`
+		UserFilter string `yaml:"user_filter"`
+
+		// GroupAttribute lists the group DNs of a user, default `memberOf`.
+		// Their common names are the `groups` attribute.
+		GroupAttribute string `yaml:"group_attr"`
+
+		// Attributes are further user attributes kept, e.g. `mail`.
+		Attributes []string `yaml:"attributes"`
+
+		// CacheTTL keeps successful binds, by username and password, for the
+		// duration instead of binding on every request.
+		CacheTTL time.Duration `yaml:"cache_ttl"`
+
+		// Realm is sent in the basic auth challenge, default `armor`.
+		Realm string `yaml:"realm"`
+
+		// Timeout bounds connecting and each LDAP request, default 10s.
+		Timeout time.Duration `yaml:"timeout"`
+
+		// SkipPaths are requests passed without authentication, e.g.
+		// `/health` or `GET /public/*`.
+		SkipPaths []string `yaml:"skip_paths"`
+
+		// CasbinCfg authorizes the users, `subject_attr` is a user attribute.
+		// Policies for the user's groups, or the values of `role_attr`, apply
+		// too.
+		CasbinCfg CasbinConfig `yaml:"casbin"`
+	}
+
+	ldapUser struct {
+		username   string
+		attributes map[string][]string
+	}
+
+	ldapCacheEntry struct {
+		user    *ldapUser
+		expires time.Time
+	}
+
+	ldapCtxKey int
+)
+
+const (
+	LdapUsernameCtxKey ldapCtxKey = iota
+	LdapAttributesCtxKey
+)
+
+const (
+	ldapHeaderPrefix = "X-Ldap-"
+
+	// ldapGroupsAttribute holds the common names of the user's groups.
+	ldapGroupsAttribute = "groups"
+
+	ldapCacheSize = 10000
+)
+
+var errLdapInvalidCredentials = errors.New("invalid credentials")
+
+func (c LdapConfig) userFilter() string {
+	if c.UserFilter == "" {
+		return "(uid=%s)"
+	}
+	return c.UserFilter
+}
+
+func (c LdapConfig) groupAttribute() string {
+	if c.GroupAttribute == "" {
+		return "memberOf"
+	}
+	return c.GroupAttribute
+}
+
+func (c LdapConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return c.Timeout
+}
+
+func (c LdapConfig) realm() string {
+	if c.Realm == "" {
+		return "armor"
+	}
+	return c.Realm
+}
+
+func (l *Ldap) Initialize() {
+	l.cache, l.casbinMid = nil, nil
+	if l.CacheTTL > 0 {
+		l.cache, _ = lru.New(ldapCacheSize)
+	}
+	authz := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return next
+	}
+	if l.CasbinCfg.Model != "" {
+		casbinMid, err := newSubjectCasbinMiddleware(l.CasbinCfg, ldapAttrGetter(l.CasbinCfg.SubjectAttribute))
+		if err != nil {
+			if l.Logger != nil {
+				l.Logger.Errorf("ldap: invalid casbin config: %v", err)
+			}
+			l.Middleware = internalErrorMid
+			return
+		}
+		roles := ldapGroupsAttribute
+		if l.CasbinCfg.RoleAttribute != "" {
+			roles = l.CasbinCfg.RoleAttribute
+		}
+		casbinMid.RolesFunc = func(c echo.Context) []string {
+			attrs, _ := c.Request().Context().Value(LdapAttributesCtxKey).(map[string][]string)
+			return attrs[roles]
+		}
+		l.casbinMid, authz = casbinMid, casbinMid.MiddlewareFunc()
+	}
+	config, cache := l.LdapConfig, l.cache
+	l.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := authz(next)
+		return func(c echo.Context) error {
+			username, password, ok := c.Request().BasicAuth()
+			// An empty password is an unauthenticated bind, which succeeds
+			if !ok || username == "" || password == "" {
+				return ldapUnauthorized(c, config)
+			}
+			user, err := authenticateLdap(config, cache, username, password)
+			if err == errLdapInvalidCredentials {
+				return ldapUnauthorized(c, config)
+			} else if err != nil {
+				c.Logger().Errorf("ldap: %v", err)
+				return echo.ErrServiceUnavailable
+			}
+			setLdapUser(c, user.username, user.attributes)
+			return h(c)
+		}
+	}
+}
+
+func ldapUnauthorized(c echo.Context, config LdapConfig) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, fmt.Sprintf("Basic realm=%q", config.realm()))
+	return echo.ErrUnauthorized
+}
+
+func ldapCacheKey(username, password string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(username + "\x00" + password))
+}
+
+// authenticateLdap binds as the user, successful binds are cached.
+func authenticateLdap(config LdapConfig, cache *lru.Cache, username, password string) (*ldapUser, error) {
+	key := ldapCacheKey(username, password)
+	if cache != nil {
+		if v, ok := cache.Get(key); ok {
+			if e := v.(ldapCacheEntry); time.Now().Before(e.expires) {
+				return e.user, nil
+			}
+			cache.Remove(key)
+		}
+	}
+	user, err := bindLdap(config, username, password)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		cache.Add(key, ldapCacheEntry{user: user, expires: time.Now().Add(config.CacheTTL)})
+	}
+	return user, nil
+}
+
+// dialLdap connects to the server and binds as the search user.
+func dialLdap(config LdapConfig) (*ldap.Conn, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	dialer := &net.Dialer{Timeout: config.timeout()}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", ldapHost(u, "389"))
+	case "ldaps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", ldapHost(u, "636"), tlsConfig)
+	default:
+		return nil, fmt.Errorf("invalid ldap url=%s", config.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := ldap.NewConn(conn, u.Scheme == "ldaps")
+	l.Start()
+	l.SetTimeout(config.timeout())
+	if config.StartTLS && u.Scheme == "ldap" {
+		if err := l.StartTLS(tlsConfig); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if config.BindDN != "" {
+		if err := l.Bind(config.BindDN, config.BindPassword); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to bind dn=%s: %v", config.BindDN, err)
+		}
+	}
+	return l, nil
+}
+
+func ldapHost(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// bindLdap finds the user and checks the password with a bind as the user.
+func bindLdap(config LdapConfig, username, password string) (*ldapUser, error) {
+	l, err := dialLdap(config)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	attrs := append([]string{config.groupAttribute()}, config.Attributes...)
+	res, err := l.Search(ldap.NewSearchRequest(
+		config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(config.timeout().Seconds()), false,
+		fmt.Sprintf(config.userFilter(), ldap.EscapeFilter(username)), attrs, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) != 1 {
+		return nil, errLdapInvalidCredentials
+	}
+	entry := res.Entries[0]
+	if err := l.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, errLdapInvalidCredentials
+		}
+		return nil, err
+	}
+	user := &ldapUser{username: username, attributes: map[string][]string{}}
+	for _, a := range attrs {
+		if v := entry.GetAttributeValues(a); len(v) > 0 {
+			user.attributes[a] = v
+		}
+	}
+	for _, g := range entry.GetAttributeValues(config.groupAttribute()) {
+		dn, err := ldap.ParseDN(g)
+		if err != nil || len(dn.RDNs) == 0 {
+			continue
+		}
+		for _, a := range dn.RDNs[0].Attributes {
+			if strings.EqualFold(a.Type, "cn") {
+				user.attributes[ldapGroupsAttribute] = append(user.attributes[ldapGroupsAttribute], a.Value)
+			}
+		}
+	}
+	return user, nil
+}
+
+func (l *Ldap) Update(p Plugin) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.LdapConfig = p.(*Ldap).LdapConfig
+	l.Initialize()
+}
+
+func (*Ldap) Priority() int {
+	return -1
+}
+
+func (l *Ldap) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return skipPaths(l.SkipPaths, next, l.Middleware(next))
+}
+
+func (l *Ldap) ValidateConfig() error {
+	u, err := url.Parse(l.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return fmt.Errorf("invalid ldap url=%s", l.URL)
+	}
+	if strings.Count(l.userFilter(), "%s") != 1 {
+		return fmt.Errorf("invalid ldap user filter=%s", l.UserFilter)
+	}
+	if err := validatePathRules(l.SkipPaths); err != nil {
+		return err
+	}
+	if l.CasbinCfg.Model != "" {
+		if _, err := l.CasbinCfg.Enforcer(); err != nil {
+			return fmt.Errorf("invalid casbin config: %v", err)
+		}
+	}
+	return nil
+}
+
+func (*Ldap) DefaultConfig() interface{} {
+	return LdapConfig{
+		URL:      "ldap://ldap.example.com",
+		StartTLS: true,
+		BaseDN:   "dc=example,dc=com",
+		CacheTTL: 5 * time.Minute,
+	}
+}
+
+func (l *Ldap) ProbeConfig(probe ProbeFunc) error {
+	return ProbeConfig(&l.LdapConfig, probe)
+}
+
+func (*Ldap) OpenAPITag() *openapi3.Tag {
+	return &openapi3.Tag{
+		Name:        "LDAP",
+		Description: "Authenticated by basic auth against LDAP",
+	}
+}
+
+func (*Ldap) OpenAPISecurityScheme() *openapi3.SecurityScheme {
+	return &openapi3.SecurityScheme{
+		Type:   "http",
+		Scheme: "basic",
+	}
+}
+
+// Reload loads the casbin model and policy again, if configured.
+func (l *Ldap) Reload() error {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if l.casbinMid == nil {
+		return nil
+	}
+	return l.casbinMid.Reload()
+}
+
+// setLdapUser stores the LDAP user on the echo and request contexts and in
+// the upstream request headers, as X-LDAP-User and X-LDAP-Attr-*.
+func setLdapUser(c echo.Context, username string, attrs map[string][]string) {
+	r := c.Request()
+	c.Set("ldapAttributes", attrs)
+	c.Set("ldapUsername", username)
+	newCtx := context.WithValue(r.Context(), LdapUsernameCtxKey, username)
+	newCtx = context.WithValue(newCtx, LdapAttributesCtxKey, attrs)
+
+	// Drop headers sent by the client
+	for k := range r.Header {
+		if strings.HasPrefix(k, ldapHeaderPrefix) {
+			r.Header.Del(k)
+		}
+	}
+	r.Header.Set("X-LDAP-User", username)
+	for k, v := range attrs {
+		r.Header.Set("X-LDAP-Attr-"+k, strings.Join(v, " "))
+	}
+	c.SetRequest(r.WithContext(newCtx))
+}
+
+func getLdapUsername(c echo.Context) string {
+	username, _ := c.Request().Context().Value(LdapUsernameCtxKey).(string)
+	return username
+}
+
+// ldapAttrGetter returns the casbin subject, the username or the attribute.
+func ldapAttrGetter(attr string) func(c echo.Context) string {
+	if attr == "" {
+		return getLdapUsername
+	}
+	return func(c echo.Context) string {
+		attrs, _ := c.Request().Context().Value(LdapAttributesCtxKey).(map[string][]string)
+		if v := attrs[attr]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+}
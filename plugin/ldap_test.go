@@ -0,0 +1,206 @@
+package plugin
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type ldapTestEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+var ldapTestUIDFilter = regexp.MustCompile(`\(uid=([^)]*)\)`)
+
+// newLdapServer serves simple binds and uid searches of entries, keyed by
+// uid, after a bind as cn=armor,dc=labstack,dc=com. It counts the binds.
+func newLdapServer(t *testing.T, entries map[string]ldapTestEntry) (net.Listener, *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binds := new(int32)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveLdap(conn, entries, binds)
+		}
+	}()
+	return ln, binds
+}
+
+func serveLdap(conn net.Conn, entries map[string]ldapTestEntry, binds *int32) {
+	defer conn.Close()
+	bound := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, op := packet.Children[0].Value.(int64), packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			atomic.AddInt32(binds, 1)
+			dn, password := op.Children[1].Value.(string), op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if dn == "cn=armor,dc=labstack,dc=com" && password == "secret" {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, e := range entries {
+				if e.dn == dn && e.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			if code == ldap.LDAPResultSuccess {
+				bound = dn
+			}
+			conn.Write(ldapResponse(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			if bound != "cn=armor,dc=labstack,dc=com" {
+				conn.Write(ldapResponse(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights).Bytes())
+				continue
+			}
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			if m := ldapTestUIDFilter.FindStringSubmatch(filter); m != nil {
+				if e, ok := entries[m[1]]; ok {
+					conn.Write(ldapSearchEntry(id, e).Bytes())
+				}
+			}
+			conn.Write(ldapResponse(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	return p
+}
+
+func ldapResponse(id int64, tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return ldapMessage(id, op)
+}
+
+func ldapSearchEntry(id int64, e ldapTestEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for k, v := range e.attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, k, ""))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, s := range v {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, s, ""))
+		}
+		attr.AppendChild(values)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return ldapMessage(id, op)
+}
+
+func TestLdap(t *testing.T) {
+	ln, binds := newLdapServer(t, map[string]ldapTestEntry{
+		"jon": {
+			dn:       "uid=jon,ou=people,dc=labstack,dc=com",
+			password: "jon-secret",
+			attrs: map[string][]string{
+				"mail":     {"jon@labstack.com"},
+				"memberOf": {"cn=admin,ou=groups,dc=labstack,dc=com"},
+			},
+		},
+		"joe": {
+			dn:       "uid=joe,ou=people,dc=labstack,dc=com",
+			password: "joe-secret",
+			attrs: map[string][]string{
+				"memberOf": {"cn=dev,ou=groups,dc=labstack,dc=com"},
+			},
+		},
+	})
+	defer ln.Close()
+
+	l := validated(t, &Ldap{LdapConfig: LdapConfig{
+		URL:          "ldap://" + ln.Addr().String(),
+		BindDN:       "cn=armor,dc=labstack,dc=com",
+		BindPassword: "secret",
+		BaseDN:       "dc=labstack,dc=com",
+		Attributes:   []string{"mail"},
+		CacheTTL:     time.Minute,
+		CasbinCfg: CasbinConfig{
+			Model:      "testdata/casbin_model.conf",
+			Policy:     "testdata/casbin_role_policy.csv",
+			PathObject: true,
+		},
+	}}).(*Ldap)
+	e := echo.New()
+	var header http.Header
+	h := l.Process(func(c echo.Context) error {
+		header = c.Request().Header
+		return c.String(http.StatusOK, "OK")
+	})
+	do := func(username, password string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(echo.GET, "/users", nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		req.Header.Set("X-LDAP-Attr-Groups", "admin")
+		rec := httptest.NewRecorder()
+		return rec, h(e.NewContext(req, rec))
+	}
+
+	// Valid, authorized through the admin group
+	_, err := do("jon", "jon-secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "jon", header.Get("X-LDAP-User"))
+	assert.Equal(t, "jon@labstack.com", header.Get("X-LDAP-Attr-Mail"))
+	assert.Equal(t, "admin", header.Get("X-LDAP-Attr-Groups"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(binds))
+
+	// Cached
+	_, err = do("jon", "jon-secret")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(binds))
+
+	// Invalid
+	for _, c := range [][2]string{{"", ""}, {"jon", ""}, {"jon", "wrong"}, {"jim", "jon-secret"}, {"*", "jon-secret"}} {
+		rec, err := do(c[0], c[1])
+		assert.Equal(t, echo.ErrUnauthorized, err, c[0])
+		assert.Equal(t, `Basic realm="armor"`, rec.Header().Get(echo.HeaderWWWAuthenticate))
+	}
+
+	// Casbin
+	header = nil
+	_, err = do("joe", "joe-secret")
+	assert.Equal(t, echo.ErrForbidden, err)
+	assert.Nil(t, header)
+
+	// Unavailable
+	l.BindPassword = "wrong"
+	l.Initialize()
+	h = l.Process(func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	_, err = do("jon", "jon-secret")
+	assert.Equal(t, echo.ErrServiceUnavailable, err)
+}
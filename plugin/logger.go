@@ -1,7 +1,6 @@
 package plugin
 
 import (
-	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
@@ -22,9 +21,3 @@ func (l *Logger) Update(p Plugin) {
 	l.LoggerConfig = p.(*Logger).LoggerConfig
 	l.Initialize()
 }
-
-func (l *Logger) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	l.mutex.RLock()
-	defer l.mutex.RUnlock()
-	return l.Middleware(next)
-}
@@ -0,0 +1,212 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+)
+
+// Maintenance mode, a 503 with Retry-After for all requests but the ones of
+// the allowed clients and users, enabled by the config or the admin API.
+
+type (
+	Maintenance struct {
+		Base              `json:",squash" yaml:",squash"`
+		MaintenanceConfig `json:",squash" yaml:",squash"`
+
+		// override is the mode set by the admin API, kept on updates unless
+		// Enabled changes.
+		override int32
+	}
+
+	MaintenanceConfig struct {
+		Enabled bool `yaml:"enabled"`
+
+		// Page is a Go html template file of the response, with the data
+		// MaintenancePageData. Without, the error pages apply.
+		Page string `yaml:"page"`
+
+		// Message of the response, default `Service under maintenance`.
+		Message string `yaml:"message"`
+
+		// RetryAfter is the Retry-After header, default 5m.
+		RetryAfter time.Duration `yaml:"retry_after"`
+
+		// Allow are the clients, CIDRs or IPs, and AllowUsers the users of the
+		// auth plugins, e.g. the CAS usernames, served as usual.
+		Allow      []string `yaml:"allow"`
+		AllowUsers []string `yaml:"allow_users"`
+
+		// TrustedProxies are the proxies the client IP is read from
+		// X-Forwarded-For of, as in the ip-filter plugin.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+
+		// SkipPaths are requests always served, e.g. `/health`.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// MaintenancePageData is the data of the maintenance page template.
+	MaintenancePageData struct {
+		Message string
+		// RetryAfter in seconds
+		RetryAfter int
+		Host       string
+		Path       string
+		RequestID  string
+	}
+)
+
+const (
+	maintenanceConfig int32 = iota
+	maintenanceOn
+	maintenanceOff
+)
+
+func (c MaintenanceConfig) message() string {
+	if c.Message == "" {
+		return "Service under maintenance"
+	}
+	return c.Message
+}
+
+func (c MaintenanceConfig) retryAfter() int {
+	if c.RetryAfter == 0 {
+		return 300
+	}
+	return int(c.RetryAfter / time.Second)
+}
+
+// SetMaintenance enables or disables the maintenance mode until Enabled
+// changes.
+func (m *Maintenance) SetMaintenance(enabled bool) {
+	mode := maintenanceOff
+	if enabled {
+		mode = maintenanceOn
+	}
+	atomic.StoreInt32(&m.override, mode)
+}
+
+// InMaintenance reports whether the maintenance mode is enabled.
+func (m *Maintenance) InMaintenance() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.enabled(m.Enabled)
+}
+
+// enabled returns the mode set by the admin API, configured otherwise.
+func (m *Maintenance) enabled(configured bool) bool {
+	switch atomic.LoadInt32(&m.override) {
+	case maintenanceOn:
+		return true
+	case maintenanceOff:
+		return false
+	}
+	return configured
+}
+
+func (m *Maintenance) ValidateConfig() error {
+	if _, err := util.ParseIPNets(m.Allow); err != nil {
+		return err
+	}
+	if _, err := util.ParseIPNets(m.TrustedProxies); err != nil {
+		return err
+	}
+	if m.RetryAfter < 0 {
+		return errors.New("invalid maintenance retry after")
+	}
+	if m.Page != "" {
+		if _, err := template.ParseFiles(m.Page); err != nil {
+			return fmt.Errorf("invalid maintenance page=%s, %v", m.Page, err)
+		}
+	}
+	return validatePathRules(m.SkipPaths)
+}
+
+func (m *Maintenance) Initialize() {
+	fail := func(err error) {
+		if m.Logger != nil {
+			m.Logger.Errorf("maintenance: %v", err)
+		}
+		m.Middleware = internalErrorMid
+	}
+	allow, err := util.ParseIPNets(m.Allow)
+	if err != nil {
+		fail(err)
+		return
+	}
+	trusted, err := util.ParseIPNets(m.TrustedProxies)
+	if err != nil {
+		fail(err)
+		return
+	}
+	var page *template.Template
+	if m.Page != "" {
+		if page, err = template.ParseFiles(m.Page); err != nil {
+			fail(err)
+			return
+		}
+	}
+	users := make(map[string]bool, len(m.AllowUsers))
+	for _, u := range m.AllowUsers {
+		users[u] = true
+	}
+	pageFile, configured, message, retryAfter := m.Page, m.Enabled, m.message(), m.retryAfter()
+	m.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !m.enabled(configured) {
+				return next(c)
+			}
+			if ip := clientIP(c.Request(), trusted); ip != nil && allow.Contains(ip) {
+				return next(c)
+			}
+			if sub := AuthSubject(c); sub != "" && users[sub] {
+				return next(c)
+			}
+			header := c.Response().Header()
+			header.Set("Retry-After", strconv.Itoa(retryAfter))
+			header.Set("Cache-Control", "no-store")
+			if page == nil {
+				return echo.NewHTTPError(http.StatusServiceUnavailable, message)
+			}
+			r := c.Request()
+			buf := new(bytes.Buffer)
+			if err := page.Execute(buf, &MaintenancePageData{
+				Message:    message,
+				RetryAfter: retryAfter,
+				Host:       r.Host,
+				Path:       r.URL.Path,
+				RequestID:  GetRequestID(c),
+			}); err != nil {
+				c.Logger().Errorf("maintenance: failed to render page=%s, %v", pageFile, err)
+				return echo.NewHTTPError(http.StatusServiceUnavailable, message)
+			}
+			return c.HTMLBlob(http.StatusServiceUnavailable, buf.Bytes())
+		}
+	}
+}
+
+func (m *Maintenance) Update(p Plugin) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	config := p.(*Maintenance).MaintenanceConfig
+	if config.Enabled != m.Enabled {
+		// The config is the latest intent
+		atomic.StoreInt32(&m.override, maintenanceConfig)
+	}
+	m.MaintenanceConfig = config
+	m.Initialize()
+}
+
+func (m *Maintenance) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return skipPaths(m.SkipPaths, next, m.Middleware(next))
+}
@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	page := filepath.Join(dir, "maintenance.html")
+	assert.NoError(t, ioutil.WriteFile(page, []byte("{{.Message}} on {{.Host}}, retry in {{.RetryAfter}}s"), 0644))
+
+	e := echo.New()
+	m := Decode(RawPlugin{
+		"name":        PluginMaintenance,
+		"order":       1,
+		"enabled":     true,
+		"message":     "Back soon",
+		"retry_after": "10m",
+		"allow":       []interface{}{"10.0.0.0/8"},
+		"allow_users": []interface{}{"ops"},
+		"skip_paths":  []interface{}{"/health"},
+	}, e, nil).(*Maintenance)
+	assert.NoError(t, m.ValidateConfig())
+	m.Initialize()
+	do := func(path, ip, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.GET, path, nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if user != "" {
+			c.Set("casUsername", user)
+		}
+		if err := m.Process(func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		})(c); err != nil {
+			e.DefaultHTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+
+	rec := do("/", "192.0.2.1", "jon")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "600", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), "Back soon")
+	assert.Equal(t, http.StatusOK, do("/", "10.1.2.3", "").Code)
+	assert.Equal(t, http.StatusOK, do("/", "192.0.2.1", "ops").Code)
+	assert.Equal(t, http.StatusOK, do("/health", "192.0.2.1", "").Code)
+
+	// Page
+	up := Decode(RawPlugin{"name": PluginMaintenance, "order": 1, "enabled": true, "page": page}, e, nil).(*Maintenance)
+	m.Update(up)
+	rec = do("/", "192.0.2.1", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "Service under maintenance on example.com, retry in 300s", rec.Body.String())
+
+	// Toggled, until enabled changes
+	m.SetMaintenance(false)
+	assert.False(t, m.InMaintenance())
+	assert.Equal(t, http.StatusOK, do("/", "192.0.2.1", "").Code)
+	m.Update(up)
+	assert.False(t, m.InMaintenance())
+	m.Update(Decode(RawPlugin{"name": PluginMaintenance, "order": 1}, e, nil).(*Maintenance))
+	m.SetMaintenance(true)
+	m.Update(up)
+	assert.True(t, m.InMaintenance())
+	m.Update(Decode(RawPlugin{"name": PluginMaintenance, "order": 1}, e, nil).(*Maintenance))
+	assert.False(t, m.InMaintenance())
+
+	// Invalid
+	assert.Error(t, (&Maintenance{MaintenanceConfig: MaintenanceConfig{Allow: []string{"invalid"}}}).ValidateConfig())
+	assert.Error(t, (&Maintenance{MaintenanceConfig: MaintenanceConfig{Page: filepath.Join(dir, "missing.html")}}).ValidateConfig())
+}
@@ -0,0 +1,57 @@
+package plugin
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	proxyRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "armor_proxy_requests_total",
+		Help: "Number of requests proxied by target and status class, `error` if the target is unreachable.",
+	}, []string{"target", "code"})
+	proxyRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "armor_proxy_request_duration_seconds",
+		Help:    "Duration until the response headers of the targets.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"target"})
+	proxyMirrored = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "armor_proxy_mirrored_requests_total",
+		Help: "Number of mirrored requests by status class of the shadow upstream, `error`, `dropped` or `skipped`.",
+	}, []string{"code"})
+	casValidationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "armor_cas_validation_failures_total",
+		Help: "Number of CAS service tickets failing validation.",
+	})
+	casbinDenied = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "armor_casbin_denied_total",
+		Help: "Number of requests denied by the casbin policy.",
+	})
+	opaDenied = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "armor_opa_denied_total",
+		Help: "Number of requests denied by the OPA policy.",
+	})
+	ipFilterDenied = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "armor_ip_filter_denied_total",
+		Help: "Number of requests denied by the ip-filter plugin.",
+	})
+	extAuthzChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "armor_ext_authz_checks_total",
+		Help: "Number of ext-authz checks by result, `allow`, `deny` or `error`.",
+	}, []string{"result"})
+	auditDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "armor_audit_dropped_total",
+		Help: "Number of audit events dropped, the queue full or failing to write or send.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(proxyRequests, proxyRequestDuration, proxyMirrored, casValidationFailures, casbinDenied, opaDenied, ipFilterDenied,
+		extAuthzChecks, auditDropped)
+}
+
+// StatusClass returns the class of status, e.g. `2xx`.
+func StatusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
@@ -0,0 +1,49 @@
+package plugin
+
+import (
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// middlewarePlugin is a plugin of an `echo.MiddlewareFunc`, see Middleware.
+	middlewarePlugin struct {
+		Base
+	}
+)
+
+// Middleware returns a decorator which turns an `echo.MiddlewareFunc` into a
+// plugin with the given name and order, e.g.
+// `plugin.Middleware("cors", 10)(middleware.CORS())`. Like the built-in
+// plugins of a single middleware, it is processed by `Base`.
+func Middleware(name string, order int) func(echo.MiddlewareFunc) Plugin {
+	return func(mf echo.MiddlewareFunc) Plugin {
+		return &middlewarePlugin{Base{
+			name:       name,
+			order:      order,
+			mutex:      new(sync.RWMutex),
+			Middleware: mf,
+		}}
+	}
+}
+
+func (*middlewarePlugin) Initialize() {
+}
+
+// Update replaces the middleware function with the one of p.
+func (m *middlewarePlugin) Update(p Plugin) {
+	if u, ok := p.(*middlewarePlugin); ok {
+		u.mutex.RLock()
+		mf := u.Middleware
+		u.mutex.RUnlock()
+		m.mutex.Lock()
+		m.Middleware = mf
+		m.mutex.Unlock()
+	}
+}
+
+// NeedsUpdate is always true, the middleware functions are not compared.
+func (*middlewarePlugin) NeedsUpdate(interface{}) bool {
+	return true
+}
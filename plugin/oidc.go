@@ -0,0 +1,330 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
+)
+
+// OpenID Connect authentication with the authorization code flow.
+
+type (
+	Oidc struct {
+		Base       `json:",squash" yaml:",squash"`
+		OidcConfig `json:",squash" yaml:",squash"`
+
+		providerMutex sync.Mutex
+		provider      *oidcProvider
+	}
+
+	// OidcConfig configures the OpenID provider, e.g. Keycloak, Okta or
+	// Google, and the client registered with it.
+	OidcConfig struct {
+		// Issuer is the provider URL, its configuration is discovered from
+		// `/.well-known/openid-configuration`.
+		Issuer       string `yaml:"issuer"`
+		ClientID     string `yaml:"client_id"`
+		ClientSecret string `yaml:"client_secret" armor:"probe,secret"`
+
+		// RedirectURL is the registered redirect URI, requests to its path
+		// complete the login.
+		RedirectURL string `yaml:"redirect_url"`
+
+		// Scopes requested in addition to `openid`, default `profile` and
+		// `email`.
+		Scopes []string `yaml:"scopes"`
+
+		// UsernameClaim is the ID token claim used as the username, default
+		// `sub`.
+		UsernameClaim string `yaml:"username_claim"`
+
+		// SkipPaths are requests passed without authentication, e.g.
+		// `/health` or `GET /public/*`.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// oidcProvider is the discovered provider, discovery is retried until
+	// it succeeds so armor starts while the provider is down.
+	oidcProvider struct {
+		oauth2   oauth2.Config
+		verifier *oidc.IDTokenVerifier
+	}
+
+	oidcCtxKey int
+)
+
+const (
+	OidcUsernameCtxKey oidcCtxKey = iota
+	OidcClaimsCtxKey
+)
+
+const (
+	// oidcSessionCookie keeps the ID token, sessions last until it expires.
+	oidcSessionCookie = "_oidc_session"
+
+	// oidcStateCookie keeps the state, nonce and requested path during the
+	// login.
+	oidcStateCookie = "_oidc_state"
+
+	oidcHeaderPrefix = "X-Oidc-"
+)
+
+func (o *Oidc) Initialize() {
+	o.providerMutex.Lock()
+	o.provider = nil
+	o.providerMutex.Unlock()
+}
+
+func (o *Oidc) Update(p Plugin) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.OidcConfig = p.(*Oidc).OidcConfig
+	o.Initialize()
+}
+
+func (*Oidc) Priority() int {
+	return -1
+}
+
+func (o *Oidc) ValidateConfig() error {
+	if u, err := url.Parse(o.Issuer); err != nil || !u.IsAbs() {
+		return fmt.Errorf("invalid oidc issuer=%s", o.Issuer)
+	}
+	if u, err := url.Parse(o.RedirectURL); err != nil || !u.IsAbs() {
+		return fmt.Errorf("invalid oidc redirect url=%s", o.RedirectURL)
+	}
+	if o.ClientID == "" {
+		return errors.New("oidc client id is required")
+	}
+	return validatePathRules(o.SkipPaths)
+}
+
+func (*Oidc) DefaultConfig() interface{} {
+	return OidcConfig{
+		Issuer:      "https://accounts.example.com",
+		ClientID:    "armor",
+		RedirectURL: "https://www.example.com/oidc/callback",
+	}
+}
+
+func (o *Oidc) ProbeConfig(probe ProbeFunc) error {
+	return ProbeConfig(&o.OidcConfig, probe)
+}
+
+// discover returns the provider, discovering it on first use.
+func (o *Oidc) discover(ctx context.Context, config OidcConfig) (*oidcProvider, error) {
+	o.providerMutex.Lock()
+	defer o.providerMutex.Unlock()
+	if o.provider != nil {
+		return o.provider, nil
+	}
+	p, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"profile", "email"}
+	}
+	o.provider = &oidcProvider{
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     p.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		},
+		verifier: p.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}
+	return o.provider, nil
+}
+
+func (o *Oidc) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	config := o.OidcConfig
+	callback := ""
+	secure := false
+	if u, err := url.Parse(config.RedirectURL); err == nil {
+		callback, secure = u.Path, u.Scheme == "https"
+	}
+	return skipPaths(config.SkipPaths, next, func(c echo.Context) error {
+		r := c.Request()
+		p, err := o.discover(r.Context(), config)
+		if err != nil {
+			c.Logger().Errorf("oidc: failed to discover the provider: %v", err)
+			return echo.ErrServiceUnavailable
+		}
+		if r.URL.Path == callback {
+			return oidcCallback(c, p, secure)
+		}
+		if cookie, err := r.Cookie(oidcSessionCookie); err == nil {
+			if token, err := p.verifier.Verify(r.Context(), cookie.Value); err == nil {
+				claims := map[string]interface{}{}
+				if err := token.Claims(&claims); err != nil {
+					return err
+				}
+				setOidcUser(c, oidcUsername(config, token, claims), claims)
+				return next(c)
+			}
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead || c.IsWebSocket() {
+			return echo.ErrUnauthorized
+		}
+		return oidcLogin(c, p, secure)
+	})
+}
+
+// oidcLogin redirects to the provider, the state cookie brings the user back
+// to the requested path.
+func oidcLogin(c echo.Context, p *oidcProvider, secure bool) error {
+	state, nonce := oidcRandom(), oidcRandom()
+	v := url.Values{"state": {state}, "nonce": {nonce}, "path": {c.Request().URL.RequestURI()}}
+	http.SetCookie(c.Response(), &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(v.Encode())),
+		Path:     "/",
+		MaxAge:   600,
+		Secure:   secure,
+		HttpOnly: true,
+	})
+	return c.Redirect(http.StatusFound, p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce)))
+}
+
+// oidcCallback validates the authorization response and exchanges the code
+// for the ID token kept in the session cookie.
+func oidcCallback(c echo.Context, p *oidcProvider, secure bool) error {
+	r := c.Request()
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing oidc state")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid oidc state")
+	}
+	v, err := url.ParseQuery(string(b))
+	if err != nil || v.Get("state") == "" || v.Get("state") != r.URL.Query().Get("state") {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid oidc state")
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, fmt.Sprintf("oidc error=%s", e))
+	}
+	token, err := p.oauth2.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		c.Logger().Warnf("oidc: failed to exchange the code: %v", err)
+		return echo.ErrUnauthorized
+	}
+	raw, _ := token.Extra("id_token").(string)
+	idToken, err := p.verifier.Verify(r.Context(), raw)
+	if err != nil {
+		c.Logger().Warnf("oidc: invalid id token: %v", err)
+		return echo.ErrUnauthorized
+	}
+	if idToken.Nonce != v.Get("nonce") {
+		return echo.ErrUnauthorized
+	}
+	http.SetCookie(c.Response(), &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   secure,
+		HttpOnly: true,
+	})
+	http.SetCookie(c.Response(), &http.Cookie{
+		Name:     oidcSessionCookie,
+		Value:    raw,
+		Path:     "/",
+		Expires:  idToken.Expiry,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// Only redirect to a local path
+	path := v.Get("path")
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") {
+		path = "/"
+	}
+	return c.Redirect(http.StatusFound, path)
+}
+
+func oidcRandom() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func oidcUsername(config OidcConfig, token *oidc.IDToken, claims map[string]interface{}) string {
+	if config.UsernameClaim == "" || config.UsernameClaim == "sub" {
+		return token.Subject
+	}
+	s, _ := claims[config.UsernameClaim].(string)
+	return s
+}
+
+// setOidcUser stores the OIDC user on the echo and request contexts and in
+// the upstream request headers, as X-OIDC-User and X-OIDC-Claim-*.
+func setOidcUser(c echo.Context, username string, claims map[string]interface{}) {
+	r := c.Request()
+	c.Set("oidcClaims", claims)
+	c.Set("oidcUsername", username)
+	newCtx := context.WithValue(r.Context(), OidcUsernameCtxKey, username)
+	newCtx = context.WithValue(newCtx, OidcClaimsCtxKey, claims)
+
+	// Drop headers sent by the client
+	for k := range r.Header {
+		if strings.HasPrefix(k, oidcHeaderPrefix) {
+			r.Header.Del(k)
+		}
+	}
+	r.Header.Set("X-OIDC-User", username)
+	for k, v := range claims {
+		if s, ok := claimString(v); ok {
+			r.Header.Set("X-OIDC-Claim-"+k, s)
+		}
+	}
+	c.SetRequest(r.WithContext(newCtx))
+}
+
+// claimString formats scalar claims and lists of scalars, space separated
+// like CAS attributes.
+func claimString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case []interface{}:
+		s := make([]string, 0, len(v))
+		for _, e := range v {
+			es, ok := claimString(e)
+			if !ok {
+				return "", false
+			}
+			s = append(s, es)
+		}
+		return strings.Join(s, " "), true
+	}
+	return "", false
+}
+
+// getOidcUsername returns the username set by the oidc plugin.
+func getOidcUsername(c echo.Context) string {
+	username, _ := c.Request().Context().Value(OidcUsernameCtxKey).(string)
+	return username
+}
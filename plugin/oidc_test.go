@@ -0,0 +1,187 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// newOidcServer starts an OpenID provider issuing ID tokens with the given
+// claims for any code, the nonce of the last authorization request is
+// included.
+func newOidcServer(t *testing.T, claims map[string]interface{}) *httptest.Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		s     *httptest.Server
+		mutex sync.Mutex
+		nonce string
+	)
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                 s.URL,
+				"authorization_endpoint": s.URL + "/auth",
+				"token_endpoint":         s.URL + "/token",
+				"jwks_uri":               s.URL + "/keys",
+			})
+		case "/keys":
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &key.PublicKey, KeyID: "1", Algorithm: "RS256", Use: "sig"},
+			}})
+		case "/auth":
+			mutex.Lock()
+			nonce = r.URL.Query().Get("nonce")
+			mutex.Unlock()
+		case "/token":
+			c := map[string]interface{}{
+				"iss":   s.URL,
+				"aud":   "armor",
+				"sub":   "1234",
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"iat":   time.Now().Unix(),
+				"nonce": nonce,
+			}
+			for k, v := range claims {
+				c[k] = v
+			}
+			b, _ := json.Marshal(c)
+			jws, err := signer.Sign(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, _ := jws.CompactSerialize()
+			w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "access",
+				"token_type":   "Bearer",
+				"id_token":     token,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return s
+}
+
+func TestOidc(t *testing.T) {
+	s := newOidcServer(t, map[string]interface{}{
+		"email":  "jon@labstack.com",
+		"groups": []string{"admin", "dev"},
+	})
+	defer s.Close()
+	o := validated(t, &Oidc{OidcConfig: OidcConfig{
+		Issuer:        s.URL,
+		ClientID:      "armor",
+		ClientSecret:  "secret",
+		RedirectURL:   "https://www.labstack.com/oidc/callback",
+		UsernameClaim: "email",
+	}}).(*Oidc)
+	e := echo.New()
+	var header http.Header
+	username := ""
+	h := o.Process(func(c echo.Context) error {
+		header, username = c.Request().Header, getOidcUsername(c)
+		return c.String(http.StatusOK, "OK")
+	})
+	cookies := func(rec *httptest.ResponseRecorder) map[string]*http.Cookie {
+		m := map[string]*http.Cookie{}
+		for _, c := range (&http.Response{Header: rec.Header()}).Cookies() {
+			m[c.Name] = c
+		}
+		return m
+	}
+
+	// Login
+	req := httptest.NewRequest(echo.GET, "/users?id=1", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusFound, rec.Code)
+	auth, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, s.URL+"/auth", auth.Scheme+"://"+auth.Host+auth.Path)
+	assert.Equal(t, "armor", auth.Query().Get("client_id"))
+	state := cookies(rec)[oidcStateCookie]
+	if !assert.NotNil(t, state) {
+		return
+	}
+	res, err := http.Get(auth.String())
+	if assert.NoError(t, err) {
+		res.Body.Close()
+	}
+
+	// Invalid state
+	req = httptest.NewRequest(echo.GET, "/oidc/callback?code=1&state=invalid", nil)
+	req.AddCookie(state)
+	err = h(e.NewContext(req, httptest.NewRecorder()))
+	if assert.IsType(t, &echo.HTTPError{}, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+
+	// Callback
+	req = httptest.NewRequest(echo.GET, "/oidc/callback?code=1&state="+auth.Query().Get("state"), nil)
+	req.AddCookie(state)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/users?id=1", rec.Header().Get(echo.HeaderLocation))
+	session := cookies(rec)[oidcSessionCookie]
+	if !assert.NotNil(t, session) {
+		return
+	}
+
+	// Session, spoofed headers are dropped
+	req = httptest.NewRequest(echo.GET, "/users", nil)
+	req.AddCookie(session)
+	req.Header.Set("X-OIDC-Claim-Role", "admin")
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "jon@labstack.com", username)
+	assert.Equal(t, "jon@labstack.com", header.Get("X-OIDC-User"))
+	assert.Equal(t, "1234", header.Get("X-OIDC-Claim-Sub"))
+	assert.Equal(t, "admin dev", header.Get("X-OIDC-Claim-Groups"))
+	assert.Empty(t, header.Get("X-OIDC-Claim-Role"))
+
+	// Invalid session
+	session.Value += "x"
+	req = httptest.NewRequest(echo.POST, "/users", nil)
+	req.AddCookie(session)
+	assert.Equal(t, echo.ErrUnauthorized, h(e.NewContext(req, httptest.NewRecorder())))
+}
+
+func TestClaimString(t *testing.T) {
+	for v, s := range map[interface{}]string{
+		"jon":        "jon",
+		float64(1e9): "1000000000",
+		1.5:          "1.5",
+		true:         "true",
+	} {
+		got, _ := claimString(v)
+		assert.Equal(t, s, got)
+	}
+	s, ok := claimString([]interface{}{"a", float64(1)})
+	assert.True(t, ok)
+	assert.Equal(t, "a 1", s)
+	_, ok = claimString(map[string]interface{}{})
+	assert.False(t, ok)
+}
@@ -0,0 +1,341 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"gopkg.in/cas.v2"
+)
+
+// Open Policy Agent authorization, an alternative to casbin evaluating Rego
+// policies of files or of a bundle server with the request as input.
+
+type (
+	// OPAConfig authorizes with the Rego policies of Policy, a file or
+	// directory, or of Bundle, the URL of a bundle, instead of casbin.
+	OPAConfig struct {
+		Policy string `yaml:"policy"`
+		Bundle string `yaml:"bundle"`
+
+		// Query is the decision, true to allow, default `data.armor.allow`.
+		Query string `yaml:"query"`
+
+		// Headers are the request headers of the input, default all but
+		// Cookie and Authorization.
+		Headers []string `yaml:"headers"`
+
+		// TrustedProxies are the proxies the `remote_ip` of the input is read
+		// from X-Forwarded-For of, as in the ip-filter plugin.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+
+		// PollInterval reloads the policies periodically, the bundle only
+		// when changed.
+		PollInterval time.Duration `yaml:"poll_interval"`
+
+		// DecisionCacheTTL enables caching of the decisions by input for the
+		// duration, at most DecisionCacheSize (default 1000) are kept.
+		DecisionCacheTTL  time.Duration `yaml:"decision_cache_ttl"`
+		DecisionCacheSize int           `yaml:"decision_cache_size"`
+	}
+
+	// opaInput is the input document of the policies.
+	opaInput struct {
+		Method     string              `json:"method"`
+		Path       string              `json:"path"`
+		Query      url.Values          `json:"query"`
+		Host       string              `json:"host"`
+		RemoteIP   string              `json:"remote_ip"`
+		Headers    map[string]string   `json:"headers"`
+		Subject    string              `json:"subject"`
+		Attributes map[string][]string `json:"attributes"`
+	}
+
+	opaMiddleware struct {
+		mutex sync.RWMutex
+		query *rego.PreparedEvalQuery
+		etag  string
+
+		cfg     OPAConfig
+		trusted util.IPNets
+		subject func(c echo.Context) string
+		cache   *enforceCache
+		logger  *log.Logger
+		done    chan struct{}
+		stopped chan struct{}
+		once    sync.Once
+	}
+)
+
+func (cfg OPAConfig) enabled() bool {
+	return cfg.Policy != "" || cfg.Bundle != ""
+}
+
+func (cfg OPAConfig) query() string {
+	if cfg.Query == "" {
+		return "data.armor.allow"
+	}
+	return cfg.Query
+}
+
+func (cfg OPAConfig) validate() error {
+	if cfg.Policy != "" && cfg.Bundle != "" {
+		return errors.New("opa requires either policy or bundle")
+	}
+	if _, err := util.ParseIPNets(cfg.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid opa trusted proxies: %v", err)
+	}
+	if cfg.Bundle != "" {
+		if u, err := url.Parse(cfg.Bundle); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid opa bundle url=%s", cfg.Bundle)
+		}
+	}
+	if cfg.Policy != "" {
+		if _, err := cfg.prepare(context.Background(), rego.Load([]string{cfg.Policy}, nil)); err != nil {
+			return fmt.Errorf("invalid opa policy: %v", err)
+		}
+	}
+	return nil
+}
+
+func (cfg OPAConfig) prepare(ctx context.Context, opts ...func(*rego.Rego)) (*rego.PreparedEvalQuery, error) {
+	q, err := rego.New(append(opts, rego.Query(cfg.query()))...).PrepareForEval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// load returns the query of the policy, or of the bundle unless its etag is
+// unchanged, nil then.
+func (cfg OPAConfig) load(ctx context.Context, etag string) (*rego.PreparedEvalQuery, string, error) {
+	if cfg.Policy != "" {
+		q, err := cfg.prepare(ctx, rego.Load([]string{cfg.Policy}, nil))
+		return q, "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, cfg.Bundle, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		return nil, etag, nil
+	case http.StatusOK:
+	default:
+		return nil, "", fmt.Errorf("opa bundle=%s, %s", cfg.Bundle, res.Status)
+	}
+	b, err := bundle.NewReader(res.Body).Read()
+	if err != nil {
+		return nil, "", err
+	}
+	opts := []func(*rego.Rego){rego.Store(inmem.NewFromObject(b.Data))}
+	for _, m := range b.Modules {
+		opts = append(opts, rego.ParsedModule(m.Parsed))
+	}
+	q, err := cfg.prepare(ctx, opts...)
+	return q, res.Header.Get("Etag"), err
+}
+
+// input returns the input document of the request of c, of the client IP
+// read from X-Forwarded-For of trusted proxies only.
+func (cfg OPAConfig) input(c echo.Context, sub string, trusted util.IPNets) *opaInput {
+	r := c.Request()
+	in := &opaInput{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Query:    r.URL.Query(),
+		Host:     r.Host,
+		RemoteIP: remoteIP(r, trusted),
+		Headers:  map[string]string{},
+		Subject:  sub,
+	}
+	if len(cfg.Headers) == 0 {
+		for k, v := range r.Header {
+			if k != "Cookie" && k != echo.HeaderAuthorization {
+				in.Headers[strings.ToLower(k)] = strings.Join(v, ",")
+			}
+		}
+	} else {
+		for _, k := range cfg.Headers {
+			if v := r.Header.Get(k); v != "" {
+				in.Headers[strings.ToLower(k)] = v
+			}
+		}
+	}
+	if attrs, ok := r.Context().Value(CasAttributesCtxKey).(cas.UserAttributes); ok {
+		in.Attributes = map[string][]string(attrs)
+	}
+	return in
+}
+
+func newOPAMiddleware(cfg OPAConfig, subject func(c echo.Context) string, logger *log.Logger) (*opaMiddleware, error) {
+	trusted, err := util.ParseIPNets(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	om := &opaMiddleware{
+		cfg:     cfg,
+		trusted: trusted,
+		subject: subject,
+		logger:  logger,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if cfg.DecisionCacheTTL > 0 {
+		om.cache = newEnforceCache(cfg.DecisionCacheSize, cfg.DecisionCacheTTL)
+	}
+	if err := om.Reload(); err != nil {
+		return nil, err
+	}
+	if cfg.PollInterval > 0 {
+		go om.poll()
+	} else {
+		close(om.stopped)
+	}
+	return om, nil
+}
+
+// Reload loads the policies again, on error the previous ones are kept.
+func (om *opaMiddleware) Reload() error {
+	om.mutex.RLock()
+	etag := om.etag
+	om.mutex.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	q, etag, err := om.cfg.load(ctx, etag)
+	if err != nil || q == nil {
+		return err
+	}
+	om.mutex.Lock()
+	om.query, om.etag = q, etag
+	om.mutex.Unlock()
+	om.InvalidateCache()
+	return nil
+}
+
+func (om *opaMiddleware) poll() {
+	defer close(om.stopped)
+	t := time.NewTicker(om.cfg.PollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := om.Reload(); err != nil && om.logger != nil {
+				om.logger.Errorf("opa: failed to reload the policy: %v", err)
+			}
+		case <-om.done:
+			return
+		}
+	}
+}
+
+func (om *opaMiddleware) stop(ctx context.Context) {
+	om.once.Do(func() {
+		close(om.done)
+	})
+	select {
+	case <-om.stopped:
+	case <-ctx.Done():
+	}
+}
+
+// InvalidateCache drops all cached decisions.
+func (om *opaMiddleware) InvalidateCache() {
+	if om.cache != nil {
+		om.cache.purge()
+	}
+}
+
+func (om *opaMiddleware) InvalidateUserCache(username string) int {
+	if om.cache == nil {
+		return 0
+	}
+	return om.cache.invalidate(username)
+}
+
+// allow evaluates the query of the policy with in.
+func (om *opaMiddleware) allow(ctx context.Context, in *opaInput) (bool, error) {
+	var key []string
+	if om.cache != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return false, err
+		}
+		key = []string{in.Subject, string(b)}
+		if allow, ok := om.cache.get(key); ok {
+			return allow, nil
+		}
+	}
+	om.mutex.RLock()
+	q := om.query
+	om.mutex.RUnlock()
+	rs, err := q.Eval(ctx, rego.EvalInput(in))
+	if err != nil {
+		return false, err
+	}
+	allow := len(rs) == 1 && len(rs[0].Expressions) == 1 && rs[0].Expressions[0].Value == true
+	if om.cache != nil {
+		// Don't cache a decision of a policy replaced meanwhile
+		om.mutex.RLock()
+		current := om.query
+		om.mutex.RUnlock()
+		if current == q {
+			om.cache.add(key, allow)
+		}
+	}
+	return allow, nil
+}
+
+func (om *opaMiddleware) MiddlewareFunc() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			sub := om.subject(c)
+			if sub == "" {
+				if anonymous, _ := c.Get(casAnonymousKey).(bool); anonymous {
+					return next(c)
+				}
+				return echo.ErrUnauthorized
+			}
+			start := time.Now()
+			allow, err := om.allow(c.Request().Context(), om.cfg.input(c, sub, om.trusted))
+			d := authDecision{plugin: "opa", subject: sub, policy: om.cfg.query(), latency: time.Since(start)}
+			if err != nil {
+				d.decision = decisionError
+				recordDecision(c, d)
+				c.Logger().Errorf("opa: %v", err)
+				return echo.ErrForbidden
+			}
+			if allow {
+				d.decision = decisionAllow
+				recordDecision(c, d)
+				c.Set(casbinDecisionKey, "allow")
+				return next(c)
+			}
+			d.decision = decisionDeny
+			recordDecision(c, d)
+			c.Set(casbinDecisionKey, "deny")
+			opaDenied.Inc()
+			return echo.ErrForbidden
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cas.v2"
+)
+
+const opaTestPolicy = `package armor
+
+default allow = false
+
+allow {
+	input.method == "GET"
+	startswith(input.path, "/docs")
+}
+
+allow {
+	input.attributes.memberOf[_] == data.admins
+}
+`
+
+func opaServe(om *opaMiddleware, path string, groups ...string) int {
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, path, nil)
+	if groups != nil {
+		req = req.WithContext(context.WithValue(req.Context(), CasAttributesCtxKey, cas.UserAttributes{"memberOf": groups}))
+	}
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	err := om.MiddlewareFunc()(func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})(c)
+	if he, ok := err.(*echo.HTTPError); ok {
+		return he.Code
+	}
+	return rec.Code
+}
+
+func TestOPAPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "armor.rego"), []byte(opaTestPolicy), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "data.json"), []byte(`{"admins": "admin"}`), 0644))
+
+	cfg := OPAConfig{Policy: dir, DecisionCacheTTL: 60e9}
+	assert.NoError(t, cfg.validate())
+	om, err := newOPAMiddleware(cfg, func(c echo.Context) string { return "jon" }, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer om.stop(context.Background())
+	assert.Equal(t, http.StatusOK, opaServe(om, "/docs/api"))
+	assert.Equal(t, http.StatusForbidden, opaServe(om, "/admin"))
+	assert.Equal(t, http.StatusOK, opaServe(om, "/admin", "users", "admin"))
+
+	// Cached until reloaded
+	assert.Equal(t, 3, om.cache.cache.Len())
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "data.json"), []byte(`{"admins": "ops"}`), 0644))
+	assert.Equal(t, http.StatusOK, opaServe(om, "/admin", "users", "admin"))
+	assert.NoError(t, om.Reload())
+	assert.Equal(t, http.StatusForbidden, opaServe(om, "/admin", "users", "admin"))
+	assert.Equal(t, 1, om.InvalidateUserCache("jon"))
+
+	// Anonymous
+	om.subject = func(c echo.Context) string { return "" }
+	assert.Equal(t, http.StatusUnauthorized, opaServe(om, "/docs"))
+
+	assert.Error(t, OPAConfig{Policy: dir, Bundle: "http://opa/bundle.tar.gz"}.validate())
+	assert.Error(t, OPAConfig{Policy: filepath.Join(dir, "missing.rego")}.validate())
+}
+
+func TestOPABundle(t *testing.T) {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for name, body := range map[string]string{"/armor/policy.rego": opaTestPolicy, "/data.json": `{"admins": "admin"}`} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))})
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+	gw.Close()
+	requests := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Etag", `"1"`)
+		w.Write(buf.Bytes())
+	}))
+	defer s.Close()
+
+	om, err := newOPAMiddleware(OPAConfig{Bundle: s.URL + "/bundle.tar.gz"}, func(c echo.Context) string { return "jon" }, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, opaServe(om, "/docs"))
+	assert.Equal(t, http.StatusOK, opaServe(om, "/admin", "admin"))
+	assert.Equal(t, http.StatusForbidden, opaServe(om, "/admin"))
+	q := om.query
+	assert.NoError(t, om.Reload())
+	assert.Equal(t, 2, requests)
+	assert.True(t, q == om.query) // Not modified
+}
+
+func TestOPARemoteIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	policy := filepath.Join(dir, "armor.rego")
+	assert.NoError(t, ioutil.WriteFile(policy, []byte("package armor\n\ndefault allow = false\n\nallow {\n\tinput.remote_ip == \"10.0.0.1\"\n}\n"), 0644))
+	serve := func(om *opaMiddleware, peer string) int {
+		e := echo.New()
+		req := httptest.NewRequest(echo.GET, "/admin", nil)
+		req.RemoteAddr = peer + ":1234"
+		req.Header.Set(echo.HeaderXForwardedFor, "10.0.0.1")
+		req.Header.Set(echo.HeaderXRealIP, "10.0.0.1")
+		rec := httptest.NewRecorder()
+		err := om.MiddlewareFunc()(func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		})(e.NewContext(req, rec))
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he.Code
+		}
+		return rec.Code
+	}
+
+	// Spoofed by clients, read from trusted proxies
+	cfg := OPAConfig{Policy: policy, TrustedProxies: []string{"192.168.0.0/16"}}
+	assert.NoError(t, cfg.validate())
+	om, err := newOPAMiddleware(cfg, func(c echo.Context) string { return "jon" }, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusForbidden, serve(om, "203.0.113.1"))
+	assert.Equal(t, http.StatusOK, serve(om, "192.168.0.1"))
+
+	assert.Error(t, OPAConfig{Policy: policy, TrustedProxies: []string{"proxy"}}.validate())
+}
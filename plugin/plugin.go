@@ -2,13 +2,19 @@ package plugin
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"net/http"
+	"reflect"
 	"strings"
 	"sync"
 
 	"github.com/Knetic/govaluate"
+	"github.com/labstack/armor/util"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
 	"github.com/mitchellh/mapstructure"
@@ -31,15 +37,54 @@ type (
 		mutex *sync.RWMutex
 		name  string
 		order int
+		raw   RawPlugin
 		// TODO: to disable
-		Skip       string              `yaml:"skip"`
+		Skip     string `yaml:"skip"`
+		Inherits string `yaml:"inherits"`
+
+		// RolloutPercent applies the plugin to a share of the requests, from 0
+		// to 100 (default), the others skip it. Requests are selected by a hash
+		// of RolloutKey, a template, default the user of the auth plugins or
+		// the client IP, read from X-Forwarded-For of RolloutTrustedProxies
+		// only, so clients cannot pick whether they skip it.
+		RolloutPercent        *float64 `yaml:"rollout_percent"`
+		RolloutKey            string   `yaml:"rollout_key"`
+		RolloutTrustedProxies []string `yaml:"rollout_trusted_proxies"`
+
+		// Methods applies the plugin to the requests of the methods only, e.g.
+		// `POST` and `DELETE`, to all if empty.
+		Methods []string `yaml:"methods"`
+
 		Middleware echo.MiddlewareFunc `yaml:"-"`
 		Echo       *echo.Echo          `yaml:"-"`
 		Logger     *log.Logger         `yaml:"-"`
 	}
 
+	// Claimer is implemented by plugins which handle some requests whatever
+	// their `Methods`, e.g. the CAS ticket validations.
+	Claimer interface {
+		Claims(r *http.Request) bool
+	}
+
+	// rollout is implemented by plugins embedding `Base`.
+	rollout interface {
+		rolloutConfig() (percent float64, key string, trusted []string)
+		methodsConfig() []string
+	}
+
+	// updatable is implemented by plugins embedding `Base`.
+	updatable interface {
+		NeedsUpdate(interface{}) bool
+		rawConfig() RawPlugin
+		setRawConfig(RawPlugin)
+		logger() *log.Logger
+	}
+
+	// Template is a template of the request variables, `remote_ip` is read
+	// from X-Forwarded-For of Trusted only, else the connection address.
 	Template struct {
 		*fasttemplate.Template
+		Trusted util.IPNets
 	}
 
 	Expression struct {
@@ -50,6 +95,7 @@ type (
 const (
 	// Plugin types
 	PluginBodyLimit           = "body-limit"
+	PluginBodyInspect         = "body-inspect"
 	PluginLogger              = "logger"
 	PluginRedirect            = "redirect"
 	PluginHTTPSRedirect       = "https-redirect"
@@ -64,9 +110,30 @@ const (
 	PluginCORS                = "cors"
 	PluginGzip                = "gzip"
 	PluginHeader              = "header"
+	PluginHeaders             = "headers"
 	PluginProxy               = "proxy"
 	PluginStatic              = "static"
 	PluginFile                = "file"
+	PluginCas                 = "cas"
+	PluginOidc                = "oidc"
+	PluginSaml                = "saml"
+	PluginJwt                 = "jwt"
+	PluginLdap                = "ldap"
+	PluginBasicAuth           = "basic-auth"
+	PluginAPIKey              = "api-key"
+	PluginRateLimit           = "rate-limit"
+	PluginCache               = "cache"
+	PluginBodyRewrite         = "body-rewrite"
+	PluginTracing             = "tracing"
+	PluginAccessLog           = "access-log"
+	PluginSecureHeaders       = "secure-headers"
+	PluginCSRF                = "csrf"
+	PluginIPFilter            = "ip-filter"
+	PluginCompress            = "compress"
+	PluginRequestID           = "request-id"
+	PluginExtAuthz            = "ext-authz"
+	PluginAudit               = "audit"
+	PluginMaintenance         = "maintenance"
 )
 
 var (
@@ -77,6 +144,8 @@ var (
 		switch base.Name() {
 		case PluginBodyLimit:
 			p = &BodyLimit{Base: base}
+		case PluginBodyInspect:
+			p = &BodyInspect{Base: base}
 		case PluginLogger:
 			p = &Logger{Base: base}
 		case PluginRedirect:
@@ -103,7 +172,7 @@ var (
 			p = &CORS{Base: base}
 		case PluginGzip:
 			p = &Gzip{Base: base}
-		case PluginHeader:
+		case PluginHeader, PluginHeaders:
 			p = &Header{Base: base}
 		case PluginProxy:
 			p = &Proxy{Base: base}
@@ -111,8 +180,46 @@ var (
 			p = &Static{Base: base}
 		case PluginFile:
 			p = &File{Base: base}
-		case "cas":
+		case PluginCas:
 			p = &Cas{Base: base}
+		case PluginOidc:
+			p = &Oidc{Base: base}
+		case PluginSaml:
+			p = &Saml{Base: base}
+		case PluginJwt:
+			p = &Jwt{Base: base}
+		case PluginLdap:
+			p = &Ldap{Base: base}
+		case PluginBasicAuth:
+			p = &BasicAuth{Base: base}
+		case PluginAPIKey:
+			p = &APIKey{Base: base}
+		case PluginRateLimit:
+			p = &RateLimit{Base: base}
+		case PluginCache:
+			p = &Cache{Base: base}
+		case PluginBodyRewrite:
+			p = &BodyRewrite{Base: base}
+		case PluginTracing:
+			p = &Tracing{Base: base}
+		case PluginAccessLog:
+			p = &AccessLog{Base: base}
+		case PluginSecureHeaders:
+			p = &SecureHeaders{Base: base}
+		case PluginCSRF:
+			p = &CSRF{Base: base}
+		case PluginIPFilter:
+			p = &IPFilter{Base: base}
+		case PluginRequestID:
+			p = &RequestID{Base: base}
+		case PluginExtAuthz:
+			p = &ExtAuthz{Base: base}
+		case PluginAudit:
+			p = &Audit{Base: base}
+		case PluginMaintenance:
+			p = &Maintenance{Base: base}
+		case PluginCompress:
+			p = &Compress{Base: base}
 		}
 		return
 	}
@@ -152,6 +259,7 @@ func Decode(r RawPlugin, e *echo.Echo, l *log.Logger) (p Plugin) {
 	base := Base{
 		name:   name,
 		order:  r.Order(),
+		raw:    r,
 		mutex:  new(sync.RWMutex),
 		Skip:   "false",
 		Echo:   e,
@@ -161,8 +269,9 @@ func Decode(r RawPlugin, e *echo.Echo, l *log.Logger) (p Plugin) {
 		panic(fmt.Sprintf("plugin=%s not found", name))
 	}
 	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-		TagName: "yaml",
-		Result:  p,
+		TagName:    "yaml",
+		Result:     p,
+		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
 	})
 	err = dec.Decode(r)
 	if err != nil {
@@ -171,6 +280,29 @@ func Decode(r RawPlugin, e *echo.Echo, l *log.Logger) (p Plugin) {
 	return
 }
 
+// ValidateConfig checks the config of the Base of p, then the config of p if
+// it implements `ValidateConfig`.
+func ValidateConfig(p Plugin) error {
+	if ro, ok := p.(rollout); ok {
+		_, _, trusted := ro.rolloutConfig()
+		if _, err := util.ParseIPNets(trusted); err != nil {
+			return fmt.Errorf("invalid rollout trusted proxies: %v", err)
+		}
+	}
+	if v, ok := p.(interface{ ValidateConfig() error }); ok {
+		return v.ValidateConfig()
+	}
+	return nil
+}
+
+// Process applies the Middleware set by Initialize, the plugins of a single
+// middleware need no Process of their own.
+func (b *Base) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.Middleware(next)
+}
+
 func (b *Base) Name() string {
 	return b.name
 }
@@ -179,6 +311,138 @@ func (b *Base) Order() int {
 	return b.order
 }
 
+// NeedsUpdate reports whether config, a raw plugin config, differs from the
+// one the plugin was decoded from.
+func (b *Base) NeedsUpdate(config interface{}) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return !reflect.DeepEqual(b.raw, config)
+}
+
+func (b *Base) rawConfig() RawPlugin {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.raw
+}
+
+func (b *Base) setRawConfig(r RawPlugin) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.raw = r
+}
+
+// Update updates p from np unless np was decoded from the same config.
+func Update(p, np Plugin) {
+	u, ok := p.(updatable)
+	nu, nok := np.(updatable)
+	if !ok || !nok {
+		p.Update(np)
+		return
+	}
+	config := nu.rawConfig()
+	if !u.NeedsUpdate(config) {
+		if l := u.logger(); l != nil {
+			l.Debugf("plugin=%s, skipping update, config unchanged", p.Name())
+		}
+		return
+	}
+	p.Update(np)
+	u.setRawConfig(config)
+}
+
+// RawConfig returns the raw config p was decoded from, nil for plugins not
+// embedding `Base`.
+func RawConfig(p Plugin) RawPlugin {
+	if u, ok := p.(updatable); ok {
+		return u.rawConfig()
+	}
+	return nil
+}
+
+func (b *Base) rolloutConfig() (float64, string, []string) {
+	if b.RolloutPercent == nil {
+		return 100, b.RolloutKey, b.RolloutTrustedProxies
+	}
+	return *b.RolloutPercent, b.RolloutKey, b.RolloutTrustedProxies
+}
+
+// Rollout returns the middleware applying p to the requests within its
+// `RolloutPercent`, the selection is deterministic on the rollout key.
+func Rollout(p Plugin) echo.MiddlewareFunc {
+	r, ok := p.(rollout)
+	if !ok {
+		return p.Process
+	}
+	percent, key, proxies := r.rolloutConfig()
+	if percent >= 100 {
+		return p.Process
+	}
+	// Validated by ValidateConfig
+	trusted, _ := util.ParseIPNets(proxies)
+	var t *Template
+	if key != "" {
+		t = NewTemplate(key)
+		t.Trusted = trusted
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := p.Process(next)
+		return func(c echo.Context) error {
+			k := AuthSubject(c)
+			if t != nil {
+				k, _ = t.Execute(c)
+			} else if k == "" {
+				k = remoteIP(c.Request(), trusted)
+			}
+			if inRollout(k, percent) {
+				return h(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+func (b *Base) methodsConfig() []string {
+	return b.Methods
+}
+
+// Activate returns the middleware applying p to the requests of its
+// `Methods`, all if none, and to the ones it claims, within its
+// `RolloutPercent`.
+func Activate(p Plugin) echo.MiddlewareFunc {
+	m := Rollout(p)
+	r, ok := p.(rollout)
+	if !ok || len(r.methodsConfig()) == 0 {
+		return m
+	}
+	methods := map[string]bool{}
+	for _, method := range r.methodsConfig() {
+		methods[strings.ToUpper(method)] = true
+	}
+	claimer, _ := p.(Claimer)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := m(next)
+		return func(c echo.Context) error {
+			if methods[c.Request().Method] || claimer != nil && claimer.Claims(c.Request()) {
+				return h(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+// inRollout reports whether key hashes within percent of the key space.
+func inRollout(key string, percent float64) bool {
+	if percent <= 0 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(key))
+	return float64(binary.BigEndian.Uint64(sum[:8]))/math.MaxUint64*100 < percent
+}
+
+func (b *Base) logger() *log.Logger {
+	return b.Logger
+}
+
 func NewTemplate(t string) *Template {
 	return &Template{Template: fasttemplate.New(t, "${", "}")}
 }
@@ -188,7 +452,7 @@ func (t *Template) Execute(c echo.Context) (string, error) {
 	buf.Reset()
 	defer bufferPool.Put(buf)
 	_, err := t.ExecuteFunc(buf, func(w io.Writer, tag string) (int, error) {
-		mapTag(buf, c, tag)
+		mapTag(buf, c, tag, t.Trusted)
 		return 0, nil
 	})
 	return buf.String(), err
@@ -205,7 +469,7 @@ func (e *Expression) Evaluate(c echo.Context) (interface{}, error) {
 
 	if _, err := e.ExecuteFunc(buf, func(w io.Writer, tag string) (int, error) {
 		buf.WriteString("'")
-		mapTag(buf, c, tag)
+		mapTag(buf, c, tag, nil)
 		buf.WriteString("'")
 		return 0, nil
 	}); err != nil {
@@ -219,7 +483,9 @@ func (e *Expression) Evaluate(c echo.Context) (interface{}, error) {
 	return expr.Evaluate(nil)
 }
 
-func mapTag(b *bytes.Buffer, c echo.Context, t string) {
+// mapTag writes the value of the variable t, `remote_ip` of X-Forwarded-For
+// of trusted only.
+func mapTag(b *bytes.Buffer, c echo.Context, t string, trusted util.IPNets) {
 	switch t {
 	case "scheme":
 		b.WriteString(c.Scheme())
@@ -229,6 +495,17 @@ func mapTag(b *bytes.Buffer, c echo.Context, t string) {
 		b.WriteString(c.Request().RequestURI)
 	case "path":
 		b.WriteString(c.Request().URL.Path)
+	case "host":
+		b.WriteString(c.Request().Host)
+	case "remote_ip":
+		b.WriteString(remoteIP(c.Request(), trusted))
+	case "user":
+		b.WriteString(AuthSubject(c))
+	case CSPNonceKey, CSRFTokenKey:
+		s, _ := c.Get(t).(string)
+		b.WriteString(s)
+	case RequestIDKey:
+		b.WriteString(GetRequestID(c))
 	default:
 		switch {
 		case strings.HasPrefix(t, "header:"):
@@ -0,0 +1,255 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type counter struct {
+	Base        `yaml:",squash"`
+	Value       string `yaml:"value"`
+	initialized int
+}
+
+func (c *counter) Initialize() {
+	c.initialized++
+}
+
+func (c *counter) Update(p Plugin) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Value = p.(*counter).Value
+	c.Initialize()
+}
+
+func (c *counter) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	return next
+}
+
+// initialized sets the mutex of the Base of p, a pointer to a plugin
+// embedding it, and initializes p, as Decode would without a raw config.
+func initialized(p Plugin) Plugin {
+	reflect.ValueOf(p).Elem().FieldByName("Base").Addr().Interface().(*Base).mutex = new(sync.RWMutex)
+	p.Initialize()
+	return p
+}
+
+// validated checks the config of p, then initializes it.
+func validated(t *testing.T, p Plugin) Plugin {
+	assert.NoError(t, ValidateConfig(p))
+	return initialized(p)
+}
+
+func TestUpdate(t *testing.T) {
+	Lookup = func(base Base) Plugin {
+		return &counter{Base: base}
+	}
+	defer func() {
+		Lookup = DefaultLookup
+	}()
+	decode := func(value string) Plugin {
+		return Decode(RawPlugin{"name": "counter", "order": 1, "value": value}, nil, nil)
+	}
+
+	p := decode("one").(*counter)
+	p.Initialize()
+
+	// Unchanged
+	Update(p, decode("one"))
+	assert.Equal(t, 1, p.initialized)
+
+	// Changed
+	Update(p, decode("two"))
+	assert.Equal(t, 2, p.initialized)
+	assert.Equal(t, "two", p.Value)
+	Update(p, decode("two"))
+	assert.Equal(t, 2, p.initialized)
+}
+
+func TestPluginRespectsContextCancellation(t *testing.T) {
+	// Upstream which never responds
+	block := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer s.Close()
+	defer close(block)
+	l := log.New("test")
+	l.SetOutput(ioutil.Discard)
+
+	for _, rp := range []RawPlugin{
+		{"name": PluginCas, "url": s.URL + "/cas"},
+		{"name": PluginProxy, "targets": []interface{}{map[string]interface{}{"url": s.URL}}},
+		{"name": PluginBodyLimit, "limit": "1K"},
+		{"name": PluginBodyInspect},
+		{"name": PluginLogger, "output": ioutil.Discard},
+		{"name": PluginHeader},
+		{"name": PluginGzip},
+		{"name": PluginSecure},
+		{"name": PluginCORS},
+		{"name": PluginAddTrailingSlash},
+	} {
+		rp["order"] = 0
+		e := echo.New()
+		e.Logger = l
+		p := Decode(rp, e, l)
+		p.Initialize()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest(echo.GET, "/?ticket=ST-1", strings.NewReader(`{}`)).WithContext(ctx)
+		next := func(c echo.Context) error {
+			return c.Request().Context().Err()
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- p.Process(next)(e.NewContext(req, httptest.NewRecorder()))
+		}()
+		select {
+		case err := <-done:
+			// Plugins like logger handle the error themselves
+			assert.True(t, err == nil || isContextError(err), "plugin=%s, error=%v", p.Name(), err)
+		case <-time.After(100 * time.Millisecond):
+			t.Errorf("plugin=%s blocked on a cancelled context", p.Name())
+		}
+	}
+}
+
+func isContextError(err error) bool {
+	if he, ok := err.(*echo.HTTPError); ok && he.Internal != nil {
+		err = he.Internal
+	}
+	return err != nil && strings.Contains(err.Error(), context.Canceled.Error())
+}
+
+func TestRollout(t *testing.T) {
+	e := echo.New()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+	serve := func(h echo.HandlerFunc, ip string, header http.Header, user ...string) bool {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if len(user) > 0 {
+			c.Set("casUsername", user[0])
+		}
+		assert.NoError(t, h(c))
+		return rec.Header().Get("X-Name") == "armor"
+	}
+	header := func(config RawPlugin) echo.HandlerFunc {
+		config["name"] = PluginHeader
+		config["order"] = 0
+		config["set"] = map[string]interface{}{"X-Name": "armor"}
+		p := Decode(config, e, nil)
+		p.Initialize()
+		return Rollout(p)(ok)
+	}
+	ips := func(h echo.HandlerFunc) (applied int) {
+		for i := 0; i < 1000; i++ {
+			if serve(h, fmt.Sprintf("10.0.%d.%d", i/256, i%256), nil) {
+				applied++
+			}
+		}
+		return
+	}
+
+	assert.Equal(t, 1000, ips(header(RawPlugin{})))
+	assert.Equal(t, 1000, ips(header(RawPlugin{"rollout_percent": 100})))
+	assert.Equal(t, 0, ips(header(RawPlugin{"rollout_percent": 0})))
+	h := header(RawPlugin{"rollout_percent": 50})
+	assert.InDelta(t, 500, ips(h), 60)
+
+	// Deterministic
+	for i := 0; i < 10; i++ {
+		ip := fmt.Sprintf("10.1.0.%d", i)
+		first := serve(h, ip, nil)
+		for j := 0; j < 5; j++ {
+			assert.Equal(t, first, serve(h, ip, nil))
+		}
+	}
+
+	// Spoofed X-Forwarded-For, of trusted proxies only
+	forwarded := func(h echo.HandlerFunc, ip string) (applied int) {
+		for i := 0; i < 100; i++ {
+			if serve(h, ip, http.Header{echo.HeaderXForwardedFor: {fmt.Sprintf("10.3.0.%d", i)}, echo.HeaderXRealIP: {fmt.Sprintf("10.3.0.%d", i)}}) {
+				applied++
+			}
+		}
+		return
+	}
+	assert.Contains(t, []int{0, 100}, forwarded(h, "10.1.0.1"))
+	h = header(RawPlugin{"rollout_percent": 50, "rollout_trusted_proxies": []string{"192.168.0.1"}})
+	assert.InDelta(t, 50, forwarded(h, "192.168.0.1"), 20)
+	assert.Error(t, ValidateConfig(Decode(RawPlugin{"name": PluginHeader, "order": 0, "rollout_trusted_proxies": []string{"proxy"}}, e, nil)))
+	assert.NoError(t, ValidateConfig(Decode(RawPlugin{"name": PluginHeader, "order": 0, "rollout_trusted_proxies": []string{"192.168.0.1"}}, e, nil)))
+
+	// The remote_ip of the key, of trusted proxies only
+	assert.Contains(t, []int{0, 100}, forwarded(header(RawPlugin{"rollout_percent": 50, "rollout_key": "${remote_ip}"}), "10.1.0.1"))
+	assert.InDelta(t, 50, forwarded(header(RawPlugin{"rollout_percent": 50, "rollout_key": "${remote_ip}", "rollout_trusted_proxies": []string{"192.168.0.1"}}), "192.168.0.1"), 20)
+
+	// By the user of the auth plugins
+	for _, user := range []string{"jon", "joe", "jane"} {
+		first := serve(h, "10.2.0.1", nil, user)
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, first, serve(h, fmt.Sprintf("10.2.1.%d", i), nil, user))
+		}
+	}
+
+	// Rollout key
+	h = header(RawPlugin{"rollout_percent": 50.0, "rollout_key": "${header:X-User}"})
+	for _, user := range []string{"jon", "joe", "jane"} {
+		first := serve(h, "10.2.0.1", http.Header{"X-User": {user}})
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, first, serve(h, fmt.Sprintf("10.2.1.%d", i), http.Header{"X-User": {user}}))
+		}
+	}
+}
+
+func TestActivate(t *testing.T) {
+	e := echo.New()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+	header := func(config RawPlugin) echo.HandlerFunc {
+		config["name"] = PluginHeader
+		config["order"] = 0
+		config["set"] = map[string]interface{}{"X-Name": "armor"}
+		p := Decode(config, e, nil)
+		p.Initialize()
+		return Activate(p)(ok)
+	}
+	applied := func(h echo.HandlerFunc, method string) bool {
+		rec := httptest.NewRecorder()
+		assert.NoError(t, h(e.NewContext(httptest.NewRequest(method, "/", nil), rec)))
+		return rec.Header().Get("X-Name") == "armor"
+	}
+
+	h := header(RawPlugin{})
+	assert.True(t, applied(h, echo.GET))
+	assert.True(t, applied(h, echo.POST))
+	h = header(RawPlugin{"methods": []string{"post", "DELETE"}})
+	assert.False(t, applied(h, echo.GET))
+	assert.True(t, applied(h, echo.POST))
+	assert.True(t, applied(h, echo.DELETE))
+	assert.False(t, applied(h, echo.PUT))
+
+	// Within the rollout
+	h = header(RawPlugin{"methods": []string{"POST"}, "rollout_percent": 0})
+	assert.False(t, applied(h, echo.POST))
+}
@@ -0,0 +1,235 @@
+package plugin
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+type (
+	// ProbeFunc resolves a config value by key from an external system, e.g.
+	// a secret store. It returns an empty value to keep the configured one.
+	ProbeFunc func(key string) (string, error)
+)
+
+const redacted = "REDACTED"
+
+// passwordParamRegexp matches the passwords of key=value DSNs and query
+// params.
+var passwordParamRegexp = regexp.MustCompile(`(?i)(password=)[^\s&]+`)
+
+// ProbeConfig sets the string fields of config, a pointer to a config struct,
+// tagged `armor:"probe"` from probe. The key is the yaml name of the field,
+// dotted for nested structs, e.g. `url` or `casbin.policy`. The fields
+// tagged `armor:"probe,secret"` are secrets, redacted in the admin API.
+func ProbeConfig(config interface{}, probe ProbeFunc) error {
+	return probeStruct(reflect.ValueOf(config).Elem(), "", probe)
+}
+
+func probeStruct(v reflect.Value, prefix string, probe ProbeFunc) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			p := prefix
+			if len(tag) < 2 || tag[1] != "squash" {
+				p += tag[0] + "."
+			}
+			if err := probeStruct(fv, p, probe); err != nil {
+				return err
+			}
+			continue
+		}
+		if probe, _ := armorTag(f); !probe || fv.Kind() != reflect.String {
+			continue
+		}
+		key := prefix + tag[0]
+		s, err := probe(key)
+		if err != nil {
+			return fmt.Errorf("failed to probe config key=%s, error=%v", key, err)
+		}
+		if s != "" {
+			fv.SetString(s)
+		}
+	}
+	return nil
+}
+
+// armorTag reports whether f is tagged `armor:"probe"`, and a secret.
+func armorTag(f reflect.StructField) (probe, secret bool) {
+	tag := strings.Split(f.Tag.Get("armor"), ",")
+	return tag[0] == "probe", len(tag) > 1 && tag[1] == "secret"
+}
+
+// probeKeys adds the keys of the probed fields of t to keys, true for the
+// secrets.
+func probeKeys(t reflect.Type, prefix string, keys map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if f.Type.Kind() == reflect.Struct {
+			p := prefix
+			if len(tag) < 2 || tag[1] != "squash" {
+				p += tag[0] + "."
+			}
+			probeKeys(f.Type, p, keys)
+			continue
+		}
+		if probe, secret := armorTag(f); probe && f.Type.Kind() == reflect.String {
+			keys[prefix+tag[0]] = secret
+		}
+	}
+}
+
+// RedactedConfig returns the raw config of p as RawConfig, with the secrets
+// and the passwords of the URIs of its probed fields redacted.
+func RedactedConfig(p Plugin) RawPlugin {
+	rp := RawConfig(p)
+	if rp == nil {
+		return nil
+	}
+	keys := map[string]bool{}
+	if t := reflect.TypeOf(p); t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+		probeKeys(t.Elem(), "", keys)
+	}
+	return RawPlugin(redactMap(rp, "", keys))
+}
+
+func redactMap(m map[string]interface{}, prefix string, keys map[string]bool) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		// Decoded case insensitive
+		key := prefix + strings.ToLower(k)
+		if secret, ok := keys[key]; ok {
+			if s, ok := v.(string); ok && s != "" {
+				if secret {
+					v = redacted
+				} else {
+					v = redactURI(s)
+				}
+			}
+		} else {
+			switch nested := v.(type) {
+			case map[string]interface{}:
+				v = redactMap(nested, key+".", keys)
+			case RawPlugin:
+				v = redactMap(nested, key+".", keys)
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// UnredactedConfig returns rp, a config of p as read from RedactedConfig,
+// with the redacted secrets and URIs of its probed fields restored from the
+// current raw config of p, so that a config read back keeps its secrets.
+func UnredactedConfig(p Plugin, rp RawPlugin) RawPlugin {
+	current := RawConfig(p)
+	if rp == nil || current == nil {
+		return rp
+	}
+	keys := map[string]bool{}
+	if t := reflect.TypeOf(p); t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+		probeKeys(t.Elem(), "", keys)
+	}
+	return RawPlugin(unredactMap(rp, current, "", keys))
+}
+
+func unredactMap(m, current map[string]interface{}, prefix string, keys map[string]bool) map[string]interface{} {
+	// Decoded case insensitive
+	cur := make(map[string]interface{}, len(current))
+	for k, v := range current {
+		cur[strings.ToLower(k)] = v
+	}
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		key := prefix + strings.ToLower(k)
+		c := cur[strings.ToLower(k)]
+		if secret, ok := keys[key]; ok {
+			s, _ := v.(string)
+			if cs, ok := c.(string); ok && cs != "" && (secret && s == redacted || !secret && s == redactURI(cs)) {
+				v = cs
+			}
+		} else {
+			switch nested := v.(type) {
+			case map[string]interface{}:
+				v = unredactMap(nested, asMap(c), key+".", keys)
+			case RawPlugin:
+				v = unredactMap(nested, asMap(c), key+".", keys)
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func asMap(v interface{}) map[string]interface{} {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m
+	case RawPlugin:
+		return m
+	}
+	return nil
+}
+
+// redactURI redacts the password of s, a URL, e.g.
+// `redis://:password@localhost`, or a DSN, e.g. `user:password@tcp(db)/armor`
+// or `host=db password=password`.
+func redactURI(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		if _, ok := u.User.Password(); u.User != nil && ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			s = u.String()
+		}
+	} else if i := strings.LastIndexByte(s, '@'); i > 0 {
+		if j := strings.IndexByte(s[:i], ':'); j >= 0 {
+			s = s[:j+1] + redacted + s[i:]
+		}
+	}
+	return passwordParamRegexp.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// VaultProbe returns a probe reading the config keys from the Vault secret at
+// mount, e.g. `secret/armor` or `secret/data/armor` for the KV v2 engine.
+// The secret is read once, on first use.
+func VaultProbe(client *vault.Client, mount string) ProbeFunc {
+	var (
+		once sync.Once
+		data map[string]interface{}
+		err  error
+	)
+	return func(key string) (string, error) {
+		once.Do(func() {
+			var s *vault.Secret
+			if s, err = client.Logical().Read(mount); err != nil || s == nil {
+				return
+			}
+			data = s.Data
+			if d, ok := data["data"].(map[string]interface{}); ok { // KV v2
+				data = d
+			}
+		})
+		if err != nil {
+			return "", err
+		}
+		if v, ok := data[key]; ok {
+			return fmt.Sprint(v), nil
+		}
+		return "", nil
+	}
+}
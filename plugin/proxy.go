@@ -1,9 +1,12 @@
 package plugin
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -15,11 +18,61 @@ type (
 		middleware.ProxyConfig `yaml:",squash"`
 		Balance                string    `yaml:"balance"`
 		Targets                []*Target `yaml:"targets"`
+
+		// HealthCheck removes unhealthy targets from the rotation, enabled
+		// by a path.
+		HealthCheck ProxyHealthCheck `yaml:"health_check"`
+
+		// Sticky pins clients to a target.
+		Sticky ProxySticky `yaml:"sticky"`
+
+		// Split sends a share of the requests to the targets of a group,
+		// e.g. a canary.
+		Split ProxySplit `yaml:"split"`
+
+		// Mirror sends a copy of a share of the requests to a shadow
+		// upstream.
+		Mirror ProxyMirror `yaml:"mirror"`
+
+		// Upstream are the connection settings of the targets.
+		Upstream ProxyUpstream `yaml:"upstream"`
+
+		// Discovery re-resolves the targets discovered by DNS.
+		Discovery ProxyDiscovery `yaml:"discovery"`
+
+		WebSocket      ProxyWebSocket      `yaml:"websocket"`
+		Retry          ProxyRetry          `yaml:"retry"`
+		CircuitBreaker ProxyCircuitBreaker `yaml:"circuit_breaker"`
+
+		health    *proxyHealthChecker
+		discovery *proxyDiscovery
 	}
 
 	Target struct {
 		Name string `yaml:"name"`
 		URL  string `yaml:"url"`
+
+		// Weight of the weighted balancers, default 1.
+		Weight int `yaml:"weight"`
+
+		// Protocol is h2c or grpc to proxy over HTTP/2.
+		Protocol string `yaml:"protocol"`
+
+		// Group of the target, the split group or none.
+		Group string `yaml:"group"`
+
+		// Upstream are the connection settings of the target, instead of
+		// the ones of the proxy.
+		Upstream *ProxyUpstream `yaml:"upstream"`
+
+		// Discovery is dns or srv to proxy to the addresses of the url host,
+		// re-resolved.
+		Discovery string `yaml:"discovery"`
+	}
+
+	// wrappedBalancer is a balancer wrapping another.
+	wrappedBalancer interface {
+		wrapped() middleware.ProxyBalancer
 	}
 )
 
@@ -28,46 +81,308 @@ func (t Target) ProxyTarget() (target *middleware.ProxyTarget, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("not able to parse proxy: url=%s, error=%v", t.URL, err)
 	}
+	// The balancer removes targets by name
+	name := t.Name
+	if name == "" {
+		name = t.URL
+	}
 	return &middleware.ProxyTarget{
-		Name: t.Name,
+		Name: name,
 		URL:  u,
 	}, nil
 }
 
+func (p *Proxy) ValidateConfig() error {
+	if len(p.Targets) == 0 {
+		return errors.New("proxy requires at least one target")
+	}
+	for _, t := range p.Targets {
+		pt, err := t.ProxyTarget()
+		if err != nil {
+			return err
+		}
+		if err := validateProxyProtocol(t, pt.URL); err != nil {
+			return err
+		}
+		if err := validateProxyDiscovery(t, pt.URL); err != nil {
+			return err
+		}
+		if t.Weight < 0 {
+			return fmt.Errorf("invalid proxy target weight=%d", t.Weight)
+		}
+		if t.Upstream != nil {
+			if err := t.Upstream.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := p.Upstream.validate(); err != nil {
+		return err
+	}
+	if err := p.Discovery.validate(); err != nil {
+		return err
+	}
+	switch p.Balance {
+	case "", ProxyBalanceRandom, ProxyBalanceRoundRobin, ProxyBalanceWeightedRoundRobin, ProxyBalanceLeastConn:
+	default:
+		return fmt.Errorf("invalid proxy balance=%s", p.Balance)
+	}
+	if h := p.HealthCheck.Path; h != "" && !strings.HasPrefix(h, "/") {
+		return fmt.Errorf("invalid proxy health check path=%s", h)
+	}
+	if err := p.Split.validate(p.Targets); err != nil {
+		return err
+	}
+	if err := p.Mirror.validate(); err != nil {
+		return err
+	}
+	if err := p.WebSocket.validate(); err != nil {
+		return err
+	}
+	if err := p.Retry.validate(); err != nil {
+		return err
+	}
+	if p.CircuitBreaker.FailureThreshold < 0 {
+		return fmt.Errorf("invalid proxy circuit breaker failure threshold=%d", p.CircuitBreaker.FailureThreshold)
+	}
+	return p.Sticky.validate()
+}
+
 func (p *Proxy) Initialize() {
+	if p.health != nil {
+		p.health.stop(context.Background())
+		p.health = nil
+	}
+	if p.discovery != nil {
+		p.discovery.stop(context.Background())
+		p.discovery = nil
+	}
+
 	// Targets
-	targets := make([]*middleware.ProxyTarget, len(p.Targets))
-	for i, t := range p.Targets {
+	base := p.Transport
+	old, _ := base.(*proxyTransport)
+	if old != nil {
+		base = old.base
+	}
+	transport := newProxyTransport(base)
+	p.Transport = transport
+	setUpstream := func(u *url.URL, config ProxyUpstream) bool {
+		if err := transport.setUpstream(u, config, old); err != nil {
+			if p.Logger != nil {
+				p.Logger.Errorf("proxy: %v", err)
+			}
+			p.Middleware = internalErrorMid
+			return false
+		}
+		return true
+	}
+	if !p.Upstream.empty() && !setUpstream(nil, p.Upstream) {
+		return
+	}
+	var (
+		targets   []*middleware.ProxyTarget
+		groupOf   []string
+		discovery *proxyDiscovery
+	)
+	weights := map[string]int{}
+	for _, t := range p.Targets {
 		pg, err := t.ProxyTarget()
 		if err != nil {
 			panic(err)
 		}
-		targets[i] = pg
+		if t.Discovery != "" {
+			if discovery == nil {
+				discovery = newProxyDiscovery(p.Discovery, transport, p.Upstream, p.Logger)
+			}
+			for _, dt := range discovery.add(t, pg, old) {
+				targets, groupOf = append(targets, dt.ProxyTarget), append(groupOf, t.Group)
+				weights[dt.Name] = dt.weight
+			}
+			continue
+		}
+		targets, groupOf = append(targets, pg), append(groupOf, t.Group)
+		weights[pg.Name] = t.Weight
+		transport.setProtocol(pg.URL, t.Protocol)
+		if t.Upstream != nil && !setUpstream(pg.URL, *t.Upstream) {
+			return
+		}
 	}
+	transport.closeIdle(old)
 
 	// Balancer
+	if p.Split.enabled() {
+		groups := map[string]middleware.ProxyBalancer{}
+		grouped := map[string][]*middleware.ProxyTarget{"": nil, p.Split.Group: nil}
+		names := map[string]string{}
+		for i, t := range targets {
+			grouped[groupOf[i]] = append(grouped[groupOf[i]], t)
+			names[t.Name] = groupOf[i]
+		}
+		for group, targets := range grouped {
+			groups[group] = p.newBalancer(nil, targets, weights)
+		}
+		p.Balancer = newSplitBalancer(p.Split, groups, names)
+	} else {
+		p.Balancer = p.newBalancer(p.weighted(), targets, weights)
+	}
+	var retry *retryBalancer
+	if p.Retry.Count > 0 || p.Retry.PerTryTimeout > 0 || p.CircuitBreaker.FailureThreshold > 0 {
+		var breaker *proxyBreaker
+		if p.CircuitBreaker.FailureThreshold > 0 {
+			breaker = newProxyBreaker(p.CircuitBreaker, p.Logger)
+		}
+		retry = newRetryBalancer(p.Balancer, breaker, targets)
+		p.Balancer = retry
+	}
+	if p.HealthCheck.Path != "" {
+		p.health = newProxyHealthChecker(p.HealthCheck, p.Balancer, targets, transport, p.Logger)
+	}
+	if discovery != nil {
+		discovery.start(p.Balancer, p.health)
+		p.discovery = discovery
+	}
+
+	// Need to be initialied in the end to reflect config changes.
+	mid := middleware.ProxyWithConfig(p.ProxyConfig)
+	if p.WebSocket.enabled() {
+		mid = webSocketMiddleware(p.WebSocket, newProxyRewrites(p.Rewrite), p.Balancer, mid)
+	}
+	if b := p.leastConn(); b != nil {
+		proxy := mid
+		mid = func(next echo.HandlerFunc) echo.HandlerFunc {
+			h := proxy(next)
+			return func(c echo.Context) error {
+				defer b.release(c)
+				return h(c)
+			}
+		}
+		if retry != nil {
+			retry.release = b.release
+		}
+	}
+	if retry != nil {
+		mid = retryMiddleware(p.Retry, retry, mid)
+	}
+	if discovery != nil && len(targets) == 0 {
+		// None resolved yet
+		proxy := mid
+		mid = func(next echo.HandlerFunc) echo.HandlerFunc {
+			h := proxy(next)
+			return func(c echo.Context) error {
+				if !discovery.available() {
+					return echo.NewHTTPError(http.StatusServiceUnavailable)
+				}
+				return h(c)
+			}
+		}
+	}
+	if p.Mirror.enabled() {
+		mid = mirrorMiddleware(p.Mirror, mid)
+	}
+	p.Middleware = mid
+}
+
+// newBalancer returns the balancer of targets, wrapped by the sticky balancer,
+// weighted is updated instead if of the same kind.
+func (p *Proxy) newBalancer(weighted *proxyBalancer, targets []*middleware.ProxyTarget, weights map[string]int) middleware.ProxyBalancer {
+	var balancer middleware.ProxyBalancer
 	switch p.Balance {
-	case "round-robin":
-		p.Balancer = middleware.NewRoundRobinBalancer(targets)
+	case ProxyBalanceRoundRobin:
+		balancer = &syncBalancer{balancer: middleware.NewRoundRobinBalancer(targets)}
+	case ProxyBalanceWeightedRoundRobin, ProxyBalanceLeastConn:
+		leastConn := p.Balance == ProxyBalanceLeastConn
+		// Keep the active requests counted on updates
+		if weighted != nil && weighted.leastConn == leastConn {
+			weighted.update(targets, weights)
+			balancer = weighted
+		} else {
+			balancer = newProxyBalancer(leastConn, targets, weights)
+		}
 	default: // Random
-		p.Balancer = middleware.NewRandomBalancer(targets)
+		balancer = &syncBalancer{balancer: middleware.NewRandomBalancer(targets)}
+	}
+	if p.Sticky.Mode != "" {
+		balancer = newStickyBalancer(p.Sticky, balancer, targets)
 	}
+	return balancer
+}
 
-	// Need to be initialied in the end to reflect config changes.
-	p.Middleware = middleware.ProxyWithConfig(p.ProxyConfig)
+// leastConn returns a least_conn balancer, of a split group too, nil for the
+// others.
+func (p *Proxy) leastConn() *proxyBalancer {
+	b := p.weighted()
+	if s, ok := innerBalancer(p.Balancer).(*splitBalancer); ok {
+		b = s.weighted()
+	}
+	if b != nil && b.leastConn {
+		return b
+	}
+	return nil
+}
+
+// weighted returns the weighted balancer, nil for the others.
+func (p *Proxy) weighted() *proxyBalancer {
+	return unwrapBalancer(p.Balancer)
+}
+
+// unwrapBalancer returns the weighted balancer wrapped by balancer, if any.
+func unwrapBalancer(balancer middleware.ProxyBalancer) *proxyBalancer {
+	b, _ := innerBalancer(balancer).(*proxyBalancer)
+	return b
+}
+
+// innerBalancer returns the balancer wrapped by the wrapping balancers.
+func innerBalancer(balancer middleware.ProxyBalancer) middleware.ProxyBalancer {
+	for {
+		w, ok := balancer.(wrappedBalancer)
+		if !ok {
+			return balancer
+		}
+		balancer = w.wrapped()
+	}
 }
 
 func (p *Proxy) Update(plugin Plugin) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	p.ProxyConfig = plugin.(*Proxy).ProxyConfig
+	np := plugin.(*Proxy)
+	balancer, transport := p.Balancer, p.Transport
+	p.ProxyConfig, p.Balance, p.Targets, p.HealthCheck = np.ProxyConfig, np.Balance, np.Targets, np.HealthCheck
+	p.Sticky, p.Split, p.Mirror, p.Upstream, p.Discovery, p.WebSocket = np.Sticky, np.Split, np.Mirror, np.Upstream, np.Discovery, np.WebSocket
+	p.Retry, p.CircuitBreaker = np.Retry, np.CircuitBreaker
+	if np.Balancer == nil {
+		p.Balancer = balancer
+	}
+	// The connections are kept
+	if np.Transport == nil {
+		p.Transport = transport
+	}
 	p.Initialize()
 }
 
-func (p *Proxy) Process(next echo.HandlerFunc) echo.HandlerFunc {
+// TargetHealth returns the health check state of the targets, nil without
+// health checks.
+func (p *Proxy) TargetHealth() []TargetHealth {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
-	return p.Middleware(next)
+	if p.health == nil {
+		return nil
+	}
+	return p.health.health()
+}
+
+// ShutdownGrace stops the health checks and the discovery.
+func (p *Proxy) ShutdownGrace(ctx context.Context) {
+	p.mutex.Lock()
+	h, d := p.health, p.discovery
+	p.health, p.discovery = nil, nil
+	p.mutex.Unlock()
+	if h != nil {
+		h.stop(ctx)
+	}
+	if d != nil {
+		d.stop(ctx)
+	}
 }
 
 func (p *Proxy) AddTarget(c echo.Context) (err error) {
@@ -79,6 +394,23 @@ func (p *Proxy) AddTarget(c echo.Context) (err error) {
 	if err != nil {
 		return
 	}
+	if err = validateProxyProtocol(t, pt.URL); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if tr, ok := p.Transport.(*proxyTransport); ok {
+		tr.setProtocol(pt.URL, t.Protocol)
+		if t.Upstream != nil {
+			if err = t.Upstream.validate(); err == nil {
+				err = tr.setUpstream(pt.URL, *t.Upstream, tr)
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+	}
+	if b := p.weighted(); b != nil && t.Weight > 0 {
+		b.setWeight(pt.Name, t.Weight)
+	}
 	p.Balancer.AddTarget(pt)
 	return c.NoContent(http.StatusOK)
 }
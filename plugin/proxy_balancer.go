@@ -0,0 +1,200 @@
+package plugin
+
+import (
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	// Balancing strategies, random is the default
+	ProxyBalanceRandom             = "random"
+	ProxyBalanceRoundRobin         = "round-robin"
+	ProxyBalanceWeightedRoundRobin = "weighted_round_robin"
+	ProxyBalanceLeastConn          = "least_conn"
+)
+
+type (
+	// proxyBalancer balances by weight, with smooth weighted round-robin, or
+	// by the fewest active requests relative to the weight.
+	proxyBalancer struct {
+		mutex     sync.Mutex
+		leastConn bool
+		targets   []*proxyBalancerTarget
+		weights   map[string]int
+		next      int
+	}
+
+	// syncBalancer serializes the echo balancers, their Next is not safe
+	// with targets added and removed, e.g. by the health checks.
+	syncBalancer struct {
+		mutex    sync.Mutex
+		balancer middleware.ProxyBalancer
+	}
+
+	proxyBalancerTarget struct {
+		*middleware.ProxyTarget
+		balancer *proxyBalancer
+		weight   int
+		current  int
+		active   int
+	}
+)
+
+// proxyBalancerKey is the echo context key of the target counted as active.
+const proxyBalancerKey = "proxyBalancerTarget"
+
+// newProxyBalancer returns the balancer of targets, weights default to 1.
+func newProxyBalancer(leastConn bool, targets []*middleware.ProxyTarget, weights map[string]int) *proxyBalancer {
+	b := &proxyBalancer{leastConn: leastConn}
+	b.update(targets, weights)
+	return b
+}
+
+// update replaces the targets and weights, the active requests of the targets
+// kept by name are still counted.
+func (b *proxyBalancer) update(targets []*middleware.ProxyTarget, weights map[string]int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	kept := map[string]*proxyBalancerTarget{}
+	for _, t := range b.targets {
+		kept[t.Name] = t
+	}
+	b.weights = map[string]int{}
+	for name, w := range weights {
+		b.weights[name] = w
+	}
+	b.targets = make([]*proxyBalancerTarget, len(targets))
+	for i, t := range targets {
+		bt := kept[t.Name]
+		if bt == nil {
+			bt = new(proxyBalancerTarget)
+		}
+		bt.ProxyTarget, bt.balancer, bt.weight, bt.current = t, b, b.weight(t.Name), 0
+		b.targets[i] = bt
+	}
+}
+
+func (b *proxyBalancer) weight(name string) int {
+	if w := b.weights[name]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// setWeight sets the weight of the target name.
+func (b *proxyBalancer) setWeight(name string, weight int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.weights[name] = weight
+	for _, t := range b.targets {
+		if t.Name == name {
+			t.weight = b.weight(name)
+		}
+	}
+}
+
+func (b *proxyBalancer) AddTarget(target *middleware.ProxyTarget) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, t := range b.targets {
+		if t.Name == target.Name {
+			return false
+		}
+	}
+	b.targets = append(b.targets, &proxyBalancerTarget{ProxyTarget: target, balancer: b, weight: b.weight(target.Name)})
+	return true
+}
+
+func (b *proxyBalancer) RemoveTarget(name string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, t := range b.targets {
+		if t.Name == name {
+			b.targets = append(b.targets[:i], b.targets[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *proxyBalancer) Next(c echo.Context) *middleware.ProxyTarget {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.targets) == 0 {
+		return nil
+	}
+	var best *proxyBalancerTarget
+	if b.leastConn {
+		// Ties rotate between the targets
+		b.next = (b.next + 1) % len(b.targets)
+		for i := range b.targets {
+			t := b.targets[(b.next+i)%len(b.targets)]
+			if best == nil || t.active*best.weight < best.active*t.weight {
+				best = t
+			}
+		}
+		best.active++
+		c.Set(proxyBalancerKey, best)
+		return best.ProxyTarget
+	}
+	total := 0
+	for _, t := range b.targets {
+		t.current += t.weight
+		total += t.weight
+		if best == nil || t.current > best.current {
+			best = t
+		}
+	}
+	best.current -= total
+	return best.ProxyTarget
+}
+
+// pick returns the target name, counted as active by least_conn.
+func (b *proxyBalancer) pick(c echo.Context, name string) *middleware.ProxyTarget {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, t := range b.targets {
+		if t.Name == name {
+			if b.leastConn {
+				t.active++
+				c.Set(proxyBalancerKey, t)
+			}
+			return t.ProxyTarget
+		}
+	}
+	return nil
+}
+
+// release ends the active request of c, counted by b or another balancer
+// of the proxy, e.g. of a split group.
+func (b *proxyBalancer) release(c echo.Context) {
+	if t, ok := c.Get(proxyBalancerKey).(*proxyBalancerTarget); ok {
+		t.balancer.mutex.Lock()
+		t.active--
+		t.balancer.mutex.Unlock()
+	}
+}
+
+func (b *syncBalancer) wrapped() middleware.ProxyBalancer {
+	return b.balancer
+}
+
+func (b *syncBalancer) AddTarget(target *middleware.ProxyTarget) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.balancer.AddTarget(target)
+}
+
+func (b *syncBalancer) RemoveTarget(name string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.balancer.RemoveTarget(name)
+}
+
+func (b *syncBalancer) Next(c echo.Context) *middleware.ProxyTarget {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.balancer.Next(c)
+}
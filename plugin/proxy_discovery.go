@@ -0,0 +1,423 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	// Discovery of the targets, by the A/AAAA records of the url host with
+	// the url port, by the SRV records of the url host, or the instances of
+	// the service of the url host in Consul or etcd
+	ProxyDiscoveryDNS    = "dns"
+	ProxyDiscoverySRV    = "srv"
+	ProxyDiscoveryConsul = "consul"
+	ProxyDiscoveryEtcd   = "etcd"
+)
+
+type (
+	// ProxyDiscovery re-resolves the targets discovered by DNS every Interval
+	// (default 30s), within Timeout (default 5s), and watches the ones of
+	// Consul and etcd. On errors, or if none is found, the addresses last
+	// resolved are kept.
+	ProxyDiscovery struct {
+		Interval time.Duration `yaml:"interval"`
+		Timeout  time.Duration `yaml:"timeout"`
+		Consul   ProxyConsul   `yaml:"consul"`
+		Etcd     ProxyEtcd     `yaml:"etcd"`
+	}
+
+	// proxyResolver resolves the discovered targets, a *net.Resolver.
+	proxyResolver interface {
+		LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+		LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	}
+
+	// proxyDiscovery adds and removes the targets resolved of the discovery
+	// targets.
+	proxyDiscovery struct {
+		config     ProxyDiscovery
+		resolver   proxyResolver
+		registries map[string]proxyRegistry
+		transport  *proxyTransport
+		upstream   ProxyUpstream
+		logger     *log.Logger
+
+		balancer middleware.ProxyBalancer
+		health   *proxyHealthChecker
+		entries  []*discoveryEntry
+		resolved int32
+
+		ctx    context.Context
+		cancel context.CancelFunc
+		wg     sync.WaitGroup
+	}
+
+	// discoveryEntry is a discovery target, the targets are changed by a
+	// goroutine at a time.
+	discoveryEntry struct {
+		target  *Target
+		name    string
+		url     *url.URL
+		targets map[string]discoveredTarget
+		// index of the registry
+		index uint64
+	}
+
+	discoveredTarget struct {
+		*middleware.ProxyTarget
+		weight int
+	}
+)
+
+// defaultProxyResolver is the resolver of the discovery, replaced by tests.
+var defaultProxyResolver proxyResolver = net.DefaultResolver
+
+func (d ProxyDiscovery) interval() time.Duration {
+	if d.Interval == 0 {
+		return 30 * time.Second
+	}
+	return d.Interval
+}
+
+func (d ProxyDiscovery) timeout() time.Duration {
+	if d.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return d.Timeout
+}
+
+func (d ProxyDiscovery) validate() error {
+	if d.Interval < 0 || d.Timeout < 0 {
+		return fmt.Errorf("invalid proxy discovery settings")
+	}
+	if err := d.Consul.validate(); err != nil {
+		return err
+	}
+	return d.Etcd.validate()
+}
+
+func validateProxyDiscovery(t *Target, u *url.URL) error {
+	switch t.Discovery {
+	case "":
+		return nil
+	case ProxyDiscoveryDNS, ProxyDiscoverySRV, ProxyDiscoveryConsul, ProxyDiscoveryEtcd:
+	default:
+		return fmt.Errorf("invalid proxy discovery=%s", t.Discovery)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("proxy discovery requires a host, url=%s", t.URL)
+	}
+	if t.Discovery != ProxyDiscoveryDNS && u.Port() != "" {
+		return fmt.Errorf("proxy discovery=%s url=%s has a port, of the records instead", t.Discovery, t.URL)
+	}
+	return nil
+}
+
+// newProxyDiscovery returns the discovery of targets, the transport is set up
+// for the targets resolved, with the upstream settings of the proxy.
+func newProxyDiscovery(config ProxyDiscovery, transport *proxyTransport, upstream ProxyUpstream, logger *log.Logger) *proxyDiscovery {
+	// No timeout, the blocking queries are of a context
+	client := new(http.Client)
+	d := &proxyDiscovery{
+		config:   config,
+		resolver: defaultProxyResolver,
+		registries: map[string]proxyRegistry{
+			ProxyDiscoveryConsul: &consulRegistry{config: config.Consul, client: client},
+			ProxyDiscoveryEtcd:   &etcdRegistry{config: config.Etcd, client: client},
+		},
+		transport: transport,
+		upstream:  upstream,
+		logger:    logger,
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	return d
+}
+
+// add resolves the target t, it returns the targets resolved, none if the
+// resolution fails. The transports of old are kept, as by setUpstream.
+func (d *proxyDiscovery) add(t *Target, pt *middleware.ProxyTarget, old *proxyTransport) []discoveredTarget {
+	e := &discoveryEntry{target: t, name: pt.Name, url: pt.URL, targets: map[string]discoveredTarget{}}
+	d.entries = append(d.entries, e)
+	ctx, cancel := context.WithTimeout(d.ctx, d.config.timeout())
+	defer cancel()
+	resolved, index, err := d.lookup(ctx, e, 0)
+	if err != nil {
+		d.warn(e, err)
+		return nil
+	}
+	e.index = index
+	var targets []discoveredTarget
+	for name, dt := range resolved {
+		if d.prepare(e, dt, old) {
+			e.targets[name] = dt
+			targets = append(targets, dt)
+		}
+	}
+	if len(targets) > 0 {
+		atomic.StoreInt32(&d.resolved, 1)
+	}
+	return targets
+}
+
+// start re-resolves the targets in the background, they are added to and
+// removed from balancer, through the health checks if any.
+func (d *proxyDiscovery) start(balancer middleware.ProxyBalancer, health *proxyHealthChecker) {
+	d.balancer, d.health = balancer, health
+	for _, e := range d.entries {
+		if d.registries[e.target.Discovery] != nil {
+			d.wg.Add(1)
+			go d.watch(e)
+		}
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(d.config.interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-ticker.C:
+				d.refresh()
+			}
+		}
+	}()
+}
+
+// watch applies the changes of the registry of e, with blocking queries.
+func (d *proxyDiscovery) watch(e *discoveryEntry) {
+	defer d.wg.Done()
+	delay := time.Second
+	for {
+		ctx, cancel := context.WithTimeout(d.ctx, registryWait+registryWait/16+d.config.timeout())
+		resolved, index, err := d.lookup(ctx, e, e.index)
+		cancel()
+		if d.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			d.warn(e, err)
+			// Queried anew, e.g. of an expired index
+			e.index = 0
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > d.config.interval() {
+				delay = d.config.interval()
+			}
+			continue
+		}
+		delay = time.Second
+		switch {
+		case index == 0:
+			// No index, polled
+			d.apply(e, resolved)
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(d.config.interval()):
+			}
+		case index < e.index:
+			// Reset, queried anew
+			e.index = 0
+		case index > e.index:
+			e.index = index
+			d.apply(e, resolved)
+		}
+	}
+}
+
+// available reports whether a target was resolved, the balancers have no
+// empty rotation.
+func (d *proxyDiscovery) available() bool {
+	return atomic.LoadInt32(&d.resolved) == 1
+}
+
+// refresh re-resolves the targets discovered by DNS.
+func (d *proxyDiscovery) refresh() {
+	for _, e := range d.entries {
+		if d.registries[e.target.Discovery] != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(d.ctx, d.config.timeout())
+		resolved, _, err := d.lookup(ctx, e, 0)
+		cancel()
+		if err != nil {
+			d.warn(e, err)
+			continue
+		}
+		d.apply(e, resolved)
+	}
+}
+
+// apply adds and removes the targets of e, resolved, kept if none.
+func (d *proxyDiscovery) apply(e *discoveryEntry, resolved map[string]discoveredTarget) {
+	if len(resolved) == 0 {
+		if len(e.targets) > 0 && d.logger != nil {
+			d.logger.Warnf("proxy: no targets of target=%s, keeping the %d last", e.url, len(e.targets))
+		}
+		return
+	}
+	for name, dt := range resolved {
+		if _, ok := e.targets[name]; ok || !d.prepare(e, dt, nil) {
+			continue
+		}
+		e.targets[name] = dt
+		d.addTarget(e, dt)
+		atomic.StoreInt32(&d.resolved, 1)
+		if d.logger != nil {
+			d.logger.Infof("proxy: discovered target=%s", dt.URL)
+		}
+	}
+	for name, dt := range e.targets {
+		if _, ok := resolved[name]; ok {
+			continue
+		}
+		delete(e.targets, name)
+		if d.health != nil {
+			d.health.remove(name)
+		} else {
+			d.balancer.RemoveTarget(name)
+		}
+		d.transport.remove(dt.URL)
+		if d.logger != nil {
+			d.logger.Infof("proxy: removed discovered target=%s", dt.URL)
+		}
+	}
+}
+
+func (d *proxyDiscovery) addTarget(e *discoveryEntry, dt discoveredTarget) {
+	weighted := unwrapBalancer(d.balancer)
+	if s, ok := innerBalancer(d.balancer).(*splitBalancer); ok {
+		weighted = unwrapBalancer(s.assign(dt.Name, e.target.Group))
+	}
+	if weighted != nil && dt.weight > 0 {
+		weighted.setWeight(dt.Name, dt.weight)
+	}
+	if d.health != nil {
+		d.health.add(dt.ProxyTarget)
+	} else {
+		d.balancer.AddTarget(dt.ProxyTarget)
+	}
+}
+
+// lookup returns the targets resolved of e, by name, and the index of the
+// registry after index.
+func (d *proxyDiscovery) lookup(ctx context.Context, e *discoveryEntry, index uint64) (map[string]discoveredTarget, uint64, error) {
+	targets := map[string]discoveredTarget{}
+	target := func(host string, weight int) {
+		u := *e.url
+		u.Host = host
+		name := e.name + "@" + host
+		targets[name] = discoveredTarget{&middleware.ProxyTarget{Name: name, URL: &u}, weight}
+	}
+	if r := d.registries[e.target.Discovery]; r != nil {
+		instances, next, err := r.instances(ctx, e.url.Hostname(), index)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, i := range instances {
+			weight := e.target.Weight
+			if weight == 0 {
+				weight = i.weight
+			}
+			target(i.address, weight)
+		}
+		return targets, next, nil
+	}
+	if e.target.Discovery == ProxyDiscoverySRV {
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", e.url.Hostname())
+		if err != nil {
+			return nil, 0, err
+		}
+		// Only the records of the lowest priority are used
+		for _, r := range records {
+			if r.Priority != records[0].Priority {
+				continue
+			}
+			weight := e.target.Weight
+			if weight == 0 {
+				weight = int(r.Weight)
+			}
+			target(net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))), weight)
+		}
+		return targets, 0, nil
+	}
+	addrs, err := d.resolver.LookupIPAddr(ctx, e.url.Hostname())
+	if err != nil {
+		return nil, 0, err
+	}
+	port := e.url.Port()
+	if port == "" {
+		port = "80"
+		if e.url.Scheme == "https" {
+			port = "443"
+		}
+	}
+	for _, a := range addrs {
+		target(net.JoinHostPort(a.IP.String(), port), e.target.Weight)
+	}
+	return targets, 0, nil
+}
+
+// prepare sets the protocol and the upstream settings of dt, the TLS server
+// name of the addresses of a host is the host.
+func (d *proxyDiscovery) prepare(e *discoveryEntry, dt discoveredTarget, old *proxyTransport) bool {
+	d.transport.setProtocol(dt.URL, e.target.Protocol)
+	upstream := e.target.Upstream
+	if e.target.Discovery == ProxyDiscoveryDNS && dt.URL.Scheme == "https" {
+		u := d.upstream
+		if upstream != nil {
+			u = *upstream
+		}
+		if u.TLS.ServerName == "" {
+			u.TLS.ServerName = e.url.Hostname()
+		}
+		upstream = &u
+	}
+	if upstream == nil {
+		return true
+	}
+	if err := d.transport.setUpstream(dt.URL, *upstream, old); err != nil {
+		if d.logger != nil {
+			d.logger.Errorf("proxy: discovered target=%s: %v", dt.URL, err)
+		}
+		return false
+	}
+	return true
+}
+
+func (d *proxyDiscovery) warn(e *discoveryEntry, err error) {
+	if d.logger != nil {
+		d.logger.Warnf("proxy: failed to resolve target=%s, %v", e.url, err)
+	}
+}
+
+// stop stops the resolutions, it returns once stopped or ctx is done.
+func (d *proxyDiscovery) stop(ctx context.Context) {
+	d.cancel()
+	stopped := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,250 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+)
+
+type (
+	// ProxyHealthCheck actively checks the targets with a GET of Path every
+	// Interval (default 10s), 2xx and 3xx responses within Timeout (default
+	// 2s) are healthy. A target leaves the rotation after UnhealthyThreshold
+	// (default 3) failed checks in a row and returns after HealthyThreshold
+	// (default 2) successful ones. If all targets are unhealthy all are kept.
+	ProxyHealthCheck struct {
+		Path               string        `yaml:"path"`
+		Interval           time.Duration `yaml:"interval"`
+		Timeout            time.Duration `yaml:"timeout"`
+		HealthyThreshold   int           `yaml:"healthy_threshold"`
+		UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+	}
+
+	// TargetHealth is the health check state of a proxy target.
+	TargetHealth struct {
+		Name       string    `json:"name"`
+		URL        string    `json:"url"`
+		Healthy    bool      `json:"healthy"`
+		InRotation bool      `json:"in_rotation"`
+		Failures   int       `json:"failures"`
+		LastError  string    `json:"last_error,omitempty"`
+		LastCheck  time.Time `json:"last_check"`
+	}
+
+	proxyHealthChecker struct {
+		config   ProxyHealthCheck
+		balancer middleware.ProxyBalancer
+		client   *http.Client
+		logger   *log.Logger
+
+		mutex   sync.RWMutex
+		targets []*proxyTargetHealth
+
+		done    chan struct{}
+		stopped chan struct{}
+	}
+
+	proxyTargetHealth struct {
+		target     *middleware.ProxyTarget
+		healthy    bool
+		inRotation bool
+		successes  int
+		failures   int
+		lastError  string
+		lastCheck  time.Time
+	}
+)
+
+func (h ProxyHealthCheck) interval() time.Duration {
+	if h.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return h.Interval
+}
+
+func (h ProxyHealthCheck) timeout() time.Duration {
+	if h.Timeout <= 0 {
+		return 2 * time.Second
+	}
+	return h.Timeout
+}
+
+func (h ProxyHealthCheck) healthyThreshold() int {
+	if h.HealthyThreshold <= 0 {
+		return 2
+	}
+	return h.HealthyThreshold
+}
+
+func (h ProxyHealthCheck) unhealthyThreshold() int {
+	if h.UnhealthyThreshold <= 0 {
+		return 3
+	}
+	return h.UnhealthyThreshold
+}
+
+// newProxyHealthChecker checks the targets, all initially in the rotation of
+// balancer, in the background with transport.
+func newProxyHealthChecker(config ProxyHealthCheck, balancer middleware.ProxyBalancer, targets []*middleware.ProxyTarget, transport http.RoundTripper, logger *log.Logger) *proxyHealthChecker {
+	hc := &proxyHealthChecker{
+		config:   config,
+		balancer: balancer,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.timeout(),
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		logger:  logger,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for _, t := range targets {
+		hc.targets = append(hc.targets, &proxyTargetHealth{target: t, healthy: true, inRotation: true})
+	}
+	go func() {
+		defer close(hc.stopped)
+		ticker := time.NewTicker(config.interval())
+		defer ticker.Stop()
+		for {
+			hc.checkAll()
+			select {
+			case <-hc.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return hc
+}
+
+func (hc *proxyHealthChecker) checkAll() {
+	// Targets are added and removed by the discovery
+	hc.mutex.RLock()
+	targets := append([]*proxyTargetHealth(nil), hc.targets...)
+	hc.mutex.RUnlock()
+	var wg sync.WaitGroup
+	errs := make([]error, len(targets))
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *proxyTargetHealth) {
+			defer wg.Done()
+			errs[i] = hc.check(t.target)
+		}(i, t)
+	}
+	wg.Wait()
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	now := time.Now()
+	for i, t := range targets {
+		t.lastCheck = now
+		if err := errs[i]; err != nil {
+			t.successes, t.lastError = 0, err.Error()
+			t.failures++
+			if t.healthy && t.failures >= hc.config.unhealthyThreshold() {
+				t.healthy = false
+				if hc.logger != nil {
+					hc.logger.Warnf("proxy: target=%s is unhealthy: %v", t.target.URL, err)
+				}
+			}
+		} else {
+			t.failures, t.lastError = 0, ""
+			t.successes++
+			if !t.healthy && t.successes >= hc.config.healthyThreshold() {
+				t.healthy = true
+				if hc.logger != nil {
+					hc.logger.Infof("proxy: target=%s is healthy", t.target.URL)
+				}
+			}
+		}
+	}
+	hc.rotate()
+}
+
+// add checks the target t, healthy until checked.
+func (hc *proxyHealthChecker) add(t *middleware.ProxyTarget) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	hc.targets = append(hc.targets, &proxyTargetHealth{target: t, healthy: true})
+	hc.rotate()
+}
+
+// remove stops checking the target name.
+func (hc *proxyHealthChecker) remove(name string) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	for i, t := range hc.targets {
+		if t.target.Name == name {
+			hc.targets = append(hc.targets[:i], hc.targets[i+1:]...)
+			if t.inRotation {
+				hc.balancer.RemoveTarget(name)
+			}
+			break
+		}
+	}
+	hc.rotate()
+}
+
+// rotate keeps the healthy targets in the rotation, or all if none is.
+func (hc *proxyHealthChecker) rotate() {
+	healthy := false
+	for _, t := range hc.targets {
+		healthy = healthy || t.healthy
+	}
+	for _, t := range hc.targets {
+		want := t.healthy || !healthy
+		if want && !t.inRotation {
+			hc.balancer.AddTarget(t.target)
+		} else if !want && t.inRotation {
+			hc.balancer.RemoveTarget(t.target.Name)
+		}
+		t.inRotation = want
+	}
+}
+
+func (hc *proxyHealthChecker) check(t *middleware.ProxyTarget) error {
+	res, err := hc.client.Get(strings.TrimSuffix(t.URL.String(), "/") + hc.config.Path)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status=%d", res.StatusCode)
+	}
+	return nil
+}
+
+func (hc *proxyHealthChecker) health() []TargetHealth {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+	health := make([]TargetHealth, len(hc.targets))
+	for i, t := range hc.targets {
+		health[i] = TargetHealth{
+			Name:       t.target.Name,
+			URL:        t.target.URL.String(),
+			Healthy:    t.healthy,
+			InRotation: t.inRotation,
+			Failures:   t.failures,
+			LastError:  t.lastError,
+			LastCheck:  t.lastCheck,
+		}
+	}
+	return health
+}
+
+// stop stops the checks, it returns once stopped or ctx is done.
+func (hc *proxyHealthChecker) stop(ctx context.Context) {
+	close(hc.done)
+	select {
+	case <-hc.stopped:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,168 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// ProxyMirror sends a copy of Percent of the requests to the shadow
+	// upstream URL in the background, its responses are discarded.
+	ProxyMirror struct {
+		URL     string  `yaml:"url"`
+		Percent float64 `yaml:"percent"`
+
+		// Timeout of the mirrored requests, default 5s.
+		Timeout time.Duration `yaml:"timeout"`
+
+		// MaxBodySize is the largest request body mirrored, default 1M bytes,
+		// larger requests are not mirrored.
+		MaxBodySize int64 `yaml:"max_body_size"`
+
+		// Concurrency is the number of requests in flight, default 100,
+		// others are not mirrored.
+		Concurrency int `yaml:"concurrency"`
+	}
+)
+
+// proxyMirrorHeader marks the mirrored requests.
+const proxyMirrorHeader = "X-Armor-Mirror"
+
+func (m ProxyMirror) enabled() bool {
+	return m.URL != "" && m.Percent > 0
+}
+
+func (m ProxyMirror) timeout() time.Duration {
+	if m.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return m.Timeout
+}
+
+func (m ProxyMirror) maxBodySize() int64 {
+	if m.MaxBodySize == 0 {
+		return 1 << 20
+	}
+	return m.MaxBodySize
+}
+
+func (m ProxyMirror) concurrency() int {
+	if m.Concurrency == 0 {
+		return 100
+	}
+	return m.Concurrency
+}
+
+func (m ProxyMirror) validate() error {
+	if m.URL != "" {
+		if u, err := url.Parse(m.URL); err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid proxy mirror url=%s", m.URL)
+		}
+	}
+	if m.Percent < 0 || m.Percent > 100 {
+		return fmt.Errorf("invalid proxy mirror percent=%v", m.Percent)
+	}
+	if m.Timeout < 0 || m.MaxBodySize < 0 || m.Concurrency < 0 {
+		return fmt.Errorf("invalid proxy mirror settings")
+	}
+	return nil
+}
+
+// mirrorMiddleware mirrors the sampled requests before proxying them with
+// mid.
+func mirrorMiddleware(config ProxyMirror, mid echo.MiddlewareFunc) echo.MiddlewareFunc {
+	target, _ := url.Parse(config.URL)
+	client := &http.Client{
+		Timeout: config.timeout(),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	inflight := make(chan struct{}, config.concurrency())
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := mid(next)
+		return func(c echo.Context) error {
+			if c.IsWebSocket() || rand.Float64()*100 >= config.Percent {
+				return h(c)
+			}
+			req := c.Request()
+			var body []byte
+			if req.Body != nil && req.Body != http.NoBody {
+				if req.ContentLength > config.maxBodySize() {
+					proxyMirrored.WithLabelValues("skipped").Inc()
+					return h(c)
+				}
+				// Read at most one byte more not to mirror a truncated body
+				b, err := ioutil.ReadAll(io.LimitReader(req.Body, config.maxBodySize()+1))
+				if err != nil {
+					return err
+				}
+				if int64(len(b)) > config.maxBodySize() {
+					req.Body = readCloser{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+					proxyMirrored.WithLabelValues("skipped").Inc()
+					return h(c)
+				}
+				req.Body, body = ioutil.NopCloser(bytes.NewReader(b)), b
+			}
+			select {
+			case inflight <- struct{}{}:
+				mreq := mirrorRequest(req, target, body)
+				go func() {
+					defer func() { <-inflight }()
+					sendMirror(client, mreq)
+				}()
+			default:
+				proxyMirrored.WithLabelValues("dropped").Inc()
+			}
+			return h(c)
+		}
+	}
+}
+
+// readCloser reads from Reader and closes Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// mirrorRequest returns the copy of r to target, with its own context.
+func mirrorRequest(r *http.Request, target *url.URL, body []byte) *http.Request {
+	u := *r.URL
+	u.Scheme, u.Host = target.Scheme, target.Host
+	if p := strings.TrimSuffix(target.Path, "/"); p != "" {
+		u.Path = p + u.Path
+	}
+	m := r.WithContext(context.Background())
+	m.URL, m.Host, m.RequestURI = &u, target.Host, ""
+	m.Header = make(http.Header, len(r.Header)+1)
+	for k, v := range r.Header {
+		m.Header[k] = append([]string(nil), v...)
+	}
+	m.Header.Set(proxyMirrorHeader, "true")
+	m.Body, m.ContentLength, m.TransferEncoding = http.NoBody, int64(len(body)), nil
+	if body != nil {
+		m.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return m
+}
+
+func sendMirror(client *http.Client, r *http.Request) {
+	res, err := client.Do(r)
+	if err != nil {
+		proxyMirrored.WithLabelValues("error").Inc()
+		return
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	proxyMirrored.WithLabelValues(StatusClass(res.StatusCode)).Inc()
+}
@@ -0,0 +1,240 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// ProxyConsul is the Consul agent of the targets discovered in the
+	// service catalog, the instances passing their health checks.
+	ProxyConsul struct {
+		// Address of the agent, default `http://localhost:8500`.
+		Address    string `yaml:"address"`
+		Token      string `yaml:"token" armor:"probe,secret"`
+		Datacenter string `yaml:"datacenter"`
+
+		// Tag filters the instances of the services.
+		Tag string `yaml:"tag"`
+	}
+
+	// ProxyEtcd is the etcd cluster, of the v2 API, of the targets
+	// registered as the `host:port` values of the keys under Prefix/<host>.
+	ProxyEtcd struct {
+		// Endpoints, default `http://localhost:2379`.
+		Endpoints []string `yaml:"endpoints"`
+
+		// Prefix of the keys, default `/armor/upstreams`.
+		Prefix   string `yaml:"prefix"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password" armor:"probe,secret"`
+	}
+
+	// proxyRegistry is a service registry, the instances of a service are
+	// returned with the index of the registry, once changed since index if
+	// not 0.
+	proxyRegistry interface {
+		instances(ctx context.Context, service string, index uint64) ([]registryInstance, uint64, error)
+	}
+
+	registryInstance struct {
+		address string
+		weight  int
+	}
+
+	consulRegistry struct {
+		config ProxyConsul
+		client *http.Client
+	}
+
+	etcdRegistry struct {
+		config ProxyEtcd
+		client *http.Client
+	}
+
+	consulServiceEntry struct {
+		Node struct {
+			Address string `json:"Address"`
+		} `json:"Node"`
+		Service struct {
+			Address string `json:"Address"`
+			Port    int    `json:"Port"`
+			Weights struct {
+				Passing int `json:"Passing"`
+			} `json:"Weights"`
+		} `json:"Service"`
+	}
+
+	etcdNode struct {
+		Key   string      `json:"key"`
+		Value string      `json:"value"`
+		Dir   bool        `json:"dir"`
+		Nodes []*etcdNode `json:"nodes"`
+	}
+)
+
+// registryWait is the wait of the blocking queries.
+const registryWait = 5 * time.Minute
+
+func (c ProxyConsul) address() string {
+	if c.Address == "" {
+		return "http://localhost:8500"
+	}
+	return strings.TrimSuffix(c.Address, "/")
+}
+
+func (c ProxyEtcd) endpoints() []string {
+	if len(c.Endpoints) == 0 {
+		return []string{"http://localhost:2379"}
+	}
+	return c.Endpoints
+}
+
+func (c ProxyEtcd) prefix() string {
+	if c.Prefix == "" {
+		return "/armor/upstreams"
+	}
+	return "/" + strings.Trim(c.Prefix, "/")
+}
+
+func (c ProxyConsul) validate() error {
+	if u, err := url.Parse(c.address()); err != nil || u.Host == "" {
+		return fmt.Errorf("invalid proxy discovery consul address=%s", c.Address)
+	}
+	return nil
+}
+
+func (c ProxyEtcd) validate() error {
+	for _, e := range c.Endpoints {
+		if u, err := url.Parse(e); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy discovery etcd endpoint=%s", e)
+		}
+	}
+	return nil
+}
+
+// registryGet returns the body of the response to req, an error if not 200,
+// and the index header.
+func registryGet(ctx context.Context, client *http.Client, req *http.Request, indexHeader string) ([]byte, uint64, error) {
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 16<<20))
+	if err != nil {
+		return nil, 0, err
+	}
+	index, _ := strconv.ParseUint(res.Header.Get(indexHeader), 10, 64)
+	if res.StatusCode != http.StatusOK {
+		return b, index, fmt.Errorf("%s, %s", req.URL.Path, res.Status)
+	}
+	return b, index, nil
+}
+
+func (r *consulRegistry) instances(ctx context.Context, service string, index uint64) ([]registryInstance, uint64, error) {
+	q := url.Values{"passing": {"1"}}
+	if r.config.Datacenter != "" {
+		q.Set("dc", r.config.Datacenter)
+	}
+	if r.config.Tag != "" {
+		q.Set("tag", r.config.Tag)
+	}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", registryWait.String())
+	}
+	req, err := http.NewRequest(http.MethodGet, r.config.address()+"/v1/health/service/"+url.PathEscape(service)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.config.Token != "" {
+		req.Header.Set("X-Consul-Token", r.config.Token)
+	}
+	b, next, err := registryGet(ctx, r.client, req, "X-Consul-Index")
+	if err != nil {
+		return nil, 0, err
+	}
+	var entries []consulServiceEntry
+	if err = json.Unmarshal(b, &entries); err != nil {
+		return nil, 0, err
+	}
+	instances := make([]registryInstance, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		instances = append(instances, registryInstance{net.JoinHostPort(host, strconv.Itoa(e.Service.Port)), e.Service.Weights.Passing})
+	}
+	return instances, next, nil
+}
+
+func (r *etcdRegistry) instances(ctx context.Context, service string, index uint64) ([]registryInstance, uint64, error) {
+	key := r.config.prefix() + "/" + url.PathEscape(service)
+	if index > 0 {
+		// Wait for a change, then get all
+		if _, _, err := r.get(ctx, key, url.Values{"wait": {"true"}, "recursive": {"true"}, "waitIndex": {strconv.FormatUint(index+1, 10)}}); err != nil {
+			return nil, 0, err
+		}
+	}
+	var body struct {
+		ErrorCode int       `json:"errorCode"`
+		Node      *etcdNode `json:"node"`
+	}
+	b, next, err := r.get(ctx, key, url.Values{"recursive": {"true"}})
+	if err != nil {
+		// Key not found, none registered
+		if json.Unmarshal(b, &body) == nil && body.ErrorCode == 100 {
+			return nil, next, nil
+		}
+		return nil, 0, err
+	}
+	if err = json.Unmarshal(b, &body); err != nil {
+		return nil, 0, err
+	}
+	var instances []registryInstance
+	var walk func(n *etcdNode)
+	walk = func(n *etcdNode) {
+		if !n.Dir {
+			if v := strings.TrimSpace(n.Value); v != "" {
+				instances = append(instances, registryInstance{address: v})
+			}
+		}
+		for _, c := range n.Nodes {
+			walk(c)
+		}
+	}
+	if body.Node != nil {
+		walk(body.Node)
+	}
+	return instances, next, nil
+}
+
+// get returns the response of the first endpoint answering.
+func (r *etcdRegistry) get(ctx context.Context, key string, q url.Values) (b []byte, index uint64, err error) {
+	err = errors.New("no etcd endpoint")
+	for _, e := range r.config.endpoints() {
+		var req *http.Request
+		if req, err = http.NewRequest(http.MethodGet, strings.TrimSuffix(e, "/")+"/v2/keys"+key+"?"+q.Encode(), nil); err != nil {
+			return
+		}
+		if r.config.Username != "" {
+			req.SetBasicAuth(r.config.Username, r.config.Password)
+		}
+		if b, index, err = registryGet(ctx, r.client, req, "X-Etcd-Index"); err == nil || b != nil || ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
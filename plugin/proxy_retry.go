@@ -0,0 +1,351 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+)
+
+type (
+	// ProxyRetry retries idempotent requests on another target up to Count
+	// times if the response status is one of Statuses (default 502, 503 and
+	// 504). PerTryTimeout limits each try.
+	ProxyRetry struct {
+		Count         int           `yaml:"count"`
+		Statuses      []int         `yaml:"statuses"`
+		PerTryTimeout time.Duration `yaml:"per_try_timeout"`
+	}
+
+	// ProxyCircuitBreaker stops proxying to a target after FailureThreshold
+	// 5xx responses in a row, after Cooldown (default 30s) one request tries
+	// it again.
+	ProxyCircuitBreaker struct {
+		FailureThreshold int           `yaml:"failure_threshold"`
+		Cooldown         time.Duration `yaml:"cooldown"`
+	}
+
+	proxyBreaker struct {
+		config ProxyCircuitBreaker
+		logger *log.Logger
+		mutex  sync.Mutex
+		states map[string]*proxyBreakerState
+	}
+
+	proxyBreakerState struct {
+		failures int
+		openedAt time.Time
+		probing  bool
+	}
+
+	// retryBalancer skips the targets already tried by the request and those
+	// with an open circuit.
+	retryBalancer struct {
+		middleware.ProxyBalancer
+		breaker *proxyBreaker
+		release func(echo.Context)
+
+		mutex   sync.RWMutex
+		targets map[string]bool
+	}
+
+	// proxyAttemptWriter drops the response of a try with a retryable status.
+	proxyAttemptWriter struct {
+		http.ResponseWriter
+		header    http.Header
+		retryable func(int) bool
+		wrote     bool
+		discarded bool
+	}
+)
+
+const (
+	proxyTriedKey  = "proxyTried"
+	proxyTargetKey = "proxyTargetName"
+)
+
+func (r ProxyRetry) retryable(status int) bool {
+	statuses := r.Statuses
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ProxyRetry) validate() error {
+	if r.Count < 0 {
+		return fmt.Errorf("invalid proxy retry count=%d", r.Count)
+	}
+	for _, s := range r.Statuses {
+		if s < 100 || s > 599 {
+			return fmt.Errorf("invalid proxy retry status=%d", s)
+		}
+	}
+	return nil
+}
+
+func (b ProxyCircuitBreaker) cooldown() time.Duration {
+	if b.Cooldown <= 0 {
+		return 30 * time.Second
+	}
+	return b.Cooldown
+}
+
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func newProxyBreaker(config ProxyCircuitBreaker, logger *log.Logger) *proxyBreaker {
+	return &proxyBreaker{config: config, logger: logger, states: map[string]*proxyBreakerState{}}
+}
+
+// ready reports whether the circuit of name is closed or may be probed.
+func (b *proxyBreaker) ready(name string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s := b.states[name]
+	return s == nil || s.failures < b.config.FailureThreshold ||
+		!s.probing && time.Since(s.openedAt) >= b.config.cooldown()
+}
+
+// allow reports whether a request may be proxied to name, it half-opens the
+// circuit after the cooldown.
+func (b *proxyBreaker) allow(name string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s := b.states[name]
+	if s == nil || s.failures < b.config.FailureThreshold {
+		return true
+	}
+	if s.probing || time.Since(s.openedAt) < b.config.cooldown() {
+		return false
+	}
+	s.probing = true
+	return true
+}
+
+func (b *proxyBreaker) record(name string, ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s := b.states[name]
+	if s == nil {
+		s = new(proxyBreakerState)
+		b.states[name] = s
+	}
+	if ok {
+		if s.failures >= b.config.FailureThreshold && b.logger != nil {
+			b.logger.Infof("proxy: target=%s circuit closed", name)
+		}
+		s.failures, s.probing = 0, false
+		return
+	}
+	s.failures++
+	if s.failures >= b.config.FailureThreshold {
+		if (s.probing || s.failures == b.config.FailureThreshold) && b.logger != nil {
+			b.logger.Warnf("proxy: target=%s circuit opened after %d failures", name, s.failures)
+		}
+		s.openedAt, s.probing = time.Now(), false
+	}
+}
+
+func newRetryBalancer(balancer middleware.ProxyBalancer, breaker *proxyBreaker, targets []*middleware.ProxyTarget) *retryBalancer {
+	b := &retryBalancer{ProxyBalancer: balancer, breaker: breaker, targets: map[string]bool{}}
+	for _, t := range targets {
+		b.targets[t.Name] = true
+	}
+	return b
+}
+
+func (b *retryBalancer) wrapped() middleware.ProxyBalancer {
+	return b.ProxyBalancer
+}
+
+func (b *retryBalancer) AddTarget(target *middleware.ProxyTarget) bool {
+	if !b.ProxyBalancer.AddTarget(target) {
+		return false
+	}
+	b.mutex.Lock()
+	b.targets[target.Name] = true
+	b.mutex.Unlock()
+	return true
+}
+
+func (b *retryBalancer) RemoveTarget(name string) bool {
+	if !b.ProxyBalancer.RemoveTarget(name) {
+		return false
+	}
+	b.mutex.Lock()
+	delete(b.targets, name)
+	b.mutex.Unlock()
+	return true
+}
+
+// available reports whether a target has no open circuit.
+func (b *retryBalancer) available() bool {
+	if b.breaker == nil {
+		return true
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for name := range b.targets {
+		if b.breaker.ready(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *retryBalancer) Next(c echo.Context) *middleware.ProxyTarget {
+	tried, _ := c.Get(proxyTriedKey).([]string)
+	b.mutex.RLock()
+	max := 2*len(b.targets) + 1
+	b.mutex.RUnlock()
+	for i := 0; ; i++ {
+		t := b.ProxyBalancer.Next(c)
+		if t == nil {
+			return nil
+		}
+		if i == max-1 || !containsString(tried, t.Name) && (b.breaker == nil || b.breaker.allow(t.Name)) {
+			c.Set(proxyTargetKey, t.Name)
+			return t
+		}
+		// Not proxied to, no longer active
+		if b.release != nil {
+			b.release(c)
+		}
+	}
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// retryMiddleware retries the proxy middleware mid and records the results of
+// the tries with the breaker.
+func retryMiddleware(config ProxyRetry, balancer *retryBalancer, mid echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := mid(next)
+		return func(c echo.Context) (err error) {
+			if !balancer.available() {
+				return echo.NewHTTPError(http.StatusServiceUnavailable)
+			}
+			req := c.Request()
+			defer c.SetRequest(req)
+			retries := config.Count
+			if !idempotentMethod(req.Method) || c.IsWebSocket() {
+				retries = 0
+			}
+			var body []byte
+			if retries > 0 && req.Body != nil && req.Body != http.NoBody {
+				if body, err = ioutil.ReadAll(req.Body); err != nil {
+					return
+				}
+				req.Body.Close()
+			}
+
+			var tried []string
+			for try := 0; ; try++ {
+				ctx, cancel := req.Context(), context.CancelFunc(func() {})
+				if config.PerTryTimeout > 0 {
+					ctx, cancel = context.WithTimeout(ctx, config.PerTryTimeout)
+				}
+				// The proxy rewrites the path
+				r := req.WithContext(ctx)
+				u := *req.URL
+				r.URL = &u
+				if body != nil {
+					r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				}
+				c.SetRequest(r)
+				c.Set(proxyTriedKey, tried)
+				c.Set(proxyTargetKey, "")
+
+				res := c.Response()
+				var w *proxyAttemptWriter
+				if try < retries {
+					w = &proxyAttemptWriter{ResponseWriter: res.Writer, header: http.Header{}, retryable: config.retryable}
+					for k, v := range res.Header() {
+						w.header[k] = v
+					}
+					res.Writer = w
+				}
+				err = h(c)
+				cancel()
+				if w != nil {
+					res.Writer = w.ResponseWriter
+				}
+				name, _ := c.Get(proxyTargetKey).(string)
+				if balancer.breaker != nil && name != "" {
+					balancer.breaker.record(name, err == nil && res.Status < http.StatusInternalServerError)
+				}
+				if w == nil || !w.discarded {
+					return
+				}
+				tried = append(tried, name)
+				res.Committed, res.Status, res.Size = false, http.StatusOK, 0
+			}
+		}
+	}
+}
+
+func (w *proxyAttemptWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *proxyAttemptWriter) WriteHeader(code int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	if w.retryable(code) {
+		w.discarded = true
+		return
+	}
+	h := w.ResponseWriter.Header()
+	for k := range h {
+		delete(h, k)
+	}
+	for k, v := range w.header {
+		h[k] = v
+	}
+	// Trailers are set after the body
+	w.header = h
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *proxyAttemptWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discarded {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *proxyAttemptWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.discarded {
+		f.Flush()
+	}
+}
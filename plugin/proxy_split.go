@@ -0,0 +1,235 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"gopkg.in/cas.v2"
+)
+
+type (
+	// ProxySplit sends Percent of the requests, and the ones matching a rule,
+	// to the targets of Group, e.g. a canary, the others to the targets
+	// without a group. The users of the auth plugins, or the clients by
+	// Cookie, keep their assignment.
+	ProxySplit struct {
+		Group   string           `yaml:"group"`
+		Percent float64          `yaml:"percent"`
+		Rules   []ProxySplitRule `yaml:"rules"`
+
+		// Cookie of the clients without a user, default `armor_split`, kept
+		// for CookieTTL, default 30 days.
+		Cookie    string        `yaml:"cookie"`
+		CookieTTL time.Duration `yaml:"cookie_ttl"`
+	}
+
+	// ProxySplitRule matches the requests with a Header, Cookie or CAS
+	// Attribute of one of Values, any value if empty.
+	ProxySplitRule struct {
+		Header    string   `yaml:"header"`
+		Cookie    string   `yaml:"cookie"`
+		Attribute string   `yaml:"attribute"`
+		Values    []string `yaml:"values"`
+	}
+
+	// splitBalancer balances the requests of a group with its own balancer.
+	splitBalancer struct {
+		config ProxySplit
+
+		mutex   sync.RWMutex
+		groups  map[string]middleware.ProxyBalancer
+		targets map[string]string
+		counts  map[string]int
+	}
+)
+
+func (s ProxySplit) enabled() bool {
+	return s.Group != ""
+}
+
+func (s ProxySplit) cookie() string {
+	if s.Cookie == "" {
+		return "armor_split"
+	}
+	return s.Cookie
+}
+
+func (s ProxySplit) cookieTTL() time.Duration {
+	if s.CookieTTL == 0 {
+		return 30 * 24 * time.Hour
+	}
+	return s.CookieTTL
+}
+
+func (s ProxySplit) validate(targets []*Target) error {
+	if s.Percent < 0 || s.Percent > 100 {
+		return fmt.Errorf("invalid proxy split percent=%v", s.Percent)
+	}
+	if s.CookieTTL < 0 {
+		return errors.New("invalid proxy split cookie ttl")
+	}
+	for _, r := range s.Rules {
+		n := 0
+		for _, k := range []string{r.Header, r.Cookie, r.Attribute} {
+			if k != "" {
+				n++
+			}
+		}
+		if n != 1 {
+			return errors.New("proxy split rule requires one of header, cookie or attribute")
+		}
+	}
+	grouped := 0
+	for _, t := range targets {
+		if t.Group != "" && t.Group != s.Group {
+			return fmt.Errorf("proxy target group=%s is not the split group", t.Group)
+		}
+		if t.Group != "" {
+			grouped++
+		}
+	}
+	if s.enabled() && grouped == 0 {
+		return fmt.Errorf("proxy split group=%s has no targets", s.Group)
+	}
+	return nil
+}
+
+// match reports whether the request of c matches r.
+func (r ProxySplitRule) match(c echo.Context) bool {
+	var values []string
+	req := c.Request()
+	switch {
+	case r.Header != "":
+		values = req.Header[http.CanonicalHeaderKey(r.Header)]
+	case r.Cookie != "":
+		if cookie, err := req.Cookie(r.Cookie); err == nil {
+			values = []string{cookie.Value}
+		}
+	case r.Attribute != "":
+		attrs, _ := req.Context().Value(CasAttributesCtxKey).(cas.UserAttributes)
+		values = attrs[r.Attribute]
+	}
+	if len(r.Values) == 0 {
+		return len(values) > 0
+	}
+	for _, v := range values {
+		if containsString(r.Values, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// grouped reports whether the request of c goes to the split group, by rule
+// or by the assignment of the user or the client.
+func (s ProxySplit) grouped(c echo.Context) bool {
+	for _, r := range s.Rules {
+		if r.match(c) {
+			return true
+		}
+	}
+	if s.Percent <= 0 {
+		return false
+	}
+	key := AuthSubject(c)
+	if key == "" {
+		if cookie, err := c.Cookie(s.cookie()); err == nil && cookie.Value != "" {
+			key = cookie.Value
+		} else if id, err := newRequestID(); err == nil {
+			key = id
+			c.SetCookie(&http.Cookie{
+				Name:     s.cookie(),
+				Value:    id,
+				Path:     "/",
+				MaxAge:   int(s.cookieTTL() / time.Second),
+				Secure:   c.IsTLS(),
+				HttpOnly: true,
+			})
+		}
+	}
+	// Per group, not to send the same users to all canaries
+	return float64(stickyHash(s.Group+"#"+key)%10000) < s.Percent*100
+}
+
+// newSplitBalancer returns the balancer of the groups, the balancers are of
+// the targets of each group, by target name.
+func newSplitBalancer(config ProxySplit, groups map[string]middleware.ProxyBalancer, targets map[string]string) *splitBalancer {
+	b := &splitBalancer{config: config, groups: groups, targets: targets, counts: map[string]int{}}
+	for _, group := range targets {
+		b.counts[group]++
+	}
+	return b
+}
+
+func (b *splitBalancer) AddTarget(target *middleware.ProxyTarget) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	// A target added again is of the group it left, a new one of none
+	group, ok := b.targets[target.Name]
+	if !ok {
+		b.targets[target.Name] = ""
+	}
+	if !b.groups[group].AddTarget(target) {
+		return false
+	}
+	b.counts[group]++
+	return true
+}
+
+func (b *splitBalancer) RemoveTarget(name string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	group, ok := b.targets[name]
+	if !ok || !b.groups[group].RemoveTarget(name) {
+		return false
+	}
+	b.counts[group]--
+	return true
+}
+
+// assign sets the group of the target name, if new, it returns the balancer
+// of its group.
+func (b *splitBalancer) assign(name, group string) middleware.ProxyBalancer {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if g, ok := b.targets[name]; ok {
+		group = g
+	} else {
+		b.targets[name] = group
+	}
+	return b.groups[group]
+}
+
+// Next returns a target of the group of the request of c, of the other group
+// if the group has none left.
+func (b *splitBalancer) Next(c echo.Context) *middleware.ProxyTarget {
+	group, other := "", b.config.Group
+	if b.config.grouped(c) {
+		group, other = other, group
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	// The balancers of the echo middleware have no empty rotation
+	if b.counts[group] == 0 {
+		if b.counts[other] == 0 {
+			return nil
+		}
+		group = other
+	}
+	return b.groups[group].Next(c)
+}
+
+// weighted returns a weighted balancer of a group, nil for the others.
+func (b *splitBalancer) weighted() *proxyBalancer {
+	for _, g := range b.groups {
+		if w := unwrapBalancer(g); w != nil {
+			return w
+		}
+	}
+	return nil
+}
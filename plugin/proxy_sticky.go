@@ -0,0 +1,218 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	// Sticky session modes
+	ProxyStickyCookie = "cookie"
+	ProxyStickyIP     = "ip"
+	ProxyStickyHeader = "header"
+)
+
+type (
+	// ProxySticky pins clients to a target, by a cookie naming the target or
+	// by a consistent hash of the client IP or a header. Clients whose target
+	// left the rotation are balanced again.
+	ProxySticky struct {
+		Mode      string        `yaml:"mode"`
+		Cookie    string        `yaml:"cookie"`
+		CookieTTL time.Duration `yaml:"cookie_ttl"`
+		Header    string        `yaml:"header"`
+
+		// TrustedProxies are the IPs or CIDRs of the proxies whose
+		// X-Forwarded-For is the client IP of the `ip` mode, else the client
+		// IP is the connection address.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+	}
+
+	// stickyBalancer pins clients to the targets of the wrapped balancer.
+	stickyBalancer struct {
+		middleware.ProxyBalancer
+		config  ProxySticky
+		trusted util.IPNets
+
+		mutex   sync.RWMutex
+		targets map[string]*middleware.ProxyTarget
+		ring    []stickyNode
+	}
+
+	stickyNode struct {
+		hash   uint32
+		target *middleware.ProxyTarget
+	}
+
+	// targetPicker counts a target picked by the sticky balancer as active.
+	targetPicker interface {
+		pick(c echo.Context, name string) *middleware.ProxyTarget
+	}
+)
+
+// stickyReplicas is the number of ring nodes of a target.
+const stickyReplicas = 100
+
+func (s ProxySticky) cookie() string {
+	if s.Cookie == "" {
+		return "armor_upstream"
+	}
+	return s.Cookie
+}
+
+func (s ProxySticky) validate() error {
+	switch s.Mode {
+	case "", ProxyStickyCookie, ProxyStickyIP:
+	case ProxyStickyHeader:
+		if s.Header == "" {
+			return fmt.Errorf("proxy sticky mode=%s requires a header", s.Mode)
+		}
+	default:
+		return fmt.Errorf("invalid proxy sticky mode=%s", s.Mode)
+	}
+	if _, err := util.ParseIPNets(s.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid proxy sticky trusted proxies: %v", err)
+	}
+	return nil
+}
+
+func newStickyBalancer(config ProxySticky, balancer middleware.ProxyBalancer, targets []*middleware.ProxyTarget) *stickyBalancer {
+	// Validated by ValidateConfig
+	trusted, _ := util.ParseIPNets(config.TrustedProxies)
+	b := &stickyBalancer{
+		ProxyBalancer: balancer,
+		config:        config,
+		trusted:       trusted,
+		targets:       map[string]*middleware.ProxyTarget{},
+	}
+	for _, t := range targets {
+		b.targets[t.Name] = t
+	}
+	b.build()
+	return b
+}
+
+func stickyHash(s string) uint32 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// stickyID is the opaque cookie value of a target.
+func stickyID(name string) string {
+	return strconv.FormatUint(uint64(stickyHash(name)), 36)
+}
+
+// build rebuilds the hash ring, the mutex is held.
+func (b *stickyBalancer) build() {
+	if b.config.Mode == ProxyStickyCookie {
+		return
+	}
+	b.ring = b.ring[:0]
+	for name, t := range b.targets {
+		for i := 0; i < stickyReplicas; i++ {
+			b.ring = append(b.ring, stickyNode{stickyHash(name + "#" + strconv.Itoa(i)), t})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+}
+
+func (b *stickyBalancer) wrapped() middleware.ProxyBalancer {
+	return b.ProxyBalancer
+}
+
+func (b *stickyBalancer) AddTarget(target *middleware.ProxyTarget) bool {
+	if !b.ProxyBalancer.AddTarget(target) {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.targets[target.Name] = target
+	b.build()
+	return true
+}
+
+func (b *stickyBalancer) RemoveTarget(name string) bool {
+	if !b.ProxyBalancer.RemoveTarget(name) {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.targets, name)
+	b.build()
+	return true
+}
+
+func (b *stickyBalancer) Next(c echo.Context) *middleware.ProxyTarget {
+	if b.config.Mode == ProxyStickyCookie {
+		return b.nextCookie(c)
+	}
+	key := remoteIP(c.Request(), b.trusted)
+	if b.config.Mode == ProxyStickyHeader {
+		key = c.Request().Header.Get(b.config.Header)
+	}
+	var target *middleware.ProxyTarget
+	b.mutex.RLock()
+	if key != "" && len(b.ring) > 0 {
+		h := stickyHash(key)
+		i := sort.Search(len(b.ring), func(i int) bool {
+			return b.ring[i].hash >= h
+		})
+		target = b.ring[i%len(b.ring)].target
+	}
+	b.mutex.RUnlock()
+	if target == nil {
+		return b.ProxyBalancer.Next(c)
+	}
+	return b.pick(c, target)
+}
+
+func (b *stickyBalancer) nextCookie(c echo.Context) *middleware.ProxyTarget {
+	if cookie, err := c.Cookie(b.config.cookie()); err == nil {
+		b.mutex.RLock()
+		var target *middleware.ProxyTarget
+		for name, t := range b.targets {
+			if stickyID(name) == cookie.Value {
+				target = t
+				break
+			}
+		}
+		b.mutex.RUnlock()
+		if target != nil {
+			return b.pick(c, target)
+		}
+	}
+	target := b.ProxyBalancer.Next(c)
+	if target != nil {
+		c.SetCookie(&http.Cookie{
+			Name:     b.config.cookie(),
+			Value:    stickyID(target.Name),
+			Path:     "/",
+			MaxAge:   int(b.config.CookieTTL / time.Second),
+			Secure:   c.IsTLS(),
+			HttpOnly: true,
+		})
+	}
+	return target
+}
+
+// pick returns target, counted by the wrapped balancer if it counts.
+func (b *stickyBalancer) pick(c echo.Context, target *middleware.ProxyTarget) *middleware.ProxyTarget {
+	if p, ok := b.ProxyBalancer.(targetPicker); ok {
+		if t := p.pick(c, target.Name); t != nil {
+			return t
+		}
+	}
+	return target
+}
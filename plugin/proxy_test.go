@@ -0,0 +1,870 @@
+package plugin
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"gopkg.in/cas.v2"
+)
+
+func TestProxyHealthCheck(t *testing.T) {
+	var healthy int32 = 1
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("up"))
+	}))
+	defer up.Close()
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("flaky"))
+	}))
+	defer flaky.Close()
+
+	p := validated(t, &Proxy{
+		Balance: "round-robin",
+		Targets: []*Target{{URL: up.URL}, {Name: "flaky", URL: flaky.URL}},
+		HealthCheck: ProxyHealthCheck{
+			Path:               "/health",
+			Interval:           time.Hour,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 2,
+		},
+	}).(*Proxy)
+	defer p.ShutdownGrace(context.Background())
+	// Wait for the initial check
+	for p.TargetHealth()[0].LastCheck.IsZero() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	h := p.Process(nil)
+	e := echo.New()
+	bodies := func() map[string]bool {
+		b := map[string]bool{}
+		for i := 0; i < 4; i++ {
+			rec := httptest.NewRecorder()
+			h(e.NewContext(httptest.NewRequest(echo.GET, "/", nil), rec))
+			b[rec.Body.String()] = true
+		}
+		return b
+	}
+	assert.Equal(t, map[string]bool{"up": true, "flaky": true}, bodies())
+
+	// Unhealthy after 2 failed checks
+	atomic.StoreInt32(&healthy, 0)
+	p.health.checkAll()
+	assert.True(t, p.TargetHealth()[1].InRotation)
+	p.health.checkAll()
+	health := p.TargetHealth()
+	assert.Equal(t, up.URL, health[0].Name)
+	assert.False(t, health[1].Healthy)
+	assert.False(t, health[1].InRotation)
+	assert.Equal(t, 2, health[1].Failures)
+	assert.Equal(t, "unexpected status=503", health[1].LastError)
+	assert.Equal(t, map[string]bool{"up": true}, bodies())
+
+	// All unhealthy keeps all
+	up.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	p.health.checkAll()
+	p.health.checkAll()
+	health = p.TargetHealth()
+	assert.False(t, health[0].Healthy)
+	assert.True(t, health[0].InRotation)
+	assert.True(t, health[1].InRotation)
+
+	// Recovery
+	atomic.StoreInt32(&healthy, 1)
+	p.health.checkAll()
+	health = p.TargetHealth()
+	assert.True(t, health[1].Healthy)
+	assert.False(t, health[0].InRotation)
+	assert.Equal(t, map[string]bool{"flaky": true}, bodies())
+
+	p.HealthCheck.Path = "health"
+	assert.Error(t, p.ValidateConfig())
+}
+
+func TestProxyWeightedRoundRobin(t *testing.T) {
+	p := validated(t, &Proxy{
+		Balance: ProxyBalanceWeightedRoundRobin,
+		Targets: []*Target{{Name: "a", URL: "http://a", Weight: 3}, {Name: "b", URL: "http://b"}},
+	}).(*Proxy)
+	e := echo.New()
+	next := func() string {
+		return p.Balancer.Next(e.NewContext(nil, nil)).Name
+	}
+	names := ""
+	for i := 0; i < 8; i++ {
+		names += next()
+	}
+	// Smooth, b is not starved
+	assert.Equal(t, "aabaaaba", names)
+
+	// Weights change on updates
+	p.Update(&Proxy{
+		Balance: ProxyBalanceWeightedRoundRobin,
+		Targets: []*Target{{Name: "a", URL: "http://a"}, {Name: "b", URL: "http://b"}},
+	})
+	names = ""
+	for i := 0; i < 4; i++ {
+		names += next()
+	}
+	assert.Equal(t, 2, strings.Count(names, "a"))
+
+	p.Targets[0].Weight = -1
+	assert.Error(t, p.ValidateConfig())
+}
+
+func TestProxyLeastConn(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("up"))
+	}))
+	defer up.Close()
+
+	p := initialized(&Proxy{
+		Balance: ProxyBalanceLeastConn,
+		Targets: []*Target{{Name: "a", URL: up.URL, Weight: 2}, {Name: "b", URL: up.URL}},
+	}).(*Proxy)
+	e := echo.New()
+	b := p.Balancer.(*proxyBalancer)
+
+	// Active requests relative to the weight
+	contexts := []echo.Context{}
+	names := ""
+	for i := 0; i < 3; i++ {
+		c := e.NewContext(nil, nil)
+		names += b.Next(c).Name
+		contexts = append(contexts, c)
+	}
+	assert.Equal(t, 2, strings.Count(names, "a"))
+	b.release(contexts[0])
+	b.release(contexts[1])
+	b.release(contexts[2])
+	assert.Equal(t, 0, b.targets[0].active)
+	assert.Equal(t, 0, b.targets[1].active)
+
+	// Proxied requests are released
+	rec := httptest.NewRecorder()
+	p.Process(nil)(e.NewContext(httptest.NewRequest(echo.GET, "/", nil), rec))
+	assert.Equal(t, "up", rec.Body.String())
+	assert.Equal(t, 0, b.targets[0].active+b.targets[1].active)
+
+	// Counts are kept on updates
+	c := e.NewContext(nil, nil)
+	name := b.Next(c).Name
+	p.Update(&Proxy{Balance: ProxyBalanceLeastConn, Targets: p.Targets})
+	assert.True(t, b == p.Balancer)
+	b.release(c)
+	for _, t2 := range b.targets {
+		if t2.Name == name {
+			assert.Equal(t, 0, t2.active)
+		}
+	}
+}
+
+func TestProxySticky(t *testing.T) {
+	p := validated(t, &Proxy{
+		Targets: []*Target{{Name: "a", URL: "http://a"}, {Name: "b", URL: "http://b"}, {Name: "c", URL: "http://c"}},
+		Sticky:  ProxySticky{Mode: ProxyStickyCookie},
+	}).(*Proxy)
+	e := echo.New()
+
+	// Cookie
+	rec := httptest.NewRecorder()
+	name := p.Balancer.Next(e.NewContext(httptest.NewRequest(echo.GET, "/", nil), rec)).Name
+	cookie := rec.Result().Cookies()[0]
+	assert.Equal(t, "armor_upstream", cookie.Name)
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		assert.Equal(t, name, p.Balancer.Next(e.NewContext(req, rec)).Name)
+		assert.Empty(t, rec.Result().Cookies())
+	}
+	// Balanced again without the target
+	p.Balancer.RemoveTarget(name)
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	assert.NotEqual(t, name, p.Balancer.Next(e.NewContext(req, rec)).Name)
+	assert.Len(t, rec.Result().Cookies(), 1)
+
+	// Header
+	p.Update(&Proxy{Targets: p.Targets, Sticky: ProxySticky{Mode: ProxyStickyHeader, Header: "X-User"}})
+	next := func(user string) string {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.Header.Set("X-User", user)
+		return p.Balancer.Next(e.NewContext(req, nil)).Name
+	}
+	names := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		user := "user" + strconv.Itoa(i)
+		name := next(user)
+		assert.Equal(t, name, next(user))
+		names[name] = true
+	}
+	assert.Len(t, names, 3)
+	// Only the clients of a removed target move
+	moved := 0
+	before := map[string]string{}
+	for i := 0; i < 20; i++ {
+		user := "user" + strconv.Itoa(i)
+		before[user] = next(user)
+	}
+	p.Balancer.RemoveTarget("a")
+	for user, name := range before {
+		if n := next(user); n != name {
+			assert.Equal(t, "a", name)
+			moved++
+		}
+	}
+	assert.NotZero(t, moved)
+
+	// IP with least_conn counts the pinned requests
+	p.Update(&Proxy{Balance: ProxyBalanceLeastConn, Targets: p.Targets, Sticky: ProxySticky{Mode: ProxyStickyIP}})
+	c := e.NewContext(httptest.NewRequest(echo.GET, "/", nil), nil)
+	name = p.Balancer.Next(c).Name
+	b := p.weighted()
+	assert.Equal(t, 1, b.targets[0].active+b.targets[1].active+b.targets[2].active)
+	b.release(c)
+	assert.Equal(t, name, p.Balancer.Next(e.NewContext(httptest.NewRequest(echo.GET, "/", nil), nil)).Name)
+
+	// IP, of X-Forwarded-For of the trusted proxies only
+	p.Update(&Proxy{Targets: p.Targets, Sticky: ProxySticky{Mode: ProxyStickyIP, TrustedProxies: []string{"10.0.0.1"}}})
+	nextIP := func(ip, forwarded string) string {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set(echo.HeaderXForwardedFor, forwarded)
+		return p.Balancer.Next(e.NewContext(req, nil)).Name
+	}
+	names = map[string]bool{}
+	for i := 0; i < 20; i++ {
+		ip := "192.168.0." + strconv.Itoa(i)
+		assert.Equal(t, nextIP(ip, ""), nextIP("10.0.0.1", ip))
+		assert.Equal(t, nextIP("192.168.1.1", ""), nextIP("192.168.1.1", ip))
+		names[nextIP(ip, "")] = true
+	}
+	assert.Len(t, names, 3)
+
+	p.Sticky = ProxySticky{Mode: ProxyStickyHeader}
+	assert.Error(t, p.ValidateConfig())
+	p.Sticky = ProxySticky{Mode: "hash"}
+	assert.Error(t, p.ValidateConfig())
+	p.Sticky = ProxySticky{Mode: ProxyStickyIP, TrustedProxies: []string{"10.0.0"}}
+	assert.Error(t, p.ValidateConfig())
+}
+
+func TestProxyRetry(t *testing.T) {
+	var badHits int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&badHits, 1)
+		w.Header().Set("X-Bad", "1")
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer bad.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("good "), body...))
+	}))
+	defer good.Close()
+
+	p := validated(t, &Proxy{
+		Balance: ProxyBalanceRoundRobin,
+		Targets: []*Target{{Name: "bad", URL: bad.URL}, {Name: "slow", URL: slow.URL}, {Name: "good", URL: good.URL}},
+		Retry:   ProxyRetry{Count: 2, PerTryTimeout: 50 * time.Millisecond},
+	}).(*Proxy)
+	e := echo.New()
+	e.Logger.SetOutput(ioutil.Discard)
+	serve := func(method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(method, "/", strings.NewReader(body)), rec)
+		if err := p.Process(nil)(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+
+	// Retried on the other targets with the body
+	for i := 0; i < 3; i++ {
+		rec := serve(echo.PUT, "body")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "good body", rec.Body.String())
+		assert.Empty(t, rec.Header().Get("X-Bad"))
+	}
+
+	// Not idempotent
+	codes := map[int]bool{}
+	for i := 0; i < 3; i++ {
+		codes[serve(echo.POST, "").Code] = true
+	}
+	assert.Equal(t, map[int]bool{http.StatusOK: true, http.StatusBadGateway: true, http.StatusServiceUnavailable: true}, codes)
+
+	// Circuit breaker
+	p.Update(&Proxy{
+		Balance:        ProxyBalanceRoundRobin,
+		Targets:        []*Target{{Name: "bad", URL: bad.URL}, {Name: "good", URL: good.URL}},
+		CircuitBreaker: ProxyCircuitBreaker{FailureThreshold: 2, Cooldown: 100 * time.Millisecond},
+	})
+	atomic.StoreInt32(&badHits, 0)
+	for i := 0; i < 10; i++ {
+		serve(echo.GET, "")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&badHits))
+	// Half-open after the cooldown, one request probes
+	time.Sleep(150 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		serve(echo.GET, "")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&badHits))
+	// Closed again after a successful probe
+	bad.Config.Handler = good.Config.Handler
+	time.Sleep(150 * time.Millisecond)
+	bodies := map[int]bool{}
+	for i := 0; i < 4; i++ {
+		bodies[serve(echo.GET, "").Code] = true
+	}
+	assert.Equal(t, map[int]bool{http.StatusOK: true}, bodies)
+	b := p.Balancer.(*retryBalancer)
+	assert.True(t, b.breaker.ready("bad"))
+	assert.Equal(t, 0, b.breaker.states["bad"].failures)
+
+	// All open
+	b.breaker.record("bad", false)
+	b.breaker.record("bad", false)
+	b.breaker.record("good", false)
+	b.breaker.record("good", false)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(echo.GET, "").Code)
+
+	p.Retry = ProxyRetry{Statuses: []int{1000}}
+	assert.Error(t, p.ValidateConfig())
+}
+
+func TestProxyH2C(t *testing.T) {
+	up := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte(r.Proto + " te=" + r.Header.Get("Te")))
+		w.Header().Set("Grpc-Status", "0")
+	}), new(http2.Server)))
+	defer up.Close()
+
+	for _, protocol := range []string{ProxyProtocolH2C, ProxyProtocolGRPC} {
+		p := validated(t, &Proxy{Targets: []*Target{{URL: up.URL, Protocol: protocol}}}).(*Proxy)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/", strings.NewReader("message"))
+		req.Header.Set("Te", "trailers")
+		p.Process(nil)(echo.New().NewContext(req, rec))
+		res := rec.Result()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		body, _ := ioutil.ReadAll(res.Body)
+		if protocol == ProxyProtocolGRPC {
+			assert.Equal(t, "HTTP/2.0 te=trailers", string(body))
+		} else {
+			assert.Contains(t, string(body), "HTTP/2.0")
+		}
+		assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+	}
+
+	p := &Proxy{Targets: []*Target{{URL: "https://localhost", Protocol: ProxyProtocolH2C}}}
+	assert.Error(t, p.ValidateConfig())
+	p.Targets[0].Protocol = "h3"
+	assert.Error(t, p.ValidateConfig())
+}
+
+func TestProxyWebSocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(r.URL.Path+" user="+r.Header.Get("X-User")))
+		for {
+			t, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(t, msg)
+		}
+	}))
+	defer up.Close()
+
+	p := validated(t, &Proxy{
+		ProxyConfig: middleware.ProxyConfig{Rewrite: map[string]string{"/ws/*": "/$1"}},
+		Targets:     []*Target{{URL: up.URL}},
+		WebSocket:   ProxyWebSocket{IdleTimeout: 200 * time.Millisecond, MaxMessageSize: 16, SubjectHeader: "X-User"},
+	}).(*Proxy)
+	e := echo.New()
+	e.Any("/*", func(c echo.Context) error {
+		c.Set("casUsername", "jon")
+		return p.Process(nil)(c)
+	})
+	s := httptest.NewServer(e)
+	defer s.Close()
+	dial := func() *websocket.Conn {
+		header := http.Header{"X-User": {"spoofed"}}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws/chat", header)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return conn
+	}
+
+	// Rewritten with the subject
+	conn := dial()
+	_, msg, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "/chat user=jon", string(msg))
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	_, msg, err = conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(msg))
+
+	// Max message size
+	conn.WriteMessage(websocket.TextMessage, []byte("a message too big"))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "%v", err)
+	conn.Close()
+
+	// Idle timeout
+	conn = dial()
+	defer conn.Close()
+	conn.ReadMessage()
+	start := time.Now()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "%v", err)
+	assert.True(t, time.Since(start) >= 150*time.Millisecond)
+
+	p.WebSocket.MaxMessageSize = -1
+	assert.Error(t, p.ValidateConfig())
+}
+
+func TestProxyMetrics(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer up.Close()
+	p := initialized(&Proxy{Targets: []*Target{{URL: up.URL}}}).(*Proxy)
+	requests := proxyRequests.WithLabelValues(up.URL, "4xx")
+	before := testutil.ToFloat64(requests)
+	rec := httptest.NewRecorder()
+	p.Process(nil)(echo.New().NewContext(httptest.NewRequest(echo.GET, "/", nil), rec))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, before+1, testutil.ToFloat64(requests))
+}
+
+func TestProxySplit(t *testing.T) {
+	p := validated(t, &Proxy{
+		Targets: []*Target{{Name: "stable", URL: "http://stable"}, {Name: "canary", URL: "http://canary", Group: "canary"}},
+		Split: ProxySplit{
+			Group:   "canary",
+			Percent: 20,
+			Rules:   []ProxySplitRule{{Header: "X-Canary", Values: []string{"1"}}, {Attribute: "group", Values: []string{"beta"}}},
+		},
+	}).(*Proxy)
+	e := echo.New()
+	next := func(req *http.Request, user string) (string, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if user != "" {
+			c.Set("casUsername", user)
+		}
+		return p.Balancer.Next(c).Name, rec
+	}
+
+	// Sticky per user
+	canaries := 0
+	for i := 0; i < 1000; i++ {
+		user := "user" + strconv.Itoa(i)
+		name, _ := next(httptest.NewRequest(echo.GET, "/", nil), user)
+		again, _ := next(httptest.NewRequest(echo.GET, "/", nil), user)
+		assert.Equal(t, name, again)
+		if name == "canary" {
+			canaries++
+		}
+	}
+	assert.InDelta(t, 200, canaries, 50)
+
+	// Sticky per cookie without a user
+	_, rec := next(httptest.NewRequest(echo.GET, "/", nil), "")
+	cookie := rec.Result().Cookies()[0]
+	assert.Equal(t, "armor_split", cookie.Name)
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	req.AddCookie(cookie)
+	name, rec := next(req, "")
+	assert.Empty(t, rec.Result().Cookies())
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.AddCookie(cookie)
+		again, _ := next(req, "")
+		assert.Equal(t, name, again)
+	}
+
+	// Rules
+	p.Update(&Proxy{Targets: p.Targets, Split: ProxySplit{Group: "canary", Rules: p.Split.Rules}})
+	req = httptest.NewRequest(echo.GET, "/", nil)
+	req.Header.Set("X-Canary", "1")
+	name, _ = next(req, "jon")
+	assert.Equal(t, "canary", name)
+	req = httptest.NewRequest(echo.GET, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), CasAttributesCtxKey, cas.UserAttributes{"group": {"staff", "beta"}}))
+	name, _ = next(req, "jon")
+	assert.Equal(t, "canary", name)
+	name, _ = next(httptest.NewRequest(echo.GET, "/", nil), "jon")
+	assert.Equal(t, "stable", name)
+
+	// The other group without targets
+	assert.True(t, p.Balancer.RemoveTarget("stable"))
+	name, _ = next(httptest.NewRequest(echo.GET, "/", nil), "jon")
+	assert.Equal(t, "canary", name)
+	assert.True(t, p.Balancer.AddTarget(&middleware.ProxyTarget{Name: "stable"}))
+	name, _ = next(httptest.NewRequest(echo.GET, "/", nil), "jon")
+	assert.Equal(t, "stable", name)
+
+	// Invalid
+	p.Split.Percent = 101
+	assert.Error(t, p.ValidateConfig())
+	p.Split = ProxySplit{Group: "beta"}
+	assert.Error(t, p.ValidateConfig())
+	p.Split = ProxySplit{Group: "canary", Rules: []ProxySplitRule{{Header: "X-Canary", Cookie: "canary"}}}
+	assert.Error(t, p.ValidateConfig())
+}
+
+func TestProxyMirror(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("up "), b...))
+	}))
+	defer up.Close()
+	mirrored := make(chan *http.Request, 10)
+	bodies := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mirrored <- r
+		bodies <- string(b)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	p := validated(t, &Proxy{
+		Targets: []*Target{{URL: up.URL}},
+		Mirror:  ProxyMirror{URL: shadow.URL + "/shadow", Percent: 100, MaxBodySize: 8},
+	}).(*Proxy)
+	e := echo.New()
+	do := func(body string) string {
+		rec := httptest.NewRecorder()
+		p.Process(nil)(e.NewContext(httptest.NewRequest(echo.POST, "/orders?id=1", strings.NewReader(body)), rec))
+		return rec.Body.String()
+	}
+
+	// The response of the upstream, the copy to the shadow
+	assert.Equal(t, "up order", do("order"))
+	select {
+	case r := <-mirrored:
+		assert.Equal(t, "/shadow/orders", r.URL.Path)
+		assert.Equal(t, "id=1", r.URL.RawQuery)
+		assert.Equal(t, "true", r.Header.Get("X-Armor-Mirror"))
+		assert.Equal(t, "order", <-bodies)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not mirrored")
+	}
+
+	// Larger bodies are proxied only
+	skipped := testutil.ToFloat64(proxyMirrored.WithLabelValues("skipped"))
+	assert.Equal(t, "up a large order", do("a large order"))
+	assert.Equal(t, skipped+1, testutil.ToFloat64(proxyMirrored.WithLabelValues("skipped")))
+
+	p.Mirror = ProxyMirror{URL: "shadow:8080", Percent: 10}
+	assert.Error(t, p.ValidateConfig())
+	p.Mirror = ProxyMirror{URL: shadow.URL, Percent: 110}
+	assert.Error(t, p.ValidateConfig())
+}
+
+func TestProxyUpstream(t *testing.T) {
+	up := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	assert.NoError(t, http2.ConfigureServer(up.Config, nil))
+	up.TLS = up.Config.TLSConfig
+	up.StartTLS()
+	defer up.Close()
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: up.Certificate().Raw}), 0644))
+
+	p := initialized(&Proxy{Targets: []*Target{{URL: up.URL}}}).(*Proxy)
+	e := echo.New()
+	do := func() (int, string) {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(echo.GET, "/", nil), rec)
+		if err := p.Process(nil)(c); err != nil {
+			e.DefaultHTTPErrorHandler(err, c)
+		}
+		return rec.Code, rec.Body.String()
+	}
+
+	// Unknown CA
+	code, _ := do()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// Custom CA, HTTP/2
+	http2 := false
+	p.Update(&Proxy{Targets: p.Targets, Upstream: ProxyUpstream{TLS: ProxyUpstreamTLS{CA: ca}}})
+	code, body := do()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "HTTP/2.0", body)
+	transport := p.Transport.(*proxyTransport).upstreams[proxyDefaultUpstream]
+	p.Update(&Proxy{Targets: p.Targets, Upstream: ProxyUpstream{TLS: ProxyUpstreamTLS{CA: ca}}})
+	assert.True(t, transport == p.Transport.(*proxyTransport).upstreams[proxyDefaultUpstream])
+
+	// Per target, HTTP/1.1
+	targets := []*Target{{URL: up.URL, Upstream: &ProxyUpstream{HTTP2: &http2, TLS: ProxyUpstreamTLS{CA: ca}}}}
+	p.Update(&Proxy{Targets: targets})
+	code, body = do()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "HTTP/1.1", body)
+
+	// SNI not matching the certificate
+	targets = []*Target{{URL: up.URL}}
+	p.Update(&Proxy{Targets: targets, Upstream: ProxyUpstream{TLS: ProxyUpstreamTLS{CA: ca, ServerName: "other.com"}}})
+	code, _ = do()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	p.Update(&Proxy{Targets: targets, Upstream: ProxyUpstream{TLS: ProxyUpstreamTLS{InsecureSkipVerify: true}}})
+	code, _ = do()
+	assert.Equal(t, http.StatusOK, code)
+
+	// Invalid
+	p.Upstream = ProxyUpstream{TLS: ProxyUpstreamTLS{CA: filepath.Join(dir, "missing.pem")}}
+	assert.Error(t, p.ValidateConfig())
+	p.Upstream = ProxyUpstream{MaxConnsPerHost: -1}
+	assert.Error(t, p.ValidateConfig())
+}
+
+type testResolver struct {
+	mutex sync.Mutex
+	ips   map[string][]net.IPAddr
+	srvs  map[string][]*net.SRV
+}
+
+func (r *testResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if ips := r.ips[host]; len(ips) > 0 {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host}
+}
+
+func (r *testResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if srvs := r.srvs[name]; len(srvs) > 0 {
+		return "", srvs, nil
+	}
+	return "", nil, &net.DNSError{Err: "no such host", Name: name}
+}
+
+func TestProxyDiscovery(t *testing.T) {
+	servers := map[string]string{}
+	for _, name := range []string{"a", "b", "c"} {
+		body := name
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		defer s.Close()
+		servers[name] = s.URL
+	}
+	port := func(name string) uint16 {
+		u, _ := url.Parse(servers[name])
+		p, _ := strconv.Atoi(u.Port())
+		return uint16(p)
+	}
+	resolver := &testResolver{
+		srvs: map[string][]*net.SRV{"_http._tcp.app.test": {
+			{Target: "127.0.0.1.", Port: port("a"), Priority: 1},
+			{Target: "127.0.0.1.", Port: port("b"), Priority: 1},
+			{Target: "127.0.0.1.", Port: port("c"), Priority: 2},
+		}},
+	}
+	defer func(r proxyResolver) { defaultProxyResolver = r }(defaultProxyResolver)
+	defaultProxyResolver = resolver
+
+	u, _ := url.Parse(servers["c"])
+	p := validated(t, &Proxy{
+		Balance: ProxyBalanceRoundRobin,
+		Targets: []*Target{
+			{Name: "app", URL: "http://_http._tcp.app.test", Discovery: ProxyDiscoverySRV},
+			{Name: "dns", URL: "http://dns.test:" + u.Port(), Discovery: ProxyDiscoveryDNS},
+		},
+		Discovery: ProxyDiscovery{Interval: time.Hour},
+	}).(*Proxy)
+	defer p.ShutdownGrace(context.Background())
+	e := echo.New()
+	bodies := func() map[string]bool {
+		b := map[string]bool{}
+		for i := 0; i < 6; i++ {
+			rec := httptest.NewRecorder()
+			p.Process(nil)(e.NewContext(httptest.NewRequest(echo.GET, "/", nil), rec))
+			b[rec.Body.String()] = true
+		}
+		return b
+	}
+	// Of the lowest priority, dns.test not resolved
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, bodies())
+
+	// Re-resolved
+	resolver.mutex.Lock()
+	resolver.srvs["_http._tcp.app.test"] = resolver.srvs["_http._tcp.app.test"][1:2]
+	resolver.ips = map[string][]net.IPAddr{"dns.test": {{IP: net.ParseIP("127.0.0.1")}}}
+	resolver.mutex.Unlock()
+	p.discovery.refresh()
+	assert.Equal(t, map[string]bool{"b": true, "c": true}, bodies())
+
+	// Kept on errors
+	resolver.mutex.Lock()
+	resolver.srvs = nil
+	resolver.mutex.Unlock()
+	p.discovery.refresh()
+	assert.Equal(t, map[string]bool{"b": true, "c": true}, bodies())
+
+	// None resolved
+	p.Update(&Proxy{Targets: []*Target{{URL: "http://none.test", Discovery: ProxyDiscoveryDNS}}})
+	rec := httptest.NewRecorder()
+	err := p.Process(nil)(e.NewContext(httptest.NewRequest(echo.GET, "/", nil), rec))
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusServiceUnavailable, err.(*echo.HTTPError).Code)
+	}
+
+	// Invalid
+	p.Targets = []*Target{{URL: "http://_http._tcp.app.test:80", Discovery: ProxyDiscoverySRV}}
+	assert.Error(t, p.ValidateConfig())
+	p.Targets = []*Target{{URL: "http://app.test", Discovery: "zookeeper"}}
+	assert.Error(t, p.ValidateConfig())
+}
+
+func TestProxyRegistry(t *testing.T) {
+	servers := map[string]string{}
+	for _, name := range []string{"a", "b"} {
+		body := name
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		defer s.Close()
+		servers[name] = strings.TrimPrefix(s.URL, "http://")
+	}
+
+	// Consul, blocking queries of the passing instances
+	var consulIndex int32 = 1
+	changed := make(chan struct{}, 1)
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/health/service/web", r.URL.Path)
+		assert.Equal(t, "1", r.URL.Query().Get("passing"))
+		assert.Equal(t, "t", r.Header.Get("X-Consul-Token"))
+		if r.URL.Query().Get("index") == fmt.Sprint(atomic.LoadInt32(&consulIndex)) {
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		index := atomic.LoadInt32(&consulIndex)
+		w.Header().Set("X-Consul-Index", fmt.Sprint(index))
+		entries := []string{servers["a"], servers["b"]}[index-1:]
+		fmt.Fprint(w, "[")
+		for i, e := range entries {
+			host, port, _ := net.SplitHostPort(e)
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, `{"Node":{"Address":%q},"Service":{"Port":%s,"Weights":{"Passing":1}}}`, host, port)
+		}
+		fmt.Fprint(w, "]")
+	}))
+	defer consul.Close()
+
+	// etcd, the keys under the prefix
+	etcd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/keys/upstreams/api", r.URL.Path)
+		if r.URL.Query().Get("wait") == "true" {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Etcd-Index", "7")
+		fmt.Fprintf(w, `{"action":"get","node":{"key":"/upstreams/api","dir":true,"nodes":[{"key":"/upstreams/api/1","value":%q}]}}`, servers["b"])
+	}))
+	defer etcd.Close()
+
+	p := validated(t, &Proxy{
+		Balance: ProxyBalanceRoundRobin,
+		Targets: []*Target{
+			{Name: "web", URL: "http://web", Discovery: ProxyDiscoveryConsul},
+			{Name: "api", URL: "http://api", Discovery: ProxyDiscoveryEtcd},
+		},
+		Discovery: ProxyDiscovery{
+			Interval: time.Hour,
+			Consul:   ProxyConsul{Address: consul.URL, Token: "t"},
+			Etcd:     ProxyEtcd{Endpoints: []string{etcd.URL}, Prefix: "/upstreams/"},
+		},
+	}).(*Proxy)
+	defer p.ShutdownGrace(context.Background())
+	e := echo.New()
+	names := func() map[string]bool {
+		n := map[string]bool{}
+		for i := 0; i < 6; i++ {
+			c := e.NewContext(httptest.NewRequest(echo.GET, "/", nil), nil)
+			n[p.Balancer.Next(c).Name] = true
+		}
+		return n
+	}
+	assert.Equal(t, map[string]bool{"web@" + servers["a"]: true, "web@" + servers["b"]: true, "api@" + servers["b"]: true}, names())
+
+	// a fails its health checks
+	atomic.StoreInt32(&consulIndex, 2)
+	changed <- struct{}{}
+	for i := 0; i < 100 && len(names()) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, map[string]bool{"web@" + servers["b"]: true, "api@" + servers["b"]: true}, names())
+
+	// Invalid
+	p.Targets = []*Target{{URL: "http://web:80", Discovery: ProxyDiscoveryConsul}}
+	assert.Error(t, p.ValidateConfig())
+	p.Targets = []*Target{{URL: "http://web", Discovery: ProxyDiscoveryEtcd}}
+	p.Discovery.Etcd.Endpoints = []string{"etcd:2379"}
+	assert.Error(t, p.ValidateConfig())
+}
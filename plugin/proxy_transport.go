@@ -0,0 +1,301 @@
+package plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// Target protocols, HTTP/1.1 or HTTP/2 over TLS by default
+	ProxyProtocolHTTP = "http"
+	ProxyProtocolH2C  = "h2c"
+	ProxyProtocolGRPC = "grpc"
+)
+
+type (
+	// ProxyUpstream are the connection settings of the targets, replacing
+	// the defaults of Go.
+	ProxyUpstream struct {
+		// HTTP2 negotiates HTTP/2 with the https targets, default true.
+		HTTP2 *bool `yaml:"http2"`
+
+		// MaxIdleConns of all hosts (default 100) and MaxIdleConnsPerHost
+		// (default 2) are kept for IdleConnTimeout (default 90s),
+		// MaxConnsPerHost limits the connections, none if 0.
+		MaxIdleConns        int           `yaml:"max_idle_conns"`
+		MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+		MaxConnsPerHost     int           `yaml:"max_conns_per_host"`
+		IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+
+		// DialTimeout (default 30s) and ResponseHeaderTimeout, none if 0.
+		DialTimeout           time.Duration `yaml:"dial_timeout"`
+		ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+
+		TLS ProxyUpstreamTLS `yaml:"tls"`
+	}
+
+	// ProxyUpstreamTLS verifies the https targets with the CA certificates
+	// of the CA file, the system ones by default, for ServerName, the host of
+	// the URL by default. InsecureSkipVerify is for development only.
+	ProxyUpstreamTLS struct {
+		CA                 string `yaml:"ca"`
+		ServerName         string `yaml:"server_name"`
+		InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	}
+
+	// proxyTransport proxies to the h2c and gRPC targets over HTTP/2, in
+	// cleartext for http URLs, and to the others with base, or with the
+	// transports of their upstream settings.
+	proxyTransport struct {
+		base http.RoundTripper
+		h2c  *http2.Transport
+		h2   *http2.Transport
+
+		mutex     sync.RWMutex
+		protocols map[string]string
+		upstreams map[string]*upstreamTransport
+	}
+
+	// upstreamTransport are the transports of upstream settings.
+	upstreamTransport struct {
+		config ProxyUpstream
+		http   *http.Transport
+		h2     *http2.Transport
+	}
+)
+
+// proxyDefaultUpstream is the key of the upstream settings of all targets.
+const proxyDefaultUpstream = ""
+
+func (u ProxyUpstream) empty() bool {
+	return reflect.DeepEqual(u, ProxyUpstream{})
+}
+
+func (u ProxyUpstream) validate() error {
+	if u.MaxIdleConns < 0 || u.MaxIdleConnsPerHost < 0 || u.MaxConnsPerHost < 0 {
+		return errors.New("invalid proxy upstream connection limits")
+	}
+	if u.IdleConnTimeout < 0 || u.DialTimeout < 0 || u.ResponseHeaderTimeout < 0 {
+		return errors.New("invalid proxy upstream timeouts")
+	}
+	_, err := u.TLS.config()
+	return err
+}
+
+func (t ProxyUpstreamTLS) config() (*tls.Config, error) {
+	config := &tls.Config{ServerName: t.ServerName, InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CA != "" {
+		b, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy upstream ca=%s, %v", t.CA, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("invalid proxy upstream ca=%s, no certificates", t.CA)
+		}
+	}
+	return config, nil
+}
+
+// newUpstreamTransport returns the transports of config, HTTP/1.1 or
+// HTTP/2 over TLS and HTTP/2 of the gRPC targets.
+func newUpstreamTransport(config ProxyUpstream) (*upstreamTransport, error) {
+	tlsConfig, err := config.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+	orDefault := func(v, def time.Duration) time.Duration {
+		if v == 0 {
+			return def
+		}
+		return v
+	}
+	maxIdle := config.MaxIdleConns
+	if maxIdle == 0 {
+		maxIdle = 100
+	}
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   orDefault(config.DialTimeout, 30*time.Second),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          maxIdle,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       orDefault(config.IdleConnTimeout, 90*time.Second),
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+	h2 := &http2.Transport{TLSClientConfig: tlsConfig.Clone()}
+	if config.HTTP2 == nil || *config.HTTP2 {
+		// With a TLS config, HTTP/2 is configured explicitly
+		if err := http2.ConfigureTransport(t); err != nil {
+			return nil, err
+		}
+	}
+	return &upstreamTransport{config: config, http: t, h2: h2}, nil
+}
+
+func validateProxyProtocol(t *Target, u *url.URL) error {
+	switch t.Protocol {
+	case "", ProxyProtocolHTTP, ProxyProtocolGRPC:
+	case ProxyProtocolH2C:
+		if u.Scheme != "http" {
+			return fmt.Errorf("proxy protocol=h2c requires an http url=%s", t.URL)
+		}
+	default:
+		return fmt.Errorf("invalid proxy protocol=%s", t.Protocol)
+	}
+	return nil
+}
+
+func newProxyTransport(base http.RoundTripper) *proxyTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &proxyTransport{
+		base: base,
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+		h2:        new(http2.Transport),
+		protocols: map[string]string{},
+		upstreams: map[string]*upstreamTransport{},
+	}
+}
+
+// setUpstream sets the upstream settings of the target u, of all targets if
+// nil. The transports of old with the same settings are kept, not to open new
+// connections on updates.
+func (t *proxyTransport) setUpstream(u *url.URL, config ProxyUpstream, old *proxyTransport) error {
+	key := proxyDefaultUpstream
+	if u != nil {
+		key = u.Scheme + "://" + u.Host
+	}
+	var upstream *upstreamTransport
+	if old != nil {
+		old.mutex.RLock()
+		if o := old.upstreams[key]; o != nil && reflect.DeepEqual(o.config, config) {
+			upstream = o
+		}
+		old.mutex.RUnlock()
+	}
+	if upstream == nil {
+		var err error
+		if upstream, err = newUpstreamTransport(config); err != nil {
+			return err
+		}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.upstreams[key] = upstream
+	return nil
+}
+
+// closeIdle closes the idle connections of the transports not kept by t.
+func (t *proxyTransport) closeIdle(old *proxyTransport) {
+	if old == nil || old == t {
+		return
+	}
+	t.mutex.RLock()
+	kept := map[*upstreamTransport]bool{}
+	for _, u := range t.upstreams {
+		kept[u] = true
+	}
+	t.mutex.RUnlock()
+	old.mutex.RLock()
+	defer old.mutex.RUnlock()
+	for _, u := range old.upstreams {
+		if !kept[u] {
+			u.http.CloseIdleConnections()
+			u.h2.CloseIdleConnections()
+		}
+	}
+}
+
+// remove removes the settings of the target u, closing its idle
+// connections.
+func (t *proxyTransport) remove(u *url.URL) {
+	key := u.Scheme + "://" + u.Host
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.protocols, key)
+	upstream := t.upstreams[key]
+	if upstream == nil {
+		return
+	}
+	delete(t.upstreams, key)
+	for _, o := range t.upstreams {
+		if o == upstream {
+			return
+		}
+	}
+	upstream.http.CloseIdleConnections()
+	upstream.h2.CloseIdleConnections()
+}
+
+// setProtocol sets the protocol of the target u.
+func (t *proxyTransport) setProtocol(u *url.URL, protocol string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.protocols[u.Scheme+"://"+u.Host] = protocol
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target := req.URL.Scheme + "://" + req.URL.Host
+	start := time.Now()
+	res, err := t.roundTrip(req)
+	proxyRequestDuration.WithLabelValues(target).Observe(time.Since(start).Seconds())
+	code := "error"
+	if err == nil {
+		code = StatusClass(res.StatusCode)
+	}
+	proxyRequests.WithLabelValues(target, code).Inc()
+	return res, err
+}
+
+func (t *proxyTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	key := req.URL.Scheme + "://" + req.URL.Host
+	t.mutex.RLock()
+	protocol := t.protocols[key]
+	upstream := t.upstreams[key]
+	if upstream == nil {
+		upstream = t.upstreams[proxyDefaultUpstream]
+	}
+	t.mutex.RUnlock()
+	switch protocol {
+	case ProxyProtocolH2C, ProxyProtocolGRPC:
+		if protocol == ProxyProtocolGRPC {
+			// Required by gRPC servers, hop-by-hop for older proxies
+			req.Header.Set("Te", "trailers")
+		}
+		if req.URL.Scheme == "http" {
+			return t.h2c.RoundTrip(req)
+		}
+		if upstream != nil {
+			return upstream.h2.RoundTrip(req)
+		}
+		return t.h2.RoundTrip(req)
+	}
+	if upstream != nil {
+		return upstream.http.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
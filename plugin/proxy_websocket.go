@@ -0,0 +1,243 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+type (
+	// ProxyWebSocket proxies WebSocket connections message by message,
+	// closing them after IdleTimeout without messages or on messages larger
+	// than MaxMessageSize bytes. SubjectHeader carries the user of the auth
+	// plugins to the target, a header sent by the client is dropped.
+	ProxyWebSocket struct {
+		IdleTimeout    time.Duration `yaml:"idle_timeout"`
+		MaxMessageSize int64         `yaml:"max_message_size"`
+		SubjectHeader  string        `yaml:"subject_header"`
+	}
+
+	proxyRewrite struct {
+		pattern *regexp.Regexp
+		to      string
+	}
+)
+
+// proxyWebSocketWait is the deadline of control messages.
+const proxyWebSocketWait = 5 * time.Second
+
+func (w ProxyWebSocket) enabled() bool {
+	return w.IdleTimeout > 0 || w.MaxMessageSize > 0 || w.SubjectHeader != ""
+}
+
+func (w ProxyWebSocket) validate() error {
+	if w.MaxMessageSize < 0 {
+		return fmt.Errorf("invalid proxy websocket max message size=%d", w.MaxMessageSize)
+	}
+	return nil
+}
+
+// newProxyRewrites compiles the rewrite rules the way the echo proxy does.
+func newProxyRewrites(rules map[string]string) []proxyRewrite {
+	rewrites := make([]proxyRewrite, 0, len(rules))
+	for k, v := range rules {
+		k = strings.Replace(k, "*", "(\\S*)", -1)
+		rewrites = append(rewrites, proxyRewrite{regexp.MustCompile(k), v})
+	}
+	return rewrites
+}
+
+func rewritePath(rewrites []proxyRewrite, p string) string {
+	for _, r := range rewrites {
+		groups := r.pattern.FindAllStringSubmatch(p, -1)
+		if groups == nil {
+			continue
+		}
+		replace := []string{}
+		for i, v := range groups[0][1:] {
+			replace = append(replace, "$"+strconv.Itoa(i+1), v)
+		}
+		p = strings.NewReplacer(replace...).Replace(r.to)
+	}
+	return p
+}
+
+// webSocketMiddleware proxies the WebSocket requests to the targets of
+// balancer, others are proxied by mid.
+func webSocketMiddleware(config ProxyWebSocket, rewrites []proxyRewrite, balancer middleware.ProxyBalancer, mid echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := mid(next)
+		return func(c echo.Context) error {
+			if !c.IsWebSocket() {
+				return h(c)
+			}
+			tgt := balancer.Next(c)
+			if tgt == nil {
+				return echo.NewHTTPError(http.StatusServiceUnavailable)
+			}
+			return proxyWebSocket(c, tgt, config, rewrites)
+		}
+	}
+}
+
+// webSocketHeaders are set by the dialer.
+var webSocketHeaders = []string{"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions"}
+
+func proxyWebSocket(c echo.Context, tgt *middleware.ProxyTarget, config ProxyWebSocket, rewrites []proxyRewrite) error {
+	r := c.Request()
+	u := *tgt.URL
+	u.Scheme = "ws"
+	if tgt.URL.Scheme == "https" {
+		u.Scheme = "wss"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(rewritePath(rewrites, r.URL.Path), "/")
+	u.RawPath = ""
+	if u.RawQuery == "" || r.URL.RawQuery == "" {
+		u.RawQuery += r.URL.RawQuery
+	} else {
+		u.RawQuery += "&" + r.URL.RawQuery
+	}
+
+	header := http.Header{}
+	for k, v := range r.Header {
+		header[k] = v
+	}
+	for _, k := range webSocketHeaders {
+		header.Del(k)
+	}
+	header.Set("Host", r.Host)
+	if header.Get(echo.HeaderXRealIP) == "" {
+		header.Set(echo.HeaderXRealIP, c.RealIP())
+	}
+	if header.Get(echo.HeaderXForwardedProto) == "" {
+		header.Set(echo.HeaderXForwardedProto, c.Scheme())
+	}
+	if header.Get(echo.HeaderXForwardedFor) == "" {
+		header.Set(echo.HeaderXForwardedFor, c.RealIP())
+	}
+	if config.SubjectHeader != "" {
+		header.Del(config.SubjectHeader)
+		if s := AuthSubject(c); s != "" {
+			header.Set(config.SubjectHeader, s)
+		}
+	}
+
+	out, res, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if err != nil {
+		if res != nil {
+			return echo.NewHTTPError(res.StatusCode)
+		}
+		c.Logger().Errorf("remote %s unreachable, could not forward: %v", tgt.URL, err)
+		return echo.NewHTTPError(http.StatusServiceUnavailable)
+	}
+	defer out.Close()
+
+	// Cookies of the target and the plugins, e.g. sticky sessions
+	resHeader := http.Header{}
+	if p := out.Subprotocol(); p != "" {
+		resHeader.Set("Sec-Websocket-Protocol", p)
+	}
+	resHeader[echo.HeaderSetCookie] = append(res.Header[echo.HeaderSetCookie], c.Response().Header()[echo.HeaderSetCookie]...)
+	upgrader := websocket.Upgrader{
+		// The target checks the forwarded origin
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	in, err := upgrader.Upgrade(c.Response(), r, resHeader)
+	if err != nil {
+		// The upgrader responded
+		return nil
+	}
+	defer in.Close()
+
+	relayWebSocket(in, out, config)
+	return nil
+}
+
+// relayWebSocket relays the messages between in and out until one closes.
+func relayWebSocket(in, out *websocket.Conn, config ProxyWebSocket) {
+	var (
+		mutex  sync.Mutex
+		active = time.Now()
+	)
+	touch := func() {
+		mutex.Lock()
+		active = time.Now()
+		mutex.Unlock()
+	}
+	closeBoth := func(code int, text string) {
+		msg := websocket.FormatCloseMessage(code, text)
+		deadline := time.Now().Add(proxyWebSocketWait)
+		in.WriteControl(websocket.CloseMessage, msg, deadline)
+		out.WriteControl(websocket.CloseMessage, msg, deadline)
+		in.Close()
+		out.Close()
+	}
+	if config.IdleTimeout > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(config.IdleTimeout, func() {
+			mutex.Lock()
+			idle := time.Since(active)
+			mutex.Unlock()
+			if idle < config.IdleTimeout {
+				timer.Reset(config.IdleTimeout - idle)
+				return
+			}
+			closeBoth(websocket.CloseGoingAway, "idle timeout")
+		})
+		defer timer.Stop()
+	}
+
+	errc := make(chan error, 2)
+	relay := func(dst, src *websocket.Conn) {
+		if config.MaxMessageSize > 0 {
+			src.SetReadLimit(config.MaxMessageSize)
+		}
+		src.SetPingHandler(func(data string) error {
+			touch()
+			return dst.WriteControl(websocket.PingMessage, []byte(data), time.Now().Add(proxyWebSocketWait))
+		})
+		src.SetPongHandler(func(data string) error {
+			touch()
+			return dst.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(proxyWebSocketWait))
+		})
+		for {
+			t, msg, err := src.ReadMessage()
+			if err != nil {
+				errc <- err
+				return
+			}
+			touch()
+			if err := dst.WriteMessage(t, msg); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}
+	go relay(out, in)
+	go relay(in, out)
+
+	err := <-errc
+	switch e := err.(type) {
+	case *websocket.CloseError:
+		if e.Code == websocket.CloseAbnormalClosure {
+			// Not sent on the wire
+			e.Code = websocket.CloseGoingAway
+		}
+		closeBoth(e.Code, e.Text)
+	default:
+		if err == websocket.ErrReadLimit {
+			closeBoth(websocket.CloseMessageTooBig, "message too big")
+		} else {
+			closeBoth(websocket.CloseGoingAway, "")
+		}
+	}
+	<-errc
+}
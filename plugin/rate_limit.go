@@ -0,0 +1,283 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+)
+
+// Token bucket rate limits by client IP, header or authenticated user.
+
+type (
+	RateLimit struct {
+		Base            `json:",squash" yaml:",squash"`
+		RateLimitConfig `json:",squash" yaml:",squash"`
+
+		store       rateLimitStore
+		storeConfig RateLimitStoreConfig
+	}
+
+	RateLimitConfig struct {
+		// Requests per Period, default 1s, refill the bucket of a key, Burst,
+		// default Requests, is its size.
+		Requests int           `yaml:"requests"`
+		Period   time.Duration `yaml:"period"`
+		Burst    int           `yaml:"burst"`
+
+		// KeyBy is `ip` (default), `header`, the value of Header, or `user`,
+		// the user of the auth plugins, e.g. the CAS username. Requests
+		// without the header or user are limited by IP.
+		KeyBy  string `yaml:"key_by"`
+		Header string `yaml:"header"`
+
+		// TrustedProxies are the proxies the client IP is read from
+		// X-Forwarded-For of, as in the ip-filter plugin. Without, it is the
+		// address of the connection, the PROXY protocol one behind a load
+		// balancer.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+
+		// Whitelist are the clients, IPs or CIDRs, and the users of the auth
+		// plugins never limited, e.g. monitoring. Entries that are not IPs
+		// are users. WhitelistHeader, e.g. `X-Forwarded-User`, is the user
+		// of the requests of trusted proxies.
+		Whitelist       []string `yaml:"whitelist"`
+		WhitelistHeader string   `yaml:"whitelist_header"`
+
+		// Store keeps the buckets, in `memory` (default) or in `redis` to
+		// share the limits between instances.
+		Store RateLimitStoreConfig `yaml:"store"`
+
+		// SkipPaths are requests passed without limits, e.g. `/health`.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// RateLimitStoreConfig selects the store, URI is the redis URL.
+	RateLimitStoreConfig struct {
+		Backend string `yaml:"backend"`
+		URI     string `yaml:"uri" armor:"probe"`
+	}
+)
+
+const (
+	// Rate limit keys
+	RateLimitKeyIP     = "ip"
+	RateLimitKeyHeader = "header"
+	RateLimitKeyUser   = "user"
+)
+
+func (c RateLimitConfig) period() time.Duration {
+	if c.Period <= 0 {
+		return time.Second
+	}
+	return c.Period
+}
+
+func (c RateLimitConfig) burst() int {
+	if c.Burst <= 0 {
+		return c.Requests
+	}
+	return c.Burst
+}
+
+// rate is the refill in tokens per second.
+func (c RateLimitConfig) rate() float64 {
+	return float64(c.Requests) / c.period().Seconds()
+}
+
+// whitelist splits the whitelist into the clients and the users.
+func (c RateLimitConfig) whitelist() (util.IPNets, map[string]bool) {
+	var ips util.IPNets
+	users := map[string]bool{}
+	for _, w := range c.Whitelist {
+		if n, err := util.ParseIPNets([]string{w}); err == nil {
+			ips = append(ips, n...)
+		} else {
+			users[w] = true
+		}
+	}
+	return ips, users
+}
+
+func (c RateLimitConfig) key(ctx echo.Context, trusted util.IPNets) string {
+	switch c.KeyBy {
+	case RateLimitKeyHeader:
+		if v := ctx.Request().Header.Get(c.Header); v != "" {
+			return "header:" + v
+		}
+	case RateLimitKeyUser:
+		if s := AuthSubject(ctx); s != "" {
+			return "user:" + s
+		}
+	}
+	return "ip:" + remoteIP(ctx.Request(), trusted)
+}
+
+func (l *RateLimit) Initialize() {
+	if l.Requests <= 0 {
+		if l.Logger != nil {
+			l.Logger.Errorf("rate-limit: requires requests")
+		}
+		l.Middleware = internalErrorMid
+		return
+	}
+	trusted, err := util.ParseIPNets(l.TrustedProxies)
+	if err != nil {
+		if l.Logger != nil {
+			l.Logger.Errorf("rate-limit: %v", err)
+		}
+		l.Middleware = internalErrorMid
+		return
+	}
+	// The buckets are kept on updates of the limits
+	if l.store != nil && l.storeConfig != l.Store {
+		l.store.close()
+		l.store = nil
+	}
+	if l.store == nil {
+		store, err := newRateLimitStore(l.Store)
+		if err != nil {
+			if l.Logger != nil {
+				l.Logger.Errorf("rate-limit: invalid store: %v", err)
+			}
+			l.Middleware = internalErrorMid
+			return
+		}
+		l.store, l.storeConfig = store, l.Store
+	}
+	store, config := l.store, l.RateLimitConfig
+	rate, burst := config.rate(), config.burst()
+	ips, users := config.whitelist()
+	whitelisted := func(c echo.Context) bool {
+		r := c.Request()
+		if ip := clientIP(r, trusted); ip != nil && ips.Contains(ip) {
+			return true
+		}
+		if len(users) == 0 {
+			return false
+		}
+		if s := AuthSubject(c); s != "" && users[s] {
+			return true
+		}
+		if config.WhitelistHeader == "" {
+			return false
+		}
+		// The header is only of trusted proxies, clients would set it
+		if ip := clientIP(r, nil); ip == nil || !trusted.Contains(ip) {
+			return false
+		}
+		v := r.Header.Get(config.WhitelistHeader)
+		return v != "" && users[v]
+	}
+	l.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if whitelisted(c) {
+				return next(c)
+			}
+			if err := limitRequest(c, store, config.key(c, trusted), rate, burst); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// limitRequest takes a token of key from store and sets the RateLimit
+// headers, it returns 429 once limited. Requests are unlimited while the
+// store is unavailable.
+func limitRequest(c echo.Context, store rateLimitStore, key string, rate float64, burst int) error {
+	allowed, tokens, err := store.take(key, rate, burst)
+	if err != nil {
+		c.Logger().Errorf("rate-limit: %v", err)
+		return nil
+	}
+	header := c.Response().Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(burst))
+	header.Set("RateLimit-Remaining", strconv.Itoa(int(tokens)))
+	header.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil((float64(burst)-tokens)/rate))))
+	if !allowed {
+		header.Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil((1-tokens)/rate)))))
+		return echo.NewHTTPError(http.StatusTooManyRequests)
+	}
+	return nil
+}
+
+func (l *RateLimit) Update(p Plugin) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.RateLimitConfig = p.(*RateLimit).RateLimitConfig
+	l.Initialize()
+}
+
+func (l *RateLimit) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return skipPaths(l.SkipPaths, next, l.Middleware(next))
+}
+
+func (l *RateLimit) ValidateConfig() error {
+	if l.Requests <= 0 {
+		return errors.New("rate-limit requires requests")
+	}
+	if l.Period < 0 || l.Burst < 0 {
+		return errors.New("invalid rate-limit period or burst")
+	}
+	switch l.KeyBy {
+	case "", RateLimitKeyIP, RateLimitKeyUser:
+	case RateLimitKeyHeader:
+		if l.Header == "" {
+			return errors.New("rate-limit key_by=header requires a header")
+		}
+	default:
+		return fmt.Errorf("invalid rate-limit key_by=%s", l.KeyBy)
+	}
+	if _, err := util.ParseIPNets(l.TrustedProxies); err != nil {
+		return err
+	}
+	for _, w := range l.Whitelist {
+		if w == "" {
+			return errors.New("invalid empty rate-limit whitelist entry")
+		}
+	}
+	if l.WhitelistHeader != "" && len(l.TrustedProxies) == 0 {
+		return errors.New("rate-limit whitelist_header requires trusted_proxies")
+	}
+	switch l.Store.Backend {
+	case "", RateLimitStoreMemory:
+	case RateLimitStoreRedis:
+		if l.Store.URI == "" {
+			return errors.New("rate-limit redis store requires a uri")
+		}
+	default:
+		return fmt.Errorf("invalid rate limit store backend=%s", l.Store.Backend)
+	}
+	return validatePathRules(l.SkipPaths)
+}
+
+func (*RateLimit) DefaultConfig() interface{} {
+	return RateLimitConfig{
+		Requests: 100,
+		Period:   time.Minute,
+	}
+}
+
+func (l *RateLimit) ProbeConfig(probe ProbeFunc) error {
+	return ProbeConfig(&l.RateLimitConfig, probe)
+}
+
+// ShutdownGrace closes the store.
+func (l *RateLimit) ShutdownGrace(ctx context.Context) {
+	l.mutex.Lock()
+	s := l.store
+	l.store = nil
+	l.mutex.Unlock()
+	if s != nil {
+		s.close()
+	}
+}
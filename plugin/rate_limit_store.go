@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+type (
+	// rateLimitStore takes a token from the bucket of key, refilled with
+	// rate tokens per second up to burst. It returns the tokens left.
+	rateLimitStore interface {
+		take(key string, rate float64, burst int) (allowed bool, tokens float64, err error)
+		close() error
+	}
+
+	rateLimitMemoryStore struct {
+		mutex   sync.Mutex
+		buckets *lru.Cache
+	}
+
+	rateLimitBucket struct {
+		tokens float64
+		last   time.Time
+	}
+
+	rateLimitRedisStore struct {
+		client *redis.Client
+	}
+)
+
+const (
+	// Rate limit store backends
+	RateLimitStoreMemory = "memory"
+	RateLimitStoreRedis  = "redis"
+
+	// rateLimitMemoryKeys bounds the buckets kept, the least recently used
+	// are dropped, i.e. full again.
+	rateLimitMemoryKeys = 100000
+
+	rateLimitRedisPrefix = "armor:ratelimit:"
+)
+
+// rateLimitScript takes a token atomically, the bucket expires once full.
+var rateLimitScript = redis.NewScript(`
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens, last = tonumber(bucket[1]), tonumber(bucket[2])
+if tokens == nil then
+	tokens, last = burst, now
+end
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate / 1000)
+local allowed = 0
+if tokens >= 1 then
+	tokens, allowed = tokens - 1, 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) * 1000 / rate) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+func newRateLimitStore(config RateLimitStoreConfig) (rateLimitStore, error) {
+	switch config.Backend {
+	case "", RateLimitStoreMemory:
+		buckets, _ := lru.New(rateLimitMemoryKeys)
+		return &rateLimitMemoryStore{buckets: buckets}, nil
+	case RateLimitStoreRedis:
+		opt, err := redis.ParseURL(config.URI)
+		if err != nil {
+			return nil, err
+		}
+		client := redis.NewClient(opt)
+		if err := client.Ping().Err(); err != nil {
+			client.Close()
+			return nil, err
+		}
+		return &rateLimitRedisStore{client: client}, nil
+	}
+	return nil, fmt.Errorf("invalid rate limit store backend=%s", config.Backend)
+}
+
+func (s *rateLimitMemoryStore) take(key string, rate float64, burst int) (bool, float64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	b := &rateLimitBucket{tokens: float64(burst), last: now}
+	if v, ok := s.buckets.Get(key); ok {
+		b = v.(*rateLimitBucket)
+	} else {
+		s.buckets.Add(key, b)
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, b.tokens, nil
+	}
+	b.tokens--
+	return true, b.tokens, nil
+}
+
+func (s *rateLimitMemoryStore) close() error {
+	return nil
+}
+
+func (s *rateLimitRedisStore) take(key string, rate float64, burst int) (bool, float64, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	v, err := rateLimitScript.Run(s.client, []string{rateLimitRedisPrefix + key}, rate, burst, now).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	res, ok := v.([]interface{})
+	if !ok || len(res) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limit script result=%v", v)
+	}
+	allowed, _ := res[0].(int64)
+	left, _ := res[1].(string)
+	tokens, err := strconv.ParseFloat(left, 64)
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed == 1, tokens, nil
+}
+
+func (s *rateLimitRedisStore) close() error {
+	return s.client.Close()
+}
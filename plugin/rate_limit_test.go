@@ -0,0 +1,175 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func rateLimited(l *RateLimit, ip, user string, forwarded ...string) *httptest.ResponseRecorder {
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	req.RemoteAddr = ip + ":1234"
+	for _, f := range forwarded {
+		req.Header.Add(echo.HeaderXForwardedFor, f)
+	}
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	if user != "" {
+		c.Set("casUsername", user)
+	}
+	err := l.Process(func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})(c)
+	if err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	return rec
+}
+
+func TestRateLimit(t *testing.T) {
+	l := initialized(&RateLimit{RateLimitConfig: RateLimitConfig{Requests: 2, Period: time.Minute}}).(*RateLimit)
+	assert.NoError(t, l.ValidateConfig())
+
+	rec := rateLimited(l, "10.0.0.1", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", rec.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", rec.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, http.StatusOK, rateLimited(l, "10.0.0.1", "").Code)
+	rec = rateLimited(l, "10.0.0.1", "")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+
+	// By IP
+	assert.Equal(t, http.StatusOK, rateLimited(l, "10.0.0.2", "").Code)
+
+	// Buckets are kept on updates
+	l.Update(&RateLimit{RateLimitConfig: RateLimitConfig{Requests: 2, Period: time.Minute, Burst: 3}})
+	assert.Equal(t, http.StatusTooManyRequests, rateLimited(l, "10.0.0.1", "").Code)
+
+	// By user, by IP without
+	l.Update(&RateLimit{RateLimitConfig: RateLimitConfig{Requests: 1, Period: time.Minute, KeyBy: RateLimitKeyUser}})
+	assert.Equal(t, http.StatusOK, rateLimited(l, "10.0.0.3", "jon").Code)
+	assert.Equal(t, http.StatusTooManyRequests, rateLimited(l, "10.0.0.4", "jon").Code)
+	assert.Equal(t, http.StatusOK, rateLimited(l, "10.0.0.4", "").Code)
+
+	// Spoofed X-Forwarded-For of untrusted peers, read of trusted proxies
+	l.Update(&RateLimit{RateLimitConfig: RateLimitConfig{Requests: 1, Period: time.Minute, TrustedProxies: []string{"10.1.0.0/16"}}})
+	assert.Equal(t, http.StatusOK, rateLimited(l, "10.0.0.6", "", "203.0.113.1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, rateLimited(l, "10.0.0.6", "", "203.0.113.2").Code)
+	assert.Equal(t, http.StatusTooManyRequests, rateLimited(l, "10.0.0.6", "").Code)
+	assert.Equal(t, http.StatusOK, rateLimited(l, "10.1.0.1", "", "203.0.113.3").Code)
+	assert.Equal(t, http.StatusTooManyRequests, rateLimited(l, "10.1.0.2", "", "203.0.113.3").Code)
+	assert.Equal(t, http.StatusTooManyRequests, rateLimited(l, "10.1.0.1", "", "198.51.100.1, 203.0.113.3").Code)
+
+	// Refill
+	l.Update(&RateLimit{RateLimitConfig: RateLimitConfig{Requests: 20, Burst: 1}})
+	assert.Equal(t, http.StatusOK, rateLimited(l, "10.0.0.5", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, rateLimited(l, "10.0.0.5", "").Code)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, rateLimited(l, "10.0.0.5", "").Code)
+
+	// Without requests
+	assert.Equal(t, http.StatusInternalServerError, rateLimited(initialized(&RateLimit{}).(*RateLimit), "10.0.0.1", "").Code)
+
+	for _, config := range []RateLimitConfig{
+		{},
+		{Requests: 1, KeyBy: RateLimitKeyHeader},
+		{Requests: 1, KeyBy: "host"},
+		{Requests: 1, Store: RateLimitStoreConfig{Backend: RateLimitStoreRedis}},
+		{Requests: 1, SkipPaths: []string{"health"}},
+		{Requests: 1, TrustedProxies: []string{"10.0.0.0/33"}},
+	} {
+		assert.Error(t, (&RateLimit{RateLimitConfig: config}).ValidateConfig())
+	}
+}
+
+func TestRateLimitWhitelist(t *testing.T) {
+	l := initialized(&RateLimit{RateLimitConfig: RateLimitConfig{
+		Requests:        1,
+		Period:          time.Minute,
+		TrustedProxies:  []string{"10.1.0.1"},
+		Whitelist:       []string{"10.0.0.1", "192.168.0.0/16", "monitoring"},
+		WhitelistHeader: "X-Forwarded-User",
+	}}).(*RateLimit)
+	assert.NoError(t, l.ValidateConfig())
+	twice := func(ip, user string, header ...string) int {
+		do := func() *httptest.ResponseRecorder {
+			e := echo.New()
+			req := httptest.NewRequest(echo.GET, "/", nil)
+			req.RemoteAddr = ip + ":1234"
+			if len(header) > 0 {
+				req.Header.Set("X-Forwarded-User", header[0])
+			}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			if user != "" {
+				c.Set("casUsername", user)
+			}
+			if err := l.Process(func(c echo.Context) error {
+				return c.String(http.StatusOK, "OK")
+			})(c); err != nil {
+				e.HTTPErrorHandler(err, c)
+			}
+			return rec
+		}
+		do()
+		rec := do()
+		if rec.Code == http.StatusOK {
+			assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+		}
+		return rec.Code
+	}
+
+	// IP, CIDR, user and the header of a trusted proxy
+	assert.Equal(t, http.StatusOK, twice("10.0.0.1", ""))
+	assert.Equal(t, http.StatusOK, twice("192.168.1.1", ""))
+	assert.Equal(t, http.StatusOK, twice("10.0.0.2", "monitoring"))
+	assert.Equal(t, http.StatusOK, twice("10.1.0.1", "", "monitoring"))
+
+	// Neither, the header of untrusted clients
+	assert.Equal(t, http.StatusTooManyRequests, twice("10.0.0.3", "jon"))
+	assert.Equal(t, http.StatusTooManyRequests, twice("10.0.0.4", "", "monitoring"))
+
+	for _, config := range []RateLimitConfig{
+		{Requests: 1, Whitelist: []string{""}},
+		{Requests: 1, WhitelistHeader: "X-Forwarded-User"},
+	} {
+		assert.Error(t, (&RateLimit{RateLimitConfig: config}).ValidateConfig())
+	}
+}
+
+func TestRateLimitRedis(t *testing.T) {
+	r, err := miniredis.Run()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+
+	// Shared between instances
+	config := RateLimitConfig{
+		Requests: 2,
+		Period:   time.Minute,
+		Store:    RateLimitStoreConfig{Backend: RateLimitStoreRedis, URI: "redis://" + r.Addr()},
+	}
+	a, b := initialized(&RateLimit{RateLimitConfig: config}).(*RateLimit), initialized(&RateLimit{RateLimitConfig: config}).(*RateLimit)
+	assert.Equal(t, http.StatusOK, rateLimited(a, "10.0.0.1", "").Code)
+	rec := rateLimited(b, "10.0.0.1", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+	rec = rateLimited(a, "10.0.0.1", "")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+	assert.Len(t, r.Keys(), 1)
+
+	// Unlimited while unavailable
+	r.Close()
+	assert.Equal(t, http.StatusOK, rateLimited(a, "10.0.0.1", "").Code)
+}
@@ -1,9 +1,18 @@
 package plugin
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/armor/util"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"net/http"
+	"github.com/valyala/fasttemplate"
 )
 
 type (
@@ -12,6 +21,27 @@ type (
 		From     string `yaml:"from"`
 		To       string `yaml:"to"`
 		Code     int    `yaml:"code"`
+
+		// Rules redirect the requests matching a path pattern, the first
+		// matching one applies.
+		Rules []RedirectRule `yaml:"rules"`
+	}
+
+	// RedirectRule redirects the paths matching Path, a pattern where `*` is
+	// a segment and `**` the rest of the path, or Regexp, to To, a template
+	// of the request also expanding the captures, e.g. `${1}` or `${name}`.
+	RedirectRule struct {
+		regexp *regexp.Regexp
+		to     *fasttemplate.Template
+
+		// Host, optional, e.g. `old.example.com`
+		Host   string `yaml:"host"`
+		Path   string `yaml:"path"`
+		Regexp string `yaml:"regexp"`
+		To     string `yaml:"to"`
+
+		// Code, default the code of the plugin
+		Code int `yaml:"code"`
 	}
 
 	Redirect struct {
@@ -45,12 +75,100 @@ type (
 	}
 )
 
+// globRegexp returns the regular expression of the path pattern p, capturing
+// its wildcards.
+func globRegexp(p string) string {
+	b := new(strings.Builder)
+	b.WriteString("^")
+	for i := 0; i < len(p); i++ {
+		switch {
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString("(.*)")
+			i++
+		case p[i] == '*':
+			b.WriteString("([^/]*)")
+		default:
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func (r RedirectRule) expression() string {
+	if r.Path != "" {
+		return globRegexp(r.Path)
+	}
+	return r.Regexp
+}
+
+// target returns the redirect of the request of c, if it matches r.
+func (r *RedirectRule) target(c echo.Context) (string, bool) {
+	req := c.Request()
+	if r.Host != "" && !strings.EqualFold(r.Host, util.StripPort(req.Host)) {
+		return "", false
+	}
+	m := r.regexp.FindStringSubmatchIndex(req.URL.Path)
+	if m == nil {
+		return "", false
+	}
+	buf := new(bytes.Buffer)
+	r.to.ExecuteFunc(buf, func(w io.Writer, tag string) (int, error) {
+		if templateTag(tag) {
+			mapTag(buf, c, tag, nil)
+			return 0, nil
+		}
+		return w.Write([]byte("${" + tag + "}"))
+	})
+	return string(r.regexp.ExpandString(nil, buf.String(), req.URL.Path, m)), true
+}
+
+func validRedirectCode(code int) error {
+	switch code {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return nil
+	}
+	return fmt.Errorf("invalid redirect code=%d", code)
+}
+
+func (r *Redirect) ValidateConfig() error {
+	if err := validRedirectCode(r.Code); err != nil {
+		return err
+	}
+	for _, rule := range r.Rules {
+		if (rule.Path == "") == (rule.Regexp == "") {
+			return errors.New("redirect rule requires path or regexp")
+		}
+		if rule.To == "" {
+			return errors.New("redirect rule requires to")
+		}
+		if _, err := regexp.Compile(rule.expression()); err != nil {
+			return fmt.Errorf("invalid redirect regexp=%s, error=%v", rule.Regexp, err)
+		}
+		if err := validRedirectCode(rule.Code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (r *Redirect) Initialize() {
 	r.template = NewTemplate(r.To)
 	// Defaults
 	if r.Code == 0 {
 		r.Code = http.StatusMovedPermanently
 	}
+	rules := make([]RedirectRule, len(r.Rules))
+	for i, rule := range r.Rules {
+		rule.regexp = regexp.MustCompile(rule.expression())
+		rule.to = fasttemplate.New(rule.To, "${", "}")
+		if rule.Code == 0 {
+			rule.Code = r.Code
+		}
+		rules[i] = rule
+	}
+	r.Rules = rules
 }
 
 func (r *Redirect) Update(p Plugin) {
@@ -63,18 +181,28 @@ func (r *Redirect) Update(p Plugin) {
 func (r *Redirect) Process(next echo.HandlerFunc) echo.HandlerFunc {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
+	config := r.RedirectConfig
 	return func(c echo.Context) error {
-		if c.Request().URL.Path == r.From {
-			to, err := r.template.Execute(c)
+		if config.From != "" && c.Request().URL.Path == config.From {
+			to, err := config.template.Execute(c)
 			if err != nil {
 				return err
 			}
-			return c.Redirect(r.Code, to)
+			return c.Redirect(config.Code, to)
+		}
+		for i := range config.Rules {
+			if to, ok := config.Rules[i].target(c); ok {
+				return c.Redirect(config.Rules[i].Code, to)
+			}
 		}
 		return next(c)
 	}
 }
 
+func (r *HTTPSRedirect) ValidateConfig() error {
+	return validRedirectCode(r.Code)
+}
+
 func (r *HTTPSRedirect) Initialize() {
 	r.Middleware = middleware.HTTPSRedirectWithConfig(r.RedirectConfig)
 }
@@ -86,10 +214,8 @@ func (r *HTTPSRedirect) Update(p Plugin) {
 	r.Initialize()
 }
 
-func (r *HTTPSRedirect) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-	return r.Middleware(next)
+func (r *HTTPSWWWRedirect) ValidateConfig() error {
+	return validRedirectCode(r.Code)
 }
 
 func (r *HTTPSWWWRedirect) Initialize() {
@@ -103,10 +229,8 @@ func (r *HTTPSWWWRedirect) Update(p Plugin) {
 	r.Initialize()
 }
 
-func (r *HTTPSWWWRedirect) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-	return r.Middleware(next)
+func (r *HTTPSNonWWWRedirect) ValidateConfig() error {
+	return validRedirectCode(r.Code)
 }
 
 func (r *HTTPSNonWWWRedirect) Initialize() {
@@ -128,10 +252,8 @@ func (r *HTTPSNonWWWRedirect) Update(p Plugin) {
 	r.Initialize()
 }
 
-func (r *HTTPSNonWWWRedirect) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-	return r.Middleware(next)
+func (r *WWWRedirect) ValidateConfig() error {
+	return validRedirectCode(r.Code)
 }
 
 func (r *WWWRedirect) Initialize() {
@@ -145,10 +267,8 @@ func (r *WWWRedirect) Update(p Plugin) {
 	r.Initialize()
 }
 
-func (r *WWWRedirect) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-	return r.Middleware(next)
+func (r *NonWWWRedirect) ValidateConfig() error {
+	return validRedirectCode(r.Code)
 }
 
 func (r *NonWWWRedirect) Initialize() {
@@ -161,9 +281,3 @@ func (r *NonWWWRedirect) Update(p Plugin) {
 	r.RedirectConfig = p.(*NonWWWRedirect).RedirectConfig
 	r.Initialize()
 }
-
-func (r *NonWWWRedirect) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-	return r.Middleware(next)
-}
@@ -0,0 +1,69 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectRules(t *testing.T) {
+	e := echo.New()
+	r := Decode(RawPlugin{
+		"name":  "redirect",
+		"order": 1,
+		"from":  "/old",
+		"to":    "/new",
+		"rules": []interface{}{
+			map[string]interface{}{"path": "/blog/*/*.html", "to": "/posts/${1}/${2}", "code": 308},
+			map[string]interface{}{"path": "/docs/**", "to": "https://docs.example.com/${1}?q=${query:q}"},
+			map[string]interface{}{"regexp": `^/users/(?P<id>\d+)$`, "to": "/people/${id}", "code": 302},
+			map[string]interface{}{"host": "old.example.com", "path": "/**", "to": "https://example.com/${1}"},
+		},
+	}, e, nil).(*Redirect)
+	if !assert.NoError(t, r.ValidateConfig()) {
+		return
+	}
+	r.Initialize()
+	h := r.Process(func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	do := func(host, target string) (int, string) {
+		req := httptest.NewRequest(echo.GET, target, nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		h(e.NewContext(req, rec))
+		return rec.Code, rec.Header().Get(echo.HeaderLocation)
+	}
+
+	for _, tt := range []struct {
+		host, target string
+		code         int
+		location     string
+	}{
+		{"example.com", "/old", http.StatusMovedPermanently, "/new"},
+		{"example.com", "/blog/2020/hello.html", http.StatusPermanentRedirect, "/posts/2020/hello"},
+		{"example.com", "/blog/2020/01/hello.html", http.StatusOK, ""},
+		{"example.com", "/docs/guide/install?q=armor", http.StatusMovedPermanently, "https://docs.example.com/guide/install?q=armor"},
+		{"example.com", "/users/42", http.StatusFound, "/people/42"},
+		{"example.com", "/users/jon", http.StatusOK, ""},
+		{"old.example.com:8080", "/about", http.StatusMovedPermanently, "https://example.com/about"},
+	} {
+		code, location := do(tt.host, tt.target)
+		assert.Equal(t, tt.code, code, tt.target)
+		assert.Equal(t, tt.location, location, tt.target)
+	}
+
+	// Invalid
+	for _, raw := range []RawPlugin{
+		{"name": "redirect", "order": 1, "code": 200},
+		{"name": "redirect", "order": 1, "rules": []interface{}{map[string]interface{}{"to": "/"}}},
+		{"name": "redirect", "order": 1, "rules": []interface{}{map[string]interface{}{"regexp": "(", "to": "/"}}},
+		{"name": "redirect", "order": 1, "rules": []interface{}{map[string]interface{}{"path": "/a", "to": "/", "code": 304}}},
+		{"name": "https-redirect", "order": 1, "code": 200},
+	} {
+		assert.Error(t, Decode(raw, e, nil).(interface{ ValidateConfig() error }).ValidateConfig())
+	}
+}
@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+
+	"github.com/labstack/armor/util"
+	"github.com/labstack/echo/v4"
+)
+
+// Request IDs correlating the requests across armor and the upstreams,
+// accepted from the trusted clients or generated, in the request context,
+// the access log, the error pages and the upstream request.
+
+type (
+	RequestID struct {
+		Base            `json:",squash" yaml:",squash"`
+		RequestIDConfig `json:",squash" yaml:",squash"`
+	}
+
+	RequestIDConfig struct {
+		// Header of the ID, on the upstream request and the response, default
+		// `X-Request-ID`.
+		Header string `yaml:"header"`
+
+		// Trusted are the clients, CIDRs or IPs, e.g. a load balancer, whose
+		// IDs are kept, `0.0.0.0/0` and `::/0` for all. The IDs of the other
+		// clients are replaced.
+		Trusted []string `yaml:"trusted"`
+
+		// SkipPaths are requests without an ID.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+)
+
+// RequestIDKey is the context key of the ID of the request, `${request_id}`
+// in the templates.
+const RequestIDKey = "request_id"
+
+// requestIDPattern are the IDs accepted from the trusted clients.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:+/=-]{1,128}$`)
+
+// newRequestID returns a random UUID.
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // Version 4
+	b[8] = b[8]&0x3f | 0x80 // Variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// GetRequestID returns the ID of the request of c, of the request-id plugin
+// or of the X-Request-ID header.
+func GetRequestID(c echo.Context) string {
+	if id, ok := c.Get(RequestIDKey).(string); ok && id != "" {
+		return id
+	}
+	if id := c.Request().Header.Get(echo.HeaderXRequestID); id != "" {
+		return id
+	}
+	return c.Response().Header().Get(echo.HeaderXRequestID)
+}
+
+func (c RequestIDConfig) header() string {
+	if c.Header == "" {
+		return echo.HeaderXRequestID
+	}
+	return c.Header
+}
+
+// requestIDTrusted reports whether the ID of r is kept.
+func requestIDTrusted(r *http.Request, trusted util.IPNets) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && trusted.Contains(ip)
+}
+
+func (r *RequestID) ValidateConfig() error {
+	if _, err := util.ParseIPNets(r.Trusted); err != nil {
+		return err
+	}
+	return validatePathRules(r.SkipPaths)
+}
+
+func (r *RequestID) Initialize() {
+	trusted, err := util.ParseIPNets(r.Trusted)
+	if err != nil {
+		if r.Logger != nil {
+			r.Logger.Errorf("request-id: %v", err)
+		}
+		r.Middleware = internalErrorMid
+		return
+	}
+	header := r.header()
+	r.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			id := req.Header.Get(header)
+			if id == "" || !requestIDPattern.MatchString(id) || !requestIDTrusted(req, trusted) {
+				var err error
+				if id, err = newRequestID(); err != nil {
+					return err
+				}
+			}
+			c.Set(RequestIDKey, id)
+			req.Header.Set(header, id)
+			c.Response().Header().Set(header, id)
+			return next(c)
+		}
+	}
+}
+
+func (r *RequestID) Update(p Plugin) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.RequestIDConfig = p.(*RequestID).RequestIDConfig
+	r.Initialize()
+}
+
+func (r *RequestID) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return skipPaths(r.SkipPaths, next, r.Middleware(next))
+}
@@ -0,0 +1,56 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	e := echo.New()
+	r := Decode(RawPlugin{
+		"name":    "request-id",
+		"order":   1,
+		"trusted": []interface{}{"10.0.0.0/8"},
+	}, e, nil).(*RequestID)
+	if !assert.NoError(t, r.ValidateConfig()) {
+		return
+	}
+	r.Initialize()
+	var upstream, template string
+	h := r.Process(func(c echo.Context) error {
+		upstream = c.Request().Header.Get(echo.HeaderXRequestID)
+		template, _ = NewTemplate("${request_id}").Execute(c)
+		return echo.ErrForbidden
+	})
+	do := func(remote, id string) string {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.RemoteAddr = remote
+		if id != "" {
+			req.Header.Set(echo.HeaderXRequestID, id)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		e.HTTPErrorHandler(h(c), c)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Equal(t, GetRequestID(c), rec.Header().Get(echo.HeaderXRequestID))
+		assert.Equal(t, upstream, rec.Header().Get(echo.HeaderXRequestID))
+		assert.Equal(t, upstream, template)
+		return upstream
+	}
+
+	// Generated
+	id := do("192.0.2.1:1234", "")
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, id)
+	assert.NotEqual(t, id, do("192.0.2.1:1234", ""))
+
+	// Trusted
+	assert.Equal(t, "lb-1", do("10.0.0.1:1234", "lb-1"))
+	assert.NotEqual(t, "lb-1", do("192.0.2.1:1234", "lb-1"))
+	assert.NotEqual(t, "lb 1\n", do("10.0.0.1:1234", "lb 1\n"))
+
+	assert.Error(t, Decode(RawPlugin{"name": "request-id", "order": 1, "trusted": []interface{}{"10.0.0"}}, e, nil).(*RequestID).ValidateConfig())
+}
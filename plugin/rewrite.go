@@ -1,7 +1,6 @@
 package plugin
 
 import (
-	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
@@ -22,9 +21,3 @@ func (r *Rewrite) Update(p Plugin) {
 	r.RewriteConfig = p.(*Rewrite).RewriteConfig
 	r.Initialize()
 }
-
-func (r *Rewrite) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-	return r.Middleware(next)
-}
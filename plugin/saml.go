@@ -0,0 +1,302 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/labstack/echo/v4"
+)
+
+// SAML 2.0 service provider with SP-initiated single sign-on.
+
+type (
+	Saml struct {
+		Base       `json:",squash" yaml:",squash"`
+		SamlConfig `json:",squash" yaml:",squash"`
+
+		casbinMid *casbinMiddleware
+	}
+
+	SamlConfig struct {
+		// RootURL is the service provider URL, the metadata is served at
+		// `saml/metadata` and assertions are consumed at `saml/acs` below it.
+		RootURL string `yaml:"root_url"`
+
+		// EntityID defaults to the metadata URL.
+		EntityID string `yaml:"entity_id"`
+
+		// Certificate and Key are the PEM files of the service provider RSA
+		// key pair, it signs requests and the session cookie.
+		Certificate string `yaml:"certificate"`
+		Key         string `yaml:"key"`
+
+		// IDPMetadataURL is fetched on initialization, IDPMetadata is a
+		// metadata file used instead.
+		IDPMetadataURL string `yaml:"idp_metadata_url" armor:"probe"`
+		IDPMetadata    string `yaml:"idp_metadata"`
+
+		// AllowIDPInitiated accepts assertions without a request from armor.
+		AllowIDPInitiated bool `yaml:"allow_idp_initiated"`
+
+		// CookieMaxAge is the session lifetime, default 1 hour.
+		CookieMaxAge time.Duration `yaml:"cookie_max_age"`
+
+		// UsernameAttribute is the assertion attribute used as the username,
+		// default the subject NameID.
+		UsernameAttribute string `yaml:"username_attr"`
+
+		// SkipPaths are requests passed without authentication, e.g.
+		// `/health` or `GET /public/*`.
+		SkipPaths []string `yaml:"skip_paths"`
+
+		// CasbinCfg authorizes the users, `subject_attr` is an assertion
+		// attribute.
+		CasbinCfg CasbinConfig `yaml:"casbin"`
+	}
+
+	samlCtxKey int
+)
+
+const (
+	SamlUsernameCtxKey samlCtxKey = iota
+	SamlAttributesCtxKey
+)
+
+const (
+	samlHeaderPrefix = "X-Saml-"
+
+	// samlMetadataTimeout bounds fetching the IdP metadata.
+	samlMetadataTimeout = 10 * time.Second
+)
+
+func (s *Saml) Initialize() {
+	s.casbinMid = nil
+	sp, err := newSamlServiceProvider(s.SamlConfig)
+	if err != nil {
+		if s.Logger != nil {
+			s.Logger.Errorf("saml: %v", err)
+		}
+		s.Middleware = internalErrorMid
+		return
+	}
+	sp.OnError = func(w http.ResponseWriter, r *http.Request, err error) {
+		if s.Logger != nil {
+			if e, ok := err.(*saml.InvalidResponseError); ok {
+				err = e.PrivateErr
+			}
+			s.Logger.Warnf("saml: %v", err)
+		}
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+	authz := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return next
+	}
+	if s.CasbinCfg.Model != "" {
+		casbinMid, err := newSubjectCasbinMiddleware(s.CasbinCfg, samlAttrGetter(s.CasbinCfg.SubjectAttribute))
+		if err != nil {
+			if s.Logger != nil {
+				s.Logger.Errorf("saml: invalid casbin config: %v", err)
+			}
+			s.Middleware = internalErrorMid
+			return
+		}
+		if attr := s.CasbinCfg.RoleAttribute; attr != "" {
+			casbinMid.RolesFunc = func(c echo.Context) []string {
+				attrs, _ := c.Request().Context().Value(SamlAttributesCtxKey).(samlsp.Attributes)
+				return attrs[attr]
+			}
+		}
+		s.casbinMid, authz = casbinMid, casbinMid.MiddlewareFunc()
+	}
+	config := s.SamlConfig
+	s.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := authz(next)
+		return func(c echo.Context) error {
+			w, r := c.Response(), c.Request()
+			switch r.URL.Path {
+			case sp.ServiceProvider.MetadataURL.Path, sp.ServiceProvider.AcsURL.Path:
+				sp.ServeHTTP(w, r)
+				return nil
+			}
+			session, err := sp.Session.GetSession(r)
+			if err == samlsp.ErrNoSession {
+				if c.IsWebSocket() {
+					return echo.ErrUnauthorized
+				}
+				sp.HandleStartAuthFlow(w, r)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			claims, ok := session.(samlsp.JWTSessionClaims)
+			if !ok {
+				return echo.ErrUnauthorized
+			}
+			username := claims.Subject
+			if config.UsernameAttribute != "" {
+				username = claims.Attributes.Get(config.UsernameAttribute)
+			}
+			setSamlUser(c, username, claims.Attributes)
+			return h(c)
+		}
+	}
+}
+
+// newSamlServiceProvider loads the key pair and IdP metadata of config.
+func newSamlServiceProvider(config SamlConfig) (*samlsp.Middleware, error) {
+	root, err := url.Parse(config.RootURL)
+	if err != nil || !root.IsAbs() {
+		return nil, fmt.Errorf("invalid saml root url=%s", config.RootURL)
+	}
+	pair, err := tls.LoadX509KeyPair(config.Certificate, config.Key)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("saml key must be an RSA key")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	var metadata *saml.EntityDescriptor
+	if config.IDPMetadata != "" {
+		b, err := ioutil.ReadFile(config.IDPMetadata)
+		if err != nil {
+			return nil, err
+		}
+		if metadata, err = samlsp.ParseMetadata(b); err != nil {
+			return nil, fmt.Errorf("invalid idp metadata=%s, error=%v", config.IDPMetadata, err)
+		}
+	} else {
+		u, err := url.Parse(config.IDPMetadataURL)
+		if err != nil || !u.IsAbs() {
+			return nil, fmt.Errorf("invalid idp metadata url=%s", config.IDPMetadataURL)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), samlMetadataTimeout)
+		defer cancel()
+		if metadata, err = samlsp.FetchMetadata(ctx, http.DefaultClient, *u); err != nil {
+			return nil, err
+		}
+	}
+	return samlsp.New(samlsp.Options{
+		EntityID:          config.EntityID,
+		URL:               *root,
+		Key:               key,
+		Certificate:       cert,
+		IDPMetadata:       metadata,
+		AllowIDPInitiated: config.AllowIDPInitiated,
+		CookieMaxAge:      config.CookieMaxAge,
+	})
+}
+
+func (s *Saml) Update(p Plugin) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.SamlConfig = p.(*Saml).SamlConfig
+	s.Initialize()
+}
+
+func (*Saml) Priority() int {
+	return -1
+}
+
+func (s *Saml) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return skipPaths(s.SkipPaths, next, s.Middleware(next))
+}
+
+func (s *Saml) ValidateConfig() error {
+	if u, err := url.Parse(s.RootURL); err != nil || !u.IsAbs() {
+		return fmt.Errorf("invalid saml root url=%s", s.RootURL)
+	}
+	if s.Certificate == "" || s.Key == "" {
+		return errors.New("saml certificate and key are required")
+	}
+	if s.IDPMetadata == "" && s.IDPMetadataURL == "" {
+		return errors.New("saml idp metadata or idp metadata url is required")
+	}
+	if err := validatePathRules(s.SkipPaths); err != nil {
+		return err
+	}
+	if s.CasbinCfg.Model != "" {
+		if _, err := s.CasbinCfg.Enforcer(); err != nil {
+			return fmt.Errorf("invalid casbin config: %v", err)
+		}
+	}
+	return nil
+}
+
+func (*Saml) DefaultConfig() interface{} {
+	return SamlConfig{
+		RootURL:        "https://www.example.com",
+		Certificate:    "/etc/armor/saml.crt",
+		Key:            "/etc/armor/saml.key",
+		IDPMetadataURL: "https://idp.example.com/metadata",
+	}
+}
+
+func (s *Saml) ProbeConfig(probe ProbeFunc) error {
+	return ProbeConfig(&s.SamlConfig, probe)
+}
+
+// Reload loads the casbin model and policy again, if configured.
+func (s *Saml) Reload() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.casbinMid == nil {
+		return nil
+	}
+	return s.casbinMid.Reload()
+}
+
+// setSamlUser stores the SAML user on the echo and request contexts and in
+// the upstream request headers, as X-SAML-User and X-SAML-Attr-*.
+func setSamlUser(c echo.Context, username string, attrs samlsp.Attributes) {
+	r := c.Request()
+	c.Set("samlAttributes", attrs)
+	c.Set("samlUsername", username)
+	newCtx := context.WithValue(r.Context(), SamlUsernameCtxKey, username)
+	newCtx = context.WithValue(newCtx, SamlAttributesCtxKey, attrs)
+
+	// Drop headers sent by the client
+	for k := range r.Header {
+		if strings.HasPrefix(k, samlHeaderPrefix) {
+			r.Header.Del(k)
+		}
+	}
+	r.Header.Set("X-SAML-User", username)
+	for k, v := range attrs {
+		r.Header.Set("X-SAML-Attr-"+k, strings.Join(v, " "))
+	}
+	c.SetRequest(r.WithContext(newCtx))
+}
+
+func getSamlUsername(c echo.Context) string {
+	username, _ := c.Request().Context().Value(SamlUsernameCtxKey).(string)
+	return username
+}
+
+// samlAttrGetter returns the casbin subject, the username or the attribute.
+func samlAttrGetter(attr string) func(c echo.Context) string {
+	if attr == "" {
+		return getSamlUsername
+	}
+	return func(c echo.Context) string {
+		attrs, _ := c.Request().Context().Value(SamlAttributesCtxKey).(samlsp.Attributes)
+		return attrs.Get(attr)
+	}
+}
@@ -0,0 +1,133 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml/samlsp"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const samlIDPMetadata = `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.labstack.com/metadata">
+	<IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+		<SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.labstack.com/sso"/>
+	</IDPSSODescriptor>
+</EntityDescriptor>`
+
+// writeSamlKeyPair writes a self-signed service provider key pair to dir.
+func writeSamlKeyPair(t *testing.T, dir string) (*rsa.PrivateKey, string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "armor"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, keyFile := filepath.Join(dir, "saml.crt"), filepath.Join(dir, "saml.key")
+	assert.NoError(t, ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	return key, cert, keyFile
+}
+
+func TestSaml(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	key, cert, keyFile := writeSamlKeyPair(t, dir)
+	metadata := filepath.Join(dir, "idp.xml")
+	assert.NoError(t, ioutil.WriteFile(metadata, []byte(samlIDPMetadata), 0644))
+
+	s := validated(t, &Saml{SamlConfig: SamlConfig{
+		RootURL:           "https://www.labstack.com",
+		Certificate:       cert,
+		Key:               keyFile,
+		IDPMetadata:       metadata,
+		UsernameAttribute: "uid",
+		CasbinCfg: CasbinConfig{
+			Model:  "testdata/casbin_model.conf",
+			Policy: "testdata/casbin_policy.csv",
+		},
+	}}).(*Saml)
+	e := echo.New()
+	var header http.Header
+	h := s.Process(func(c echo.Context) error {
+		header = c.Request().Header
+		return c.String(http.StatusOK, "OK")
+	})
+
+	// Metadata
+	req := httptest.NewRequest(echo.GET, "/saml/metadata", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "https://www.labstack.com/saml/acs")
+
+	// Login
+	req = httptest.NewRequest(echo.GET, "/users", nil)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusFound, rec.Code)
+	sso, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "idp.labstack.com", sso.Host)
+		assert.Equal(t, "/sso", sso.Path)
+		assert.NotEmpty(t, sso.Query().Get("SAMLRequest"))
+	}
+
+	// Session
+	root, _ := url.Parse(s.RootURL)
+	codec := samlsp.DefaultSessionCodec(samlsp.Options{URL: *root, Key: key})
+	session := func(uid string) *http.Cookie {
+		claims := samlsp.JWTSessionClaims{
+			Attributes:  samlsp.Attributes{"uid": {uid}, "groups": {"admin", "dev"}},
+			SAMLSession: true,
+		}
+		claims.Audience, claims.Issuer = codec.Audience, codec.Issuer
+		claims.Subject = "1234"
+		claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+		v, err := codec.Encode(claims)
+		assert.NoError(t, err)
+		return &http.Cookie{Name: "token", Value: v}
+	}
+	req = httptest.NewRequest(echo.GET, "/users", nil)
+	req.AddCookie(session("jon"))
+	req.Header.Set("X-SAML-Attr-Role", "admin")
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "jon", header.Get("X-SAML-User"))
+	assert.Equal(t, "admin dev", header.Get("X-SAML-Attr-Groups"))
+	assert.Empty(t, header.Get("X-SAML-Attr-Role"))
+
+	// Casbin
+	req = httptest.NewRequest(echo.GET, "/users", nil)
+	req.AddCookie(session("joe"))
+	assert.Equal(t, echo.ErrForbidden, h(e.NewContext(req, httptest.NewRecorder())))
+
+	// Invalid config
+	s.Key = filepath.Join(dir, "missing.key")
+	s.Initialize()
+	assert.Equal(t, echo.ErrInternalServerError, s.Process(h)(e.NewContext(req, httptest.NewRecorder())))
+}
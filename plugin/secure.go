@@ -1,7 +1,6 @@
 package plugin
 
 import (
-	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
@@ -22,9 +21,3 @@ func (s *Secure) Update(p Plugin) {
 	s.SecureConfig = p.(*Secure).SecureConfig
 	s.Initialize()
 }
-
-func (s *Secure) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	return s.Middleware(next)
-}
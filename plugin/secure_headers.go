@@ -0,0 +1,256 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Security response headers, Content-Security-Policy with a nonce generated
+// per request, HSTS, X-Frame-Options, Referrer-Policy and Permissions-Policy,
+// overridden for path patterns.
+
+type (
+	SecureHeaders struct {
+		Base                `json:",squash" yaml:",squash"`
+		SecureHeadersConfig `json:",squash" yaml:",squash"`
+	}
+
+	SecureHeadersConfig struct {
+		SecureHeadersPolicy `json:",squash" yaml:",squash"`
+
+		// Paths override the policy for the requests matching their path
+		// pattern, e.g. `/embed/**`, the first matching one applies.
+		Paths []SecureHeadersPath `yaml:"paths"`
+
+		// NonceHeader, if set, is the request header passing the nonce to the
+		// upstream, e.g. `X-CSP-Nonce`.
+		NonceHeader string `yaml:"nonce_header"`
+
+		// SkipPaths are requests passed without the headers.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// SecureHeadersPolicy are the headers, unset ones are not sent, or kept
+	// from the plugin policy for a path. An empty value disables a header.
+	SecureHeadersPolicy struct {
+		// ContentSecurityPolicy, `${nonce}` is replaced by the nonce of the
+		// request, e.g. `script-src 'self' 'nonce-${nonce}'`.
+		ContentSecurityPolicy *string `yaml:"content_security_policy"`
+
+		// CSPReportOnly sends the policy as
+		// Content-Security-Policy-Report-Only.
+		CSPReportOnly *bool `yaml:"csp_report_only"`
+
+		// HSTSMaxAge in seconds of Strict-Transport-Security, sent over
+		// HTTPS, with includeSubDomains and preload.
+		HSTSMaxAge            *int  `yaml:"hsts_max_age"`
+		HSTSIncludeSubdomains *bool `yaml:"hsts_include_subdomains"`
+		HSTSPreload           *bool `yaml:"hsts_preload"`
+
+		// FrameOptions is X-Frame-Options, `DENY` or `SAMEORIGIN`.
+		FrameOptions *string `yaml:"frame_options"`
+
+		// ReferrerPolicy, e.g. `strict-origin-when-cross-origin`.
+		ReferrerPolicy *string `yaml:"referrer_policy"`
+
+		// PermissionsPolicy, e.g. `camera=(), geolocation=(self)`.
+		PermissionsPolicy *string `yaml:"permissions_policy"`
+	}
+
+	SecureHeadersPath struct {
+		Path                string `yaml:"path"`
+		SecureHeadersPolicy `json:",squash" yaml:",squash"`
+	}
+
+	// secureHeaders are the headers of a policy, computed once.
+	secureHeaders struct {
+		csp, cspHeader string
+		nonce          bool
+		hsts           string
+		headers        [][2]string
+	}
+)
+
+const (
+	// CSPNonceKey is the context key of the nonce of the request, for
+	// handlers and templates, e.g. `${csp_nonce}` in body-rewrite.
+	CSPNonceKey = "csp_nonce"
+
+	// HSTS preload list requirement
+	hstsPreloadMinAge = 31536000
+)
+
+// merge returns p overridden by the set fields of o.
+func (p SecureHeadersPolicy) merge(o SecureHeadersPolicy) SecureHeadersPolicy {
+	if o.ContentSecurityPolicy != nil {
+		p.ContentSecurityPolicy = o.ContentSecurityPolicy
+	}
+	if o.CSPReportOnly != nil {
+		p.CSPReportOnly = o.CSPReportOnly
+	}
+	if o.HSTSMaxAge != nil {
+		p.HSTSMaxAge = o.HSTSMaxAge
+	}
+	if o.HSTSIncludeSubdomains != nil {
+		p.HSTSIncludeSubdomains = o.HSTSIncludeSubdomains
+	}
+	if o.HSTSPreload != nil {
+		p.HSTSPreload = o.HSTSPreload
+	}
+	if o.FrameOptions != nil {
+		p.FrameOptions = o.FrameOptions
+	}
+	if o.ReferrerPolicy != nil {
+		p.ReferrerPolicy = o.ReferrerPolicy
+	}
+	if o.PermissionsPolicy != nil {
+		p.PermissionsPolicy = o.PermissionsPolicy
+	}
+	return p
+}
+
+func (p SecureHeadersPolicy) validate() error {
+	if p.HSTSMaxAge != nil && *p.HSTSMaxAge < 0 {
+		return errors.New("invalid hsts_max_age")
+	}
+	if p.HSTSPreload != nil && *p.HSTSPreload {
+		if p.HSTSMaxAge == nil || *p.HSTSMaxAge < hstsPreloadMinAge ||
+			p.HSTSIncludeSubdomains == nil || !*p.HSTSIncludeSubdomains {
+			return fmt.Errorf("hsts_preload requires hsts_include_subdomains and hsts_max_age of at least %d", hstsPreloadMinAge)
+		}
+	}
+	if p.FrameOptions != nil {
+		switch strings.ToUpper(*p.FrameOptions) {
+		case "", "DENY", "SAMEORIGIN":
+		default:
+			return fmt.Errorf("invalid frame_options=%s", *p.FrameOptions)
+		}
+	}
+	return nil
+}
+
+func (p SecureHeadersPolicy) headers() *secureHeaders {
+	h := new(secureHeaders)
+	set := func(name string, v *string) {
+		if v != nil && *v != "" {
+			h.headers = append(h.headers, [2]string{name, *v})
+		}
+	}
+	if p.ContentSecurityPolicy != nil && *p.ContentSecurityPolicy != "" {
+		h.csp = *p.ContentSecurityPolicy
+		h.nonce = strings.Contains(h.csp, "${nonce}")
+		h.cspHeader = echo.HeaderContentSecurityPolicy
+		if p.CSPReportOnly != nil && *p.CSPReportOnly {
+			h.cspHeader = "Content-Security-Policy-Report-Only"
+		}
+	}
+	if p.HSTSMaxAge != nil && *p.HSTSMaxAge > 0 {
+		h.hsts = "max-age=" + strconv.Itoa(*p.HSTSMaxAge)
+		if p.HSTSIncludeSubdomains != nil && *p.HSTSIncludeSubdomains {
+			h.hsts += "; includeSubDomains"
+		}
+		if p.HSTSPreload != nil && *p.HSTSPreload {
+			h.hsts += "; preload"
+		}
+	}
+	if p.FrameOptions != nil {
+		o := strings.ToUpper(*p.FrameOptions)
+		set(echo.HeaderXFrameOptions, &o)
+	}
+	set("Referrer-Policy", p.ReferrerPolicy)
+	set("Permissions-Policy", p.PermissionsPolicy)
+	return h
+}
+
+// newNonce returns a random nonce, 128 bits in base64.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func (s *SecureHeaders) Initialize() {
+	base := s.headers()
+	type pathHeaders struct {
+		rule    pathRule
+		headers *secureHeaders
+	}
+	paths := make([]pathHeaders, 0, len(s.Paths))
+	for _, p := range s.Paths {
+		if r, err := parsePathRule(p.Path); err == nil {
+			paths = append(paths, pathHeaders{r, s.merge(p.SecureHeadersPolicy).headers()})
+		}
+	}
+	nonceHeader := s.NonceHeader
+	s.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			h := base
+			for _, p := range paths {
+				if p.rule.match(req.Method, req.URL.Path) {
+					h = p.headers
+					break
+				}
+			}
+			header := c.Response().Header()
+			if h.nonce || nonceHeader != "" {
+				nonce, err := newNonce()
+				if err != nil {
+					return err
+				}
+				c.Set(CSPNonceKey, nonce)
+				if nonceHeader != "" {
+					req.Header.Set(nonceHeader, nonce)
+				}
+				if h.csp != "" {
+					header.Set(h.cspHeader, strings.Replace(h.csp, "${nonce}", nonce, -1))
+				}
+			} else if h.csp != "" {
+				header.Set(h.cspHeader, h.csp)
+			}
+			if h.hsts != "" && (c.IsTLS() || req.Header.Get(echo.HeaderXForwardedProto) == "https") {
+				header.Set(echo.HeaderStrictTransportSecurity, h.hsts)
+			}
+			for _, kv := range h.headers {
+				header.Set(kv[0], kv[1])
+			}
+			return next(c)
+		}
+	}
+}
+
+func (s *SecureHeaders) Update(p Plugin) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.SecureHeadersConfig = p.(*SecureHeaders).SecureHeadersConfig
+	s.Initialize()
+}
+
+func (s *SecureHeaders) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return skipPaths(s.SkipPaths, next, s.Middleware(next))
+}
+
+func (s *SecureHeaders) ValidateConfig() error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	for _, p := range s.Paths {
+		if _, err := parsePathRule(p.Path); err != nil {
+			return err
+		}
+		if err := s.merge(p.SecureHeadersPolicy).validate(); err != nil {
+			return fmt.Errorf("path=%s, %v", p.Path, err)
+		}
+	}
+	return validatePathRules(s.SkipPaths)
+}
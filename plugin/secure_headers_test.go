@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecureHeaders(t *testing.T) {
+	e := echo.New()
+	p := Decode(RawPlugin{
+		"name":                    PluginSecureHeaders,
+		"order":                   1,
+		"content_security_policy": "script-src 'self' 'nonce-${nonce}'",
+		"hsts_max_age":            31536000,
+		"hsts_include_subdomains": true,
+		"hsts_preload":            true,
+		"frame_options":           "deny",
+		"referrer_policy":         "no-referrer",
+		"permissions_policy":      "camera=()",
+		"nonce_header":            "X-CSP-Nonce",
+		"paths": []interface{}{
+			map[string]interface{}{"path": "/embed/**", "frame_options": "", "csp_report_only": true},
+		},
+	}, e, nil).(*SecureHeaders)
+	if !assert.NoError(t, p.ValidateConfig()) {
+		return
+	}
+	p.Initialize()
+
+	do := func(path string, tls bool) (*httptest.ResponseRecorder, string, string) {
+		req := httptest.NewRequest(echo.GET, path, nil)
+		if tls {
+			req.Header.Set(echo.HeaderXForwardedProto, "https")
+		}
+		rec := httptest.NewRecorder()
+		var nonce, upstream string
+		p.Process(func(c echo.Context) error {
+			nonce, _ = c.Get(CSPNonceKey).(string)
+			upstream = c.Request().Header.Get("X-CSP-Nonce")
+			return c.String(http.StatusOK, "OK")
+		})(e.NewContext(req, rec))
+		return rec, nonce, upstream
+	}
+
+	rec, nonce, upstream := do("/", true)
+	assert.NotEmpty(t, nonce)
+	assert.Equal(t, nonce, upstream)
+	assert.Equal(t, "script-src 'self' 'nonce-"+nonce+"'", rec.Header().Get(echo.HeaderContentSecurityPolicy))
+	assert.Equal(t, "max-age=31536000; includeSubDomains; preload", rec.Header().Get(echo.HeaderStrictTransportSecurity))
+	assert.Equal(t, "DENY", rec.Header().Get(echo.HeaderXFrameOptions))
+	assert.Equal(t, "no-referrer", rec.Header().Get("Referrer-Policy"))
+	assert.Equal(t, "camera=()", rec.Header().Get("Permissions-Policy"))
+
+	// A nonce per request, HSTS over HTTPS only
+	rec, next, _ := do("/", false)
+	assert.NotEqual(t, nonce, next)
+	assert.Empty(t, rec.Header().Get(echo.HeaderStrictTransportSecurity))
+
+	// Path override
+	rec, nonce, _ = do("/embed/video", false)
+	assert.Empty(t, rec.Header().Get(echo.HeaderXFrameOptions))
+	assert.Empty(t, rec.Header().Get(echo.HeaderContentSecurityPolicy))
+	assert.True(t, strings.HasSuffix(rec.Header().Get("Content-Security-Policy-Report-Only"), nonce+"'"))
+	assert.Equal(t, "no-referrer", rec.Header().Get("Referrer-Policy"))
+
+	// The nonce in templates
+	assert.True(t, templateTag(CSPNonceKey))
+}
+
+func TestSecureHeadersValidateConfig(t *testing.T) {
+	p := Decode(RawPlugin{
+		"name":          PluginSecureHeaders,
+		"order":         1,
+		"hsts_max_age":  3600,
+		"hsts_preload":  true,
+		"frame_options": "ALLOW-FROM https://example.com",
+	}, echo.New(), nil).(*SecureHeaders)
+	assert.Error(t, p.ValidateConfig())
+}
@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Path patterns of the auth plugins, `/metrics`, `/public/*` or `/static/**`,
+// optionally with a method, e.g. `GET /public/*`.
+
+type pathRule struct {
+	method  string
+	pattern string
+}
+
+func parsePathRule(s string) (pathRule, error) {
+	r := pathRule{pattern: strings.TrimSpace(s)}
+	if i := strings.IndexByte(r.pattern, ' '); i > 0 {
+		r.method, r.pattern = strings.ToUpper(r.pattern[:i]), strings.TrimSpace(r.pattern[i+1:])
+	}
+	if !strings.HasPrefix(r.pattern, "/") {
+		return r, fmt.Errorf("invalid path pattern=%s", s)
+	}
+	if _, err := path.Match(strings.TrimSuffix(r.pattern, "/**"), ""); err != nil {
+		return r, fmt.Errorf("invalid path pattern=%s", s)
+	}
+	return r, nil
+}
+
+func (r pathRule) match(method, p string) bool {
+	if r.method != "" && r.method != method {
+		return false
+	}
+	return matchPath(r.pattern, cleanPath(p))
+}
+
+// cleanPath returns p without dot segments and duplicate slashes, as the
+// upstream may route it, e.g. `/public/../admin` is `/admin`. A trailing
+// slash is kept.
+func cleanPath(p string) string {
+	c := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && c != "/" {
+		c += "/"
+	}
+	return c
+}
+
+// matchPath matches p with path.Match, a trailing `/**` matches the
+// directory and everything below it.
+func matchPath(pattern, p string) bool {
+	if strings.HasSuffix(pattern, "/**") {
+		dir := strings.TrimSuffix(pattern, "/**")
+		for ; p != "/" && p != "."; p = path.Dir(p) {
+			if ok, _ := path.Match(dir, p); ok {
+				return true
+			}
+		}
+		return dir == ""
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// matchPaths reports whether r matches one of the rules.
+func matchPaths(rules []string, r *http.Request) bool {
+	for _, s := range rules {
+		if rule, err := parsePathRule(s); err == nil && rule.match(r.Method, r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePathRules(rules []string) error {
+	for _, s := range rules {
+		if _, err := parsePathRule(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipPaths calls next, without h, for requests matching one of the rules.
+func skipPaths(rules []string, next, h echo.HandlerFunc) echo.HandlerFunc {
+	if len(rules) == 0 {
+		return h
+	}
+	parsed := make([]pathRule, 0, len(rules))
+	for _, s := range rules {
+		if r, err := parsePathRule(s); err == nil {
+			parsed = append(parsed, r)
+		}
+	}
+	return func(c echo.Context) error {
+		r := c.Request()
+		for _, rule := range parsed {
+			if rule.match(r.Method, r.URL.Path) {
+				return next(c)
+			}
+		}
+		return h(c)
+	}
+}
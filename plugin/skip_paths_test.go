@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchPath(t *testing.T) {
+	for _, c := range []struct {
+		pattern, path string
+		match         bool
+	}{
+		{"/health", "/health", true},
+		{"/health", "/healthz", false},
+		{"/public/*", "/public/index.html", true},
+		{"/public/*", "/public/css/main.css", false},
+		{"/static/**", "/static", true},
+		{"/static/**", "/static/css/main.css", true},
+		{"/static/**", "/statics/main.css", false},
+		{"/**", "/users", true},
+	} {
+		assert.Equal(t, c.match, matchPath(c.pattern, c.path), c.pattern+" "+c.path)
+	}
+}
+
+func TestSkipPaths(t *testing.T) {
+	s := newCasServer("jon", nil, time.Now())
+	defer s.Close()
+	c := initialized(&Cas{CasConfig: CasConfig{URL: s.URL + "/cas", SkipPaths: []string{"/health", "GET /public/*"}}}).(*Cas)
+	assert.NoError(t, c.ValidateConfig())
+	h := c.Process(func(c echo.Context) error {
+		return c.String(http.StatusOK, getUsername(c))
+	})
+	e := echo.New()
+	for _, r := range []struct {
+		method, path string
+		code         int
+	}{
+		{echo.GET, "/health", http.StatusOK},
+		{echo.POST, "/health", http.StatusOK},
+		{echo.GET, "/public/logo.png", http.StatusOK},
+		{echo.POST, "/public/logo.png", http.StatusFound},
+		{echo.GET, "/users", http.StatusFound},
+		// Dot segments
+		{echo.GET, "/public/..", http.StatusFound},
+		{echo.GET, "/public/../users", http.StatusFound},
+		{echo.GET, "/public/css/../logo.png", http.StatusOK},
+		{echo.GET, "/users/../health", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		assert.NoError(t, h(e.NewContext(httptest.NewRequest(r.method, r.path, nil), rec)))
+		assert.Equal(t, r.code, rec.Code, r.method+" "+r.path)
+	}
+
+	for _, rules := range [][]string{{"health"}, {"GET /["}} {
+		assert.Error(t, (&Cas{CasConfig: CasConfig{URL: s.URL, SkipPaths: rules}}).ValidateConfig())
+	}
+}
@@ -1,7 +1,6 @@
 package plugin
 
 import (
-	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
@@ -28,12 +27,6 @@ func (s *AddTrailingSlash) Update(p Plugin) {
 	s.Initialize()
 }
 
-func (s *AddTrailingSlash) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	return s.Middleware(next)
-}
-
 func (s *RemoveTrailingSlash) Initialize() {
 	s.Middleware = middleware.RemoveTrailingSlashWithConfig(s.TrailingSlashConfig)
 }
@@ -44,9 +37,3 @@ func (s *RemoveTrailingSlash) Update(p Plugin) {
 	s.TrailingSlashConfig = p.(*RemoveTrailingSlash).TrailingSlashConfig
 	s.Initialize()
 }
-
-func (s *RemoveTrailingSlash) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	return s.Middleware(next)
-}
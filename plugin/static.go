@@ -1,19 +1,207 @@
 package plugin
 
 import (
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
 )
 
+// Static files of a directory, with ETag, Last-Modified and ranges, directory
+// listings, a 404 page and a fallback to the index for single page apps.
+
 type (
 	Static struct {
-		Base                    `yaml:",squash"`
-		middleware.StaticConfig `yaml:",squash"`
+		Base         `yaml:",squash"`
+		StaticConfig `yaml:",squash"`
+	}
+
+	StaticConfig struct {
+		// Root is the directory served, default the working directory.
+		Root string `yaml:"root"`
+
+		// Index is the file of the directories, default `index.html`.
+		Index string `yaml:"index"`
+
+		// Browse lists the directories without an index.
+		Browse bool `yaml:"browse"`
+
+		// SPA serves the Index of Root for the GET requests of unknown paths,
+		// so a single page app routes them. HTML5 is its former name.
+		SPA   bool `yaml:"spa"`
+		HTML5 bool `yaml:"html5"`
+
+		// NotFound is a page of Root, e.g. `404.html`, of the unknown paths.
+		NotFound string `yaml:"not_found"`
 	}
 )
 
+var staticListing = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<ul>
+{{range .Files}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+func (c StaticConfig) root() string {
+	if c.Root == "" {
+		return "."
+	}
+	return c.Root
+}
+
+func (c StaticConfig) index() string {
+	if c.Index == "" {
+		return "index.html"
+	}
+	return c.Index
+}
+
+// staticETag returns a weak ETag of the size and modification time of fi.
+func staticETag(fi os.FileInfo) string {
+	return `W/"` + strconv.FormatInt(fi.Size(), 16) + "-" + strconv.FormatInt(fi.ModTime().UnixNano(), 16) + `"`
+}
+
+// serveFile serves the file name with the ETag, conditional and range
+// requests.
+func serveFile(c echo.Context, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("Etag", staticETag(fi))
+	http.ServeContent(c.Response(), c.Request(), fi.Name(), fi.ModTime(), f)
+	return nil
+}
+
+// listDir writes the entries of the directory name.
+func listDir(c echo.Context, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, err := f.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	type file struct{ Name, URL string }
+	data := struct {
+		Path  string
+		Files []file
+	}{Path: c.Request().URL.Path}
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() {
+			n += "/"
+		}
+		data.Files = append(data.Files, file{n, (&url.URL{Path: n}).String()})
+	}
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	res.WriteHeader(http.StatusOK)
+	return staticListing.Execute(res, data)
+}
+
+func (s *Static) ValidateConfig() error {
+	fi, err := os.Stat(s.root())
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("static root=%s is not a directory", s.Root)
+	}
+	return nil
+}
+
 func (s *Static) Initialize() {
-	s.Middleware = middleware.StaticWithConfig(s.StaticConfig)
+	config := s.StaticConfig
+	root, index := config.root(), config.index()
+	spa := config.SPA || config.HTML5
+
+	// notFound serves the SPA index or the 404 page for err of the next
+	// handlers.
+	notFound := func(c echo.Context, err error) error {
+		if he, ok := err.(*echo.HTTPError); !ok || he.Code != http.StatusNotFound {
+			return err
+		}
+		method := c.Request().Method
+		if spa && (method == http.MethodGet || method == http.MethodHead) {
+			return serveFile(c, filepath.Join(root, index))
+		}
+		if config.NotFound != "" {
+			f, ferr := os.Open(filepath.Join(root, config.NotFound))
+			if ferr != nil {
+				return err
+			}
+			defer f.Close()
+			ct := mime.TypeByExtension(filepath.Ext(config.NotFound))
+			if ct == "" {
+				ct = echo.MIMETextHTMLCharsetUTF8
+			}
+			return c.Stream(http.StatusNotFound, ct, f)
+		}
+		return err
+	}
+
+	s.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			p := c.Request().URL.Path
+			if strings.HasSuffix(c.Path(), "*") { // The path of a group, e.g. `/docs/*`
+				p = c.Param("*")
+			}
+			p, err := url.PathUnescape(p)
+			if err != nil {
+				return err
+			}
+			name := filepath.Join(root, path.Clean("/"+p)) // "/"+ for security
+			fi, err := os.Stat(name)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return notFound(c, next(c))
+				}
+				return err
+			}
+			if !fi.IsDir() {
+				return serveFile(c, name)
+			}
+			// Directory, relative links need the trailing slash
+			if u := c.Request().URL; !strings.HasSuffix(u.Path, "/") {
+				target := u.Path + "/"
+				if u.RawQuery != "" {
+					target += "?" + u.RawQuery
+				}
+				return c.Redirect(http.StatusMovedPermanently, target)
+			}
+			if _, err := os.Stat(filepath.Join(name, index)); err == nil {
+				return serveFile(c, filepath.Join(name, index))
+			}
+			if config.Browse {
+				return listDir(c, name)
+			}
+			return notFound(c, next(c))
+		}
+	}
 }
 
 func (s *Static) Update(p Plugin) {
@@ -22,9 +210,3 @@ func (s *Static) Update(p Plugin) {
 	s.StaticConfig = p.(*Static).StaticConfig
 	s.Initialize()
 }
-
-func (s *Static) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	return s.Middleware(next)
-}
@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatic(t *testing.T) {
+	root, err := ioutil.TempDir("", "armor-static")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(root)
+	for name, body := range map[string]string{
+		"index.html":        "<h1>Home</h1>",
+		"404.html":          "<h1>Not Found</h1>",
+		"docs/guide.txt":    "0123456789",
+		"assets/index.html": "<h1>Assets</h1>",
+		"files/a.txt":       "a",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(root, name), []byte(body), 0644))
+	}
+
+	e := echo.New()
+	newStatic := func(raw RawPlugin) *Static {
+		raw["name"], raw["order"], raw["root"] = PluginStatic, 1, root
+		s := Decode(raw, e, nil).(*Static)
+		assert.NoError(t, s.ValidateConfig())
+		s.Initialize()
+		return s
+	}
+	do := func(s *Static, method, path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if err := s.Process(echo.NotFoundHandler)(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+
+	s := newStatic(RawPlugin{"browse": true, "not_found": "404.html"})
+
+	// ETag, Last-Modified and ranges
+	rec := do(s, echo.GET, "/docs/guide.txt")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0123456789", rec.Body.String())
+	etag := rec.Header().Get("Etag")
+	assert.Regexp(t, `^W/"a-[0-9a-f]+"$`, etag)
+	assert.NotEmpty(t, rec.Header().Get(echo.HeaderLastModified))
+	assert.Equal(t, http.StatusNotModified, do(s, echo.GET, "/docs/guide.txt", "If-None-Match", etag).Code)
+	rec = do(s, echo.GET, "/docs/guide.txt", "Range", "bytes=2-4")
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "234", rec.Body.String())
+	assert.Equal(t, "bytes 2-4/10", rec.Header().Get("Content-Range"))
+
+	// Directories
+	rec = do(s, echo.GET, "/assets")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "/assets/", rec.Header().Get(echo.HeaderLocation))
+	assert.Equal(t, "<h1>Assets</h1>", do(s, echo.GET, "/assets/").Body.String())
+	rec = do(s, echo.GET, "/files/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `<a href="a.txt">a.txt</a>`)
+
+	// 404 page
+	rec = do(s, echo.GET, "/missing")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "<h1>Not Found</h1>", rec.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get(echo.HeaderContentType))
+
+	// Without browse
+	s = newStatic(RawPlugin{})
+	assert.Equal(t, http.StatusNotFound, do(s, echo.GET, "/files/").Code)
+
+	// SPA
+	s = newStatic(RawPlugin{"spa": true})
+	rec = do(s, echo.GET, "/app/orders/1")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "<h1>Home</h1>", rec.Body.String())
+	assert.Equal(t, http.StatusNotFound, do(s, echo.POST, "/app/orders").Code)
+	assert.Equal(t, "0123456789", do(s, echo.GET, "/docs/guide.txt").Body.String())
+
+	// Root
+	s = Decode(RawPlugin{"name": PluginStatic, "order": 1, "root": filepath.Join(root, "index.html")}, e, nil).(*Static)
+	assert.Error(t, s.ValidateConfig())
+}
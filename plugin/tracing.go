@@ -0,0 +1,284 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Trace requests with OpenTelemetry spans exported over OTLP, the trace
+// context is propagated upstream with the W3C traceparent header.
+
+type (
+	Tracing struct {
+		Base          `json:",squash" yaml:",squash"`
+		TracingConfig `json:",squash" yaml:",squash"`
+
+		exporter       *spanExporter
+		exporterConfig tracingExporterKey
+	}
+
+	TracingConfig struct {
+		// ServiceName is the `service.name` of the spans, default `armor`.
+		ServiceName string `yaml:"service_name"`
+
+		// SampleRatio, from 0 to 1 (default), is the share of new traces
+		// sampled. Requests with a trace context follow its sampling.
+		SampleRatio *float64 `yaml:"sample_ratio"`
+
+		// Exporter sends the spans to an OTLP collector.
+		Exporter TracingExporter `yaml:"exporter"`
+
+		// SkipPaths are requests not traced, e.g. `/health`.
+		SkipPaths []string `yaml:"skip_paths"`
+	}
+
+	// TracingExporter sends the spans over OTLP `grpc` (default), to
+	// Endpoint host:port, or `http`, to the Endpoint URL. Headers are sent
+	// with each export, e.g. an API key.
+	TracingExporter struct {
+		Protocol string            `yaml:"protocol"`
+		Endpoint string            `yaml:"endpoint"`
+		Headers  map[string]string `yaml:"headers"`
+		Insecure bool              `yaml:"insecure"`
+		Timeout  time.Duration     `yaml:"timeout"`
+	}
+
+	// tracingExporterKey compares exporter configs, the headers as a string.
+	tracingExporterKey struct {
+		protocol, endpoint, headers, service string
+		insecure                             bool
+		timeout                              time.Duration
+	}
+
+	traceID [16]byte
+	spanID  [8]byte
+
+	span struct {
+		traceID       traceID
+		spanID        spanID
+		parentID      spanID
+		traceState    string
+		sampled       bool
+		name          string
+		start         time.Time
+		end           time.Time
+		attributes    []spanAttribute
+		status        int
+		statusMessage string
+	}
+
+	spanAttribute struct {
+		key   string
+		value interface{}
+	}
+)
+
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+
+	// casbinDecisionKey is the echo context key of the casbin decision,
+	// `allow` or `deny`.
+	casbinDecisionKey = "casbinDecision"
+)
+
+func (t TracingExporter) key(service string) tracingExporterKey {
+	headers := make([]string, 0, len(t.Headers))
+	for k, v := range t.Headers {
+		headers = append(headers, k+"="+v)
+	}
+	sort.Strings(headers)
+	return tracingExporterKey{
+		protocol: t.Protocol,
+		endpoint: t.Endpoint,
+		headers:  strings.Join(headers, "\n"),
+		service:  service,
+		insecure: t.Insecure,
+		timeout:  t.Timeout,
+	}
+}
+
+func (c TracingConfig) serviceName() string {
+	if c.ServiceName == "" {
+		return "armor"
+	}
+	return c.ServiceName
+}
+
+func (c TracingConfig) sampleRatio() float64 {
+	if c.SampleRatio == nil {
+		return 1
+	}
+	return *c.SampleRatio
+}
+
+// parseTraceparent parses a version 00 traceparent header.
+func parseTraceparent(v string) (tid traceID, sid spanID, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return
+	}
+	if _, err := hex.Decode(tid[:], []byte(parts[1])); err != nil || tid == (traceID{}) {
+		return
+	}
+	if _, err := hex.Decode(sid[:], []byte(parts[2])); err != nil || sid == (spanID{}) {
+		return
+	}
+	return tid, sid, flags[0]&1 == 1, true
+}
+
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+func (s *span) set(key string, value interface{}) {
+	s.attributes = append(s.attributes, spanAttribute{key, value})
+}
+
+// sampledTrace samples the trace id by ratio, consistently across services
+// sampling by the trace id.
+func sampledTrace(tid traceID, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(tid[8:])>>1) < ratio*float64(math.MaxInt64)
+}
+
+// newSpan starts the span of r, a child of the trace context of r if any.
+func newSpan(r *http.Request, ratio float64) *span {
+	s := &span{name: r.Method, start: time.Now()}
+	rand.Read(s.spanID[:])
+	if tid, parent, sampled, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		s.traceID, s.parentID, s.sampled = tid, parent, sampled
+		s.traceState = r.Header.Get(tracestateHeader)
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = sampledTrace(s.traceID, ratio)
+	}
+	return s
+}
+
+func (t *Tracing) Initialize() {
+	key := t.Exporter.key(t.serviceName())
+	// The queued spans are kept on updates of the sampling
+	if t.exporter != nil && t.exporterConfig != key {
+		t.exporter.stop(context.Background())
+		t.exporter = nil
+	}
+	if t.exporter == nil {
+		resource := []spanAttribute{{"service.name", t.serviceName()}}
+		exporter, err := newSpanExporter(t.Exporter, resource, t.Logger)
+		if err != nil {
+			if t.Logger != nil {
+				t.Logger.Errorf("tracing: invalid exporter: %v", err)
+			}
+			t.Middleware = internalErrorMid
+			return
+		}
+		t.exporter, t.exporterConfig = exporter, key
+	}
+	exporter, ratio := t.exporter, t.sampleRatio()
+	t.Middleware = func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			req := c.Request()
+			s := newSpan(req, ratio)
+			// The upstream continues the trace as a child of the span
+			req.Header.Set(traceparentHeader, s.traceparent())
+			if !s.sampled {
+				return next(c)
+			}
+			if err = next(c); err != nil {
+				c.Error(err)
+			}
+			s.end = time.Now()
+			status := c.Response().Status
+			s.set("http.request.method", req.Method)
+			s.set("url.path", req.URL.Path)
+			s.set("url.scheme", c.Scheme())
+			s.set("server.address", req.Host)
+			s.set("client.address", c.RealIP())
+			s.set("user_agent.original", req.UserAgent())
+			s.set("http.response.status_code", status)
+			if sub := AuthSubject(c); sub != "" {
+				s.set("enduser.id", sub)
+			}
+			if d, ok := c.Get(casbinDecisionKey).(string); ok {
+				s.set("armor.casbin.decision", d)
+			}
+			if status >= http.StatusInternalServerError {
+				s.status, s.statusMessage = spanStatusError, http.StatusText(status)
+			}
+			exporter.export(s)
+			// Handled
+			return nil
+		}
+	}
+}
+
+func (t *Tracing) Update(p Plugin) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.TracingConfig = p.(*Tracing).TracingConfig
+	t.Initialize()
+}
+
+func (t *Tracing) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return skipPaths(t.SkipPaths, next, t.Middleware(next))
+}
+
+func (t *Tracing) ValidateConfig() error {
+	if r := t.sampleRatio(); r < 0 || r > 1 {
+		return fmt.Errorf("invalid tracing sample ratio=%v", r)
+	}
+	switch t.Exporter.Protocol {
+	case "", TracingExporterGRPC:
+		if strings.Contains(t.Exporter.Endpoint, "://") {
+			return fmt.Errorf("tracing grpc exporter requires a host:port endpoint=%s", t.Exporter.Endpoint)
+		}
+	case TracingExporterHTTP:
+		if t.Exporter.Endpoint != "" && !strings.HasPrefix(t.Exporter.Endpoint, "http://") && !strings.HasPrefix(t.Exporter.Endpoint, "https://") {
+			return fmt.Errorf("tracing http exporter requires an endpoint url=%s", t.Exporter.Endpoint)
+		}
+	default:
+		return fmt.Errorf("invalid tracing exporter protocol=%s", t.Exporter.Protocol)
+	}
+	if t.Exporter.Timeout < 0 {
+		return errors.New("invalid tracing exporter timeout")
+	}
+	return validatePathRules(t.SkipPaths)
+}
+
+// ShutdownGrace exports the queued spans.
+func (t *Tracing) ShutdownGrace(ctx context.Context) {
+	t.mutex.Lock()
+	x := t.exporter
+	t.exporter = nil
+	t.mutex.Unlock()
+	if x != nil {
+		x.stop(ctx)
+	}
+}
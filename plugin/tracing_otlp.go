@@ -0,0 +1,333 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// OTLP span export, encoding the protobuf messages of opentelemetry-proto
+// trace v1 by hand.
+
+type (
+	// spanExporter sends the spans in batches to an OTLP collector.
+	spanExporter struct {
+		config   TracingExporter
+		resource []spanAttribute
+		logger   *log.Logger
+		send     func(ctx context.Context, body []byte) error
+		conn     *grpc.ClientConn
+		spans    chan *span
+		done     chan struct{}
+		stopped  chan struct{}
+		stopOnce sync.Once
+	}
+
+	// otlpCodec passes the encoded messages to gRPC as is.
+	otlpCodec struct{}
+)
+
+const (
+	// Exporter protocols
+	TracingExporterGRPC = "grpc"
+	TracingExporterHTTP = "http"
+
+	otlpExportMethod = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+
+	spanQueueSize     = 2048
+	spanBatchSize     = 512
+	spanBatchInterval = 5 * time.Second
+
+	spanKindServer  = 2
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+func (otlpCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("otlp: unexpected message type=%T", v)
+	}
+	return *b, nil
+}
+
+func (otlpCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("otlp: unexpected message type=%T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (otlpCodec) String() string {
+	return "proto"
+}
+
+func (e TracingExporter) endpoint() string {
+	if e.Endpoint != "" {
+		return e.Endpoint
+	}
+	if e.Protocol == TracingExporterHTTP {
+		return "http://localhost:4318/v1/traces"
+	}
+	return "localhost:4317"
+}
+
+func (e TracingExporter) timeout() time.Duration {
+	if e.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return e.Timeout
+}
+
+func newSpanExporter(config TracingExporter, resource []spanAttribute, logger *log.Logger) (*spanExporter, error) {
+	x := &spanExporter{
+		config:   config,
+		resource: resource,
+		logger:   logger,
+		spans:    make(chan *span, spanQueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	switch config.Protocol {
+	case "", TracingExporterGRPC:
+		opt := grpc.WithInsecure()
+		if !config.Insecure {
+			opt = grpc.WithTransportCredentials(credentials.NewTLS(new(tls.Config)))
+		}
+		conn, err := grpc.Dial(config.endpoint(), opt)
+		if err != nil {
+			return nil, err
+		}
+		x.conn = conn
+		x.send = x.sendGRPC
+	case TracingExporterHTTP:
+		x.send = x.sendHTTP
+	default:
+		return nil, fmt.Errorf("invalid tracing exporter protocol=%s", config.Protocol)
+	}
+	go x.run()
+	return x, nil
+}
+
+// export queues s, it is dropped if the queue is full.
+func (x *spanExporter) export(s *span) {
+	select {
+	case x.spans <- s:
+	default:
+	}
+}
+
+func (x *spanExporter) run() {
+	defer close(x.stopped)
+	t := time.NewTicker(spanBatchInterval)
+	defer t.Stop()
+	batch := make([]*span, 0, spanBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), x.config.timeout())
+		if err := x.send(ctx, encodeExportRequest(x.resource, batch)); err != nil && x.logger != nil {
+			x.logger.Errorf("tracing: failed to export %d spans: %v", len(batch), err)
+		}
+		cancel()
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-x.spans:
+			if batch = append(batch, s); len(batch) == spanBatchSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		case <-x.done:
+			for {
+				select {
+				case s := <-x.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// stop exports the queued spans and closes the connection.
+func (x *spanExporter) stop(ctx context.Context) {
+	x.stopOnce.Do(func() {
+		close(x.done)
+	})
+	select {
+	case <-x.stopped:
+	case <-ctx.Done():
+	}
+	if x.conn != nil {
+		x.conn.Close()
+	}
+}
+
+func (x *spanExporter) sendGRPC(ctx context.Context, body []byte) error {
+	if len(x.config.Headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(x.config.Headers))
+	}
+	var res []byte
+	return x.conn.Invoke(ctx, otlpExportMethod, &body, &res, grpc.CallCustomCodec(otlpCodec{}))
+}
+
+func (x *spanExporter) sendHTTP(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, x.config.endpoint(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range x.config.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return errors.New(res.Status)
+	}
+	return nil
+}
+
+// Protobuf wire format
+
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (b *protoBuffer) tag(field int, wire uint64) {
+	b.varint(uint64(field)<<3 | wire)
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.tag(field, 2)
+	b.varint(uint64(len(v)))
+	b.Write(v)
+}
+
+func (b *protoBuffer) string(field int, v string) {
+	if v != "" {
+		b.bytes(field, []byte(v))
+	}
+}
+
+func (b *protoBuffer) uint(field int, v uint64) {
+	if v != 0 {
+		b.tag(field, 0)
+		b.varint(v)
+	}
+}
+
+func (b *protoBuffer) fixed64(field int, v uint64) {
+	b.tag(field, 1)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	b.Write(buf[:])
+}
+
+// message writes the message encoded by f as field.
+func (b *protoBuffer) message(field int, f func(*protoBuffer)) {
+	m := new(protoBuffer)
+	f(m)
+	b.bytes(field, m.Bytes())
+}
+
+// KeyValue
+func (b *protoBuffer) attribute(field int, a spanAttribute) {
+	b.message(field, func(kv *protoBuffer) {
+		kv.string(1, a.key)
+		// AnyValue
+		kv.message(2, func(v *protoBuffer) {
+			switch value := a.value.(type) {
+			case string:
+				v.bytes(1, []byte(value))
+			case bool:
+				v.tag(2, 0)
+				if value {
+					v.varint(1)
+				} else {
+					v.varint(0)
+				}
+			case int:
+				v.tag(3, 0)
+				v.varint(uint64(value))
+			case float64:
+				v.fixed64(4, math.Float64bits(value))
+			}
+		})
+	})
+}
+
+// encodeExportRequest encodes ExportTraceServiceRequest.
+func encodeExportRequest(resource []spanAttribute, spans []*span) []byte {
+	b := new(protoBuffer)
+	// ResourceSpans
+	b.message(1, func(rs *protoBuffer) {
+		rs.message(1, func(r *protoBuffer) {
+			for _, a := range resource {
+				r.attribute(1, a)
+			}
+		})
+		// ScopeSpans
+		rs.message(2, func(ss *protoBuffer) {
+			ss.message(1, func(scope *protoBuffer) {
+				scope.string(1, "github.com/labstack/armor")
+			})
+			for _, s := range spans {
+				ss.message(2, s.encode)
+			}
+		})
+	})
+	return b.Bytes()
+}
+
+// encode encodes Span.
+func (s *span) encode(b *protoBuffer) {
+	b.bytes(1, s.traceID[:])
+	b.bytes(2, s.spanID[:])
+	b.string(3, s.traceState)
+	if s.parentID != (spanID{}) {
+		b.bytes(4, s.parentID[:])
+	}
+	b.string(5, s.name)
+	b.uint(6, spanKindServer)
+	b.fixed64(7, uint64(s.start.UnixNano()))
+	b.fixed64(8, uint64(s.end.UnixNano()))
+	for _, a := range s.attributes {
+		b.attribute(9, a)
+	}
+	b.message(15, func(st *protoBuffer) {
+		st.string(2, s.statusMessage)
+		st.uint(3, uint64(s.status))
+	})
+}
@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func traced(tr *Tracing, traceparent string) (upstream string) {
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	if traceparent != "" {
+		req.Header.Set(traceparentHeader, traceparent)
+	}
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.Set("casUsername", "alice")
+	c.Set(casbinDecisionKey, "allow")
+	tr.Process(func(c echo.Context) error {
+		upstream = c.Request().Header.Get(traceparentHeader)
+		return c.String(http.StatusOK, "OK")
+	})(c)
+	return
+}
+
+func TestTracing(t *testing.T) {
+	var (
+		mutex  sync.Mutex
+		bodies [][]byte
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Api-Key"))
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		bodies = append(bodies, body)
+		mutex.Unlock()
+	}))
+	defer s.Close()
+	tr := initialized(&Tracing{TracingConfig: TracingConfig{
+		ServiceName: "gateway",
+		Exporter: TracingExporter{
+			Protocol: TracingExporterHTTP,
+			Endpoint: s.URL + "/v1/traces",
+			Headers:  map[string]string{"X-Api-Key": "secret"},
+		},
+	}}).(*Tracing)
+	assert.NoError(t, tr.ValidateConfig())
+
+	// Continues the trace
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	upstream := traced(tr, parent)
+	tid, sid, sampled, ok := parseTraceparent(upstream)
+	assert.True(t, ok)
+	assert.True(t, sampled)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", hex.EncodeToString(tid[:]))
+	assert.NotEqual(t, "b7ad6b7169203331", hex.EncodeToString(sid[:]))
+
+	// Not sampled
+	ratio := 0.0
+	tr.Update(&Tracing{TracingConfig: TracingConfig{
+		ServiceName: "gateway",
+		SampleRatio: &ratio,
+		Exporter:    tr.Exporter,
+	}})
+	_, _, sampled, ok = parseTraceparent(traced(tr, ""))
+	assert.True(t, ok)
+	assert.False(t, sampled)
+
+	tr.ShutdownGrace(context.Background())
+	mutex.Lock()
+	defer mutex.Unlock()
+	if assert.Len(t, bodies, 1) {
+		assert.True(t, bytes.Contains(bodies[0], []byte("gateway")))
+		assert.True(t, bytes.Contains(bodies[0], []byte("alice")))
+		assert.True(t, bytes.Contains(bodies[0], []byte("armor.casbin.decision")))
+		assert.True(t, bytes.Contains(bodies[0], tid[:]))
+		assert.True(t, bytes.Contains(bodies[0], sid[:]))
+	}
+}
+
+func TestTracingGRPC(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	exported := make(chan []byte, 1)
+	s := grpc.NewServer(grpc.CustomCodec(otlpCodec{}), grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		assert.Equal(t, otlpExportMethod, method)
+		var body []byte
+		if err := stream.RecvMsg(&body); err != nil {
+			return err
+		}
+		exported <- body
+		res := []byte{}
+		return stream.SendMsg(&res)
+	}))
+	go s.Serve(ln)
+	defer s.Stop()
+
+	tr := initialized(&Tracing{TracingConfig: TracingConfig{Exporter: TracingExporter{Endpoint: ln.Addr().String(), Insecure: true}}}).(*Tracing)
+	assert.NoError(t, tr.ValidateConfig())
+	traced(tr, "")
+	tr.ShutdownGrace(context.Background())
+	body := <-exported
+	assert.True(t, bytes.Contains(body, []byte("service.name")))
+	assert.True(t, bytes.Contains(body, []byte("http.response.status_code")))
+}
+
+func TestTracingConfig(t *testing.T) {
+	_, _, _, ok := parseTraceparent("00-00000000000000000000000000000000-b7ad6b7169203331-01")
+	assert.False(t, ok)
+	_, _, _, ok = parseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331")
+	assert.False(t, ok)
+
+	ratio := 2.0
+	assert.Error(t, (&Tracing{TracingConfig: TracingConfig{SampleRatio: &ratio}}).ValidateConfig())
+	assert.Error(t, (&Tracing{TracingConfig: TracingConfig{Exporter: TracingExporter{Protocol: "zipkin"}}}).ValidateConfig())
+	assert.Error(t, (&Tracing{TracingConfig: TracingConfig{Exporter: TracingExporter{Endpoint: "http://collector:4317"}}}).ValidateConfig())
+}
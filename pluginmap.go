@@ -0,0 +1,82 @@
+package armor
+
+import (
+	"sync"
+
+	"github.com/labstack/armor/plugin"
+)
+
+type (
+	// PluginMap indexes plugins by name, safe for concurrent use.
+	PluginMap struct {
+		mutex   sync.RWMutex
+		plugins map[string]plugin.Plugin
+	}
+)
+
+// NewPluginMap returns a map of plugins, the first plugin with a name wins.
+func NewPluginMap(plugins []plugin.Plugin) *PluginMap {
+	m := &PluginMap{plugins: make(map[string]plugin.Plugin, len(plugins))}
+	m.reset(plugins)
+	return m
+}
+
+func (m *PluginMap) reset(plugins []plugin.Plugin) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.plugins = make(map[string]plugin.Plugin, len(plugins))
+	for _, p := range plugins {
+		if _, ok := m.plugins[p.Name()]; !ok {
+			m.plugins[p.Name()] = p
+		}
+	}
+}
+
+// Get returns the plugin with the name.
+func (m *PluginMap) Get(name string) (plugin.Plugin, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	p, ok := m.plugins[name]
+	return p, ok
+}
+
+// Len returns the number of names in the map.
+func (m *PluginMap) Len() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.plugins)
+}
+
+// ByName returns the first plugin in the chain with the name.
+func (pc *PluginChain) ByName(name string) (plugin.Plugin, bool) {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+	if pc.byName == nil {
+		return nil, false
+	}
+	return pc.byName.Get(name)
+}
+
+// Replace replaces the plugin with the name by p, which may have another
+// name, the name index is updated with the plugin list.
+func (pc *PluginChain) Replace(name string, p plugin.Plugin) bool {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	for i, o := range pc.plugins {
+		if o.Name() == name {
+			pc.plugins[i] = p
+			pc.index()
+			return true
+		}
+	}
+	return false
+}
+
+// index rebuilds the name index, the chain must be locked.
+func (pc *PluginChain) index() {
+	if pc.byName == nil {
+		pc.byName = NewPluginMap(pc.plugins)
+		return
+	}
+	pc.byName.reset(pc.plugins)
+}
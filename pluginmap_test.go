@@ -0,0 +1,55 @@
+package armor
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPluginChainByName(t *testing.T) {
+	chain, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": plugin.PluginHeader, "set": map[string]interface{}{"X-Name": "one"}},
+			{"name": plugin.PluginHeader, "set": map[string]interface{}{"X-Name": "two"}},
+			{"name": plugin.PluginRedirect, "from": "/old", "to": "/new"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	p, ok := chain.ByName(plugin.PluginHeader)
+	if assert.True(t, ok) {
+		assert.Equal(t, "one", p.(*plugin.Header).Set["X-Name"])
+	}
+	_, ok = chain.ByName(plugin.PluginGzip)
+	assert.False(t, ok)
+
+	// Concurrent reads
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p, ok := chain.ByName(plugin.PluginRedirect)
+				assert.True(t, ok)
+				assert.Equal(t, plugin.PluginRedirect, p.Name())
+			}
+		}()
+	}
+
+	// Renamed
+	m := Middleware("header-v2", 0)(headerMiddleware("v2"))
+	assert.True(t, chain.Replace(plugin.PluginHeader, m))
+	wg.Wait()
+	p, ok = chain.ByName("header-v2")
+	assert.True(t, ok)
+	assert.Equal(t, m, p)
+	p, ok = chain.ByName(plugin.PluginHeader)
+	if assert.True(t, ok) {
+		assert.Equal(t, "two", p.(*plugin.Header).Set["X-Name"])
+	}
+	assert.False(t, chain.Replace(plugin.PluginGzip, m))
+}
@@ -0,0 +1,14 @@
+package armor
+
+import (
+	"github.com/labstack/armor/plugin"
+)
+
+type (
+	// ConfigProber is implemented by plugins which resolve config values,
+	// e.g. secrets, from an external system before validation. See
+	// `plugin.ProbeConfig` and `plugin.VaultProbe`.
+	ConfigProber interface {
+		ProbeConfig(probe plugin.ProbeFunc) error
+	}
+)
@@ -0,0 +1,182 @@
+package armor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/armor/util"
+)
+
+// PROXY protocol, v1 and v2, of the load balancers passing the client address
+// of the TCP connections.
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+type (
+	proxyListener struct {
+		net.Listener
+		trusted util.IPNets
+		timeout time.Duration
+	}
+
+	// proxyConn reads the header on first use, in the goroutine of the
+	// connection, not to block Accept.
+	proxyConn struct {
+		net.Conn
+		r       *bufio.Reader
+		timeout time.Duration
+		once    sync.Once
+		remote  net.Addr
+		err     error
+	}
+)
+
+const (
+	// Longest v1 header
+	proxyV1MaxLength = 107
+
+	proxyDefaultTimeout = 5
+)
+
+var (
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader  = errors.New("invalid proxy protocol header")
+	errProxyTrusted = errors.New("proxy protocol requires the trusted load balancers")
+)
+
+// wrap returns ln accepting the connections from the trusted addresses with a
+// PROXY protocol header. The trusted addresses are required, the clients
+// connecting directly would set their address otherwise.
+func (p *ProxyProtocol) wrap(ln net.Listener) (net.Listener, error) {
+	if len(p.Trusted) == 0 {
+		return nil, errProxyTrusted
+	}
+	trusted, err := util.ParseIPNets(p.Trusted)
+	if err != nil {
+		return nil, err
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = proxyDefaultTimeout
+	}
+	return &proxyListener{Listener: ln, trusted: trusted, timeout: timeout * time.Second}, nil
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !l.trusted.Contains(addr.IP) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c), timeout: l.timeout}, nil
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address of the header.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the header, the connection is closed if invalid.
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer func() {
+		if c.err != nil {
+			c.Conn.Close()
+			return
+		}
+		c.Conn.SetReadDeadline(time.Time{})
+	}()
+	b, err := c.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		c.err = err
+		return
+	}
+	switch {
+	case bytes.Equal(b, proxyV2Signature):
+		c.remote, c.err = readProxyV2(c.r)
+	case bytes.HasPrefix(b, []byte("PROXY ")):
+		c.remote, c.err = readProxyV1(c.r)
+	default:
+		c.err = errProxyHeader
+	}
+}
+
+// readProxyV1 reads a text header, e.g.
+// `PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n`.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	f := strings.Fields(string(line[:len(line)-2]))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	if h[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch h[12] & 0xf {
+	case 0: // LOCAL, e.g. health checks
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errProxyHeader
+	}
+	switch h[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// Other families keep the address of the connection
+	return nil, nil
+}
@@ -0,0 +1,69 @@
+package armor
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	p := &ProxyProtocol{Trusted: []string{"127.0.0.1"}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ln, err = p.wrap(ln)
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	})}
+	go s.Serve(ln)
+	defer s.Close()
+
+	do := func(header []byte) (string, error) {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		c.Write(header)
+		fmt.Fprint(c, "GET / HTTP/1.1\r\nHost: armor\r\nConnection: close\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		b := make([]byte, 64)
+		n, _ := res.Body.Read(b)
+		return string(b[:n]), nil
+	}
+
+	// v1
+	addr, err := do([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1:56324", addr)
+	}
+
+	// v2
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, 0x21, 0x21, 0, 36)
+	h = append(h, net.ParseIP("2001:db8::1")...)
+	h = append(h, net.ParseIP("2001:db8::2")...)
+	h = append(h, 0x20, 0xfb, 0x01, 0xbb)
+	addr, err = do(h)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "[2001:db8::1]:8443", addr)
+	}
+
+	// Required from the trusted addresses, which are required
+	_, err = do(nil)
+	assert.Error(t, err)
+	_, err = (&ProxyProtocol{}).wrap(ln)
+	assert.Equal(t, errProxyTrusted, err)
+}
@@ -0,0 +1,347 @@
+package armor
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+)
+
+// mounting is the middleware of a mounted plugin, nil once unmounted.
+type mounting struct {
+	mutex      sync.RWMutex
+	middleware echo.MiddlewareFunc
+}
+
+// mounted holds the mountings of the mounted plugins. The middleware of a
+// plugin removed by a reload stays registered on echo and passes through, the
+// plugin itself is dropped.
+var mounted sync.Map
+
+// mount returns the middleware of p registered on echo.
+func mount(p plugin.Plugin) echo.MiddlewareFunc {
+	mg := &mounting{middleware: plugin.Activate(p)}
+	mounted.Store(p, mg)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			mg.mutex.RLock()
+			m := mg.middleware
+			mg.mutex.RUnlock()
+			if m == nil {
+				return next(c)
+			}
+			return m(next)(c)
+		}
+	}
+}
+
+// unmount removes the middleware of p and releases its resources.
+func unmount(p plugin.Plugin) {
+	if mg, ok := mounted.Load(p); ok {
+		mounted.Delete(p)
+		mg := mg.(*mounting)
+		mg.mutex.Lock()
+		mg.middleware = nil
+		mg.mutex.Unlock()
+	}
+	release(p)
+}
+
+// release releases the resources of p, e.g. a plugin decoded to update
+// another one.
+func release(p plugin.Plugin) {
+	if s, ok := p.(Shutdowner); ok {
+		s.ShutdownGrace(context.Background())
+	}
+}
+
+// Reload applies config, the armor config parsed anew, to the running armor
+// without dropping connections: plugins with a changed config are updated,
+// new plugins, hosts and paths added and removed ones unmounted. Nothing is
+// applied if a plugin fails to build. Changes of the listeners, e.g. the
+// address or TLS, require a restart and are logged.
+func (a *Armor) Reload(config *Armor) error {
+	errs := Errors{}
+	global := a.buildPlugins(config.RawPlugins, errs.add)
+	hosts := map[string][]plugin.Plugin{}
+	paths := map[string]map[string][]plugin.Plugin{}
+	for hn, h := range config.Hosts {
+		if h.TLS != nil {
+			if err := h.TLS.apply(new(tls.Config)); err != nil {
+				errs.add(fmt.Errorf("host=%s, %v", hn, err))
+			}
+		}
+		hosts[hn] = a.buildPlugins(h.RawPlugins, errs.add)
+		paths[hn] = map[string][]plugin.Plugin{}
+		for pn, p := range h.Paths {
+			paths[hn][pn] = a.buildPlugins(p.RawPlugins, errs.add)
+		}
+	}
+	if err := config.ValidateErrorPages(); err != nil {
+		errs.add(err)
+	}
+	if len(errs) > 0 {
+		for _, p := range allOf(global, hosts, paths) {
+			release(p)
+		}
+		return errs
+	}
+	for _, s := range a.restartRequired(config) {
+		a.Logger.Warnf("reload: %s changed, restart to apply", s)
+	}
+
+	// Global
+	a.mutex.RLock()
+	current := append([]plugin.Plugin(nil), a.Plugins...)
+	a.mutex.RUnlock()
+	added, removed := reloadPlugins(current, global)
+	a.mutex.Lock()
+	a.RawPlugins = config.RawPlugins
+	a.Plugins = without(a.Plugins, removed)
+	a.ErrorPages = config.ErrorPages
+	a.mutex.Unlock()
+	a.errorTemplates.reset()
+	for _, p := range added {
+		a.AddPlugin(p)
+	}
+
+	// Hosts
+	names := make([]string, 0, len(config.Hosts))
+	for hn := range config.Hosts {
+		names = append(names, hn)
+	}
+	sort.Strings(names)
+	for _, hn := range names {
+		nh := config.Hosts[hn]
+		h := a.FindHost(hn, true)
+		h.mutex.Lock()
+		if h.CertFile != nh.CertFile || h.KeyFile != nh.KeyFile {
+			if h.CertFile != "" || h.KeyFile != "" {
+				a.Logger.Warnf("reload: host=%s certificate changed, restart to apply", hn)
+			}
+			h.CertFile, h.KeyFile = nh.CertFile, nh.KeyFile
+		}
+		if !reflect.DeepEqual(h.ClientCAs, nh.ClientCAs) || !reflect.DeepEqual(h.TLS, nh.TLS) {
+			h.ClientCAs, h.TLS, h.TLSConfig = nh.ClientCAs, nh.TLS, nil
+		}
+		h.RawPlugins = nh.RawPlugins
+		h.ErrorPages = nh.ErrorPages
+		current := append([]plugin.Plugin(nil), h.Plugins...)
+		h.mutex.Unlock()
+		added, removed := reloadPlugins(current, hosts[hn])
+		h.mutex.Lock()
+		h.Plugins = without(h.Plugins, removed)
+		h.mutex.Unlock()
+		for _, p := range added {
+			h.AddPlugin(p)
+		}
+
+		// Paths
+		for pn, np := range nh.Paths {
+			p := h.FindPath(pn)
+			p.mutex.Lock()
+			p.RawPlugins = np.RawPlugins
+			current := append([]plugin.Plugin(nil), p.Plugins...)
+			p.mutex.Unlock()
+			added, removed := reloadPlugins(current, paths[hn][pn])
+			p.mutex.Lock()
+			p.Plugins = without(p.Plugins, removed)
+			p.mutex.Unlock()
+			for _, np := range added {
+				p.AddPlugin(np)
+			}
+		}
+		h.mutex.Lock()
+		for pn, p := range h.Paths {
+			if _, ok := nh.Paths[pn]; !ok {
+				p.unmount()
+				delete(h.Paths, pn)
+			}
+		}
+		h.mutex.Unlock()
+	}
+	a.mutex.Lock()
+	for hn, h := range a.Hosts {
+		if _, ok := config.Hosts[hn]; !ok {
+			h.unmount()
+			delete(a.Hosts, hn)
+		}
+	}
+	a.mutex.Unlock()
+
+	if a.Store != nil {
+		a.SavePlugins()
+	}
+	return nil
+}
+
+func (errs *Errors) add(err error) {
+	*errs = append(*errs, err)
+}
+
+// buildPlugins builds the raw plugins of a level, ordered the way
+// `SavePlugins` does.
+func (a *Armor) buildPlugins(raws []plugin.RawPlugin, onError func(error)) []plugin.Plugin {
+	plugins := []plugin.Plugin{}
+	i, j := -50, 0
+	for _, rp := range raws {
+		// Same as a plugin loaded from the store
+		r := plugin.RawPlugin{}
+		if err := json.Unmarshal(rp.JSON(), &r); err != nil {
+			onError(fmt.Errorf("plugin=%v, error=%v", rp["name"], err))
+			continue
+		}
+		if _, ok := prePlugins[rp.Name()]; ok {
+			i++
+			r["order"] = i
+		} else {
+			j++
+			r["order"] = j
+		}
+		p, err := buildPlugin(r, nil, nil, a.Logger)
+		if err != nil {
+			onError(err)
+			continue
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins
+}
+
+// reloadPlugins updates plugins from next, matching the plugins by name in
+// order. It returns the plugins of next without a match, to add, and the
+// plugins without a match in next, unmounted.
+func reloadPlugins(plugins, next []plugin.Plugin) (added, removed []plugin.Plugin) {
+	pending := map[string][]plugin.Plugin{}
+	for _, p := range plugins {
+		pending[p.Name()] = append(pending[p.Name()], p)
+	}
+	for _, np := range next {
+		ps := pending[np.Name()]
+		if len(ps) == 0 {
+			added = append(added, np)
+			continue
+		}
+		p := ps[0]
+		pending[np.Name()] = ps[1:]
+		// The plugin keeps its order
+		rp := plugin.RawConfig(np)
+		if rp != nil {
+			rp["order"] = p.Order()
+		}
+		plugin.Update(p, np)
+		release(np)
+	}
+	for _, ps := range pending {
+		for _, p := range ps {
+			unmount(p)
+			removed = append(removed, p)
+		}
+	}
+	return
+}
+
+// without returns plugins without the removed ones.
+func without(plugins, removed []plugin.Plugin) []plugin.Plugin {
+	ps := []plugin.Plugin{}
+	for _, p := range plugins {
+		keep := true
+		for _, r := range removed {
+			keep = keep && p != r
+		}
+		if keep {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+func allOf(global []plugin.Plugin, hosts map[string][]plugin.Plugin, paths map[string]map[string][]plugin.Plugin) []plugin.Plugin {
+	all := append([]plugin.Plugin(nil), global...)
+	for hn, ps := range hosts {
+		all = append(all, ps...)
+		for _, ps := range paths[hn] {
+			all = append(all, ps...)
+		}
+	}
+	return all
+}
+
+func (h *Host) unmount() {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, p := range h.Plugins {
+		unmount(p)
+	}
+	for _, p := range h.Paths {
+		p.unmount()
+	}
+}
+
+func (p *Path) unmount() {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, p := range p.Plugins {
+		unmount(p)
+	}
+}
+
+// restartRequired returns the settings of config which differ from the
+// running ones and only apply on restart.
+func (a *Armor) restartRequired(config *Armor) []string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	changed := []string{}
+	tls := func(t *TLS) *TLS {
+		if t == nil {
+			return nil
+		}
+		c := *t
+		_, c.Port, _ = net.SplitHostPort(c.Address)
+		return &c
+	}
+	admin := func(a *Admin) []string {
+		if a == nil {
+			return nil
+		}
+		return []string{a.Address, a.AuthToken}
+	}
+	cluster := func(c *Cluster) []string {
+		if c == nil {
+			return nil
+		}
+		return append([]string{c.Address}, c.Peers...)
+	}
+	for _, s := range []struct {
+		name           string
+		running, value interface{}
+	}{
+		{"address", a.Address, config.Address},
+		{"h2c", a.H2C, config.H2C},
+		{"proxy_protocol", a.ProxyProtocol, config.ProxyProtocol},
+		{"read_timeout", a.ReadTimeout, config.ReadTimeout},
+		{"write_timeout", a.WriteTimeout, config.WriteTimeout},
+		{"read_header_timeout", a.ReadHeaderTimeout, config.ReadHeaderTimeout},
+		{"idle_timeout", a.IdleTimeout, config.IdleTimeout},
+		{"max_header_bytes", a.MaxHeaderBytes, config.MaxHeaderBytes},
+		{"tls", tls(a.TLS), tls(config.TLS)},
+		{"admin", admin(a.Admin), admin(config.Admin)},
+		{"metrics", a.Metrics, config.Metrics},
+		{"storm", a.Storm, config.Storm},
+		{"postgres", a.Postgres, config.Postgres},
+		{"cluster", cluster(a.Cluster), cluster(config.Cluster)},
+		{"backend", a.Backend, config.Backend},
+	} {
+		if !reflect.DeepEqual(s.running, s.value) {
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,127 @@
+package armor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	a := &Armor{Echo: echo.New(), Hosts: Hosts{}, Port: "8080", TLS: &TLS{Port: "8443"}, Logger: log.New("armor")}
+	parse := func(config string) *Armor {
+		c := new(Armor)
+		assert.NoError(t, yaml.Unmarshal([]byte(config), c))
+		return c
+	}
+	get := func(host, path string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		a.Echo.ServeHTTP(rec, req)
+		return rec.Header()
+	}
+
+	assert.NoError(t, a.Reload(parse(`
+plugins:
+- name: header
+  set:
+    X-Global: "1"
+hosts:
+  example.com:
+    plugins:
+    - name: header
+      set:
+        X-Host: "1"
+  old.example.com:
+    plugins:
+    - name: header
+      set:
+        X-Old: "1"
+`)))
+	assert.Equal(t, "1", get("example.com:8080", "/").Get("X-Global"))
+	assert.Equal(t, "1", get("example.com:8080", "/").Get("X-Host"))
+	assert.Equal(t, "1", get("old.example.com:8080", "/").Get("X-Old"))
+	global, host := a.Plugins[0], a.Hosts["example.com"].Plugins[0]
+
+	// Invalid, nothing applied
+	assert.Error(t, a.Reload(parse(`
+plugins:
+- name: header
+  set:
+    X-Global: "2"
+- name: body-limit
+  limit: invalid
+`)))
+	assert.Equal(t, "1", get("example.com:8080", "/").Get("X-Global"))
+
+	assert.NoError(t, a.Reload(parse(`
+plugins:
+- name: header
+  set:
+    X-Global: "2"
+hosts:
+  example.com:
+    paths:
+      /api:
+        plugins:
+        - name: header
+          set:
+            X-Path: "1"
+`)))
+	header := get("example.com:8080", "/api/users")
+	assert.Equal(t, "2", header.Get("X-Global"))
+	assert.Equal(t, "", header.Get("X-Host"))
+	assert.Equal(t, "1", header.Get("X-Path"))
+	assert.Equal(t, "", get("old.example.com:8080", "/").Get("X-Old"))
+	if assert.Len(t, a.Plugins, 1) {
+		assert.True(t, global == a.Plugins[0], "updated in place")
+	}
+	assert.Empty(t, a.Hosts["example.com"].Plugins)
+	assert.NotContains(t, a.Hosts, "old.example.com")
+	_, ok := mounted.Load(host)
+	assert.False(t, ok, "dropped once unmounted")
+	_, ok = mounted.Load(global)
+	assert.True(t, ok)
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor-watch")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("address: :8080\n"), 0644))
+	reloaded := make(chan struct{}, 1)
+	stop, err := WatchConfig(file, log.New("armor"), func() {
+		reloaded <- struct{}{}
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+
+	// Other files are ignored
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other.yaml"), nil, 0644))
+	select {
+	case <-reloaded:
+		t.Fatal("reloaded on another file")
+	case <-time.After(3 * configWatchDelay):
+	}
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte("address: :8081\n"), 0644))
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reloaded")
+	}
+}
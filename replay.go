@@ -0,0 +1,91 @@
+package armor
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// ReplayPlugin is implemented by plugins which call external services,
+	// e.g. CAS, to process a replayed request without them.
+	ReplayPlugin interface {
+		ProcessReplay(next echo.HandlerFunc) echo.HandlerFunc
+	}
+
+	// ReplayRequest is a logged request to replay, Status is the status it
+	// was originally served with.
+	ReplayRequest struct {
+		Method   string            `json:"method"`
+		Path     string            `json:"path"`
+		Headers  map[string]string `json:"headers"`
+		Username string            `json:"username"`
+		Status   int               `json:"status"`
+	}
+
+	// ReplayResult is the outcome of a replayed request. Plugin is the plugin
+	// which served the request, empty if it passed through the chain.
+	ReplayResult struct {
+		OriginalStatus int    `json:"original_status"`
+		NewStatus      int    `json:"new_status"`
+		Plugin         string `json:"plugin"`
+	}
+)
+
+// Replay runs the requests through the chain offline, e.g. to compare the
+// outcomes of a new policy with the logged ones. Plugins implementing
+// `ReplayPlugin` authenticate the request username directly, requests
+// passing through the chain get a 200.
+func (pc *PluginChain) Replay(requests []ReplayRequest) []ReplayResult {
+	pc.mutex.RLock()
+	plugins := append([]plugin.Plugin(nil), pc.plugins...)
+	pc.mutex.RUnlock()
+	e := echo.New()
+	results := make([]ReplayResult, len(requests))
+	for i, rr := range requests {
+		var last string
+		h := func(c echo.Context) error {
+			last = ""
+			return c.NoContent(http.StatusOK)
+		}
+		for j := len(plugins) - 1; j >= 0; j-- {
+			h = replayPlugin(plugins[j], h, &last)
+		}
+
+		req := httptest.NewRequest(rr.Method, rr.Path, nil)
+		for k, v := range rr.Headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set(plugin.ReplayUserKey, rr.Username)
+		if err := h(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		results[i] = ReplayResult{
+			OriginalStatus: rr.Status,
+			NewStatus:      rec.Code,
+			Plugin:         last,
+		}
+	}
+	return results
+}
+
+// replayPlugin processes p, recording it as the last plugin entered.
+func replayPlugin(p plugin.Plugin, next echo.HandlerFunc, last *string) echo.HandlerFunc {
+	var h echo.HandlerFunc
+	if r, ok := p.(ReplayPlugin); ok {
+		h = r.ProcessReplay(next)
+	} else {
+		h = p.Process(next)
+	}
+	if v, ok := p.(RuntimeValidator); ok {
+		h = validateRuntime(v, h)
+	}
+	return func(c echo.Context) error {
+		*last = p.Name()
+		return h(c)
+	}
+}
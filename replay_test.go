@@ -0,0 +1,58 @@
+package armor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "armor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	policy := filepath.Join(dir, "policy.csv")
+	assert.NoError(t, ioutil.WriteFile(policy, []byte("p, joe, *\n"), 0644))
+	chain := func(policy string) *PluginChain {
+		chain, err := Build(&Config{
+			Plugins: []plugin.RawPlugin{
+				{"name": plugin.PluginCas, "url": "https://cas.labstack.com/cas", "casbin": map[string]interface{}{
+					"model":  "plugin/testdata/casbin_model.conf",
+					"policy": policy,
+				}},
+				{"name": plugin.PluginHeader, "set": map[string]interface{}{"X-Name": "armor"}},
+			},
+		})
+		assert.NoError(t, err)
+		return chain
+	}
+	requests := []ReplayRequest{
+		{Method: http.MethodGet, Path: "/users", Username: "jon"},
+		{Method: http.MethodGet, Path: "/users", Username: "joe"},
+		{Method: http.MethodGet, Path: "/users"},
+	}
+
+	// Original policy, statuses as logged
+	original := chain("plugin/testdata/casbin_policy.csv").Replay(requests)
+	for i, r := range original {
+		requests[i].Status = r.NewStatus
+	}
+	assert.Equal(t, []ReplayResult{
+		{NewStatus: http.StatusOK},
+		{NewStatus: http.StatusForbidden, Plugin: plugin.PluginCas},
+		{NewStatus: http.StatusUnauthorized, Plugin: plugin.PluginCas},
+	}, original)
+
+	// New policy
+	assert.Equal(t, []ReplayResult{
+		{OriginalStatus: http.StatusOK, NewStatus: http.StatusForbidden, Plugin: plugin.PluginCas},
+		{OriginalStatus: http.StatusForbidden, NewStatus: http.StatusOK},
+		{OriginalStatus: http.StatusUnauthorized, NewStatus: http.StatusUnauthorized, Plugin: plugin.PluginCas},
+	}, chain(policy).Replay(requests))
+}
@@ -0,0 +1,41 @@
+package armor
+
+import (
+	"context"
+)
+
+type (
+	// Shutdowner is implemented by plugins which hold background resources,
+	// e.g. goroutines or connections, to release at shutdown. `ShutdownGrace`
+	// returns once the resources are released.
+	Shutdowner interface {
+		ShutdownGrace(ctx context.Context)
+	}
+)
+
+// GracefulShutdown shuts down the plugins implementing `Shutdowner` in reverse
+// order. It returns the context error if ctx is done before all plugins have
+// shut down.
+func (pc *PluginChain) GracefulShutdown(ctx context.Context) error {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+	for i := len(pc.plugins) - 1; i >= 0; i-- {
+		s, ok := pc.plugins[i].(Shutdowner)
+		if !ok {
+			continue
+		}
+		done := make(chan struct{})
+		go func() {
+			s.ShutdownGrace(ctx)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package armor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+type worker struct {
+	plugin.Plugin
+	stop    chan struct{}
+	stopped chan struct{}
+	delay   time.Duration
+}
+
+func newWorker(delay time.Duration) *worker {
+	w := &worker{
+		Plugin:  Middleware("worker", 0)(headerMiddleware("worker")),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		delay:   delay,
+	}
+	go func() {
+		<-w.stop
+		time.Sleep(w.delay)
+		close(w.stopped)
+	}()
+	return w
+}
+
+func (w *worker) ShutdownGrace(ctx context.Context) {
+	close(w.stop)
+	select {
+	case <-w.stopped:
+	case <-ctx.Done():
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	w1, w2 := newWorker(0), newWorker(10*time.Millisecond)
+	chain := &PluginChain{plugins: []plugin.Plugin{
+		w1,
+		Middleware("other", 1)(headerMiddleware("other")),
+		w2,
+	}}
+	assert.NoError(t, chain.GracefulShutdown(context.Background()))
+	for _, w := range []*worker{w1, w2} {
+		select {
+		case <-w.stopped:
+		default:
+			t.Error("worker not stopped")
+		}
+	}
+
+	// Deadline
+	w := newWorker(time.Second)
+	chain = &PluginChain{plugins: []plugin.Plugin{w}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, chain.GracefulShutdown(ctx))
+}
@@ -19,6 +19,13 @@ type (
 		Close() error
 	}
 
+	// Releaser is implemented by the stores opened by a single process, e.g.
+	// the Storm file, released for the process upgraded to.
+	Releaser interface {
+		Release() error
+		Reopen() error
+	}
+
 	Plugin struct {
 		ID        string           `json:"id" db:"id" storm:"id"`
 		Name      string           `json:"name" db:"name"`
@@ -2,6 +2,7 @@ package store
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/asdine/storm/q"
 
@@ -10,28 +11,54 @@ import (
 
 type (
 	Storm struct {
+		mutex sync.RWMutex
 		*storm.DB
+		uri string
 	}
 )
 
 func NewStorm(uri string) (s *Storm, err error) {
-	s = new(Storm)
+	s = &Storm{uri: uri}
 	s.DB, err = storm.Open(uri)
 	return
 }
 
+// Release closes the file, locked by a single process, until Reopen.
+func (s *Storm) Release() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.DB.Close()
+}
+
+func (s *Storm) Reopen() (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	db, err := storm.Open(s.uri)
+	if err != nil {
+		return
+	}
+	s.DB = db
+	return
+}
+
 func (s *Storm) AddPlugin(p *Plugin) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	p.Unique = fmt.Sprintf("%s:%s:%s", p.Name, p.Host, p.Path)
 	return s.Save(p)
 }
 
 func (s *Storm) FindPlugin(id string) (p *Plugin, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	p = new(Plugin)
 	err = s.One("ID", id, p)
 	return
 }
 
 func (s *Storm) FindPlugins() (plugins []*Plugin, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	plugins = []*Plugin{}
 	if err = s.Select().OrderBy("Order").Find(&plugins); err != nil {
 		return
@@ -40,10 +67,14 @@ func (s *Storm) FindPlugins() (plugins []*Plugin, err error) {
 }
 
 func (s *Storm) UpdatePlugin(p *Plugin) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.Update(p)
 }
 
 func (s *Storm) DeleteBySource(source string) (err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	query := s.Select(q.Eq("Source", source))
 	err = query.Delete(new(Plugin))
 	if err != nil && err != storm.ErrNotFound {
@@ -53,5 +84,7 @@ func (s *Storm) DeleteBySource(source string) (err error) {
 }
 
 func (s *Storm) Close() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.DB.Close()
 }
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"fmt"
 	"os"
 )
 
@@ -35,10 +36,17 @@ func (a *Armor) setupTLSConfig() *tls.Config {
 // GetConfigForClient implements the Config.GetClientCertificate callback
 func (a *Armor) GetConfigForClient(clientHelloInfo *tls.ClientHelloInfo) (*tls.Config, error) {
 	// Get the host from the hello info
+	a.mutex.RLock()
 	host := a.Hosts[clientHelloInfo.ServerName]
-	// If the host or the clientCAs are not configured the function
+	a.mutex.RUnlock()
+	// If the host has neither clientCAs nor a TLS policy the function
 	// returns the default TLS configuration
-	if host == nil || len(host.ClientCAs) == 0 {
+	if host == nil {
+		return nil, nil
+	}
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+	if len(host.ClientCAs) == 0 && host.TLS == nil {
 		return nil, nil
 	}
 
@@ -48,21 +56,33 @@ func (a *Armor) GetConfigForClient(clientHelloInfo *tls.ClientHelloInfo) (*tls.C
 	}
 
 	// Build and save the host config
-	host.TLSConfig = a.buildTLSConfig(clientHelloInfo, host)
+	tlsConfig, err := a.buildTLSConfig(clientHelloInfo, host)
+	if err != nil {
+		return nil, err
+	}
+	host.TLSConfig = tlsConfig
 
 	return host.TLSConfig, nil
 }
 
-func (a *Armor) buildTLSConfig(clientHelloInfo *tls.ClientHelloInfo, host *Host) *tls.Config {
+func (a *Armor) buildTLSConfig(clientHelloInfo *tls.ClientHelloInfo, host *Host) (*tls.Config, error) {
 	// Copy the configurations from the regular server
-	tlsConfig := new(tls.Config)
-	*tlsConfig = *a.Echo.TLSServer.TLSConfig
+	tlsConfig := a.Echo.TLSServer.TLSConfig.Clone()
 
 	// Set the client validation and the certification pool
-	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
-	tlsConfig.ClientCAs = a.buildClientCertPool(host)
+	if len(host.ClientCAs) > 0 {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = a.buildClientCertPool(host)
+	}
+
+	// Host policy
+	if host.TLS != nil {
+		if err := host.TLS.apply(tlsConfig); err != nil {
+			return nil, fmt.Errorf("host=%s, %v", host.Name, err)
+		}
+	}
 
-	return tlsConfig
+	return tlsConfig, nil
 }
 
 func (a *Armor) buildClientCertPool(host *Host) (certPool *x509.CertPool) {
@@ -92,3 +112,79 @@ func (a *Armor) buildClientCertPool(host *Host) (certPool *x509.CertPool) {
 
 	return certPool
 }
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	tlsCipherSuites = map[string]uint16{
+		"TLS_RSA_WITH_RC4_128_SHA":                tls.TLS_RSA_WITH_RC4_128_SHA,
+		"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+		"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":        tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_RC4_128_SHA":          tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+		"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	}
+
+	tlsCurves = map[string]tls.CurveID{
+		"X25519": tls.X25519,
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+	}
+)
+
+// apply sets the policy on tlsConfig.
+func (t *HostTLS) apply(tlsConfig *tls.Config) error {
+	if t.MinVersion != "" {
+		v, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return fmt.Errorf("invalid tls min_version=%s", t.MinVersion)
+		}
+		tlsConfig.MinVersion = v
+	}
+	if len(t.CipherSuites) > 0 {
+		tlsConfig.CipherSuites = nil
+		for _, name := range t.CipherSuites {
+			c, ok := tlsCipherSuites[name]
+			if !ok {
+				return fmt.Errorf("invalid tls cipher suite=%s", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, c)
+		}
+	}
+	if len(t.CurvePreferences) > 0 {
+		tlsConfig.CurvePreferences = nil
+		for _, name := range t.CurvePreferences {
+			c, ok := tlsCurves[name]
+			if !ok {
+				return fmt.Errorf("invalid tls curve=%s", name)
+			}
+			tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, c)
+		}
+	}
+	if len(t.ALPN) > 0 {
+		tlsConfig.NextProtos = append([]string(nil), t.ALPN...)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package armor
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetConfigForClient(t *testing.T) {
+	a := &Armor{
+		Echo: echo.New(),
+		TLS:  &TLS{Secured: true},
+		Hosts: Hosts{
+			"legacy.labstack.com": &Host{TLS: &HostTLS{
+				MinVersion:       "1.0",
+				CipherSuites:     []string{"TLS_RSA_WITH_AES_128_CBC_SHA"},
+				CurvePreferences: []string{"P256"},
+				ALPN:             []string{"http/1.1"},
+			}},
+			"modern.labstack.com":  &Host{TLS: &HostTLS{MinVersion: "1.3"}},
+			"invalid.labstack.com": &Host{TLS: &HostTLS{MinVersion: "2.0"}},
+			"labstack.com":         &Host{},
+		},
+	}
+	a.Echo.TLSServer = &http.Server{TLSConfig: a.setupTLSConfig()}
+	a.Echo.TLSServer.TLSConfig.NextProtos = []string{"h2"}
+	config := func(name string) (*tls.Config, error) {
+		return a.GetConfigForClient(&tls.ClientHelloInfo{ServerName: name})
+	}
+
+	c, err := config("legacy.labstack.com")
+	if assert.NoError(t, err) && assert.NotNil(t, c) {
+		assert.Equal(t, uint16(tls.VersionTLS10), c.MinVersion)
+		assert.Equal(t, []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}, c.CipherSuites)
+		assert.Equal(t, []tls.CurveID{tls.CurveP256}, c.CurvePreferences)
+		assert.Equal(t, []string{"http/1.1"}, c.NextProtos)
+		assert.Equal(t, tls.NoClientCert, c.ClientAuth)
+	}
+	c, err = config("modern.labstack.com")
+	if assert.NoError(t, err) && assert.NotNil(t, c) {
+		assert.Equal(t, uint16(tls.VersionTLS13), c.MinVersion)
+		// Global policy
+		assert.Len(t, c.CipherSuites, 6)
+		assert.Equal(t, []string{"h2"}, c.NextProtos)
+	}
+	_, err = config("invalid.labstack.com")
+	assert.Error(t, err)
+	c, err = config("labstack.com")
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	// The global config stays unchanged
+	assert.Equal(t, uint16(tls.VersionTLS12), a.Echo.TLSServer.TLSConfig.MinVersion)
+}
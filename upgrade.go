@@ -0,0 +1,365 @@
+package armor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/armor/store"
+)
+
+// Zero downtime upgrades: Upgrade starts a new armor process, of the same
+// executable and arguments, passing it the open listeners. The new process
+// listens on the inherited ones, then asks the old one, see Ready, to stop
+// accepting connections and exit once the requests in flight are served.
+
+type (
+	// listenerSet is the listeners of an armor process, by address.
+	listenerSet struct {
+		mutex sync.Mutex
+		open  map[string]*listener
+	}
+
+	// listener accepts TCP keep-alive connections until paused, the
+	// connections are then left to the other processes on the address.
+	listener struct {
+		*net.TCPListener
+		paused int32
+		once   sync.Once
+		closed chan struct{}
+	}
+)
+
+const (
+	// listenersEnv is the inherited listeners, `address=fd` separated by
+	// commas, and parentEnv the pid of the process upgraded from.
+	listenersEnv = "ARMOR_LISTENERS"
+	parentEnv    = "ARMOR_PARENT_PID"
+)
+
+var (
+	inherited struct {
+		once   sync.Once
+		mutex  sync.Mutex
+		files  map[string]*os.File
+		parent int
+	}
+
+	errUpgradeUnsupported = errors.New("upgrade is not supported on this platform")
+)
+
+// shutdownDelay lets the connections accepted before a shutdown send their
+// first request, dropped once the server is shutting down.
+const shutdownDelay = 500 * time.Millisecond
+
+// inheritListeners parses the listeners of env, the files are closed once
+// listened on.
+func inheritListeners(env string) map[string]*os.File {
+	files := map[string]*os.File{}
+	for _, l := range strings.Split(env, ",") {
+		i := strings.LastIndex(l, "=")
+		if i < 0 {
+			continue
+		}
+		fd, err := strconv.Atoi(l[i+1:])
+		if err != nil {
+			continue
+		}
+		files[l[:i]] = os.NewFile(uintptr(fd), l[:i])
+	}
+	return files
+}
+
+func initInherited() {
+	inherited.once.Do(func() {
+		inherited.files = inheritListeners(os.Getenv(listenersEnv))
+		inherited.parent, _ = strconv.Atoi(os.Getenv(parentEnv))
+		os.Unsetenv(listenersEnv)
+		os.Unsetenv(parentEnv)
+	})
+}
+
+// inheritedFile returns the inherited listener on address, nil if none.
+func inheritedFile(address string) *os.File {
+	initInherited()
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+	f := inherited.files[address]
+	delete(inherited.files, address)
+	return f
+}
+
+// upgradedFrom returns the pid of the process upgraded from, 0 if not
+// upgraded.
+func upgradedFrom() int {
+	initInherited()
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+	return inherited.parent
+}
+
+func (s *listenerSet) listen(address string, reusePort bool) (*listener, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var (
+		ln  net.Listener
+		err error
+	)
+	if f := inheritedFile(address); f != nil {
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		lc := net.ListenConfig{}
+		if reusePort {
+			lc.Control = reusePortControl
+		}
+		ln, err = lc.Listen(context.Background(), "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return nil, fmt.Errorf("address=%s, not a TCP listener", address)
+	}
+	l := &listener{TCPListener: tl, closed: make(chan struct{})}
+	if s.open == nil {
+		s.open = map[string]*listener{}
+	}
+	s.open[address] = l
+	return l, nil
+}
+
+// pause stops the listeners from accepting connections.
+func (s *listenerSet) pause() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, l := range s.open {
+		atomic.StoreInt32(&l.paused, 1)
+		// Interrupts Accept
+		l.SetDeadline(time.Now())
+	}
+}
+
+// files returns the addresses and copies of the open listeners.
+func (s *listenerSet) files() ([]string, []*os.File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	addresses := make([]string, 0, len(s.open))
+	for address := range s.open {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	files := make([]*os.File, 0, len(addresses))
+	for _, address := range addresses {
+		f, err := s.open[address].File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, fmt.Errorf("address=%s, %v", address, err)
+		}
+		files = append(files, f)
+	}
+	return addresses, files, nil
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		if atomic.LoadInt32(&l.paused) == 1 {
+			<-l.closed
+		}
+		return nil, err
+	}
+	c.SetKeepAlive(true)
+	c.SetKeepAlivePeriod(3 * time.Minute)
+	return c, nil
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return l.TCPListener.Close()
+}
+
+// Listen returns a TCP listener on address, the one inherited from the
+// process upgraded from if any. With `ReusePort`, other processes can listen
+// on address too.
+func (a *Armor) Listen(address string) (net.Listener, error) {
+	ln, err := a.listeners.listen(address, a.ReusePort)
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Upgrade starts a new armor process, of the current executable and
+// arguments, on the listeners of a. The new process shuts a down once
+// serving, a keeps serving if the new process fails to start. A store of a
+// single process is released meanwhile, reopened if the new process exits.
+func (a *Armor) Upgrade() (pid int, err error) {
+	if !upgradeSupported {
+		return 0, errUpgradeUnsupported
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	addresses, files, err := a.listeners.files()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	listeners := make([]string, len(addresses))
+	for i, address := range addresses {
+		// The extra files start after stderr
+		listeners[i] = address + "=" + strconv.Itoa(3+i)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, listenersEnv+"=") && !strings.HasPrefix(env, parentEnv+"=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		listenersEnv+"="+strings.Join(listeners, ","),
+		parentEnv+"="+strconv.Itoa(os.Getpid()),
+	)
+	releaser, _ := a.Store.(store.Releaser)
+	if releaser != nil {
+		if err = releaser.Release(); err != nil {
+			return 0, err
+		}
+	}
+	reopen := func() {
+		if releaser != nil {
+			if err := releaser.Reopen(); err != nil {
+				a.Logger.Errorf("upgrade: failed to reopen the store, %v", err)
+			}
+		}
+	}
+	if err = cmd.Start(); err != nil {
+		reopen()
+		return 0, err
+	}
+	go func() {
+		err := cmd.Wait()
+		a.Logger.Errorf("upgrade: process=%d exited, %v", cmd.Process.Pid, err)
+		reopen()
+	}()
+	return cmd.Process.Pid, nil
+}
+
+// Ready asks the process upgraded from, if any, to shut down. It is called
+// once the plugins are loaded and the servers started.
+func (a *Armor) Ready() error {
+	pid := upgradedFrom()
+	// Not to signal another process if the parent is gone
+	if pid == 0 || pid != os.Getppid() {
+		return nil
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(syscall.SIGTERM)
+}
+
+// Shutdown leaves the cluster, stops the servers from accepting connections
+// and waits for the requests in flight to be served, then shuts down the
+// plugins, until ctx is done.
+func (a *Armor) Shutdown(ctx context.Context) error {
+	if a.Cluster != nil && a.Cluster.Serf != nil {
+		// Frees the address for the process upgraded to
+		a.Cluster.Leave()
+		a.Cluster.Serf.Shutdown()
+	}
+	servers := []*http.Server{a.Echo.Server, a.Echo.TLSServer}
+	a.listeners.pause()
+	for _, s := range servers {
+		s.SetKeepAlivesEnabled(false)
+	}
+	select {
+	case <-time.After(shutdownDelay):
+	case <-ctx.Done():
+	}
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *http.Server) {
+			errs <- s.Shutdown(ctx)
+		}(s)
+	}
+	var err error
+	for range servers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if e := a.shutdownPlugins(ctx); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// shutdownPlugins shuts down the global, host and path plugins.
+func (a *Armor) shutdownPlugins(ctx context.Context) error {
+	a.mutex.RLock()
+	plugins := append([]plugin.Plugin(nil), a.Plugins...)
+	for _, h := range a.Hosts {
+		h.mutex.RLock()
+		plugins = append(plugins, h.Plugins...)
+		for _, p := range h.Paths {
+			p.mutex.RLock()
+			plugins = append(plugins, p.Plugins...)
+			p.mutex.RUnlock()
+		}
+		h.mutex.RUnlock()
+	}
+	a.mutex.RUnlock()
+	return (&PluginChain{plugins: plugins}).GracefulShutdown(ctx)
+}
+
+// AwaitShutdown blocks until SIGTERM or SIGINT, then shuts down a within
+// timeout. SIGUSR2 upgrades a, where supported.
+func (a *Armor) AwaitShutdown(timeout time.Duration) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, append([]os.Signal{syscall.SIGTERM, os.Interrupt}, upgradeSignals...)...)
+	defer signal.Stop(sig)
+	for s := range sig {
+		if s == syscall.SIGTERM || s == os.Interrupt {
+			a.Logger.Infof("shutdown: %v received, draining the connections", s)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			return a.Shutdown(ctx)
+		}
+		a.Logger.Infof("upgrade: %v received", s)
+		if pid, err := a.Upgrade(); err != nil {
+			a.Logger.Errorf("upgrade: %v", err)
+		} else {
+			a.Logger.Infof("upgrade: started process=%d", pid)
+		}
+	}
+	return nil
+}
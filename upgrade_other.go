@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package armor
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const upgradeSupported = false
+
+var upgradeSignals []os.Signal
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("reuse_port is not supported on this platform")
+}
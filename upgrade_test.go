@@ -0,0 +1,82 @@
+package armor
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	a := &Armor{Logger: log.New("armor"), Hosts: Hosts{}}
+	a.NewHTTP()
+	entered, release := make(chan struct{}), make(chan struct{})
+	a.Echo.GET("/", func(c echo.Context) error {
+		close(entered)
+		<-release
+		return c.String(http.StatusOK, "OK")
+	})
+	w := newWorker(0)
+	a.Plugins = []plugin.Plugin{w}
+	ln, err := a.Listen("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	a.Echo.Listener = ln
+	go a.Echo.StartServer(a.Echo.Server)
+	address := ln.Addr().String()
+
+	body := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://" + address + "/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		body <- string(b)
+	}()
+	<-entered
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Shutdown(context.Background())
+	}()
+
+	// No new connections while draining
+	assert.Eventually(t, func() bool {
+		c, err := net.Dial("tcp", address)
+		if err == nil {
+			c.Close()
+		}
+		return err != nil
+	}, 2*time.Second, 10*time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("shut down with a request in flight")
+	default:
+	}
+	close(release)
+	assert.Equal(t, "OK", <-body)
+	assert.NoError(t, <-done)
+	select {
+	case <-w.stopped:
+	default:
+		t.Error("plugin not shut down")
+	}
+
+	// Deadline
+	a = &Armor{Logger: log.New("armor"), Hosts: Hosts{}}
+	a.NewHTTP()
+	a.Plugins = []plugin.Plugin{newWorker(time.Second)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, a.Shutdown(ctx))
+}
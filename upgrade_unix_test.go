@@ -0,0 +1,62 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package armor
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenInherited(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := ln.(*net.TCPListener).File()
+	ln.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Owned by the inherited files
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+	address := ln.Addr().String()
+	initInherited()
+	inherited.mutex.Lock()
+	inherited.files = inheritListeners(fmt.Sprintf("%s=%d,invalid", address, fd))
+	inherited.mutex.Unlock()
+
+	a := new(Armor)
+	l, err := a.Listen(address)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	assert.Equal(t, address, l.Addr().String())
+	assert.Nil(t, inheritedFile(address))
+	go func() {
+		if c, err := net.Dial("tcp", address); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := l.Accept()
+	if assert.NoError(t, err) {
+		c.Close()
+	}
+
+	addresses, files, err := a.listeners.files()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{address}, addresses)
+		for _, f := range files {
+			f.Close()
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"fmt"
 	"net"
 	"strings"
 
@@ -45,3 +46,41 @@ func PrivateIP() string {
 	}
 	return ""
 }
+
+// IPNets is a list of networks.
+type IPNets []*net.IPNet
+
+// ParseIPNets parses CIDRs, e.g. `10.0.0.0/8`, or IPs as single host networks.
+func ParseIPNets(list []string) (IPNets, error) {
+	nets := make(IPNets, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip=%s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Contains reports whether ip is in one of the networks.
+func (n IPNets) Contains(ip net.IP) bool {
+	for _, ipNet := range n {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
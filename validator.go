@@ -0,0 +1,29 @@
+package armor
+
+import (
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// ConfigValidator is implemented by plugins which check their decoded
+	// config before `Initialize`.
+	ConfigValidator interface {
+		ValidateConfig() error
+	}
+
+	// RuntimeValidator is implemented by plugins which check per request
+	// preconditions, e.g. context values set by an earlier plugin.
+	RuntimeValidator interface {
+		ValidateRuntime(echo.Context) error
+	}
+)
+
+// validateRuntime runs the runtime validation of v before next.
+func validateRuntime(v RuntimeValidator, next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := v.ValidateRuntime(c); err != nil {
+			return err
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,66 @@
+package armor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type requireUser struct {
+	plugin.Plugin
+}
+
+func (*requireUser) ValidateRuntime(c echo.Context) error {
+	if c.Get("user") == nil {
+		return echo.ErrUnauthorized
+	}
+	return nil
+}
+
+func TestValidateConfig(t *testing.T) {
+	_, err := Build(&Config{
+		Plugins: []plugin.RawPlugin{
+			{"name": "cas", "url": "cas.example.com"},
+			{"name": plugin.PluginBodyInspect, "rules": []interface{}{
+				map[string]interface{}{"json_path": "a", "action": "drop"},
+			}},
+			{"name": plugin.PluginProxy},
+		},
+	})
+	if assert.IsType(t, Errors{}, err) {
+		assert.Len(t, err.(Errors), 3)
+	}
+}
+
+func TestValidateRuntime(t *testing.T) {
+	e := echo.New()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}
+	setUser := Middleware("user", 1)(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.QueryParam("user") != "" {
+				c.Set("user", c.QueryParam("user"))
+			}
+			return next(c)
+		}
+	})
+	chain := &PluginChain{plugins: []plugin.Plugin{
+		setUser,
+		&requireUser{Middleware("require-user", 2)(headerMiddleware("user"))},
+	}}
+
+	req := httptest.NewRequest(echo.GET, "/?user=jon", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, chain.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, "user", rec.Header().Get("X-Middleware"))
+
+	req = httptest.NewRequest(echo.GET, "/", nil)
+	rec = httptest.NewRecorder()
+	assert.Equal(t, echo.ErrUnauthorized, chain.Process(ok)(e.NewContext(req, rec)))
+	assert.Equal(t, "", rec.Header().Get("X-Middleware"))
+}
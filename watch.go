@@ -0,0 +1,82 @@
+package armor
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/labstack/gommon/log"
+)
+
+// configWatchDelay coalesces the events of a single save, e.g. truncate and
+// write.
+const configWatchDelay = 100 * time.Millisecond
+
+// WatchConfig calls reload on SIGHUP and when file, if set, changes. The
+// directory of file is watched, editors and Kubernetes config maps replace
+// the file. Watching stops with stop.
+func WatchConfig(file string, logger *log.Logger, reload func()) (stop func(), err error) {
+	var (
+		fsw    *fsnotify.Watcher
+		events chan fsnotify.Event
+		errs   chan error
+		last   os.FileInfo
+	)
+	if file != "" {
+		if file, err = filepath.Abs(file); err != nil {
+			return nil, err
+		}
+		if fsw, err = fsnotify.NewWatcher(); err != nil {
+			return nil, err
+		}
+		if err = fsw.Add(filepath.Dir(file)); err != nil {
+			fsw.Close()
+			return nil, err
+		}
+		events, errs = fsw.Events, fsw.Errors
+		last, _ = os.Stat(file)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done, stopped := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		defer signal.Stop(hup)
+		if fsw != nil {
+			defer fsw.Close()
+		}
+		var pending <-chan time.Time
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+				logger.Info("reload: SIGHUP received")
+				reload()
+			case <-events:
+				pending = time.After(configWatchDelay)
+			case err := <-errs:
+				logger.Errorf("reload: watch error: %v", err)
+			case <-pending:
+				pending = nil
+				fi, err := os.Stat(file)
+				if err != nil {
+					continue
+				}
+				if last == nil || !fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size() {
+					last = fi
+					logger.Infof("reload: %s changed", file)
+					reload()
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}, nil
+}
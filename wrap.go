@@ -0,0 +1,42 @@
+package armor
+
+import (
+	"errors"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// RouteFilter returns the plugin chain for a route, nil to use the default
+	// chain.
+	RouteFilter func(method, path string) *PluginChain
+)
+
+// WrapEcho adds the plugin chain in front of every handler registered on e.
+// Filters are consulted in order for each registered route and the first
+// non-nil chain replaces the default one for that route. Routes added after
+// WrapEcho use the default chain.
+func WrapEcho(e *echo.Echo, chain *PluginChain, filters ...RouteFilter) error {
+	if chain == nil {
+		return errors.New("armor: plugin chain is required")
+	}
+	routes := map[string]*PluginChain{}
+	for _, r := range e.Routes() {
+		for _, f := range filters {
+			if pc := f(r.Method, r.Path); pc != nil {
+				routes[r.Method+r.Path] = pc
+				break
+			}
+		}
+	}
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			pc, ok := routes[c.Request().Method+c.Path()]
+			if !ok {
+				pc = chain
+			}
+			return pc.Process(next)(c)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,44 @@
+package armor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/armor/plugin"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapEcho(t *testing.T) {
+	e := echo.New()
+	handler := func(c echo.Context) error {
+		return c.String(http.StatusOK, c.Response().Header().Get("X-Middleware"))
+	}
+	e.GET("/", handler)
+	e.GET("/admin", handler)
+
+	chain := &PluginChain{plugins: []plugin.Plugin{
+		Middleware("default", 1)(headerMiddleware("default")),
+	}}
+	admin := &PluginChain{plugins: []plugin.Plugin{
+		Middleware("admin", 1)(headerMiddleware("admin")),
+	}}
+	assert.Error(t, WrapEcho(e, nil))
+	assert.NoError(t, WrapEcho(e, chain, func(method, path string) *PluginChain {
+		if path == "/admin" {
+			return admin
+		}
+		return nil
+	}))
+
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, "default", rec.Body.String())
+
+	req = httptest.NewRequest(echo.GET, "/admin", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, "admin", rec.Body.String())
+}